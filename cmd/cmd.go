@@ -53,6 +53,11 @@ func Main(embeddedWebsite fs.FS) {
 
 	flag.Parse()
 
+	// headless commands have their own flags, and exit codes for scripts
+	if _, ok := headlessCommands[flag.Arg(0)]; ok {
+		os.Exit(runHeadless(ctx, app, flag.Arg(0), flag.Args()[1:]))
+	}
+
 	// implement standard (CLI-only) flags
 	subCommand, subCommandFunc := getStandardSubcommand(app)
 	if subCommandFunc != nil {
@@ -137,14 +142,10 @@ func openWebBrowser(loc string) error {
 // Gets CLI-only commands.
 func getStandardSubcommand(app *tlzapp.App) (string, func() error) {
 	standardCommands := map[string]func() error{
-		"serve": func() error {
-			if err := app.MustServe(); err != nil {
-				return err
-			}
-			select {}
-		},
 		"help": func() error { //nolint:unparam // bug filed: https://github.com/mvdan/unparam/issues/82
 			fmt.Println(app.CommandLineHelp())
+			fmt.Println()
+			fmt.Print(headlessHelp)
 			return nil
 		},
 		"version": func() error {
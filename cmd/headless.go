@@ -0,0 +1,728 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlcmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/timelinize/timelinize/timeline"
+	"github.com/timelinize/timelinize/tlzapp"
+)
+
+// headlessCommands are the commands for using timelines without the web UI,
+// as on a NAS or in scripts. Unlike the standard commands, they take their
+// own flags after the command name. They go through the API, so they work
+// the same whether or not the server is running in another process; if it
+// isn't, jobs run in this process until they end.
+var headlessCommands = map[string]func(context.Context, *tlzapp.App, []string) error{
+	"api":    cmdAPI,
+	"export": cmdExport,
+	"import": cmdImport,
+	"jobs":   cmdJobs,
+	"search": cmdSearch,
+	"serve":  cmdServe,
+}
+
+const headlessHelp = `Headless Commands:
+  (flags go before arguments; -repo is a timeline's ID or folder, and may be
+  omitted if only one timeline is open; -json prints JSON for scripting)
+
+  import [-repo] [-json] [-detach] [-options] [-integrity] [-overwrite] [-estimate-total] [-preview] <data source> <path>...
+  export [-repo] [-json] [-detach] [-format] [-start] [-end] [-source] [-skip-data-files] <path>
+  search [-repo] [-json] [-limit] [-offset] [-explain] <query>
+  jobs list [-repo] [-json] [-n]
+  jobs cancel [-repo] <job ID>...
+  jobs resume [-repo] [-json] [-detach] <job ID>
+  jobs wait [-repo] [-json] <job ID>
+  serve [-api-only]
+  api <command> [args...]    (runs one of the commands below: import, export, search, and jobs are API commands too)
+
+  Commands that run a job wait for it to end, unless -detach is given, and
+  exit with a status that reflects how it ended: 0 succeeded, 3 failed,
+  4 aborted, 5 interrupted (it may be resumed). Other errors exit with 1,
+  and incorrect usage with 2.
+`
+
+// Exit codes of the headless commands.
+const (
+	exitError          = 1 // the command failed
+	exitUsage          = 2 // the command was used incorrectly (as with the flag package)
+	exitJobFailed      = 3
+	exitJobAborted     = 4
+	exitJobInterrupted = 5 // the job may be resumed
+)
+
+// exitCodeError is an error that exits the program with a specific status.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e exitCodeError) Error() string { return e.err.Error() }
+func (e exitCodeError) Unwrap() error { return e.err }
+
+// runHeadless runs the headless command and returns the status to exit with.
+func runHeadless(ctx context.Context, app *tlzapp.App, command string, args []string) int {
+	err := headlessCommands[command](ctx, app, args)
+	if err == nil {
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+	var exitErr exitCodeError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return exitError
+}
+
+// headlessFlags is a flag set with the flags that most headless commands have.
+type headlessFlags struct {
+	*flag.FlagSet
+	repo string
+	json bool
+}
+
+func newHeadlessFlags(name, usage, description string) *headlessFlags {
+	fs := &headlessFlags{FlagSet: flag.NewFlagSet(name, flag.ExitOnError)}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: timelinize %s %s\n\n%s\n\nFlags:\n", name, usage, description)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&fs.repo, "repo", "", "the ID or folder of the timeline (default: the only open timeline)")
+	fs.BoolVar(&fs.json, "json", false, "print JSON instead of text")
+	return fs
+}
+
+// usageError prints the usage of the command and returns an error that
+// exits with the usage status.
+func (fs *headlessFlags) usageError(msg string) error {
+	fs.Usage()
+	return exitCodeError{exitUsage, errors.New(msg)}
+}
+
+// resolveRepo returns the ID of the timeline the user specified: the open
+// timeline with the given ID or folder, or the timeline in the folder,
+// which it opens, or the only open timeline if none was specified.
+func resolveRepo(ctx context.Context, app *tlzapp.App, repo string) (string, error) {
+	type openRepo struct {
+		RepoDir    string `json:"repo_dir"`
+		InstanceID string `json:"instance_id"`
+	}
+	var open []openRepo
+	if err := app.Call(ctx, "open-repositories", nil, &open); err != nil {
+		return "", fmt.Errorf("listing open timelines: %w", err)
+	}
+
+	if repo == "" {
+		switch len(open) {
+		case 0:
+			return "", errors.New("no timeline is open; specify one with -repo")
+		case 1:
+			return open[0].InstanceID, nil
+		default:
+			return "", fmt.Errorf("%d timelines are open; specify one with -repo", len(open))
+		}
+	}
+
+	absRepo, err := filepath.Abs(repo)
+	if err != nil {
+		return "", err
+	}
+	for _, otl := range open {
+		if otl.InstanceID == repo || otl.RepoDir == absRepo {
+			return otl.InstanceID, nil
+		}
+	}
+
+	if info, err := os.Stat(absRepo); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("no open timeline has the ID or folder %s", repo)
+	}
+	var opened openRepo
+	if err := app.Call(ctx, "open-repository", map[string]any{"repo_path": absRepo}, &opened); err != nil {
+		return "", fmt.Errorf("opening timeline: %w", err)
+	}
+	return opened.InstanceID, nil
+}
+
+// startedJob reports a job that the command started: if detach is true, it
+// prints the job's ID; otherwise it waits for the job to end.
+func startedJob(ctx context.Context, app *tlzapp.App, fs *headlessFlags, repoID string, jobID uint64, detach bool) error {
+	if detach {
+		if fs.json {
+			return printJSON(map[string]any{"repo_id": repoID, "job_id": jobID})
+		}
+		fmt.Println(jobID)
+		return nil
+	}
+	return waitForJob(ctx, app, fs, repoID, jobID)
+}
+
+// checkDetach returns an error if the command can't detach from its job,
+// which is the case if the server isn't running: the job runs in this
+// process, so it would stop when the command exits.
+func checkDetach(app *tlzapp.App, detach bool) error {
+	if detach && !app.ServerRunning() {
+		return errors.New("-detach requires the server to be running (timelinize serve); otherwise, the job stops when this command exits")
+	}
+	return nil
+}
+
+// waitForJob waits for the job to end, printing its progress to stderr, and
+// then prints it; it returns an error with the exit code for how the job
+// ended if it didn't succeed.
+func waitForJob(ctx context.Context, app *tlzapp.App, fs *headlessFlags, repoID string, jobID uint64) error {
+	job, err := awaitJob(ctx, app, repoID, jobID)
+	if fs.json && job.ID != 0 {
+		if err := printJSON(job); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// awaitJob is like waitForJob, but returns the job instead of printing it.
+func awaitJob(ctx context.Context, app *tlzapp.App, repoID string, jobID uint64) (timeline.Job, error) {
+	const pollInterval = time.Second
+
+	var lastStatus string
+	for {
+		var jobs []timeline.Job
+		err := app.Call(ctx, "jobs", map[string]any{"repo_id": repoID, "job_ids": []uint64{jobID}}, &jobs)
+		if err != nil {
+			return timeline.Job{}, fmt.Errorf("getting job: %w", err)
+		}
+		if len(jobs) == 0 {
+			return timeline.Job{}, fmt.Errorf("job %d not found", jobID)
+		}
+		job := jobs[0]
+
+		if status := describeJob(job); status != lastStatus {
+			fmt.Fprintln(os.Stderr, status)
+			lastStatus = status
+		}
+
+		var code int
+		switch job.State {
+		case timeline.JobSucceeded:
+		case timeline.JobFailed:
+			code = exitJobFailed
+		case timeline.JobAborted:
+			code = exitJobAborted
+		case timeline.JobInterrupted:
+			code = exitJobInterrupted
+		default:
+			select {
+			case <-time.After(pollInterval):
+				continue
+			case <-ctx.Done():
+				return timeline.Job{}, ctx.Err()
+			}
+		}
+
+		if code != 0 {
+			return job, exitCodeError{code, fmt.Errorf("job %d %s", job.ID, job.State)}
+		}
+		return job, nil
+	}
+}
+
+// describeJob returns a line describing the state and progress of the job.
+func describeJob(job timeline.Job) string {
+	status := fmt.Sprintf("job %d (%s): %s", job.ID, job.Type, job.State)
+	if progress := jobProgress(job); progress != "" {
+		status += " " + progress
+	}
+	if job.Message != nil && *job.Message != "" {
+		status += ": " + *job.Message
+	}
+	return status
+}
+
+func jobProgress(job timeline.Job) string {
+	switch {
+	case job.Progress != nil && job.Total != nil && *job.Total > 0:
+		return fmt.Sprintf("%d/%d (%d%%)", *job.Progress, *job.Total, *job.Progress*100 / *job.Total)
+	case job.Progress != nil:
+		return strconv.Itoa(*job.Progress)
+	}
+	return ""
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+func parseJobIDs(fs *headlessFlags) ([]uint64, error) {
+	if fs.NArg() == 0 {
+		return nil, fs.usageError("job ID is required")
+	}
+	ids := make([]uint64, 0, fs.NArg())
+	for _, arg := range fs.Args() {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return nil, fs.usageError(fmt.Sprintf("invalid job ID: %s", arg))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func cmdImport(ctx context.Context, app *tlzapp.App, args []string) error {
+	fs := newHeadlessFlags("import", "[flags] <data source> <path>...",
+		"Imports files or folders into the timeline with a data source, such as 'media' or 'smsbackuprestore' (see the data-sources command).")
+	detach := fs.Bool("detach", false, "don't wait for the import job to end (requires the server to be running)")
+	options := fs.String("options", "", "the data source options, as JSON")
+	integrity := fs.Bool("integrity", false, "perform integrity checks")
+	overwrite := fs.Bool("overwrite", false, "overwrite changes made to items in the timeline since they were imported")
+	estimateTotal := fs.Bool("estimate-total", false, "estimate the number of items first, for accurate progress")
+	preview := fs.Bool("preview", false, "don't import anything; report what the import would do instead")
+	_ = fs.Parse(args)
+
+	if fs.NArg() < 2 { //nolint:mnd
+		return fs.usageError("data source and path are required")
+	}
+	if *options != "" && !json.Valid([]byte(*options)) {
+		return fs.usageError("data source options are not valid JSON")
+	}
+	if err := checkDetach(app, *detach); err != nil {
+		return err
+	}
+
+	fileImport := timeline.FileImport{DataSourceName: fs.Arg(0)}
+	if *options != "" {
+		fileImport.DataSourceOptions = json.RawMessage(*options)
+	}
+	for _, path := range fs.Args()[1:] {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(absPath); err != nil {
+			return err
+		}
+		fileImport.Filenames = append(fileImport.Filenames, absPath)
+	}
+
+	repoID, err := resolveRepo(ctx, app, fs.repo)
+	if err != nil {
+		return err
+	}
+
+	params := tlzapp.ImportParameters{
+		Repo: repoID,
+		Job: &timeline.ImportJob{
+			Plan: timeline.ImportPlan{Files: []timeline.FileImport{fileImport}},
+			ProcessingOptions: timeline.ProcessingOptions{
+				Integrity:             *integrity,
+				OverwriteLocalChanges: *overwrite,
+				// the same as the import page of the UI
+				ItemUniqueConstraints: map[string]bool{
+					"classification_name": true,
+					"filename":            true,
+					"timestamp":           true,
+					"timespan":            true,
+					"timeframe":           true,
+					"data":                true,
+					"location":            true,
+				},
+			},
+			EstimateTotal: *estimateTotal,
+			Preview:       *preview,
+		},
+	}
+	var resp struct {
+		JobID uint64 `json:"job_id"`
+	}
+	if err := app.Call(ctx, "import", params, &resp); err != nil {
+		return err
+	}
+	if !*preview || *detach {
+		return startedJob(ctx, app, fs, repoID, resp.JobID, *detach)
+	}
+
+	if _, err := awaitJob(ctx, app, repoID, resp.JobID); err != nil {
+		return err
+	}
+	var report timeline.PreviewReport
+	if err := app.Call(ctx, "import-preview", map[string]any{"repo_id": repoID, "job_id": resp.JobID}, &report); err != nil {
+		return err
+	}
+	if fs.json {
+		return printJSON(report)
+	}
+	printPreviewReport(report)
+	return nil
+}
+
+func printPreviewReport(report timeline.PreviewReport) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint:mnd
+	defer tw.Flush()
+
+	fmt.Fprintf(tw, "Items:\t%d (%d already in the timeline)\n", report.Items, report.Duplicates)
+	fmt.Fprintf(tw, "Entities:\t%d\n", report.Entities)
+	if report.Earliest != nil && report.Latest != nil {
+		fmt.Fprintf(tw, "Dates:\t%s to %s\n", report.Earliest.Local().Format(time.DateOnly), report.Latest.Local().Format(time.DateOnly))
+	}
+	fmt.Fprintf(tw, "Undated:\t%d\n", report.Undated)
+	if report.Outside > 0 {
+		fmt.Fprintf(tw, "Outside timeframe:\t%d (skipped)\n", report.Outside)
+	}
+
+	classes := make([]string, 0, len(report.ByClass))
+	for _, class := range slices.Sorted(maps.Keys(report.ByClass)) {
+		name := class
+		if name == "" {
+			name = "unclassified"
+		}
+		classes = append(classes, fmt.Sprintf("%s %d", name, report.ByClass[class]))
+	}
+	if len(classes) > 0 {
+		fmt.Fprintf(tw, "Classifications:\t%s\n", strings.Join(classes, ", "))
+	}
+
+	years := make([]string, 0, len(report.ByYear))
+	for _, year := range slices.Sorted(maps.Keys(report.ByYear)) {
+		years = append(years, fmt.Sprintf("%d: %d", year, report.ByYear[year]))
+	}
+	if len(years) > 0 {
+		fmt.Fprintf(tw, "Years:\t%s\n", strings.Join(years, ", "))
+	}
+
+	var mediaFiles, mediaBytes int64
+	for _, mediaType := range slices.Sorted(maps.Keys(report.Media)) {
+		size := report.Media[mediaType]
+		if mediaType == "" {
+			mediaType = "other"
+		}
+		fmt.Fprintf(tw, "Media (%s):\t%d files, %s\n", mediaType, size.Files, byteSize(size.Bytes))
+		mediaFiles += size.Files
+		mediaBytes += size.Bytes
+	}
+	fmt.Fprintf(tw, "Media total:\t%d files, %s\n", mediaFiles, byteSize(mediaBytes))
+
+	if report.Errors > 0 {
+		fmt.Fprintf(tw, "Errors:\t%d items could not be previewed (see the logs)\n", report.Errors)
+	}
+	if len(report.Skipped) > 0 {
+		fmt.Fprintf(tw, "Not previewed:\t%s (imports from an API)\n", strings.Join(report.Skipped, ", "))
+	}
+}
+
+// byteSize formats n bytes for humans, like "1.5 GB".
+func byteSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+func cmdExport(ctx context.Context, app *tlzapp.App, args []string) error {
+	fs := newHeadlessFlags("export", "[flags] <path>",
+		"Exports the timeline to a portable archive at the path, which must not exist yet.")
+	detach := fs.Bool("detach", false, "don't wait for the export job to end (requires the server to be running)")
+	format := fs.String("format", string(timeline.ExportFormatZip), "the format of the archive: zip or folder")
+	start := fs.String("start", "", "only export items from this time on (YYYY-MM-DD or RFC 3339)")
+	end := fs.String("end", "", "only export items before this time (YYYY-MM-DD or RFC 3339)")
+	skipDataFiles := fs.Bool("skip-data-files", false, "leave out data files and entity pictures")
+	var sources stringsFlag
+	fs.Var(&sources, "source", "only export items from this data source (may be repeated)")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fs.usageError("path is required")
+	}
+	path, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	opts := timeline.ExportOptions{
+		Path:           path,
+		Format:         timeline.ExportFormat(*format),
+		DataSourceName: sources,
+		SkipDataFiles:  *skipDataFiles,
+	}
+	if opts.StartTimestamp, err = parseTimeFlag(*start); err != nil {
+		return fs.usageError(fmt.Sprintf("invalid start: %v", err))
+	}
+	if opts.EndTimestamp, err = parseTimeFlag(*end); err != nil {
+		return fs.usageError(fmt.Sprintf("invalid end: %v", err))
+	}
+	if err := checkDetach(app, *detach); err != nil {
+		return err
+	}
+
+	repoID, err := resolveRepo(ctx, app, fs.repo)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		JobID uint64 `json:"job_id"`
+	}
+	if err := app.Call(ctx, "export", tlzapp.ExportParameters{Repo: repoID, Options: opts}, &resp); err != nil {
+		return err
+	}
+	return startedJob(ctx, app, fs, repoID, resp.JobID, *detach)
+}
+
+func cmdSearch(ctx context.Context, app *tlzapp.App, args []string) error {
+	fs := newHeadlessFlags("search", "[flags] <query>",
+		`Finds items in the timeline with the query language, like "photos with Mom in Spain during summer 2019".`)
+	limit := fs.Int("limit", 0, "the maximum number of items (default 100)")
+	offset := fs.Int("offset", 0, "the number of items to skip, for paging")
+	explain := fs.Bool("explain", false, "show how the query would be carried out instead")
+	_ = fs.Parse(args)
+
+	// the query may be quoted, or not
+	query := strings.Join(fs.Args(), " ")
+	if strings.TrimSpace(query) == "" {
+		return fs.usageError("query is required")
+	}
+
+	repoID, err := resolveRepo(ctx, app, fs.repo)
+	if err != nil {
+		return err
+	}
+	payload := struct {
+		timeline.QuerySearchParams
+		Explain bool `json:"explain,omitempty"`
+	}{
+		QuerySearchParams: timeline.QuerySearchParams{Repo: repoID, Query: query, Limit: *limit, Offset: *offset},
+		Explain:           *explain,
+	}
+
+	if *explain {
+		var plan timeline.QueryPlan
+		if err := app.Call(ctx, "search", payload, &plan); err != nil {
+			return err
+		}
+		if fs.json {
+			return printJSON(plan)
+		}
+		for _, note := range plan.Notes {
+			fmt.Println("Note:", note)
+		}
+		fmt.Println(plan.SQL)
+		if len(plan.Args) > 0 {
+			fmt.Println("Args:", plan.Args)
+		}
+		return nil
+	}
+
+	var results timeline.SearchResults
+	if err := app.Call(ctx, "search", payload, &results); err != nil {
+		return err
+	}
+	if fs.json {
+		return printJSON(results)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint:mnd
+	fmt.Fprintln(tw, "ID\tTIMESTAMP\tCLASS\tSOURCE\tCONTENT")
+	for _, sr := range results.Items {
+		var timestamp string
+		if sr.Timestamp != nil {
+			timestamp = sr.Timestamp.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", sr.ID, timestamp, deref(sr.Classification), deref(sr.DataSourceName), itemContent(sr.ItemRow))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d items\n", len(results.Items), results.Total)
+	return nil
+}
+
+// itemContent returns a short, single-line summary of the item's content.
+func itemContent(ir timeline.ItemRow) string {
+	const maxLen = 80
+	var content string
+	switch {
+	case ir.DataText != nil:
+		content = strings.Join(strings.Fields(*ir.DataText), " ")
+	case ir.DataFile != nil:
+		content = *ir.DataFile
+	case ir.DataType != nil:
+		content = "(" + *ir.DataType + ")"
+	}
+	if runes := []rune(content); len(runes) > maxLen {
+		content = string(runes[:maxLen-1]) + "…"
+	}
+	return content
+}
+
+func cmdJobs(ctx context.Context, app *tlzapp.App, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, headlessHelp)
+		return exitCodeError{exitUsage, errors.New("subcommand is required: list, cancel, resume, or wait")}
+	}
+
+	switch args[0] {
+	case "list":
+		fs := newHeadlessFlags("jobs list", "[flags]", "Lists the most recent jobs, newest first.")
+		n := fs.Int("n", 20, "the number of jobs") //nolint:mnd
+		_ = fs.Parse(args[1:])
+		repoID, err := resolveRepo(ctx, app, fs.repo)
+		if err != nil {
+			return err
+		}
+		var jobs []timeline.Job
+		if err := app.Call(ctx, "jobs", map[string]any{"repo_id": repoID, "most_recent": *n}, &jobs); err != nil {
+			return err
+		}
+		if fs.json {
+			return printJSON(jobs)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint:mnd
+		fmt.Fprintln(tw, "ID\tTYPE\tSTATE\tPROGRESS\tCREATED\tMESSAGE")
+		for _, job := range jobs {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", job.ID, job.Type, job.State, jobProgress(job),
+				job.Created.Local().Format("2006-01-02 15:04"), deref(job.Message))
+		}
+		return tw.Flush()
+
+	case "cancel":
+		fs := newHeadlessFlags("jobs cancel", "[flags] <job ID>...", "Cancels active jobs.")
+		_ = fs.Parse(args[1:])
+		jobIDs, err := parseJobIDs(fs)
+		if err != nil {
+			return err
+		}
+		repoID, err := resolveRepo(ctx, app, fs.repo)
+		if err != nil {
+			return err
+		}
+		return app.Call(ctx, "cancel-jobs", map[string]any{"repo_id": repoID, "job_ids": jobIDs}, nil)
+
+	case "resume":
+		fs := newHeadlessFlags("jobs resume", "[flags] <job ID>",
+			"Resumes an interrupted, paused, aborted, or failed job from its last checkpoint, and waits for it to end.")
+		detach := fs.Bool("detach", false, "don't wait for the job to end (requires the server to be running)")
+		_ = fs.Parse(args[1:])
+		jobIDs, err := parseJobIDs(fs)
+		if err != nil {
+			return err
+		}
+		if len(jobIDs) > 1 {
+			return fs.usageError("only one job can be resumed at a time")
+		}
+		if err := checkDetach(app, *detach); err != nil {
+			return err
+		}
+		repoID, err := resolveRepo(ctx, app, fs.repo)
+		if err != nil {
+			return err
+		}
+		if err := app.Call(ctx, "resume-job", map[string]any{"repo_id": repoID, "job_id": jobIDs[0]}, nil); err != nil {
+			return err
+		}
+		return startedJob(ctx, app, fs, repoID, jobIDs[0], *detach)
+
+	case "wait":
+		fs := newHeadlessFlags("jobs wait", "[flags] <job ID>",
+			"Waits for a job to end, and exits with a status that reflects how it ended.")
+		_ = fs.Parse(args[1:])
+		jobIDs, err := parseJobIDs(fs)
+		if err != nil {
+			return err
+		}
+		if len(jobIDs) > 1 {
+			return fs.usageError("only one job can be waited for at a time")
+		}
+		repoID, err := resolveRepo(ctx, app, fs.repo)
+		if err != nil {
+			return err
+		}
+		return waitForJob(ctx, app, fs, repoID, jobIDs[0])
+	}
+
+	fmt.Fprint(os.Stderr, headlessHelp)
+	return exitCodeError{exitUsage, fmt.Errorf("unrecognized subcommand: %s", args[0])}
+}
+
+func cmdServe(_ context.Context, app *tlzapp.App, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	apiOnly := fs.Bool("api-only", false, "serve only the API, not the web UI")
+	_ = fs.Parse(args)
+
+	serve := app.MustServe
+	if *apiOnly {
+		serve = app.MustServeAPI
+	}
+	if err := serve(); err != nil {
+		return err
+	}
+	select {}
+}
+
+// cmdAPI runs an API command, for those that have the same name as a
+// headless command.
+func cmdAPI(ctx context.Context, app *tlzapp.App, args []string) error {
+	if len(args) == 0 {
+		return exitCodeError{exitUsage, errors.New("API command is required")}
+	}
+	return app.RunCommand(ctx, args)
+}
+
+// stringsFlag is a flag that may be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string       { return strings.Join(*s, ",") }
+func (s *stringsFlag) Set(val string) error { *s = append(*s, val); return nil }
+
+// parseTimeFlag parses a date in local time, or a timestamp.
+func parseTimeFlag(val string) (*time.Time, error) {
+	if val == "" {
+		return nil, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, val, time.Local); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return nil, errors.New("expected YYYY-MM-DD or RFC 3339 timestamp")
+	}
+	return &t, nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,308 @@
+package calendar
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/timelinize/timelinize/timeline"
+	"go.uber.org/zap"
+)
+
+func init() {
+	err := timeline.RegisterDataSource(timeline.DataSource{
+		Name:           "caldav",
+		Title:          "Calendar (CalDAV)",
+		Icon:           "calendar.svg",
+		NewOptions:     func() any { return new(CalDAVOptions) },
+		NewAPIImporter: func() timeline.APIImporter { return new(CalDAVImporter) },
+	})
+	if err != nil {
+		timeline.Log.Fatal("registering data source", zap.Error(err))
+	}
+}
+
+// CalDAVOptions configures the CalDAV data source. Since the options are
+// saved with the import job (and its schedule, if any), an app password
+// is recommended, if the server supports them.
+type CalDAVOptions struct {
+	// The URL of a calendar, or of a collection of calendars (like the
+	// calendar home of a user), in which case all of them are imported.
+	URL string `json:"url"`
+
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// The ID of the owner entity, for events that have no organizer.
+	OwnerEntityID uint64 `json:"owner_entity_id"`
+}
+
+// CalDAVImporter imports events from calendars on a CalDAV server (RFC
+// 4791). Since a server has the entire calendar, events that were deleted
+// from a calendar since the last import are noticed, and their occurrences
+// that were upcoming are marked as canceled.
+type CalDAVImporter struct{}
+
+// Authenticate checks that the server accepts the credentials.
+func (CalDAVImporter) Authenticate(ctx context.Context, _ timeline.Account, dsOpt any) error {
+	opt := dsOpt.(*CalDAVOptions)
+	_, err := newCalDAVClient(opt).calendars(ctx)
+	return err
+}
+
+// APIImport imports the events in the configured calendars.
+func (CalDAVImporter) APIImport(ctx context.Context, _ timeline.Account, params timeline.ImportParams) error {
+	opt := params.DataSourceOptions.(*CalDAVOptions)
+	c := newCalDAVClient(opt)
+	imp := newCalendarImport(params, opt.OwnerEntityID)
+
+	calendars, err := c.calendars(ctx)
+	if err != nil {
+		return err
+	}
+	if len(calendars) == 0 {
+		return fmt.Errorf("no calendars found at %s", opt.URL)
+	}
+
+	// an event may move between calendars, so it is only deleted if it
+	// isn't in any of them anymore
+	seen := make(map[string]bool)
+	var deleted []string
+	for _, cal := range calendars {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		uids, err := imp.importCalDAVCalendar(ctx, c, cal)
+		if err != nil {
+			return fmt.Errorf("importing calendar %s: %w", cal.href, err)
+		}
+		for _, uid := range uids {
+			seen[uid] = true
+		}
+
+		// events can only be known to be deleted if all of them were listed
+		if !params.Timeframe.IsEmpty() {
+			continue
+		}
+		stateKey := "calendar/" + cal.href
+		var prev caldavCalendarState
+		if _, err := params.State.Load(stateKey, &prev); err != nil {
+			params.Log.Error("loading state of previous import", zap.String("calendar", cal.href), zap.Error(err))
+		}
+		deleted = append(deleted, prev.UIDs...)
+		if err := params.State.Save(stateKey, caldavCalendarState{UIDs: uids}); err != nil {
+			return err
+		}
+	}
+
+	for _, uid := range deleted {
+		if !seen[uid] {
+			params.Log.Debug("event was deleted", zap.String("uid", uid))
+			imp.cancelEvent(uid)
+			seen[uid] = true
+		}
+	}
+
+	return nil
+}
+
+// caldavCalendarState is the import state of a calendar.
+type caldavCalendarState struct {
+	UIDs []string `json:"uids,omitempty"` // of the events in the calendar
+}
+
+// importCalDAVCalendar imports the events in cal, and returns their UIDs.
+func (imp *calendarImport) importCalDAVCalendar(ctx context.Context, c *caldavClient, cal caldavCalendar) ([]string, error) {
+	logger := imp.params.Log.With(zap.String("calendar", cal.href))
+
+	objects, err := c.calendarObjects(ctx, cal.href, imp.params.Timeframe)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("importing calendar", zap.String("name", cal.name), zap.Int("objects", len(objects)))
+
+	var uids []string
+	for _, obj := range objects {
+		objUIDs, err := imp.importCalendar(ctx, strings.NewReader(obj.data), cal.name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			logger.Error("parsing calendar object", zap.String("href", obj.href), zap.Error(err))
+			continue
+		}
+		uids = append(uids, objUIDs...)
+	}
+	return uids, nil
+}
+
+// caldavClient makes requests of a CalDAV server.
+type caldavClient struct {
+	opt  *CalDAVOptions
+	http *http.Client
+}
+
+func newCalDAVClient(opt *CalDAVOptions) *caldavClient {
+	return &caldavClient{opt: opt, http: &http.Client{Timeout: caldavTimeout}}
+}
+
+// caldavCalendar is a calendar collection on the server.
+type caldavCalendar struct {
+	href string // absolute URL
+	name string
+}
+
+// caldavObject is a calendar object resource, which has the events with one UID.
+type caldavObject struct {
+	href string
+	data string // iCalendar
+}
+
+// calendars returns the calendars at the configured URL, which is
+// either itself a calendar or has calendars in it.
+func (c *caldavClient) calendars(ctx context.Context) ([]caldavCalendar, error) {
+	const body = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:displayname/></d:prop></d:propfind>`
+
+	ms, err := c.request(ctx, "PROPFIND", c.opt.URL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var calendars []caldavCalendar
+	for _, resp := range ms.Responses {
+		prop, ok := resp.prop()
+		if !ok || prop.ResourceType.Calendar == nil {
+			continue
+		}
+		href, err := c.resolve(resp.Href)
+		if err != nil {
+			return nil, err
+		}
+		calendars = append(calendars, caldavCalendar{href: href, name: prop.DisplayName})
+	}
+	return calendars, nil
+}
+
+// calendarObjects returns the objects (events) in the calendar at href,
+// limited to the events that occur in the timeframe, if it is set.
+func (c *caldavClient) calendarObjects(ctx context.Context, href string, tf timeline.Timeframe) ([]caldavObject, error) {
+	var timeRange string
+	if tf.Since != nil || tf.Until != nil {
+		timeRange = "<c:time-range"
+		if tf.Since != nil {
+			timeRange += ` start="` + tf.Since.UTC().Format("20060102T150405Z") + `"`
+		}
+		if tf.Until != nil {
+			timeRange += ` end="` + tf.Until.UTC().Format("20060102T150405Z") + `"`
+		}
+		timeRange += "/>"
+	}
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+<d:prop><d:getetag/><c:calendar-data/></d:prop>
+<c:filter><c:comp-filter name="VCALENDAR"><c:comp-filter name="VEVENT">` + timeRange + `</c:comp-filter></c:comp-filter></c:filter>
+</c:calendar-query>`
+
+	ms, err := c.request(ctx, "REPORT", href, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []caldavObject
+	for _, resp := range ms.Responses {
+		if prop, ok := resp.prop(); ok && prop.CalendarData != "" {
+			objects = append(objects, caldavObject{href: resp.Href, data: prop.CalendarData})
+		}
+	}
+	return objects, nil
+}
+
+// request makes a WebDAV request with a depth of 1 and returns the multistatus response.
+func (c *caldavClient) request(ctx context.Context, method, endpoint, body string) (davMultistatus, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, strings.NewReader(body))
+	if err != nil {
+		return davMultistatus{}, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
+	req.Header.Set("Depth", "1")
+	if c.opt.Username != "" || c.opt.Password != "" {
+		req.SetBasicAuth(c.opt.Username, c.opt.Password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return davMultistatus{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return davMultistatus{}, fmt.Errorf("%s %s: %w (HTTP %d)", method, endpoint, errCalDAVAuth, resp.StatusCode)
+	case resp.StatusCode != http.StatusMultiStatus:
+		return davMultistatus{}, fmt.Errorf("%s %s: unexpected HTTP status %s", method, endpoint, resp.Status)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return davMultistatus{}, fmt.Errorf("decoding %s response: %w", method, err)
+	}
+	return ms, nil
+}
+
+// resolve returns the absolute URL of href, which is relative to the configured URL.
+func (c *caldavClient) resolve(href string) (string, error) {
+	base, err := url.Parse(c.opt.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("invalid href from server: %w", err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+var errCalDAVAuth = errors.New("server did not accept the credentials")
+
+// davMultistatus is a WebDAV multistatus response (RFC 4918 §14.16).
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Propstats []davPropstat `xml:"DAV: propstat"`
+}
+
+// prop returns the properties that were found.
+func (r davResponse) prop() (davProp, bool) {
+	for _, ps := range r.Propstats {
+		if strings.Contains(ps.Status, " 200 ") {
+			return ps.Prop, true
+		}
+	}
+	return davProp{}, false
+}
+
+type davPropstat struct {
+	Status string  `xml:"DAV: status"`
+	Prop   davProp `xml:"DAV: prop"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Calendar *struct{} `xml:"urn:ietf:params:xml:ns:caldav calendar"`
+	} `xml:"DAV: resourcetype"`
+	DisplayName  string `xml:"DAV: displayname"`
+	CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+}
+
+// caldavTimeout is how long a request to the server may take, including
+// reading the response; a calendar-query lists a whole calendar.
+const caldavTimeout = 5 * time.Minute
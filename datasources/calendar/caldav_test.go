@@ -0,0 +1,117 @@
+package calendar
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/timelinize/timelinize/timeline"
+	"go.uber.org/zap"
+)
+
+func TestCalDAVImport(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Second).AddDate(0, 0, 1)
+	daily := fmt.Sprintf("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:daily\r\nDTSTART:%s\r\nRRULE:FREQ=DAILY;COUNT=2\r\nSUMMARY:Walk\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+		start.Format("20060102T150405Z"))
+	once := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:once\r\nDTSTART:20200101T120000Z\r\nSUMMARY:Party\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+	var mu sync.Mutex
+	objects := map[string]string{"/cal/work/daily.ics": daily, "/cal/work/once.ics": once}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "me" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var sb strings.Builder
+		sb.WriteString(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">`)
+		switch {
+		case r.Method == "PROPFIND" && r.URL.Path == "/cal/":
+			sb.WriteString(`<d:response><d:href>/cal/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`)
+			sb.WriteString(`<d:response><d:href>/cal/work/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/><c:calendar/></d:resourcetype><d:displayname>Work</d:displayname></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`)
+		case r.Method == "REPORT" && r.URL.Path == "/cal/work/":
+			mu.Lock()
+			for href, data := range objects {
+				sb.WriteString(`<d:response><d:href>` + href + `</d:href><d:propstat><d:prop><d:getetag>"1"</d:getetag><c:calendar-data>`)
+				_ = xml.EscapeText(&sb, []byte(data))
+				sb.WriteString(`</c:calendar-data></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`)
+			}
+			mu.Unlock()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sb.WriteString(`</d:multistatus>`)
+		w.WriteHeader(http.StatusMultiStatus)
+		_, _ = w.Write([]byte(sb.String()))
+	}))
+	defer srv.Close()
+
+	opt := &CalDAVOptions{URL: srv.URL + "/cal/", Username: "me", Password: "secret"}
+
+	var saved map[string]json.RawMessage
+	runImport := func() map[string]*timeline.Item {
+		t.Helper()
+		pipeline := make(chan *timeline.Graph, 10)
+		state := timeline.NewImportState(saved)
+		err := new(CalDAVImporter).APIImport(context.Background(), timeline.Account{}, timeline.ImportParams{
+			Pipeline:          pipeline,
+			Log:               zap.NewNop(),
+			DataSourceOptions: opt,
+			State:             state,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		close(pipeline)
+		items := make(map[string]*timeline.Item)
+		for g := range pipeline {
+			items[g.Item.ID] = g.Item
+		}
+		if saved == nil {
+			saved = make(map[string]json.RawMessage)
+		}
+		for k, v := range state.Pending() {
+			saved[k] = v
+		}
+		return items
+	}
+
+	first := occurrenceID("daily", start, false)
+	second := occurrenceID("daily", start.AddDate(0, 0, 1), false)
+
+	items := runImport()
+	if len(items) != 3 || items[first] == nil || items[second] == nil || items["once"] == nil {
+		t.Fatalf("expected both occurrences and the single event, got %v", items)
+	}
+	if cal := items["once"].Metadata["Calendar"]; cal != "Work" {
+		t.Errorf("expected the name of the calendar, got %v", cal)
+	}
+
+	// the upcoming occurrences of a deleted event are canceled
+	mu.Lock()
+	delete(objects, "/cal/work/daily.ics")
+	mu.Unlock()
+	items = runImport()
+	if len(items) != 3 || items[first].Metadata["Status"] != "cancelled" || items[second].Metadata["Status"] != "cancelled" {
+		t.Fatalf("expected the occurrences of the deleted event to be canceled, got %v", items)
+	}
+
+	// and only once
+	if items = runImport(); len(items) != 1 {
+		t.Errorf("expected only the single event, got %v", items)
+	}
+
+	// wrong password
+	opt.Password = "nope"
+	if err := new(CalDAVImporter).Authenticate(context.Background(), timeline.Account{}, opt); err == nil {
+		t.Error("expected error with wrong password")
+	}
+}
@@ -2,12 +2,14 @@ package calendar
 
 import (
 	"context"
+	"io"
 	"io/fs"
+	"maps"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/apognu/gocal"
 	"github.com/timelinize/timelinize/timeline"
 	"go.uber.org/zap"
 )
@@ -52,11 +54,7 @@ type Options struct {
 // FileImport imports data from a file.
 func (fi FileImporter) FileImport(ctx context.Context, dirEntry timeline.DirEntry, params timeline.ImportParams) error {
 	dsOpt := params.DataSourceOptions.(*Options)
-
-	// if no organizer/owner is specified, we default to the configured entity
-	defaultOwner := timeline.Entity{
-		ID: dsOpt.OwnerEntityID,
-	}
+	imp := newCalendarImport(params, dsOpt.OwnerEntityID)
 
 	err := fs.WalkDir(dirEntry.FS, dirEntry.Filename, func(fpath string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -88,74 +86,391 @@ func (fi FileImporter) FileImport(ctx context.Context, dirEntry timeline.DirEntr
 		}
 		defer file.Close()
 
-		c := gocal.NewParser(file)
-
-		// import all items (with reasonable bounds still on recurring events)
-		// regardless of date range (set Start/End to configure date range)
-		c.SkipBounds = true
-
-		if err := c.Parse(); err != nil {
+		if _, err := imp.importCalendar(ctx, file, ""); err != nil {
 			// go on to the next calendar file
 			params.Log.Error("parsing calendar file",
 				zap.String("filename", fpath),
 				zap.Error(err))
-			return nil
 		}
 
-		for _, e := range c.Events {
-			var start, end time.Time
-			if e.Start != nil {
-				start = *e.Start
-			}
-			if e.End != nil {
-				end = *e.End
-			}
+		return nil
+	})
 
-			var loc timeline.Location
-			if e.Geo != nil {
-				loc.Latitude = &e.Geo.Lat
-				loc.Longitude = &e.Geo.Long
-			}
+	return err
+}
 
-			var owner timeline.Entity
-			if e.Organizer == nil {
-				owner = defaultOwner
-			} else if e.Organizer != nil && e.Organizer.Cn != "" {
-				owner.Name = e.Organizer.Cn
-			}
+// calendarImport sends the events of calendars down the pipeline. Each
+// occurrence of a recurring event becomes its own item, within the import
+// window: the timeframe of the import, if set; otherwise from the start
+// of the event until defaultFutureWindow from now (since recurring events
+// often never end).
+//
+// Occurrences are identified by the UID of the event and the time they
+// were originally scheduled for, and have a retrieval key, so when an
+// event is updated, importing it again updates the items of its occurrences
+// (regardless of whether they come from a file or a CalDAV server).
+// Occurrences that are canceled have a "Status" of "cancelled" in their
+// metadata. The import state of each recurring event remembers its
+// occurrences that were still upcoming, so that if they disappear from the
+// event (because it was shortened, or they were excluded), the items of
+// those occurrences are marked as canceled too. An event that has an older
+// SEQUENCE number than was imported before is skipped, since it is stale.
+type calendarImport struct {
+	params       timeline.ImportParams
+	defaultOwner timeline.Entity
+	now          time.Time
+	since, until time.Time // the import window; since may be zero
+}
 
-			content := strings.TrimSpace(e.Summary)
-			if e.Description != "" {
-				if content != "" {
-					content += "\n"
-				}
-				content += strings.TrimSpace(e.Description)
-			}
+func newCalendarImport(params timeline.ImportParams, ownerEntityID uint64) *calendarImport {
+	imp := &calendarImport{
+		params:       params,
+		defaultOwner: timeline.Entity{ID: ownerEntityID},
+		now:          time.Now(),
+	}
+	imp.until = imp.now.Add(defaultFutureWindow)
+	if tf := params.Timeframe; tf.Since != nil {
+		imp.since = *tf.Since
+	}
+	if tf := params.Timeframe; tf.Until != nil {
+		imp.until = *tf.Until
+	}
+	return imp
+}
+
+// importCalendar imports the events in the iCalendar data read from r,
+// and returns their UIDs. If the data doesn't name the calendar, the
+// events are in the calendar with the given name, if any; objects from
+// CalDAV servers usually don't, since the name is a property of the
+// calendar collection.
+func (imp *calendarImport) importCalendar(ctx context.Context, r io.Reader, calendarName string) ([]string, error) {
+	events, err := parseICS(r)
+	if err != nil {
+		return nil, err
+	}
 
-			params.Pipeline <- &timeline.Graph{
-				Item: &timeline.Item{
-					ID:             e.Uid,
-					Classification: timeline.ClassEvent,
-					Timestamp:      start,
-					Timespan:       end,
-					Location:       loc,
-					Owner:          owner,
-					Content: timeline.ItemData{
-						MediaType: "text/plain",
-						Data:      timeline.StringData(content),
-					},
-					Metadata: timeline.Metadata{
-						"Location": e.Location,
-						"Class":    e.Class,
-					},
-				},
+	// a recurring event and the occurrences it overrides share a UID
+	var uids []string
+	byUID := make(map[string][]*icsEvent)
+	for _, e := range events {
+		if e.calendarName == "" {
+			e.calendarName = calendarName
+		}
+		if e.uid == "" {
+			imp.sendEvent(e, "", e.start, e.end)
+			continue
+		}
+		if _, ok := byUID[e.uid]; !ok {
+			uids = append(uids, e.uid)
+		}
+		byUID[e.uid] = append(byUID[e.uid], e)
+	}
+
+	for _, uid := range uids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		imp.importEvent(uid, byUID[uid])
+	}
+
+	return uids, nil
+}
+
+// eventState is the import state of an event.
+type eventState struct {
+	Sequence int `json:"sequence,omitempty"`
+
+	// the original start times (as Unix seconds) of the occurrences of
+	// a recurring event that hadn't happened yet as of the import
+	Upcoming []int64 `json:"upcoming,omitempty"`
+	AllDay   bool    `json:"all_day,omitempty"`
+}
+
+func eventStateKey(uid string) string { return "event/" + uid }
+
+// importEvent imports the event with the given UID, which consists of the
+// (possibly recurring) event itself and any occurrences that it overrides.
+func (imp *calendarImport) importEvent(uid string, events []*icsEvent) {
+	logger := imp.params.Log.With(zap.String("uid", uid))
+
+	var master *icsEvent
+	overrides := make(map[int64]*icsEvent)
+	sequence := 0
+	for _, e := range events {
+		sequence = max(sequence, e.sequence)
+		if e.recurrenceID.IsZero() {
+			master = e
+		} else {
+			overrides[e.recurrenceID.Unix()] = e
+		}
+	}
+
+	var prev eventState
+	if _, err := imp.params.State.Load(eventStateKey(uid), &prev); err != nil {
+		logger.Error("loading state of previous import", zap.Error(err))
+	}
+	if prev.Sequence > sequence {
+		logger.Debug("skipping event that is older than the one imported before",
+			zap.Int("sequence", sequence),
+			zap.Int("imported_sequence", prev.Sequence))
+		return
+	}
+
+	if master != nil && !master.recurring() && len(overrides) == 0 {
+		if imp.params.Timeframe.Contains(master.start) {
+			imp.sendEvent(master, uid, master.start, master.end)
+		}
+		imp.saveState(uid, eventState{Sequence: sequence})
+		return
+	}
+
+	// the recurrence IDs of all-day events are dates
+	allDay := events[0].allDay
+	if master != nil {
+		allDay = master.allDay
+	}
+
+	// send each occurrence, overridden or not, and remember the upcoming ones
+	known := make(map[int64]bool)
+	var upcoming []int64
+	send := func(recurrenceID time.Time, e *icsEvent, start, end time.Time) {
+		key := recurrenceID.Unix()
+		if known[key] {
+			return
+		}
+		known[key] = true
+		if start.Before(imp.since) || start.After(imp.until) {
+			return
+		}
+		if !recurrenceID.Before(imp.now) {
+			upcoming = append(upcoming, key)
+		}
+		imp.sendEvent(e, occurrenceID(uid, recurrenceID, allDay), start, end)
+	}
+	if master != nil {
+		for _, start := range imp.occurrences(logger, master) {
+			if e, ok := overrides[start.Unix()]; ok {
+				send(start, e, e.start, e.end)
+				continue
 			}
+			send(start, master, start, start.Add(master.duration()))
 		}
+	}
+	// overridden occurrences that aren't (or are no longer) in the recurrence set
+	for _, key := range slices.Sorted(maps.Keys(overrides)) {
+		e := overrides[key]
+		send(e.recurrenceID, e, e.start, e.end)
+	}
 
-		return nil
-	})
+	// occurrences that were upcoming before but have disappeared from the event
+	for _, key := range prev.Upcoming {
+		recurrenceID := time.Unix(key, 0)
+		if known[key] || recurrenceID.Before(imp.since) || recurrenceID.After(imp.until) {
+			continue
+		}
+		imp.cancelOccurrence(master, uid, recurrenceID, allDay)
+	}
 
-	return err
+	imp.saveState(uid, eventState{Sequence: sequence, Upcoming: upcoming, AllDay: allDay})
+}
+
+// saveState saves the import state of the event with the given UID,
+// unless the import has a timeframe, since it doesn't see all occurrences.
+func (imp *calendarImport) saveState(uid string, state eventState) {
+	if !imp.params.Timeframe.IsEmpty() {
+		return
+	}
+	if err := imp.params.State.Save(eventStateKey(uid), state); err != nil {
+		imp.params.Log.Error("saving import state", zap.String("uid", uid), zap.Error(err))
+	}
+}
+
+// occurrences returns the start times of the occurrences of the recurring
+// event e that start before the end of the import window, in order.
+func (imp *calendarImport) occurrences(logger *zap.Logger, e *icsEvent) []time.Time {
+	excluded := make(map[int64]bool)
+	for _, t := range e.exdates {
+		excluded[t.Unix()] = true
+	}
+
+	var starts []time.Time
+	add := func(t time.Time) bool {
+		if !excluded[t.Unix()] {
+			starts = append(starts, t)
+		}
+		if len(starts) >= maxOccurrences {
+			logger.Warn("event has too many occurrences; ignoring the rest",
+				zap.Int("max", maxOccurrences),
+				zap.Time("last", t))
+			return false
+		}
+		return true
+	}
+
+	if e.rrule == "" {
+		add(e.start)
+	} else if rule, err := parseRecurrenceRule(e.rrule); err != nil {
+		logger.Warn("unable to expand recurring event; importing only its first occurrence",
+			zap.String("rrule", e.rrule),
+			zap.Error(err))
+		add(e.start)
+	} else {
+		rule.occurrences(e.start, imp.until, add)
+	}
+	for _, t := range e.rdates {
+		if !t.After(imp.until) && len(starts) < maxOccurrences {
+			add(t)
+		}
+	}
+
+	slices.SortFunc(starts, func(a, b time.Time) int { return a.Compare(b) })
+	return slices.CompactFunc(starts, func(a, b time.Time) bool { return a.Equal(b) })
+}
+
+// cancelOccurrence marks the occurrence of the event with the given UID
+// that was originally scheduled for recurrenceID as canceled. If the
+// event is known, the whole item is updated from it; otherwise (for
+// example, if it was deleted), only the item's metadata is replaced.
+func (imp *calendarImport) cancelOccurrence(master *icsEvent, uid string, recurrenceID time.Time, allDay bool) {
+	id := occurrenceID(uid, recurrenceID, allDay)
+	if master != nil {
+		canceled := *master
+		canceled.status = statusCancelled
+		imp.sendEvent(&canceled, id, recurrenceID, recurrenceID.Add(master.duration()))
+		return
+	}
+	item := &timeline.Item{
+		ID:             id,
+		Classification: timeline.ClassEvent,
+		Timestamp:      recurrenceID,
+		Metadata:       timeline.Metadata{"Status": strings.ToLower(statusCancelled)},
+	}
+	item.Retrieval.SetKey(retrievalKey(id))
+	item.Retrieval.PreferFields = []string{"metadata"}
+	imp.params.Pipeline <- &timeline.Graph{Item: item}
+}
+
+// cancelEvent marks the upcoming occurrences of the event with the given
+// UID, which no longer exists, as canceled.
+func (imp *calendarImport) cancelEvent(uid string) {
+	var prev eventState
+	if ok, err := imp.params.State.Load(eventStateKey(uid), &prev); !ok || err != nil {
+		return
+	}
+	for _, key := range prev.Upcoming {
+		if recurrenceID := time.Unix(key, 0); !recurrenceID.Before(imp.now) {
+			imp.cancelOccurrence(nil, uid, recurrenceID, prev.AllDay)
+		}
+	}
+	imp.saveState(uid, eventState{Sequence: prev.Sequence})
+}
+
+// sendEvent sends an item for (an occurrence of) the event e, with the
+// given ID, start, and end, down the pipeline.
+func (imp *calendarImport) sendEvent(e *icsEvent, id string, start, end time.Time) {
+	var loc timeline.Location
+	if e.lat != nil && e.lon != nil {
+		loc.Latitude = e.lat
+		loc.Longitude = e.lon
+	}
+
+	// if no organizer/owner is specified, we default to the configured entity
+	owner := imp.defaultOwner
+	if e.organizer != nil {
+		owner = personEntity(*e.organizer)
+	}
+
+	content := strings.TrimSpace(e.summary)
+	if e.description != "" {
+		if content != "" {
+			content += "\n"
+		}
+		content += strings.TrimSpace(e.description)
+	}
+
+	if e.allDay && !end.IsZero() {
+		// the end date of all-day events is exclusive
+		end = end.Add(-time.Millisecond)
+	}
+	if !end.After(start) {
+		end = time.Time{}
+	}
+
+	item := &timeline.Item{
+		ID:             id,
+		Classification: timeline.ClassEvent,
+		Timestamp:      start,
+		Timespan:       end,
+		Location:       loc,
+		Owner:          owner,
+		Content: timeline.ItemData{
+			MediaType: "text/plain",
+			Data:      timeline.StringData(content),
+		},
+		Metadata: timeline.Metadata{
+			"Location": e.location,
+			"Class":    e.class,
+			"Status":   strings.ToLower(e.status),
+			"URL":      e.url,
+			"Calendar": e.calendarName,
+		},
+	}
+	if id != "" {
+		// so that updates to the event (including cancellations) replace what was imported before
+		item.Retrieval.SetKey(retrievalKey(id))
+		item.Retrieval.PreferFields = []string{"timestamp", "timespan", "data", "metadata", "location"}
+	}
+
+	ig := &timeline.Graph{Item: item}
+	for _, attendee := range e.attendees {
+		if attendee.name == "" && attendee.email == "" {
+			continue
+		}
+		entity := personEntity(attendee)
+		ig.ToEntityWithValue(timeline.RelAttendee, &entity, strings.ToLower(attendee.partStat))
+	}
+
+	imp.params.Pipeline <- ig
+}
+
+// personEntity returns the entity of an organizer or attendee.
+func personEntity(p icsPerson) timeline.Entity {
+	entity := timeline.Entity{Name: p.name}
+	if p.email != "" {
+		entity.Attributes = []timeline.Attribute{
+			{
+				Name:     timeline.AttributeEmail,
+				Value:    p.email,
+				Identity: true,
+			},
+		}
+	}
+	return entity
+}
+
+// occurrenceID returns the item ID of the occurrence of a recurring event
+// that was originally scheduled for recurrenceID.
+func occurrenceID(uid string, recurrenceID time.Time, allDay bool) string {
+	if allDay {
+		return uid + "/" + recurrenceID.Format("20060102")
+	}
+	return uid + "/" + recurrenceID.UTC().Format("20060102T150405Z")
 }
 
+// retrievalKey returns the retrieval key of the item with the given ID.
+// It is the same across the calendar data sources, so that a calendar
+// that is imported both from files and from a server has one item for
+// each event.
+func retrievalKey(id string) string { return "calendar:" + id }
+
+const statusCancelled = "CANCELLED"
+
+const (
+	// how far into the future recurring events are expanded, if the import has no timeframe
+	defaultFutureWindow = 365 * 24 * time.Hour
+
+	// the most occurrences of one recurring event that are imported
+	maxOccurrences = 10000
+)
+
 const extIcs = ".ics"
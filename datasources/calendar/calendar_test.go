@@ -0,0 +1,248 @@
+package calendar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/timelinize/timelinize/timeline"
+	"go.uber.org/zap"
+)
+
+func TestRecurrenceRule(t *testing.T) {
+	for i, tc := range []struct {
+		dtstart string
+		rule    string
+		end     string // 10 years after dtstart if empty
+		expect  []string
+	}{
+		{
+			dtstart: "2024-01-01",
+			rule:    "FREQ=DAILY;COUNT=3",
+			expect:  []string{"2024-01-01", "2024-01-02", "2024-01-03"},
+		},
+		{
+			dtstart: "2024-01-01",
+			rule:    "FREQ=WEEKLY;BYDAY=MO,WE;UNTIL=20240110",
+			expect:  []string{"2024-01-01", "2024-01-03", "2024-01-08", "2024-01-10"},
+		},
+		{
+			dtstart: "2024-01-01",
+			rule:    "FREQ=WEEKLY;INTERVAL=2;COUNT=3",
+			expect:  []string{"2024-01-01", "2024-01-15", "2024-01-29"},
+		},
+		{
+			dtstart: "2024-01-26",
+			rule:    "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3",
+			expect:  []string{"2024-01-26", "2024-02-23", "2024-03-29"},
+		},
+		{
+			dtstart: "2024-01-31",
+			rule:    "FREQ=MONTHLY;COUNT=3",
+			expect:  []string{"2024-01-31", "2024-03-31", "2024-05-31"},
+		},
+		{
+			dtstart: "2024-01-31",
+			rule:    "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1;COUNT=3",
+			expect:  []string{"2024-01-31", "2024-02-29", "2024-03-29"},
+		},
+		{
+			dtstart: "2024-11-28",
+			rule:    "FREQ=YEARLY;BYMONTH=11;BYDAY=4TH;COUNT=3",
+			expect:  []string{"2024-11-28", "2025-11-27", "2026-11-26"},
+		},
+		{
+			dtstart: "2024-02-29",
+			rule:    "FREQ=YEARLY;COUNT=2",
+			expect:  []string{"2024-02-29", "2028-02-29"},
+		},
+		{
+			dtstart: "2024-01-01",
+			rule:    "FREQ=DAILY;BYDAY=SA,SU",
+			end:     "2024-01-08",
+			expect:  []string{"2024-01-01", "2024-01-06", "2024-01-07"},
+		},
+	} {
+		rule, err := parseRecurrenceRule(tc.rule)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		dtstart, _ := time.Parse(time.DateOnly, tc.dtstart)
+		dtstart = dtstart.Add(9 * time.Hour)
+
+		end := dtstart.AddDate(10, 0, 0)
+		if tc.end != "" {
+			end, _ = time.Parse(time.DateOnly, tc.end)
+		}
+
+		var actual []string
+		rule.occurrences(dtstart, end, func(t time.Time) bool {
+			actual = append(actual, t.Format(time.DateOnly))
+			return true
+		})
+		if strings.Join(actual, " ") != strings.Join(tc.expect, " ") {
+			t.Errorf("test %d (%s): expected %v, got %v", i, tc.rule, tc.expect, actual)
+		}
+	}
+}
+
+func TestFileImport(t *testing.T) {
+	// the first Monday of next year, so that the occurrences are upcoming
+	start := time.Date(time.Now().Year()+1, time.January, 1, 10, 0, 0, 0, time.UTC)
+	for start.Weekday() != time.Monday {
+		start = start.AddDate(0, 0, 1)
+	}
+	week := func(n int) string { return start.AddDate(0, 0, 7*n).Format("20060102T150405Z") }
+	standupID := func(n int) string { return "standup/" + week(n) }
+
+	original := fmt.Sprintf(`BEGIN:VCALENDAR
+VERSION:2.0
+X-WR-CALNAME:Work
+BEGIN:VEVENT
+UID:standup
+SEQUENCE:0
+DTSTART:%[1]s
+DURATION:PT15M
+RRULE:FREQ=WEEKLY;COUNT=4
+EXDATE:%[2]s
+SUMMARY:Standup
+ORGANIZER;CN=Bob:mailto:bob@example.com
+ATTENDEE;CN="Alice, A.";PARTSTAT=ACCEPTED:mailto:alice@example.com
+BEGIN:VALARM
+SUMMARY:Not the event
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+UID:standup
+RECURRENCE-ID:%[3]s
+DTSTART:%[3]s
+DTEND:%[4]s
+SUMMARY:Standup
+  (moved)
+END:VEVENT
+BEGIN:VEVENT
+UID:lunch
+DTSTART;VALUE=DATE:20200101
+SUMMARY:Lunch\, with friends
+END:VEVENT
+END:VCALENDAR
+`, week(0), week(1), week(2), start.AddDate(0, 0, 14).Add(time.Hour).Format("20060102T150405Z"))
+
+	// the series was shortened, and the moved occurrence is gone with it
+	updated := fmt.Sprintf(`BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:standup
+SEQUENCE:1
+DTSTART:%s
+DURATION:PT15M
+RRULE:FREQ=WEEKLY;COUNT=2
+SUMMARY:Standup
+END:VEVENT
+END:VCALENDAR
+`, week(0))
+
+	var saved map[string]json.RawMessage
+	runImport := func(ics string) []*timeline.Graph {
+		t.Helper()
+		pipeline := make(chan *timeline.Graph, 10)
+		state := timeline.NewImportState(saved)
+		err := new(FileImporter).FileImport(context.Background(), timeline.DirEntry{
+			FS:       fstest.MapFS{"cal.ics": {Data: []byte(strings.ReplaceAll(ics, "\n", "\r\n"))}},
+			Filename: "cal.ics",
+		}, timeline.ImportParams{
+			Pipeline:          pipeline,
+			Log:               zap.NewNop(),
+			DataSourceOptions: new(Options),
+			State:             state,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		close(pipeline)
+		var graphs []*timeline.Graph
+		for g := range pipeline {
+			graphs = append(graphs, g)
+		}
+		if saved == nil {
+			saved = make(map[string]json.RawMessage)
+		}
+		for k, v := range state.Pending() {
+			saved[k] = v
+		}
+		return graphs
+	}
+	expectItems := func(graphs []*timeline.Graph, idsAndStatuses ...string) {
+		t.Helper()
+		if len(graphs) != len(idsAndStatuses)/2 {
+			t.Fatalf("expected %d items, got %d", len(idsAndStatuses)/2, len(graphs))
+		}
+		for i, g := range graphs {
+			id, status := idsAndStatuses[2*i], idsAndStatuses[2*i+1]
+			if g.Item.ID != id || g.Item.Metadata["Status"] != status {
+				t.Errorf("expected item %d to be %s (status %q), got %s (status %q)",
+					i, id, status, g.Item.ID, g.Item.Metadata["Status"])
+			}
+		}
+	}
+
+	// occurrences are expanded, except the excluded one, and the moved one is updated
+	graphs := runImport(original)
+	expectItems(graphs,
+		standupID(0), "",
+		standupID(2), "",
+		standupID(3), "",
+		"lunch", "")
+	if ts := graphs[1].Item.Timestamp; !ts.Equal(start.AddDate(0, 0, 14)) {
+		t.Errorf("expected moved occurrence to start at the overridden time, got %s", ts)
+	}
+	if content := itemContent(t, graphs[1].Item); content != "Standup (moved)" {
+		t.Errorf("expected content of moved occurrence, got %q", content)
+	}
+	if content := itemContent(t, graphs[3].Item); content != "Lunch, with friends" {
+		t.Errorf("expected unescaped content, got %q", content)
+	}
+	if end := graphs[2].Item.Timespan; !end.Equal(start.AddDate(0, 0, 21).Add(15 * time.Minute)) {
+		t.Errorf("expected occurrence to last 15 minutes, got end %s", end)
+	}
+	if owner := graphs[0].Item.Owner; owner.Name != "Bob" || owner.Attributes[0].Value != "bob@example.com" {
+		t.Errorf("expected organizer to be owner, got %+v", owner)
+	}
+	if len(graphs[0].Edges) != 1 ||
+		graphs[0].Edges[0].Relation != timeline.RelAttendee ||
+		graphs[0].Edges[0].To.Entity.Name != "Alice, A." ||
+		graphs[0].Edges[0].Value != "accepted" {
+		t.Errorf("expected attendee, got %+v", graphs[0].Edges)
+	}
+	if cal := graphs[0].Item.Metadata["Calendar"]; cal != "Work" {
+		t.Errorf("expected calendar name, got %v", cal)
+	}
+
+	// occurrences that disappeared are canceled (and the excluded one is back)
+	expectItems(runImport(updated),
+		standupID(0), "",
+		standupID(1), "",
+		standupID(2), "cancelled",
+		standupID(3), "cancelled")
+
+	// an older version of the event is stale
+	expectItems(runImport(original), "lunch", "")
+}
+
+func itemContent(t *testing.T, it *timeline.Item) string {
+	t.Helper()
+	rc, err := it.Content.Data(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
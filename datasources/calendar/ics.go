@@ -0,0 +1,349 @@
+package calendar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apognu/gocal/parser"
+)
+
+// icsEvent is an event (VEVENT) from an iCalendar object (RFC 5545),
+// with the properties this data source uses.
+type icsEvent struct {
+	uid      string
+	sequence int
+
+	// set if this event overrides one occurrence of a recurring event
+	recurrenceID time.Time
+
+	start, end time.Time
+	allDay     bool
+	rrule      string
+	rdates     []time.Time
+	exdates    []time.Time
+
+	status       string // TENTATIVE, CONFIRMED, or CANCELLED
+	summary      string
+	description  string
+	location     string
+	class        string
+	url          string
+	calendarName string // of the calendar the event is in, if known
+	lat, lon     *float64
+
+	organizer *icsPerson
+	attendees []icsPerson
+}
+
+// icsPerson is an organizer or attendee of an event.
+type icsPerson struct {
+	name     string
+	email    string
+	partStat string // participation status, like ACCEPTED or DECLINED
+}
+
+// recurring returns true if the event has more than one occurrence.
+func (e *icsEvent) recurring() bool {
+	return e.rrule != "" || len(e.rdates) > 0
+}
+
+// parseICS reads the events in an iCalendar stream, which may have more
+// than one calendar in it. Properties that can't be parsed are skipped,
+// as are events without a start time.
+func parseICS(r io.Reader) ([]*icsEvent, error) {
+	var (
+		events       []*icsEvent
+		event        *icsEvent
+		components   []string // stack of the components we're in
+		calendarName string
+	)
+
+	err := readICSLines(r, func(line string) {
+		prop, ok := parseICSProperty(line)
+		if !ok {
+			return
+		}
+		switch prop.name {
+		case "BEGIN":
+			components = append(components, strings.ToUpper(prop.value))
+			if len(components) == 2 && components[1] == "VEVENT" {
+				event = &icsEvent{calendarName: calendarName}
+			}
+			return
+		case "END":
+			if len(components) == 0 {
+				return
+			}
+			if len(components) == 2 && components[1] == "VEVENT" && event != nil {
+				if event.finish() {
+					events = append(events, event)
+				}
+				event = nil
+			}
+			if len(components) == 1 {
+				calendarName = ""
+			}
+			components = components[:len(components)-1]
+			return
+		}
+
+		switch {
+		case len(components) == 1 && prop.name == "X-WR-CALNAME":
+			calendarName = unescapeICSText(prop.value)
+		case len(components) == 2 && event != nil:
+			// properties of nested components, like alarms, are not the event's
+			event.set(prop)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// set sets the event property prop.
+func (e *icsEvent) set(prop icsProperty) {
+	switch prop.name {
+	case "UID":
+		e.uid = prop.value
+	case "SEQUENCE":
+		e.sequence, _ = strconv.Atoi(prop.value)
+	case "RECURRENCE-ID":
+		e.recurrenceID, _, _ = parseICSTime(prop.value, prop.params)
+	case "DTSTART":
+		e.start, e.allDay, _ = parseICSTime(prop.value, prop.params)
+	case "DTEND":
+		e.end, _, _ = parseICSTime(prop.value, prop.params)
+	case "DURATION":
+		if !e.start.IsZero() && e.end.IsZero() {
+			if dur, err := parser.ParseDuration(prop.value); err == nil {
+				e.end = e.start.Add(*dur)
+			}
+		}
+	case "RRULE":
+		e.rrule = prop.value
+	case "RDATE":
+		e.rdates = append(e.rdates, parseICSTimes(prop)...)
+	case "EXDATE":
+		e.exdates = append(e.exdates, parseICSTimes(prop)...)
+	case "STATUS":
+		e.status = strings.ToUpper(prop.value)
+	case "SUMMARY":
+		e.summary = unescapeICSText(prop.value)
+	case "DESCRIPTION":
+		e.description = unescapeICSText(prop.value)
+	case "LOCATION":
+		e.location = unescapeICSText(prop.value)
+	case "CLASS":
+		e.class = prop.value
+	case "URL":
+		e.url = prop.value
+	case "GEO":
+		lat, lon, ok := strings.Cut(prop.value, ";")
+		if !ok {
+			return
+		}
+		latF, err1 := strconv.ParseFloat(lat, 64)
+		lonF, err2 := strconv.ParseFloat(lon, 64)
+		if err1 == nil && err2 == nil {
+			e.lat, e.lon = &latF, &lonF
+		}
+	case "ORGANIZER":
+		p := parseICSPerson(prop)
+		e.organizer = &p
+	case "ATTENDEE":
+		e.attendees = append(e.attendees, parseICSPerson(prop))
+	}
+}
+
+// finish fills in implied values after all properties have been set,
+// and returns false if the event is not usable.
+func (e *icsEvent) finish() bool {
+	if e.start.IsZero() {
+		return false
+	}
+	if e.end.IsZero() && e.allDay {
+		// "the event's duration is taken to be one day" (RFC 5545 §3.6.1)
+		e.end = e.start.AddDate(0, 0, 1)
+	}
+	if e.end.Before(e.start) {
+		e.end = time.Time{}
+	}
+	return true
+}
+
+// duration returns how long the event lasts.
+func (e *icsEvent) duration() time.Duration {
+	if e.end.IsZero() {
+		return 0
+	}
+	return e.end.Sub(e.start)
+}
+
+// icsProperty is a content line of an iCalendar object.
+type icsProperty struct {
+	name   string // upper-case
+	params map[string]string
+	value  string
+}
+
+// readICSLines calls handle with each unfolded content line read from r.
+func readICSLines(r io.Reader, handle func(string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxICSLineLength)
+
+	var line strings.Builder
+	for scanner.Scan() {
+		physical := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.HasPrefix(physical, " ") || strings.HasPrefix(physical, "\t") {
+			// folded line (RFC 5545 §3.1)
+			line.WriteString(physical[1:])
+			continue
+		}
+		if line.Len() > 0 {
+			handle(line.String())
+			line.Reset()
+		}
+		line.WriteString(physical)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading iCalendar data: %w", err)
+	}
+	if line.Len() > 0 {
+		handle(line.String())
+	}
+	return nil
+}
+
+// parseICSProperty parses an unfolded content line, which looks like
+// "NAME;PARAM=value;PARAM="quoted value":value".
+func parseICSProperty(line string) (icsProperty, bool) {
+	// the value starts after the first colon that isn't in a quoted parameter value
+	var quoted bool
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return icsProperty{}, false
+	}
+
+	prop := icsProperty{value: line[colon+1:]}
+	parts := splitUnquoted(line[:colon], ';')
+	prop.name = strings.ToUpper(strings.TrimSpace(parts[0]))
+	for _, param := range parts[1:] {
+		key, val, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		if prop.params == nil {
+			prop.params = make(map[string]string)
+		}
+		prop.params[strings.ToUpper(key)] = strings.ReplaceAll(val, `"`, "")
+	}
+
+	return prop, prop.name != ""
+}
+
+// splitUnquoted splits s around each sep that is not in double quotes.
+func splitUnquoted(s string, sep rune) []string {
+	var parts []string
+	var quoted bool
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseICSTime parses a DATE or DATE-TIME value. Dates (all-day values)
+// and times without a time zone ("floating" times) are in the local time
+// zone, as are times in a time zone that isn't known.
+func parseICSTime(value string, params map[string]string) (t time.Time, date bool, err error) {
+	value = strings.TrimSpace(value)
+	if params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err = time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	loc := time.Local
+	if tzid := params["TZID"]; tzid != "" {
+		if tz, err := parser.LoadTimezone(strings.TrimPrefix(tzid, "/")); err == nil {
+			loc = tz
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// parseICSTimes parses the comma-separated times of an RDATE or EXDATE
+// property; for periods, only the start times are used.
+func parseICSTimes(prop icsProperty) []time.Time {
+	var times []time.Time
+	for _, value := range strings.Split(prop.value, ",") {
+		value, _, _ = strings.Cut(value, "/")
+		if t, _, err := parseICSTime(value, prop.params); err == nil {
+			times = append(times, t)
+		}
+	}
+	return times
+}
+
+// parseICSPerson parses a calendar user, like an attendee.
+func parseICSPerson(prop icsProperty) icsPerson {
+	p := icsPerson{
+		name:     prop.params["CN"],
+		email:    prop.params["EMAIL"],
+		partStat: strings.ToUpper(prop.params["PARTSTAT"]),
+	}
+	if p.email == "" && len(prop.value) > len("mailto:") && strings.EqualFold(prop.value[:len("mailto:")], "mailto:") {
+		p.email = prop.value[len("mailto:"):]
+	}
+	return p
+}
+
+// unescapeICSText unescapes a TEXT value (RFC 5545 §3.3.11).
+func unescapeICSText(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+// maxICSLineLength is the longest physical line that is read; folded
+// lines are usually no longer than 75 bytes, but not everything folds
+// long lines (like inline attachments).
+const maxICSLineLength = 16 * 1024 * 1024
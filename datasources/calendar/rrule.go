@@ -0,0 +1,337 @@
+package calendar
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recurrenceRule is a parsed RRULE value (RFC 5545 §3.3.10). Frequencies
+// more often than daily are not supported, nor are the BYHOUR, BYMINUTE,
+// BYSECOND, BYWEEKNO, and BYYEARDAY parts, which are rarely used for
+// events in people's calendars.
+type recurrenceRule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time // inclusive
+	byMonth    []int
+	byMonthDay []int
+	byDay      []weekdayRule
+	bySetPos   []int
+	weekStart  time.Weekday
+}
+
+// weekdayRule is a BYDAY value, like "MO" (every Monday) or "-1FR" (the
+// last Friday of the month or year).
+type weekdayRule struct {
+	n   int // 0 for every such weekday
+	day time.Weekday
+}
+
+// Values of recurrenceRule.freq.
+const (
+	freqDaily   = "DAILY"
+	freqWeekly  = "WEEKLY"
+	freqMonthly = "MONTHLY"
+	freqYearly  = "YEARLY"
+)
+
+func parseRecurrenceRule(rule string) (recurrenceRule, error) {
+	r := recurrenceRule{interval: 1, weekStart: time.Monday}
+	for _, part := range strings.Split(rule, ";") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.freq = strings.ToUpper(val)
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(val)
+			if err == nil && r.interval < 1 {
+				err = fmt.Errorf("invalid interval %d", r.interval)
+			}
+		case "COUNT":
+			r.count, err = strconv.Atoi(val)
+		case "UNTIL":
+			var date bool
+			r.until, date, err = parseICSTime(val, nil)
+			if date {
+				r.until = r.until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+		case "BYMONTH":
+			r.byMonth, err = parseInts(val, 1, 12)
+		case "BYMONTHDAY":
+			r.byMonthDay, err = parseInts(val, 1, 31)
+		case "BYSETPOS":
+			r.bySetPos, err = parseInts(val, 1, 366)
+		case "BYDAY":
+			for _, v := range strings.Split(val, ",") {
+				var wd weekdayRule
+				if wd, err = parseWeekdayRule(v); err != nil {
+					break
+				}
+				r.byDay = append(r.byDay, wd)
+			}
+		case "WKST":
+			var wd weekdayRule
+			wd, err = parseWeekdayRule(val)
+			r.weekStart = wd.day
+		case "BYHOUR", "BYMINUTE", "BYSECOND", "BYWEEKNO", "BYYEARDAY":
+			err = fmt.Errorf("%s is not supported", key)
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid recurrence rule %s: %w", part, err)
+		}
+	}
+	switch r.freq {
+	case freqDaily, freqWeekly, freqMonthly, freqYearly:
+	default:
+		return r, fmt.Errorf("unsupported recurrence frequency: %q", r.freq)
+	}
+	return r, nil
+}
+
+// parseInts parses a list of integers whose absolute values are within min and max.
+func parseInts(list string, minVal, maxVal int) ([]int, error) {
+	var ints []int
+	for _, v := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		if abs := max(n, -n); abs < minVal || abs > maxVal {
+			return nil, fmt.Errorf("value out of range: %d", n)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+func parseWeekdayRule(s string) (weekdayRule, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) < 2 {
+		return weekdayRule{}, fmt.Errorf("invalid weekday: %q", s)
+	}
+	day, ok := weekdays[s[len(s)-2:]]
+	if !ok {
+		return weekdayRule{}, fmt.Errorf("invalid weekday: %q", s)
+	}
+	wd := weekdayRule{day: day}
+	if s = s[:len(s)-2]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return weekdayRule{}, fmt.Errorf("invalid weekday: %q", s)
+		}
+		wd.n = n
+	}
+	return wd, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// occurrences calls yield with the start time of each occurrence, in
+// order, of the recurring event that starts at dtstart, until yield
+// returns false, the rule ends, or the next occurrence would start after
+// end. The first occurrence is always dtstart. Occurrences are at the
+// same wall clock time as dtstart, in its time zone.
+func (r recurrenceRule) occurrences(dtstart, end time.Time, yield func(time.Time) bool) {
+	if !yield(dtstart) {
+		return
+	}
+	emitted := 1
+
+	for period := 1; ; period++ {
+		candidates, periodStart := r.expand(dtstart, period-1)
+		if periodStart.After(end) || (!r.until.IsZero() && periodStart.After(r.until)) {
+			return
+		}
+		for _, t := range candidates {
+			if !t.After(dtstart) {
+				continue
+			}
+			if t.After(end) || (!r.until.IsZero() && t.After(r.until)) {
+				return
+			}
+			if r.count > 0 && emitted >= r.count {
+				return
+			}
+			if !yield(t) {
+				return
+			}
+			emitted++
+		}
+	}
+}
+
+// expand returns the times in the given period of the rule (0 being the
+// period that contains dtstart), in order, and the start of the period.
+func (r recurrenceRule) expand(dtstart time.Time, period int) ([]time.Time, time.Time) {
+	y, m, d := dtstart.Date()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, dtstart.Location())
+	}
+	midnight := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, dtstart.Location())
+	}
+
+	var days []time.Time // at midnight
+	var periodStart time.Time
+
+	switch r.freq {
+	case freqDaily:
+		periodStart = midnight(y, m, d+period*r.interval)
+		if r.matchesMonth(periodStart.Month()) &&
+			r.matchesMonthDay(periodStart) &&
+			r.matchesWeekday(periodStart.Weekday()) {
+			days = append(days, periodStart)
+		}
+
+	case freqWeekly:
+		offset := (int(dtstart.Weekday()) - int(r.weekStart) + 7) % 7
+		periodStart = midnight(y, m, d-offset+7*period*r.interval)
+		for i := range 7 {
+			day := periodStart.AddDate(0, 0, i)
+			if len(r.byDay) == 0 && day.Weekday() != dtstart.Weekday() {
+				continue
+			}
+			if r.matchesWeekday(day.Weekday()) && r.matchesMonth(day.Month()) && r.matchesMonthDay(day) {
+				days = append(days, day)
+			}
+		}
+
+	case freqMonthly:
+		periodStart = midnight(y, m+time.Month(period*r.interval), 1)
+		if r.matchesMonth(periodStart.Month()) {
+			days = r.monthDays(periodStart, d)
+		}
+
+	case freqYearly:
+		periodStart = midnight(y+period*r.interval, time.January, 1)
+		switch {
+		case len(r.byMonth) > 0:
+			for month := time.January; month <= time.December; month++ {
+				if r.matchesMonth(month) {
+					days = append(days, r.monthDays(midnight(periodStart.Year(), month, 1), d)...)
+				}
+			}
+		case len(r.byDay) > 0:
+			days = r.yearDays(periodStart)
+		case len(r.byMonthDay) > 0:
+			for month := time.January; month <= time.December; month++ {
+				days = append(days, r.monthDays(midnight(periodStart.Year(), month, 1), d)...)
+			}
+		default:
+			if day := midnight(periodStart.Year(), m, d); day.Day() == d {
+				days = append(days, day)
+			}
+		}
+	}
+
+	if len(r.bySetPos) > 0 {
+		var selected []time.Time
+		for _, pos := range r.bySetPos {
+			if pos > 0 && pos <= len(days) {
+				selected = append(selected, days[pos-1])
+			} else if pos < 0 && -pos <= len(days) {
+				selected = append(selected, days[len(days)+pos])
+			}
+		}
+		slices.SortFunc(selected, func(a, b time.Time) int { return a.Compare(b) })
+		days = slices.CompactFunc(selected, func(a, b time.Time) bool { return a.Equal(b) })
+	}
+
+	times := make([]time.Time, len(days))
+	for i, day := range days {
+		times[i] = at(day.Date())
+	}
+	return times, periodStart
+}
+
+// monthDays returns the days in the month that starts at first which
+// match the BYMONTHDAY and BYDAY parts of the rule, or the given day of
+// the month if there are neither.
+func (r recurrenceRule) monthDays(first time.Time, day int) []time.Time {
+	daysInMonth := first.AddDate(0, 1, -1).Day()
+	if len(r.byMonthDay) == 0 && len(r.byDay) == 0 {
+		if day > daysInMonth {
+			return nil
+		}
+		return []time.Time{first.AddDate(0, 0, day-1)}
+	}
+
+	var days []time.Time
+	for i := range daysInMonth {
+		date := first.AddDate(0, 0, i)
+		if !r.matchesMonthDay(date) {
+			continue
+		}
+		nth, nthLast := i/7+1, -((daysInMonth-i-1)/7 + 1)
+		if len(r.byDay) > 0 && !r.matchesNthWeekday(date.Weekday(), nth, nthLast) {
+			continue
+		}
+		days = append(days, date)
+	}
+	return days
+}
+
+// yearDays returns the days in the year that starts at first which match
+// the BYDAY (and BYMONTHDAY) parts of the rule, with the ordinals of BYDAY
+// relative to the year.
+func (r recurrenceRule) yearDays(first time.Time) []time.Time {
+	daysInYear := first.AddDate(1, 0, -1).YearDay()
+	var days []time.Time
+	for i := range daysInYear {
+		date := first.AddDate(0, 0, i)
+		nth, nthLast := i/7+1, -((daysInYear-i-1)/7 + 1)
+		if r.matchesNthWeekday(date.Weekday(), nth, nthLast) && r.matchesMonthDay(date) {
+			days = append(days, date)
+		}
+	}
+	return days
+}
+
+func (r recurrenceRule) matchesMonth(month time.Month) bool {
+	return len(r.byMonth) == 0 || slices.Contains(r.byMonth, int(month))
+}
+
+func (r recurrenceRule) matchesMonthDay(date time.Time) bool {
+	if len(r.byMonthDay) == 0 {
+		return true
+	}
+	daysInMonth := time.Date(date.Year(), date.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, md := range r.byMonthDay {
+		if md == date.Day() || (md < 0 && daysInMonth+md+1 == date.Day()) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesWeekday returns true if the weekday is in BYDAY, ignoring ordinals.
+func (r recurrenceRule) matchesWeekday(day time.Weekday) bool {
+	if len(r.byDay) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.byDay, func(wd weekdayRule) bool { return wd.day == day })
+}
+
+// matchesNthWeekday returns true if the weekday, being the nth (and
+// nthLast from the end) such day of its month or year, is in BYDAY.
+func (r recurrenceRule) matchesNthWeekday(day time.Weekday, nth, nthLast int) bool {
+	return slices.ContainsFunc(r.byDay, func(wd weekdayRule) bool {
+		return wd.day == day && (wd.n == 0 || wd.n == nth || wd.n == nthLast)
+	})
+}
@@ -256,6 +256,7 @@ func itemGraphFromEnvelope(m message, opt timeline.ImportParams, dsOpt *Options)
 	}
 
 	item := &timeline.Item{
+		ID:             messageID(m.GetHeader("Message-ID")),
 		Classification: timeline.ClassEmail,
 		Timestamp:      m.timestamp(),
 		Owner:          m.firstFrom(),
@@ -278,6 +279,11 @@ func itemGraphFromEnvelope(m message, opt timeline.ImportParams, dsOpt *Options)
 		ig.ToEntity(timeline.RelCCed, &ccCopy)
 	}
 
+	// relate the message to the one it replies to, so conversations can be followed
+	if inReplyTo := messageID(m.GetHeader("In-Reply-To")); inReplyTo != "" {
+		ig.ToItem(timeline.RelReply, &timeline.Item{ID: inReplyTo})
+	}
+
 	// add attachments to graph
 	for i, attach := range m.Attachments {
 		// skip part if there are any severe errors
@@ -414,6 +420,20 @@ func (m message) to(fieldName string) []timeline.Entity {
 	return persons
 }
 
+// messageID returns the first message ID in the value of a Message-ID,
+// In-Reply-To, or References header, without the angle brackets.
+func messageID(header string) string {
+	start := strings.IndexByte(header, '<')
+	if start < 0 {
+		return strings.TrimSpace(header)
+	}
+	end := strings.IndexByte(header[start:], '>')
+	if end < 0 {
+		return strings.TrimSpace(header[start+1:])
+	}
+	return strings.TrimSpace(header[start+1 : start+end])
+}
+
 var (
 	nextMailboxMessage = []byte("From ") // prefix of line that separates messages in mailbox files
 	spaceBytes         = []byte{' '}
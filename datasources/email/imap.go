@@ -0,0 +1,334 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+	"github.com/timelinize/timelinize/timeline"
+	"go.uber.org/zap"
+)
+
+func init() {
+	err := timeline.RegisterDataSource(timeline.DataSource{
+		Name:           "imap",
+		Title:          "Email (IMAP)",
+		Icon:           "email.png",
+		NewOptions:     func() any { return new(IMAPOptions) },
+		NewAPIImporter: func() timeline.APIImporter { return new(IMAPImporter) },
+	})
+	if err != nil {
+		timeline.Log.Fatal("registering data source", zap.Error(err))
+	}
+}
+
+// IMAPOptions configures the IMAP data source. Since the options are saved
+// with the import job (and its schedule, if any), an app password that can
+// only read mail is recommended; the password is redacted when jobs and
+// schedules are listed.
+type IMAPOptions struct {
+	// The host of the mail server, with an optional port (993 by
+	// default, or 143 if the connection security is not "tls").
+	Server string `json:"server"`
+
+	// How the connection is secured: "tls" (the default), "starttls",
+	// or "none" (only for servers on the local machine).
+	Security string `json:"security,omitempty"`
+
+	Username string `json:"username"`
+	Password string `json:"password" sensitive:"true"`
+
+	// The mailboxes (folders) to import from; INBOX by default. If
+	// one is "*", all mailboxes are imported from.
+	Mailboxes []string `json:"mailboxes,omitempty"`
+}
+
+func (opt IMAPOptions) security() string {
+	if opt.Security == "" {
+		return imapSecurityTLS
+	}
+	return strings.ToLower(opt.Security)
+}
+
+// stateKey returns the key of the import state of mailbox.
+func (opt IMAPOptions) stateKey(mailbox string) string {
+	return strings.ToLower(opt.Username+"@"+opt.Server) + "/" + mailbox
+}
+
+// Values of IMAPOptions.Security.
+const (
+	imapSecurityTLS      = "tls"
+	imapSecurityStartTLS = "starttls"
+	imapSecurityNone     = "none"
+)
+
+// IMAPImporter imports messages and their attachments from a mail server
+// using IMAP. Each import of a mailbox remembers the next UID the server
+// will assign, so that later imports (such as scheduled ones) only fetch
+// messages that are new, unless the server resets the UIDs of the mailbox
+// (which it signals with a new UIDVALIDITY), in which case the whole
+// mailbox is read again; already-imported messages are recognized by
+// their Message-ID.
+type IMAPImporter struct{}
+
+// Authenticate checks that the server accepts the credentials.
+func (IMAPImporter) Authenticate(ctx context.Context, _ timeline.Account, dsOpt any) error {
+	opt := dsOpt.(*IMAPOptions)
+	c, err := opt.connect(ctx)
+	if err != nil {
+		return err
+	}
+	c.logout()
+	return nil
+}
+
+// APIImport imports messages from the configured mailboxes.
+func (IMAPImporter) APIImport(ctx context.Context, _ timeline.Account, params timeline.ImportParams) error {
+	opt := params.DataSourceOptions.(*IMAPOptions)
+
+	var chkpt imapCheckpoint
+	if params.Checkpoint != nil {
+		if err := json.Unmarshal(params.Checkpoint, &chkpt); err != nil {
+			return fmt.Errorf("decoding checkpoint: %w", err)
+		}
+	}
+
+	c, err := opt.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+
+	mailboxes := opt.Mailboxes
+	if len(mailboxes) == 0 {
+		mailboxes = []string{"INBOX"}
+	}
+	if slices.Contains(mailboxes, "*") {
+		if mailboxes, err = c.list(); err != nil {
+			return fmt.Errorf("listing mailboxes: %w", err)
+		}
+	}
+
+	imp := &imapImport{client: c, opt: opt, params: params, done: chkpt.Done}
+	for _, mailbox := range mailboxes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// mailboxes that were done before the import was interrupted
+		if state, ok := chkpt.Done[mailbox]; ok {
+			if err := imp.finishMailbox(mailbox, state); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var resumeAfter uint32
+		var resumeValidity uint32
+		if chkpt.Mailbox == mailbox {
+			resumeAfter, resumeValidity = chkpt.UID, chkpt.UIDValidity
+		}
+		err := imp.importMailbox(ctx, mailbox, resumeValidity, resumeAfter)
+		var statusErr imapStatusError
+		if errors.As(err, &statusErr) {
+			// the server refused something about this mailbox, but another one may be fine
+			params.Log.Error("importing mailbox", zap.String("mailbox", mailbox), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("importing mailbox %s: %w", mailbox, err)
+		}
+	}
+
+	return nil
+}
+
+// connect connects to the server and logs in.
+func (opt IMAPOptions) connect(ctx context.Context) (*imapClient, error) {
+	if opt.Server == "" || opt.Username == "" {
+		return nil, errors.New("server and username are required")
+	}
+	c, err := dialIMAP(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.login(opt.Username, opt.Password); err != nil {
+		c.logout()
+		return nil, fmt.Errorf("logging in: %w", err)
+	}
+	return c, nil
+}
+
+// imapMailboxState is the import state of a mailbox.
+type imapMailboxState struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	UIDNext     uint32 `json:"uid_next"` // messages with lesser UIDs have been imported
+}
+
+// imapCheckpoint is where an import is in the configured mailboxes.
+type imapCheckpoint struct {
+	// the states of the mailboxes that have been imported
+	Done map[string]imapMailboxState `json:"done,omitempty"`
+
+	// the last message sent from the mailbox being imported from
+	Mailbox     string `json:"mailbox,omitempty"`
+	UIDValidity uint32 `json:"uid_validity,omitempty"`
+	UID         uint32 `json:"uid,omitempty"`
+}
+
+// imapImport is an import in progress.
+type imapImport struct {
+	client *imapClient
+	opt    *IMAPOptions
+	params timeline.ImportParams
+
+	// states of the mailboxes that are done; replaced, never
+	// modified, since it is shared by checkpoints
+	done map[string]imapMailboxState
+}
+
+// importMailbox imports the messages in mailbox that are new since the
+// last import, or after the given UID if resuming from a checkpoint.
+func (imp *imapImport) importMailbox(ctx context.Context, mailbox string, resumeValidity, resumeAfter uint32) error {
+	logger := imp.params.Log.With(zap.String("mailbox", mailbox))
+
+	status, err := imp.client.examine(mailbox)
+	if err != nil {
+		return err
+	}
+
+	from := uint32(1)
+	var prev imapMailboxState
+	hasPrev, err := imp.params.State.Load(imp.opt.stateKey(mailbox), &prev)
+	if err != nil {
+		logger.Error("loading state of previous import; reading the whole mailbox", zap.Error(err))
+		hasPrev = false
+	}
+	switch {
+	case hasPrev && prev.UIDValidity == status.uidValidity:
+		if status.uidNext != 0 && status.uidNext <= prev.UIDNext {
+			logger.Debug("no new messages", zap.Uint32("uid_next", status.uidNext))
+			return imp.finishMailbox(mailbox, prev)
+		}
+		from = prev.UIDNext
+	case hasPrev:
+		logger.Warn("server reset the UIDs of the mailbox; reading the whole mailbox again",
+			zap.Uint32("previous_uid_validity", prev.UIDValidity),
+			zap.Uint32("uid_validity", status.uidValidity))
+	}
+	if resumeValidity == status.uidValidity && resumeAfter >= from {
+		from = resumeAfter + 1
+	}
+
+	var uids []uint32
+	if status.exists > 0 {
+		criteria := []any{"UID", strconv.FormatUint(uint64(from), 10) + ":*"}
+		if tf := imp.params.Timeframe; tf.Since != nil {
+			criteria = append(criteria, "SINCE", imapDate(*tf.Since))
+		}
+		if tf := imp.params.Timeframe; tf.Until != nil {
+			criteria = append(criteria, "BEFORE", imapDate(tf.Until.AddDate(0, 0, 1)))
+		}
+		if uids, err = imp.client.uidSearch(criteria...); err != nil {
+			return err
+		}
+		// "n:*" includes the greatest UID in the mailbox even if it is less than n
+		uids = slices.DeleteFunc(uids, func(uid uint32) bool { return uid < from })
+		slices.Sort(uids)
+	}
+	logger.Info("fetching messages", zap.Int("count", len(uids)), zap.Uint32("from_uid", from))
+
+	next := max(from, status.uidNext)
+	for chunk := range slices.Chunk(uids, imapFetchBatchSize) {
+		err := imp.client.uidFetch(chunk, func(msg imapMessage) error {
+			next = max(next, msg.uid+1)
+			imp.processMessage(mailbox, status.uidValidity, msg)
+			return ctx.Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// a search restricted to a timeframe may have skipped messages, so the
+	// next import should still look at all of them
+	if !imp.params.Timeframe.IsEmpty() {
+		return nil
+	}
+	return imp.finishMailbox(mailbox, imapMailboxState{UIDValidity: status.uidValidity, UIDNext: next})
+}
+
+// finishMailbox saves the state of mailbox after importing from it.
+func (imp *imapImport) finishMailbox(mailbox string, state imapMailboxState) error {
+	done := maps.Clone(imp.done)
+	if done == nil {
+		done = make(map[string]imapMailboxState)
+	}
+	done[mailbox] = state
+	imp.done = done
+	return imp.params.State.Save(imp.opt.stateKey(mailbox), state)
+}
+
+// processMessage sends the item graph of msg down the pipeline.
+func (imp *imapImport) processMessage(mailbox string, uidValidity uint32, msg imapMessage) {
+	logger := imp.params.Log.With(zap.String("mailbox", mailbox), zap.Uint32("uid", msg.uid))
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(msg.body))
+	if err != nil {
+		logger.Error("reading envelope", zap.Error(err))
+		return
+	}
+	m := message{
+		mboxName:          mailbox,
+		index:             int(msg.uid),
+		FromLineTimestamp: msg.internalDate,
+		Envelope:          env,
+	}
+	ig, err := itemGraphFromEnvelope(m, imp.params, new(Options))
+	if err != nil {
+		logger.Error("building item graph from envelope", zap.Error(err))
+		return
+	}
+	if ig == nil {
+		return
+	}
+	if ig.Item.ID == "" {
+		ig.Item.ID = fmt.Sprintf("%s:%d:%d", imp.opt.stateKey(mailbox), uidValidity, msg.uid)
+	}
+	ig.Item.Metadata["Mailbox"] = mailbox
+	ig.Checkpoint = imapCheckpoint{
+		Done:        imp.done,
+		Mailbox:     mailbox,
+		UIDValidity: uidValidity,
+		UID:         msg.uid,
+	}
+	imp.params.Pipeline <- ig
+}
+
+// imapFetchBatchSize is how many messages are fetched with each command.
+const imapFetchBatchSize = 25
@@ -0,0 +1,266 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package email
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/timelinize/timelinize/timeline"
+	"go.uber.org/zap"
+)
+
+func TestIMAPImport(t *testing.T) {
+	srv := newFakeIMAPServer(t, "me", "pässwörd")
+	srv.add(1, "a@example.com", "", "Hello")
+	srv.add(2, "b@example.com", "a@example.com", "Hi back")
+
+	opt := &IMAPOptions{
+		Server:   srv.addr,
+		Security: imapSecurityNone,
+		Username: "me",
+		Password: "pässwörd",
+	}
+
+	var saved map[string]json.RawMessage
+	runImport := func() []*timeline.Graph {
+		t.Helper()
+		pipeline := make(chan *timeline.Graph, 10)
+		state := timeline.NewImportState(saved)
+		err := new(IMAPImporter).APIImport(context.Background(), timeline.Account{}, timeline.ImportParams{
+			Pipeline:          pipeline,
+			Log:               zap.NewNop(),
+			DataSourceOptions: opt,
+			State:             state,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		close(pipeline)
+		var graphs []*timeline.Graph
+		for g := range pipeline {
+			graphs = append(graphs, g)
+		}
+		if saved == nil {
+			saved = make(map[string]json.RawMessage)
+		}
+		for k, v := range state.Pending() {
+			saved[k] = v
+		}
+		return graphs
+	}
+	expectIDs := func(graphs []*timeline.Graph, ids ...string) {
+		t.Helper()
+		if len(graphs) != len(ids) {
+			t.Fatalf("expected %d messages, got %d", len(ids), len(graphs))
+		}
+		for i, g := range graphs {
+			if g.Item.ID != ids[i] {
+				t.Errorf("expected message %d to have ID %s, got %s", i, ids[i], g.Item.ID)
+			}
+		}
+	}
+
+	// first import gets everything
+	graphs := runImport()
+	expectIDs(graphs, "a@example.com", "b@example.com")
+	var replyTo string
+	for _, edge := range graphs[1].Edges {
+		if edge.Relation == timeline.RelReply {
+			replyTo = edge.To.Item.ID
+		}
+	}
+	if replyTo != "a@example.com" {
+		t.Errorf("expected reply to a@example.com, got %q", replyTo)
+	}
+	if graphs[0].Item.Owner.Attributes[0].Value != "sender@example.com" {
+		t.Errorf("expected sender entity, got %+v", graphs[0].Item.Owner)
+	}
+
+	// later imports only get new messages
+	srv.add(5, "c@example.com", "b@example.com", "And again")
+	expectIDs(runImport(), "c@example.com")
+	expectIDs(runImport())
+
+	// if the server resets the UIDs, everything is read again
+	srv.mu.Lock()
+	srv.uidValidity++
+	srv.mu.Unlock()
+	expectIDs(runImport(), "a@example.com", "b@example.com", "c@example.com")
+
+	// wrong password
+	opt.Password = "nope"
+	if err := new(IMAPImporter).Authenticate(context.Background(), timeline.Account{}, opt); err == nil {
+		t.Error("expected error with wrong password")
+	}
+}
+
+// fakeIMAPServer serves one mailbox (INBOX) and only the commands used
+// by the data source.
+type fakeIMAPServer struct {
+	addr               string
+	username, password string
+
+	mu          sync.Mutex
+	uidValidity uint32
+	messages    []fakeIMAPMessage // sorted by UID
+}
+
+type fakeIMAPMessage struct {
+	uid  uint32
+	body string
+}
+
+func newFakeIMAPServer(t *testing.T, username, password string) *fakeIMAPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &fakeIMAPServer{addr: ln.Addr().String(), username: username, password: password, uidValidity: 7}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *fakeIMAPServer) add(uid uint32, messageID, inReplyTo, text string) {
+	body := "From: Sender <sender@example.com>\r\nTo: me@example.com\r\nSubject: Test\r\n" +
+		"Date: Mon, 02 Jan 2023 15:04:05 +0000\r\nMessage-ID: <" + messageID + ">\r\n"
+	if inReplyTo != "" {
+		body += "In-Reply-To: <" + inReplyTo + ">\r\n"
+	}
+	body += "Content-Type: text/plain\r\n\r\n" + text + "\r\n"
+	srv.mu.Lock()
+	srv.messages = append(srv.messages, fakeIMAPMessage{uid, body})
+	srv.mu.Unlock()
+}
+
+func (srv *fakeIMAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+
+	reply("* OK fake server ready")
+	for {
+		args, err := readFakeIMAPCommand(r, reply)
+		if err != nil {
+			return
+		}
+		tag, cmd := args[0], strings.ToUpper(strings.Join(args[1:min(3, len(args))], " "))
+
+		srv.mu.Lock()
+		switch {
+		case strings.HasPrefix(cmd, "LOGIN"):
+			if args[2] == srv.username && args[3] == srv.password {
+				reply("%s OK logged in", tag)
+			} else {
+				reply("%s NO wrong credentials", tag)
+			}
+		case strings.HasPrefix(cmd, "EXAMINE"):
+			var next uint32 = 1
+			if len(srv.messages) > 0 {
+				next = srv.messages[len(srv.messages)-1].uid + 1
+			}
+			reply("* %d EXISTS", len(srv.messages))
+			reply("* OK [UIDVALIDITY %d] UIDs valid", srv.uidValidity)
+			reply("* OK [UIDNEXT %d] predicted next UID", next)
+			reply("%s OK [READ-ONLY] examined", tag)
+		case cmd == "UID SEARCH":
+			// like real servers, "n:*" includes the last message even if its UID is less than n
+			from, _ := strconv.ParseUint(strings.TrimSuffix(args[4], ":*"), 10, 32)
+			var uids []string
+			for i, m := range srv.messages {
+				if m.uid >= uint32(from) || (i == len(srv.messages)-1 && len(uids) == 0) {
+					uids = append(uids, strconv.Itoa(int(m.uid)))
+				}
+			}
+			reply("* SEARCH %s", strings.Join(uids, " "))
+			reply("%s OK searched", tag)
+		case cmd == "UID FETCH":
+			for _, uidStr := range strings.Split(args[3], ",") {
+				uid, _ := strconv.ParseUint(uidStr, 10, 32)
+				for i, m := range srv.messages {
+					if m.uid == uint32(uid) {
+						reply("* %d FETCH (UID %d INTERNALDATE \" 2-Jan-2023 15:04:05 +0000\" BODY[] {%d}\r\n%s)",
+							i+1, m.uid, len(m.body), m.body)
+					}
+				}
+			}
+			reply("%s OK fetched", tag)
+		case cmd == "LOGOUT":
+			reply("* BYE")
+			reply("%s OK bye", tag)
+			srv.mu.Unlock()
+			return
+		default:
+			reply("%s BAD unknown command", tag)
+		}
+		srv.mu.Unlock()
+	}
+}
+
+// readFakeIMAPCommand reads a command and splits it into arguments,
+// unquoting quoted strings and reading literals.
+func readFakeIMAPCommand(r *bufio.Reader, reply func(string, ...any)) ([]string, error) {
+	var args []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+
+		var literalSize int
+		if end := strings.LastIndexByte(line, '{'); end >= 0 && strings.HasSuffix(line, "}") {
+			literalSize, _ = strconv.Atoi(line[end+1 : len(line)-1])
+			line = line[:end]
+		}
+		for _, field := range strings.Fields(line) {
+			args = append(args, strings.Trim(field, `"`))
+		}
+		if literalSize == 0 {
+			return args, nil
+		}
+
+		reply("+ go ahead")
+		literal := make([]byte, literalSize)
+		if _, err := io.ReadFull(r, literal); err != nil {
+			return nil, err
+		}
+		args = append(args, string(literal))
+	}
+}
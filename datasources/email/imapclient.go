@@ -0,0 +1,605 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package email
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapClient is a minimal IMAP4rev1 (RFC 3501) client that does only what
+// the IMAP data source needs: logging in, listing and examining mailboxes,
+// and searching for and fetching messages by UID. It is not safe for
+// concurrent use.
+type imapClient struct {
+	ctx  context.Context
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	tag  int
+	stop func() bool // stops the context watcher
+}
+
+// dialIMAP connects to the server in opt and reads its greeting. The
+// connection is closed if ctx is canceled.
+func dialIMAP(ctx context.Context, opt IMAPOptions) (*imapClient, error) {
+	security := opt.security()
+	addr := opt.Server
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "993"
+		if security != imapSecurityTLS {
+			port = "143"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %s: %w", opt.Server, err)
+	}
+	tlsConfig := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+
+	dialer := &net.Dialer{Timeout: imapTimeout}
+	var conn net.Conn
+	switch security {
+	case imapSecurityTLS:
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	case imapSecurityStartTLS, imapSecurityNone:
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	default:
+		return nil, fmt.Errorf("unknown connection security: %s", security)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+
+	c := &imapClient{ctx: ctx}
+	c.setConn(conn)
+
+	greeting, err := c.readResponse()
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("reading greeting: %w", err)
+	}
+	if greeting.tag != "*" || (greeting.status != "OK" && greeting.status != "PREAUTH") {
+		c.close()
+		return nil, fmt.Errorf("server refused connection: %s %s", greeting.status, greeting.text)
+	}
+
+	if security == imapSecurityStartTLS {
+		if _, err := c.command(nil, "STARTTLS"); err != nil {
+			c.close()
+			return nil, err
+		}
+		tlsConn := tls.Client(c.conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			c.close()
+			return nil, fmt.Errorf("TLS handshake: %w", err)
+		}
+		c.setConn(tlsConn)
+	}
+
+	return c, nil
+}
+
+// setConn makes the client use conn, which is closed if the context is canceled.
+func (c *imapClient) setConn(conn net.Conn) {
+	if c.stop != nil {
+		c.stop()
+	}
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	c.w = bufio.NewWriter(conn)
+	c.stop = context.AfterFunc(c.ctx, func() { conn.Close() })
+}
+
+func (c *imapClient) close() error {
+	c.stop()
+	return c.conn.Close()
+}
+
+// login authenticates with the server.
+func (c *imapClient) login(username, password string) error {
+	_, err := c.command(nil, "LOGIN", imapString(username), imapString(password))
+	return err
+}
+
+// logout ends the session and closes the connection.
+func (c *imapClient) logout() {
+	if c.ctx.Err() == nil {
+		_, _ = c.command(nil, "LOGOUT")
+	}
+	c.close()
+}
+
+// list returns the names of all mailboxes that can be selected.
+func (c *imapClient) list() ([]string, error) {
+	var mailboxes []string
+	_, err := c.command(func(resp imapResponse) error {
+		if len(resp.fields) < 4 || !strings.EqualFold(imapAtom(resp.fields[0]), "LIST") {
+			return nil
+		}
+		flags, _ := resp.fields[1].([]any)
+		for _, flag := range flags {
+			if f := imapAtom(flag); strings.EqualFold(f, `\Noselect`) || strings.EqualFold(f, `\NonExistent`) {
+				return nil
+			}
+		}
+		mailboxes = append(mailboxes, imapAtom(resp.fields[3]))
+		return nil
+	}, "LIST", imapString(""), imapString("*"))
+	return mailboxes, err
+}
+
+// imapMailboxStatus is the status of a mailbox when it was selected.
+type imapMailboxStatus struct {
+	exists      uint32
+	uidValidity uint32
+	uidNext     uint32 // 0 if the server didn't say
+}
+
+// examine selects mailbox read-only and returns its status.
+func (c *imapClient) examine(mailbox string) (imapMailboxStatus, error) {
+	var status imapMailboxStatus
+	_, err := c.command(func(resp imapResponse) error {
+		if len(resp.code) == 2 {
+			n, _ := strconv.ParseUint(resp.code[1], 10, 32)
+			switch strings.ToUpper(resp.code[0]) {
+			case "UIDVALIDITY":
+				status.uidValidity = uint32(n)
+			case "UIDNEXT":
+				status.uidNext = uint32(n)
+			}
+		}
+		if len(resp.fields) == 2 && strings.EqualFold(imapAtom(resp.fields[1]), "EXISTS") {
+			n, _ := strconv.ParseUint(imapAtom(resp.fields[0]), 10, 32)
+			status.exists = uint32(n)
+		}
+		return nil
+	}, "EXAMINE", imapString(mailbox))
+	return status, err
+}
+
+// uidSearch returns the UIDs of the messages in the selected mailbox that
+// match the search criteria, which are sent as-is.
+func (c *imapClient) uidSearch(criteria ...any) ([]uint32, error) {
+	var uids []uint32
+	args := append([]any{"UID", "SEARCH"}, criteria...)
+	_, err := c.command(func(resp imapResponse) error {
+		if len(resp.fields) == 0 || !strings.EqualFold(imapAtom(resp.fields[0]), "SEARCH") {
+			return nil
+		}
+		for _, field := range resp.fields[1:] {
+			uid, err := strconv.ParseUint(imapAtom(field), 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid UID in search results: %w", err)
+			}
+			uids = append(uids, uint32(uid))
+		}
+		return nil
+	}, args...)
+	return uids, err
+}
+
+// imapMessage is a message fetched from the server.
+type imapMessage struct {
+	uid          uint32
+	internalDate time.Time // when the server received it
+	body         []byte    // the whole message (RFC 5322)
+}
+
+// uidFetch fetches the messages with the given UIDs from the selected
+// mailbox, calling handle for each one as it arrives, without marking
+// them as read. If handle returns an error, the rest of the messages
+// are still read from the connection, but are not passed to handle.
+func (c *imapClient) uidFetch(uids []uint32, handle func(imapMessage) error) error {
+	set := make([]string, len(uids))
+	for i, uid := range uids {
+		set[i] = strconv.FormatUint(uint64(uid), 10)
+	}
+	_, err := c.command(func(resp imapResponse) error {
+		if len(resp.fields) < 3 || !strings.EqualFold(imapAtom(resp.fields[1]), "FETCH") {
+			return nil
+		}
+		items, _ := resp.fields[2].([]any)
+		var msg imapMessage
+		var hasBody bool
+		for i := 0; i+1 < len(items); i += 2 {
+			switch strings.ToUpper(imapAtom(items[i])) {
+			case "UID":
+				uid, _ := strconv.ParseUint(imapAtom(items[i+1]), 10, 32)
+				msg.uid = uint32(uid)
+			case "INTERNALDATE":
+				msg.internalDate, _ = time.Parse(imapDateTimeLayout, imapAtom(items[i+1]))
+			case "BODY[]":
+				hasBody = true
+				switch v := items[i+1].(type) {
+				case []byte:
+					msg.body = v
+				case string:
+					msg.body = []byte(v)
+				}
+			}
+		}
+		if !hasBody || msg.uid == 0 {
+			return nil // probably an unsolicited flag update
+		}
+		return handle(msg)
+	}, "UID", "FETCH", strings.Join(set, ","), "(UID INTERNALDATE BODY.PEEK[])")
+	return err
+}
+
+// imapString is a command argument that is sent as a quoted string, or
+// as a literal if it can't be quoted.
+type imapString string
+
+// imapStatusError is a NO or BAD response from the server to a command.
+type imapStatusError struct {
+	command, status, text string
+}
+
+func (e imapStatusError) Error() string {
+	return fmt.Sprintf("%s: %s %s", e.command, e.status, e.text)
+}
+
+// command sends a command made of args (strings, which are sent as-is,
+// and imapStrings) separated by spaces, and reads responses until the
+// command completes. Untagged responses are passed to handle, if it is
+// not nil; if it returns an error, the other responses are still read
+// so that the connection can be used again, and the error is returned.
+// The command fails with an imapStatusError if it is not successful.
+func (c *imapClient) command(handle func(imapResponse) error, args ...any) (imapResponse, error) {
+	if err := c.ctx.Err(); err != nil {
+		return imapResponse{}, err
+	}
+	if err := c.conn.SetDeadline(time.Now().Add(imapTimeout)); err != nil {
+		return imapResponse{}, err
+	}
+
+	c.tag++
+	tag := "T" + strconv.Itoa(c.tag)
+	name, _ := args[0].(string)
+
+	c.w.WriteString(tag)
+	for _, arg := range args {
+		c.w.WriteByte(' ')
+		switch arg := arg.(type) {
+		case string:
+			c.w.WriteString(arg)
+		case imapString:
+			if imapQuotable(string(arg)) {
+				c.w.WriteString(`"` + imapQuoteEscaper.Replace(string(arg)) + `"`)
+				continue
+			}
+			// send a literal, after the server says to continue
+			c.w.WriteString("{" + strconv.Itoa(len(arg)) + "}\r\n")
+			if err := c.w.Flush(); err != nil {
+				return imapResponse{}, err
+			}
+			if err := c.awaitContinuation(handle); err != nil {
+				return imapResponse{}, fmt.Errorf("%s: %w", name, err)
+			}
+			c.w.WriteString(string(arg))
+		}
+	}
+	c.w.WriteString("\r\n")
+	if err := c.w.Flush(); err != nil {
+		return imapResponse{}, err
+	}
+
+	var handleErr error
+	for {
+		// large mailboxes can take a while, but each response should arrive promptly
+		if err := c.conn.SetDeadline(time.Now().Add(imapTimeout)); err != nil {
+			return imapResponse{}, err
+		}
+		resp, err := c.readResponse()
+		if err != nil {
+			return resp, fmt.Errorf("%s: reading response: %w", name, c.contextErr(err))
+		}
+		if resp.tag == tag {
+			if resp.status != "OK" {
+				return resp, imapStatusError{command: name, status: resp.status, text: resp.text}
+			}
+			return resp, handleErr
+		}
+		if resp.tag == "*" && handle != nil && handleErr == nil {
+			handleErr = handle(resp)
+		}
+	}
+}
+
+// awaitContinuation reads responses until the server asks to continue
+// sending a command.
+func (c *imapClient) awaitContinuation(handle func(imapResponse) error) error {
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return c.contextErr(err)
+		}
+		switch resp.tag {
+		case "+":
+			return nil
+		case "*":
+			if handle != nil {
+				_ = handle(resp)
+			}
+		default:
+			return imapStatusError{status: resp.status, text: resp.text}
+		}
+	}
+}
+
+// contextErr returns the context's error if it was canceled (which closes
+// the connection), since that is why err happened.
+func (c *imapClient) contextErr(err error) error {
+	if ctxErr := c.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// imapResponse is a response from the server.
+type imapResponse struct {
+	tag string // "*" if untagged, "+" if a continuation request
+
+	// of status responses (and continuation requests)
+	status string   // OK, NO, BAD, PREAUTH, or BYE
+	code   []string // response code, like [UIDNEXT 4392], split into fields
+	text   string
+
+	// of other untagged responses: atoms and quoted strings are strings,
+	// literals are []byte, lists are []any, and NIL is nil
+	fields []any
+}
+
+// readResponse reads a whole response from the server.
+func (c *imapClient) readResponse() (imapResponse, error) {
+	var resp imapResponse
+	tag, err := c.readAtom()
+	if err != nil {
+		return resp, err
+	}
+	resp.tag = tag
+
+	if tag == "+" {
+		return resp, c.readStatusText(&resp)
+	}
+	if err := c.readSpace(); err != nil {
+		return resp, err
+	}
+
+	first, err := c.readValue()
+	if err != nil {
+		return resp, err
+	}
+	if s, ok := first.(string); ok {
+		switch strings.ToUpper(s) {
+		case "OK", "NO", "BAD", "PREAUTH", "BYE":
+			resp.status = strings.ToUpper(s)
+			return resp, c.readStatusText(&resp)
+		}
+	}
+	if tag != "*" {
+		return resp, fmt.Errorf("invalid status in tagged response: %v", first)
+	}
+
+	resp.fields = []any{first}
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return resp, err
+		}
+		switch b {
+		case ' ':
+			value, err := c.readValue()
+			if err != nil {
+				return resp, err
+			}
+			resp.fields = append(resp.fields, value)
+		case '\r':
+			if err := c.expectByte('\n'); err != nil {
+				return resp, err
+			}
+			return resp, nil
+		default:
+			return resp, fmt.Errorf("unexpected character in response: %q", b)
+		}
+	}
+}
+
+// readStatusText reads the rest of the line of a status response: an
+// optional response code in brackets, and human-readable text.
+func (c *imapClient) readStatusText(resp *imapResponse) error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "[") {
+		if end := strings.IndexByte(line, ']'); end > 0 {
+			resp.code = strings.Fields(line[1:end])
+			line = strings.TrimSpace(line[end+1:])
+		}
+	}
+	resp.text = line
+	return nil
+}
+
+// readValue reads an atom, number, quoted string, literal, or list.
+func (c *imapClient) readValue() (any, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch b {
+	case '(':
+		var list []any
+		for {
+			b, err := c.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			switch b {
+			case ')':
+				return list, nil
+			case ' ':
+				continue
+			}
+			if err := c.r.UnreadByte(); err != nil {
+				return nil, err
+			}
+			value, err := c.readValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+	case '"':
+		var sb strings.Builder
+		for {
+			b, err := c.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			switch b {
+			case '"':
+				return sb.String(), nil
+			case '\\':
+				if b, err = c.r.ReadByte(); err != nil {
+					return nil, err
+				}
+			case '\r', '\n':
+				return nil, errors.New("unterminated quoted string")
+			}
+			sb.WriteByte(b)
+		}
+	case '{':
+		sizeStr, err := c.r.ReadString('}')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.TrimSuffix(sizeStr, "}"), 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid literal size: %q", sizeStr)
+		}
+		if size > imapMaxLiteralSize {
+			return nil, fmt.Errorf("literal of %d bytes is too large", size)
+		}
+		if err := c.expectByte('\r'); err != nil {
+			return nil, err
+		}
+		if err := c.expectByte('\n'); err != nil {
+			return nil, err
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return nil, err
+		}
+		return literal, nil
+	}
+
+	if err := c.r.UnreadByte(); err != nil {
+		return nil, err
+	}
+	atom, err := c.readAtom()
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(atom, "NIL") {
+		return nil, nil
+	}
+	return atom, nil
+}
+
+// readAtom reads characters until a space, parenthesis, or line ending.
+func (c *imapClient) readAtom() (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case ' ', '(', ')', '\r', '\n':
+			if err := c.r.UnreadByte(); err != nil {
+				return "", err
+			}
+			if sb.Len() == 0 {
+				return "", fmt.Errorf("unexpected character in response: %q", b)
+			}
+			return sb.String(), nil
+		}
+		sb.WriteByte(b)
+	}
+}
+
+func (c *imapClient) readSpace() error { return c.expectByte(' ') }
+
+func (c *imapClient) expectByte(expected byte) error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != expected {
+		return fmt.Errorf("expected %q in response, got %q", expected, b)
+	}
+	return nil
+}
+
+// imapAtom returns the string value of an atom, quoted string, or literal.
+func imapAtom(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// imapQuotable returns whether s can be sent as a quoted string.
+func imapQuotable(s string) bool {
+	for i := range len(s) {
+		if b := s[i]; b == 0 || b == '\r' || b == '\n' || b >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+var imapQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// imapDate formats t as a date for search criteria.
+func imapDate(t time.Time) string {
+	return t.Format("2-Jan-2006")
+}
+
+const (
+	imapDateTimeLayout = "_2-Jan-2006 15:04:05 -0700"
+	imapTimeout        = 5 * time.Minute
+	imapMaxLiteralSize = 256 << 20
+)
@@ -98,7 +98,7 @@ func (c *Client) Authenticate(ctx context.Context, acc timeline.Account, _ any)
 func (c *Client) APIImport(ctx context.Context, _ timeline.Account, _ timeline.ImportParams) error {
 	// TODO: load any previous checkpoint
 
-	for {
+	for page := 1; ; page++ {
 		if err := ctx.Err(); err != nil {
 			return err
 		}
@@ -107,6 +107,7 @@ func (c *Client) APIImport(ctx context.Context, _ timeline.Account, _ timeline.I
 		if err != nil {
 			return fmt.Errorf("getting page of threads: %w", err)
 		}
+		timeline.LogPagination("gmail", page, threadsResp.estimatedPages(), len(threadsResp.Threads))
 
 		// TODO: batch requests
 		for _, th := range threadsResp.Threads {
@@ -193,6 +194,15 @@ type gmailThreads struct {
 	ResultSizeEstimate int                `json:"resultSizeEstimate"`
 }
 
+// estimatedPages returns the estimated total number of pages of threads,
+// based on the size of this page, or 0 if unknown.
+func (t gmailThreads) estimatedPages() int {
+	if len(t.Threads) == 0 || t.ResultSizeEstimate <= 0 {
+		return 0
+	}
+	return (t.ResultSizeEstimate + len(t.Threads) - 1) / len(t.Threads)
+}
+
 type gmailThreadIndex struct {
 	ID        string `json:"id"`
 	Snippet   string `json:"snippet"`
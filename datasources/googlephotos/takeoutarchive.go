@@ -43,10 +43,12 @@ const googlePhotosPath = "Takeout/Google Photos"
 func (fimp *FileImporter) listFromTakeoutArchive(ctx context.Context, opt timeline.ImportParams, dirEntry timeline.DirEntry) error {
 	fimp.truncatedNames = make(map[string]int)
 
+	start := time.Now()
 	albumFolders, err := fs.ReadDir(dirEntry.FS, dirEntry.Filename)
 	if err != nil {
 		return fmt.Errorf("getting album list from %s: %w", googlePhotosPath, err)
 	}
+	timeline.LogDiscovery(dataSourceName, len(albumFolders), "albums", time.Since(start))
 
 	// We don't use Walk() because we need to control the order in which we read
 	// the files. It's quite niche, but I ran into it with my very first import
@@ -160,9 +160,7 @@ func (imp *FileImporter) FileImport(ctx context.Context, dirEntry timeline.DirEn
 		class, supported := ItemClassByExtension(d.Name())
 		if !supported {
 			// skip unsupported files by filename extension (naive, but hopefully OK)
-			params.Log.Debug("skipping unrecognized file",
-				zap.String("filename", fpath),
-				zap.String("dir_entry_name", d.Name()))
+			timeline.LogUnsupportedFormat(params.Log, "media", fpath, strings.ToLower(path.Ext(d.Name())))
 			return nil
 		}
 
@@ -0,0 +1,272 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package timelinizeexport implements a data source for timelines
+// exported by timeline.Export, so that they can be imported into
+// another timeline.
+package timelinizeexport
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/timelinize/timelinize/timeline"
+	"go.uber.org/zap"
+)
+
+// Data source name and ID.
+const (
+	DataSourceName = "Timelinize export"
+	DataSourceID   = "timelinize_export"
+)
+
+// Options configures the data source.
+type Options struct{}
+
+func init() {
+	err := timeline.RegisterDataSource(timeline.DataSource{
+		Name:            DataSourceID,
+		Title:           DataSourceName,
+		Icon:            "folder.svg",
+		Description:     "A timeline exported by Timelinize",
+		NewOptions:      func() any { return new(Options) },
+		NewFileImporter: func() timeline.FileImporter { return new(FileImporter) },
+	})
+	if err != nil {
+		timeline.Log.Fatal("registering data source", zap.Error(err))
+	}
+}
+
+// FileImporter implements the timeline.FileImporter interface.
+type FileImporter struct{}
+
+// Recognize returns whether the folder (or archive) is an exported timeline.
+func (FileImporter) Recognize(_ context.Context, dirEntry timeline.DirEntry, _ timeline.RecognizeParams) (timeline.Recognition, error) {
+	var rec timeline.Recognition
+	if !dirEntry.IsDir() {
+		return rec, nil
+	}
+	if manifest, err := readManifest(dirEntry); err == nil && manifest.Format == timeline.ArchiveFormat {
+		rec.Confidence = 1
+	}
+	return rec, nil
+}
+
+// FileImport imports the exported timeline. The items refer to their
+// entities and related items, so those are loaded first.
+func (FileImporter) FileImport(ctx context.Context, dirEntry timeline.DirEntry, params timeline.ImportParams) error {
+	manifest, err := readManifest(dirEntry)
+	if err != nil {
+		return err
+	}
+	params.Log.Info("importing exported timeline",
+		zap.String("exported_repo_id", manifest.RepoID),
+		zap.Time("exported", manifest.Exported),
+		zap.Int("items", manifest.Items))
+
+	imp := &importer{
+		dirEntry: dirEntry,
+		entities: make(map[string]timeline.ArchiveEntity),
+		fromItem: make(map[string][]timeline.ArchiveRelationship),
+		toItem:   make(map[string][]timeline.ArchiveRelationship),
+	}
+
+	err = readLines(ctx, dirEntry, "entities.jsonl", func(entity timeline.ArchiveEntity) error {
+		for _, attr := range entity.Attributes {
+			imp.entities[attrKey(attr)] = entity
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// relationships between entities don't belong to any item, so they're sent on their own
+	var entityRels []timeline.ArchiveRelationship
+	err = readLines(ctx, dirEntry, "relationships.jsonl", func(rel timeline.ArchiveRelationship) error {
+		switch {
+		case rel.FromItem != "":
+			imp.fromItem[rel.FromItem] = append(imp.fromItem[rel.FromItem], rel)
+		case rel.ToItem != "":
+			imp.toItem[rel.ToItem] = append(imp.toItem[rel.ToItem], rel)
+		default:
+			entityRels = append(entityRels, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = readLines(ctx, dirEntry, "items.jsonl", func(exported timeline.ArchiveItem) error {
+		item := exported.Item()
+		if !params.Timeframe.ContainsItem(item, false) {
+			return nil
+		}
+		if exported.DataFile != "" {
+			item.Content.Data = imp.fileData(exported.DataFile)
+		}
+		if exported.Attribute != nil {
+			item.Owner = imp.entity(*exported.Attribute)
+		}
+
+		graph := &timeline.Graph{Item: item}
+		for _, rel := range imp.fromItem[exported.UID] {
+			graph.Edges = append(graph.Edges, imp.relationship(rel, nil, imp.node(rel.ToItem, rel.ToAttribute)))
+		}
+		for _, rel := range imp.toItem[exported.UID] {
+			graph.Edges = append(graph.Edges, imp.relationship(rel, imp.node("", rel.FromAttribute), nil))
+		}
+
+		select {
+		case params.Pipeline <- graph:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range entityRels {
+		from := imp.node("", rel.FromAttribute)
+		graph := &timeline.Graph{Entity: from.Entity}
+		graph.Edges = append(graph.Edges, imp.relationship(rel, nil, imp.node("", rel.ToAttribute)))
+		select {
+		case params.Pipeline <- graph:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// importer holds the state of an import of an exported timeline.
+type importer struct {
+	dirEntry timeline.DirEntry
+	entities map[string]timeline.ArchiveEntity // keyed by each of their attributes
+
+	// relationships from and to items (from entities), keyed by item UID
+	fromItem map[string][]timeline.ArchiveRelationship
+	toItem   map[string][]timeline.ArchiveRelationship
+}
+
+// entity returns the entity with the given attribute, which is its
+// identity; if the entity wasn't exported, it has only the attribute.
+func (imp *importer) entity(attr timeline.ArchiveAttribute) timeline.Entity {
+	exported, ok := imp.entities[attrKey(attr)]
+	if !ok {
+		exported = timeline.ArchiveEntity{Attributes: []timeline.ArchiveAttribute{attr}}
+	}
+	entity := exported.Entity(&attr)
+	if exported.Picture != "" {
+		entity.NewPicture = imp.fileData(exported.Picture)
+	}
+	return entity
+}
+
+// node returns the graph node of the item with the given UID, or if
+// empty, of the entity with the given attribute. Items are referred to
+// only by ID, so that they are linked to when they are imported.
+func (imp *importer) node(itemUID string, attr *timeline.ArchiveAttribute) *timeline.Graph {
+	if itemUID != "" {
+		return &timeline.Graph{Item: &timeline.Item{ID: itemUID}}
+	}
+	if attr != nil {
+		entity := imp.entity(*attr)
+		return &timeline.Graph{Entity: &entity}
+	}
+	return nil
+}
+
+// relationship returns the edge of the exported relationship, from or to the given node.
+func (imp *importer) relationship(rel timeline.ArchiveRelationship, from, to *timeline.Graph) timeline.Relationship {
+	edge := timeline.Relationship{
+		Relation: rel.Relation,
+		Value:    rel.Value,
+		From:     from,
+		To:       to,
+		Start:    rel.Start,
+		End:      rel.End,
+	}
+	if len(rel.Metadata) > 0 {
+		_ = json.Unmarshal(rel.Metadata, &edge.Metadata)
+	}
+	return edge
+}
+
+// fileData returns the function that reads a file from the archive.
+func (imp *importer) fileData(name string) timeline.DataFunc {
+	return func(_ context.Context) (io.ReadCloser, error) {
+		return imp.dirEntry.Open(name)
+	}
+}
+
+func readManifest(dirEntry timeline.DirEntry) (timeline.ArchiveManifest, error) {
+	var manifest timeline.ArchiveManifest
+	file, err := dirEntry.Open(timeline.ArchiveManifestName)
+	if err != nil {
+		return manifest, err
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("decoding manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// readLines decodes each line of the JSON lines file and calls handle with it.
+func readLines[T any](ctx context.Context, dirEntry timeline.DirEntry, name string, handle func(T) error) error {
+	file, err := dirEntry.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var v T
+		if err := dec.Decode(&v); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("decoding %s: %w", path.Base(name), err)
+		}
+		if err := handle(v); err != nil {
+			return err
+		}
+	}
+}
+
+// attrKey returns a key that identifies the attribute by name and value.
+func attrKey(attr timeline.ArchiveAttribute) string {
+	return attr.Name + "\x00" + fmt.Sprint(attr.Value)
+}
@@ -0,0 +1,98 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package timelinizelogs implements a data source for Timelinize's own
+// logs, as exported by timeline.ExportLogsAsItems, so that users can
+// browse the app's activity on a timeline.
+package timelinizelogs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/timelinize/timelinize/timeline"
+	"go.uber.org/zap"
+)
+
+// Data source name and ID.
+const (
+	DataSourceName = "Timelinize logs"
+	DataSourceID   = "timelinize_logs"
+)
+
+// Options configures the data source.
+type Options struct{}
+
+func init() {
+	err := timeline.RegisterDataSource(timeline.DataSource{
+		Name:            DataSourceID,
+		Title:           DataSourceName,
+		Icon:            "folder.svg",
+		Description:     "Logs exported by Timelinize itself",
+		NewOptions:      func() any { return new(Options) },
+		NewFileImporter: func() timeline.FileImporter { return new(FileImporter) },
+	})
+	if err != nil {
+		timeline.Log.Fatal("registering data source", zap.Error(err))
+	}
+}
+
+// FileImporter implements the timeline.FileImporter interface.
+type FileImporter struct{}
+
+// Recognize returns whether the file is supported.
+func (FileImporter) Recognize(_ context.Context, dirEntry timeline.DirEntry, _ timeline.RecognizeParams) (timeline.Recognition, error) {
+	var rec timeline.Recognition
+	if !dirEntry.IsDir() && strings.ToLower(path.Ext(dirEntry.Name())) == timeline.LogItemsExt {
+		rec.Confidence = 1
+	}
+	return rec, nil
+}
+
+// FileImport imports the exported log items from the file.
+func (FileImporter) FileImport(ctx context.Context, dirEntry timeline.DirEntry, params timeline.ImportParams) error {
+	file, err := dirEntry.Open(".")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var exported timeline.ExportedItem
+		if err := dec.Decode(&exported); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("decoding exported log item: %w", err)
+		}
+
+		item := exported.Item()
+		if params.Timeframe.ContainsItem(item, false) {
+			params.Pipeline <- &timeline.Graph{Item: item}
+		}
+	}
+}
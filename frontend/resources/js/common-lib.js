@@ -1482,9 +1482,11 @@ function itemContentElement(item, opts) {
 				if (opts?.thumbnail) {
 					return makeVideoTag([ {src: itemImgSrc(item, true), type: 'video/webm'} ]);
 				} else {
-					// prefer original video if browser supports it, otherwise they will have to choose the transcode
+					// prefer original video if browser supports it, then the preview that was transcoded
+					// in the background (if there is one), otherwise they will have to choose the live transcode
 					return makeVideoTag([
 						{src: `/repo/${item.repo_id}/${item.data_file}`, type: item.data_type},
+						{src: `/repo/${item.repo_id}/transcode/${item.data_file}?format=mp4`, type: 'video/mp4'},
 						{src: `/repo/${item.repo_id}/transcode/${item.data_file}`, type: 'video/webm'}
 					]);
 				}
@@ -45,6 +45,8 @@ import (
 	_ "github.com/timelinize/timelinize/datasources/smsbackuprestore"
 	_ "github.com/timelinize/timelinize/datasources/strava"
 	_ "github.com/timelinize/timelinize/datasources/telegram"
+	_ "github.com/timelinize/timelinize/datasources/timelinizeexport"
+	_ "github.com/timelinize/timelinize/datasources/timelinizelogs"
 	_ "github.com/timelinize/timelinize/datasources/twitter"
 	_ "github.com/timelinize/timelinize/datasources/vcard"
 	_ "github.com/timelinize/timelinize/datasources/whatsapp"
@@ -0,0 +1,1045 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+// Backups of a timeline are snapshots of its database and files, stored in
+// a backup target: a local folder or an S3-compatible bucket. The files are
+// stored by their content (their BLAKE3 hash), so each file is only copied
+// once, no matter how many snapshots contain it; only the database is copied
+// in full each time. A target can hold the backups of many timelines, laid
+// out like this:
+//
+//   - blobs/ab/abcd...: the contents of databases and files, shared by all
+//     the timelines in the target
+//   - timelines/<repo ID>/catalog.json: the list of snapshots of the timeline
+//   - timelines/<repo ID>/snapshots/<snapshot ID>.json.gz: the manifest of
+//     a snapshot, which lists its files
+//
+// Snapshots include the data and assets folders, but not the thumbnails and
+// previews, which are regenerated as needed. If the timeline is encrypted
+// (see EnableEncryption), files are backed up as they are stored, encrypted,
+// but the snapshot of the database is not, so the target should be kept safe.
+
+// BackupTarget is where backups are stored. Exactly one of Dir or S3 must be set.
+type BackupTarget struct {
+	ID      uint64    `json:"id,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+
+	// A local folder, such as on an external drive.
+	Dir string `json:"dir,omitempty"`
+
+	// A bucket of S3 or an S3-compatible service.
+	S3 *S3Target `json:"s3,omitempty"`
+}
+
+// S3Target is a bucket of S3 or a compatible service (like MinIO, Backblaze
+// B2, or Cloudflare R2).
+type S3Target struct {
+	// The base URL of the service, like "https://s3.us-east-1.amazonaws.com".
+	Endpoint string `json:"endpoint"`
+
+	// The region of the bucket. Default: us-east-1.
+	Region string `json:"region,omitempty"`
+
+	Bucket string `json:"bucket"`
+
+	// If set, everything is stored under this path in the bucket.
+	Prefix string `json:"prefix,omitempty"`
+
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key,omitempty" sensitive:"true"`
+
+	// If true, the bucket is addressed as a subdomain of the endpoint
+	// instead of as the first element of the path.
+	VirtualHosted bool `json:"virtual_hosted,omitempty"`
+}
+
+func (bt *BackupTarget) validate() error {
+	if (bt.Dir == "") == (bt.S3 == nil) {
+		return errors.New("backup target must have exactly one of dir or s3")
+	}
+	if bt.Dir != "" {
+		dir, err := filepath.Abs(bt.Dir)
+		if err != nil {
+			return err
+		}
+		bt.Dir = dir
+		return nil
+	}
+	_, err := newS3Store(*bt.S3)
+	return err
+}
+
+func (bt BackupTarget) store() (backupStore, error) {
+	if bt.S3 != nil {
+		return newS3Store(*bt.S3)
+	}
+	return dirStore(bt.Dir), nil
+}
+
+// BackupSnapshot describes a snapshot of a timeline.
+type BackupSnapshot struct {
+	ID       string    `json:"id"`
+	RepoID   string    `json:"repo_id"`
+	TargetID uint64    `json:"target_id,omitempty"` // only in the local catalog
+	Created  time.Time `json:"created"`
+	JobID    uint64    `json:"job_id,omitempty"`
+
+	// The snapshot of the database.
+	Database BackupFile `json:"database"`
+
+	// The data files and assets, only in the manifest of the snapshot.
+	Files []BackupFile `json:"files,omitempty"`
+
+	FileCount int   `json:"file_count"`
+	Size      int64 `json:"size"`     // total bytes of the database and files
+	Uploaded  int64 `json:"uploaded"` // bytes copied to the target; the rest were already there
+}
+
+// BackupFile is a file in a snapshot.
+type BackupFile struct {
+	Path     string    `json:"path"` // relative to the repo, with forward slashes
+	Hash     string    `json:"hash"` // hex-encoded BLAKE3 hash of the contents
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// backupCatalog is the list of snapshots of a timeline in a target.
+type backupCatalog struct {
+	RepoID    string           `json:"repo_id"`
+	Snapshots []BackupSnapshot `json:"snapshots"`
+}
+
+// AddBackupTarget validates and stores the target, and returns its ID. If
+// the target already has snapshots of this timeline (for example, because
+// it was removed and added again), they are added to the catalog, so they
+// can be restored.
+func (tl *Timeline) AddBackupTarget(ctx context.Context, target BackupTarget) (uint64, error) {
+	if err := target.validate(); err != nil {
+		return 0, err
+	}
+	store, err := target.store()
+	if err != nil {
+		return 0, err
+	}
+	catalog, err := readBackupCatalog(ctx, store, tl.id.String())
+	if err != nil {
+		return 0, fmt.Errorf("reading catalog of backup target: %w", err)
+	}
+
+	target.ID, target.Created = 0, time.Time{} // these are columns of their own
+	config, err := json.Marshal(target)
+	if err != nil {
+		return 0, fmt.Errorf("JSON-encoding backup target: %w", err)
+	}
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id uint64
+	err = tx.QueryRowContext(ctx, `INSERT INTO backup_targets (name, config) VALUES (?, ?) RETURNING id`,
+		nullString(target.Name), string(config)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("inserting backup target: %w", err)
+	}
+	for _, snap := range catalog.Snapshots {
+		snap.TargetID = id
+		if err := insertBackupSnapshot(ctx, tx, snap); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	Log.Named("backup").Info("added backup target",
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("target_id", id),
+		zap.Int("existing_snapshots", len(catalog.Snapshots)))
+
+	return id, nil
+}
+
+// BackupTargets returns the backup targets, without their secrets.
+func (tl *Timeline) BackupTargets(ctx context.Context) ([]BackupTarget, error) {
+	targets, err := tl.backupTargets(ctx, 0)
+	for i := range targets {
+		if targets[i].S3 != nil {
+			targets[i].S3.SecretAccessKey = ""
+		}
+	}
+	return targets, err
+}
+
+// backupTarget returns the target with the given ID, including its secrets.
+func (tl *Timeline) backupTarget(ctx context.Context, id uint64) (BackupTarget, error) {
+	targets, err := tl.backupTargets(ctx, id)
+	if err != nil {
+		return BackupTarget{}, err
+	}
+	if len(targets) == 0 {
+		return BackupTarget{}, fmt.Errorf("no backup target with ID %d", id)
+	}
+	return targets[0], nil
+}
+
+// backupTargets returns the target with the given ID, or all of them if 0.
+func (tl *Timeline) backupTargets(ctx context.Context, id uint64) ([]BackupTarget, error) {
+	query := `SELECT id, config, created FROM backup_targets`
+	var args []any
+	if id > 0 {
+		query += ` WHERE id=?`
+		args = append(args, id)
+	}
+	query += ` ORDER BY id`
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying backup targets: %w", err)
+	}
+	defer rows.Close()
+
+	var targets []BackupTarget
+	for rows.Next() {
+		var id uint64
+		var config string
+		var created int64
+		if err := rows.Scan(&id, &config, &created); err != nil {
+			return nil, fmt.Errorf("scanning backup target: %w", err)
+		}
+		var target BackupTarget
+		if err := json.Unmarshal([]byte(config), &target); err != nil {
+			return nil, fmt.Errorf("decoding backup target %d: %w", id, err)
+		}
+		target.ID = id
+		target.Created = time.Unix(created, 0)
+		targets = append(targets, target)
+	}
+	return targets, rows.Err()
+}
+
+// DeleteBackupTarget deletes the target, and its snapshots from the catalog.
+// The backups in the target are not deleted.
+func (tl *Timeline) DeleteBackupTarget(ctx context.Context, id uint64) error {
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+	_, err := tl.db.ExecContext(ctx, `DELETE FROM backup_targets WHERE id=?`, id)
+	return err
+}
+
+// BackupSnapshots returns the catalog of snapshots in the target with the
+// given ID, or in all targets if 0, newest first. The files of the snapshots
+// are not included.
+func (tl *Timeline) BackupSnapshots(ctx context.Context, targetID uint64) ([]BackupSnapshot, error) {
+	query := `SELECT id, target_id, created, job_id, database_hash, database_size, files, size, uploaded FROM backup_snapshots`
+	var args []any
+	if targetID > 0 {
+		query += ` WHERE target_id=?`
+		args = append(args, targetID)
+	}
+	query += ` ORDER BY created DESC, id DESC`
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying backup snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	var snapshots []BackupSnapshot
+	for rows.Next() {
+		snap := BackupSnapshot{RepoID: tl.id.String(), Database: BackupFile{Path: DBFilename}}
+		var created int64
+		var jobID *uint64
+		if err := rows.Scan(&snap.ID, &snap.TargetID, &created, &jobID, &snap.Database.Hash,
+			&snap.Database.Size, &snap.FileCount, &snap.Size, &snap.Uploaded); err != nil {
+			return nil, fmt.Errorf("scanning backup snapshot: %w", err)
+		}
+		snap.Created = time.UnixMilli(created)
+		snap.JobID = deref(jobID)
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, rows.Err()
+}
+
+func insertBackupSnapshot(ctx context.Context, tx *sql.Tx, snap BackupSnapshot) error {
+	var jobID *uint64
+	if snap.JobID > 0 {
+		jobID = &snap.JobID
+	}
+	_, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO backup_snapshots
+		(id, target_id, created, job_id, database_hash, database_size, files, size, uploaded)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		snap.ID, snap.TargetID, snap.Created.UnixMilli(), jobID, snap.Database.Hash,
+		snap.Database.Size, snap.FileCount, snap.Size, snap.Uploaded)
+	if err != nil {
+		return fmt.Errorf("adding snapshot %s to catalog: %w", snap.ID, err)
+	}
+	return nil
+}
+
+// Backup starts a job that snapshots the timeline to the target with the
+// given ID, and returns the job ID.
+func (tl *Timeline) Backup(ctx context.Context, targetID uint64) (uint64, error) {
+	if _, err := tl.backupTarget(ctx, targetID); err != nil {
+		return 0, err
+	}
+	return tl.CreateJob(backupJob{TargetID: targetID}, time.Time{}, 0, 0, 0)
+}
+
+// ScheduleBackup creates a schedule that snapshots the timeline to the
+// target with the given ID when spec calls for it, and returns its ID (see
+// CreateSchedule).
+func (tl *Timeline) ScheduleBackup(ctx context.Context, targetID uint64, spec ScheduleSpec) (uint64, error) {
+	if _, err := tl.backupTarget(ctx, targetID); err != nil {
+		return 0, err
+	}
+	return tl.CreateSchedule(ctx, backupJob{TargetID: targetID}, spec)
+}
+
+// Restore starts a job that rolls the timeline back to the snapshot with
+// the given ID, and returns the job ID. The database is replaced with the
+// one in the snapshot, and the data files and assets are made to match it:
+// files that changed or are missing are copied from the backup, and files
+// that aren't in the snapshot are deleted. The jobs, the backup targets,
+// and the catalog of snapshots are kept as they are, so that the restore
+// can itself be undone by restoring a later snapshot. No other jobs may
+// be running.
+func (tl *Timeline) Restore(ctx context.Context, snapshotID string) (uint64, error) {
+	if _, err := tl.catalogedSnapshot(ctx, snapshotID); err != nil {
+		return 0, err
+	}
+	return tl.CreateJob(restoreJob{SnapshotID: snapshotID}, time.Time{}, 0, 0, 0)
+}
+
+func (tl *Timeline) catalogedSnapshot(ctx context.Context, snapshotID string) (BackupSnapshot, error) {
+	snapshots, err := tl.BackupSnapshots(ctx, 0)
+	if err != nil {
+		return BackupSnapshot{}, err
+	}
+	for _, snap := range snapshots {
+		if snap.ID == snapshotID {
+			return snap, nil
+		}
+	}
+	return BackupSnapshot{}, fmt.Errorf("no snapshot with ID %s in the catalog", snapshotID)
+}
+
+// backupJob is the job action that snapshots a timeline.
+type backupJob struct {
+	TargetID uint64 `json:"target_id"`
+}
+
+// Run snapshots the timeline. Interrupted backups are started over, but
+// the files that were already copied are not copied again.
+func (bj backupJob) Run(job *ActiveJob, _ []byte) error {
+	tl, ctx := job.tl, job.ctx
+
+	target, err := tl.backupTarget(ctx, bj.TargetID)
+	if err != nil {
+		return err
+	}
+	store, err := target.store()
+	if err != nil {
+		return err
+	}
+	logger := job.Logger().With(zap.Uint64("target_id", target.ID))
+
+	tmpDir, err := os.MkdirTemp("", "timelinize_backup_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// files that are unchanged since the last snapshot aren't hashed again,
+	// and their contents are known to be in the target already
+	previous := make(map[string]BackupFile)
+	stored := make(map[string]struct{})
+	if last, err := tl.BackupSnapshots(ctx, target.ID); err != nil {
+		return err
+	} else if len(last) > 0 {
+		manifest, err := readSnapshotManifest(ctx, store, tl.id.String(), last[0].ID)
+		if err != nil {
+			logger.Warn("unable to read manifest of previous snapshot; hashing all files", zap.Error(err))
+		}
+		for _, f := range manifest.Files {
+			previous[f.Path] = f
+			stored[f.Hash] = struct{}{}
+		}
+	}
+
+	now := time.Now()
+	snap := BackupSnapshot{
+		ID:       newSnapshotID(now),
+		RepoID:   tl.id.String(),
+		TargetID: target.ID,
+		Created:  now,
+		JobID:    job.id,
+	}
+
+	// copy the database first, so that the files that are copied after it
+	// include all of the ones it refers to (new files may be copied too)
+	job.Message("Snapshotting database")
+	dbPath := filepath.Join(tmpDir, DBFilename)
+	tl.dbMu.RLock()
+	_, err = tl.db.ExecContext(ctx, `VACUUM INTO ?`, dbPath)
+	tl.dbMu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("snapshotting database: %w", err)
+	}
+	snap.Database, err = statBackupFile(dbPath, DBFilename)
+	if err != nil {
+		return err
+	}
+	if snap.Database.Hash, err = hashFile(dbPath); err != nil {
+		return err
+	}
+	uploaded, err := putBackupBlob(ctx, store, dbPath, snap.Database.Hash, stored)
+	if err != nil {
+		return fmt.Errorf("copying database: %w", err)
+	}
+	snap.Size, snap.Uploaded = snap.Database.Size, uploaded
+
+	job.Message("Listing files")
+	if snap.Files, err = tl.listBackupFiles(); err != nil {
+		return fmt.Errorf("listing files: %w", err)
+	}
+	job.SetTotal(len(snap.Files))
+	logger.Info("backing up timeline", zap.String("snapshot_id", snap.ID), zap.Int("files", len(snap.Files)))
+
+	job.Message("Copying files")
+	for i := range snap.Files {
+		if err := job.Continue(); err != nil {
+			return err
+		}
+		file := &snap.Files[i]
+		if prev, ok := previous[file.Path]; ok && prev.Size == file.Size && prev.Modified.Equal(file.Modified) {
+			file.Hash = prev.Hash
+		} else if file.Hash, err = hashFile(tl.FullPath(file.Path)); err != nil {
+			return fmt.Errorf("hashing %s: %w", file.Path, err)
+		}
+		uploaded, err := putBackupBlob(ctx, store, tl.FullPath(file.Path), file.Hash, stored)
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", file.Path, err)
+		}
+		snap.Size += file.Size
+		snap.Uploaded += uploaded
+		job.Progress(1)
+	}
+	snap.FileCount = len(snap.Files)
+
+	// the manifest goes in before the catalog, so that the catalog
+	// only lists snapshots that are complete
+	job.Message("Updating catalog")
+	if err := writeSnapshotManifest(ctx, store, snap); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	catalog, err := readBackupCatalog(ctx, store, snap.RepoID)
+	if err != nil {
+		return fmt.Errorf("reading catalog: %w", err)
+	}
+	entry := snap
+	entry.TargetID, entry.Files = 0, nil
+	catalog.Snapshots = append(catalog.Snapshots, entry)
+	if err := writeBackupJSON(ctx, store, backupCatalogName(snap.RepoID), catalog); err != nil {
+		return fmt.Errorf("writing catalog: %w", err)
+	}
+
+	tl.dbMu.Lock()
+	err = func() error {
+		tx, err := tl.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := insertBackupSnapshot(ctx, tx, snap); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	tl.dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("backed up timeline",
+		zap.String("snapshot_id", snap.ID),
+		zap.Int("files", snap.FileCount),
+		zap.Int64("size", snap.Size),
+		zap.Int64("uploaded", snap.Uploaded))
+	return nil
+}
+
+// listBackupFiles returns the files of the repo that belong in a snapshot,
+// without their hashes.
+func (tl *Timeline) listBackupFiles() ([]BackupFile, error) {
+	var files []BackupFile
+	for _, dir := range []string{DataFolderName, AssetsFolderName} {
+		root := filepath.Join(tl.repoDir, dir)
+		err := filepath.WalkDir(root, func(fpath string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && fpath == root {
+				return nil
+			}
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(tl.repoDir, fpath)
+			if err != nil {
+				return err
+			}
+			file, err := statBackupFile(fpath, filepath.ToSlash(rel))
+			if err != nil {
+				return err
+			}
+			files = append(files, file)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func statBackupFile(fpath, name string) (BackupFile, error) {
+	info, err := os.Stat(fpath)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	return BackupFile{Path: name, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+func hashFile(fpath string) (string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// putBackupBlob copies the file to the target, unless its contents are
+// already there, and returns how many bytes were copied. Hashes of known
+// contents are added to stored.
+func putBackupBlob(ctx context.Context, store backupStore, fpath, hash string, stored map[string]struct{}) (int64, error) {
+	if _, ok := stored[hash]; ok {
+		return 0, nil
+	}
+	name := backupBlobName(hash)
+	exists, err := store.exists(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	if !exists {
+		f, err := os.Open(fpath)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if err := store.put(ctx, name, f, info.Size()); err != nil {
+			return 0, err
+		}
+		size = info.Size()
+	}
+	stored[hash] = struct{}{}
+	return size, nil
+}
+
+// getBackupBlob copies the contents with the given hash from the target to
+// fpath, atomically, and checks their hash.
+func getBackupBlob(ctx context.Context, store backupStore, hash, fpath string) error {
+	rc, err := store.get(ctx, backupBlobName(hash))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(fpath), 0700); err != nil {
+		return err
+	}
+	partial := fpath + ".restoring"
+	f, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	h := newHash()
+	_, err = io.Copy(io.MultiWriter(f, h), rc)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != hash {
+		err = fmt.Errorf("contents of blob %s are corrupted", hash)
+	}
+	if err != nil {
+		_ = os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, fpath)
+}
+
+// restoreJob is the job action that rolls a timeline back to a snapshot.
+type restoreJob struct {
+	SnapshotID string `json:"snapshot_id"`
+}
+
+// Run restores the snapshot. An interrupted restore can be started over;
+// the database is only replaced once all the files it needs are in place.
+func (rj restoreJob) Run(job *ActiveJob, _ []byte) error {
+	tl, ctx := job.tl, job.ctx
+	logger := job.Logger().With(zap.String("snapshot_id", rj.SnapshotID))
+
+	tl.activeJobsMu.RLock()
+	for id, other := range tl.activeJobs {
+		if id != job.id && other.ctx.Err() == nil {
+			tl.activeJobsMu.RUnlock()
+			return fmt.Errorf("job %d is running; restoring requires that no other jobs are running", id)
+		}
+	}
+	tl.activeJobsMu.RUnlock()
+
+	entry, err := tl.catalogedSnapshot(ctx, rj.SnapshotID)
+	if err != nil {
+		return err
+	}
+	target, err := tl.backupTarget(ctx, entry.TargetID)
+	if err != nil {
+		return err
+	}
+	store, err := target.store()
+	if err != nil {
+		return err
+	}
+	snap, err := readSnapshotManifest(ctx, store, tl.id.String(), rj.SnapshotID)
+	if err != nil {
+		return fmt.Errorf("reading manifest: %w", err)
+	}
+	if snap.RepoID != tl.id.String() {
+		return fmt.Errorf("snapshot is of a different timeline: %s", snap.RepoID)
+	}
+	job.SetTotal(len(snap.Files) + 1)
+	logger.Info("restoring timeline", zap.Time("created", snap.Created), zap.Int("files", len(snap.Files)))
+
+	job.Message("Restoring files")
+	inSnapshot := make(map[string]struct{}, len(snap.Files))
+	var changed []string
+	for _, file := range snap.Files {
+		if err := job.Continue(); err != nil {
+			return err
+		}
+		inSnapshot[file.Path] = struct{}{}
+		same, err := sameAsBackupFile(tl.FullPath(file.Path), file)
+		if err != nil {
+			return err
+		}
+		if !same {
+			if err := getBackupBlob(ctx, store, file.Hash, tl.FullPath(file.Path)); err != nil {
+				return fmt.Errorf("restoring %s: %w", file.Path, err)
+			}
+			changed = append(changed, file.Path)
+		}
+		if err := os.Chtimes(tl.FullPath(file.Path), time.Time{}, file.Modified); err != nil {
+			return err
+		}
+		job.Progress(1)
+	}
+
+	job.Message("Restoring database")
+	tmpDir, err := os.MkdirTemp("", "timelinize_restore_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	dbPath := filepath.Join(tmpDir, DBFilename)
+	if err := getBackupBlob(ctx, store, snap.Database.Hash, dbPath); err != nil {
+		return fmt.Errorf("copying database: %w", err)
+	}
+	if err := tl.restoreDatabase(ctx, dbPath); err != nil {
+		return fmt.Errorf("restoring database: %w", err)
+	}
+	job.Progress(1)
+
+	// the current database doesn't refer to these files anymore
+	job.Message("Deleting files that aren't in the snapshot")
+	current, err := tl.listBackupFiles()
+	if err != nil {
+		return err
+	}
+	var removed []string
+	for _, file := range current {
+		if _, ok := inSnapshot[file.Path]; ok {
+			continue
+		}
+		if err := os.Remove(tl.FullPath(file.Path)); err != nil {
+			return err
+		}
+		removed = append(removed, file.Path)
+	}
+
+	// previews of files that changed or are gone are stale
+	if tl.thumbs != nil {
+		if err := tl.deleteThumbnails(ctx, nil, append(changed, removed...)); err != nil {
+			logger.Error("deleting thumbnails of restored files", zap.Error(err))
+		}
+	}
+
+	logger.Info("restored timeline",
+		zap.Int("files_restored", len(changed)),
+		zap.Int("files_deleted", len(removed)))
+	return nil
+}
+
+// sameAsBackupFile returns true if the file at fpath has the contents of file.
+func sameAsBackupFile(fpath string, file BackupFile) (bool, error) {
+	info, err := os.Stat(fpath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != file.Size {
+		return false, nil
+	}
+	if info.ModTime().Equal(file.Modified) {
+		return true, nil
+	}
+	hash, err := hashFile(fpath)
+	return hash == file.Hash, err
+}
+
+// backupPreservedTables are the tables whose rows are kept when restoring
+// a snapshot of the database.
+var backupPreservedTables = []string{"jobs", "backup_targets", "backup_snapshots"}
+
+// restoreDatabase replaces the contents of the database with the database
+// in the file at snapshotPath, except for the rows of backupPreservedTables.
+func (tl *Timeline) restoreDatabase(ctx context.Context, snapshotPath string) error {
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	preserved := make([]preservedRows, 0, len(backupPreservedTables))
+	for _, table := range backupPreservedTables {
+		rows, err := readPreservedRows(ctx, tl.db, table)
+		if err != nil {
+			return err
+		}
+		preserved = append(preserved, rows)
+	}
+
+	// the online backup API copies the snapshot into the open database,
+	// so the connections in the pool see the restored contents
+	srcConn, err := (&sqlite3.SQLiteDriver{}).Open(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("opening snapshot: %w", err)
+	}
+	defer srcConn.Close()
+	conn, err := tl.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	err = conn.Raw(func(driverConn any) error {
+		dst, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected database connection type: %T", driverConn)
+		}
+		src, ok := srcConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected snapshot connection type: %T", srcConn)
+		}
+		b, err := dst.Backup("main", src, "main")
+		if err != nil {
+			return err
+		}
+		if _, err := b.Step(-1); err != nil {
+			_ = b.Close()
+			return err
+		}
+		return b.Finish()
+	})
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("copying snapshot into database: %w", err)
+	}
+
+	// the snapshot may be from an older version of the schema
+	if err := provisionDB(ctx, tl.db); err != nil {
+		return err
+	}
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, rows := range preserved {
+		if err := rows.restore(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return tl.reloadCaches(ctx)
+}
+
+// reloadCaches reloads the maps of names to row IDs from the database.
+func (tl *Timeline) reloadCaches(ctx context.Context) error {
+	dataSources, err := mapNamesToIDs(ctx, tl.db, "data_sources")
+	if err != nil {
+		return err
+	}
+	classes, err := mapNamesToIDs(ctx, tl.db, "classifications")
+	if err != nil {
+		return err
+	}
+	entityTypes, err := mapNamesToIDs(ctx, tl.db, "entity_types")
+	if err != nil {
+		return err
+	}
+	relations, err := mapNamesToIDs(ctx, tl.db, "relations")
+	if err != nil {
+		return err
+	}
+	tl.cachesMu.Lock()
+	tl.dataSources, tl.classifications, tl.entityTypes, tl.relations = dataSources, classes, entityTypes, relations
+	tl.cachesMu.Unlock()
+	return nil
+}
+
+// preservedRows are the rows of a table, as they were before a restore.
+type preservedRows struct {
+	table   string
+	columns []string
+	rows    [][]any
+}
+
+func readPreservedRows(ctx context.Context, db *sql.DB, table string) (preservedRows, error) {
+	rows, err := db.QueryContext(ctx, `SELECT * FROM `+table) //nolint:gosec // table names are constants
+	if err != nil {
+		return preservedRows{}, fmt.Errorf("reading %s: %w", table, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return preservedRows{}, err
+	}
+	pr := preservedRows{table: table, columns: columns}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return preservedRows{}, fmt.Errorf("scanning %s: %w", table, err)
+		}
+		pr.rows = append(pr.rows, values)
+	}
+	return pr, rows.Err()
+}
+
+// restore upserts the rows, so that rows which refer to them aren't
+// affected (not even by ON DELETE clauses).
+func (pr preservedRows) restore(ctx context.Context, tx *sql.Tx) error {
+	if len(pr.rows) == 0 {
+		return nil
+	}
+	updates := make([]string, 0, len(pr.columns))
+	for _, col := range pr.columns {
+		if col != "id" {
+			updates = append(updates, fmt.Sprintf(`"%s"=excluded."%s"`, col, col))
+		}
+	}
+	query := fmt.Sprintf(`INSERT INTO %s ("%s") VALUES %s ON CONFLICT (id) DO UPDATE SET %s`, //nolint:gosec // table and column names are from the schema
+		pr.table, strings.Join(pr.columns, `", "`), sqlPlaceholders(len(pr.columns)), strings.Join(updates, ", "))
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("preparing to restore %s: %w", pr.table, err)
+	}
+	defer stmt.Close()
+	for _, row := range pr.rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return fmt.Errorf("restoring %s: %w", pr.table, err)
+		}
+	}
+	return nil
+}
+
+func newSnapshotID(t time.Time) string {
+	var suffix [3]byte
+	_, _ = rand.Read(suffix[:])
+	return t.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix[:])
+}
+
+func backupBlobName(hash string) string {
+	return path.Join("blobs", hash[:2], hash)
+}
+
+func backupCatalogName(repoID string) string {
+	return path.Join("timelines", repoID, "catalog.json")
+}
+
+func backupManifestName(repoID, snapshotID string) string {
+	return path.Join("timelines", repoID, "snapshots", snapshotID+".json.gz")
+}
+
+// readBackupCatalog returns the catalog of the timeline in the store,
+// which is empty if the timeline has no snapshots there.
+func readBackupCatalog(ctx context.Context, store backupStore, repoID string) (backupCatalog, error) {
+	catalog := backupCatalog{RepoID: repoID}
+	rc, err := store.get(ctx, backupCatalogName(repoID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return catalog, nil
+	}
+	if err != nil {
+		return catalog, err
+	}
+	defer rc.Close()
+	err = json.NewDecoder(rc).Decode(&catalog)
+	return catalog, err
+}
+
+func readSnapshotManifest(ctx context.Context, store backupStore, repoID, snapshotID string) (BackupSnapshot, error) {
+	rc, err := store.get(ctx, backupManifestName(repoID, snapshotID))
+	if err != nil {
+		return BackupSnapshot{}, err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return BackupSnapshot{}, err
+	}
+	var snap BackupSnapshot
+	if err := json.NewDecoder(zr).Decode(&snap); err != nil {
+		return BackupSnapshot{}, err
+	}
+	// the target might not be as trustworthy as the repo, and restoring
+	// writes and deletes the files named by the manifest
+	if err := snap.validate(); err != nil {
+		return BackupSnapshot{}, fmt.Errorf("invalid manifest of snapshot %s: %w", snapshotID, err)
+	}
+	return snap, nil
+}
+
+// validate returns an error if the snapshot has a file that isn't in one
+// of the folders that are backed up, or a hash that isn't one.
+func (snap BackupSnapshot) validate() error {
+	if !validBackupHash(snap.Database.Hash) {
+		return fmt.Errorf("invalid hash of database: %q", snap.Database.Hash)
+	}
+	for _, file := range snap.Files {
+		if !validBackupPath(file.Path) {
+			return fmt.Errorf("invalid file path: %q", file.Path)
+		}
+		if !validBackupHash(file.Hash) {
+			return fmt.Errorf("invalid hash of %s: %q", file.Path, file.Hash)
+		}
+	}
+	return nil
+}
+
+// validBackupPath returns true if name is a clean, local path (with forward
+// slashes) to a file in the data, assets, or previews folder.
+func validBackupPath(name string) bool {
+	if path.Clean(name) != name || strings.Contains(name, "\\") || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return false
+	}
+	dir, rest, ok := strings.Cut(name, "/")
+	if !ok || rest == "" {
+		return false
+	}
+	return dir == DataFolderName || dir == AssetsFolderName || dir == PreviewsFolderName
+}
+
+// validBackupHash returns true if hash is hex-encoded and as long as the
+// hashes of backed up files.
+func validBackupHash(hash string) bool {
+	if len(hash) != newHash().Size()*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func writeSnapshotManifest(ctx context.Context, store backupStore, snap BackupSnapshot) error {
+	snap.TargetID = 0
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(snap); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return store.put(ctx, backupManifestName(snap.RepoID, snap.ID), bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+}
+
+func writeBackupJSON(ctx context.Context, store backupStore, name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return store.put(ctx, name, bytes.NewReader(data), int64(len(data)))
+}
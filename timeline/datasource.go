@@ -539,8 +539,11 @@ type FileImporter interface {
 	FileImport(context.Context, DirEntry, ImportParams) error
 }
 
-// TODO: unused?
 // APIImporter is a type that can import data via a remote service API.
+// A data source with an APIImporter and no FileImporter is run once for
+// its entry in an import plan, which needs no filenames. Data sources
+// that import from an API on a schedule can use ImportParams.State to
+// only import what is new since the last import.
 type APIImporter interface {
 	Authenticate(ctx context.Context, acc Account, dsOpt any) error
 	//nolint:inamedparam
@@ -0,0 +1,378 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// DataSourcePlugin describes a data source that is implemented by an
+// external program, so that importers can be written in any language
+// and added without rebuilding the application. The program is run for
+// each file or folder that it is asked to recognize or import, and
+// speaks a simple protocol of JSON lines: it reads one request from
+// stdin, and writes its responses to stdout, one JSON object per line.
+// Anything it writes to stderr is included in errors if it fails.
+//
+// Requests have an "action" of either "recognize" or "import", and the
+// "path" of the file or folder on disk, along with "is_dir". Import
+// requests also have the data source "options" as given by the user
+// (which is how credentials and other settings get to the plugin), the
+// "checkpoint" to resume from, if any, and the "timeframe" (see
+// ImportParams).
+//
+// To a recognize request, the program responds with a Recognition,
+// such as {"confidence":1}, and exits. To an import request, it
+// responds with any number of these messages, and exits when done:
+//
+//   - {"graph":{...}} sends a Graph down the processing pipeline. It
+//     may have a "checkpoint" (see Graph), which is passed back in the
+//     request when the import is resumed. Since data can't be encoded
+//     in a Graph, the content of its item can be given as "data_text",
+//     or as the path of a file to read it from in "data_file".
+//   - {"log":{"level":"info","msg":"...","fields":{...}}} logs a message.
+//   - {"error":"..."} fails the import with the given error message.
+//
+// A nonzero exit status also fails the import. Plugins can only read
+// files on disk, so files inside archives are never offered to them.
+type DataSourcePlugin struct {
+	// The name, title, icon, and description of the data source,
+	// which are the same as those of DataSource.
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Icon        string `json:"icon,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// The program to run, and its arguments. If the program is a
+	// relative path with a separator in it, it is relative to the
+	// folder of the manifest it was loaded from (see
+	// LoadDataSourcePlugins).
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+
+	// Patterns (see path.Match) of the names of the files and folders
+	// that the plugin might recognize, such as "*.mbox"; only those
+	// are offered to it, since running a program for every file during
+	// import planning is slow. If empty, all are offered.
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// RegisterDataSourcePlugin registers plugin as a data source (see
+// RegisterDataSource). Like other data sources, it must be registered
+// before any timelines are opened, so they know about it.
+func RegisterDataSourcePlugin(plugin DataSourcePlugin) error {
+	if plugin.Command == "" {
+		return fmt.Errorf("data source plugin %s: missing command", plugin.Name)
+	}
+	for _, pattern := range plugin.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("data source plugin %s: invalid pattern %q: %w", plugin.Name, pattern, err)
+		}
+	}
+	return RegisterDataSource(DataSource{
+		Name:        plugin.Name,
+		Title:       plugin.Title,
+		Icon:        plugin.Icon,
+		Description: plugin.Description,
+		NewOptions:  func() any { return new(json.RawMessage) },
+		NewFileImporter: func() FileImporter {
+			return pluginImporter{plugin}
+		},
+	})
+}
+
+// LoadDataSourcePlugins registers the data source plugins that are
+// described by the manifest files in dir, which are the files whose
+// names end in ".json", each of which is a DataSourcePlugin encoded as
+// JSON. It returns the names of the plugins that were registered. A
+// manifest that can't be loaded is skipped, and its error returned
+// along with any others, after trying the rest.
+func LoadDataSourcePlugins(dir string) ([]string, error) {
+	manifests, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	var errs []error
+	for _, manifest := range manifests {
+		plugin, err := loadDataSourcePlugin(manifest)
+		if err == nil {
+			err = RegisterDataSourcePlugin(plugin)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("loading data source plugin from %s: %w", manifest, err))
+			continue
+		}
+		Log.Named("plugin").Info("registered data source plugin",
+			zap.String("name", plugin.Name),
+			zap.String("manifest", manifest))
+		names = append(names, plugin.Name)
+	}
+	return names, errors.Join(errs...)
+}
+
+func loadDataSourcePlugin(manifest string) (DataSourcePlugin, error) {
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return DataSourcePlugin{}, err
+	}
+	var plugin DataSourcePlugin
+	if err := json.Unmarshal(data, &plugin); err != nil {
+		return DataSourcePlugin{}, fmt.Errorf("decoding manifest: %w", err)
+	}
+	if !filepath.IsAbs(plugin.Command) && strings.ContainsAny(plugin.Command, `/\`) {
+		plugin.Command = filepath.Join(filepath.Dir(manifest), plugin.Command)
+	}
+	return plugin, nil
+}
+
+// pluginImporter is the FileImporter of a data source plugin.
+type pluginImporter struct {
+	plugin DataSourcePlugin
+}
+
+func (pi pluginImporter) Recognize(ctx context.Context, dirEntry DirEntry, _ RecognizeParams) (Recognition, error) {
+	if !pi.plugin.offered(dirEntry.Name()) {
+		return Recognition{}, nil
+	}
+	filename, ok := pluginFilename(dirEntry)
+	if !ok {
+		return Recognition{}, nil
+	}
+	var rec Recognition
+	err := pi.plugin.run(ctx, pluginRequest{
+		Action: "recognize",
+		Path:   filename,
+		IsDir:  dirEntry.IsDir(),
+	}, func(line []byte) error {
+		return json.Unmarshal(line, &rec)
+	})
+	return rec, err
+}
+
+func (pi pluginImporter) FileImport(ctx context.Context, dirEntry DirEntry, params ImportParams) error {
+	filename, ok := pluginFilename(dirEntry)
+	if !ok {
+		return fmt.Errorf("data source plugin %s can only import files on disk, not %s", pi.plugin.Name, dirEntry.Name())
+	}
+	options, err := json.Marshal(params.DataSourceOptions)
+	if err != nil {
+		return fmt.Errorf("encoding data source options: %w", err)
+	}
+	logger := params.Log
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	logger = logger.With(zap.String("plugin", pi.plugin.Name))
+
+	return pi.plugin.run(ctx, pluginRequest{
+		Action:     "import",
+		Path:       filename,
+		IsDir:      dirEntry.IsDir(),
+		Options:    options,
+		Checkpoint: params.Checkpoint,
+		Timeframe:  &params.Timeframe,
+	}, func(line []byte) error {
+		var msg pluginMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return fmt.Errorf("decoding message from data source plugin: %w", err)
+		}
+		switch {
+		case msg.Error != "":
+			return fmt.Errorf("data source plugin %s: %s", pi.plugin.Name, msg.Error)
+		case msg.Log != nil:
+			msg.Log.write(logger)
+		case msg.Graph != nil:
+			if err := msg.prepareGraph(); err != nil {
+				return err
+			}
+			select {
+			case params.Pipeline <- msg.Graph:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+}
+
+// offered returns true if the file or folder with the given name
+// should be offered to the plugin.
+func (p DataSourcePlugin) offered(name string) bool {
+	if len(p.Patterns) == 0 {
+		return true
+	}
+	for _, pattern := range p.Patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pluginFilename returns the path on disk of the file or folder of
+// dirEntry, if it is on disk (rather than inside an archive).
+func pluginFilename(dirEntry DirEntry) (string, bool) {
+	filename := filepath.Join(dirEntry.FSRoot, filepath.FromSlash(dirEntry.Filename))
+	info, err := os.Stat(filename)
+	return filename, err == nil && info.IsDir() == dirEntry.IsDir()
+}
+
+// run runs the plugin with req as its input, and calls handle with
+// each line of its output, stopping it if handle returns an error.
+func (p DataSourcePlugin) run(ctx context.Context, req pluginRequest, handle func([]byte) error) error {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("encoding request for data source plugin: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.Command, p.Args...) //nolint:gosec // running the plugin is the point
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	stderr := &tailBuffer{max: pluginStderrTail}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting data source plugin %s: %w", p.Name, err)
+	}
+
+	var handleErr error
+	r := bufio.NewReader(stdout)
+	for {
+		line, err := r.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 && handleErr == nil {
+			if handleErr = handle(line); handleErr != nil {
+				cancel() // no need for the rest
+			}
+		}
+		if err != nil {
+			break // the pipe is closed when the program exits
+		}
+	}
+
+	err = cmd.Wait()
+	if handleErr != nil {
+		return handleErr
+	}
+	if err != nil {
+		if out := strings.TrimSpace(stderr.String()); out != "" {
+			return fmt.Errorf("data source plugin %s: %w: %s", p.Name, err, out)
+		}
+		return fmt.Errorf("data source plugin %s: %w", p.Name, err)
+	}
+	return nil
+}
+
+// pluginRequest is the input to a data source plugin.
+type pluginRequest struct {
+	Action     string          `json:"action"`
+	Path       string          `json:"path"`
+	IsDir      bool            `json:"is_dir"`
+	Options    json.RawMessage `json:"options,omitempty"`
+	Checkpoint json.RawMessage `json:"checkpoint,omitempty"`
+	Timeframe  *Timeframe      `json:"timeframe,omitempty"`
+}
+
+// pluginMessage is a line of output from a data source plugin that is importing.
+type pluginMessage struct {
+	Graph      *Graph          `json:"graph,omitempty"`
+	Checkpoint json.RawMessage `json:"checkpoint,omitempty"`
+	DataText   *string         `json:"data_text,omitempty"`
+	DataFile   string          `json:"data_file,omitempty"`
+
+	Log   *pluginLog `json:"log,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// prepareGraph sets the checkpoint and data of the graph from the message.
+func (msg pluginMessage) prepareGraph() error {
+	if len(msg.Checkpoint) > 0 {
+		msg.Graph.Checkpoint = msg.Checkpoint
+	}
+	if msg.DataText == nil && msg.DataFile == "" {
+		return nil
+	}
+	if msg.Graph.Item == nil {
+		return errors.New("data source plugin sent data for a graph without an item")
+	}
+	if msg.DataText != nil {
+		msg.Graph.Item.Content.Data = StringData(*msg.DataText)
+		return nil
+	}
+	dataFile := msg.DataFile
+	msg.Graph.Item.Content.Data = func(_ context.Context) (io.ReadCloser, error) {
+		return os.Open(dataFile)
+	}
+	return nil
+}
+
+// pluginLog is a log message from a data source plugin.
+type pluginLog struct {
+	Level   zapcore.Level  `json:"level"`
+	Message string         `json:"msg"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+func (l pluginLog) write(logger *zap.Logger) {
+	if checked := logger.Check(l.Level, l.Message); checked != nil {
+		fields := make([]zap.Field, 0, len(l.Fields))
+		for key, val := range l.Fields {
+			fields = append(fields, zap.Any(key, val))
+		}
+		checked.Write(fields...)
+	}
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string { return string(t.buf) }
+
+// how much of the end of a plugin's stderr to include in errors
+const pluginStderrTail = 4096
@@ -0,0 +1,121 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDataSourcePlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test plugin is a shell script")
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"notes.txt", "notes.md"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("hello"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the second graph is only sent if the plugin received the options
+	script := `#!/bin/sh
+read -r req
+case "$req" in
+*'"action":"recognize"'*) echo '{"confidence":0.5}' ;;
+*'"action":"import"'*)
+	echo '{"log":{"level":"info","msg":"starting"}}'
+	echo '{"graph":{"item":{"original_location":"a"}},"checkpoint":{"n":1},"data_text":"one"}'
+	case "$req" in
+	*'"token":"secret"'*) echo '{"graph":{"item":{"original_location":"b"}},"data_text":"two"}' ;;
+	esac
+	echo '{"error":"out of notes"}'
+	;;
+esac
+`
+	command := filepath.Join(dir, "plugin.sh")
+	if err := os.WriteFile(command, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	importer := pluginImporter{DataSourcePlugin{Name: "test_plugin", Command: command, Patterns: []string{"*.txt"}}}
+	ctx := context.Background()
+	entry := func(name string) DirEntry {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return DirEntry{DirEntry: fs.FileInfoToDirEntry(info), FSRoot: dir, Filename: name}
+	}
+
+	rec, err := importer.Recognize(ctx, entry("notes.txt"), RecognizeParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Confidence != 0.5 {
+		t.Errorf("expected confidence 0.5, got %v", rec.Confidence)
+	}
+	rec, err = importer.Recognize(ctx, entry("notes.md"), RecognizeParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Confidence != 0 {
+		t.Errorf("expected file not matching patterns to be unrecognized, got confidence %v", rec.Confidence)
+	}
+
+	pipeline := make(chan *Graph, 10)
+	err = importer.FileImport(ctx, entry("notes.txt"), ImportParams{
+		Pipeline:          pipeline,
+		DataSourceOptions: json.RawMessage(`{"token":"secret"}`),
+	})
+	if err == nil || !strings.Contains(err.Error(), "out of notes") {
+		t.Errorf("expected error from plugin, got %v", err)
+	}
+	close(pipeline)
+
+	var got []string
+	for g := range pipeline {
+		r, err := g.Item.Content.Data(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, g.Item.OriginalLocation+"="+string(data))
+		if g.Item.OriginalLocation == "a" {
+			if cp, ok := g.Checkpoint.(json.RawMessage); !ok || string(cp) != `{"n":1}` {
+				t.Errorf("expected checkpoint to be passed through, got %#v", g.Checkpoint)
+			}
+		}
+	}
+	if strings.Join(got, ",") != "a=one,b=two" {
+		t.Errorf("expected graphs a=one,b=two, got %v", got)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"context"
 	"database/sql"
 	_ "embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"mime"
@@ -29,7 +30,9 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"text/tabwriter"
+	"time"
 
 	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
 	"github.com/google/uuid"
@@ -103,6 +106,12 @@ func provisionDB(ctx context.Context, db *sql.DB) error {
 		return fmt.Errorf("persisting repo UUID and version: %w", err)
 	}
 
+	// index existing items in any indexes that are new
+	err = buildItemIndexes(ctx, db)
+	if err != nil {
+		return err
+	}
+
 	// add all registered data sources
 	err = saveAllDataSources(ctx, db)
 	if err != nil {
@@ -124,6 +133,273 @@ func provisionDB(ctx context.Context, db *sql.DB) error {
 	return nil
 }
 
+// itemIndex is a table that indexes items for searching. Indexes are kept
+// up to date by triggers (see schema.sql), but have to be filled with the
+// items that already exist when they are created, which is the case when
+// upgrading a timeline that predates them.
+type itemIndex struct {
+	name    string
+	repoKey string // set once the index has been filled
+	fill    string // query that indexes all items with a greater ID than its argument
+
+	// the trigger that indexes inserted items, which is dropped
+	// while indexing is deferred (see deferItemIndexing)
+	insertTrigger string
+}
+
+var itemIndexes = []itemIndex{
+	{
+		name:    "search",
+		repoKey: "search_index",
+		fill: `INSERT OR REPLACE INTO items_fts (docid, data_text, filename, entity_name, metadata)
+			SELECT id, data_text, filename, entity_name, metadata FROM items_fts_source WHERE id > ?`,
+		insertTrigger: "items_fts_insert",
+	},
+	{
+		name:    "location",
+		repoKey: "location_index",
+		fill: `INSERT OR REPLACE INTO items_rtree (id, min_lat, max_lat, min_lon, max_lon)
+			SELECT id, latitude, latitude, longitude, longitude FROM items
+			WHERE id > ? AND latitude IS NOT NULL AND longitude IS NOT NULL`,
+		insertTrigger: "items_rtree_insert",
+	},
+}
+
+func buildItemIndexes(ctx context.Context, db *sql.DB) error {
+	for _, idx := range itemIndexes {
+		if err := idx.build(ctx, db); err != nil {
+			return fmt.Errorf("building %s index: %w", idx.name, err)
+		}
+	}
+	// if the app stopped while indexing was deferred, catch up now
+	// (the schema has just recreated the triggers)
+	if err := indexDeferredItems(ctx, db); err != nil {
+		return fmt.Errorf("indexing items that were inserted while indexing was deferred: %w", err)
+	}
+	return nil
+}
+
+// build fills the index, if it hasn't been already.
+func (idx itemIndex) build(ctx context.Context, db *sql.DB) error {
+	var built bool
+	err := db.QueryRowContext(ctx, `SELECT 1 FROM repo WHERE key=?`, idx.repoKey).Scan(&built)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	start := time.Now()
+	result, err := tx.ExecContext(ctx, idx.fill, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `INSERT INTO repo (key, value) VALUES (?, ?)`, idx.repoKey, 1); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if indexed, err := result.RowsAffected(); err == nil && indexed > 0 {
+		Log.Info("built index of items",
+			zap.String("index", idx.name),
+			zap.Int64("items", indexed),
+			zap.Duration("duration", time.Since(start)))
+	}
+	return nil
+}
+
+// deferItemIndexing stops the search and location indexes from being
+// updated as each item is inserted, until resumeItemIndexing has been
+// called as many times as this; then the items that were inserted in the
+// meantime are indexed all at once, which is much faster during large
+// imports (but they can't be found by text or on a map until then).
+// Changes to existing items are still indexed right away. The ID of the
+// last item before indexing was deferred is stored in the repo table, so
+// that if the app stops before indexing resumes, the items are indexed
+// the next time the timeline is opened.
+func (tl *Timeline) deferItemIndexing(ctx context.Context) error {
+	tl.deferredIndexingMu.Lock()
+	defer tl.deferredIndexingMu.Unlock()
+
+	if tl.deferredIndexing > 0 {
+		tl.deferredIndexing++
+		return nil
+	}
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO repo (key, value)
+		SELECT ?, coalesce(max(id), 0) FROM items`, deferredIndexingRepoKey)
+	if err != nil {
+		return fmt.Errorf("remembering where deferred indexing starts: %w", err)
+	}
+	for _, idx := range itemIndexes {
+		if _, err := tx.ExecContext(ctx, `DROP TRIGGER IF EXISTS `+idx.insertTrigger); err != nil {
+			return fmt.Errorf("disabling %s index trigger: %w", idx.name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	tl.deferredIndexing++
+	return nil
+}
+
+// resumeItemIndexing undoes a call to deferItemIndexing.
+func (tl *Timeline) resumeItemIndexing(ctx context.Context) error {
+	tl.deferredIndexingMu.Lock()
+	defer tl.deferredIndexingMu.Unlock()
+
+	if tl.deferredIndexing == 0 {
+		return nil
+	}
+	if tl.deferredIndexing--; tl.deferredIndexing > 0 {
+		return nil
+	}
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	// recreate the triggers
+	if _, err := tl.db.ExecContext(ctx, createDB); err != nil {
+		return fmt.Errorf("restoring index triggers: %w", err)
+	}
+	return indexDeferredItems(ctx, tl.db)
+}
+
+// indexDeferredItems indexes the items that were inserted while indexing
+// was deferred, if it was, and clears the deferral. The insert triggers
+// must already exist again.
+func indexDeferredItems(ctx context.Context, db *sql.DB) error {
+	var lastIndexedID uint64
+	err := db.QueryRowContext(ctx, `SELECT value FROM repo WHERE key=?`, deferredIndexingRepoKey).Scan(&lastIndexedID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	start := time.Now()
+	var indexed int64
+	for _, idx := range itemIndexes {
+		result, err := tx.ExecContext(ctx, idx.fill, lastIndexedID)
+		if err != nil {
+			return fmt.Errorf("filling %s index: %w", idx.name, err)
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			indexed = max(indexed, n)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM repo WHERE key=?`, deferredIndexingRepoKey); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	Log.Info("indexed items whose indexing was deferred",
+		zap.Uint64("after_item_id", lastIndexedID),
+		zap.Int64("items", indexed),
+		zap.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// deferredIndexingRepoKey is the key in the repo table whose value is the
+// ID of the last item that was indexed before indexing was deferred.
+const deferredIndexingRepoKey = "deferred_indexing_after_item_id"
+
+// stmtCache holds statements that are prepared on the database once and
+// then used by transactions, so that the queries that are run for each
+// item during an import don't have to be compiled by SQLite every time.
+// The zero value is ready to use.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// stmt returns the statement for query, prepared on db, to be used in tx.
+func (c *stmtCache) stmt(ctx context.Context, db *sql.DB, tx *sql.Tx, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	stmt, ok := c.stmts[query]
+	if !ok {
+		if len(c.stmts) >= maxCachedStmts {
+			// probably a query built with varying parts; don't let the cache grow forever
+			c.mu.Unlock()
+			return tx.PrepareContext(ctx, query)
+		}
+		var err error
+		stmt, err = db.PrepareContext(ctx, query)
+		if err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		if c.stmts == nil {
+			c.stmts = make(map[string]*sql.Stmt)
+		}
+		c.stmts[query] = stmt
+	}
+	c.mu.Unlock()
+	return tx.StmtContext(ctx, stmt), nil
+}
+
+// close closes all the statements.
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, stmt := range c.stmts {
+		stmt.Close()
+	}
+	c.stmts = nil
+}
+
+// maxCachedStmts is how many statements a stmtCache holds at most.
+const maxCachedStmts = 256
+
+// txQueryRow is like tx.QueryRowContext, but uses a prepared statement for
+// query; it is meant for queries that are run many times, as during imports.
+func (tl *Timeline) txQueryRow(ctx context.Context, tx *sql.Tx, query string, args ...any) *sql.Row {
+	stmt, err := tl.stmts.stmt(ctx, tl.db, tx, query)
+	if err != nil {
+		// the error will come up again, through the returned row
+		return tx.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+// txExec is like tx.ExecContext, but uses a prepared statement for query;
+// it is meant for statements that are run many times, as during imports.
+func (tl *Timeline) txExec(ctx context.Context, tx *sql.Tx, query string, args ...any) (sql.Result, error) {
+	stmt, err := tl.stmts.stmt(ctx, tl.db, tx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
 func saveAllDataSources(ctx context.Context, db *sql.DB) error {
 	if len(dataSources) == 0 {
 		return nil
@@ -305,6 +581,17 @@ func provisionThumbsDB(ctx context.Context, thumbsDB *sql.DB, repoID uuid.UUID)
 	return nil
 }
 
+// rowQueryer is a DB or tx.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// queryer is a DB or tx.
+type queryer interface {
+	rowQueryer
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
 // explainQueryPlan prints out the query and its plan. You MUST acquire a lock on the dbMu first.
 //
 //nolint:unused
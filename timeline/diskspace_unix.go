@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd
+
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import "golang.org/x/sys/unix"
+
+func diskSpace(path string) (storageSpace, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return storageSpace{}, err
+	}
+	blockSize := uint64(st.Bsize) //nolint:gosec // block size is never negative
+	return storageSpace{
+		available: uint64(st.Bavail) * blockSize, //nolint:unconvert,gosec // the type varies by platform
+		total:     uint64(st.Blocks) * blockSize, //nolint:unconvert,gosec // the type varies by platform
+	}, nil
+}
@@ -0,0 +1,685 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math/bits"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DuplicateSearchParams configures a search for duplicate items, such as
+// the same photo imported from a cloud service and from a local folder.
+type DuplicateSearchParams struct {
+	Repo string `json:"repo,omitempty"`
+
+	// The heuristics to find duplicates with; if none are enabled, all are used.
+	ByContent      bool `json:"by_content,omitempty"`        // identical data files
+	ByImage        bool `json:"by_image,omitempty"`          // images that look the same
+	ByTimeAndPlace bool `json:"by_time_and_place,omitempty"` // the same kind of item at the same time and place
+
+	// How different the perceptual hashes of images may be, in bits
+	// (at most 7); and how far apart in time and space items may be.
+	// If not set, defaults are used.
+	MaxImageDistance  int           `json:"max_image_distance,omitempty"`
+	TimeTolerance     time.Duration `json:"time_tolerance,omitempty"`
+	DistanceTolerance float64       `json:"distance_tolerance,omitempty"` // meters
+
+	// By default, only items from different data sources are considered
+	// duplicates, since items from the same data source are almost always
+	// distinct (the same data source rarely gives the same item twice).
+	WithinDataSource bool `json:"within_data_source,omitempty"`
+
+	Limit  int `json:"limit,omitempty"` // default 100 clusters
+	Offset int `json:"offset,omitempty"`
+}
+
+// DuplicateReason is why items are thought to be duplicates.
+type DuplicateReason string
+
+const (
+	DuplicateContent      DuplicateReason = "content"        // the data files are identical
+	DuplicateImage        DuplicateReason = "image"          // the images look the same
+	DuplicateTimeAndPlace DuplicateReason = "time_and_place" // same kind of item, at the same time and place
+)
+
+// DuplicateCluster is a group of items that are likely duplicates of each other.
+type DuplicateCluster struct {
+	Items   []*SearchResult   `json:"items"`
+	Reasons []DuplicateReason `json:"reasons"`
+
+	// The suggested item to keep when merging: the one imported first.
+	Keep uint64 `json:"keep"`
+}
+
+// FindDuplicates returns clusters of items that are likely duplicates, which
+// can then be combined with MergeItems. Perceptual hashes of images are
+// computed when their thumbnails are generated, so images are only compared
+// if they have been thumbnailed since that was added (regenerating thumbnails
+// computes them for older items).
+func (tl *Timeline) FindDuplicates(ctx context.Context, params DuplicateSearchParams) ([]DuplicateCluster, error) {
+	if params.MaxImageDistance <= 0 {
+		params.MaxImageDistance = defaultMaxImageDistance
+	}
+	if params.MaxImageDistance >= 8 {
+		return nil, fmt.Errorf("maximum image distance must be less than 8 bits: %d", params.MaxImageDistance)
+	}
+	if params.TimeTolerance <= 0 {
+		params.TimeTolerance = defaultDuplicateTimeTolerance
+	}
+	if params.DistanceTolerance <= 0 {
+		params.DistanceTolerance = defaultDuplicateDistanceTolerance
+	}
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+	all := !params.ByContent && !params.ByImage && !params.ByTimeAndPlace
+
+	dups := &duplicateSet{params: params, parent: make(map[uint64]uint64)}
+	if all || params.ByContent {
+		if err := tl.findContentDuplicates(ctx, dups); err != nil {
+			return nil, fmt.Errorf("finding identical data files: %w", err)
+		}
+	}
+	if all || params.ByImage {
+		if err := tl.findImageDuplicates(ctx, dups); err != nil {
+			return nil, fmt.Errorf("finding similar images: %w", err)
+		}
+	}
+	if all || params.ByTimeAndPlace {
+		if err := tl.findTimeAndPlaceDuplicates(ctx, dups); err != nil {
+			return nil, fmt.Errorf("finding items at the same time and place: %w", err)
+		}
+	}
+
+	groups := dups.groups()
+	if params.Offset >= len(groups) {
+		return []DuplicateCluster{}, nil
+	}
+	groups = groups[params.Offset:min(params.Offset+params.Limit, len(groups))]
+
+	var rowIDs []int64
+	for _, g := range groups {
+		for _, id := range g.items {
+			rowIDs = append(rowIDs, int64(id))
+		}
+	}
+	results, err := tl.Search(ctx, ItemSearchParams{RowID: rowIDs, Limit: -1})
+	if err != nil {
+		return nil, fmt.Errorf("loading duplicate items: %w", err)
+	}
+	byID := make(map[uint64]*SearchResult, len(results.Items))
+	for _, sr := range results.Items {
+		byID[sr.ID] = sr
+	}
+
+	clusters := make([]DuplicateCluster, 0, len(groups))
+	for _, g := range groups {
+		cluster := DuplicateCluster{Reasons: g.reasons, Keep: g.items[0]}
+		for _, id := range g.items {
+			if sr, ok := byID[id]; ok {
+				cluster.Items = append(cluster.Items, sr)
+			}
+		}
+		if len(cluster.Items) > 1 {
+			clusters = append(clusters, cluster)
+		}
+	}
+	return clusters, nil
+}
+
+// findContentDuplicates finds items with identical data files.
+func (tl *Timeline) findContentDuplicates(ctx context.Context, dups *duplicateSet) error {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT id, COALESCE(data_source_id, 0), data_hash
+		FROM items
+		WHERE data_hash IN (SELECT data_hash FROM items
+				WHERE data_hash IS NOT NULL AND deleted IS NULL AND hidden IS NULL
+				GROUP BY data_hash
+				HAVING count() > 1)
+			AND deleted IS NULL AND hidden IS NULL
+		ORDER BY data_hash, id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var group []duplicateCandidate
+	var groupHash []byte
+	for rows.Next() {
+		var c duplicateCandidate
+		var hash []byte
+		if err := rows.Scan(&c.id, &c.dataSourceID, &hash); err != nil {
+			return err
+		}
+		if string(hash) != string(groupHash) {
+			dups.addAll(group, DuplicateContent)
+			group, groupHash = group[:0], hash
+		}
+		group = append(group, c)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	dups.addAll(group, DuplicateContent)
+	return nil
+}
+
+// findImageDuplicates finds images whose perceptual hashes are within the
+// maximum distance. Since that is less than 8 bits, two such hashes have at
+// least one of their 8 bytes in common; so only the hashes that share a byte
+// (in the same position) need to be compared.
+func (tl *Timeline) findImageDuplicates(ctx context.Context, dups *duplicateSet) error {
+	var candidates []duplicateCandidate
+	err := func() error {
+		tl.dbMu.RLock()
+		defer tl.dbMu.RUnlock()
+
+		rows, err := tl.db.QueryContext(ctx, `SELECT items.id, COALESCE(items.data_source_id, 0), perceptual_hashes.hash
+			FROM perceptual_hashes
+			JOIN items ON items.id = perceptual_hashes.item_id
+			WHERE items.deleted IS NULL AND items.hidden IS NULL
+			ORDER BY items.id`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var c duplicateCandidate
+			var hash int64
+			if err := rows.Scan(&c.id, &c.dataSourceID, &hash); err != nil {
+				return err
+			}
+			c.phash = uint64(hash)
+			candidates = append(candidates, c)
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return err
+	}
+
+	for i := range 8 {
+		shift := uint(i * 8)
+		buckets := make(map[uint8][]int)
+		for j, c := range candidates {
+			b := uint8(c.phash >> shift)
+			buckets[b] = append(buckets[b], j)
+		}
+		for _, bucket := range buckets {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			for x := range bucket {
+				for y := x + 1; y < len(bucket); y++ {
+					a, b := candidates[bucket[x]], candidates[bucket[y]]
+					if bits.OnesCount64(a.phash^b.phash) <= dups.params.MaxImageDistance {
+						dups.add(a, b, DuplicateImage)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// findTimeAndPlaceDuplicates finds items of the same classification that
+// happened at about the same time and place. Location points are skipped,
+// since those from different sources corroborate, rather than duplicate,
+// each other.
+func (tl *Timeline) findTimeAndPlaceDuplicates(ctx context.Context, dups *duplicateSet) error {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT id, COALESCE(data_source_id, 0), classification_id, timestamp, latitude, longitude
+		FROM extended_items
+		WHERE timestamp IS NOT NULL AND latitude IS NOT NULL AND longitude IS NOT NULL
+			AND classification_id IS NOT NULL AND classification_name != ?
+			AND deleted IS NULL AND hidden IS NULL
+		ORDER BY timestamp`, ClassLocation.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// compare each item to the previous ones within the time tolerance
+	tolerance := dups.params.TimeTolerance.Milliseconds()
+	var window []duplicateCandidate
+	for rows.Next() {
+		var c duplicateCandidate
+		if err := rows.Scan(&c.id, &c.dataSourceID, &c.classificationID, &c.timestamp, &c.latitude, &c.longitude); err != nil {
+			return err
+		}
+		for len(window) > 0 && c.timestamp-window[0].timestamp > tolerance {
+			window = window[1:]
+		}
+		for _, other := range window {
+			if other.classificationID == c.classificationID &&
+				haversineDistanceMeters(c.latitude, c.longitude, other.latitude, other.longitude) <= dups.params.DistanceTolerance {
+				dups.add(other, c, DuplicateTimeAndPlace)
+			}
+		}
+		window = append(window, c)
+	}
+	return rows.Err()
+}
+
+// duplicateCandidate is an item that may be a duplicate of another.
+type duplicateCandidate struct {
+	id, dataSourceID    uint64
+	classificationID    uint64
+	phash               uint64
+	timestamp           int64
+	latitude, longitude float64
+}
+
+// duplicateSet accumulates pairs of duplicate items into groups
+// (with a disjoint-set forest, keyed by item ID).
+type duplicateSet struct {
+	params  DuplicateSearchParams
+	parent  map[uint64]uint64
+	reasons map[[2]uint64]DuplicateReason
+}
+
+func (ds *duplicateSet) find(id uint64) uint64 {
+	parent, ok := ds.parent[id]
+	if !ok {
+		ds.parent[id] = id
+		return id
+	}
+	if parent == id {
+		return id
+	}
+	root := ds.find(parent)
+	ds.parent[id] = root
+	return root
+}
+
+func (ds *duplicateSet) add(a, b duplicateCandidate, reason DuplicateReason) {
+	if a.dataSourceID == b.dataSourceID && !ds.params.WithinDataSource {
+		return
+	}
+	rootA, rootB := ds.find(a.id), ds.find(b.id)
+	if rootA != rootB {
+		// the root is the lowest ID, since that's the suggested item to keep
+		ds.parent[max(rootA, rootB)] = min(rootA, rootB)
+	}
+	if ds.reasons == nil {
+		ds.reasons = make(map[[2]uint64]DuplicateReason)
+	}
+	ds.reasons[[2]uint64{a.id, b.id}] = reason
+}
+
+// addAll adds all pairs of the candidates, which share a reason.
+func (ds *duplicateSet) addAll(candidates []duplicateCandidate, reason DuplicateReason) {
+	for i := range candidates {
+		for j := i + 1; j < len(candidates); j++ {
+			ds.add(candidates[i], candidates[j], reason)
+		}
+	}
+}
+
+type duplicateGroup struct {
+	items   []uint64 // sorted
+	reasons []DuplicateReason
+}
+
+// groups returns the groups of duplicates, ordered by their first item.
+func (ds *duplicateSet) groups() []duplicateGroup {
+	byRoot := make(map[uint64]*duplicateGroup)
+	for id := range ds.parent {
+		root := ds.find(id)
+		g, ok := byRoot[root]
+		if !ok {
+			g = new(duplicateGroup)
+			byRoot[root] = g
+		}
+		g.items = append(g.items, id)
+	}
+	for pair, reason := range ds.reasons {
+		g := byRoot[ds.find(pair[0])]
+		if !slices.Contains(g.reasons, reason) {
+			g.reasons = append(g.reasons, reason)
+		}
+	}
+
+	groups := make([]duplicateGroup, 0, len(byRoot))
+	for _, g := range byRoot {
+		if len(g.items) < 2 {
+			continue
+		}
+		slices.Sort(g.items)
+		slices.Sort(g.reasons)
+		groups = append(groups, *g)
+	}
+	slices.SortFunc(groups, func(a, b duplicateGroup) int { return cmp.Compare(a.items[0], b.items[0]) })
+	return groups
+}
+
+// MergeItems combines the duplicate items to merge into the item to keep.
+// Information that the item to keep is missing (like its location, or
+// data file) is brought over from the others, and their relationships,
+// tags, notes, and places in stories are moved to it. The items to merge
+// are then deleted, but where they came from (data source, original ID
+// and location, etc.) is preserved with the item to keep (see ItemSources),
+// so that importing them again updates the item that was kept instead of
+// duplicating it again.
+func (tl *Timeline) MergeItems(ctx context.Context, itemIDToKeep uint64, itemIDsToMerge []uint64) error {
+	if itemIDToKeep == 0 {
+		return errors.New("item to keep must have an ID greater than 0")
+	}
+	if len(itemIDsToMerge) == 0 {
+		return errors.New("no items to merge")
+	}
+	seen := make(map[uint64]struct{})
+	for _, id := range itemIDsToMerge {
+		if id == 0 {
+			return errors.New("items to merge must have IDs greater than 0")
+		}
+		if id == itemIDToKeep {
+			return fmt.Errorf("cannot merge item into itself (%d)", id)
+		}
+		if _, ok := seen[id]; ok {
+			return fmt.Errorf("item to merge specified more than once (%d)", id)
+		}
+		seen[id] = struct{}{}
+	}
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	keep, err := tl.loadItemRow(ctx, tx, itemIDToKeep, nil, nil, nil, false)
+	if err != nil {
+		return fmt.Errorf("loading item to keep: %w", err)
+	}
+	var keepMeta Metadata
+	if len(keep.Metadata) > 0 {
+		if err := json.Unmarshal(keep.Metadata, &keepMeta); err != nil {
+			return fmt.Errorf("decoding metadata of item to keep: %w", err)
+		}
+	}
+
+	var dataFilesToDelete []string
+	for _, id := range itemIDsToMerge {
+		merge, err := tl.loadItemRow(ctx, tx, id, nil, nil, nil, false)
+		if err != nil {
+			return fmt.Errorf("loading item to merge: %w", err)
+		}
+
+		// preserve the provenance of the merged item, and of any items merged into it before
+		var metadata *string
+		if len(merge.Metadata) > 0 {
+			metadata = new(string)
+			*metadata = string(merge.Metadata)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO item_sources
+			(item_id, data_source_id, job_id, original_id, original_location, intermediate_location, filename, data_hash, metadata)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			itemIDToKeep, merge.DataSourceID, merge.JobID, merge.OriginalID, merge.OriginalLocation,
+			merge.IntermediateLocation, merge.Filename, merge.DataHash, metadata)
+		if err != nil {
+			return fmt.Errorf("storing provenance of merged item %d: %w", id, err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE item_sources SET item_id=? WHERE item_id=?`, itemIDToKeep, id); err != nil {
+			return fmt.Errorf("moving provenance of previously merged items: %w", err)
+		}
+
+		// bring over any information on the item to merge that's missing on the item to keep
+		mergedDataFile := keep.fillMissing(merge)
+		if len(merge.Metadata) > 0 {
+			var mergeMeta Metadata
+			if err := json.Unmarshal(merge.Metadata, &mergeMeta); err == nil {
+				if keepMeta == nil {
+					keepMeta = make(Metadata)
+				}
+				keepMeta.Merge(mergeMeta, MetaMergeSkip)
+			}
+		}
+
+		// point everything that refers to the item to merge to the item to keep
+		for _, q := range []string{
+			`UPDATE relationships SET from_item_id=? WHERE from_item_id=?`,
+			`UPDATE relationships SET to_item_id=? WHERE to_item_id=?`,
+			`UPDATE story_elements SET item_id=? WHERE item_id=?`,
+			`UPDATE OR IGNORE tagged SET item_id=? WHERE item_id=?`,
+			`UPDATE notes SET item_id=? WHERE item_id=?`,
+		} {
+			if _, err := tx.ExecContext(ctx, q, itemIDToKeep, id); err != nil {
+				return fmt.Errorf("replacing item ID: %w", err)
+			}
+		}
+
+		// the data file of the merged item, unless it was brought over, can be deleted if no other item uses it
+		if merge.DataFile != nil && !mergedDataFile && (keep.DataFile == nil || *keep.DataFile != *merge.DataFile) {
+			var count int
+			err := tx.QueryRowContext(ctx, `SELECT count() FROM items WHERE data_file=? AND id!=?`, merge.DataFile, id).Scan(&count)
+			if err != nil {
+				return fmt.Errorf("counting items sharing data file: %w", err)
+			}
+			if count == 0 {
+				dataFilesToDelete = append(dataFilesToDelete, *merge.DataFile)
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM items WHERE id=?`, id); err != nil {
+			return fmt.Errorf("deleting merged item %d: %w", id, err)
+		}
+	}
+
+	// the items may have been related to each other
+	if _, err := tx.ExecContext(ctx, `DELETE FROM relationships WHERE from_item_id=? AND to_item_id=?`, itemIDToKeep, itemIDToKeep); err != nil {
+		return fmt.Errorf("deleting relationships between merged items: %w", err)
+	}
+
+	var metadata *string
+	if len(keepMeta) > 0 {
+		metaJSON, err := json.Marshal(keepMeta)
+		if err != nil {
+			return fmt.Errorf("encoding metadata: %w", err)
+		}
+		metadata = new(string)
+		*metadata = string(metaJSON)
+	}
+	unixMilli := func(t *time.Time) *int64 {
+		if t == nil {
+			return nil
+		}
+		ms := t.UnixMilli()
+		return &ms
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE items SET attribute_id=?, classification_id=?, original_location=?,
+			intermediate_location=?, filename=?, timestamp=?, timespan=?, timeframe=?, time_offset=?,
+			time_uncertainty=?, data_type=?, data_text=?, data_file=?, data_hash=?, metadata=?,
+			longitude=?, latitude=?, altitude=?, coordinate_system=?, coordinate_uncertainty=?,
+			note=?, starred=?, modified=?
+		WHERE id=?`,
+		keep.AttributeID, keep.ClassificationID, keep.OriginalLocation,
+		keep.IntermediateLocation, keep.Filename, unixMilli(keep.Timestamp), unixMilli(keep.Timespan), unixMilli(keep.Timeframe), keep.TimeOffset,
+		keep.TimeUncertainty, keep.DataType, keep.DataText, keep.DataFile, keep.DataHash, metadata,
+		keep.Longitude, keep.Latitude, keep.Altitude, keep.CoordinateSystem, keep.CoordinateUncertainty,
+		keep.Note, keep.Starred, time.Now().Unix(),
+		itemIDToKeep)
+	if err != nil {
+		return fmt.Errorf("updating item to keep: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	Log.Info("merged duplicate items",
+		zap.Uint64("kept_item_id", itemIDToKeep),
+		zap.Uint64s("merged_item_ids", itemIDsToMerge))
+
+	// as with deleting items, only delete files after the DB no longer refers to them
+	if _, err := tl.deleteRepoFiles(ctx, Log, dataFilesToDelete); err != nil {
+		return fmt.Errorf("deleting data files of merged items: %w", err)
+	}
+	return nil
+}
+
+// fillMissing fills in the fields of ir that are missing from other,
+// and returns true if the data file of other was brought over.
+func (ir *ItemRow) fillMissing(other ItemRow) bool {
+	fill := func(dst **string, src *string) {
+		if *dst == nil {
+			*dst = src
+		}
+	}
+	if ir.AttributeID == nil {
+		ir.AttributeID = other.AttributeID
+	}
+	if ir.ClassificationID == nil {
+		ir.ClassificationID = other.ClassificationID
+	}
+	fill(&ir.OriginalLocation, other.OriginalLocation)
+	fill(&ir.IntermediateLocation, other.IntermediateLocation)
+	fill(&ir.Filename, other.Filename)
+	fill(&ir.Note, other.Note)
+	if ir.Timestamp == nil {
+		ir.Timestamp, ir.Timespan, ir.Timeframe = other.Timestamp, other.Timespan, other.Timeframe
+		ir.TimeOffset, ir.TimeUncertainty = other.TimeOffset, other.TimeUncertainty
+	}
+	if ir.Location.IsEmpty() {
+		ir.Location = other.Location
+	}
+	if ir.Starred == nil {
+		ir.Starred = other.Starred
+	}
+
+	// the content is brought over only if the item to keep has none
+	if ir.DataText == nil && ir.DataFile == nil && ir.DataID == nil {
+		ir.DataType, ir.DataText = other.DataType, other.DataText
+		if other.DataFile != nil {
+			ir.DataFile, ir.DataHash = other.DataFile, other.DataHash
+			return true
+		}
+	}
+	return false
+}
+
+// ItemSource is where an item that was merged into another came from.
+type ItemSource struct {
+	DataSourceName       *string         `json:"data_source_name,omitempty"`
+	JobID                *uint64         `json:"job_id,omitempty"`
+	OriginalID           *string         `json:"original_id,omitempty"`
+	OriginalLocation     *string         `json:"original_location,omitempty"`
+	IntermediateLocation *string         `json:"intermediate_location,omitempty"`
+	Filename             *string         `json:"filename,omitempty"`
+	DataHash             []byte          `json:"data_hash,omitempty"`
+	Metadata             json.RawMessage `json:"metadata,omitempty"`
+	Merged               time.Time       `json:"merged"`
+}
+
+// ItemSources returns where the items that were merged into the item came from.
+func (tl *Timeline) ItemSources(ctx context.Context, itemID uint64) ([]ItemSource, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT data_sources.name, item_sources.job_id, item_sources.original_id,
+			item_sources.original_location, item_sources.intermediate_location, item_sources.filename,
+			item_sources.data_hash, item_sources.metadata, item_sources.merged
+		FROM item_sources
+		LEFT JOIN data_sources ON data_sources.id = item_sources.data_source_id
+		WHERE item_sources.item_id=?
+		ORDER BY item_sources.id`, itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := []ItemSource{}
+	for rows.Next() {
+		var src ItemSource
+		var metadata *string
+		var merged int64
+		err := rows.Scan(&src.DataSourceName, &src.JobID, &src.OriginalID, &src.OriginalLocation,
+			&src.IntermediateLocation, &src.Filename, &src.DataHash, &metadata, &merged)
+		if err != nil {
+			return nil, err
+		}
+		if metadata != nil {
+			src.Metadata = json.RawMessage(*metadata)
+		}
+		src.Merged = time.Unix(merged, 0)
+		sources = append(sources, src)
+	}
+	return sources, rows.Err()
+}
+
+// perceptualHash returns the difference hash (dHash) of the image: the
+// image is shrunk to 9x8 grayscale pixels, and each bit of the hash is whether
+// a pixel is brighter than the one to its right. Images that look the same
+// have hashes that differ by only a few bits, even if resized or re-encoded.
+func perceptualHash(img image.Image) uint64 {
+	const width, height = 9, 8
+	bounds := img.Bounds()
+
+	// average the brightness of the area of the image that each pixel covers
+	var pixels [height][width]float64
+	for y := range height {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, y0+1)
+		for x := range width {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/width, x0+1)
+			var sum float64
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+			pixels[y][x] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+
+	var hash uint64
+	for y := range height {
+		for x := range width - 1 {
+			hash <<= 1
+			if pixels[y][x] > pixels[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+const (
+	defaultMaxImageDistance           = 6
+	defaultDuplicateTimeTolerance     = time.Minute
+	defaultDuplicateDistanceTolerance = 50.0 // meters
+)
@@ -0,0 +1,167 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math/bits"
+	"testing"
+)
+
+func TestFindAndMergeDuplicates(t *testing.T) {
+	ctx := context.Background()
+	db, err := openAndProvisionDB(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tl := &Timeline{db: db}
+
+	// 1 and 2 are the same photo file from two sources; 3 and 4 look the same;
+	// 5 and 6 are the same post; 7 is at the same time and place as 5 and 6
+	// but is from the same source as 5, and is a different kind of item
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO data_sources (id, name, title) VALUES (1, 'google_photos', 'Google Photos'), (2, 'media', 'Media');
+		INSERT INTO items (id, data_source_id, original_id, classification_id, timestamp, data_type, data_file, data_hash) VALUES
+			(1, 1, 'photo1', NULL, 1000, 'image/jpeg', 'data/a.jpg', x'aa'),
+			(2, 2, NULL, NULL, NULL, 'image/jpeg', 'data/b.jpg', x'aa'),
+			(3, 1, 'photo3', NULL, 2000, 'image/jpeg', 'data/c.jpg', x'cc'),
+			(4, 2, NULL, NULL, 2000, 'image/jpeg', 'data/d.jpg', x'dd');
+		INSERT INTO perceptual_hashes (item_id, hash) VALUES (3, 1234567890), (4, 1234567891);
+		INSERT INTO items (id, data_source_id, original_id, classification_id, timestamp, latitude, longitude, note) VALUES
+			(5, 1, 'post5', (SELECT id FROM classifications WHERE name='social'), 1700000000000, 40.0, -105.0, NULL),
+			(6, 2, 'post6', (SELECT id FROM classifications WHERE name='social'), 1700000030000, 40.0001, -105.0, 'my note'),
+			(7, 1, 'msg7', (SELECT id FROM classifications WHERE name='message'), 1700000000000, 40.0, -105.0, NULL);
+		INSERT INTO relations (id, label) VALUES (100, 'test_attached');
+		INSERT INTO relationships (relation_id, from_item_id, to_item_id) VALUES (100, 7, 6), (100, 5, 6);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := tl.FindDuplicates(ctx, DuplicateSearchParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		items  []uint64
+		reason DuplicateReason
+	}{
+		{[]uint64{1, 2}, DuplicateContent},
+		{[]uint64{3, 4}, DuplicateImage},
+		{[]uint64{5, 6}, DuplicateTimeAndPlace},
+	}
+	if len(clusters) != len(expected) {
+		t.Fatalf("expected %d clusters, got %d: %+v", len(expected), len(clusters), clusters)
+	}
+	for i, exp := range expected {
+		c := clusters[i]
+		if len(c.Items) != len(exp.items) || c.Items[0].ID != exp.items[0] || c.Items[1].ID != exp.items[1] {
+			t.Errorf("cluster %d: expected items %v, got %+v", i, exp.items, c.Items)
+		}
+		if len(c.Reasons) != 1 || c.Reasons[0] != exp.reason {
+			t.Errorf("cluster %d: expected reason %s, got %v", i, exp.reason, c.Reasons)
+		}
+		if c.Keep != exp.items[0] {
+			t.Errorf("cluster %d: expected to keep item %d, got %d", i, exp.items[0], c.Keep)
+		}
+	}
+
+	// items from the same data source are only duplicates if asked
+	clusters, err = tl.FindDuplicates(ctx, DuplicateSearchParams{ByTimeAndPlace: true, WithinDataSource: true, TimeTolerance: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 0 {
+		t.Errorf("expected no clusters with a tiny time tolerance, got %+v", clusters)
+	}
+
+	if err := tl.MergeItems(ctx, 5, []uint64{6}); err != nil {
+		t.Fatal(err)
+	}
+	var note *string
+	if err := db.QueryRow(`SELECT note FROM items WHERE id=5`).Scan(&note); err != nil {
+		t.Fatal(err)
+	}
+	if note == nil || *note != "my note" {
+		t.Errorf("expected missing note to be brought over, got %v", note)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT count() FROM items WHERE id=6`).Scan(&count); err != nil || count != 0 {
+		t.Errorf("expected merged item to be deleted (count=%d err=%v)", count, err)
+	}
+	if err := db.QueryRow(`SELECT count() FROM relationships WHERE to_item_id=5 AND from_item_id=7`).Scan(&count); err != nil || count != 1 {
+		t.Errorf("expected relationship to be moved to kept item (count=%d err=%v)", count, err)
+	}
+	if err := db.QueryRow(`SELECT count() FROM relationships WHERE from_item_id=5 AND to_item_id=5`).Scan(&count); err != nil || count != 0 {
+		t.Errorf("expected relationship between merged items to be deleted (count=%d err=%v)", count, err)
+	}
+
+	sources, err := tl.ItemSources(ctx, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].DataSourceName == nil || *sources[0].DataSourceName != "media" ||
+		sources[0].OriginalID == nil || *sources[0].OriginalID != "post6" {
+		t.Errorf("expected provenance of merged item, got %+v", sources)
+	}
+
+	// importing the merged item again finds the item it was merged into
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	dsName := "media"
+	ir, err := tl.loadItemRow(ctx, tx, 0, &Item{ID: "post6"}, &dsName, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.ID != 5 {
+		t.Errorf("expected merged item to be found as item 5, got %d", ir.ID)
+	}
+}
+
+func TestPerceptualHash(t *testing.T) {
+	gradient := func(width, height int, flip bool) image.Image {
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		for y := range height {
+			for x := range width {
+				v := uint8((x*x + y*3) * 255 / (width*width + height*3))
+				if flip {
+					v = 255 - v
+				}
+				img.SetGray(x, y, color.Gray{Y: v})
+			}
+		}
+		return img
+	}
+
+	original := perceptualHash(gradient(320, 240, false))
+	resized := perceptualHash(gradient(100, 75, false))
+	different := perceptualHash(gradient(320, 240, true))
+
+	if dist := bits.OnesCount64(original ^ resized); dist > defaultMaxImageDistance {
+		t.Errorf("expected resized image to have a similar hash, but distance is %d", dist)
+	}
+	if dist := bits.OnesCount64(original ^ different); dist <= defaultMaxImageDistance {
+		t.Errorf("expected different image to have a different hash, but distance is %d", dist)
+	}
+}
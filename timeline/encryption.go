@@ -0,0 +1,750 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encryption of timelines works differently for the files of the timeline
+// and its databases.
+//
+// Data files, assets, and previews are encrypted when they are written and
+// decrypted when they are read, so they are never plaintext in the repo,
+// even while the timeline is open: they are read with OpenRepoFile or
+// RepoFS, or, for programs that need a file path (like ffmpeg), decrypted
+// to a temporary file with DecryptedPath. Files that were written before
+// encryption was enabled are encrypted once, when it is enabled.
+//
+// The databases, however, are NOT encrypted while the timeline is open,
+// since the SQLite driver we use doesn't support page-level encryption
+// (like SQLCipher does). They are encrypted in place when the timeline is
+// closed, and decrypted by Unlock, which checks the passphrase and opens
+// the timeline; a timeline with encryption enabled can't be opened with
+// Open. So while the timeline is open, or if the program stops without
+// closing it, the databases are plaintext on disk until the timeline is
+// unlocked and closed again. The cache folder is not encrypted.
+
+var (
+	// ErrLocked is returned when opening a timeline that is encrypted;
+	// it must be unlocked with its passphrase instead.
+	ErrLocked = errors.New("timeline is encrypted and locked")
+
+	// ErrIncorrectPassphrase is returned when unlocking a timeline
+	// with the wrong passphrase.
+	ErrIncorrectPassphrase = errors.New("incorrect passphrase")
+)
+
+// encryptionParams describes how the key of an encrypted timeline is
+// derived from its passphrase. It is stored, in plaintext, in the
+// EncryptionFilename file of the repo.
+type encryptionParams struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"` // always "argon2id"
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+
+	// a known value sealed with the key, to check the passphrase
+	// before decrypting anything with it
+	Check []byte `json:"check"`
+}
+
+// IsEncrypted returns true if the timeline in repo has encryption enabled.
+func IsEncrypted(repo string) bool {
+	return FileExists(filepath.Join(repo, EncryptionFilename))
+}
+
+// EnableEncryption turns on encryption of the timeline with a key derived
+// from passphrase. The files of the timeline are encrypted right away, which
+// takes time proportional to their size, and no jobs may be running. The
+// databases are encrypted when the timeline is closed, and from then on, it
+// can only be opened with Unlock. The passphrase can't be recovered or
+// changed, so it must be kept safe.
+func (tl *Timeline) EnableEncryption(passphrase string) error {
+	if passphrase == "" {
+		return errors.New("passphrase is required")
+	}
+	if IsEncrypted(tl.repoDir) {
+		return errors.New("timeline is already encrypted")
+	}
+	tl.activeJobsMu.RLock()
+	for id := range tl.activeJobs {
+		tl.activeJobsMu.RUnlock()
+		return fmt.Errorf("job %d is running; encryption can only be enabled while no jobs are running", id)
+	}
+	tl.activeJobsMu.RUnlock()
+
+	params := encryptionParams{
+		Version: encryptionVersion,
+		KDF:     "argon2id",
+		Salt:    make([]byte, 16),
+		Time:    argon2Time,
+		Memory:  argon2Memory,
+		Threads: argon2Threads,
+	}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return err
+	}
+	key := params.deriveKey(passphrase)
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	params.Check = aead.Seal(nonce, nonce, []byte(encryptionCheckValue), nil)
+
+	paramsJSON, err := json.MarshalIndent(params, "", "\t")
+	if err != nil {
+		return err
+	}
+	// write atomically, since a corrupt file would lock the user out
+	paramsFile := filepath.Join(tl.repoDir, EncryptionFilename)
+	if err := os.WriteFile(paramsFile+".tmp", paramsJSON, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(paramsFile+".tmp", paramsFile); err != nil {
+		return err
+	}
+
+	// from now on, files are written encrypted, so once the ones that are
+	// already there are encrypted, there are no plaintext files left
+	tl.encryptionKey.Store(&key)
+	start := time.Now()
+	files, err := forEachDataFile(tl.repoDir, func(path string) (bool, error) {
+		return sealFile(key, path)
+	})
+	if err != nil {
+		return fmt.Errorf("encrypting files: %w", err)
+	}
+	Log.Info("enabled encryption of timeline; the database will be encrypted when closed",
+		zap.String("repo", tl.repoDir),
+		zap.Int("files", files),
+		zap.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// Unlock decrypts the databases of the encrypted timeline in repo with its
+// passphrase, then opens it like Open. When the timeline is closed, they are
+// encrypted again. If the passphrase is wrong, ErrIncorrectPassphrase is
+// returned.
+func Unlock(ctx context.Context, repo, cache, passphrase string) (*Timeline, error) {
+	paramsJSON, err := os.ReadFile(filepath.Join(repo, EncryptionFilename))
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption parameters: %w", err)
+	}
+	var params encryptionParams
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("decoding encryption parameters: %w", err)
+	}
+	if params.Version != encryptionVersion || params.KDF != "argon2id" {
+		return nil, fmt.Errorf("unsupported encryption: version %d, kdf %s", params.Version, params.KDF)
+	}
+
+	key := params.deriveKey(passphrase)
+	if err := params.verifyKey(key); err != nil {
+		return nil, err
+	}
+
+	if _, err := forEachDBFile(repo, func(path string) (bool, error) {
+		return unsealFile(key, path)
+	}); err != nil {
+		return nil, fmt.Errorf("decrypting database: %w", err)
+	}
+	Log.Info("decrypted database of timeline", zap.String("repo", repo))
+
+	tl, err := openExisting(ctx, repo, cache)
+	if err != nil {
+		return nil, err
+	}
+	tl.encryptionKey.Store(&key)
+	return tl, nil
+}
+
+// seal encrypts the databases of the timeline, which must be closed.
+func (tl *Timeline) seal() error {
+	if _, err := forEachDBFile(tl.repoDir, func(path string) (bool, error) {
+		return sealFile(tl.fileKey(), path)
+	}); err != nil {
+		return fmt.Errorf("encrypting database: %w", err)
+	}
+	Log.Info("encrypted database of timeline", zap.String("repo", tl.repoDir))
+	return nil
+}
+
+// fileKey returns the key with which the files of the timeline are
+// encrypted, or nil if encryption is not enabled.
+func (tl *Timeline) fileKey() []byte {
+	if key := tl.encryptionKey.Load(); key != nil {
+		return *key
+	}
+	return nil
+}
+
+// RepoFile is a file of the repository opened for reading. If the file
+// is encrypted, it is decrypted as it is read.
+type RepoFile interface {
+	io.ReadSeekCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// OpenRepoFile opens the file at the path relative to the repo root (like
+// a data file or asset) for reading, decrypting it if it is encrypted.
+func (tl *Timeline) OpenRepoFile(name string) (RepoFile, error) {
+	return tl.openFile(tl.FullPath(name))
+}
+
+// openFile is like OpenRepoFile, but with the full path of the file.
+func (tl *Timeline) openFile(fpath string) (RepoFile, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	magic := make([]byte, len(sealMagic))
+	if n, _ := f.ReadAt(magic, 0); !info.Mode().IsRegular() || n < len(magic) || string(magic) != sealMagic {
+		return f, nil
+	}
+	key := tl.fileKey()
+	if key == nil {
+		f.Close()
+		return nil, fmt.Errorf("%s is encrypted, but the timeline has no key", fpath)
+	}
+	sf, err := openSealedFile(key, f, info)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fpath, err)
+	}
+	return sf, nil
+}
+
+// RepoFS returns the repository as a file system in which encrypted
+// files are decrypted as they are read.
+func (tl *Timeline) RepoFS() fs.FS { return repoFS{tl} }
+
+type repoFS struct{ tl *Timeline }
+
+func (rfs repoFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, err := rfs.tl.OpenRepoFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// DecryptedPath returns the full path of a plaintext copy of the file at
+// the path relative to the repo root, for programs that read files by path
+// (like ffmpeg). It is the file itself, unless it is encrypted, in which
+// case it is decrypted to a temporary file. The returned function deletes
+// the temporary file, if any, and must be called when done with it.
+func (tl *Timeline) DecryptedPath(name string) (string, func(), error) {
+	fpath := tl.FullPath(name)
+	if tl.fileKey() == nil {
+		return fpath, func() {}, nil
+	}
+	f, err := tl.openFile(fpath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	if _, ok := f.(*sealedFile); !ok {
+		return fpath, func() {}, nil
+	}
+
+	// keep the extension, since some programs go by it
+	tmp, err := os.CreateTemp("", "timelinize_decrypted_*"+filepath.Ext(fpath))
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = io.Copy(tmp, f)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", nil, fmt.Errorf("decrypting %s: %w", name, err)
+	}
+	return tmp.Name(), func() { _ = os.Remove(tmp.Name()) }, nil
+}
+
+// encryptingWriter returns a writer that encrypts what is written to w,
+// if encryption is enabled; otherwise, it writes to w as is. It must be
+// closed when done, which doesn't close w.
+func (tl *Timeline) encryptingWriter(w io.Writer) (io.WriteCloser, error) {
+	if key := tl.fileKey(); key != nil {
+		return newSealWriter(key, w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (params encryptionParams) deriveKey(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), params.Salt, params.Time, params.Memory, params.Threads, 32)
+}
+
+func (params encryptionParams) verifyKey(key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	if len(params.Check) < aead.NonceSize() {
+		return errors.New("encryption parameters are corrupt")
+	}
+	nonce, sealed := params.Check[:aead.NonceSize()], params.Check[aead.NonceSize():]
+	check, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil || string(check) != encryptionCheckValue {
+		return ErrIncorrectPassphrase
+	}
+	return nil
+}
+
+// forEachDBFile calls fn for each database file of the repo. fn returns
+// whether it changed the file, and the number of changed files is returned.
+func forEachDBFile(repo string, fn func(path string) (bool, error)) (int, error) {
+	var changed int
+	for _, name := range []string{DBFilename, DBFilename + "-wal", ThumbsDBFilename, ThumbsDBFilename + "-wal"} {
+		ok, err := fn(filepath.Join(repo, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return changed, fmt.Errorf("%s: %w", name, err)
+		}
+		if ok {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// forEachDataFile is like forEachDBFile, but for all the files in the data,
+// assets, and previews folders.
+func forEachDataFile(repo string, fn func(path string) (bool, error)) (int, error) {
+	var changed int
+	for _, dir := range []string{DataFolderName, AssetsFolderName, PreviewsFolderName} {
+		root := filepath.Join(repo, dir)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && path == root {
+				return nil
+			}
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			ok, err := fn(path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if ok {
+				changed++
+			}
+			return nil
+		})
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// sealFile encrypts the file in place, unless it is already encrypted.
+func sealFile(key []byte, path string) (bool, error) {
+	return rewriteFile(path, func(in *bufio.Reader, out io.Writer) (bool, error) {
+		if isSealed(in) {
+			return false, nil
+		}
+		return true, encryptStream(key, in, out)
+	})
+}
+
+// unsealFile decrypts the file in place, if it is encrypted.
+func unsealFile(key []byte, path string) (bool, error) {
+	return rewriteFile(path, func(in *bufio.Reader, out io.Writer) (bool, error) {
+		if !isSealed(in) {
+			return false, nil
+		}
+		return true, decryptStream(key, in, out)
+	})
+}
+
+// encryptFile writes the contents of the file at src, encrypted, to dst.
+func encryptFile(key []byte, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	bufw := bufio.NewWriter(out)
+	err = encryptStream(key, bufio.NewReaderSize(in, sealChunkSize), bufw)
+	if err == nil {
+		err = bufw.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rewriteFile replaces the contents of the file at path with what
+// transform writes, atomically, so that an interruption doesn't leave
+// a half-encrypted file. If transform returns false, the file isn't
+// changed.
+func rewriteFile(path string, transform func(in *bufio.Reader, out io.Writer) (bool, error)) (bool, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	tmpPath := path + ".tlzseal"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	bufw := bufio.NewWriter(out)
+	changed, err := transform(bufio.NewReaderSize(in, sealChunkSize), bufw)
+	if err == nil && changed {
+		err = bufw.Flush()
+	}
+	if err == nil && changed {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !changed {
+		return false, err
+	}
+	in.Close()
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return false, err
+	}
+	// preserve modification times, since they're used to compare data files
+	return true, os.Chtimes(path, time.Time{}, info.ModTime())
+}
+
+// Encrypted files begin with sealMagic, followed by a random salt from
+// which the key of the file is derived (so that nonces are never reused),
+// followed by the contents in chunks of sealChunkSize bytes, each sealed
+// with AES-GCM. The nonce of each chunk is its sequence number, with a
+// flag on the last chunk, so chunks can't be reordered or truncated.
+const (
+	sealMagic     = "TLZSEAL\x01"
+	sealSaltSize  = 16
+	sealChunkSize = 64 * 1024
+)
+
+func isSealed(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(sealMagic))
+	return string(magic) == sealMagic
+}
+
+func encryptStream(key []byte, r *bufio.Reader, w io.Writer) error {
+	sw, err := newSealWriter(key, w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(sw, r); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+func decryptStream(key []byte, r *bufio.Reader, w io.Writer) error {
+	header := make([]byte, len(sealMagic)+sealSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	aead, err := fileAEAD(key, header[len(sealMagic):])
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]byte, sealChunkSize+aead.Overhead())
+	var chunk []byte
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, sealed)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			if errors.Is(err, io.EOF) {
+				return errors.New("encrypted file is truncated")
+			}
+			return err
+		}
+		_, peekErr := r.Peek(1)
+		last := errors.Is(peekErr, io.EOF)
+		chunk, err = aead.Open(chunk[:0], chunkNonce(aead, counter, last), sealed[:n], header)
+		if err != nil {
+			return fmt.Errorf("decrypting chunk %d: %w", counter, err)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// sealWriter encrypts what is written to it in the format described above.
+// It must be closed to write the last chunk; that doesn't close the
+// underlying writer.
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	sealed  []byte
+	counter uint64
+}
+
+func newSealWriter(key []byte, w io.Writer) (*sealWriter, error) {
+	salt := make([]byte, sealSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(sealMagic), salt...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, sealChunkSize),
+		sealed: make([]byte, 0, sealChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (sw *sealWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		// a full chunk is only written once there's more, since
+		// the last chunk is sealed differently
+		if len(sw.buf) == sealChunkSize {
+			if err := sw.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(sw.buf[len(sw.buf):sealChunkSize], p)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (sw *sealWriter) Close() error {
+	return sw.writeChunk(true)
+}
+
+func (sw *sealWriter) writeChunk(last bool) error {
+	sw.sealed = sw.aead.Seal(sw.sealed[:0], chunkNonce(sw.aead, sw.counter, last), sw.buf, sw.header)
+	sw.counter++
+	sw.buf = sw.buf[:0]
+	_, err := sw.w.Write(sw.sealed)
+	return err
+}
+
+// sealedFile is an encrypted file opened for reading, which reads and seeks
+// in the plaintext. Since chunks are a fixed size, it only needs to decrypt
+// the chunk it is reading from.
+type sealedFile struct {
+	f      *os.File
+	info   fs.FileInfo
+	aead   cipher.AEAD
+	header []byte
+	chunks int64 // number of chunks in the file
+	size   int64 // of the plaintext
+	offset int64 // in the plaintext
+
+	chunk    []byte // the decrypted chunk at chunkIdx
+	chunkIdx int64
+	sealed   []byte
+}
+
+func openSealedFile(key []byte, f *os.File, info fs.FileInfo) (*sealedFile, error) {
+	header := make([]byte, len(sealMagic)+sealSaltSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(key, header[len(sealMagic):])
+	if err != nil {
+		return nil, err
+	}
+	sealedChunkSize := int64(sealChunkSize + aead.Overhead())
+	body := info.Size() - int64(len(header))
+	chunks := (body + sealedChunkSize - 1) / sealedChunkSize
+	if chunks == 0 || body-(chunks-1)*sealedChunkSize < int64(aead.Overhead()) {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	return &sealedFile{
+		f:        f,
+		info:     info,
+		aead:     aead,
+		header:   header,
+		chunks:   chunks,
+		size:     body - chunks*int64(aead.Overhead()),
+		chunkIdx: -1,
+		sealed:   make([]byte, sealedChunkSize),
+	}, nil
+}
+
+func (sf *sealedFile) Read(p []byte) (int, error) {
+	if sf.offset >= sf.size {
+		return 0, io.EOF
+	}
+	idx := sf.offset / sealChunkSize
+	if idx != sf.chunkIdx {
+		if err := sf.loadChunk(idx); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, sf.chunk[sf.offset-idx*sealChunkSize:])
+	sf.offset += int64(n)
+	return n, nil
+}
+
+func (sf *sealedFile) loadChunk(idx int64) error {
+	sealedChunkSize := int64(len(sf.sealed))
+	n, err := sf.f.ReadAt(sf.sealed, int64(len(sf.header))+idx*sealedChunkSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	sf.chunkIdx = -1
+	sf.chunk, err = sf.aead.Open(sf.chunk[:0], chunkNonce(sf.aead, uint64(idx), idx == sf.chunks-1), sf.sealed[:n], sf.header)
+	if err != nil {
+		return fmt.Errorf("decrypting chunk %d: %w", idx, err)
+	}
+	sf.chunkIdx = idx
+	return nil
+}
+
+func (sf *sealedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sf.offset
+	case io.SeekEnd:
+		offset += sf.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	sf.offset = offset
+	return offset, nil
+}
+
+func (sf *sealedFile) Stat() (fs.FileInfo, error) {
+	return sealedFileInfo{sf.info, sf.size}, nil
+}
+
+func (sf *sealedFile) Close() error { return sf.f.Close() }
+
+// sealedFileInfo is the info of an encrypted file, with the size of its plaintext.
+type sealedFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (info sealedFileInfo) Size() int64 { return info.size }
+
+func chunkNonce(aead cipher.AEAD, counter uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// fileAEAD returns the cipher for a file with the given salt.
+func fileAEAD(key, salt []byte) (cipher.AEAD, error) {
+	fileKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte("timelinize file")), fileKey); err != nil {
+		return nil, err
+	}
+	return newAEAD(fileKey)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+const (
+	encryptionVersion    = 1
+	encryptionCheckValue = "timelinize"
+
+	// recommended parameters of argon2id (RFC 9106, second recommendation)
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
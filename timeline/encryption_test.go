@@ -0,0 +1,256 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+
+	tl, err := Create(ctx, repo, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataFile := path.Join(DataFolderName, "photo.jpg")
+	if err := os.MkdirAll(filepath.Join(repo, DataFolderName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	contents := bytes.Repeat([]byte("photo"), sealChunkSize/2) // more than one chunk
+	if err := os.WriteFile(tl.FullPath(dataFile), contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.EnableEncryption("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	// files are encrypted right away, and decrypted as they are read
+	if sealed, err := fileIsSealed(tl.FullPath(dataFile)); err != nil || !sealed {
+		t.Errorf("expected data file to be encrypted after enabling encryption (err=%v)", err)
+	}
+	checkDecrypted(t, tl, dataFile, contents)
+
+	// as are new files
+	newFile := path.Join(DataFolderName, "note.txt")
+	f, err := os.Create(tl.FullPath(newFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := tl.encryptingWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sealed, err := fileIsSealed(tl.FullPath(newFile)); err != nil || !sealed {
+		t.Errorf("expected newly written file to be encrypted (err=%v)", err)
+	}
+	checkDecrypted(t, tl, newFile, []byte("hello"))
+
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sealed, err := fileIsSealed(filepath.Join(repo, DBFilename)); err != nil || !sealed {
+		t.Errorf("expected database to be encrypted after closing (err=%v)", err)
+	}
+	if ok, err := Valid(ctx, repo); err != nil || !ok {
+		t.Errorf("expected encrypted timeline to be valid, got %t (err=%v)", ok, err)
+	}
+	if _, err := Open(ctx, repo, t.TempDir()); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected opening encrypted timeline to fail with %v, got %v", ErrLocked, err)
+	}
+	if _, err := Unlock(ctx, repo, t.TempDir(), "wrong horse"); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Errorf("expected unlocking with wrong passphrase to fail with %v, got %v", ErrIncorrectPassphrase, err)
+	}
+
+	tl, err = Unlock(ctx, repo, t.TempDir(), "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tl.Empty() {
+		t.Error("expected decrypted timeline to be readable and empty")
+	}
+	if sealed, err := fileIsSealed(tl.FullPath(dataFile)); err != nil || !sealed {
+		t.Errorf("expected data file to stay encrypted after unlocking (err=%v)", err)
+	}
+	checkDecrypted(t, tl, dataFile, contents)
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealedFileSeek(t *testing.T) {
+	tl := &Timeline{repoDir: t.TempDir()}
+	key := bytes.Repeat([]byte{1}, 32)
+	tl.encryptionKey.Store(&key)
+
+	plaintext := make([]byte, sealChunkSize*2+100)
+	for i := range plaintext {
+		plaintext[i] = byte(i % 251)
+	}
+	var sealed bytes.Buffer
+	if err := encryptStream(key, bufio.NewReader(bytes.NewReader(plaintext)), &sealed); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tl.FullPath("file"), sealed.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := tl.OpenRepoFile("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() != int64(len(plaintext)) {
+		t.Fatalf("expected size %d, got %v (err=%v)", len(plaintext), info, err)
+	}
+	for _, offset := range []int64{0, sealChunkSize - 10, sealChunkSize, sealChunkSize*2 + 50} {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 20)
+		n, err := io.ReadFull(f, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		if want := plaintext[offset:min(offset+20, int64(len(plaintext)))]; !bytes.Equal(buf[:n], want) {
+			t.Errorf("offset %d: expected %v, got %v", offset, want, buf[:n])
+		}
+	}
+	if end, err := f.Seek(0, io.SeekEnd); err != nil || end != int64(len(plaintext)) {
+		t.Errorf("expected end at %d, got %d (err=%v)", len(plaintext), end, err)
+	}
+}
+
+func TestCloseWaitsForJobsBeforeSealing(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+	tl, err := Create(ctx, repo, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.EnableEncryption("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &ActiveJob{done: make(chan struct{})}
+	tl.activeJobsMu.Lock()
+	tl.activeJobs[1] = job
+	tl.activeJobsMu.Unlock()
+
+	closed := make(chan error, 1)
+	go func() { closed <- tl.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("expected Close to wait for the active job, but it returned (err=%v)", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(job.done)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if sealed, err := fileIsSealed(filepath.Join(repo, DBFilename)); err != nil || !sealed {
+		t.Errorf("expected database to be encrypted after closing (err=%v)", err)
+	}
+}
+
+func TestSealedStreamTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	plaintext := bytes.Repeat([]byte("x"), sealChunkSize*2)
+	var sealed bytes.Buffer
+	if err := encryptStream(key, bufio.NewReader(bytes.NewReader(plaintext)), &sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ciphertext := range map[string][]byte{
+		"truncated at chunk boundary": sealed.Bytes()[:len(sealMagic)+sealSaltSize+sealChunkSize+16],
+		"flipped bit":                 flipBit(sealed.Bytes(), sealed.Len()/2),
+	} {
+		err := decryptStream(key, bufio.NewReader(bytes.NewReader(ciphertext)), &bytes.Buffer{})
+		if err == nil {
+			t.Errorf("%s: expected decryption to fail", name)
+		}
+	}
+
+	var decrypted bytes.Buffer
+	if err := decryptStream(key, bufio.NewReader(bytes.NewReader(sealed.Bytes())), &decrypted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), plaintext) {
+		t.Error("decrypted contents don't match")
+	}
+}
+
+func checkDecrypted(t *testing.T, tl *Timeline, name string, want []byte) {
+	t.Helper()
+	f, err := tl.OpenRepoFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("%s was not decrypted correctly when opened (err=%v)", name, err)
+	}
+	if got, err := fs.ReadFile(tl.RepoFS(), name); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("%s was not decrypted correctly when read from the repo FS (err=%v)", name, err)
+	}
+	fpath, done, err := tl.DecryptedPath(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if got, err := os.ReadFile(fpath); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("%s was not decrypted correctly to a path (err=%v)", name, err)
+	}
+}
+
+func fileIsSealed(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return isSealed(bufio.NewReader(f)), nil
+}
+
+func flipBit(b []byte, i int) []byte {
+	b = bytes.Clone(b)
+	b[i] ^= 1
+	return b
+}
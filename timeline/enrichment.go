@@ -0,0 +1,790 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
+	"go.uber.org/zap"
+)
+
+// EnrichmentTask is a kind of analysis that enrichment performs on the
+// content of items. All analysis is done by the local ML server, so the
+// content never leaves the machine.
+type EnrichmentTask string
+
+const (
+	// Recognize text in images of documents, screenshots, and the like.
+	EnrichOCR EnrichmentTask = "ocr"
+
+	// Tag images with the objects and scenes they depict.
+	EnrichTags EnrichmentTask = "tags"
+
+	// Detect faces in images and cluster them by similarity.
+	EnrichFaces EnrichmentTask = "faces"
+)
+
+// Enrichment is what enrichment found in the content of an item.
+type Enrichment struct {
+	ItemID uint64          `json:"item_id"`
+	Text   string          `json:"text,omitempty"`
+	Tags   []EnrichmentTag `json:"tags,omitempty"`
+	Faces  []Face          `json:"faces,omitempty"`
+}
+
+// EnrichmentTag is a label of something an item depicts.
+type EnrichmentTag struct {
+	Label string  `json:"label"`
+	Score float64 `json:"score"`
+}
+
+// Face is a face detected in an item. Its box is relative to the
+// dimensions of the image, so each coordinate is from 0 to 1.
+type Face struct {
+	ID        uint64     `json:"id,omitempty"`
+	ItemID    uint64     `json:"item_id,omitempty"`
+	ClusterID *uint64    `json:"cluster_id,omitempty"`
+	Box       [4]float64 `json:"box"` // left, top, right, bottom
+	Score     float64    `json:"score,omitempty"`
+	Embedding []float32  `json:"embedding,omitempty"`
+}
+
+// FaceCluster is a group of similar faces, which are probably of the
+// same person. Linking it to an entity relates the items with its faces
+// to the entity, including items whose faces join the cluster later.
+type FaceCluster struct {
+	ID       uint64  `json:"id"`
+	EntityID *uint64 `json:"entity_id,omitempty"`
+	Size     int     `json:"size"`
+	Sample   *Face   `json:"sample,omitempty"` // the most confidently detected face
+}
+
+// Enrich creates a job that performs the given enrichment tasks (or all of
+// them, if none are given) on the items with the given IDs, or on all the
+// images in the timeline if no IDs are given, and returns the job ID. Any
+// earlier results of those tasks for the items are replaced.
+func (tl *Timeline) Enrich(itemIDs []uint64, tasks []EnrichmentTask) (uint64, error) {
+	for _, task := range tasks {
+		if !slices.Contains(allEnrichmentTasks, task) {
+			return 0, fmt.Errorf("unknown enrichment task: %s", task)
+		}
+	}
+	return tl.CreateJob(enrichmentJob{ItemIDs: itemIDs, Tasks: tasks}, time.Time{}, 0, 0, 0)
+}
+
+// ItemEnrichment returns what enrichment found in the item with the given ID.
+func (tl *Timeline) ItemEnrichment(ctx context.Context, itemID uint64) (Enrichment, error) {
+	result := Enrichment{ItemID: itemID}
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT kind, value, score FROM item_enrichments WHERE item_id=? ORDER BY score DESC`, itemID)
+	if err != nil {
+		return result, fmt.Errorf("querying enrichments: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, value string
+		var score *float64
+		if err := rows.Scan(&kind, &value, &score); err != nil {
+			return result, err
+		}
+		switch kind {
+		case enrichmentKindOCR:
+			result.Text = value
+		case enrichmentKindTag:
+			result.Tags = append(result.Tags, EnrichmentTag{Label: value, Score: deref(score)})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	result.Faces, err = queryFaces(ctx, tl.db, `WHERE item_id=? ORDER BY id`, itemID)
+	return result, err
+}
+
+// FaceClusters returns the clusters of faces, biggest first.
+func (tl *Timeline) FaceClusters(ctx context.Context) ([]FaceCluster, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `
+		SELECT face_clusters.id, face_clusters.entity_id, count(faces.id) AS size
+		FROM face_clusters
+		LEFT JOIN faces ON faces.cluster_id = face_clusters.id
+		GROUP BY face_clusters.id
+		ORDER BY size DESC, face_clusters.id`)
+	if err != nil {
+		return nil, fmt.Errorf("querying face clusters: %w", err)
+	}
+	var clusters []FaceCluster
+	for rows.Next() {
+		var fc FaceCluster
+		if err := rows.Scan(&fc.ID, &fc.EntityID, &fc.Size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		clusters = append(clusters, fc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, fc := range clusters {
+		faces, err := queryFaces(ctx, tl.db, `WHERE cluster_id=? ORDER BY score DESC LIMIT 1`, fc.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(faces) > 0 {
+			clusters[i].Sample = &faces[0]
+		}
+	}
+
+	return clusters, nil
+}
+
+// LinkFaceCluster links the cluster of faces to the entity, which relates
+// the items with those faces to the entity. An entity ID of 0 unlinks the
+// cluster, which removes the relationships.
+func (tl *Timeline) LinkFaceCluster(ctx context.Context, clusterID, entityID uint64) error {
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var oldEntityID *uint64
+	if err := tx.QueryRowContext(ctx, `SELECT entity_id FROM face_clusters WHERE id=? LIMIT 1`, clusterID).Scan(&oldEntityID); err != nil {
+		return fmt.Errorf("loading face cluster %d: %w", clusterID, err)
+	}
+
+	itemIDs, err := selectIDs(ctx, tx, `SELECT DISTINCT item_id FROM faces WHERE cluster_id=?`, clusterID)
+	if err != nil {
+		return fmt.Errorf("selecting items with faces in cluster: %w", err)
+	}
+
+	if oldEntityID != nil {
+		for _, itemID := range itemIDs {
+			if err := unrelateFaceCluster(ctx, tx, uint64(itemID), clusterID); err != nil { //nolint:gosec // row IDs are positive
+				return err
+			}
+		}
+	}
+
+	var newEntityID *uint64
+	if entityID != 0 {
+		newEntityID = &entityID
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE face_clusters SET entity_id=? WHERE id=?`, newEntityID, clusterID); err != nil {
+		return fmt.Errorf("linking face cluster: %w", err)
+	}
+
+	if newEntityID != nil {
+		for _, itemID := range itemIDs {
+			if err := tl.relateFaceCluster(ctx, tx, uint64(itemID), clusterID, entityID); err != nil { //nolint:gosec // row IDs are positive
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// storeEnrichment replaces the results of the given tasks for the item with
+// those in result. New faces are added to the most similar cluster of faces,
+// or to a new cluster if there isn't a similar enough one.
+func (tl *Timeline) storeEnrichment(ctx context.Context, itemID uint64, tasks []EnrichmentTask, result Enrichment) error {
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteEnrichments(ctx, tx, itemID, tasks); err != nil {
+		return err
+	}
+
+	if slices.Contains(tasks, EnrichOCR) && strings.TrimSpace(result.Text) != "" {
+		_, err := tx.ExecContext(ctx, `INSERT INTO item_enrichments (item_id, kind, value) VALUES (?, ?, ?)`,
+			itemID, enrichmentKindOCR, strings.TrimSpace(result.Text))
+		if err != nil {
+			return fmt.Errorf("storing recognized text: %w", err)
+		}
+	}
+	if slices.Contains(tasks, EnrichTags) {
+		for _, tag := range result.Tags {
+			_, err := tx.ExecContext(ctx, `INSERT INTO item_enrichments (item_id, kind, value, score) VALUES (?, ?, ?, ?)`,
+				itemID, enrichmentKindTag, tag.Label, tag.Score)
+			if err != nil {
+				return fmt.Errorf("storing tag: %w", err)
+			}
+		}
+	}
+	if slices.Contains(tasks, EnrichFaces) {
+		for _, face := range result.Faces {
+			if err := tl.storeFace(ctx, tx, itemID, face); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// storeFace stores the face and adds it to a cluster.
+func (tl *Timeline) storeFace(ctx context.Context, tx *sql.Tx, itemID uint64, face Face) error {
+	embedding := normalizeVector(face.Embedding)
+	if embedding == nil {
+		return errors.New("face has no embedding")
+	}
+	serialized, err := sqlite_vec.SerializeFloat32(embedding)
+	if err != nil {
+		return fmt.Errorf("serializing face embedding: %w", err)
+	}
+
+	// faces in the same image are of different people, so they can't share a cluster
+	var clusterID uint64
+	var entityID *uint64
+	var distance float64
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, entity_id, vec_distance_cosine(centroid, ?) AS distance
+		FROM face_clusters
+		WHERE vec_length(centroid) = ?
+			AND id NOT IN (SELECT cluster_id FROM faces WHERE item_id=? AND cluster_id IS NOT NULL)
+		ORDER BY distance
+		LIMIT 1`, serialized, len(embedding), itemID).Scan(&clusterID, &entityID, &distance)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("finding most similar face cluster: %w", err)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) || distance > faceClusterMaxDistance {
+		err := tx.QueryRowContext(ctx, `INSERT INTO face_clusters (centroid) VALUES (?) RETURNING id`, serialized).Scan(&clusterID)
+		if err != nil {
+			return fmt.Errorf("creating face cluster: %w", err)
+		}
+		entityID = nil
+	} else if err := updateFaceClusterCentroid(ctx, tx, clusterID, embedding); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO faces (item_id, cluster_id, left, top, right, bottom, score, embedding)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		itemID, clusterID, face.Box[0], face.Box[1], face.Box[2], face.Box[3], face.Score, serialized)
+	if err != nil {
+		return fmt.Errorf("storing face: %w", err)
+	}
+
+	if entityID != nil {
+		return tl.relateFaceCluster(ctx, tx, itemID, clusterID, *entityID)
+	}
+	return nil
+}
+
+// updateFaceClusterCentroid adds the (normalized) embedding of a new face
+// to the running mean of the cluster's face embeddings.
+func updateFaceClusterCentroid(ctx context.Context, tx *sql.Tx, clusterID uint64, embedding []float32) error {
+	var centroidBytes []byte
+	var size int
+	err := tx.QueryRowContext(ctx, `
+		SELECT centroid, (SELECT count() FROM faces WHERE cluster_id=face_clusters.id)
+		FROM face_clusters
+		WHERE id=?
+		LIMIT 1`, clusterID).Scan(&centroidBytes, &size)
+	if err != nil {
+		return fmt.Errorf("loading face cluster centroid: %w", err)
+	}
+	centroid := deserializeFloat32(centroidBytes)
+	if len(centroid) != len(embedding) {
+		return fmt.Errorf("face cluster %d has centroid of %d dimensions, but face embedding has %d", clusterID, len(centroid), len(embedding))
+	}
+	for i := range centroid {
+		centroid[i] = (centroid[i]*float32(size) + embedding[i]) / float32(size+1)
+	}
+	serialized, err := sqlite_vec.SerializeFloat32(centroid)
+	if err != nil {
+		return fmt.Errorf("serializing face cluster centroid: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE face_clusters SET centroid=? WHERE id=?`, serialized, clusterID); err != nil {
+		return fmt.Errorf("updating face cluster centroid: %w", err)
+	}
+	return nil
+}
+
+// recomputeFaceCluster recomputes the centroid of the cluster from the faces
+// that remain in it, after some were removed. Clusters with no faces left
+// are deleted, unless they are linked to an entity, so that more faces of
+// the entity can join it later.
+func recomputeFaceCluster(ctx context.Context, tx *sql.Tx, clusterID uint64) error {
+	rows, err := tx.QueryContext(ctx, `SELECT embedding FROM faces WHERE cluster_id=?`, clusterID)
+	if err != nil {
+		return fmt.Errorf("loading faces of cluster: %w", err)
+	}
+	var sum []float32
+	var size int
+	for rows.Next() {
+		var embeddingBytes []byte
+		if err := rows.Scan(&embeddingBytes); err != nil {
+			rows.Close()
+			return err
+		}
+		embedding := deserializeFloat32(embeddingBytes)
+		if sum == nil {
+			sum = make([]float32, len(embedding))
+		}
+		if len(embedding) != len(sum) {
+			continue
+		}
+		for i, v := range embedding {
+			sum[i] += v
+		}
+		size++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if size == 0 {
+		_, err := tx.ExecContext(ctx, `DELETE FROM face_clusters WHERE id=? AND entity_id IS NULL`, clusterID)
+		return err
+	}
+	for i := range sum {
+		sum[i] /= float32(size)
+	}
+	serialized, err := sqlite_vec.SerializeFloat32(sum)
+	if err != nil {
+		return fmt.Errorf("serializing face cluster centroid: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE face_clusters SET centroid=? WHERE id=?`, serialized, clusterID)
+	return err
+}
+
+// relateFaceCluster relates the item to the entity its face cluster is
+// linked to. The metadata of the relationship identifies the cluster, so
+// that it can be removed if the cluster is unlinked.
+func (tl *Timeline) relateFaceCluster(ctx context.Context, tx *sql.Tx, itemID, clusterID, entityID uint64) error {
+	attrID, err := (&latentID{entityID: entityID}).identifyingAttributeID(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("getting identifying attribute of entity %d: %w", entityID, err)
+	}
+	return tl.storeRelationship(ctx, tx, rawRelationship{
+		Relation:      RelIncludes,
+		fromItemID:    &itemID,
+		toAttributeID: &attrID,
+		metadata:      faceClusterMetadata(clusterID),
+	})
+}
+
+// unrelateFaceCluster removes the relationship between the item and the
+// entity that relateFaceCluster stored for the face cluster.
+func unrelateFaceCluster(ctx context.Context, tx *sql.Tx, itemID, clusterID uint64) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM relationships WHERE from_item_id=? AND metadata=?`,
+		itemID, string(faceClusterMetadata(clusterID)))
+	if err != nil {
+		return fmt.Errorf("removing relationship of item %d to face cluster's entity: %w", itemID, err)
+	}
+	return nil
+}
+
+func faceClusterMetadata(clusterID uint64) json.RawMessage {
+	return json.RawMessage(`{"face_cluster":` + strconv.FormatUint(clusterID, 10) + `}`)
+}
+
+// deleteEnrichments deletes the results of the given enrichment tasks (all of
+// them, if none are given) for the item, including the relationships that its
+// faces brought about.
+func deleteEnrichments(ctx context.Context, tx *sql.Tx, itemID uint64, tasks []EnrichmentTask) error {
+	if len(tasks) == 0 {
+		tasks = allEnrichmentTasks
+	}
+
+	var kinds []any
+	if slices.Contains(tasks, EnrichOCR) {
+		kinds = append(kinds, enrichmentKindOCR)
+	}
+	if slices.Contains(tasks, EnrichTags) {
+		kinds = append(kinds, enrichmentKindTag)
+	}
+	if len(kinds) > 0 {
+		_, err := tx.ExecContext(ctx, `DELETE FROM item_enrichments WHERE item_id=? AND kind IN `+sqlPlaceholders(len(kinds)),
+			append([]any{itemID}, kinds...)...)
+		if err != nil {
+			return fmt.Errorf("deleting enrichments of item %d: %w", itemID, err)
+		}
+	}
+
+	if !slices.Contains(tasks, EnrichFaces) {
+		return nil
+	}
+	clusterIDs, err := selectIDs(ctx, tx, `SELECT DISTINCT cluster_id FROM faces WHERE item_id=? AND cluster_id IS NOT NULL`, itemID)
+	if err != nil {
+		return fmt.Errorf("selecting face clusters of item %d: %w", itemID, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM faces WHERE item_id=?`, itemID); err != nil {
+		return fmt.Errorf("deleting faces of item %d: %w", itemID, err)
+	}
+	for _, clusterID := range clusterIDs {
+		if err := unrelateFaceCluster(ctx, tx, itemID, uint64(clusterID)); err != nil { //nolint:gosec // row IDs are positive
+			return err
+		}
+		if err := recomputeFaceCluster(ctx, tx, uint64(clusterID)); err != nil { //nolint:gosec // row IDs are positive
+			return fmt.Errorf("updating face cluster %d: %w", clusterID, err)
+		}
+	}
+	return nil
+}
+
+func queryFaces(ctx context.Context, db *sql.DB, clauses string, args ...any) ([]Face, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, item_id, cluster_id, left, top, right, bottom, score FROM faces `+clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying faces: %w", err)
+	}
+	defer rows.Close()
+
+	var faces []Face
+	for rows.Next() {
+		var f Face
+		var score *float64
+		if err := rows.Scan(&f.ID, &f.ItemID, &f.ClusterID, &f.Box[0], &f.Box[1], &f.Box[2], &f.Box[3], &score); err != nil {
+			return nil, err
+		}
+		f.Score = deref(score)
+		faces = append(faces, f)
+	}
+	return faces, rows.Err()
+}
+
+// enrichmentJob is the job action that enriches items.
+type enrichmentJob struct {
+	// be sure not to include duplicates in this list
+	ItemIDs []uint64 `json:"item_ids,omitempty"`
+
+	// infer items from the given import job
+	ItemsFromImportJob uint64 `json:"items_from_import_job,omitempty"`
+
+	// the tasks to perform; all of them if empty
+	Tasks []EnrichmentTask `json:"tasks,omitempty"`
+}
+
+type enrichmentJobCheckpoint struct {
+	LastItemID uint64 `json:"last_item_id"`
+}
+
+func (ej enrichmentJob) Run(job *ActiveJob, checkpoint []byte) error {
+	var chkpt enrichmentJobCheckpoint
+	if checkpoint != nil {
+		if err := json.Unmarshal(checkpoint, &chkpt); err != nil {
+			job.Logger().Error("failed to resume from checkpoint", zap.Error(err))
+		}
+		job.Logger().Info("resuming from checkpoint", zap.Uint64("last_item_id", chkpt.LastItemID))
+	}
+
+	tasks := ej.Tasks
+	if len(tasks) == 0 {
+		tasks = allEnrichmentTasks
+	}
+
+	// only images with content qualify; redacted items have none
+	where := `items.deleted IS NULL
+		AND items.data_type LIKE 'image/%'
+		AND (items.data_file IS NOT NULL OR items.data_id IS NOT NULL)`
+	var args []any
+	if len(ej.ItemIDs) > 0 {
+		in, ids := sqlArray(ej.ItemIDs)
+		where += " AND items.id IN " + in
+		args = append(args, ids...)
+	} else if ej.ItemsFromImportJob > 0 {
+		where += " AND (items.job_id=? OR items.modified_job_id=?)"
+		args = append(args, ej.ItemsFromImportJob, ej.ItemsFromImportJob)
+	}
+
+	job.tl.dbMu.RLock()
+	var jobSize int
+	err := job.tl.db.QueryRowContext(job.ctx, `SELECT count() FROM items WHERE `+where, args...).Scan(&jobSize)
+	job.tl.dbMu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("counting items to enrich: %w", err)
+	}
+	job.SetTotal(jobSize)
+
+	if jobSize == 0 {
+		job.Logger().Info("no items to enrich")
+		return nil
+	}
+
+	job.Logger().Info("waiting until Python server is ready")
+	if !pythonServerReady(job.ctx, true) {
+		return errors.New("python server not ready")
+	}
+
+	job.Logger().Info("enriching items", zap.Int("count", jobSize), zap.Any("tasks", tasks))
+
+	lastItemID := chkpt.LastItemID
+	for {
+		const pageSize = 1000
+
+		job.tl.dbMu.RLock()
+		ids, err := selectIDs(job.ctx, job.tl.db, `SELECT items.id FROM items
+			WHERE `+where+` AND items.id > ?
+			ORDER BY items.id
+			LIMIT ?`, slices.Concat(args, []any{lastItemID, pageSize})...)
+		job.tl.dbMu.RUnlock()
+		if err != nil {
+			return fmt.Errorf("selecting page of items to enrich: %w", err)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		for i, id := range ids {
+			if err := job.Continue(); err != nil {
+				return err
+			}
+
+			itemID := uint64(id) //nolint:gosec // row IDs are positive
+			if err := ej.enrichItem(job, itemID, tasks); err != nil {
+				job.Logger().Error("failed enriching item", zap.Uint64("item_id", itemID), zap.Error(err))
+			}
+			job.Progress(1)
+			lastItemID = itemID
+
+			const checkpointInterval = 10
+			if i%checkpointInterval == checkpointInterval-1 {
+				if err := job.Checkpoint(enrichmentJobCheckpoint{LastItemID: lastItemID}); err != nil {
+					job.Logger().Error("failed to save checkpoint", zap.Uint64("last_item_id", lastItemID), zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+func (enrichmentJob) enrichItem(job *ActiveJob, itemID uint64, tasks []EnrichmentTask) error {
+	var data []byte
+	var dataFile, dataType, itemFilename *string
+
+	job.tl.dbMu.RLock()
+	err := job.tl.db.QueryRowContext(job.ctx,
+		`SELECT items.data_file, items.data_type, items.filename, item_data.content
+		FROM items
+		LEFT JOIN item_data ON item_data.id = items.data_id
+		WHERE items.id=?
+		LIMIT 1`, itemID).Scan(&dataFile, &dataType, &itemFilename, &data)
+	job.tl.dbMu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("querying item to enrich: %w", err)
+	}
+	if dataType == nil {
+		return fmt.Errorf("item %d has no data type", itemID)
+	}
+	input := enrichmentInput{dataType: *dataType, data: data}
+	if dataFile != nil {
+		fn, done, err := job.tl.DecryptedPath(*dataFile)
+		if err != nil {
+			return fmt.Errorf("opening data file: %w", err)
+		}
+		defer done()
+		input.filename = &fn
+	}
+
+	result := Enrichment{ItemID: itemID}
+
+	// tags also tell us whether the image has text worth recognizing
+	var tags []EnrichmentTag
+	if slices.Contains(tasks, EnrichTags) || slices.Contains(tasks, EnrichOCR) {
+		qs := url.Values{"labels": enrichmentTagLabels}
+		if err := input.query(job.ctx, "/tags", qs, &tags); err != nil {
+			return fmt.Errorf("tagging: %w", err)
+		}
+		for _, tag := range tags {
+			if tag.Score >= enrichmentTagMinScore {
+				result.Tags = append(result.Tags, tag)
+			}
+		}
+	}
+	if slices.Contains(tasks, EnrichOCR) && hasText(result.Tags, deref(itemFilename)) {
+		var ocr struct {
+			Text string `json:"text"`
+		}
+		if err := input.query(job.ctx, "/ocr", nil, &ocr); err != nil {
+			return fmt.Errorf("recognizing text: %w", err)
+		}
+		result.Text = ocr.Text
+	}
+	if slices.Contains(tasks, EnrichFaces) {
+		if err := input.query(job.ctx, "/faces", nil, &result.Faces); err != nil {
+			return fmt.Errorf("detecting faces: %w", err)
+		}
+	}
+
+	return job.tl.storeEnrichment(job.ctx, itemID, tasks, result)
+}
+
+// enrichmentInput is the content of an item to analyze: either a file in
+// the repo, or data from the database.
+type enrichmentInput struct {
+	dataType string
+	data     []byte
+	filename *string
+}
+
+// query sends the input to the given endpoint of the local ML server, and
+// decodes the JSON response into v.
+func (in enrichmentInput) query(ctx context.Context, path string, qs url.Values, v any) error {
+	if qs == nil {
+		qs = make(url.Values)
+	}
+	var body io.Reader
+	if in.filename != nil {
+		qs.Set("filename", *in.filename)
+	} else {
+		body = bytes.NewReader(in.data)
+	}
+	endpoint := pyServerURL(path)
+	if len(qs) > 0 {
+		endpoint += "?" + qs.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "QUERY", endpoint, body)
+	if err != nil {
+		return fmt.Errorf("making request to ML server: %w", err)
+	}
+	req.Header.Set("Content-Type", in.dataType)
+
+	// throttle expensive operation
+	defer acquireCPUIntensiveThrottle()()
+
+	// check here in case the job was cancelled while we waited on the throttle
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("performing request to ML server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		const maxSize = 1024 * 10
+		msg, err := io.ReadAll(io.LimitReader(resp.Body, maxSize))
+		if err != nil {
+			return fmt.Errorf("error reading error response from ML server, HTTP %d: %w", resp.StatusCode, err)
+		}
+		return fmt.Errorf("got error status from ML server: HTTP %d (message='%s')", resp.StatusCode, msg)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding JSON response: %w", err)
+	}
+	return nil
+}
+
+// hasText returns true if an image with the given tags or filename probably
+// has text in it, so that OCR is worth the while.
+func hasText(tags []EnrichmentTag, filename string) bool {
+	lower := strings.ToLower(filename)
+	if strings.Contains(lower, "screenshot") || strings.Contains(lower, "scan") {
+		return true
+	}
+	for _, tag := range tags {
+		if slices.Contains(textTagLabels, tag.Label) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeVector returns v scaled to a length of 1, or nil if it has no length.
+func normalizeVector(v []float32) []float32 {
+	var sumSquares float64
+	for _, x := range v {
+		sumSquares += float64(x) * float64(x)
+	}
+	if sumSquares == 0 {
+		return nil
+	}
+	norm := float32(math.Sqrt(sumSquares))
+	normalized := make([]float32, len(v))
+	for i, x := range v {
+		normalized[i] = x / norm
+	}
+	return normalized
+}
+
+// deserializeFloat32 is the inverse of sqlite_vec.SerializeFloat32.
+func deserializeFloat32(b []byte) []float32 {
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+	return v
+}
+
+var allEnrichmentTasks = []EnrichmentTask{EnrichOCR, EnrichTags, EnrichFaces}
+
+// kinds of rows in the item_enrichments table
+const (
+	enrichmentKindOCR = "ocr"
+	enrichmentKindTag = "tag"
+)
+
+// Faces are in the same cluster if the cosine distance between a face's
+// embedding and the cluster's centroid is at most this much.
+const faceClusterMaxDistance = 0.35
+
+// Tags with a lower score than this are dropped.
+const enrichmentTagMinScore = 0.1
+
+// The labels that images are tagged with, if they depict them.
+var enrichmentTagLabels = append([]string{
+	"person", "group of people", "baby", "selfie",
+	"dog", "cat", "bird", "horse", "animal",
+	"car", "bicycle", "motorcycle", "boat", "airplane", "train",
+	"food", "drink", "cake", "flower", "plant", "tree",
+	"beach", "mountain", "forest", "lake", "river", "snow", "sunset", "night sky",
+	"city", "building", "street", "house", "room", "restaurant",
+	"party", "wedding", "concert", "sports", "landscape", "art",
+}, textTagLabels...)
+
+// Tags of images that probably have text in them.
+var textTagLabels = []string{"document", "screenshot", "receipt", "sign", "whiteboard", "handwriting"}
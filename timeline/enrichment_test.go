@@ -0,0 +1,175 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEnrichment(t *testing.T) {
+	ctx := context.Background()
+	tl := newTestTimeline(t)
+
+	mustExec(t, tl, `
+		INSERT INTO entities (id, type_id, name) VALUES (1, (SELECT id FROM entity_types WHERE name='person'), 'Alice');
+		INSERT INTO items (id, data_type, data_text) VALUES
+			(1, 'image/jpeg', 'one'),
+			(2, 'image/jpeg', 'two'),
+			(3, 'image/jpeg', 'three');`)
+
+	alice := []float32{1, 0, 0, 0}
+	bob := []float32{0, 1, 0, 0}
+	face := func(embedding ...float32) Face {
+		return Face{Box: [4]float64{0.1, 0.1, 0.3, 0.4}, Score: 0.9, Embedding: embedding}
+	}
+
+	// Alice and Bob are in the first photo, which has text; Alice is also
+	// in the second photo, and Bob in the third
+	if err := tl.storeEnrichment(ctx, 1, allEnrichmentTasks, Enrichment{
+		Text:  " Happy birthday! ",
+		Tags:  []EnrichmentTag{{Label: "party", Score: 0.4}, {Label: "sign", Score: 0.2}},
+		Faces: []Face{face(alice...), face(bob...)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.storeEnrichment(ctx, 2, allEnrichmentTasks, Enrichment{Faces: []Face{face(0.9, 0.1, 0, 0)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.storeEnrichment(ctx, 3, allEnrichmentTasks, Enrichment{Faces: []Face{face(0.1, 2, 0, 0)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := tl.FaceClusters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || clusters[0].Size != 2 || clusters[1].Size != 2 {
+		t.Fatalf("expected 2 clusters of 2 faces, got %+v", clusters)
+	}
+	aliceCluster := clusterOfItem(t, tl, 2)
+
+	enrichment, err := tl.ItemEnrichment(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enrichment.Text != "Happy birthday!" || len(enrichment.Tags) != 2 || enrichment.Tags[0].Label != "party" || len(enrichment.Faces) != 2 {
+		t.Errorf("unexpected enrichment of item 1: %+v", enrichment)
+	}
+
+	// linking the cluster relates its items to the entity, including items whose faces join it later
+	if err := tl.LinkFaceCluster(ctx, aliceCluster, 1); err != nil {
+		t.Fatal(err)
+	}
+	assertRelatedToEntity(t, tl, 1, []uint64{1, 2})
+	if err := tl.storeEnrichment(ctx, 3, []EnrichmentTask{EnrichFaces}, Enrichment{
+		Faces: []Face{face(0.1, 2, 0, 0), face(2, 0.2, 0, 0)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertRelatedToEntity(t, tl, 1, []uint64{1, 2, 3})
+
+	// enriching again replaces only the results of the tasks performed
+	if err := tl.storeEnrichment(ctx, 2, []EnrichmentTask{EnrichFaces}, Enrichment{}); err != nil {
+		t.Fatal(err)
+	}
+	assertRelatedToEntity(t, tl, 1, []uint64{1, 3})
+	if err := tl.storeEnrichment(ctx, 1, []EnrichmentTask{EnrichTags}, Enrichment{}); err != nil {
+		t.Fatal(err)
+	}
+	if enrichment, err = tl.ItemEnrichment(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if enrichment.Text == "" || len(enrichment.Tags) != 0 || len(enrichment.Faces) != 2 {
+		t.Errorf("expected only tags of item 1 to be replaced, got %+v", enrichment)
+	}
+
+	// redaction erases enrichments along with the content
+	if err := tl.redactItems(ctx, []uint64{1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if enrichment, err = tl.ItemEnrichment(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if enrichment.Text != "" || len(enrichment.Faces) != 0 {
+		t.Errorf("expected enrichment of redacted item to be deleted, got %+v", enrichment)
+	}
+	assertRelatedToEntity(t, tl, 1, []uint64{3})
+
+	if err := tl.LinkFaceCluster(ctx, aliceCluster, 0); err != nil {
+		t.Fatal(err)
+	}
+	assertRelatedToEntity(t, tl, 1, nil)
+}
+
+func TestHasText(t *testing.T) {
+	for i, tc := range []struct {
+		tags     []EnrichmentTag
+		filename string
+		expect   bool
+	}{
+		{nil, "IMG_0001.jpg", false},
+		{nil, "Screenshot 2024-01-02.png", true},
+		{[]EnrichmentTag{{Label: "dog"}}, "", false},
+		{[]EnrichmentTag{{Label: "dog"}, {Label: "receipt"}}, "", true},
+	} {
+		if actual := hasText(tc.tags, tc.filename); actual != tc.expect {
+			t.Errorf("test %d: expected %t, got %t", i, tc.expect, actual)
+		}
+	}
+}
+
+func clusterOfItem(t *testing.T, tl *Timeline, itemID uint64) uint64 {
+	t.Helper()
+	var clusterID uint64
+	if err := tl.db.QueryRow(`SELECT cluster_id FROM faces WHERE item_id=? LIMIT 1`, itemID).Scan(&clusterID); err != nil {
+		t.Fatal(err)
+	}
+	return clusterID
+}
+
+func assertRelatedToEntity(t *testing.T, tl *Timeline, entityID uint64, expectItemIDs []uint64) {
+	t.Helper()
+	rows, err := tl.db.Query(`
+		SELECT DISTINCT relationships.from_item_id
+		FROM relationships
+		JOIN entity_attributes ON entity_attributes.attribute_id = relationships.to_attribute_id
+		WHERE entity_attributes.entity_id=?
+		ORDER BY relationships.from_item_id`, entityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var itemIDs []uint64
+	for rows.Next() {
+		var id uint64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		itemIDs = append(itemIDs, id)
+	}
+	if len(itemIDs) != len(expectItemIDs) {
+		t.Fatalf("expected items %v to be related to entity %d, got %v", expectItemIDs, entityID, itemIDs)
+	}
+	for i := range itemIDs {
+		if itemIDs[i] != expectItemIDs[i] {
+			t.Fatalf("expected items %v to be related to entity %d, got %v", expectItemIDs, entityID, itemIDs)
+		}
+	}
+}
@@ -419,7 +419,14 @@ func (p *processor) processEntityPicture(ctx context.Context, e Entity) (string,
 	}
 	defer w.Close()
 
-	if _, err := io.Copy(w, buffered); err != nil {
+	out, err := p.tl.encryptingWriter(w)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, buffered); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
 		return "", err
 	}
 
@@ -616,7 +623,7 @@ func (p *processor) processEntity(ctx context.Context, tx *sql.Tx, in Entity) (l
 			}
 			q += " LIMIT 1"
 
-			err = tx.QueryRowContext(ctx, q, args...).Scan(&eaID, &existingDataSourceID)
+			err = p.tl.txQueryRow(ctx, tx, q, args...).Scan(&eaID, &existingDataSourceID)
 			noRows := errors.Is(err, sql.ErrNoRows)
 			if err != nil && !noRows {
 				return latentID{}, fmt.Errorf("checking for existing link of entity to attribute: %w (entity_id=%d attribute_id=%d)", err, entity.ID, attrID)
@@ -632,7 +639,7 @@ func (p *processor) processEntity(ctx context.Context, tx *sql.Tx, in Entity) (l
 			if noRows {
 				// the entity and attribute are not yet related in the DB; insert
 
-				_, err = tx.ExecContext(ctx,
+				_, err = p.tl.txExec(ctx, tx,
 					`INSERT INTO entity_attributes
 						(entity_id, attribute_id, data_source_id, job_id, autolink_job_id, autolink_attribute_id)
 					VALUES (?, ?, ?, ?, ?, ?)`,
@@ -644,7 +651,7 @@ func (p *processor) processEntity(ctx context.Context, tx *sql.Tx, in Entity) (l
 			} else if eaID > 0 && existingDataSourceID == nil {
 				// the entity and attribute are already related in the DB but not as an ID on any data source; update
 
-				_, err = tx.ExecContext(ctx,
+				_, err = p.tl.txExec(ctx, tx,
 					`UPDATE entity_attributes SET data_source_id=?, job_id=?, autolink_job_id=?, autolink_attribute_id=? WHERE id=?`, // TODO: LIMIT 1 would be nice...
 					linkedDataSourceID, p.ij.job.id, autolinkImportID, autolinkAttrIDPtr, eaID)
 				if err != nil {
@@ -808,6 +815,23 @@ func (tl *Timeline) MergeEntities(ctx context.Context, entityIDToKeep uint64, en
 		return fmt.Errorf("loading entity to keep: %w", err)
 	}
 
+	if err := tl.mergeEntities(ctx, entKeep, entitiesToMerge); err != nil {
+		return err
+	}
+
+	// the kept entity has new attributes, which may make it look like yet other entities
+	if err := tl.resolveEntities(ctx, []uint64{entityIDToKeep}); err != nil {
+		Log.Error("updating merge suggestions", zap.Uint64("entity_id", entityIDToKeep), zap.Error(err))
+	}
+
+	return nil
+}
+
+// mergeEntities merges the loaded entities into entKeep in a transaction,
+// recording the history of each merge so it can be undone.
+func (tl *Timeline) mergeEntities(ctx context.Context, entKeep Entity, entitiesToMerge []Entity) error {
+	entityIDToKeep := entKeep.ID
+
 	// lock DB and start transaction
 	tl.dbMu.Lock()
 	defer tl.dbMu.Unlock()
@@ -819,26 +843,37 @@ func (tl *Timeline) MergeEntities(ctx context.Context, entityIDToKeep uint64, en
 	defer tx.Rollback()
 
 	for _, entMerge := range entitiesToMerge {
+		// remember the state of both entities, so the merge can be undone
+		undo, err := loadEntityMergeUndo(ctx, tx, entityIDToKeep, entMerge.ID)
+		if err != nil {
+			return err
+		}
+		if entKeep.Metadata, err = undo.KeptBefore.metadata(); err != nil {
+			return err
+		}
+		if entMerge.Metadata, err = undo.Entity.metadata(); err != nil {
+			return err
+		}
+
 		// bring over any information on the entity to merge that's missing on the entity to keep
 		if entMerge.Name != "" && entKeep.Name == "" {
 			entKeep.Name = entMerge.Name
 		}
 
 		// combine metadata (add only missing fields)
+		if entKeep.Metadata == nil {
+			entKeep.Metadata = make(Metadata)
+		}
 		entKeep.Metadata.Merge(entMerge.Metadata, MetaMergeSkip)
 		metadata, err := entKeep.metadataString()
 		if err != nil {
 			return err
 		}
 
-		// if they both have a profile picture, we'll need to delete the one from the entity being merged
-		var oldPictureFile *string
-		if entMerge.Picture != nil {
-			if entKeep.Picture == nil {
-				entKeep.Picture = entMerge.Picture
-			} else {
-				oldPictureFile = entMerge.Picture
-			}
+		// if they both have a profile picture, the one of the entity being merged is
+		// no longer used, but the file is kept so the merge can be undone
+		if entMerge.Picture != nil && entKeep.Picture == nil {
+			entKeep.Picture = entMerge.Picture
 		}
 
 		// update the entity to keep with any info that was transferred over from the entity to merge
@@ -847,20 +882,39 @@ func (tl *Timeline) MergeEntities(ctx context.Context, entityIDToKeep uint64, en
 		if err != nil {
 			return fmt.Errorf("updating entity row: %w", err)
 		}
+		undo.KeptAfter = entityFields{Name: &entKeep.Name, Picture: entKeep.Picture, Metadata: metadata}
 
 		// replace entity IDs in the database
+		if undo.EntityAttributeIDs, err = selectIDs(ctx, tx, `SELECT id FROM entity_attributes WHERE entity_id=?`, entMerge.ID); err != nil {
+			return fmt.Errorf("selecting entity_attributes of entity to merge: %w", err)
+		}
 		if _, err := tx.ExecContext(ctx, `UPDATE entity_attributes SET entity_id=? WHERE entity_id=?`, entityIDToKeep, entMerge.ID); err != nil {
 			return fmt.Errorf("replacing entity ID in entity_attributes: %w", err)
 		}
+		if undo.TaggedIDs, err = selectIDs(ctx, tx, `SELECT id FROM tagged WHERE entity_id=?`, entMerge.ID); err != nil {
+			return fmt.Errorf("selecting tags of entity to merge: %w", err)
+		}
 		if _, err := tx.ExecContext(ctx, `UPDATE tagged SET entity_id=? WHERE entity_id=?`, entityIDToKeep, entMerge.ID); err != nil {
 			return fmt.Errorf("replacing entity ID in tagged: %w", err)
 		}
+		if undo.FaceClusterIDs, err = selectIDs(ctx, tx, `SELECT id FROM face_clusters WHERE entity_id=?`, entMerge.ID); err != nil {
+			return fmt.Errorf("selecting face clusters of entity to merge: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE face_clusters SET entity_id=? WHERE entity_id=?`, entityIDToKeep, entMerge.ID); err != nil {
+			return fmt.Errorf("replacing entity ID in face_clusters: %w", err)
+		}
 
 		// handle pass-through attribute for the entity being merged (start by seeing if there's one for the entity to keep)
-		var passThruAttrIDKeep int64
+		var passThruAttrIDKeep, passThruAttrIDMerge int64
 		if err = tx.QueryRowContext(ctx, `SELECT id FROM attributes WHERE name=? AND value=? LIMIT 1`, passThruAttribute, entityIDToKeep).Scan(&passThruAttrIDKeep); err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return fmt.Errorf("selecting pass-thru attribute for entity to keep: %w", err)
 		}
+		if err = tx.QueryRowContext(ctx, `SELECT id FROM attributes WHERE name=? AND value=? LIMIT 1`, passThruAttribute, entMerge.ID).Scan(&passThruAttrIDMerge); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("selecting pass-thru attribute for entity to merge: %w", err)
+		}
+		if passThruAttrIDMerge > 0 {
+			undo.PassThru = &passThruMergeUndo{AttributeID: passThruAttrIDMerge}
+		}
 		if passThruAttrIDKeep == 0 {
 			// a pass-thru attribute doesn't exist for the entity to keep, so we can safely
 			// just update the pass-thru attribute (if any) for the one to merge to point to
@@ -868,30 +922,27 @@ func (tl *Timeline) MergeEntities(ctx context.Context, entityIDToKeep uint64, en
 			if _, err := tx.ExecContext(ctx, `UPDATE attributes SET value=? WHERE name=? AND value=?`, entityIDToKeep, passThruAttribute, entMerge.ID); err != nil {
 				return fmt.Errorf("updating pass-thru attribute to point to entity to keep: %w", err)
 			}
-		} else {
+		} else if passThruAttrIDMerge > 0 {
 			// this is a little more work: we can't just update an attribute because it would
 			// violate uniqueness constraints; so update everything that points to the old
 			// attribute to point to the new one instead
-			var passThruAttrIDMerge int64
-			if err = tx.QueryRowContext(ctx, `SELECT id FROM attributes WHERE name=? AND value=? LIMIT 1`, passThruAttribute, entMerge.ID).Scan(&passThruAttrIDMerge); err != nil && !errors.Is(err, sql.ErrNoRows) {
-				return fmt.Errorf("selecting pass-thru attribute for entity to merge: %w", err)
+			if err := undo.PassThru.record(ctx, tx, passThruAttrIDKeep); err != nil {
+				return fmt.Errorf("recording pass-thru attribute of entity to merge: %w", err)
 			}
-			if passThruAttrIDMerge > 0 {
-				if _, err := tx.ExecContext(ctx, `UPDATE items SET attribute_id=? WHERE attribute_id=?`, passThruAttrIDKeep, passThruAttrIDMerge); err != nil {
-					return fmt.Errorf("updating attribute ID in items table: %w", err)
-				}
-				if _, err := tx.ExecContext(ctx, `UPDATE relationships SET from_attribute_id=? WHERE from_attribute_id=?`, passThruAttrIDKeep, passThruAttrIDMerge); err != nil {
-					return fmt.Errorf("updating 'from' attribute ID in relationships table: %w", err)
-				}
-				if _, err := tx.ExecContext(ctx, `UPDATE relationships SET to_attribute_id=? WHERE to_attribute_id=?`, passThruAttrIDKeep, passThruAttrIDMerge); err != nil {
-					return fmt.Errorf("updating 'to' attribute ID in relationships table: %w", err)
-				}
-				if _, err := tx.ExecContext(ctx, `DELETE FROM entity_attributes WHERE attribute_id=?`, passThruAttrIDMerge); err != nil {
-					return fmt.Errorf("deleting row in entity_attributes table: %w (attribute_id=%d)", err, passThruAttrIDMerge)
-				}
-				if _, err := tx.ExecContext(ctx, `DELETE FROM attributes WHERE id=?`, passThruAttrIDMerge); err != nil {
-					return fmt.Errorf("deleting pass-thru attribute for entity to merge: %w (attribute_id=%d)", err, passThruAttrIDMerge)
-				}
+			if _, err := tx.ExecContext(ctx, `UPDATE items SET attribute_id=? WHERE attribute_id=?`, passThruAttrIDKeep, passThruAttrIDMerge); err != nil {
+				return fmt.Errorf("updating attribute ID in items table: %w", err)
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE relationships SET from_attribute_id=? WHERE from_attribute_id=?`, passThruAttrIDKeep, passThruAttrIDMerge); err != nil {
+				return fmt.Errorf("updating 'from' attribute ID in relationships table: %w", err)
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE relationships SET to_attribute_id=? WHERE to_attribute_id=?`, passThruAttrIDKeep, passThruAttrIDMerge); err != nil {
+				return fmt.Errorf("updating 'to' attribute ID in relationships table: %w", err)
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM entity_attributes WHERE attribute_id=?`, passThruAttrIDMerge); err != nil {
+				return fmt.Errorf("deleting row in entity_attributes table: %w (attribute_id=%d)", err, passThruAttrIDMerge)
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM attributes WHERE id=?`, passThruAttrIDMerge); err != nil {
+				return fmt.Errorf("deleting pass-thru attribute for entity to merge: %w (attribute_id=%d)", err, passThruAttrIDMerge)
 			}
 		}
 
@@ -899,14 +950,26 @@ func (tl *Timeline) MergeEntities(ctx context.Context, entityIDToKeep uint64, en
 		if _, err := tx.ExecContext(ctx, `DELETE FROM entities WHERE id=?`, entMerge.ID); err != nil {
 			return fmt.Errorf("deleting from entities table: %w", err)
 		}
-		if oldPictureFile != nil {
-			if err := tl.deleteRepoFile(*oldPictureFile); err != nil {
-				return err
-			}
+
+		if err := undo.store(ctx, tx, entityIDToKeep); err != nil {
+			return fmt.Errorf("recording merge history: %w", err)
 		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	merged := make([]uint64, len(entitiesToMerge))
+	for i, ent := range entitiesToMerge {
+		merged[i] = ent.ID
+	}
+	tl.publishEvent(EventEntityMerged, EntityMergedEvent{
+		KeptEntityID:    entityIDToKeep,
+		MergedEntityIDs: merged,
+	})
+
+	return nil
 }
 
 // latentID is a type that holds either the ID of an item
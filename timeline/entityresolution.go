@@ -0,0 +1,927 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// Entity resolution finds entities that are likely the same person (or thing).
+// Each data source identifies people differently (phone numbers, email
+// addresses, usernames), so importing from several of them fragments a
+// person into several entities. Entities are scored against each other by
+// their names and by normalized attribute values, and likely matches are
+// stored as merge suggestions, which are refreshed after each import (see
+// entityResolutionJob). Merges are recorded so they can be undone.
+
+// MergeSuggestion is a pair of entities that are likely the same.
+type MergeSuggestion struct {
+	Entity      Entity  `json:"entity"`
+	OtherEntity Entity  `json:"other_entity"`
+	Confidence  float64 `json:"confidence"` // 0 to 1
+
+	// What matched: the names of the attributes with equivalent
+	// values, and/or "name" if the entities have similar names.
+	Reasons []string `json:"reasons"`
+}
+
+// SuggestedMerges returns the pairs of entities that are likely the same
+// and could be merged, most likely first. Suggestions that were dismissed
+// are not returned.
+func (tl *Timeline) SuggestedMerges(ctx context.Context) ([]MergeSuggestion, error) {
+	// timelines that predate entity resolution have to be resolved entirely once
+	tl.dbMu.RLock()
+	var resolved bool
+	err := tl.db.QueryRowContext(ctx, `SELECT 1 FROM repo WHERE key=?`, entityResolutionRepoKey).Scan(&resolved)
+	tl.dbMu.RUnlock()
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tl.resolveEntities(ctx, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolving entities: %w", err)
+	}
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `
+		SELECT s.confidence, s.reasons,
+			e1.id, t1.name, e1.name, e1.picture_file,
+			e2.id, t2.name, e2.name, e2.picture_file
+		FROM entity_merge_suggestions AS s
+		JOIN entities AS e1 ON e1.id = s.entity_id
+		JOIN entity_types AS t1 ON t1.id = e1.type_id
+		JOIN entities AS e2 ON e2.id = s.other_entity_id
+		JOIN entity_types AS t2 ON t2.id = e2.type_id
+		WHERE s.dismissed IS NULL AND e1.deleted IS NULL AND e2.deleted IS NULL
+		ORDER BY s.confidence DESC, s.id`)
+	if err != nil {
+		return nil, fmt.Errorf("querying merge suggestions: %w", err)
+	}
+	defer rows.Close()
+
+	var suggestions []MergeSuggestion
+	for rows.Next() {
+		var s MergeSuggestion
+		var reasons *string
+		err := rows.Scan(&s.Confidence, &reasons,
+			&s.Entity.ID, &s.Entity.Type, &s.Entity.name, &s.Entity.Picture,
+			&s.OtherEntity.ID, &s.OtherEntity.Type, &s.OtherEntity.name, &s.OtherEntity.Picture)
+		if err != nil {
+			return nil, fmt.Errorf("scanning merge suggestion: %w", err)
+		}
+		if s.Entity.name != nil {
+			s.Entity.Name = *s.Entity.name
+		}
+		if s.OtherEntity.name != nil {
+			s.OtherEntity.Name = *s.OtherEntity.name
+		}
+		if reasons != nil {
+			if err := json.Unmarshal([]byte(*reasons), &s.Reasons); err != nil {
+				return nil, fmt.Errorf("decoding reasons of merge suggestion: %w", err)
+			}
+		}
+		suggestions = append(suggestions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating merge suggestions: %w", err)
+	}
+
+	return suggestions, nil
+}
+
+// DismissSuggestedMerge indicates that the two entities are not the same,
+// so merging them won't be suggested again.
+func (tl *Timeline) DismissSuggestedMerge(ctx context.Context, entityID, otherEntityID uint64) error {
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := dismissSuggestedMerge(ctx, tx, entityID, otherEntityID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func dismissSuggestedMerge(ctx context.Context, tx *sql.Tx, entityID, otherEntityID uint64) error {
+	if entityID == otherEntityID {
+		return fmt.Errorf("cannot dismiss merging entity %d with itself", entityID)
+	}
+	entityID, otherEntityID = min(entityID, otherEntityID), max(entityID, otherEntityID)
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO entity_merge_suggestions (entity_id, other_entity_id, confidence, dismissed)
+		VALUES (?, ?, 0, ?)
+		ON CONFLICT (entity_id, other_entity_id) DO UPDATE SET dismissed=excluded.dismissed`,
+		entityID, otherEntityID, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("dismissing merge suggestion: %w", err)
+	}
+	return nil
+}
+
+// resolveEntities scores likely matches between entities and stores them as
+// merge suggestions. If entityIDs is nil, all entities are resolved; otherwise,
+// only pairs that include at least one of the given entities are (re)scored.
+func (tl *Timeline) resolveEntities(ctx context.Context, entityIDs []uint64) error {
+	if entityIDs != nil && len(entityIDs) == 0 {
+		return nil
+	}
+
+	tl.dbMu.RLock()
+	candidates, err := loadResolutionCandidates(ctx, tl.db)
+	tl.dbMu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("loading entities: %w", err)
+	}
+
+	var only map[uint64]bool
+	if entityIDs != nil {
+		only = make(map[uint64]bool, len(entityIDs))
+		for _, id := range entityIDs {
+			only[id] = true
+		}
+	}
+	matches := scoreEntityMatches(candidates, only)
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// previous suggestions may no longer apply; dismissals are kept, though
+	if only == nil {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM entity_merge_suggestions WHERE dismissed IS NULL`); err != nil {
+			return fmt.Errorf("clearing merge suggestions: %w", err)
+		}
+	} else {
+		stmt, err := tx.PrepareContext(ctx, `DELETE FROM entity_merge_suggestions
+			WHERE dismissed IS NULL AND (entity_id=? OR other_entity_id=?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for id := range only {
+			if _, err := stmt.ExecContext(ctx, id, id); err != nil {
+				return fmt.Errorf("clearing merge suggestions of entity %d: %w", id, err)
+			}
+		}
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO entity_merge_suggestions (entity_id, other_entity_id, confidence, reasons, updated)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (entity_id, other_entity_id) DO UPDATE
+			SET confidence=excluded.confidence, reasons=excluded.reasons, updated=excluded.updated`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for pair, match := range matches {
+		reasons, err := json.Marshal(match.reasons())
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, pair[0], pair[1], match.confidence(), string(reasons), now); err != nil {
+			return fmt.Errorf("storing merge suggestion for entities %d and %d: %w", pair[0], pair[1], err)
+		}
+	}
+
+	if only == nil {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO repo (key, value) VALUES (?, ?)`, entityResolutionRepoKey, 1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// resolutionCandidate is an entity as considered by entity resolution.
+type resolutionCandidate struct {
+	typeID uint64
+	name   string
+	attrs  []candidateAttribute
+}
+
+type candidateAttribute struct {
+	name     string
+	value    string
+	identity bool // whether it is an identity on a data source
+}
+
+func loadResolutionCandidates(ctx context.Context, db *sql.DB) (map[uint64]*resolutionCandidate, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT entities.id, entities.type_id, entities.name,
+			attributes.name, attributes.value, entity_attributes.data_source_id
+		FROM entities
+		LEFT JOIN entity_attributes ON entity_attributes.entity_id = entities.id
+		LEFT JOIN attributes ON attributes.id = entity_attributes.attribute_id
+		WHERE entities.deleted IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := make(map[uint64]*resolutionCandidate)
+	for rows.Next() {
+		var entityID, typeID uint64
+		var entityName, attrName *string
+		var attrValue any
+		var dsID *int64
+		if err := rows.Scan(&entityID, &typeID, &entityName, &attrName, &attrValue, &dsID); err != nil {
+			return nil, err
+		}
+
+		c, ok := candidates[entityID]
+		if !ok {
+			c = &resolutionCandidate{typeID: typeID}
+			if entityName != nil {
+				c.name = *entityName
+			}
+			candidates[entityID] = c
+		}
+
+		// only text values can be normalized and compared (the pass-thru
+		// attribute, for example, is an integer)
+		if value, ok := attrValue.(string); ok && attrName != nil && *attrName != passThruAttribute {
+			c.attrs = append(c.attrs, candidateAttribute{name: *attrName, value: value, identity: dsID != nil})
+		}
+	}
+
+	return candidates, rows.Err()
+}
+
+// matchKey is a normalized feature of an entity. Entities that
+// share a match key are likely the same, by the given weight.
+type matchKey struct {
+	reason string
+	weight float64
+}
+
+// matchKeys returns the features of the entity that likely identify it.
+func (c resolutionCandidate) matchKeys() map[string]matchKey {
+	keys := make(map[string]matchKey)
+	add := func(key, reason string, weight float64) {
+		if existing, ok := keys[key]; !ok || weight > existing.weight {
+			keys[key] = matchKey{reason, weight}
+		}
+	}
+
+	// names are weak evidence on their own, especially if it's just a first name
+	// (or a nickname), but strengthen other evidence
+	if tokens := nameTokens(c.name); len(tokens) > 1 {
+		add("name:"+strings.Join(tokens, " "), "name", 0.6)
+	} else if len(tokens) == 1 {
+		add("name:"+tokens[0], "name", 0.3)
+	}
+
+	for _, attr := range c.attrs {
+		switch attr.name {
+		case AttributeEmail:
+			email := normalizeEmailAddress(attr.value)
+			if email == "" {
+				continue
+			}
+			add("email:"+email, AttributeEmail, 0.9)
+
+			// email addresses are often made of the person's name, like "john.smith@..."
+			localPart, _, _ := strings.Cut(strings.ToLower(attr.value), "@")
+			localPart, _, _ = strings.Cut(localPart, "+")
+			if tokens := nameTokens(localPart); len(tokens) > 1 {
+				add("name:"+strings.Join(tokens, " "), "name", 0.5)
+			}
+		case AttributePhoneNumber:
+			if phone := phoneNumberDigits(attr.value); phone != "" {
+				add("phone:"+phone, AttributePhoneNumber, 0.9)
+			}
+		case AttributeGender:
+			// shared by too many entities to be telling
+		default:
+			// usernames, handles, IDs, etc.
+			value := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(attr.value), "@"))
+			if value == "" {
+				continue
+			}
+			weight := 0.5
+			if attr.identity {
+				weight = 0.8
+			}
+			add("attr:"+attr.name+":"+value, attr.name, weight)
+		}
+	}
+
+	return keys
+}
+
+// entityMatch is the evidence that a pair of entities is the same.
+type entityMatch map[string]float64 // reason -> weight
+
+// confidence combines the weights of the evidence as independent
+// probabilities, so that each piece of evidence adds confidence.
+func (m entityMatch) confidence() float64 {
+	doubt := 1.0
+	for _, weight := range m {
+		doubt *= 1 - weight
+	}
+	return 1 - doubt
+}
+
+func (m entityMatch) reasons() []string {
+	reasons := make([]string, 0, len(m))
+	for reason := range m {
+		reasons = append(reasons, reason)
+	}
+	slices.Sort(reasons)
+	return reasons
+}
+
+// scoreEntityMatches returns the pairs of entities (ordered by ID) that are likely
+// the same. If only is not nil, only pairs that include one of those entities are
+// scored.
+func scoreEntityMatches(candidates map[uint64]*resolutionCandidate, only map[uint64]bool) map[[2]uint64]entityMatch {
+	type keyMember struct {
+		entityID uint64
+		matchKey
+	}
+	groups := make(map[string][]keyMember)
+	for id, c := range candidates {
+		for key, mk := range c.matchKeys() {
+			groups[key] = append(groups[key], keyMember{id, mk})
+		}
+	}
+
+	matches := make(map[[2]uint64]entityMatch)
+	for _, members := range groups {
+		// a feature shared by many entities (like a company's phone number) doesn't
+		// tell them apart, and scoring all the pairs would take quadratic time
+		if len(members) < 2 || len(members) > maxMatchGroupSize {
+			continue
+		}
+		for i, a := range members {
+			for _, b := range members[i+1:] {
+				if only != nil && !only[a.entityID] && !only[b.entityID] {
+					continue
+				}
+				if candidates[a.entityID].typeID != candidates[b.entityID].typeID {
+					continue
+				}
+				pair := [2]uint64{min(a.entityID, b.entityID), max(a.entityID, b.entityID)}
+				if matches[pair] == nil {
+					matches[pair] = make(entityMatch)
+				}
+				// a name matching an email address is weaker than matching names
+				weight := min(a.weight, b.weight)
+				if weight > matches[pair][a.reason] {
+					matches[pair][a.reason] = weight
+				}
+			}
+		}
+	}
+
+	for pair, match := range matches {
+		if match.confidence() < minMergeConfidence {
+			delete(matches, pair)
+		}
+	}
+
+	return matches
+}
+
+// nameTokens returns the words of a name, lower-cased and sorted, so
+// that "Smith, John" and "john smith" are the same.
+func nameTokens(name string) []string {
+	tokens := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	slices.Sort(tokens)
+	return tokens
+}
+
+// normalizeEmailAddress returns the canonical form of an email address,
+// ignoring case and subaddressing (the "+tag" part), as well as dots in
+// Gmail addresses, since those all reach the same inbox. It returns an
+// empty string if addr doesn't look like an email address.
+func normalizeEmailAddress(addr string) string {
+	localPart, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(addr)), "@")
+	if !ok || localPart == "" || domain == "" {
+		return ""
+	}
+	localPart, _, _ = strings.Cut(localPart, "+")
+	if domain == "gmail.com" || domain == "googlemail.com" {
+		localPart = strings.ReplaceAll(localPart, ".", "")
+		domain = "gmail.com"
+	}
+	return localPart + "@" + domain
+}
+
+// phoneNumberDigits returns the last 10 digits of a phone number, so that
+// numbers with and without a country code (or formatting) are the same.
+// Phone numbers are normalized when they are stored, but only if they can
+// be parsed. It returns an empty string if there are too few digits to be
+// a phone number.
+func phoneNumberDigits(number string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+	if len(digits) < 7 {
+		return ""
+	}
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	return digits
+}
+
+const (
+	// pairs of entities less likely to be the same than this are not suggested
+	minMergeConfidence = 0.5
+
+	// how many entities can share a feature for it to be considered telling
+	maxMatchGroupSize = 25
+
+	// set in the repo table once all entities have been resolved
+	entityResolutionRepoKey = "entity_resolution"
+)
+
+// entityResolutionJob is the job action that refreshes merge suggestions.
+type entityResolutionJob struct {
+	// resolve the entities created or given attributes by this import job;
+	// if not set, all entities are resolved
+	EntitiesFromImportJob uint64 `json:"entities_from_import_job,omitempty"`
+}
+
+func (ej entityResolutionJob) Run(job *ActiveJob, _ []byte) error {
+	var entityIDs []uint64
+	if ej.EntitiesFromImportJob != 0 {
+		job.tl.dbMu.RLock()
+		ids, err := selectIDs(job.ctx, job.tl.db, `
+			SELECT id FROM entities WHERE job_id=?
+			UNION
+			SELECT entity_id FROM entity_attributes WHERE job_id=?`,
+			ej.EntitiesFromImportJob, ej.EntitiesFromImportJob)
+		job.tl.dbMu.RUnlock()
+		if err != nil {
+			return fmt.Errorf("selecting entities from import job %d: %w", ej.EntitiesFromImportJob, err)
+		}
+		if len(ids) == 0 {
+			job.Logger().Info("no entities to resolve", zap.Uint64("import_job_id", ej.EntitiesFromImportJob))
+			return nil
+		}
+		entityIDs = make([]uint64, len(ids))
+		for i, id := range ids {
+			entityIDs[i] = uint64(id)
+		}
+	}
+
+	job.Logger().Info("resolving entities", zap.Int("count", len(entityIDs)))
+
+	return job.tl.resolveEntities(job.ctx, entityIDs)
+}
+
+// EntityMerge is the record of an entity having been merged into another.
+type EntityMerge struct {
+	ID             uint64     `json:"id"`
+	EntityID       uint64     `json:"entity_id"`        // the entity that was kept
+	MergedEntityID uint64     `json:"merged_entity_id"` // the entity that was merged into it
+	MergedName     string     `json:"merged_name,omitempty"`
+	Merged         time.Time  `json:"merged"`
+	Undone         *time.Time `json:"undone,omitempty"`
+}
+
+// EntityMerges returns the history of merges into or of the given entity, most
+// recent first, including merges that were undone.
+func (tl *Timeline) EntityMerges(ctx context.Context, entityID uint64) ([]EntityMerge, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `
+		SELECT id, entity_id, merged_entity_id, merged, undone, undo
+		FROM entity_merges
+		WHERE entity_id=? OR merged_entity_id=?
+		ORDER BY id DESC`, entityID, entityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var merges []EntityMerge
+	for rows.Next() {
+		var m EntityMerge
+		var merged int64
+		var undone *int64
+		var undoJSON string
+		if err := rows.Scan(&m.ID, &m.EntityID, &m.MergedEntityID, &merged, &undone, &undoJSON); err != nil {
+			return nil, err
+		}
+		m.Merged = time.Unix(merged, 0)
+		if undone != nil {
+			u := time.Unix(*undone, 0)
+			m.Undone = &u
+		}
+		var undo entityMergeUndo
+		if err := json.Unmarshal([]byte(undoJSON), &undo); err != nil {
+			return nil, fmt.Errorf("decoding merge %d: %w", m.ID, err)
+		}
+		if undo.Entity.Name != nil {
+			m.MergedName = *undo.Entity.Name
+		}
+		merges = append(merges, m)
+	}
+
+	return merges, rows.Err()
+}
+
+// UnmergeEntities undoes the merge with the given ID (see EntityMerges): the
+// merged entity is restored, along with its attributes, tags, and the items
+// and relationships that were attributed to it directly, and the information
+// it brought over to the kept entity is removed from it, if it hasn't been
+// changed since. The ID of the restored entity is returned; it is the same as
+// before the merge, unless that ID has been reused since. Merging the two
+// entities won't be suggested again.
+func (tl *Timeline) UnmergeEntities(ctx context.Context, mergeID uint64) (uint64, error) {
+	keptID, restoredID, err := tl.unmergeEntities(ctx, mergeID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tl.resolveEntities(ctx, []uint64{keptID, restoredID}); err != nil {
+		Log.Error("updating merge suggestions",
+			zap.Uint64("entity_id", keptID),
+			zap.Uint64("restored_entity_id", restoredID),
+			zap.Error(err))
+	}
+
+	return restoredID, nil
+}
+
+func (tl *Timeline) unmergeEntities(ctx context.Context, mergeID uint64) (keptID, restoredID uint64, err error) {
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var undone *int64
+	var undoJSON string
+	err = tx.QueryRowContext(ctx, `SELECT entity_id, undone, undo FROM entity_merges WHERE id=? LIMIT 1`,
+		mergeID).Scan(&keptID, &undone, &undoJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, fmt.Errorf("no entity merge with ID %d", mergeID)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("loading entity merge: %w", err)
+	}
+	if undone != nil {
+		return 0, 0, fmt.Errorf("entity merge %d was already undone", mergeID)
+	}
+	var undo entityMergeUndo
+	if err := json.Unmarshal([]byte(undoJSON), &undo); err != nil {
+		return 0, 0, fmt.Errorf("decoding entity merge: %w", err)
+	}
+
+	// the kept entity might have been merged into yet another entity since
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM entities WHERE id=?)`, keptID).Scan(&exists); err != nil {
+		return 0, 0, err
+	}
+	if !exists {
+		var laterMergeID uint64
+		err := tx.QueryRowContext(ctx, `SELECT id FROM entity_merges WHERE merged_entity_id=? AND undone IS NULL ORDER BY id DESC LIMIT 1`,
+			keptID).Scan(&laterMergeID)
+		if err == nil {
+			return 0, 0, fmt.Errorf("entity %d was merged into another entity since; undo merge %d first", keptID, laterMergeID)
+		}
+		return 0, 0, fmt.Errorf("entity %d no longer exists", keptID)
+	}
+
+	restoredID, err = undo.restore(ctx, tx, keptID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE entity_merges SET undone=? WHERE id=?`, time.Now().Unix(), mergeID); err != nil {
+		return 0, 0, fmt.Errorf("marking entity merge as undone: %w", err)
+	}
+	if err := dismissSuggestedMerge(ctx, tx, keptID, restoredID); err != nil {
+		return 0, 0, err
+	}
+
+	return keptID, restoredID, tx.Commit()
+}
+
+// entityMergeUndo is what is needed to undo the merge of one entity into another.
+type entityMergeUndo struct {
+	// the merged entity, which is deleted by the merge
+	Entity entityRow `json:"entity"`
+
+	// the fields of the kept entity before and after the merge; a field
+	// is only restored when undoing if it hasn't been changed since
+	KeptBefore entityFields `json:"kept_before"`
+	KeptAfter  entityFields `json:"kept_after"`
+
+	// the rows that were moved from the merged entity to the kept entity
+	EntityAttributeIDs []int64 `json:"entity_attribute_ids,omitempty"`
+	TaggedIDs          []int64 `json:"tagged_ids,omitempty"`
+	FaceClusterIDs     []int64 `json:"face_cluster_ids,omitempty"`
+
+	// the pass-thru attribute of the merged entity, if it had one
+	PassThru *passThruMergeUndo `json:"pass_thru,omitempty"`
+}
+
+type entityRow struct {
+	ID       uint64 `json:"id"`
+	TypeID   uint64 `json:"type_id"`
+	JobID    *int64 `json:"job_id,omitempty"`
+	Stored   int64  `json:"stored"`
+	Modified *int64 `json:"modified,omitempty"`
+	Hidden   *int64 `json:"hidden,omitempty"`
+	Deleted  *int64 `json:"deleted,omitempty"`
+	entityFields
+}
+
+// entityFields are the fields of an entity that a merge may change.
+type entityFields struct {
+	Name     *string `json:"name,omitempty"`
+	Picture  *string `json:"picture_file,omitempty"`
+	Metadata *string `json:"metadata,omitempty"`
+}
+
+func (f entityFields) metadata() (Metadata, error) {
+	if f.Metadata == nil {
+		return nil, nil
+	}
+	var meta Metadata
+	if err := json.Unmarshal([]byte(*f.Metadata), &meta); err != nil {
+		return nil, fmt.Errorf("decoding entity metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// passThruMergeUndo describes what happened to the pass-thru attribute of the
+// merged entity. If the kept entity didn't have a pass-thru attribute, it was
+// simply pointed to the kept entity. Otherwise it was deleted, and the items
+// and relationships that referred to it were pointed to the kept entity's
+// pass-thru attribute (KeptAttributeID) instead.
+type passThruMergeUndo struct {
+	AttributeID       int64                `json:"attribute_id"`
+	KeptAttributeID   int64                `json:"kept_attribute_id,omitempty"`
+	EntityAttributes  []entityAttributeRow `json:"entity_attributes,omitempty"`
+	ItemIDs           []int64              `json:"item_ids,omitempty"`
+	FromRelationships []int64              `json:"from_relationship_ids,omitempty"`
+	ToRelationships   []int64              `json:"to_relationship_ids,omitempty"`
+}
+
+type entityAttributeRow struct {
+	DataSourceID *int64 `json:"data_source_id,omitempty"`
+	JobID        *int64 `json:"job_id,omitempty"`
+	Start        *int64 `json:"start,omitempty"`
+	End          *int64 `json:"end,omitempty"`
+}
+
+// loadEntityMergeUndo loads the state of the entities before entity mergeID is merged into keepID.
+func loadEntityMergeUndo(ctx context.Context, tx *sql.Tx, keepID, mergeID uint64) (*entityMergeUndo, error) {
+	undo := new(entityMergeUndo)
+	e := &undo.Entity
+	err := tx.QueryRowContext(ctx, `SELECT id, type_id, job_id, stored, modified, name, picture_file, metadata, hidden, deleted
+		FROM entities WHERE id=? LIMIT 1`, mergeID).Scan(&e.ID, &e.TypeID, &e.JobID, &e.Stored, &e.Modified,
+		&e.Name, &e.Picture, &e.Metadata, &e.Hidden, &e.Deleted)
+	if err != nil {
+		return nil, fmt.Errorf("loading entity to merge: %w", err)
+	}
+	k := &undo.KeptBefore
+	err = tx.QueryRowContext(ctx, `SELECT name, picture_file, metadata FROM entities WHERE id=? LIMIT 1`,
+		keepID).Scan(&k.Name, &k.Picture, &k.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("loading entity to keep: %w", err)
+	}
+	return undo, nil
+}
+
+// record remembers what refers to the pass-thru attribute before it is
+// replaced by the attribute with ID keptAttrID.
+func (pt *passThruMergeUndo) record(ctx context.Context, tx *sql.Tx, keptAttrID int64) error {
+	pt.KeptAttributeID = keptAttrID
+
+	var err error
+	if pt.ItemIDs, err = selectIDs(ctx, tx, `SELECT id FROM items WHERE attribute_id=?`, pt.AttributeID); err != nil {
+		return err
+	}
+	if pt.FromRelationships, err = selectIDs(ctx, tx, `SELECT id FROM relationships WHERE from_attribute_id=?`, pt.AttributeID); err != nil {
+		return err
+	}
+	if pt.ToRelationships, err = selectIDs(ctx, tx, `SELECT id FROM relationships WHERE to_attribute_id=?`, pt.AttributeID); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT data_source_id, job_id, "start", "end" FROM entity_attributes WHERE attribute_id=?`, pt.AttributeID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ea entityAttributeRow
+		if err := rows.Scan(&ea.DataSourceID, &ea.JobID, &ea.Start, &ea.End); err != nil {
+			return err
+		}
+		pt.EntityAttributes = append(pt.EntityAttributes, ea)
+	}
+	return rows.Err()
+}
+
+func (undo *entityMergeUndo) store(ctx context.Context, tx *sql.Tx, keepID uint64) error {
+	undoJSON, err := json.Marshal(undo)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO entity_merges (entity_id, merged_entity_id, undo) VALUES (?, ?, ?)`,
+		keepID, undo.Entity.ID, string(undoJSON))
+	return err
+}
+
+// restore undoes the merge into the entity keptID, and returns the ID of the restored entity.
+func (undo entityMergeUndo) restore(ctx context.Context, tx *sql.Tx, keptID uint64) (uint64, error) {
+	e := undo.Entity
+
+	// SQLite may have reused the row ID since the entity was deleted
+	id := &e.ID
+	var taken bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM entities WHERE id=?)`, e.ID).Scan(&taken); err != nil {
+		return 0, err
+	}
+	if taken {
+		id = nil
+	}
+
+	var restoredID uint64
+	err := tx.QueryRowContext(ctx, `INSERT INTO entities (id, type_id, job_id, stored, modified, name, picture_file, metadata, hidden, deleted)
+		VALUES (?, ?, (SELECT id FROM jobs WHERE id=?), ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`,
+		id, e.TypeID, e.JobID, e.Stored, e.Modified, e.Name, e.Picture, e.Metadata, e.Hidden, e.Deleted).Scan(&restoredID)
+	if err != nil {
+		return 0, fmt.Errorf("restoring merged entity: %w", err)
+	}
+
+	// take back what the merge brought over to the kept entity, unless it has been changed since
+	for _, field := range []struct {
+		column        string
+		before, after *string
+	}{
+		{"name", undo.KeptBefore.Name, undo.KeptAfter.Name},
+		{"picture_file", undo.KeptBefore.Picture, undo.KeptAfter.Picture},
+		{"metadata", undo.KeptBefore.Metadata, undo.KeptAfter.Metadata},
+	} {
+		_, err := tx.ExecContext(ctx, `UPDATE entities SET `+field.column+`=? WHERE id=? AND `+field.column+` IS ?`,
+			field.before, keptID, field.after)
+		if err != nil {
+			return 0, fmt.Errorf("restoring %s of kept entity: %w", field.column, err)
+		}
+	}
+
+	if err := updateEach(ctx, tx, `UPDATE entity_attributes SET entity_id=? WHERE id=? AND entity_id=?`,
+		undo.EntityAttributeIDs, restoredID, keptID); err != nil {
+		return 0, fmt.Errorf("restoring attributes of merged entity: %w", err)
+	}
+	if err := updateEach(ctx, tx, `UPDATE tagged SET entity_id=? WHERE id=? AND entity_id=?`,
+		undo.TaggedIDs, restoredID, keptID); err != nil {
+		return 0, fmt.Errorf("restoring tags of merged entity: %w", err)
+	}
+	if err := updateEach(ctx, tx, `UPDATE face_clusters SET entity_id=? WHERE id=? AND entity_id=?`,
+		undo.FaceClusterIDs, restoredID, keptID); err != nil {
+		return 0, fmt.Errorf("restoring face clusters of merged entity: %w", err)
+	}
+
+	if pt := undo.PassThru; pt != nil {
+		if err := pt.restore(ctx, tx, restoredID); err != nil {
+			return 0, fmt.Errorf("restoring pass-thru attribute of merged entity: %w", err)
+		}
+	}
+
+	return restoredID, nil
+}
+
+func (pt passThruMergeUndo) restore(ctx context.Context, tx *sql.Tx, restoredID uint64) error {
+	// if the pass-thru attribute was pointed at the kept entity, point it back
+	if pt.KeptAttributeID == 0 {
+		_, err := tx.ExecContext(ctx, `UPDATE attributes SET value=? WHERE id=? AND name=?`,
+			restoredID, pt.AttributeID, passThruAttribute)
+		return err
+	}
+
+	// otherwise it was deleted, so recreate it (with the same ID, if possible)
+	id := &pt.AttributeID
+	var taken bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM attributes WHERE id=?)`, pt.AttributeID).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		id = nil
+	}
+	var attrID int64
+	err := tx.QueryRowContext(ctx, `INSERT INTO attributes (id, name, value) VALUES (?, ?, ?) RETURNING id`,
+		id, passThruAttribute, restoredID).Scan(&attrID)
+	if err != nil {
+		return err
+	}
+	for _, ea := range pt.EntityAttributes {
+		_, err := tx.ExecContext(ctx, `INSERT INTO entity_attributes (entity_id, attribute_id, data_source_id, job_id, "start", "end")
+			VALUES (?, ?, (SELECT id FROM data_sources WHERE id=?), (SELECT id FROM jobs WHERE id=?), ?, ?)`,
+			restoredID, attrID, ea.DataSourceID, ea.JobID, ea.Start, ea.End)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := updateEach(ctx, tx, `UPDATE items SET attribute_id=? WHERE id=? AND attribute_id=?`,
+		pt.ItemIDs, attrID, pt.KeptAttributeID); err != nil {
+		return err
+	}
+	if err := updateEach(ctx, tx, `UPDATE relationships SET from_attribute_id=? WHERE id=? AND from_attribute_id=?`,
+		pt.FromRelationships, attrID, pt.KeptAttributeID); err != nil {
+		return err
+	}
+	return updateEach(ctx, tx, `UPDATE relationships SET to_attribute_id=? WHERE id=? AND to_attribute_id=?`,
+		pt.ToRelationships, attrID, pt.KeptAttributeID)
+}
+
+// updateEach runs query, which sets a column from oldValue to newValue, for each row ID.
+// The query's arguments are, in order: newValue, the row ID, and oldValue.
+func updateEach[T any](ctx context.Context, tx *sql.Tx, query string, rowIDs []int64, newValue, oldValue T) error {
+	if len(rowIDs) == 0 {
+		return nil
+	}
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, rowID := range rowIDs {
+		if _, err := stmt.ExecContext(ctx, newValue, rowID, oldValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectIDs returns the row IDs selected by query.
+func selectIDs(ctx context.Context, db interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+}, query string, args ...any) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
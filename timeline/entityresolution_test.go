@@ -0,0 +1,190 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEntityResolution(t *testing.T) {
+	ctx := context.Background()
+	db, err := openAndProvisionDB(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tl := &Timeline{db: db}
+
+	// 10, 11, and 12 are the same person known by an email address and phone number
+	// in different formats; 13 and 14 have the same Twitter handle; 15 is unrelated
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO data_sources (id, name, title) VALUES (1, 'twitter', 'Twitter');
+		INSERT INTO entities (id, type_id, name, picture_file, metadata) VALUES
+			(10, (SELECT id FROM entity_types WHERE name='person'), 'John Smith', NULL, NULL),
+			(11, (SELECT id FROM entity_types WHERE name='person'), NULL, 'data/pic11.jpg', '{"nickname":"Johnny"}'),
+			(12, (SELECT id FROM entity_types WHERE name='person'), 'Smith, John', NULL, NULL),
+			(13, (SELECT id FROM entity_types WHERE name='person'), 'Jane Doe', NULL, NULL),
+			(14, (SELECT id FROM entity_types WHERE name='person'), 'Jane', NULL, NULL),
+			(15, (SELECT id FROM entity_types WHERE name='person'), 'Bob', NULL, NULL);
+		INSERT INTO attributes (id, name, value) VALUES
+			(100, 'email_address', 'John.Smith+news@gmail.com'),
+			(101, 'phone_number', '+15551234567'),
+			(102, 'email_address', 'johnsmith@googlemail.com'),
+			(103, '_entity', 11),
+			(104, 'phone_number', '(555) 123-4567'),
+			(105, 'twitter_username', '@jane'),
+			(106, 'twitter_username', 'Jane2'),
+			(107, '_entity', 10);
+		INSERT INTO entity_attributes (id, entity_id, attribute_id, data_source_id) VALUES
+			(200, 10, 100, NULL), (201, 10, 101, NULL), (202, 11, 102, NULL), (203, 11, 103, NULL),
+			(204, 12, 104, NULL), (205, 13, 105, 1), (206, 14, 105, 1), (207, 14, 106, 1), (208, 10, 107, NULL);
+		INSERT INTO items (id, data_source_id, attribute_id, original_id) VALUES (1, 1, 103, 'msg1');
+		INSERT INTO tags (id, label) VALUES (1, 'family');
+		INSERT INTO tagged (id, tag_id, entity_id) VALUES (1, 1, 11);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	suggestions, err := tl.SuggestedMerges(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		pair    [2]uint64
+		reasons []string
+	}{
+		{[2]uint64{10, 12}, []string{"name", AttributePhoneNumber}},
+		{[2]uint64{10, 11}, []string{AttributeEmail}},
+		{[2]uint64{13, 14}, []string{"twitter_username"}},
+	}
+	if len(suggestions) != len(expected) {
+		t.Fatalf("expected %d suggestions, got %d: %+v", len(expected), len(suggestions), suggestions)
+	}
+	for i, exp := range expected {
+		s := suggestions[i]
+		if s.Entity.ID != exp.pair[0] || s.OtherEntity.ID != exp.pair[1] {
+			t.Errorf("suggestion %d: expected entities %v, got %d and %d", i, exp.pair, s.Entity.ID, s.OtherEntity.ID)
+		}
+		if len(s.Reasons) != len(exp.reasons) || s.Reasons[0] != exp.reasons[0] || s.Reasons[len(s.Reasons)-1] != exp.reasons[len(exp.reasons)-1] {
+			t.Errorf("suggestion %d: expected reasons %v, got %v", i, exp.reasons, s.Reasons)
+		}
+		if s.Confidence < minMergeConfidence || s.Confidence > 1 {
+			t.Errorf("suggestion %d: confidence out of range: %f", i, s.Confidence)
+		}
+	}
+
+	// merge, and check that everything moved to the kept entity
+	if err := tl.MergeEntities(ctx, 10, []uint64{11}); err != nil {
+		t.Fatal(err)
+	}
+	var picture, metadata *string
+	if err := db.QueryRow(`SELECT picture_file, metadata FROM entities WHERE id=10`).Scan(&picture, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if picture == nil || *picture != "data/pic11.jpg" || metadata == nil || *metadata != `{"nickname":"Johnny"}` {
+		t.Errorf("expected picture and metadata to be brought over, got %v and %v", picture, metadata)
+	}
+	assertCount := func(query string, expected int) {
+		t.Helper()
+		var count int
+		if err := db.QueryRow(query).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Errorf("%s: expected %d, got %d", query, expected, count)
+		}
+	}
+	assertCount(`SELECT count() FROM entities WHERE id=11`, 0)
+	assertCount(`SELECT count() FROM items WHERE id=1 AND attribute_id=107`, 1)
+	assertCount(`SELECT count() FROM tagged WHERE entity_id=10`, 1)
+	assertCount(`SELECT count() FROM entity_attributes WHERE entity_id=10 AND attribute_id=102`, 1)
+
+	merges, err := tl.EntityMerges(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merges) != 1 || merges[0].EntityID != 10 || merges[0].MergedEntityID != 11 || merges[0].Undone != nil {
+		t.Fatalf("unexpected merge history: %+v", merges)
+	}
+
+	// undo the merge, and check that everything is as it was
+	restoredID, err := tl.UnmergeEntities(ctx, merges[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoredID != 11 {
+		t.Errorf("expected entity to be restored with ID 11, got %d", restoredID)
+	}
+	assertCount(`SELECT count() FROM entities WHERE id=11 AND picture_file='data/pic11.jpg' AND metadata IS NOT NULL`, 1)
+	assertCount(`SELECT count() FROM entities WHERE id=10 AND name='John Smith' AND picture_file IS NULL AND metadata IS NULL`, 1)
+	assertCount(`SELECT count() FROM items
+		JOIN attributes ON attributes.id = items.attribute_id
+		WHERE items.id=1 AND attributes.name='_entity' AND attributes.value=11`, 1)
+	assertCount(`SELECT count() FROM entity_attributes
+		JOIN attributes ON attributes.id = entity_attributes.attribute_id
+		WHERE entity_attributes.entity_id=11 AND attributes.name='_entity'`, 1)
+	assertCount(`SELECT count() FROM tagged WHERE entity_id=11`, 1)
+	assertCount(`SELECT count() FROM entity_attributes WHERE entity_id=11 AND attribute_id=102`, 1)
+
+	if _, err := tl.UnmergeEntities(ctx, merges[0].ID); err == nil {
+		t.Error("expected error undoing merge twice")
+	}
+
+	// the merge was undone, so it shouldn't be suggested again
+	suggestions, err = tl.SuggestedMerges(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range suggestions {
+		if s.Entity.ID == 10 && s.OtherEntity.ID == 11 {
+			t.Errorf("undone merge was suggested again: %+v", s)
+		}
+	}
+	if len(suggestions) != 2 {
+		t.Errorf("expected 2 suggestions, got %d: %+v", len(suggestions), suggestions)
+	}
+}
+
+func TestNormalizeEntityAttributes(t *testing.T) {
+	for i, tc := range []struct {
+		email, expected string
+	}{
+		{"John.Smith+news@Gmail.com", "johnsmith@gmail.com"},
+		{"john.smith@googlemail.com", "johnsmith@gmail.com"},
+		{"john.smith@example.com", "john.smith@example.com"},
+		{"not an email", ""},
+	} {
+		if actual := normalizeEmailAddress(tc.email); actual != tc.expected {
+			t.Errorf("email %d: expected %q, got %q", i, tc.expected, actual)
+		}
+	}
+	for i, tc := range []struct {
+		phone, expected string
+	}{
+		{"+1 (555) 123-4567", "5551234567"},
+		{"555.123.4567", "5551234567"},
+		{"+44 20 7946 0958", "2079460958"},
+		{"911", ""},
+	} {
+		if actual := phoneNumberDigits(tc.phone); actual != tc.expected {
+			t.Errorf("phone %d: expected %q, got %q", i, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EventType is the kind of an Event.
+type EventType string
+
+// Types of events.
+const (
+	EventJobStarted   EventType = "job_started"   // data is JobStartedEvent
+	EventJobFinished  EventType = "job_finished"  // data is JobFinishedEvent
+	EventItemsAdded   EventType = "items_added"   // data is ItemsAddedEvent
+	EventEntityMerged EventType = "entity_merged" // data is EntityMergedEvent
+)
+
+// Event is a change to a timeline, which is published to the subscribers
+// of the timeline (see Timeline.Subscribe). Unlike logs, events are meant
+// for programs, such as home automation or backup scripts, to act on.
+type Event struct {
+	Type   EventType `json:"type"`
+	Time   time.Time `json:"time"`
+	RepoID string    `json:"repo_id"`
+
+	// One of the *Event types, according to Type.
+	Data any `json:"data"`
+}
+
+// JobStartedEvent is the data of an EventJobStarted event, which is
+// published when a job starts or resumes running.
+type JobStartedEvent struct {
+	JobID       uint64  `json:"job_id"`
+	JobType     JobType `json:"job_type"`
+	ParentJobID *uint64 `json:"parent_job_id,omitempty"`
+}
+
+// JobFinishedEvent is the data of an EventJobFinished event, which is
+// published when a job stops running, for whatever reason.
+type JobFinishedEvent struct {
+	JobID   uint64  `json:"job_id"`
+	JobType JobType `json:"job_type"`
+
+	// JobSucceeded, JobFailed, JobAborted, or JobInterrupted (if the
+	// timeline was closed while the job was running).
+	State JobState `json:"state"`
+	Error string   `json:"error,omitempty"`
+
+	// How long the job ran this time.
+	Duration time.Duration `json:"duration"`
+}
+
+// ItemsAddedEvent is the data of an EventItemsAdded event, which is
+// published as new items are stored by an import. Items are added in
+// batches, so an import usually publishes many of these events.
+type ItemsAddedEvent struct {
+	JobID      uint64   `json:"job_id"`
+	DataSource string   `json:"data_source"`
+	ItemIDs    []uint64 `json:"item_ids"`
+}
+
+// EntityMergedEvent is the data of an EventEntityMerged event, which is
+// published when entities are merged into another one.
+type EntityMergedEvent struct {
+	KeptEntityID    uint64   `json:"kept_entity_id"`
+	MergedEntityIDs []uint64 `json:"merged_entity_ids"`
+}
+
+// Subscribe calls handle with each event of the given types that is
+// published by the timeline, or every event if no types are given, until
+// the returned function is called or the timeline is closed. Events are
+// delivered in order, from a goroutine of the subscriber's own, so a slow
+// handler doesn't hold up the timeline; but if it falls too far behind,
+// events are dropped (and the number dropped is logged).
+func (tl *Timeline) Subscribe(handle func(Event), types ...EventType) (unsubscribe func()) {
+	return tl.events.subscribe(handle, types)
+}
+
+// publishEvent publishes an event with the given data to the subscribers.
+func (tl *Timeline) publishEvent(eventType EventType, data any) {
+	tl.events.publish(Event{
+		Type:   eventType,
+		Time:   time.Now(),
+		RepoID: tl.id.String(),
+		Data:   data,
+	})
+}
+
+// eventBus delivers the events of a timeline to its subscribers.
+// The zero value is ready to use.
+type eventBus struct {
+	mu     sync.RWMutex
+	subs   map[*eventSubscriber]struct{}
+	closed bool
+}
+
+type eventSubscriber struct {
+	types  []EventType // empty for all types
+	handle func(Event)
+	queue  chan Event
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func (b *eventBus) subscribe(handle func(Event), types []EventType) func() {
+	sub := &eventSubscriber{
+		types:  types,
+		handle: handle,
+		queue:  make(chan Event, eventQueueSize),
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return func() {}
+	}
+	if b.subs == nil {
+		b.subs = make(map[*eventSubscriber]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	go sub.run()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			if _, ok := b.subs[sub]; ok {
+				delete(b.subs, sub)
+				close(sub.queue)
+			}
+			b.mu.Unlock()
+		})
+	}
+}
+
+func (b *eventBus) publish(event Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if len(sub.types) > 0 && !slices.Contains(sub.types, event.Type) {
+			continue
+		}
+		select {
+		case sub.queue <- event:
+		default:
+			sub.mu.Lock()
+			sub.dropped++
+			sub.mu.Unlock()
+		}
+	}
+}
+
+// close unsubscribes all subscribers; they still get the events that
+// were already queued for them.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		close(sub.queue)
+	}
+	b.subs = nil
+	b.closed = true
+}
+
+// run delivers queued events to the subscriber until it is unsubscribed.
+func (sub *eventSubscriber) run() {
+	for event := range sub.queue {
+		sub.mu.Lock()
+		dropped := sub.dropped
+		sub.dropped = 0
+		sub.mu.Unlock()
+		if dropped > 0 {
+			Log.Warn("event subscriber fell behind; dropped events", zap.Int("dropped", dropped))
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					Log.Error("panic in event subscriber",
+						zap.String("event_type", string(event.Type)),
+						zap.Any("error", r))
+				}
+			}()
+			sub.handle(event)
+		}()
+	}
+}
+
+// eventQueueSize is how many events may wait to be delivered to a subscriber.
+const eventQueueSize = 1000
@@ -0,0 +1,139 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	tl := new(Timeline)
+
+	all := make(chan Event, 10)
+	merges := make(chan Event, 10)
+	unsubscribe := tl.Subscribe(func(e Event) { all <- e })
+	tl.Subscribe(func(e Event) { merges <- e }, EventEntityMerged)
+
+	tl.publishEvent(EventJobStarted, JobStartedEvent{JobID: 1})
+	tl.publishEvent(EventEntityMerged, EntityMergedEvent{KeptEntityID: 2, MergedEntityIDs: []uint64{3}})
+
+	receive := func(ch <-chan Event) Event {
+		t.Helper()
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return Event{}
+		}
+	}
+	if e := receive(all); e.Type != EventJobStarted || e.Data.(JobStartedEvent).JobID != 1 {
+		t.Errorf("expected job started event first, got %+v", e)
+	}
+	if e := receive(all); e.Type != EventEntityMerged {
+		t.Errorf("expected entity merged event second, got %+v", e)
+	}
+	if e := receive(merges); e.Data.(EntityMergedEvent).KeptEntityID != 2 {
+		t.Errorf("expected only the entity merged event, got %+v", e)
+	}
+
+	// unsubscribed handlers, and those of closed timelines, get no more events
+	unsubscribe()
+	unsubscribe()
+	tl.events.close()
+	tl.publishEvent(EventEntityMerged, EntityMergedEvent{})
+	tl.Subscribe(func(Event) { t.Error("subscribed to closed timeline") })
+	time.Sleep(10 * time.Millisecond)
+	if len(all) > 0 || len(merges) > 0 {
+		t.Errorf("expected no more events, got %d and %d", len(all), len(merges))
+	}
+}
+
+func TestEventWebhooks(t *testing.T) {
+	defer func(delay time.Duration) { eventWebhookRetryDelay = delay }(eventWebhookRetryDelay)
+	eventWebhookRetryDelay = time.Millisecond
+
+	type post struct {
+		header http.Header
+		event  Event
+	}
+	posts := make(chan post, 10)
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway) // retried
+			return
+		}
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding body: %v", err)
+		}
+		if sig := "sha256=" + eventWebhookSignature("s3cret", r.Header.Get("X-Timelinize-Timestamp"), body); r.Header.Get("X-Timelinize-Signature") != sig {
+			t.Errorf("expected signature %s, got %s", sig, r.Header.Get("X-Timelinize-Signature"))
+		}
+		var event Event
+		_ = json.Unmarshal(body, &event)
+		posts <- post{r.Header, event}
+	}))
+	defer srv.Close()
+
+	if _, err := NewEventWebhooks([]EventWebhook{{URL: "ftp://example.com"}}); err == nil {
+		t.Error("expected error for non-HTTP URL")
+	}
+
+	hooks, err := NewEventWebhooks([]EventWebhook{{
+		URL:     srv.URL,
+		Secret:  "s3cret",
+		Events:  []EventType{EventJobFinished},
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks.Dispatch(Event{Type: EventJobStarted, RepoID: "repo"})
+	hooks.Dispatch(Event{Type: EventJobFinished, RepoID: "repo", Data: JobFinishedEvent{JobID: 7, State: JobSucceeded}})
+
+	var p post
+	select {
+	case p = <-posts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for post")
+	}
+	hooks.Close()
+	if len(posts) > 0 {
+		t.Errorf("expected only 1 post, got %d more", len(posts))
+	}
+	if p.event.Type != EventJobFinished || p.event.RepoID != "repo" {
+		t.Errorf("unexpected event: %+v", p.event)
+	}
+	if data, ok := p.event.Data.(map[string]any); !ok || data["state"] != string(JobSucceeded) {
+		t.Errorf("unexpected event data: %+v", p.event.Data)
+	}
+	if p.header.Get("Authorization") != "Bearer token" || p.header.Get("X-Timelinize-Event") != string(EventJobFinished) {
+		t.Errorf("unexpected headers: %v", p.header)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("expected failed post to be retried once, got %d attempts", attempts.Load())
+	}
+}
@@ -0,0 +1,263 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// EventWebhook configures an endpoint that events are posted to (see
+// NewEventWebhooks).
+type EventWebhook struct {
+	// The URL to POST each event to, as JSON.
+	URL string `json:"url"`
+
+	// If set, each request is signed with it: the X-Timelinize-Signature
+	// header is "sha256=" followed by the hex-encoded HMAC-SHA256 of the
+	// X-Timelinize-Timestamp header, a period, and the body. Receivers
+	// should check the signature, and that the timestamp is recent.
+	Secret string `json:"secret,omitempty" sensitive:"true"`
+
+	// The types of events to post; if empty, all events are posted.
+	Events []EventType `json:"events,omitempty"`
+
+	// Headers to add to each request, such as for authorization.
+	Headers map[string]string `json:"headers,omitempty" sensitive:"true"`
+
+	// How many times a failed post is retried, with exponential backoff,
+	// before the event is dropped. Default: 5.
+	Retries int `json:"retries,omitempty"`
+}
+
+// EventWebhooks posts events to webhooks. Use its Dispatch method to
+// subscribe to timelines (see Timeline.Subscribe).
+type EventWebhooks struct {
+	endpoints []*eventWebhookEndpoint
+	client    *http.Client
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewEventWebhooks returns a dispatcher that posts events to the given
+// webhooks. Each webhook has its own queue, so one that is slow or down
+// doesn't delay the others. Posting happens in the background; failures
+// are logged. Call Close when done with it.
+func NewEventWebhooks(webhooks []EventWebhook) (*EventWebhooks, error) {
+	w := &EventWebhooks{
+		client: &http.Client{Timeout: eventWebhookTimeout},
+		stop:   make(chan struct{}),
+	}
+	for i, hook := range webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %d: invalid URL: %w", i, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("webhook %d: invalid URL: scheme must be http or https: %s", i, hook.URL)
+		}
+		if hook.Retries <= 0 {
+			hook.Retries = 5
+		}
+		w.endpoints = append(w.endpoints, &eventWebhookEndpoint{
+			EventWebhook: hook,
+			queue:        make(chan eventDelivery, eventQueueSize),
+			log:          Log.Named("webhook").With(zap.String("url", u.Redacted())),
+		})
+	}
+	for _, ep := range w.endpoints {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			ep.run(w)
+		}()
+	}
+	return w, nil
+}
+
+// Dispatch queues the event to be posted to each webhook that wants it.
+// It does not block; if a webhook's queue is full, the event is dropped
+// for it (and the number dropped is logged).
+func (w *EventWebhooks) Dispatch(event Event) {
+	if len(w.endpoints) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		Log.Error("encoding event for webhooks", zap.String("event_type", string(event.Type)), zap.Error(err))
+		return
+	}
+	delivery := eventDelivery{
+		id:        uuid.NewString(),
+		eventType: event.Type,
+		body:      body,
+	}
+	for _, ep := range w.endpoints {
+		if len(ep.Events) > 0 && !slices.Contains(ep.Events, event.Type) {
+			continue
+		}
+		select {
+		case ep.queue <- delivery:
+		default:
+			ep.dropped.Add(1)
+		}
+	}
+}
+
+// Close stops posting events. Events that are still queued are posted
+// once more, without retrying, before it returns.
+func (w *EventWebhooks) Close() {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		w.wg.Wait()
+	})
+}
+
+type eventWebhookEndpoint struct {
+	EventWebhook
+	queue   chan eventDelivery
+	dropped atomic.Int64
+	log     *zap.Logger
+}
+
+// eventDelivery is an event to post; its ID is the same for each attempt,
+// so receivers can recognize retries of posts they already processed.
+type eventDelivery struct {
+	id        string
+	eventType EventType
+	body      []byte
+}
+
+// run posts queued events in order until the dispatcher is closed.
+func (ep *eventWebhookEndpoint) run(w *EventWebhooks) {
+	for {
+		select {
+		case delivery := <-ep.queue:
+			ep.post(w, delivery)
+		case <-w.stop:
+			for {
+				select {
+				case delivery := <-ep.queue:
+					if err := ep.attempt(w.client, delivery); err != nil {
+						ep.log.Error("posting event", zap.String("delivery_id", delivery.id), zap.Error(err))
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// post posts the delivery, retrying with exponential backoff if it fails.
+// If the dispatcher is closed while waiting to retry, it retries
+// immediately, one last time.
+func (ep *eventWebhookEndpoint) post(w *EventWebhooks, delivery eventDelivery) {
+	if dropped := ep.dropped.Swap(0); dropped > 0 {
+		ep.log.Warn("webhook fell behind; dropped events", zap.Int64("dropped", dropped))
+	}
+	backoff := eventWebhookRetryDelay
+	for attempt, stopped := 0, false; ; attempt++ {
+		err := ep.attempt(w.client, delivery)
+		if err == nil {
+			return
+		}
+		var statusErr webhookStatusError
+		if attempt >= ep.Retries || stopped || (errors.As(err, &statusErr) && !statusErr.retryable()) {
+			ep.log.Error("posting event",
+				zap.String("event_type", string(delivery.eventType)),
+				zap.String("delivery_id", delivery.id),
+				zap.Int("attempts", attempt+1),
+				zap.Error(err))
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-w.stop:
+			stopped = true
+		}
+		backoff *= 2
+	}
+}
+
+// attempt posts the delivery once.
+func (ep *eventWebhookEndpoint) attempt(client *http.Client, delivery eventDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), eventWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	for key, val := range ep.Headers {
+		req.Header.Set(key, val)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Timelinize")
+	req.Header.Set("X-Timelinize-Event", string(delivery.eventType))
+	req.Header.Set("X-Timelinize-Delivery", delivery.id)
+	req.Header.Set("X-Timelinize-Timestamp", timestamp)
+	if ep.Secret != "" {
+		req.Header.Set("X-Timelinize-Signature", "sha256="+eventWebhookSignature(ep.Secret, timestamp, delivery.body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return webhookStatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// eventWebhookSignature returns the hex-encoded signature of a post.
+func eventWebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// eventWebhookTimeout is how long each attempt to post an event may take.
+const eventWebhookTimeout = 10 * time.Second
+
+// eventWebhookRetryDelay is how long to wait before the first retry of a
+// failed post; it is a variable so tests don't have to wait.
+var eventWebhookRetryDelay = time.Second
@@ -0,0 +1,888 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ExportFormat is the kind of archive an export is written to.
+type ExportFormat string
+
+const (
+	ExportFormatZip    ExportFormat = "zip"    // a zip file (default)
+	ExportFormatFolder ExportFormat = "folder" // a folder
+)
+
+// ExportOptions configures an export of a timeline.
+type ExportOptions struct {
+	// Where to write the export: the path of the zip file or folder,
+	// which must not exist yet.
+	Path   string       `json:"path"`
+	Format ExportFormat `json:"format,omitempty"`
+
+	// Only export items in this date range, and from these data sources.
+	StartTimestamp *time.Time `json:"start_timestamp,omitempty"`
+	EndTimestamp   *time.Time `json:"end_timestamp,omitempty"`
+	DataSourceName []string   `json:"data_source,omitempty"`
+
+	// If true, the data files of items and the pictures of entities
+	// are left out of the export, which makes it much smaller, but
+	// not self-contained.
+	SkipDataFiles bool `json:"skip_data_files,omitempty"`
+}
+
+// Export starts a job that exports the items of the timeline to a
+// self-contained archive, along with their data files and the entities
+// and relationships they involve, and returns its ID. The progress of
+// the export is reported like that of any job. The archive can be
+// imported into another timeline with the "timelinize_export" data
+// source; see ArchiveManifest for its layout.
+func (tl *Timeline) Export(opts ExportOptions) (uint64, error) {
+	if opts.Path == "" {
+		return 0, errors.New("export path is required")
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = ExportFormatZip
+	case ExportFormatZip, ExportFormatFolder:
+	default:
+		return 0, fmt.Errorf("unknown export format: %s", opts.Format)
+	}
+	absPath, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return 0, err
+	}
+	opts.Path = absPath
+	if _, err := os.Stat(opts.Path); err == nil {
+		return 0, fmt.Errorf("export path already exists: %s", opts.Path)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	return tl.CreateJob(exportJob{Options: opts}, time.Time{}, 0, 0, 0)
+}
+
+// ArchiveManifest describes an exported timeline. It is the file named
+// ArchiveManifestName at the root of the archive, alongside these files:
+//
+//   - items.jsonl: the items, one ArchiveItem per line
+//   - relationships.jsonl: the relationships between the items and
+//     entities, one ArchiveRelationship per line
+//   - entities.jsonl: the entities the items are attributed to or
+//     related to, one ArchiveEntity per line
+//   - data/...: the data files of items and pictures of entities,
+//     at the same paths as in the timeline
+type ArchiveManifest struct {
+	Format        string        `json:"format"` // always ArchiveFormat
+	Version       int           `json:"version"`
+	RepoID        string        `json:"repo_id"`
+	Exported      time.Time     `json:"exported"`
+	Options       ExportOptions `json:"options"`
+	Items         int           `json:"items"`
+	Relationships int           `json:"relationships"`
+	Entities      int           `json:"entities"`
+	Files         int           `json:"files"`
+}
+
+// The name and format of the manifest of exported timelines.
+const (
+	ArchiveManifestName = "timelinize_export.json"
+	ArchiveFormat       = "timelinize_export"
+	archiveVersion      = 1
+)
+
+// ArchiveItem is an exported item.
+type ArchiveItem struct {
+	// A unique and stable identifier of the item across exports,
+	// which relationships use to refer to the item. It is derived
+	// from the data source and the ID it gave to the item, or if
+	// it has none, the timeline and the item's row ID.
+	UID string `json:"uid"`
+
+	DataSource           string          `json:"data_source,omitempty"`
+	OriginalID           string          `json:"original_id,omitempty"`
+	Classification       string          `json:"classification,omitempty"`
+	OriginalLocation     string          `json:"original_location,omitempty"`
+	IntermediateLocation string          `json:"intermediate_location,omitempty"`
+	Filename             string          `json:"filename,omitempty"`
+	Timestamp            *time.Time      `json:"timestamp,omitempty"`
+	Timespan             *time.Time      `json:"timespan,omitempty"`
+	Timeframe            *time.Time      `json:"timeframe,omitempty"`
+	TimeOffset           *int            `json:"time_offset,omitempty"`      // seconds east of UTC
+	TimeUncertainty      *int64          `json:"time_uncertainty,omitempty"` // milliseconds
+	DataType             string          `json:"data_type,omitempty"`
+	DataText             *string         `json:"data_text,omitempty"`
+	DataFile             string          `json:"data_file,omitempty"` // path in the archive
+	Metadata             json.RawMessage `json:"metadata,omitempty"`
+	Location
+	Note    string `json:"note,omitempty"`
+	Starred *int   `json:"starred,omitempty"`
+
+	// The attribute of the entity the item is attributed to.
+	Attribute *ArchiveAttribute `json:"attribute,omitempty"`
+}
+
+// ArchiveAttribute is an exported attribute of an entity.
+type ArchiveAttribute struct {
+	Name     string `json:"name"`
+	Value    any    `json:"value"`
+	AltValue string `json:"alt_value,omitempty"`
+
+	// If the attribute is the entity's identity on a data source,
+	// the name of that data source.
+	IdentityOn string `json:"identity_on,omitempty"`
+}
+
+// ArchiveEntity is an exported entity.
+type ArchiveEntity struct {
+	ID         uint64             `json:"id"` // row ID in the exported timeline
+	Type       string             `json:"type"`
+	Name       string             `json:"name,omitempty"`
+	Picture    string             `json:"picture,omitempty"` // path in the archive
+	Metadata   json.RawMessage    `json:"metadata,omitempty"`
+	Attributes []ArchiveAttribute `json:"attributes,omitempty"`
+}
+
+// ArchiveRelationship is an exported relationship. Exactly one of the
+// from fields and one of the to fields is set; items are referred to
+// by their UIDs, and entities by one of their attributes.
+type ArchiveRelationship struct {
+	Relation
+	Value         any               `json:"value,omitempty"`
+	FromItem      string            `json:"from_item,omitempty"`
+	FromAttribute *ArchiveAttribute `json:"from_attribute,omitempty"`
+	ToItem        string            `json:"to_item,omitempty"`
+	ToAttribute   *ArchiveAttribute `json:"to_attribute,omitempty"`
+	Start         *time.Time        `json:"start,omitempty"`
+	End           *time.Time        `json:"end,omitempty"`
+	Metadata      json.RawMessage   `json:"metadata,omitempty"`
+}
+
+// Item returns the item to import for the exported item. If its
+// content is in a data file, the importer must set its data, since
+// only the importer knows where the archive is.
+func (ai ArchiveItem) Item() *Item {
+	loc := time.UTC
+	if ai.TimeOffset != nil {
+		loc = time.FixedZone("", *ai.TimeOffset)
+	}
+	inZone := func(t *time.Time) time.Time {
+		if t == nil {
+			return time.Time{}
+		}
+		return t.In(loc)
+	}
+
+	item := &Item{
+		ID:                   ai.UID,
+		Classification:       getClassification(ai.Classification),
+		Timestamp:            inZone(ai.Timestamp),
+		Timespan:             inZone(ai.Timespan),
+		Timeframe:            inZone(ai.Timeframe),
+		Location:             ai.Location,
+		OriginalLocation:     ai.OriginalLocation,
+		IntermediateLocation: ai.IntermediateLocation,
+		Content: ItemData{
+			Filename:  ai.Filename,
+			MediaType: ai.DataType,
+		},
+	}
+	if ai.TimeUncertainty != nil {
+		item.TimeUncertainty = time.Duration(*ai.TimeUncertainty) * time.Millisecond
+	}
+	if ai.DataText != nil {
+		item.Content.Data = StringData(*ai.DataText)
+	}
+	if len(ai.Metadata) > 0 {
+		_ = json.Unmarshal(ai.Metadata, &item.Metadata)
+	}
+	return item
+}
+
+// Entity returns the entity to import for the exported entity. If
+// identity is one of its attributes, it is the entity's identity (the
+// attribute that items are attributed to). The picture, if any, must
+// be set by the importer.
+func (ae ArchiveEntity) Entity(identity *ArchiveAttribute) Entity {
+	entity := Entity{Type: ae.Type, Name: ae.Name}
+	if len(ae.Metadata) > 0 {
+		_ = json.Unmarshal(ae.Metadata, &entity.Metadata)
+	}
+	for _, attr := range ae.Attributes {
+		entity.Attributes = append(entity.Attributes, Attribute{
+			Name:        attr.Name,
+			Value:       attr.Value,
+			AltValue:    attr.AltValue,
+			Identifying: attr.IdentityOn != "",
+			Identity:    identity != nil && attr.Name == identity.Name && fmt.Sprint(attr.Value) == fmt.Sprint(identity.Value),
+		})
+	}
+	return entity
+}
+
+// exportJob is the job action that exports a timeline.
+type exportJob struct {
+	Options ExportOptions `json:"options"`
+}
+
+// Run exports the timeline. Exports are not resumed from checkpoints;
+// an interrupted export is started over.
+func (ej exportJob) Run(job *ActiveJob, _ []byte) error {
+	logger := job.Logger().With(zap.String("path", ej.Options.Path))
+
+	// write to a temporary location, so that a failed or interrupted
+	// export doesn't leave a partial archive that looks complete
+	partial := ej.Options.Path + ".partial"
+	if err := os.RemoveAll(partial); err != nil {
+		return fmt.Errorf("removing previous partial export: %w", err)
+	}
+
+	exp := &exporter{job: job, opts: ej.Options}
+	if err := exp.countItems(); err != nil {
+		return fmt.Errorf("counting items to export: %w", err)
+	}
+	job.SetTotal(exp.total)
+	logger.Info("exporting timeline", zap.Int("items", exp.total))
+
+	var err error
+	if ej.Options.Format == ExportFormatFolder {
+		exp.archive, err = newFolderArchive(partial)
+	} else {
+		exp.archive, err = newZipArchive(partial)
+	}
+	if err != nil {
+		return fmt.Errorf("creating archive: %w", err)
+	}
+
+	err = exp.export()
+	if closeErr := exp.archive.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.RemoveAll(partial)
+		return err
+	}
+	if err := os.Rename(partial, ej.Options.Path); err != nil {
+		return fmt.Errorf("moving export into place: %w", err)
+	}
+
+	logger.Info("exported timeline",
+		zap.Int("items", exp.manifest.Items),
+		zap.Int("relationships", exp.manifest.Relationships),
+		zap.Int("entities", exp.manifest.Entities),
+		zap.Int("files", exp.manifest.Files))
+	return nil
+}
+
+// exporter holds the state of an export.
+type exporter struct {
+	job      *ActiveJob
+	opts     ExportOptions
+	archive  exportArchive
+	manifest ArchiveManifest
+	total    int // items and files to export, for progress
+
+	items      map[uint64]string   // row IDs of exported items to their UIDs
+	attributes map[uint64]struct{} // row IDs of attributes of exported items and relationships
+	files      []string            // data files of exported items
+}
+
+func (exp *exporter) export() error {
+	exp.items = make(map[uint64]string)
+	exp.attributes = make(map[uint64]struct{})
+	exp.manifest = ArchiveManifest{
+		Format:   ArchiveFormat,
+		Version:  archiveVersion,
+		RepoID:   exp.job.Timeline().ID().String(),
+		Exported: time.Now(),
+		Options:  exp.opts,
+	}
+
+	exp.job.Message("Exporting items")
+	if err := exp.exportItems(); err != nil {
+		return fmt.Errorf("exporting items: %w", err)
+	}
+	exp.job.Message("Exporting relationships")
+	if err := exp.exportRelationships(); err != nil {
+		return fmt.Errorf("exporting relationships: %w", err)
+	}
+	exp.job.Message("Exporting entities")
+	pictures, err := exp.exportEntities()
+	if err != nil {
+		return fmt.Errorf("exporting entities: %w", err)
+	}
+	if !exp.opts.SkipDataFiles {
+		exp.job.Message("Exporting data files")
+		if err := exp.exportFiles(exp.files, true); err != nil {
+			return fmt.Errorf("exporting data files: %w", err)
+		}
+		if err := exp.exportFiles(pictures, false); err != nil {
+			return fmt.Errorf("exporting entity pictures: %w", err)
+		}
+	}
+
+	return exp.writeJSON(ArchiveManifestName, exp.manifest)
+}
+
+// itemFilter returns the WHERE clause and arguments that select the items to export.
+func (exp *exporter) itemFilter() (string, []any) {
+	where := []string{"items.deleted IS NULL", "items.hidden IS NULL"}
+	var args []any
+	if exp.opts.StartTimestamp != nil {
+		where = append(where, "items.timestamp >= ?")
+		args = append(args, exp.opts.StartTimestamp.UnixMilli())
+	}
+	if exp.opts.EndTimestamp != nil {
+		where = append(where, "items.timestamp <= ?")
+		args = append(args, exp.opts.EndTimestamp.UnixMilli())
+	}
+	if len(exp.opts.DataSourceName) > 0 {
+		where = append(where, "items.data_source_name IN "+sqlPlaceholders(len(exp.opts.DataSourceName)))
+		for _, name := range exp.opts.DataSourceName {
+			args = append(args, name)
+		}
+	}
+	return strings.Join(where, " AND "), args
+}
+
+func (exp *exporter) countItems() error {
+	where, args := exp.itemFilter()
+	tl := exp.job.Timeline()
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+	var items, files int
+	err := tl.db.QueryRowContext(exp.job.Context(),
+		`SELECT count(), count(items.data_file) FROM extended_items AS items WHERE `+where, args...).Scan(&items, &files)
+	exp.total = items
+	if !exp.opts.SkipDataFiles {
+		exp.total += files
+	}
+	return err
+}
+
+func (exp *exporter) exportItems() error {
+	w, err := exp.archive.Create("items.jsonl")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	where, filterArgs := exp.itemFilter()
+
+	// page through the items, so the database isn't locked the whole time
+	var lastID uint64
+	for {
+		if err := exp.job.Continue(); err != nil {
+			return err
+		}
+		rows, err := exp.queryItemPage(where, append([]any{lastID}, filterArgs...))
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		for _, ir := range rows {
+			item := exp.archiveItem(ir)
+			if ir.AttributeID != nil {
+				if item.Attribute, err = exp.archiveAttribute(*ir.AttributeID); err != nil {
+					return err
+				}
+			}
+			if err := enc.Encode(item); err != nil {
+				return err
+			}
+			exp.manifest.Items++
+			lastID = ir.ID
+		}
+		exp.job.Progress(len(rows))
+	}
+}
+
+func (exp *exporter) queryItemPage(where string, args []any) ([]ItemRow, error) {
+	tl := exp.job.Timeline()
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(exp.job.Context(), `SELECT `+itemDBColumns+`
+		FROM extended_items AS items
+		WHERE items.id > ? AND `+where+`
+		ORDER BY items.id
+		LIMIT `+strconv.Itoa(exportPageSize), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page []ItemRow
+	for rows.Next() {
+		ir, err := scanItemRow(rows, nil)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, ir)
+	}
+	return page, rows.Err()
+}
+
+// archiveItem converts the item row to an exported item, and remembers it and its data file.
+func (exp *exporter) archiveItem(ir ItemRow) ArchiveItem {
+	item := newArchiveItem(ir)
+	if item.DataSource != "" && item.OriginalID != "" {
+		item.UID = item.DataSource + "/" + item.OriginalID
+	} else {
+		item.UID = exp.manifest.RepoID + "/" + strconv.FormatUint(ir.ID, 10)
+	}
+	if ir.DataFile != nil && !exp.opts.SkipDataFiles {
+		item.DataFile = *ir.DataFile
+		exp.files = append(exp.files, *ir.DataFile)
+	}
+	exp.items[ir.ID] = item.UID
+	return item
+}
+
+// newArchiveItem returns the item row as an exported item,
+// without its UID and data file.
+func newArchiveItem(ir ItemRow) ArchiveItem {
+	return ArchiveItem{
+		DataSource:           deref(ir.DataSourceName),
+		OriginalID:           deref(ir.OriginalID),
+		Classification:       deref(ir.Classification),
+		OriginalLocation:     deref(ir.OriginalLocation),
+		IntermediateLocation: deref(ir.IntermediateLocation),
+		Filename:             deref(ir.Filename),
+		Timestamp:            ir.Timestamp,
+		Timespan:             ir.Timespan,
+		Timeframe:            ir.Timeframe,
+		TimeOffset:           ir.TimeOffset,
+		TimeUncertainty:      ir.TimeUncertainty,
+		DataType:             deref(ir.DataType),
+		DataText:             ir.DataText,
+		Metadata:             ir.Metadata,
+		Location:             ir.Location,
+		Note:                 deref(ir.Note),
+		Starred:              ir.Starred,
+	}
+}
+
+func (exp *exporter) exportRelationships() error {
+	w, err := exp.archive.Create("relationships.jsonl")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	tl := exp.job.Timeline()
+
+	type relRow struct {
+		label                   string
+		directed, subordinating bool
+		value                   any
+		fromItem, toItem        *uint64
+		fromAttr, toAttr        *uint64
+		start, end              *int64
+		metadata                *string
+	}
+
+	var lastID uint64
+	for {
+		if err := exp.job.Continue(); err != nil {
+			return err
+		}
+
+		var page []relRow
+		err := func() error {
+			tl.dbMu.RLock()
+			defer tl.dbMu.RUnlock()
+			rows, err := tl.db.QueryContext(exp.job.Context(), `SELECT relationships.id, relations.label, relations.directed,
+					relations.subordinating, relationships.value, relationships.from_item_id, relationships.from_attribute_id,
+					relationships.to_item_id, relationships.to_attribute_id, relationships.start, relationships.end,
+					relationships.metadata
+				FROM relationships
+				JOIN relations ON relations.id = relationships.relation_id
+				WHERE relationships.id > ?
+				ORDER BY relationships.id
+				LIMIT ?`, lastID, exportPageSize)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var r relRow
+				err := rows.Scan(&lastID, &r.label, &r.directed, &r.subordinating, &r.value,
+					&r.fromItem, &r.fromAttr, &r.toItem, &r.toAttr, &r.start, &r.end, &r.metadata)
+				if err != nil {
+					return err
+				}
+				page = append(page, r)
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+
+		for _, r := range page {
+			// only export relationships whose items are all exported, and that
+			// involve at least one exported item (or are between entities)
+			fromUID, fromOK := exp.items[deref(r.fromItem)]
+			toUID, toOK := exp.items[deref(r.toItem)]
+			if (r.fromItem != nil && !fromOK) || (r.toItem != nil && !toOK) {
+				continue
+			}
+
+			rel := ArchiveRelationship{
+				Relation: Relation{Label: r.label, Directed: r.directed, Subordinating: r.subordinating},
+				Value:    r.value,
+				FromItem: fromUID,
+				ToItem:   toUID,
+			}
+			if r.start != nil {
+				start := time.Unix(*r.start, 0)
+				rel.Start = &start
+			}
+			if r.end != nil {
+				end := time.Unix(*r.end, 0)
+				rel.End = &end
+			}
+			if r.metadata != nil {
+				rel.Metadata = json.RawMessage(*r.metadata)
+			}
+			if r.fromAttr != nil {
+				if rel.FromAttribute, err = exp.archiveAttribute(*r.fromAttr); err != nil {
+					return err
+				}
+			}
+			if r.toAttr != nil {
+				if rel.ToAttribute, err = exp.archiveAttribute(*r.toAttr); err != nil {
+					return err
+				}
+			}
+			if (rel.FromItem == "" && rel.FromAttribute == nil) || (rel.ToItem == "" && rel.ToAttribute == nil) {
+				continue // dangling
+			}
+
+			if err := enc.Encode(rel); err != nil {
+				return err
+			}
+			exp.manifest.Relationships++
+		}
+	}
+}
+
+// archiveAttribute loads the attribute with the given row ID, and
+// remembers it so its entity is exported.
+func (exp *exporter) archiveAttribute(attrID uint64) (*ArchiveAttribute, error) {
+	tl := exp.job.Timeline()
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	attr, err := loadArchiveAttribute(exp.job.Context(), tl.db, attrID)
+	if attr != nil {
+		exp.attributes[attrID] = struct{}{}
+	}
+	return attr, err
+}
+
+// loadArchiveAttribute loads the attribute with the given row ID.
+// It returns nil, without error, if there is no such attribute.
+func loadArchiveAttribute(ctx context.Context, q rowQueryer, attrID uint64) (*ArchiveAttribute, error) {
+	var attr ArchiveAttribute
+	var altValue *string
+	err := q.QueryRowContext(ctx,
+		`SELECT name, value, alt_value FROM attributes WHERE id=?`, attrID).Scan(&attr.Name, &attr.Value, &altValue)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	attr.AltValue = deref(altValue)
+	return &attr, nil
+}
+
+// exportEntities exports the entities that have any of the attributes
+// of the exported items and relationships, and returns the paths of
+// their pictures.
+func (exp *exporter) exportEntities() ([]string, error) {
+	w, err := exp.archive.Create("entities.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+	tl := exp.job.Timeline()
+
+	// find the entities (SQLite has a limit on the number of parameters, so chunk it)
+	attrIDs := make([]any, 0, len(exp.attributes))
+	for id := range exp.attributes {
+		attrIDs = append(attrIDs, id)
+	}
+	entityIDs := make(map[uint64]struct{})
+	for start := 0; start < len(attrIDs); start += exportPageSize {
+		chunk := attrIDs[start:min(start+exportPageSize, len(attrIDs))]
+		err := func() error {
+			tl.dbMu.RLock()
+			defer tl.dbMu.RUnlock()
+			rows, err := tl.db.QueryContext(exp.job.Context(),
+				`SELECT DISTINCT entity_id FROM entity_attributes WHERE attribute_id IN `+sqlPlaceholders(len(chunk)), chunk...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id uint64
+				if err := rows.Scan(&id); err != nil {
+					return err
+				}
+				entityIDs[id] = struct{}{}
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var pictures []string
+	for entityID := range entityIDs {
+		if err := exp.job.Continue(); err != nil {
+			return nil, err
+		}
+		entity, err := exp.loadEntity(entityID)
+		if err != nil {
+			return nil, fmt.Errorf("loading entity %d: %w", entityID, err)
+		}
+		if entity.Picture != "" {
+			if exp.opts.SkipDataFiles {
+				entity.Picture = ""
+			} else {
+				pictures = append(pictures, entity.Picture)
+			}
+		}
+		if err := enc.Encode(entity); err != nil {
+			return nil, err
+		}
+		exp.manifest.Entities++
+	}
+
+	return pictures, nil
+}
+
+func (exp *exporter) loadEntity(entityID uint64) (ArchiveEntity, error) {
+	tl := exp.job.Timeline()
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+	return loadArchiveEntity(exp.job.Context(), tl.db, entityID)
+}
+
+// loadArchiveEntity loads the entity with the given row ID, along with its attributes.
+func loadArchiveEntity(ctx context.Context, q queryer, entityID uint64) (ArchiveEntity, error) {
+	entity := ArchiveEntity{ID: entityID}
+	var name, picture, metadata *string
+	err := q.QueryRowContext(ctx, `SELECT entity_types.name, entities.name, entities.picture_file, entities.metadata
+		FROM entities
+		JOIN entity_types ON entity_types.id = entities.type_id
+		WHERE entities.id=?`, entityID).Scan(&entity.Type, &name, &picture, &metadata)
+	if err != nil {
+		return entity, err
+	}
+	entity.Name, entity.Picture = deref(name), deref(picture)
+	if metadata != nil {
+		entity.Metadata = json.RawMessage(*metadata)
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT attributes.name, attributes.value, attributes.alt_value, data_sources.name
+		FROM entity_attributes
+		JOIN attributes ON attributes.id = entity_attributes.attribute_id
+		LEFT JOIN data_sources ON data_sources.id = entity_attributes.data_source_id
+		WHERE entity_attributes.entity_id=?
+		ORDER BY entity_attributes.id`, entityID)
+	if err != nil {
+		return entity, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var attr ArchiveAttribute
+		var altValue, identityOn *string
+		if err := rows.Scan(&attr.Name, &attr.Value, &altValue, &identityOn); err != nil {
+			return entity, err
+		}
+		attr.AltValue, attr.IdentityOn = deref(altValue), deref(identityOn)
+		entity.Attributes = append(entity.Attributes, attr)
+	}
+	return entity, rows.Err()
+}
+
+// exportFiles copies the files, whose paths are relative to the repo,
+// to the same paths in the archive. If progress is true, each file
+// counts toward the progress of the job.
+func (exp *exporter) exportFiles(files []string, progress bool) error {
+	tl := exp.job.Timeline()
+	copied := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		if err := exp.job.Continue(); err != nil {
+			return err
+		}
+		if progress {
+			exp.job.Progress(1)
+		}
+		if _, ok := copied[file]; ok {
+			continue // items can share a data file
+		}
+		copied[file] = struct{}{}
+
+		if err := exp.exportFile(tl, file); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				exp.job.Logger().Warn("data file is missing; skipping", zap.String("data_file", file))
+				continue
+			}
+			return err
+		}
+		exp.manifest.Files++
+	}
+	return nil
+}
+
+// exportFile copies the repo file with the given name to the archive,
+// decrypting it if it's encrypted, since exports are meant to be portable.
+func (exp *exporter) exportFile(tl *Timeline, name string) error {
+	in, err := tl.OpenRepoFile(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	w, err := exp.archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, in)
+	return err
+}
+
+func (exp *exporter) writeJSON(name string, v any) error {
+	w, err := exp.archive.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+// exportArchive is where an export is written. Only one file can be
+// written at a time; creating a file finishes the previous one.
+type exportArchive interface {
+	Create(name string) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	file *os.File
+	zw   *zip.Writer
+}
+
+func newZipArchive(filename string) (*zipArchive, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &zipArchive{file: file, zw: zip.NewWriter(file)}, nil
+}
+
+func (z *zipArchive) Create(name string) (io.Writer, error) {
+	return z.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+}
+
+func (z *zipArchive) Close() error {
+	err := z.zw.Close()
+	if closeErr := z.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type folderArchive struct {
+	root    string
+	current *os.File
+}
+
+func newFolderArchive(dir string) (*folderArchive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &folderArchive{root: dir}, nil
+}
+
+func (f *folderArchive) Create(name string) (io.Writer, error) {
+	if err := f.closeCurrent(); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(f.root, filepath.FromSlash(path.Clean("/"+name)))
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	f.current = file
+	return file, nil
+}
+
+func (f *folderArchive) closeCurrent() error {
+	if f.current == nil {
+		return nil
+	}
+	err := f.current.Close()
+	f.current = nil
+	return err
+}
+
+func (f *folderArchive) Close() error { return f.closeCurrent() }
+
+func deref[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
+
+// how many rows to load at a time while exporting
+const exportPageSize = 500
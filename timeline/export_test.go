@@ -0,0 +1,144 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	repoDir := t.TempDir()
+	db, err := openAndProvisionDB(ctx, repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tl := &Timeline{db: db, repoDir: repoDir}
+
+	if err := os.MkdirAll(filepath.Join(repoDir, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repoDir, "data", "photo.jpg"), []byte("photo"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a message with a photo attached, sent by a person to another, and an
+	// item that was deleted, which isn't exported
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO data_sources (id, name, title) VALUES (1, 'sms', 'SMS');
+		INSERT INTO attributes (id, name, value) VALUES (1, 'phone_number', '+15550001'), (2, 'phone_number', '+15550002');
+		INSERT INTO entities (id, type_id, name) VALUES (1, (SELECT id FROM entity_types WHERE name='person'), 'Alice');
+		INSERT INTO entity_attributes (entity_id, attribute_id, data_source_id) VALUES (1, 1, 1);
+		INSERT INTO items (id, data_source_id, original_id, attribute_id, timestamp, time_offset, data_type, data_text) VALUES
+			(1, 1, 'msg1', 1, 1700000000000, -25200, 'text/plain', 'Hello');
+		INSERT INTO items (id, data_source_id, attribute_id, timestamp, data_type, data_file) VALUES
+			(2, 1, 1, 1700000000000, 'image/jpeg', 'data/photo.jpg');
+		INSERT INTO items (id, data_source_id, original_id, timestamp, data_text, deleted) VALUES
+			(3, 1, 'msg3', 1700000000000, 'Gone', 1);
+		INSERT INTO relations (id, label) VALUES (100, 'test_sent'), (101, 'test_attached');
+		INSERT INTO relationships (relation_id, from_item_id, to_attribute_id) VALUES (100, 1, 2);
+		INSERT INTO relationships (relation_id, from_item_id, to_item_id) VALUES (101, 1, 2), (101, 1, 3);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exportDir := filepath.Join(t.TempDir(), "export")
+	job := &ActiveJob{ctx: ctx, tl: tl, logger: zap.NewNop(), statusLog: zap.NewNop()}
+	err = exportJob{Options: ExportOptions{Path: exportDir, Format: ExportFormatFolder}}.Run(job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest ArchiveManifest
+	readJSONLines(t, filepath.Join(exportDir, ArchiveManifestName), func(dec *json.Decoder) error { return dec.Decode(&manifest) })
+	if manifest.Format != ArchiveFormat || manifest.Items != 2 || manifest.Relationships != 2 || manifest.Entities != 1 || manifest.Files != 1 {
+		t.Errorf("unexpected manifest: %+v", manifest)
+	}
+
+	var items []ArchiveItem
+	readJSONLines(t, filepath.Join(exportDir, "items.jsonl"), func(dec *json.Decoder) error {
+		var item ArchiveItem
+		err := dec.Decode(&item)
+		items = append(items, item)
+		return err
+	})
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(items))
+	}
+	if items[0].UID != "sms/msg1" || items[0].DataText == nil || *items[0].DataText != "Hello" {
+		t.Errorf("unexpected first item: %+v", items[0])
+	}
+	if items[0].Attribute == nil || items[0].Attribute.Value != "+15550001" {
+		t.Errorf("expected first item to be attributed to its sender, got %+v", items[0].Attribute)
+	}
+	if items[1].UID != manifest.RepoID+"/2" || items[1].DataFile != "data/photo.jpg" {
+		t.Errorf("unexpected second item: %+v", items[1])
+	}
+
+	var rels []ArchiveRelationship
+	readJSONLines(t, filepath.Join(exportDir, "relationships.jsonl"), func(dec *json.Decoder) error {
+		var rel ArchiveRelationship
+		err := dec.Decode(&rel)
+		rels = append(rels, rel)
+		return err
+	})
+	for _, rel := range rels {
+		if rel.ToItem == "sms/msg3" {
+			t.Errorf("relationship to a deleted item was exported: %+v", rel)
+		}
+	}
+
+	photo, err := os.ReadFile(filepath.Join(exportDir, "data", "photo.jpg"))
+	if err != nil || string(photo) != "photo" {
+		t.Errorf("data file wasn't exported: %v", err)
+	}
+
+	// the exported item converts back to the original
+	item := items[0].Item()
+	if item.ID != "sms/msg1" || item.Content.Data == nil || !item.Timestamp.Equal(time.UnixMilli(1700000000000)) {
+		t.Errorf("unexpected item: %+v", item)
+	}
+	if _, offset := item.Timestamp.Zone(); offset != -25200 {
+		t.Errorf("expected time offset -25200, got %d", offset)
+	}
+}
+
+func readJSONLines(t *testing.T, filename string, decode func(*json.Decoder) error) {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for dec.More() {
+		if err := decode(dec); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
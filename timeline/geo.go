@@ -0,0 +1,458 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GeoQuery describes a query for the locations of items, which are
+// found using the spatial index of items. The map view uses these
+// queries to render large numbers of points without loading them all.
+type GeoQuery struct {
+	// The UUID of the open timeline to query.
+	Repo string `json:"repo,omitempty"`
+
+	// The area to query. For clusters and paths, the whole world
+	// if not set. The area can't cross the antimeridian (that is,
+	// the min longitude can't be greater than the max longitude).
+	Bounds *GeoBounds `json:"bounds,omitempty"`
+
+	// For nearby queries, the point to search around, and the
+	// distance from it in meters.
+	Latitude     *float64 `json:"latitude,omitempty"`
+	Longitude    *float64 `json:"longitude,omitempty"`
+	RadiusMeters float64  `json:"radius_meters,omitempty"`
+
+	// Only include items in this date range, and from these data sources.
+	StartTimestamp *time.Time `json:"start_timestamp,omitempty"`
+	EndTimestamp   *time.Time `json:"end_timestamp,omitempty"`
+	DataSourceName []string   `json:"data_source,omitempty"`
+
+	// For clusters and paths, the zoom level of the map, from 0
+	// (the whole world in one 256-pixel tile) to 22. The higher
+	// the zoom level, the smaller the clusters, and the more
+	// detailed the paths.
+	Zoom int `json:"zoom,omitempty"`
+
+	// For items in an area or nearby, the maximum number of
+	// items (-1 for no limit); default 1000.
+	Limit int `json:"limit,omitempty"`
+}
+
+// GeoBounds is a bounding box of coordinates.
+type GeoBounds struct {
+	MinLatitude  float64 `json:"min_latitude"`
+	MaxLatitude  float64 `json:"max_latitude"`
+	MinLongitude float64 `json:"min_longitude"`
+	MaxLongitude float64 `json:"max_longitude"`
+}
+
+func (b GeoBounds) validate() error {
+	if b.MinLatitude > b.MaxLatitude {
+		return errors.New("min latitude is greater than max latitude")
+	}
+	if b.MinLongitude > b.MaxLongitude {
+		return errors.New("min longitude is greater than max longitude (bounds crossing the antimeridian must be split)")
+	}
+	return nil
+}
+
+// GeoPoint is the location of an item.
+type GeoPoint struct {
+	ItemID    uint64     `json:"item_id"`
+	Latitude  float64    `json:"latitude"`
+	Longitude float64    `json:"longitude"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+
+	// For nearby queries, the distance from the point in meters.
+	Distance float64 `json:"distance,omitempty"`
+}
+
+// GeoCluster is a group of items that are close together at a zoom level.
+type GeoCluster struct {
+	Count int `json:"count"`
+
+	// The centroid of the points in the cluster.
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+
+	// The extent of the points in the cluster, so that the
+	// map can be zoomed to it.
+	Bounds GeoBounds `json:"bounds"`
+
+	// One of the items in the cluster (the only one if Count is 1).
+	ItemID uint64 `json:"item_id"`
+}
+
+// GeoPath is a path traveled, formed by consecutive locations from a
+// data source, which has been simplified for rendering at a zoom level.
+type GeoPath struct {
+	DataSource string    `json:"data_source,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+
+	// The number of locations on the path before it was simplified.
+	Count int `json:"count"`
+
+	// The coordinates of the path as [longitude, latitude] pairs,
+	// which is the order used by GeoJSON.
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+// ItemsInBoundingBox returns the locations of the items within the bounds of the query.
+func (tl *Timeline) ItemsInBoundingBox(ctx context.Context, q GeoQuery) ([]GeoPoint, error) {
+	if q.Bounds == nil {
+		return nil, errors.New("bounds are required")
+	}
+	if q.Limit == 0 {
+		q.Limit = 1000
+	}
+
+	where, args, err := q.where(*q.Bounds)
+	if err != nil {
+		return nil, err
+	}
+	sqlQuery := `SELECT items.id, items.latitude, items.longitude, items.timestamp ` + geoFrom + where + `
+		ORDER BY items.timestamp`
+	if q.Limit > 0 {
+		sqlQuery += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	return tl.queryGeoPoints(ctx, sqlQuery, args)
+}
+
+// ItemsNearPoint returns the locations of the items within the radius
+// of the point of the query, ordered by distance from the point.
+func (tl *Timeline) ItemsNearPoint(ctx context.Context, q GeoQuery) ([]GeoPoint, error) {
+	if q.Latitude == nil || q.Longitude == nil {
+		return nil, errors.New("latitude and longitude are required")
+	}
+	if q.RadiusMeters <= 0 {
+		return nil, errors.New("radius must be positive")
+	}
+	if q.Limit == 0 {
+		q.Limit = 1000
+	}
+	lat, lon := *q.Latitude, *q.Longitude
+
+	// find the candidates in the box around the circle, then
+	// compute their actual distances; near the poles, the box
+	// spans all longitudes
+	latDelta := q.RadiusMeters / metersPerDegreeLatitude
+	lonDelta := 180.0
+	if cosLat := math.Cos(degreesToRadians(lat)); cosLat > 1e-6 {
+		lonDelta = min(latDelta/cosLat, 180)
+	}
+	bounds := GeoBounds{
+		MinLatitude:  max(lat-latDelta, -90),
+		MaxLatitude:  min(lat+latDelta, 90),
+		MinLongitude: max(lon-lonDelta, -180),
+		MaxLongitude: min(lon+lonDelta, 180),
+	}
+
+	where, args, err := q.where(bounds)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := tl.queryGeoPoints(ctx,
+		`SELECT items.id, items.latitude, items.longitude, items.timestamp `+geoFrom+where, args)
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]GeoPoint, 0, len(candidates))
+	for _, p := range candidates {
+		p.Distance = haversineDistanceMeters(lat, lon, p.Latitude, p.Longitude)
+		if p.Distance <= q.RadiusMeters {
+			points = append(points, p)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Distance < points[j].Distance })
+	if q.Limit > 0 && len(points) > q.Limit {
+		points = points[:q.Limit]
+	}
+
+	return points, nil
+}
+
+// ClusterPoints groups the locations of the items in the bounds of the
+// query into clusters, whose size depends on the zoom level, so that
+// the map can render the clusters instead of every point. The clusters
+// are computed by the database, on a grid of cells that are a quarter
+// of a map tile wide.
+func (tl *Timeline) ClusterPoints(ctx context.Context, q GeoQuery) ([]GeoCluster, error) {
+	where, args, err := q.where(q.boundsOrWorld())
+	if err != nil {
+		return nil, err
+	}
+	cellSize := geoTileDegrees(q.Zoom) / geoClusterCellsPerTile
+	args = append(args, cellSize, cellSize)
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT count(),
+			avg(items.latitude), avg(items.longitude),
+			min(items.latitude), max(items.latitude),
+			min(items.longitude), max(items.longitude),
+			min(items.id) `+geoFrom+where+`
+		GROUP BY CAST((items.longitude+180)/? AS INTEGER), CAST((items.latitude+90)/? AS INTEGER)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying clusters: %w", err)
+	}
+	defer rows.Close()
+
+	clusters := make([]GeoCluster, 0)
+	for rows.Next() {
+		var c GeoCluster
+		err := rows.Scan(&c.Count, &c.Latitude, &c.Longitude,
+			&c.Bounds.MinLatitude, &c.Bounds.MaxLatitude,
+			&c.Bounds.MinLongitude, &c.Bounds.MaxLongitude,
+			&c.ItemID)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating clusters: %w", err)
+	}
+
+	return clusters, nil
+}
+
+// SimplifiedPaths returns the paths formed by the locations of the items
+// in the bounds of the query, which are simplified with the Douglas-Peucker
+// algorithm to the precision of about a pixel at the zoom level. A path is
+// the locations from the same data source ordered by time; it is broken
+// where the time between two locations is longer than an hour.
+func (tl *Timeline) SimplifiedPaths(ctx context.Context, q GeoQuery) ([]GeoPath, error) {
+	where, args, err := q.where(q.boundsOrWorld())
+	if err != nil {
+		return nil, err
+	}
+	tolerance := geoTileDegrees(q.Zoom) / geoTilePixels
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT items.latitude, items.longitude, items.timestamp, data_sources.name `+
+		geoFrom+where+` AND items.timestamp IS NOT NULL
+		ORDER BY items.data_source_id, items.timestamp`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying paths: %w", err)
+	}
+	defer rows.Close()
+
+	paths := make([]GeoPath, 0)
+	var current GeoPath
+	var prevTimestamp int64
+	finish := func() {
+		if current.Count > 0 {
+			current.Coordinates = simplifyPath(current.Coordinates, tolerance)
+			paths = append(paths, current)
+		}
+	}
+	for rows.Next() {
+		var lat, lon float64
+		var ts int64
+		var dsName *string
+		if err := rows.Scan(&lat, &lon, &ts, &dsName); err != nil {
+			return nil, err
+		}
+		var ds string
+		if dsName != nil {
+			ds = *dsName
+		}
+		if current.Count == 0 || ds != current.DataSource || ts-prevTimestamp > geoPathMaxGap.Milliseconds() {
+			finish()
+			current = GeoPath{DataSource: ds, Start: time.UnixMilli(ts)}
+		}
+		current.Coordinates = append(current.Coordinates, [2]float64{lon, lat})
+		current.End = time.UnixMilli(ts)
+		current.Count++
+		prevTimestamp = ts
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating path locations: %w", err)
+	}
+	finish()
+
+	return paths, nil
+}
+
+func (tl *Timeline) queryGeoPoints(ctx context.Context, q string, args []any) ([]GeoPoint, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying locations: %w", err)
+	}
+	defer rows.Close()
+
+	points := make([]GeoPoint, 0)
+	for rows.Next() {
+		var p GeoPoint
+		var ts *int64
+		if err := rows.Scan(&p.ItemID, &p.Latitude, &p.Longitude, &ts); err != nil {
+			return nil, err
+		}
+		if ts != nil {
+			t := time.UnixMilli(*ts)
+			p.Timestamp = &t
+		}
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating locations: %w", err)
+	}
+
+	return points, nil
+}
+
+// geoFrom is the FROM clause of location queries, which find the
+// items through the spatial index.
+const geoFrom = `FROM items_rtree
+		JOIN items ON items.id = items_rtree.id
+		LEFT JOIN data_sources ON data_sources.id = items.data_source_id`
+
+// where returns the WHERE clause and its arguments that filter the
+// locations of items to the bounds and the other filters of q.
+func (q GeoQuery) where(bounds GeoBounds) (string, []any, error) {
+	if err := bounds.validate(); err != nil {
+		return "", nil, err
+	}
+
+	// the spatial index stores 32-bit floats, which are rounded outward,
+	// so it finds the candidates, and the actual coordinates are checked
+	clauses := []string{
+		"items_rtree.max_lat >= ? AND items_rtree.min_lat <= ?",
+		"items_rtree.max_lon >= ? AND items_rtree.min_lon <= ?",
+		"items.latitude BETWEEN ? AND ?",
+		"items.longitude BETWEEN ? AND ?",
+		"items.deleted IS NULL",
+		"items.hidden IS NULL",
+	}
+	args := []any{
+		bounds.MinLatitude, bounds.MaxLatitude,
+		bounds.MinLongitude, bounds.MaxLongitude,
+		bounds.MinLatitude, bounds.MaxLatitude,
+		bounds.MinLongitude, bounds.MaxLongitude,
+	}
+
+	if q.StartTimestamp != nil {
+		clauses = append(clauses, "items.timestamp >= ?")
+		args = append(args, q.StartTimestamp.UnixMilli())
+	}
+	if q.EndTimestamp != nil {
+		clauses = append(clauses, "items.timestamp <= ?")
+		args = append(args, q.EndTimestamp.UnixMilli())
+	}
+	if len(q.DataSourceName) > 0 {
+		clauses = append(clauses, "data_sources.name IN "+sqlPlaceholders(len(q.DataSourceName)))
+		for _, name := range q.DataSourceName {
+			args = append(args, name)
+		}
+	}
+
+	return "\n\t\tWHERE " + strings.Join(clauses, " AND "), args, nil
+}
+
+func (q GeoQuery) boundsOrWorld() GeoBounds {
+	if q.Bounds != nil {
+		return *q.Bounds
+	}
+	return GeoBounds{MinLatitude: -90, MaxLatitude: 90, MinLongitude: -180, MaxLongitude: 180}
+}
+
+// geoTileDegrees returns the width in degrees of longitude of a map tile at the zoom level.
+func geoTileDegrees(zoom int) float64 {
+	return 360 / math.Exp2(float64(min(max(zoom, 0), geoMaxZoom)))
+}
+
+// simplifyPath simplifies the path using the Douglas-Peucker algorithm,
+// keeping only the points that deviate from the simplified path by more
+// than the tolerance. Distances are computed as if the coordinates were
+// on a plane, which is how they are drawn on the map.
+func simplifyPath(points [][2]float64, tolerance float64) [][2]float64 {
+	if len(points) < 3 { //nolint:mnd
+		return points
+	}
+
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	// use a stack instead of recursion, since paths can be very long
+	type span struct{ first, last int }
+	stack := []span{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		farthest, farthestDist := -1, tolerance
+		for i := s.first + 1; i < s.last; i++ {
+			if d := distanceToSegment(points[i], points[s.first], points[s.last]); d > farthestDist {
+				farthest, farthestDist = i, d
+			}
+		}
+		if farthest >= 0 {
+			keep[farthest] = true
+			stack = append(stack, span{s.first, farthest}, span{farthest, s.last})
+		}
+	}
+
+	simplified := make([][2]float64, 0, len(points))
+	for i, p := range points {
+		if keep[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+}
+
+// distanceToSegment returns the distance from p to the line segment from a to b.
+func distanceToSegment(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	if dx == 0 && dy == 0 {
+		return math.Hypot(p[0]-a[0], p[1]-a[1])
+	}
+	t := ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / (dx*dx + dy*dy)
+	t = min(max(t, 0), 1)
+	return math.Hypot(p[0]-(a[0]+t*dx), p[1]-(a[1]+t*dy))
+}
+
+const (
+	metersPerDegreeLatitude = 111_320.0
+
+	geoMaxZoom             = 22
+	geoTilePixels          = 256
+	geoClusterCellsPerTile = 4
+
+	// paths are broken where there's no location for this long
+	geoPathMaxGap = time.Hour
+)
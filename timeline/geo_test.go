@@ -0,0 +1,156 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGeoQueries(t *testing.T) {
+	ctx := context.Background()
+	db, err := openAndProvisionDB(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tl := &Timeline{db: db}
+
+	// a walk north along a street, a point across town, and one with no location;
+	// the walk has a gap of more than an hour, so it's two paths
+	_, err = db.ExecContext(ctx, `INSERT INTO items (id, timestamp, latitude, longitude) VALUES
+		(1, 0,       40.0000, -105.0000),
+		(2, 60000,   40.0010, -105.0000),
+		(3, 120000,  40.0020, -105.0001),
+		(4, 180000,  40.0030, -105.0000),
+		(5, 9000000, 40.0040, -105.0000),
+		(6, 0,       40.0500, -105.1000),
+		(7, 0,       NULL, NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(points []GeoPoint) []uint64 {
+		var ids []uint64
+		for _, p := range points {
+			ids = append(ids, p.ItemID)
+		}
+		return ids
+	}
+	expectIDs := func(what string, actual []uint64, expected ...uint64) {
+		t.Helper()
+		if len(actual) != len(expected) {
+			t.Errorf("%s: expected items %v, got %v", what, expected, actual)
+			return
+		}
+		for i := range actual {
+			if actual[i] != expected[i] {
+				t.Errorf("%s: expected items %v, got %v", what, expected, actual)
+				return
+			}
+		}
+	}
+
+	points, err := tl.ItemsInBoundingBox(ctx, GeoQuery{Bounds: &GeoBounds{
+		MinLatitude: 40.0005, MaxLatitude: 40.0030, MinLongitude: -105.01, MaxLongitude: -104.99,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs("bounding box", ids(points), 2, 3, 4)
+
+	// moving an item moves it in the index
+	if _, err := db.ExecContext(ctx, `UPDATE items SET latitude=40.0025 WHERE id=6`); err != nil {
+		t.Fatal(err)
+	}
+	points, err = tl.ItemsInBoundingBox(ctx, GeoQuery{Bounds: &GeoBounds{
+		MinLatitude: 40.0005, MaxLatitude: 40.0030, MinLongitude: -106, MaxLongitude: -104,
+	}, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs("moved item with limit", ids(points), 6, 2)
+	if _, err := db.ExecContext(ctx, `UPDATE items SET latitude=40.0500 WHERE id=6`); err != nil {
+		t.Fatal(err)
+	}
+
+	lat, lon := 40.0, -105.0
+	points, err = tl.ItemsNearPoint(ctx, GeoQuery{Latitude: &lat, Longitude: &lon, RadiusMeters: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIDs("nearby", ids(points), 1, 2, 3)
+	if points[1].Distance < 100 || points[1].Distance > 120 {
+		t.Errorf("expected item 2 to be about 111 meters away, got %f", points[1].Distance)
+	}
+
+	// zoomed out, the walk is one cluster; zoomed in, it's several
+	clusters, err := tl.ClusterPoints(ctx, GeoQuery{Zoom: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got %+v", clusters)
+	}
+	var total int
+	for _, c := range clusters {
+		total += c.Count
+	}
+	if total != 6 {
+		t.Errorf("expected 6 points in clusters, got %d", total)
+	}
+	clusters, err = tl.ClusterPoints(ctx, GeoQuery{Zoom: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 6 {
+		t.Errorf("expected 6 clusters when zoomed in, got %d", len(clusters))
+	}
+
+	paths, err := tl.SimplifiedPaths(ctx, GeoQuery{Bounds: &GeoBounds{
+		MinLatitude: 39.9, MaxLatitude: 40.01, MinLongitude: -105.01, MaxLongitude: -104.99,
+	}, Zoom: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("expected 2 paths, got %+v", paths)
+	}
+	if paths[0].Count != 4 || len(paths[0].Coordinates) != 2 {
+		t.Errorf("expected first path of 4 locations to be simplified to 2, got %d: %v", paths[0].Count, paths[0].Coordinates)
+	}
+
+	if _, err := tl.ItemsInBoundingBox(ctx, GeoQuery{Bounds: &GeoBounds{MinLongitude: 170, MaxLongitude: -170}}); err == nil {
+		t.Error("expected error for bounds crossing the antimeridian")
+	}
+}
+
+func TestSimplifyPath(t *testing.T) {
+	path := [][2]float64{{0, 0}, {1, 0.1}, {2, -0.1}, {3, 5}, {4, 6}, {5, 7}}
+	simplified := simplifyPath(path, 0.5)
+	expected := [][2]float64{{0, 0}, {2, -0.1}, {3, 5}, {5, 7}}
+	if len(simplified) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, simplified)
+	}
+	for i := range expected {
+		if simplified[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, simplified)
+		}
+	}
+}
@@ -716,6 +716,7 @@ var (
 	RelInCollection = Relation{Label: "in_collection", Directed: true}                   // "<from_item> is in collection <to_item> at position <value>"
 	RelEdit         = Relation{Label: "edit", Directed: true}                            // "<to_item> is edit of <from_item>"
 	RelIncludes     = Relation{Label: "includes", Directed: true}                        // "<from_item> includes <to_entity>" (has, depicts, portrays, contains... doesn't have to be item->entity either)
+	RelAttendee     = Relation{Label: "attendee", Directed: true}                        // "<from_item> is attended by <to_person>, who responded <value>"
 	// RelAt           = Relation{Label: "at", Directed: true}                              // "<from_item> is at <to_entity>" (to indicate something at a particular place, for instance)
 	// RelTranscript = Relation{Label: "transcript", Directed: true, Subordinating: true} // "<from_item> is transcribed by <to_item>"
 )
@@ -0,0 +1,668 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Items and entities form a graph: its nodes are the items and entities,
+// and its edges are their relationships, plus the ownership of items by
+// entities. The relationships of attributes are relationships of their
+// entities here, since attributes are mostly an implementation detail of
+// entities. The queries in this file traverse the graph, with limits so
+// that even the well-connected nodes (like the timeline owner, who owns
+// most items) can be rendered in an interactive view.
+
+// RelationOwner is the relation of items to the entities that own them in
+// the graph. Unlike other relations, it is not stored as relationships;
+// it's the owner (attribute) of the item: "<from_item> is owned by <to_entity>".
+const RelationOwner = "owner"
+
+// NodeRef refers to a node of the graph: an item or an entity. Exactly
+// one of the IDs must be set.
+type NodeRef struct {
+	ItemID   uint64 `json:"item_id,omitempty"`
+	EntityID uint64 `json:"entity_id,omitempty"`
+}
+
+func (n NodeRef) validate() error {
+	if (n.ItemID == 0) == (n.EntityID == 0) {
+		return errors.New("exactly one of item ID or entity ID is required")
+	}
+	return nil
+}
+
+func (n NodeRef) isZero() bool { return n == NodeRef{} }
+
+// GraphNode is an item or entity in the results of a graph query, with
+// enough information to render it.
+type GraphNode struct {
+	NodeRef
+
+	// How many edges away the node is from where the query started.
+	Depth int `json:"depth"`
+
+	// The entity's name, or a snippet of the item's text or its filename.
+	Name string `json:"name,omitempty"`
+
+	// For entities
+	EntityType  string `json:"entity_type,omitempty"`
+	PictureFile string `json:"picture_file,omitempty"`
+
+	// For items
+	Classification string     `json:"classification,omitempty"`
+	Timestamp      *time.Time `json:"timestamp,omitempty"`
+	DataType       string     `json:"data_type,omitempty"`
+}
+
+// GraphEdge is a relationship between two nodes of the graph.
+type GraphEdge struct {
+	RelationshipID uint64  `json:"relationship_id,omitempty"` // not set for RelationOwner
+	From           NodeRef `json:"from"`
+	To             NodeRef `json:"to"`
+	Relation       string  `json:"relation"`
+	Directed       bool    `json:"directed"`
+	Value          any     `json:"value,omitempty"`
+}
+
+// other returns the node at the other end of the edge from n.
+func (e GraphEdge) other(n NodeRef) NodeRef {
+	if e.From == n {
+		return e.To
+	}
+	return e.From
+}
+
+// GraphQuery has the options of graph queries.
+type GraphQuery struct {
+	// Only follow these relations (labels, such as "sent" or RelationOwner);
+	// all of them if empty.
+	Relations []string `json:"relations,omitempty"`
+
+	// Only include items with timestamps in this timeframe; if it's set,
+	// items without a timestamp are left out.
+	Timeframe Timeframe `json:"timeframe,omitempty"`
+
+	// For paging through the results; Limit is 100 by default, and at
+	// most 1000. Not used by ShortestPath.
+	Limit  int `json:"limit,omitempty"`
+	Offset int `json:"offset,omitempty"`
+}
+
+func (q GraphQuery) limit() int {
+	const defaultLimit, maxLimit = 100, 1000
+	switch {
+	case q.Limit <= 0:
+		return defaultLimit
+	case q.Limit > maxLimit:
+		return maxLimit
+	}
+	return q.Limit
+}
+
+// GraphResults is a page of nodes of the graph, and the edges between
+// them (and the nodes of previous pages).
+type GraphResults struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+	More  bool        `json:"more"` // true if there is another page
+}
+
+const (
+	// maxGraphDepth is how many edges away from where it starts a
+	// traversal of the graph may go.
+	maxGraphDepth = 6
+
+	// maxGraphFanout is how many edges of each node are followed by a
+	// traversal; the rest aren't, so that the timeline owner, say, doesn't
+	// bring in every item they own. Items are followed newest-first.
+	maxGraphFanout = 500
+
+	// maxPathNodes is how many nodes a search for a path visits before
+	// giving up.
+	maxPathNodes = 20000
+)
+
+// Neighbors returns the nodes within depth edges of the node (1 if depth
+// is not positive), breadth-first, starting with the node itself.
+func (tl *Timeline) Neighbors(ctx context.Context, node NodeRef, depth int, q GraphQuery) (GraphResults, error) {
+	if err := node.validate(); err != nil {
+		return GraphResults{}, err
+	}
+	if depth <= 0 {
+		depth = 1
+	}
+	if depth > maxGraphDepth {
+		return GraphResults{}, fmt.Errorf("depth must be at most %d", maxGraphDepth)
+	}
+	if q.Offset < 0 {
+		return GraphResults{}, errors.New("offset must not be negative")
+	}
+	limit := q.limit()
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	tx, err := tl.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return GraphResults{}, err
+	}
+	defer tx.Rollback()
+
+	// traverse until there are enough nodes for this page and to know if
+	// there's another; the order is stable, so pages don't overlap
+	want := q.Offset + limit + 1
+	depths := map[NodeRef]int{node: 0}
+	order := []NodeRef{node}
+	var edges []GraphEdge
+	seenEdges := make(map[GraphEdge]struct{})
+	frontier := []NodeRef{node}
+	for d := 1; d <= depth && len(frontier) > 0 && len(order) < want; d++ {
+		var next []NodeRef
+		for _, n := range frontier {
+			nodeEdges, err := tl.graphEdges(ctx, tx, n, q)
+			if err != nil {
+				return GraphResults{}, err
+			}
+			for _, e := range nodeEdges {
+				other := e.other(n)
+				if _, ok := depths[other]; !ok {
+					if len(order) >= want {
+						continue
+					}
+					depths[other] = d
+					order = append(order, other)
+					next = append(next, other)
+				}
+				key := e
+				key.Value = nil // values aren't always comparable
+				if _, ok := seenEdges[key]; !ok {
+					seenEdges[key] = struct{}{}
+					edges = append(edges, e)
+				}
+			}
+			if len(order) >= want {
+				break
+			}
+		}
+		frontier = next
+	}
+
+	var results GraphResults
+	if q.Offset >= len(order) {
+		return results, nil
+	}
+	end := min(q.Offset+limit, len(order))
+	results.More = len(order) > end
+	page := order[q.Offset:end]
+
+	// only the nodes up to the end of this page exist as far as the
+	// client knows, and each edge must touch this page
+	known := make(map[NodeRef]bool, end)
+	for i, n := range order[:end] {
+		known[n] = i >= q.Offset
+	}
+	for _, e := range edges {
+		fromOnPage, fromKnown := known[e.From]
+		toOnPage, toKnown := known[e.To]
+		if fromKnown && toKnown && (fromOnPage || toOnPage) {
+			results.Edges = append(results.Edges, e)
+		}
+	}
+
+	results.Nodes, err = tl.loadGraphNodes(ctx, tx, page, depths)
+	if err != nil {
+		return GraphResults{}, err
+	}
+	return results, nil
+}
+
+// ShortestPath returns the nodes and edges of a shortest path from one
+// entity to the other, of at most maxDepth edges (or the maximum of 6, if
+// maxDepth is not positive). If there is no such path, no nodes are
+// returned. Only q.Relations and q.Timeframe are used.
+func (tl *Timeline) ShortestPath(ctx context.Context, fromEntityID, toEntityID uint64, maxDepth int, q GraphQuery) (GraphResults, error) {
+	if fromEntityID == 0 || toEntityID == 0 {
+		return GraphResults{}, errors.New("both entity IDs are required")
+	}
+	if maxDepth <= 0 || maxDepth > maxGraphDepth {
+		maxDepth = maxGraphDepth
+	}
+	start, goal := NodeRef{EntityID: fromEntityID}, NodeRef{EntityID: toEntityID}
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	tx, err := tl.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return GraphResults{}, err
+	}
+	defer tx.Rollback()
+
+	// the edge by which each node was reached
+	via := map[NodeRef]GraphEdge{start: {}}
+	frontier := []NodeRef{start}
+	found := start == goal
+	for d := 1; d <= maxDepth && len(frontier) > 0 && !found && len(via) < maxPathNodes; d++ {
+		var next []NodeRef
+	frontierLoop:
+		for _, n := range frontier {
+			nodeEdges, err := tl.graphEdges(ctx, tx, n, q)
+			if err != nil {
+				return GraphResults{}, err
+			}
+			for _, e := range nodeEdges {
+				other := e.other(n)
+				if _, ok := via[other]; ok {
+					continue
+				}
+				via[other] = e
+				if other == goal {
+					found = true
+					break frontierLoop
+				}
+				next = append(next, other)
+			}
+		}
+		frontier = next
+	}
+
+	var results GraphResults
+	if !found {
+		return results, nil
+	}
+
+	// walk back from the goal
+	path := []NodeRef{goal}
+	for n := goal; n != start; {
+		e := via[n]
+		results.Edges = append(results.Edges, e)
+		n = e.other(n)
+		path = append(path, n)
+	}
+	slices.Reverse(path)
+	slices.Reverse(results.Edges)
+
+	depths := make(map[NodeRef]int, len(path))
+	for i, n := range path {
+		depths[n] = i
+	}
+	results.Nodes, err = tl.loadGraphNodes(ctx, tx, path, depths)
+	if err != nil {
+		return GraphResults{}, err
+	}
+	return results, nil
+}
+
+// CoOccurrence is how often two entities appear together in items, as in,
+// are related to the same items (for example, the sender and recipient of
+// a message, or two people in a photo).
+type CoOccurrence struct {
+	Entities [2]GraphNode `json:"entities"`
+	Items    int          `json:"items"`
+	First    *time.Time   `json:"first,omitempty"`
+	Last     *time.Time   `json:"last,omitempty"`
+}
+
+// CoOccurrences returns the pairs of entities that appear together in the
+// most items, or if entityID is set, the entities that appear with it the
+// most (it's always the first of the pair, then). Items are the ones with
+// which entities have relationships, or that they own.
+func (tl *Timeline) CoOccurrences(ctx context.Context, entityID uint64, q GraphQuery) ([]CoOccurrence, error) {
+	if q.Offset < 0 {
+		return nil, errors.New("offset must not be negative")
+	}
+
+	itemFilter, itemArgs := q.itemFilter("items")
+	relFilter, relArgs := q.relationFilter()
+
+	// the entities of each item, by the ways they can be related to it
+	var parts []string
+	var args []any
+	if q.follows(RelationOwner) {
+		parts = append(parts, `
+			SELECT items.id AS item_id, entity_attributes.entity_id, items.timestamp
+			FROM items
+			JOIN entity_attributes ON entity_attributes.attribute_id = items.attribute_id
+			WHERE `+itemFilter)
+		args = append(args, itemArgs...)
+	}
+	for _, ends := range [][2]string{{"from_item_id", "to_attribute_id"}, {"to_item_id", "from_attribute_id"}} {
+		parts = append(parts, `
+			SELECT items.id, entity_attributes.entity_id, items.timestamp
+			FROM relationships
+			JOIN relations ON relations.id = relationships.relation_id
+			JOIN items ON items.id = relationships.`+ends[0]+`
+			JOIN entity_attributes ON entity_attributes.attribute_id = relationships.`+ends[1]+`
+			WHERE `+itemFilter+relFilter)
+		args = append(args, itemArgs...)
+		args = append(args, relArgs...)
+	}
+
+	pairFilter := "a.entity_id < b.entity_id"
+	if entityID != 0 {
+		pairFilter = "a.entity_id=? AND b.entity_id != a.entity_id"
+		args = append(args, entityID)
+	}
+	args = append(args, q.limit(), q.Offset)
+
+	// entities might be related to the same item more than once
+	query := `
+		WITH item_entities AS (` + strings.Join(parts, " UNION ") + `)
+		SELECT a.entity_id, b.entity_id, count(DISTINCT a.item_id), min(a.timestamp), max(a.timestamp)
+		FROM item_entities AS a
+		JOIN item_entities AS b ON b.item_id = a.item_id
+		WHERE ` + pairFilter + `
+		GROUP BY a.entity_id, b.entity_id
+		ORDER BY count(DISTINCT a.item_id) DESC, a.entity_id, b.entity_id
+		LIMIT ? OFFSET ?`
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	tx, err := tl.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying co-occurrences: %w", err)
+	}
+	defer rows.Close()
+
+	var results []CoOccurrence
+	var entities []NodeRef
+	for rows.Next() {
+		var a, b uint64
+		var first, last *int64
+		var co CoOccurrence
+		if err := rows.Scan(&a, &b, &co.Items, &first, &last); err != nil {
+			return nil, fmt.Errorf("scanning co-occurrence: %w", err)
+		}
+		co.Entities[0].EntityID, co.Entities[1].EntityID = a, b
+		co.First, co.Last = unixMilliPtr(first), unixMilliPtr(last)
+		results = append(results, co)
+		entities = append(entities, NodeRef{EntityID: a}, NodeRef{EntityID: b})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating co-occurrences: %w", err)
+	}
+	rows.Close()
+
+	nodes, err := tl.loadGraphNodes(ctx, tx, entities, nil)
+	if err != nil {
+		return nil, err
+	}
+	byRef := make(map[NodeRef]GraphNode, len(nodes))
+	for _, n := range nodes {
+		byRef[n.NodeRef] = n
+	}
+	for i := range results {
+		for j := range results[i].Entities {
+			if n, ok := byRef[results[i].Entities[j].NodeRef]; ok {
+				results[i].Entities[j] = n
+			}
+		}
+	}
+	return results, nil
+}
+
+// graphEdges returns the edges of the node that q follows, up to
+// maxGraphFanout of each kind (relationships and ownership).
+func (tl *Timeline) graphEdges(ctx context.Context, tx *sql.Tx, node NodeRef, q GraphQuery) ([]GraphEdge, error) {
+	var edges []GraphEdge
+
+	// items at either end must be in the timeframe, if any
+	fromItemFilter, fromItemArgs := q.itemFilter("from_items")
+	toItemFilter, toItemArgs := q.itemFilter("to_items")
+	relFilter, relArgs := q.relationFilter()
+
+	var where string
+	var args []any
+	if node.ItemID != 0 {
+		where = "(relationships.from_item_id=? OR relationships.to_item_id=?)"
+		args = append(args, node.ItemID, node.ItemID)
+	} else {
+		where = `(relationships.from_attribute_id IN (SELECT attribute_id FROM entity_attributes WHERE entity_id=?)
+			OR relationships.to_attribute_id IN (SELECT attribute_id FROM entity_attributes WHERE entity_id=?))`
+		args = append(args, node.EntityID, node.EntityID)
+	}
+	args = append(args, fromItemArgs...)
+	args = append(args, toItemArgs...)
+	args = append(args, relArgs...)
+	args = append(args, maxGraphFanout)
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT relationships.id, relations.label, relations.directed, relationships.value,
+			relationships.from_item_id, from_ea.entity_id, relationships.to_item_id, to_ea.entity_id
+		FROM relationships
+		JOIN relations ON relations.id = relationships.relation_id
+		LEFT JOIN items AS from_items ON from_items.id = relationships.from_item_id
+		LEFT JOIN items AS to_items ON to_items.id = relationships.to_item_id
+		LEFT JOIN entity_attributes AS from_ea ON from_ea.attribute_id = relationships.from_attribute_id
+		LEFT JOIN entity_attributes AS to_ea ON to_ea.attribute_id = relationships.to_attribute_id
+		WHERE `+where+`
+			AND (relationships.from_item_id IS NULL OR `+fromItemFilter+`)
+			AND (relationships.to_item_id IS NULL OR `+toItemFilter+`)`+relFilter+`
+		ORDER BY relationships.id
+		LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying relationships of node: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e GraphEdge
+		var fromItem, fromEntity, toItem, toEntity *uint64
+		if err := rows.Scan(&e.RelationshipID, &e.Relation, &e.Directed, &e.Value, &fromItem, &fromEntity, &toItem, &toEntity); err != nil {
+			return nil, fmt.Errorf("scanning relationship: %w", err)
+		}
+		e.From = NodeRef{ItemID: deref(fromItem), EntityID: deref(fromEntity)}
+		e.To = NodeRef{ItemID: deref(toItem), EntityID: deref(toEntity)}
+
+		// an attribute that isn't linked to an entity leads nowhere, and an
+		// entity may be related to itself through two of its attributes
+		if e.From.isZero() || e.To.isZero() || e.From == e.To {
+			continue
+		}
+		edges = append(edges, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating relationships: %w", err)
+	}
+	rows.Close()
+
+	if !q.follows(RelationOwner) {
+		return edges, nil
+	}
+
+	itemFilter, itemArgs := q.itemFilter("items")
+	var ownerQuery string
+	if node.ItemID != 0 {
+		ownerQuery = `
+			SELECT items.id, entity_attributes.entity_id
+			FROM items
+			JOIN entity_attributes ON entity_attributes.attribute_id = items.attribute_id
+			WHERE items.id=? AND ` + itemFilter + `
+			ORDER BY entity_attributes.entity_id
+			LIMIT ?`
+		args = []any{node.ItemID}
+	} else {
+		ownerQuery = `
+			SELECT items.id, entity_attributes.entity_id
+			FROM entity_attributes
+			JOIN items ON items.attribute_id = entity_attributes.attribute_id
+			WHERE entity_attributes.entity_id=? AND ` + itemFilter + `
+			ORDER BY items.timestamp DESC, items.id
+			LIMIT ?`
+		args = []any{node.EntityID}
+	}
+	args = append(args, itemArgs...)
+	args = append(args, maxGraphFanout)
+
+	rows, err = tx.QueryContext(ctx, ownerQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying owners of node: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemID, entityID uint64
+		if err := rows.Scan(&itemID, &entityID); err != nil {
+			return nil, fmt.Errorf("scanning owner: %w", err)
+		}
+		edges = append(edges, GraphEdge{
+			From:     NodeRef{ItemID: itemID},
+			To:       NodeRef{EntityID: entityID},
+			Relation: RelationOwner,
+			Directed: true,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating owners: %w", err)
+	}
+	return edges, nil
+}
+
+// follows returns true if q follows the relation.
+func (q GraphQuery) follows(relation string) bool {
+	return len(q.Relations) == 0 || slices.Contains(q.Relations, relation)
+}
+
+// relationFilter returns the SQL condition (with a leading AND) that
+// limits relationships to the relations of q, if any.
+func (q GraphQuery) relationFilter() (string, []any) {
+	if len(q.Relations) == 0 {
+		return "", nil
+	}
+	args := make([]any, 0, len(q.Relations))
+	for _, rel := range q.Relations {
+		args = append(args, rel)
+	}
+	return " AND relations.label IN " + sqlPlaceholders(len(q.Relations)), args
+}
+
+// itemFilter returns the SQL condition that the items of the table (or its
+// alias) are not deleted, and are in the timeframe of q, if any.
+func (q GraphQuery) itemFilter(table string) (string, []any) {
+	var sb strings.Builder
+	var args []any
+	sb.WriteString("(" + table + ".deleted IS NULL")
+	if q.Timeframe.Since != nil {
+		sb.WriteString(" AND " + table + ".timestamp >= ?")
+		args = append(args, q.Timeframe.Since.UnixMilli())
+	}
+	if q.Timeframe.Until != nil {
+		sb.WriteString(" AND " + table + ".timestamp < ?")
+		args = append(args, q.Timeframe.Until.UnixMilli())
+	}
+	sb.WriteString(")")
+	return sb.String(), args
+}
+
+// loadGraphNodes returns the nodes with the information to render them, in
+// the same order, with their depths. Nodes that don't exist (or entities
+// that were deleted) are left out.
+func (tl *Timeline) loadGraphNodes(ctx context.Context, tx *sql.Tx, refs []NodeRef, depths map[NodeRef]int) ([]GraphNode, error) {
+	var itemIDs, entityIDs []any
+	for _, ref := range refs {
+		if ref.ItemID != 0 {
+			itemIDs = append(itemIDs, ref.ItemID)
+		} else {
+			entityIDs = append(entityIDs, ref.EntityID)
+		}
+	}
+
+	const maxSnippetLength = 100
+	loaded := make(map[NodeRef]GraphNode, len(refs))
+
+	if len(itemIDs) > 0 {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT items.id, coalesce(classifications.name, ''), items.timestamp, coalesce(items.data_type, ''),
+				coalesce(substr(items.data_text, 1, ?), items.filename, '')
+			FROM items
+			LEFT JOIN classifications ON classifications.id = items.classification_id
+			WHERE items.id IN `+sqlPlaceholders(len(itemIDs)), append([]any{maxSnippetLength}, itemIDs...)...)
+		if err != nil {
+			return nil, fmt.Errorf("loading items of graph: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var n GraphNode
+			var ts *int64
+			if err := rows.Scan(&n.ItemID, &n.Classification, &ts, &n.DataType, &n.Name); err != nil {
+				return nil, fmt.Errorf("scanning item of graph: %w", err)
+			}
+			n.Timestamp = unixMilliPtr(ts)
+			loaded[n.NodeRef] = n
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		rows.Close()
+	}
+
+	if len(entityIDs) > 0 {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT entities.id, coalesce(entities.name, ''), entity_types.name, coalesce(entities.picture_file, '')
+			FROM entities
+			JOIN entity_types ON entity_types.id = entities.type_id
+			WHERE entities.deleted IS NULL AND entities.id IN `+sqlPlaceholders(len(entityIDs)), entityIDs...)
+		if err != nil {
+			return nil, fmt.Errorf("loading entities of graph: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var n GraphNode
+			if err := rows.Scan(&n.EntityID, &n.Name, &n.EntityType, &n.PictureFile); err != nil {
+				return nil, fmt.Errorf("scanning entity of graph: %w", err)
+			}
+			loaded[n.NodeRef] = n
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	nodes := make([]GraphNode, 0, len(refs))
+	for _, ref := range refs {
+		if n, ok := loaded[ref]; ok {
+			n.Depth = depths[ref]
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+func unixMilliPtr(ms *int64) *time.Time {
+	if ms == nil {
+		return nil
+	}
+	t := time.UnixMilli(*ms)
+	return &t
+}
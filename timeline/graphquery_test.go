@@ -0,0 +1,126 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGraphQueries(t *testing.T) {
+	ctx := context.Background()
+	tl := newTestTimeline(t)
+
+	// Alice texted Bob twice in 2019, and Bob texted Carol in 2021; Dave
+	// has a photo and nothing to do with anyone
+	mustExec(t, tl, `
+		INSERT INTO attributes (id, name, value) VALUES
+			(1, 'phone_number', '+15550001'), (2, 'phone_number', '+15550002'),
+			(3, 'phone_number', '+15550003'), (4, 'phone_number', '+15550004');
+		INSERT INTO entities (id, type_id, name) VALUES
+			(1, (SELECT id FROM entity_types WHERE name='person'), 'Alice'),
+			(2, (SELECT id FROM entity_types WHERE name='person'), 'Bob'),
+			(3, (SELECT id FROM entity_types WHERE name='person'), 'Carol'),
+			(4, (SELECT id FROM entity_types WHERE name='person'), 'Dave');
+		INSERT INTO entity_attributes (entity_id, attribute_id, data_source_id) VALUES (1, 1, 1), (2, 2, 1), (3, 3, 1), (4, 4, 1);
+		INSERT INTO items (id, data_source_id, attribute_id, timestamp, data_text) VALUES
+			(1, 1, 1, 1546300800000, 'Hi Bob'),
+			(2, 1, 1, 1561939200000, 'Bye Bob'),
+			(3, 1, 2, 1609459200000, 'Hi Carol'),
+			(4, 1, 4, 1609459200000, NULL);
+		INSERT INTO relations (id, label) VALUES (100, 'test_sent');
+		INSERT INTO relationships (relation_id, from_item_id, to_attribute_id) VALUES (100, 1, 2), (100, 2, 2), (100, 3, 3);`)
+
+	// the first page has Alice and her newest message, then the older one
+	// and Bob, who both messages were sent to
+	alice := NodeRef{EntityID: 1}
+	page1, err := tl.Neighbors(ctx, alice, 2, GraphQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page1.Nodes) != 2 || page1.Nodes[0].NodeRef != alice || page1.Nodes[1].ItemID != 2 || !page1.More {
+		t.Fatalf("expected Alice and her newest message with more to come, got %+v", page1)
+	}
+	if page1.Nodes[0].Name != "Alice" || page1.Nodes[1].Name != "Bye Bob" || page1.Nodes[1].Depth != 1 {
+		t.Errorf("expected nodes to be described, got %+v", page1.Nodes)
+	}
+	if len(page1.Edges) != 1 || page1.Edges[0].Relation != RelationOwner {
+		t.Errorf("expected the ownership edge between the nodes, got %+v", page1.Edges)
+	}
+	page2, err := tl.Neighbors(ctx, alice, 2, GraphQuery{Limit: 2, Offset: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page2.Nodes) != 2 || page2.Nodes[0].ItemID != 1 || page2.Nodes[1].EntityID != 2 || page2.Nodes[1].Depth != 2 || page2.More {
+		t.Fatalf("expected the older message and Bob, and no more, got %+v", page2)
+	}
+	if len(page2.Edges) != 3 {
+		t.Errorf("expected the edges that touch the second page, got %+v", page2.Edges)
+	}
+
+	// only following ownership doesn't get to Bob
+	owned, err := tl.Neighbors(ctx, alice, 2, GraphQuery{Relations: []string{RelationOwner}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned.Nodes) != 3 || owned.More {
+		t.Errorf("expected Alice and her messages only, got %+v", owned.Nodes)
+	}
+
+	path, err := tl.ShortestPath(ctx, 1, 3, 0, GraphQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path.Nodes) != 5 || len(path.Edges) != 4 || path.Nodes[2].EntityID != 2 || path.Nodes[4].EntityID != 3 {
+		t.Errorf("expected a path from Alice to Carol through Bob, got %+v", path)
+	}
+	if path, err := tl.ShortestPath(ctx, 1, 3, 3, GraphQuery{}); err != nil || len(path.Nodes) != 0 {
+		t.Errorf("expected no path of 3 edges, got %+v (error: %v)", path, err)
+	}
+	if path, err := tl.ShortestPath(ctx, 1, 4, 0, GraphQuery{}); err != nil || len(path.Nodes) != 0 {
+		t.Errorf("expected no path to Dave, got %+v (error: %v)", path, err)
+	}
+
+	cos, err := tl.CoOccurrences(ctx, 2, GraphQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cos) != 2 || cos[0].Entities[1].Name != "Alice" || cos[0].Items != 2 || cos[1].Entities[1].Name != "Carol" || cos[1].Items != 1 {
+		t.Fatalf("expected Bob to be with Alice twice and Carol once, got %+v", cos)
+	}
+	if cos[0].First == nil || cos[0].First.Year() != 2019 || cos[0].Last == nil || !cos[0].Last.After(*cos[0].First) {
+		t.Errorf("expected Bob and Alice to be together during 2019, got %v to %v", cos[0].First, cos[0].Last)
+	}
+	since := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	cos, err = tl.CoOccurrences(ctx, 2, GraphQuery{Timeframe: Timeframe{Since: &since}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cos) != 1 || cos[0].Entities[1].EntityID != 3 {
+		t.Errorf("expected only Carol since 2020, got %+v", cos)
+	}
+	all, err := tl.CoOccurrences(ctx, 0, GraphQuery{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Entities[0].EntityID != 1 || all[0].Entities[1].EntityID != 2 {
+		t.Errorf("expected Alice and Bob to be the most frequent pair, got %+v", all)
+	}
+}
@@ -0,0 +1,297 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PreviewReport describes what an import would do, as found by a preview
+// of the import (see ImportJob.Preview). Duplicates are estimated the same
+// way the import looks for existing items before it downloads data files,
+// so items that only match by their data file contents are not counted.
+type PreviewReport struct {
+	Items    int64            `json:"items"`
+	Entities int64            `json:"entities"`                    // entity nodes of the graphs, not item owners
+	ByClass  map[string]int64 `json:"by_classification,omitempty"` // item counts by classification ("" if unclassified)
+
+	// The date range the items cover, and how many items fall in each year.
+	Earliest *time.Time           `json:"earliest,omitempty"`
+	Latest   *time.Time           `json:"latest,omitempty"`
+	ByYear   map[int]int64        `json:"by_year,omitempty"`
+	Undated  int64                `json:"undated"`           // items without a timestamp
+	Outside  int64                `json:"outside_timeframe"` // items that would be skipped for being outside the timeframe
+	Media    map[string]MediaSize `json:"media,omitempty"`   // data files by top-level media type (e.g. "image")
+
+	Duplicates int64 `json:"duplicates"` // items that are already in the timeline
+	Errors     int64 `json:"errors"`     // items that could not be previewed
+
+	// Data sources that were not previewed, since they import from an API.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// MediaSize is a count of files and their total size in bytes.
+type MediaSize struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// importPreview is the state of an import preview.
+type importPreview struct {
+	report    PreviewReport
+	lastFlush time.Time
+}
+
+func newImportPreview() *importPreview {
+	return &importPreview{
+		report: PreviewReport{
+			ByClass: make(map[string]int64),
+			ByYear:  make(map[int]int64),
+			Media:   make(map[string]MediaSize),
+		},
+	}
+}
+
+// previewGraph tallies the nodes of g in the preview report without
+// writing anything. It is only called by the goroutine that receives
+// graphs from the data source, so the report needs no lock.
+func (p *processor) previewGraph(ctx context.Context, g *Graph) {
+	report := &p.ij.preview.report
+
+	// gather the items first, since reading their data may take a while
+	// and shouldn't be done while holding the DB lock
+	var items []*Item
+	visited := make(map[*Graph]struct{})
+	var visit func(*Graph)
+	visit = func(g *Graph) {
+		if g == nil {
+			return
+		}
+		if _, ok := visited[g]; ok {
+			return
+		}
+		visited[g] = struct{}{}
+
+		switch {
+		case g.Entity != nil:
+			report.Entities++
+		case g.Item != nil:
+			ok, err := p.previewItem(ctx, g.Item)
+			if err != nil {
+				p.log.Error("previewing item", zap.String("item_id", g.Item.ID), zap.Error(err))
+				report.Errors++
+			} else if ok {
+				items = append(items, g.Item)
+			}
+		}
+		for _, edge := range g.Edges {
+			visit(edge.From)
+			visit(edge.To)
+		}
+	}
+	visit(g)
+
+	if len(items) == 0 {
+		return
+	}
+
+	var dsName *string
+	if p.ds.Name != "" {
+		dsName = &p.ds.Name
+	}
+
+	// look for existing items in a read-only transaction, which doesn't hold
+	// up other jobs for long (unlike the import, which needs a write lock)
+	p.tl.dbMu.RLock()
+	defer p.tl.dbMu.RUnlock()
+	tx, err := p.tl.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		p.log.Error("beginning transaction for preview", zap.Error(err))
+		report.Errors += int64(len(items))
+		return
+	}
+	defer tx.Rollback()
+
+	for _, it := range items {
+		it.makeIDHash(dsName)
+		it.makeContentHash()
+		ir, err := p.tl.loadItemRow(ctx, tx, 0, it, dsName, p.ij.ProcessingOptions.ItemUniqueConstraints, true)
+		if err != nil {
+			p.log.Error("looking up item in database", zap.String("item_id", it.ID), zap.Error(err))
+			report.Errors++
+			continue
+		}
+		if ir.ID > 0 {
+			report.Duplicates++
+		}
+	}
+}
+
+// previewItem tallies the item in the preview report, and returns true
+// if it would be imported (so it should be checked for duplicates).
+func (p *processor) previewItem(ctx context.Context, it *Item) (bool, error) {
+	report := &p.ij.preview.report
+
+	if !it.Timestamp.IsZero() && !p.ij.ProcessingOptions.Timeframe.Contains(it.Timestamp) {
+		report.Outside++
+		return false, nil
+	}
+
+	fileSize, isFile, err := previewItemData(ctx, it)
+	if err != nil {
+		return false, fmt.Errorf("reading item's data: %w", err)
+	}
+
+	report.Items++
+	report.ByClass[it.Classification.Name]++
+	if it.Timestamp.IsZero() {
+		report.Undated++
+	} else {
+		ts := it.Timestamp
+		if report.Earliest == nil || ts.Before(*report.Earliest) {
+			report.Earliest = &ts
+		}
+		if report.Latest == nil || ts.After(*report.Latest) {
+			report.Latest = &ts
+		}
+		report.ByYear[ts.Year()]++
+	}
+	if isFile {
+		mediaType, _, _ := mime.ParseMediaType(it.Content.MediaType)
+		topLevelType, _, _ := strings.Cut(mediaType, "/")
+		total := report.Media[topLevelType]
+		total.Files++
+		total.Bytes += fileSize
+		report.Media[topLevelType] = total
+	}
+	return true, nil
+}
+
+// previewItemData reads the item's data, if any, the way storeItem does:
+// small text is kept as the item's text (so it can be compared to existing
+// items) and anything else would be a data file, of which the size is
+// returned. Files are read to the end unless their size can be gotten
+// with Stat().
+func previewItemData(ctx context.Context, it *Item) (int64, bool, error) {
+	if it.Content.Data == nil {
+		return 0, false, nil
+	}
+	rc, err := it.Content.Data(ctx)
+	if err != nil || rc == nil {
+		return 0, false, err
+	}
+	defer rc.Close()
+
+	size := int64(-1)
+	if f, ok := rc.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+	}
+
+	r := bufio.NewReader(rc)
+	if it.Content.MediaType == "" {
+		const bytesNeededToSniff = 512
+		peekedBytes, _ := r.Peek(bytesNeededToSniff)
+		detectContentType(peekedBytes, it)
+		inferMediaClassification(it)
+	}
+
+	if it.Content.isPlainTextOrMarkdown() && size < maxTextSizeForDB {
+		text, err := io.ReadAll(io.LimitReader(r, maxTextSizeForDB))
+		if err != nil {
+			return 0, false, err
+		}
+		if len(text) < maxTextSizeForDB {
+			dataText := strings.TrimSpace(string(text))
+			if dataText != "" {
+				it.dataText = &dataText
+			}
+			return 0, false, nil
+		}
+		// too big to go in the database after all
+		n, err := io.Copy(io.Discard, r)
+		return int64(len(text)) + n, true, err
+	}
+
+	if size < 0 {
+		size, err = io.Copy(io.Discard, r)
+	}
+	return size, true, err
+}
+
+// flushPreview emits the preview report with the job's progress, if it has
+// been long enough since the last time or if force is true.
+func (ij *ImportJob) flushPreview(force bool) {
+	if !force && time.Since(ij.preview.lastFlush) < jobFlushInterval {
+		return
+	}
+	ij.preview.lastFlush = time.Now()
+	ij.job.mu.Lock()
+	ij.job.flushProgress(ij.job.statusLog.With(zap.Any("preview", ij.preview.report)))
+	ij.job.mu.Unlock()
+}
+
+// storeImportPreview saves the report of the preview job so it can be
+// retrieved after the job is done.
+func (tl *Timeline) storeImportPreview(ctx context.Context, jobID uint64, report PreviewReport) error {
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("JSON-encoding preview report: %w", err)
+	}
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+	_, err = tl.db.ExecContext(ctx, `INSERT OR REPLACE INTO import_previews (job_id, report) VALUES (?, ?)`, jobID, string(encoded))
+	if err != nil {
+		return fmt.Errorf("storing preview report: %w", err)
+	}
+	return nil
+}
+
+// ImportPreview returns the report of the import job with the given ID,
+// which must have been a preview that is done.
+func (tl *Timeline) ImportPreview(ctx context.Context, jobID uint64) (PreviewReport, error) {
+	tl.dbMu.RLock()
+	var encoded string
+	err := tl.db.QueryRowContext(ctx, `SELECT report FROM import_previews WHERE job_id=?`, jobID).Scan(&encoded)
+	tl.dbMu.RUnlock()
+	if errors.Is(err, sql.ErrNoRows) {
+		return PreviewReport{}, fmt.Errorf("job %d has no preview report; it may not be a finished import preview", jobID)
+	}
+	if err != nil {
+		return PreviewReport{}, fmt.Errorf("loading preview report: %w", err)
+	}
+	var report PreviewReport
+	if err := json.Unmarshal([]byte(encoded), &report); err != nil {
+		return PreviewReport{}, fmt.Errorf("decoding preview report: %w", err)
+	}
+	return report, nil
+}
@@ -0,0 +1,98 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPreviewGraph(t *testing.T) {
+	ctx := context.Background()
+	tl := newTestTimeline(t)
+	mustExec(t, tl, `INSERT INTO items (id, data_source_id, original_id, data_text) VALUES (1, 1, 'msg1', 'hello')`)
+
+	since := time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+	ij := &ImportJob{
+		job:     &ActiveJob{ctx: ctx, tl: tl, logger: zap.NewNop(), statusLog: zap.NewNop()},
+		preview: newImportPreview(),
+		ProcessingOptions: ProcessingOptions{
+			Timeframe:             Timeframe{Since: &since},
+			ItemUniqueConstraints: map[string]bool{"data": true},
+		},
+	}
+	p := &processor{ij: ij, ds: DataSource{Name: "sms"}, tl: tl, log: zap.NewNop()}
+
+	text := func(s string) DataFunc {
+		return func(context.Context) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte(s))), nil
+		}
+	}
+	photo := make([]byte, 1000)
+	copy(photo, "\x89PNG\r\n\x1a\n")
+
+	g := &Graph{Item: &Item{
+		ID:             "msg1",
+		Classification: ClassMessage,
+		Timestamp:      time.Date(2019, time.July, 4, 0, 0, 0, 0, time.UTC),
+		Content:        ItemData{Data: text("hello")},
+	}}
+	g.ToEntity(RelSent, &Entity{Name: "Mom"})
+	g.ToItem(RelAttachment, &Item{
+		ID:        "photo1",
+		Timestamp: time.Date(2020, time.August, 1, 0, 0, 0, 0, time.UTC),
+		Content:   ItemData{Data: text(string(photo))},
+	})
+	p.previewGraph(ctx, g)
+	p.previewGraph(ctx, &Graph{Item: &Item{ID: "note1", Content: ItemData{Data: text("undated")}}})
+	p.previewGraph(ctx, &Graph{Item: &Item{ID: "old", Timestamp: since.Add(-time.Hour)}})
+
+	report := ij.preview.report
+	if report.Items != 3 || report.Entities != 1 {
+		t.Errorf("expected 3 items and 1 entity, got %d and %d", report.Items, report.Entities)
+	}
+	if report.ByClass["message"] != 1 || report.ByClass["media"] != 1 || report.ByClass[""] != 1 {
+		t.Errorf("expected the photo to be classified as media, got %v", report.ByClass)
+	}
+	if report.Undated != 1 || report.Outside != 1 {
+		t.Errorf("expected 1 undated item and 1 outside the timeframe, got %d and %d", report.Undated, report.Outside)
+	}
+	if report.Earliest == nil || report.Earliest.Year() != 2019 || report.Latest == nil || report.Latest.Year() != 2020 {
+		t.Errorf("expected items from 2019 to 2020, got %v to %v", report.Earliest, report.Latest)
+	}
+	if report.ByYear[2019] != 1 || report.ByYear[2020] != 1 {
+		t.Errorf("expected 1 item in each year, got %v", report.ByYear)
+	}
+	if media := report.Media["image"]; media.Files != 1 || media.Bytes != int64(len(photo)) {
+		t.Errorf("expected 1 image of %d bytes, got %+v", len(photo), media)
+	}
+	if report.Duplicates != 1 || report.Errors != 0 {
+		t.Errorf("expected the existing message to be the only duplicate, got %d (errors: %d)", report.Duplicates, report.Errors)
+	}
+
+	var items int
+	if err := tl.db.QueryRow(`SELECT count() FROM items`).Scan(&items); err != nil || items != 1 {
+		t.Errorf("expected nothing to be written, got %d items (error: %v)", items, err)
+	}
+}
@@ -21,6 +21,7 @@ package timeline
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -60,12 +61,26 @@ type importJobCheckpoint struct {
 	DataSourceCheckpoint any `json:"data_source_checkpoint,omitempty"`
 }
 
+// dataSourceCheckpoint returns the data source checkpoint as bytes, for
+// the data source to decode when it resumes, or nil if there is none.
+func (chkpt importJobCheckpoint) dataSourceCheckpoint() (json.RawMessage, error) {
+	if chkpt.DataSourceCheckpoint == nil {
+		return nil, nil
+	}
+	dsCheckpoint, err := json.Marshal(chkpt.DataSourceCheckpoint)
+	if err != nil {
+		return nil, fmt.Errorf("re-encoding data source checkpoint to pass to DS to resume: %w", err)
+	}
+	return dsCheckpoint, nil
+}
+
 type ImportJob struct {
 	// accessed atomically (placed first to align on 64-bit word boundary, for 32-bit systems)
 	// (reset each time the job is started)
 	itemCount, newItemCount, updatedItemCount, skippedItemCount *int64
 	newEntityCount                                              *int64
 	thumbnailCount                                              *int64
+	graphCount, failedGraphCount                                *int64 // root graphs that were processed, and how many of them failed
 
 	job *ActiveJob
 
@@ -73,12 +88,26 @@ type ImportJob struct {
 	p   *processor
 	pMu *sync.Mutex
 
+	// the report being made, if the import is a preview
+	preview *importPreview
+
 	Plan              ImportPlan        `json:"plan,omitempty"`
 	ProcessingOptions ProcessingOptions `json:"processing_options,omitempty"`
 	EstimateTotal     bool              `json:"estimate_total,omitempty"`
+
+	// If true, the data sources walk their input but nothing is written;
+	// instead, a PreviewReport of what the import would do is streamed
+	// with the job's progress and stored when the job is done (see
+	// Timeline.ImportPreview). Previews start over when resumed, and
+	// data sources that import from an API are skipped.
+	Preview bool `json:"preview,omitempty"`
 }
 
 func (ij ImportJob) checkpoint(estimatedSize *int64, outer, inner int, ds any) error {
+	if ij.preview != nil {
+		// the report isn't checkpointed, so neither is the position
+		return nil
+	}
 	return ij.job.Checkpoint(importJobCheckpoint{
 		EstimatedSize:        estimatedSize,
 		OuterIndex:           outer,
@@ -88,6 +117,32 @@ func (ij ImportJob) checkpoint(estimatedSize *int64, outer, inner int, ds any) e
 	})
 }
 
+// describeCheckpoint returns a description of where the import
+// will resume from the checkpoint, for the user.
+func (ij ImportJob) describeCheckpoint(chkpt importJobCheckpoint) string {
+	if chkpt.OuterIndex >= len(ij.Plan.Files) {
+		return "end of import plan"
+	}
+	fi := ij.Plan.Files[chkpt.OuterIndex]
+	if len(fi.Filenames) == 0 {
+		// imports from an API don't have files
+		desc := fi.DataSourceName
+		if chkpt.DataSourceCheckpoint != nil {
+			desc += ", partway through"
+		}
+		return desc
+	}
+	if chkpt.InnerIndex >= len(fi.Filenames) {
+		return "end of import plan"
+	}
+	desc := fmt.Sprintf("%s (file %d of %d from %s)",
+		fi.Filenames[chkpt.InnerIndex], chkpt.InnerIndex+1, len(fi.Filenames), fi.DataSourceName)
+	if chkpt.DataSourceCheckpoint != nil {
+		desc += ", partway through"
+	}
+	return desc
+}
+
 // TODO: This was useful during the refactoring of the import flow, but
 // I ended up on a design that doesn't require rooting file systems at
 // the root of the volume. Seems like good code, since the Go standard
@@ -129,10 +184,27 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 	ij.skippedItemCount = new(int64)
 	ij.newEntityCount = new(int64)
 	ij.thumbnailCount = new(int64)
+	ij.graphCount = new(int64)
+	ij.failedGraphCount = new(int64)
 	ij.pMu = new(sync.Mutex)
 
 	estimating := ij.EstimateTotal
 
+	if ij.Preview {
+		if ij.ProcessingOptions.Interactive != nil {
+			return errors.New("interactive imports cannot be previewed")
+		}
+		ij.preview = newImportPreview()
+		estimating = false
+		if checkpoint != nil {
+			// start over, since the report so far is gone
+			checkpoint = nil
+			job.mu.Lock()
+			job.currentProgress = nil
+			job.mu.Unlock()
+		}
+	}
+
 	if ij.ProcessingOptions.Interactive != nil {
 		ij.ProcessingOptions.Interactive.Graphs = make(chan *InteractiveGraph)
 	}
@@ -150,10 +222,53 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 		// already been completed, but I don't think it should ever put us
 		// INTO "estimating" mode
 		estimating = chkpt.EstimatedSize != nil
+
+		job.mu.Lock()
+		var processed int
+		if job.currentProgress != nil {
+			processed = *job.currentProgress
+		}
+		job.mu.Unlock()
+		LogResumeImport(job.ID(), ij.describeCheckpoint(chkpt), processed)
 	}
 
+	// in bulk mode, new items are indexed all at once when the import is done
+	// (or when the timeline is opened next, if the process stops before then)
+	indexingDeferred := ij.bulk()
+	if indexingDeferred {
+		if err := job.tl.deferItemIndexing(job.Context()); err != nil {
+			return fmt.Errorf("deferring indexing of new items: %w", err)
+		}
+	}
+	resumeIndexing := func() {
+		if !indexingDeferred {
+			return
+		}
+		indexingDeferred = false
+		if err := job.tl.resumeItemIndexing(job.tl.ctx); err != nil {
+			job.Logger().Error("indexing new items", zap.Error(err))
+		}
+	}
+	defer resumeIndexing()
+
+	// set once the size estimate is done, so it can be included in the import plan
+	var estimatedTotal *int64
+
 	// two iterations: first to estimate size if enabled, then to actually import items
 	for {
+		if !estimating && ij.preview == nil {
+			LogImportPlan(job.ID(), ImportPlanSummary{
+				Files:          ij.Plan.Files,
+				Timeframe:      ij.ProcessingOptions.Timeframe,
+				EstimatedItems: estimatedTotal,
+				Integrity:      ij.ProcessingOptions.Integrity,
+				Overwrite:      ij.ProcessingOptions.OverwriteLocalChanges,
+				Interactive:    ij.ProcessingOptions.Interactive != nil,
+				Bulk:           ij.bulk(),
+				Resuming:       checkpoint != nil,
+			})
+		}
+
 		// this should be cumulative across all the files
 		var totalSizeEstimate *int64
 		if estimating {
@@ -167,6 +282,14 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 			job.Message("Estimating total import size")
 		}
 
+		phase := WithPhase(job.Logger(), "importing")
+		switch {
+		case estimating:
+			phase = WithPhase(job.Logger(), "estimating")
+		case ij.preview != nil:
+			phase = WithPhase(job.Logger(), "previewing")
+		}
+
 		for i := chkpt.OuterIndex; i < len(ij.Plan.Files); i++ {
 			if err := job.Context().Err(); err != nil {
 				return err
@@ -188,7 +311,51 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 				return err
 			}
 
-			logger := job.Logger().With(zap.String("data_source_name", ds.Name))
+			logger := phase.With(zap.String("data_source_name", ds.Name))
+
+			newProcessor := func(j int) *processor {
+				p := &processor{
+					outerLoopIdx:   i,
+					innerLoopIdx:   j,
+					estimatedCount: totalSizeEstimate,
+
+					ij:       ij,
+					ds:       ds,
+					dsRowID:  dsRowID,
+					dsOpt:    dsOpt,
+					tl:       job.Timeline(),
+					log:      logger,
+					progress: logger.Named("progress"),
+				}
+				ij.pMu.Lock()
+				ij.p = p
+				ij.pMu.Unlock()
+				return p
+			}
+
+			// data sources that import from an API have no files; they are run once
+			if ds.NewFileImporter == nil && ds.NewAPIImporter != nil {
+				if !estimating && ij.preview == nil {
+					job.Message("Importing from " + ds.Title)
+				}
+				if chkpt.DataSourceCheckpoint == nil {
+					if err := ij.checkpoint(totalSizeEstimate, i, 0, nil); err != nil {
+						job.Logger().Error("checkpointing", zap.Error(err))
+					}
+				}
+				dsCheckpoint, err := chkpt.dataSourceCheckpoint()
+				if err != nil {
+					return err
+				}
+				if err := newProcessor(0).processAPI(job.Context(), dsCheckpoint); err != nil {
+					ij.generateThumbnailsForImportedItems()
+					ij.generateEmbeddingsForImportedItems()
+					ij.enrichImportedItems()
+					return fmt.Errorf("importing from %s: %w", ds.Name, err)
+				}
+				chkpt.DataSourceCheckpoint = nil
+				continue
+			}
 
 			// process each filename one at a time
 			for j := chkpt.InnerIndex; j < len(fileImport.Filenames); j++ {
@@ -198,7 +365,10 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 
 				filename := fileImport.Filenames[j]
 
-				if !estimating {
+				switch {
+				case ij.preview != nil:
+					job.Message("Previewing " + filename)
+				case !estimating:
 					job.Message("Importing " + filename)
 				}
 
@@ -217,22 +387,7 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 					return err
 				}
 
-				p := processor{
-					outerLoopIdx:   i,
-					innerLoopIdx:   j,
-					estimatedCount: totalSizeEstimate,
-
-					ij:       ij,
-					ds:       ds,
-					dsRowID:  dsRowID,
-					dsOpt:    dsOpt,
-					tl:       job.Timeline(),
-					log:      logger,
-					progress: logger.Named("progress"),
-				}
-				ij.pMu.Lock()
-				ij.p = &p
-				ij.pMu.Unlock()
+				p := newProcessor(j)
 
 				// Create the file system from which this file/dir will be accessed. It must be
 				// a DeepFS since the filename might refer to a path inside an archive file.
@@ -333,18 +488,15 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 					Filename: filenameInsideFS,
 				}
 
-				// the data source decodes its own checkpoint, so we give it its checkpoint as bytes
-				var dsCheckpoint json.RawMessage
-				if chkpt.DataSourceCheckpoint != nil {
-					dsCheckpoint, err = json.Marshal(chkpt.DataSourceCheckpoint)
-					if err != nil {
-						return fmt.Errorf("re-encoding data source checkpoint to pass to DS to resume: %w", err)
-					}
+				dsCheckpoint, err := chkpt.dataSourceCheckpoint()
+				if err != nil {
+					return err
 				}
 
 				if err := p.process(job.Context(), dirEntry, dsCheckpoint); err != nil {
 					ij.generateThumbnailsForImportedItems()
 					ij.generateEmbeddingsForImportedItems()
+					ij.enrichImportedItems()
 					return fmt.Errorf("processing %s: %w", filename, err)
 				}
 
@@ -353,12 +505,15 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 			}
 		}
 
+		phase.End()
+
 		if estimating {
 			// inform the UI of the new total count
 			total := atomic.LoadInt64(totalSizeEstimate)
 			job.SetTotal(int(total))
 			job.FlushProgress()
 			job.Logger().Info("done with size estimation", zap.Int64("estimated_size", total))
+			estimatedTotal = &total
 
 			// loop once more to import items (don't estimate again)
 			estimating = false
@@ -372,14 +527,36 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 		return err
 	}
 
+	if ij.preview != nil {
+		ij.flushPreview(true)
+		job.Logger().Info("import preview complete", zap.Any("preview", ij.preview.report))
+		return job.tl.storeImportPreview(job.Context(), job.ID(), ij.preview.report)
+	}
+
 	job.Logger().Info("import complete; cleaning up")
 
+	resumeIndexing()
+
+	// counts start over when resuming, so they only tell us about this import if it wasn't resumed
+	if checkpoint == nil && atomic.LoadInt64(ij.newItemCount) == 0 && atomic.LoadInt64(ij.updatedItemCount) == 0 {
+		reason := "no items found"
+		if atomic.LoadInt64(ij.skippedItemCount) > 0 {
+			reason = "already up to date"
+		}
+		LogNoop(job.ID(), reason, ij.ProcessingOptions.Timeframe)
+	}
+	if failed := atomic.LoadInt64(ij.failedGraphCount); failed > 0 {
+		LogJobPartialSuccess(job.ID(), int(atomic.LoadInt64(ij.graphCount)-failed), int(failed))
+	}
+
 	if err := ij.successCleanup(); err != nil {
 		job.Logger().Error("cleaning up after import job", zap.Error(err))
 	}
 
 	ij.generateThumbnailsForImportedItems()
 	ij.generateEmbeddingsForImportedItems()
+	ij.enrichImportedItems()
+	ij.resolveImportedEntities()
 
 	// this can prevent/resolve slow queries, especially useful after (large) imports
 	// TODO: maybe only necessary after *large* imports
@@ -388,6 +565,13 @@ func (ij *ImportJob) Run(job *ActiveJob, checkpoint []byte) error {
 	return nil
 }
 
+// bulk returns true if the import is optimized for throughput; interactive
+// imports are never bulk imports, since items are reviewed as they come,
+// and neither are previews, which don't write items.
+func (ij ImportJob) bulk() bool {
+	return ij.ProcessingOptions.Bulk && ij.ProcessingOptions.Interactive == nil && !ij.Preview
+}
+
 // ImportParams specifies parameters for listing items
 // from a data source. Some data sources might not be
 // able to honor all fields.
@@ -412,6 +596,11 @@ type ImportParams struct {
 	// as provided by NewOptions.
 	DataSourceOptions any `json:"data_source_options,omitempty"`
 
+	// State the data source kept from previous imports, and
+	// can update for the next ones (see ImportState). It is
+	// nil when estimating the size of an import.
+	State *ImportState `json:"-"`
+
 	// TODO: WIP...
 	// // Maximum number of items to list; useful
 	// // for previews. Data sources should not
@@ -525,6 +714,7 @@ func (ij ImportJob) generateThumbnailsForImportedItems() {
 
 	job := thumbnailJob{
 		TasksFromImportJob: ij.job.ID(),
+		Previews:           true,
 	}
 
 	// thumbnail job will calculate its total size
@@ -548,6 +738,46 @@ func (ij ImportJob) generateEmbeddingsForImportedItems() {
 	}
 }
 
+// enrichImportedItems creates a job to enrich the imported items, if
+// enabled in the processing options.
+func (ij ImportJob) enrichImportedItems() {
+	if !ij.ProcessingOptions.Enrich {
+		return
+	}
+
+	ij.job.Logger().Info("creating enrichment job from import")
+
+	job := enrichmentJob{
+		ItemsFromImportJob: ij.job.ID(),
+	}
+
+	// enrichment job will calculate its total size
+	if _, err := ij.job.tl.CreateJob(job, time.Time{}, 0, 0, ij.job.id); err != nil {
+		ij.job.Logger().Error("creating enrichment job", zap.Error(err))
+		return
+	}
+}
+
+// resolveImportedEntities creates a job to refresh the merge suggestions of
+// the entities that were imported, if any. It should be run after the import
+// completes.
+func (ij ImportJob) resolveImportedEntities() {
+	if atomic.LoadInt64(ij.newEntityCount) == 0 &&
+		atomic.LoadInt64(ij.newItemCount) == 0 &&
+		atomic.LoadInt64(ij.updatedItemCount) == 0 {
+		return
+	}
+
+	ij.job.Logger().Info("creating entity resolution job from import")
+
+	job := entityResolutionJob{
+		EntitiesFromImportJob: ij.job.ID(),
+	}
+	if _, err := ij.job.tl.CreateJob(job, time.Time{}, 0, 0, ij.job.id); err != nil {
+		ij.job.Logger().Error("creating entity resolution job", zap.Error(err))
+	}
+}
+
 func (ij ImportJob) tempGraphFolder() string {
 	return filepath.Join(
 		os.TempDir(),
@@ -0,0 +1,158 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+)
+
+// ImportState is state that a data source keeps across imports, so that
+// it can import incrementally: for example, remembering which messages in
+// a mailbox it has already imported, so that a scheduled import only
+// fetches new ones. Values are keyed by a string of the data source's
+// choosing (such as an account and folder), and are JSON-encoded.
+//
+// Values saved during an import are only persisted after all the items
+// the data source sent before saving them have been processed, and only
+// if the import wasn't canceled; so a data source should save a value
+// after it has sent the items it describes.
+//
+// A nil *ImportState is valid; it has no values and discards saved ones.
+type ImportState struct {
+	mu      sync.Mutex
+	saved   map[string]json.RawMessage // as of the start of the import
+	pending map[string]json.RawMessage // saved during this import
+}
+
+// NewImportState returns an ImportState that has the given saved values,
+// which may be nil. It is mainly useful for running data sources outside
+// of an import job, such as in tests.
+func NewImportState(saved map[string]json.RawMessage) *ImportState {
+	return &ImportState{saved: saved}
+}
+
+// Load decodes the value for key into v, and returns false if there is no
+// value for key. The value saved latest is used, even during this import.
+func (s *ImportState) Load(key string, v any) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	val, ok := s.pending[key]
+	if !ok {
+		val, ok = s.saved[key]
+	}
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(val, v); err != nil {
+		return true, fmt.Errorf("decoding import state %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// Save sets the value for key to v.
+func (s *ImportState) Save(key string, v any) error {
+	if s == nil {
+		return nil
+	}
+	val, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding import state %s: %w", key, err)
+	}
+	s.mu.Lock()
+	if s.pending == nil {
+		s.pending = make(map[string]json.RawMessage)
+	}
+	s.pending[key] = val
+	s.mu.Unlock()
+	return nil
+}
+
+// Pending returns the values that were saved during this import.
+func (s *ImportState) Pending() map[string]json.RawMessage {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.pending)
+}
+
+// loadImportState loads the import state of the data source with the given row ID.
+func (tl *Timeline) loadImportState(ctx context.Context, dsRowID uint64) (*ImportState, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT key, value FROM import_state WHERE data_source_id=?`, dsRowID)
+	if err != nil {
+		return nil, fmt.Errorf("querying import state: %w", err)
+	}
+	defer rows.Close()
+
+	saved := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("scanning import state: %w", err)
+		}
+		saved[key] = json.RawMessage(value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating import state: %w", err)
+	}
+	return NewImportState(saved), nil
+}
+
+// storeImportState persists the values that were saved to state during
+// an import from the data source with the given row ID.
+func (tl *Timeline) storeImportState(ctx context.Context, dsRowID uint64, state *ImportState) error {
+	pending := state.Pending()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	for key, value := range pending {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO import_state (data_source_id, key, value, updated) VALUES (?, ?, ?, ?)
+			ON CONFLICT (data_source_id, key) DO UPDATE SET value=excluded.value, updated=excluded.updated`,
+			dsRowID, key, string(value), now)
+		if err != nil {
+			return fmt.Errorf("storing import state %s: %w", key, err)
+		}
+	}
+
+	return tx.Commit()
+}
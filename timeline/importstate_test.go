@@ -0,0 +1,82 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"testing"
+)
+
+func TestImportState(t *testing.T) {
+	ctx := context.Background()
+	tl := newTestTimeline(t)
+	var dsRowID uint64
+	if err := tl.db.QueryRow(`SELECT id FROM data_sources WHERE name='sms'`).Scan(&dsRowID); err != nil {
+		t.Fatal(err)
+	}
+
+	type mailboxState struct {
+		UIDNext uint32 `json:"uid_next"`
+	}
+
+	// a nil state has nothing and keeps nothing
+	var nilState *ImportState
+	if err := nilState.Save("a", mailboxState{1}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := nilState.Load("a", new(mailboxState)); ok || err != nil {
+		t.Fatalf("expected no value in nil state, got %v %v", ok, err)
+	}
+
+	for i, expected := range []uint32{5, 9} {
+		state, err := tl.loadImportState(ctx, dsRowID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ms mailboxState
+		ok, err := state.Load("inbox", &ms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && ok {
+			t.Fatalf("expected no state before the first import, got %+v", ms)
+		}
+		if i > 0 && ms.UIDNext != 5 {
+			t.Fatalf("expected state from the previous import, got %+v", ms)
+		}
+
+		if err := state.Save("inbox", mailboxState{expected}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := state.Load("inbox", &ms); err != nil || ms.UIDNext != expected {
+			t.Fatalf("expected saved value to be loaded during the import, got %+v (err=%v)", ms, err)
+		}
+		if err := tl.storeImportState(ctx, dsRowID, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	if err := tl.db.QueryRow(`SELECT count() FROM import_state`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 row of import state, got %d", count)
+	}
+}
@@ -340,7 +340,15 @@ func (p *processor) downloadAndHashDataFile(it *Item, h hash.Hash) (int64, error
 	// give the hasher a copy of the file bytes
 	tr := io.TeeReader(it.dataFileIn, h)
 
-	n, err := io.Copy(it.dataFileOut, tr)
+	out, err := p.tl.encryptingWriter(it.dataFileOut)
+	if err != nil {
+		_ = p.tl.deleteRepoFile(it.dataFileOut.Name())
+		return 0, fmt.Errorf("encrypting file: %w", err)
+	}
+	n, err := io.Copy(out, tr)
+	if err == nil {
+		err = out.Close()
+	}
 	if err != nil {
 		// TODO: The error should be highlighted as a notification of some sort. Ideally, keep what we have, but somehow indicate in the DB that it's corrupt/incomplete (like not filling out a data_hash)
 		_ = p.tl.deleteRepoFile(it.dataFileOut.Name())
@@ -573,7 +581,7 @@ func (p *processor) replaceWithExisting(tx *sql.Tx, canonical *string, checksum
 
 	// ensure the existing file is still the same
 	h := newHash()
-	f, err := os.Open(p.tl.FullPath(*existingDatafile))
+	f, err := p.tl.OpenRepoFile(*existingDatafile)
 	if err != nil {
 		// TODO: This error is happening often when (re-?)importing SMS backup & restore MMS data files ("no such file or directory")
 		return false, fmt.Errorf("opening existing file: %w", err)
@@ -25,8 +25,11 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zeebo/blake3"
@@ -38,8 +41,29 @@ const maxThrottleCPUPct = 0.25
 var (
 	throttleSize         = max(int(float64(runtime.NumCPU())*maxThrottleCPUPct), 1)
 	cpuIntensiveThrottle = make(chan struct{}, throttleSize)
+	cpuThrottleWaiting   atomic.Int64 // number of goroutines waiting for the throttle
 )
 
+// acquireCPUIntensiveThrottle blocks until there is room in the throttle
+// for CPU-intensive work, and returns a function that makes room again,
+// which must be called when the work is done. The state of the throttle
+// is reported as a worker pool (see ObserveWorkerPool).
+func acquireCPUIntensiveThrottle() (release func()) {
+	cpuThrottleWaiting.Add(1)
+	observeCPUIntensiveThrottle()
+	cpuIntensiveThrottle <- struct{}{}
+	cpuThrottleWaiting.Add(-1)
+	observeCPUIntensiveThrottle()
+	return func() {
+		<-cpuIntensiveThrottle
+		observeCPUIntensiveThrottle()
+	}
+}
+
+func observeCPUIntensiveThrottle() {
+	ObserveWorkerPool("cpu_intensive", len(cpuIntensiveThrottle), int(cpuThrottleWaiting.Load()), cap(cpuIntensiveThrottle))
+}
+
 // CreateJob creates and runs a job described by action, with an estimated total units
 // of work, to be repeated after a certain interval (if > 0). If an identical job is
 // already running, the job will be queued. If an identical job is already queued, this
@@ -50,16 +74,9 @@ func (tl *Timeline) CreateJob(action JobAction, scheduled time.Time, repeat time
 		return 0, fmt.Errorf("JSON-encoding job action: %w", err)
 	}
 
-	var jobType JobType
-	switch action.(type) {
-	case *ImportJob:
-		jobType = JobTypeImport
-	case thumbnailJob:
-		jobType = JobTypeThumbnails
-	case embeddingJob:
-		jobType = JobTypeEmbeddings
-	default:
-		return 0, fmt.Errorf("unexpected job action: %#v", action)
+	jobType, err := jobTypeOf(action)
+	if err != nil {
+		return 0, err
 	}
 
 	var repeatPtr *time.Duration
@@ -128,6 +145,34 @@ func (tl *Timeline) CreateJob(action JobAction, scheduled time.Time, repeat time
 	return jobID, nil
 }
 
+// jobTypeOf returns the type of job that runs action.
+func jobTypeOf(action JobAction) (JobType, error) {
+	switch action.(type) {
+	case *ImportJob:
+		return JobTypeImport, nil
+	case thumbnailJob:
+		return JobTypeThumbnails, nil
+	case embeddingJob:
+		return JobTypeEmbeddings, nil
+	case exportJob:
+		return JobTypeExport, nil
+	case entityResolutionJob:
+		return JobTypeEntityResolution, nil
+	case syncJob:
+		return JobTypeSync, nil
+	case policyJob:
+		return JobTypePolicies, nil
+	case enrichmentJob:
+		return JobTypeEnrichment, nil
+	case backupJob:
+		return JobTypeBackup, nil
+	case restoreJob:
+		return JobTypeRestore, nil
+	default:
+		return "", fmt.Errorf("unexpected job action: %#v", action)
+	}
+}
+
 // storeJob adds the job to the database. It does not start it.
 // TODO: Job configs could be compressed to save space in the DB...
 func (tl *Timeline) storeJob(tx *sql.Tx, job Job) (uint64, error) {
@@ -345,35 +390,84 @@ func (tl *Timeline) startJob(ctx context.Context, tx *sql.Tx, jobID uint64) erro
 	return nil
 }
 
-// runJob deserializes the job's and starts a goroutine and
-// calls its associated action function. The goroutine then finalizes
-// the job and runs the next queued job, if any. This method does
-// not sync the job's starting state to the DB, so call startJob()
-// instead. It is expected that its state is running/started.
-func (tl *Timeline) runJob(row Job) error {
-	// create the job action by deserializing the config into its assocated struct
-	var action JobAction
-	switch row.Type {
+// decodeJobAction creates the action of a job of the given type by
+// deserializing its config into its associated struct.
+func decodeJobAction(jobType JobType, config string) (JobAction, error) {
+	switch jobType {
 	case JobTypeImport:
 		var importJob *ImportJob
-		if err := json.Unmarshal([]byte(row.Config), &importJob); err != nil {
-			return fmt.Errorf("unmarshaling import job config: %w", err)
+		if err := json.Unmarshal([]byte(config), &importJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling import job config: %w", err)
 		}
-		action = importJob
+		return importJob, nil
 	case JobTypeThumbnails:
 		var thumbnailJob thumbnailJob
-		if err := json.Unmarshal([]byte(row.Config), &thumbnailJob); err != nil {
-			return fmt.Errorf("unmarshaling thumbnail job config: %w", err)
+		if err := json.Unmarshal([]byte(config), &thumbnailJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling thumbnail job config: %w", err)
 		}
-		action = thumbnailJob
+		return thumbnailJob, nil
 	case JobTypeEmbeddings:
 		var embeddingJob embeddingJob
-		if err := json.Unmarshal([]byte(row.Config), &embeddingJob); err != nil {
-			return fmt.Errorf("unmarshaling embedding job config: %w", err)
+		if err := json.Unmarshal([]byte(config), &embeddingJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling embedding job config: %w", err)
+		}
+		return embeddingJob, nil
+	case JobTypeExport:
+		var exportJob exportJob
+		if err := json.Unmarshal([]byte(config), &exportJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling export job config: %w", err)
 		}
-		action = embeddingJob
+		return exportJob, nil
+	case JobTypeEntityResolution:
+		var entityResolutionJob entityResolutionJob
+		if err := json.Unmarshal([]byte(config), &entityResolutionJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling entity resolution job config: %w", err)
+		}
+		return entityResolutionJob, nil
+	case JobTypeSync:
+		var syncJob syncJob
+		if err := json.Unmarshal([]byte(config), &syncJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling sync job config: %w", err)
+		}
+		return syncJob, nil
+	case JobTypePolicies:
+		var policyJob policyJob
+		if err := json.Unmarshal([]byte(config), &policyJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling policy job config: %w", err)
+		}
+		return policyJob, nil
+	case JobTypeEnrichment:
+		var enrichmentJob enrichmentJob
+		if err := json.Unmarshal([]byte(config), &enrichmentJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling enrichment job config: %w", err)
+		}
+		return enrichmentJob, nil
+	case JobTypeBackup:
+		var backupJob backupJob
+		if err := json.Unmarshal([]byte(config), &backupJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling backup job config: %w", err)
+		}
+		return backupJob, nil
+	case JobTypeRestore:
+		var restoreJob restoreJob
+		if err := json.Unmarshal([]byte(config), &restoreJob); err != nil {
+			return nil, fmt.Errorf("unmarshaling restore job config: %w", err)
+		}
+		return restoreJob, nil
 	default:
-		return fmt.Errorf("unknown job type '%s'", row.Type)
+		return nil, fmt.Errorf("unknown job type '%s'", jobType)
+	}
+}
+
+// runJob deserializes the job's and starts a goroutine and
+// calls its associated action function. The goroutine then finalizes
+// the job and runs the next queued job, if any. This method does
+// not sync the job's starting state to the DB, so call startJob()
+// instead. It is expected that its state is running/started.
+func (tl *Timeline) runJob(row Job) error {
+	action, err := decodeJobAction(row.Type, row.Config)
+	if err != nil {
+		return err
 	}
 
 	baseLogger := Log.Named("job").With(
@@ -428,12 +522,26 @@ func (tl *Timeline) runJob(row Job) error {
 		// (maybe "succeeded" is too specific/optimistic a term, maybe "completed" or "done" or "finished" instead?)
 
 		// run the job; we'll handle the error by logging the result and updating the state
+		began := time.Now()
+		observeJobStart(row.Type)
+		tl.publishEvent(EventJobStarted, JobStartedEvent{
+			JobID:       job.id,
+			JobType:     row.Type,
+			ParentJobID: row.ParentJobID,
+		})
 		actionErr := action.Run(job, row.Checkpoint)
 
+		// a job that is done isn't waiting anymore, even if its action didn't say so
+		LogJobResumed(job.id)
+
 		var newState JobState
 		switch {
 		case actionErr == nil:
 			newState = JobSucceeded
+		case errors.Is(actionErr, context.Canceled) && tl.ctx.Err() != nil:
+			// the timeline is closing, rather than the job being canceled,
+			// so it will be resumed from its checkpoint next time
+			newState = JobInterrupted
 		case errors.Is(actionErr, context.Canceled):
 			newState = JobAborted
 		default:
@@ -442,10 +550,29 @@ func (tl *Timeline) runJob(row Job) error {
 
 		// add info to the logger and log the result
 		end := time.Now()
+		observeJobEnd(row.Type, newState, end.Sub(began))
 		statusLog = statusLog.With(zap.Time("ended", end))
 		if row.Start != nil {
 			statusLog = statusLog.With(zap.Duration("duration", end.Sub(*row.Start)))
 		}
+		if suppressed := takeSuppressedErrors(job.id); suppressed > 0 {
+			statusLog = statusLog.With(zap.Int("suppressed_errors", suppressed))
+		}
+		if dropped := forgetJobLogBudget(job.id); dropped > 0 {
+			statusLog = statusLog.With(zap.Int("dropped_over_log_budget", dropped))
+		}
+		if unsupported := unsupportedFormats.take(job.id); len(unsupported) > 0 {
+			statusLog = statusLog.With(zap.Any("unsupported_formats", unsupported))
+		}
+		if failures := thumbnailFailures.take(job.id); len(failures) > 0 {
+			statusLog = statusLog.With(zap.Any("thumbnail_failures", failures))
+		}
+		if merges := itemMerges.take(job.id); len(merges) > 0 {
+			statusLog = statusLog.With(zap.Any("merges", merges))
+		}
+		if costs := jobPhaseCosts.take(job.id); len(costs) > 0 {
+			statusLog = statusLog.With(zap.Object("phase_costs", costs))
+		}
 
 		job.mu.Lock()
 		job.currentState = newState
@@ -456,12 +583,23 @@ func (tl *Timeline) runJob(row Job) error {
 		switch newState {
 		case JobSucceeded:
 			statusLog.Info(string(newState))
-		case JobAborted:
+		case JobAborted, JobInterrupted:
 			statusLog.Warn(string(newState), zap.Error(actionErr))
 		case JobFailed:
 			statusLog.Error(string(newState), zap.Error(actionErr))
 		}
 
+		finished := JobFinishedEvent{
+			JobID:    job.id,
+			JobType:  row.Type,
+			State:    newState,
+			Duration: end.Sub(began),
+		}
+		if actionErr != nil {
+			finished.Error = actionErr.Error()
+		}
+		tl.publishEvent(EventJobFinished, finished)
+
 		// sync to the DB, and dequeue the next job
 		tl.dbMu.Lock()
 		defer tl.dbMu.Unlock()
@@ -563,8 +701,11 @@ type ActiveJob struct {
 	currentMessage    *string // nil => unchanged, "" => clear
 	currentCheckpoint any
 	lastCheckpoint    *time.Time // when last checkpoint was created (may be more recent than last DB sync, which is throttled)
+	checkpoints       int        // number of checkpoints attempted
+	checkpointedAt    int        // progress as of the last checkpoint
 	lastSync          time.Time  // last DB update
 	lastFlush         time.Time  // last frontend update
+	rate              progressRate
 }
 
 // Context returns the context the job is being run in. It should
@@ -656,18 +797,62 @@ func (j *ActiveJob) flushProgress(logger *zap.Logger) {
 		if logger == nil {
 			logger = j.statusLog
 		}
-		logger.Info("progress",
+		now := time.Now()
+		fields := []zap.Field{
 			zap.String("state", string(j.currentState)),
 			zap.Intp("progress", j.currentProgress),
 			zap.Intp("total", j.currentTotal),
 			zap.Stringp("message", j.currentMessage),
 			zap.Timep("checkpointed", j.lastCheckpoint),
-			zap.Uint64p("parent_job_id", j.parentJobID))
-		j.lastFlush = time.Now()
+			zap.Uint64p("parent_job_id", j.parentJobID),
+		}
+		if j.currentProgress != nil {
+			if rate, ok := j.rate.update(*j.currentProgress, now); ok {
+				fields = append(fields, zap.Float64("items_per_sec", rate))
+			}
+		}
+		logger.Info("progress", fields...)
+		j.lastFlush = now
 		_ = logger.Sync() // ensure it gets written promptly
 	}
 }
 
+// progressRate computes the smoothed rate of a job's progress (throughput)
+// from the progress reported in consecutive updates.
+type progressRate struct {
+	progress int
+	time     time.Time
+	perSec   float64 // exponentially weighted moving average
+	known    bool
+}
+
+// update records the job's progress at time now, and returns the smoothed
+// rate of progress per second, if it is known; there is no rate until at
+// least two updates with some time between them have been recorded.
+func (r *progressRate) update(progress int, now time.Time) (perSec float64, ok bool) {
+	if r.time.IsZero() || progress < r.progress {
+		// first update, or progress was reset
+		r.progress, r.time, r.known = progress, now, false
+		return 0, false
+	}
+	elapsed := now.Sub(r.time).Seconds()
+	if elapsed <= 0 {
+		return r.perSec, r.known
+	}
+	instant := float64(progress-r.progress) / elapsed
+	if r.known {
+		r.perSec = progressRateSmoothing*instant + (1-progressRateSmoothing)*r.perSec
+	} else {
+		r.perSec, r.known = instant, true
+	}
+	r.progress, r.time = progress, now
+	return r.perSec, true
+}
+
+// progressRateSmoothing is the weight of the latest rate in the moving
+// average; lower values make the rate steadier but slower to adapt.
+const progressRateSmoothing = 0.3
+
 // Message updates the current job message or status to show the user.
 func (j *ActiveJob) Message(message string) {
 	j.mu.Lock()
@@ -726,7 +911,9 @@ func (j *ActiveJob) sync(tx *sql.Tx, checkpoint any) error {
 		var err error
 		chkpt, err = json.Marshal(checkpoint)
 		if err != nil {
-			return fmt.Errorf("JSON-encoding checkpoint %#v: %w", checkpoint, err)
+			err = fmt.Errorf("JSON-encoding checkpoint %#v: %w", checkpoint, err)
+			j.logCheckpoint(err)
+			return err
 		}
 		now := time.Now()
 		j.lastCheckpoint = &now
@@ -744,7 +931,13 @@ func (j *ActiveJob) sync(tx *sql.Tx, checkpoint any) error {
 		_, err = tx.ExecContext(j.tl.ctx, q, vals...)
 	}
 	if err != nil {
-		return fmt.Errorf("syncing progress with DB: %w", err)
+		err = fmt.Errorf("syncing progress with DB: %w", err)
+	}
+	if checkpoint != nil {
+		j.logCheckpoint(err)
+	}
+	if err != nil {
+		return err
 	}
 
 	j.lastSync = time.Now()
@@ -752,8 +945,22 @@ func (j *ActiveJob) sync(tx *sql.Tx, checkpoint any) error {
 	return nil
 }
 
+// logCheckpoint logs the outcome of saving a checkpoint (see LogCheckpoint).
+// j.mu must be locked.
+func (j *ActiveJob) logCheckpoint(err error) {
+	j.checkpoints++
+	var progress int
+	if j.currentProgress != nil {
+		progress = *j.currentProgress
+	}
+	LogCheckpoint(j.id, strconv.Itoa(j.checkpoints), CheckpointProgress{Items: int64(progress - j.checkpointedAt)}, err)
+	if err == nil {
+		j.checkpointedAt = progress
+	}
+}
+
 // GetJobs loads the jobs with the specified IDs, or by the most recent jobs, whichever is set.
-// Both technically can be set, but why?
+// Both technically can be set, but why? Sensitive values in their configurations are redacted.
 func (tl *Timeline) GetJobs(ctx context.Context, jobIDs []uint64, mostRecent int) ([]Job, error) {
 	var jobs []Job //nolint:prealloc // false positive! can't always know how many we'll have in this case
 
@@ -805,6 +1012,8 @@ func (tl *Timeline) GetJobs(ctx context.Context, jobIDs []uint64, mostRecent int
 	}
 
 	for i := range jobs {
+		jobs[i].Config = redactedJobConfig(jobs[i].Type, jobs[i].Config)
+
 		// if job is running, we can provide more recent information than what
 		// was last synced to the DB, which may be out-of-date at the moment
 		if jobs[i].State == JobStarted {
@@ -832,6 +1041,7 @@ func (tl *Timeline) CancelJob(ctx context.Context, jobID uint64) error {
 	if ok {
 		// job is actively running -- fun! we get to cancel it,
 		// and our job is actually easier this way
+		LogJobCanceled(jobID, "canceled by user")
 		activeJob.cancel()
 
 		// wait for job action to return; this ensures its
@@ -884,6 +1094,8 @@ func (tl *Timeline) CancelJob(ctx context.Context, jobID uint64) error {
 		return fmt.Errorf("committing transaction: %w", err)
 	}
 
+	LogJobCanceled(jobID, "canceled by user")
+
 	// update any UI elements that may be showing info about this inactive job
 	statusLog := Log.Named("job.status").With(
 		zap.String("repo_id", tl.ID().String()),
@@ -1030,6 +1242,55 @@ func (tl *Timeline) StartJob(ctx context.Context, jobID uint64, startOver bool)
 	return tx.Commit()
 }
 
+// waitForActiveJobs blocks until the jobs that are running have returned,
+// which they do soon after the timeline's context is canceled.
+func (tl *Timeline) waitForActiveJobs() {
+	tl.activeJobsMu.RLock()
+	done := make([]chan struct{}, 0, len(tl.activeJobs))
+	for _, job := range tl.activeJobs {
+		done = append(done, job.done)
+	}
+	tl.activeJobsMu.RUnlock()
+	for _, ch := range done {
+		<-ch
+	}
+}
+
+// ResumeJob continues the job with the given ID from its last checkpoint,
+// instead of starting it over, so that items which were already processed
+// are not processed again. This works for jobs that were interrupted (such
+// as by a crash), paused, aborted, or that failed. Jobs save checkpoints
+// periodically as they run (see ActiveJob.Checkpoint); an import job's
+// checkpoint includes the position in its plan and the checkpoint of the
+// data source, if any, which lets it resume partway through a file.
+func (tl *Timeline) ResumeJob(ctx context.Context, jobID uint64) error {
+	tl.activeJobsMu.RLock()
+	_, active := tl.activeJobs[jobID]
+	tl.activeJobsMu.RUnlock()
+	if active {
+		// only a paused job can be resumed while it is loaded
+		return tl.UnpauseJob(ctx, jobID)
+	}
+
+	var state JobState
+	tl.dbMu.RLock()
+	err := tl.db.QueryRowContext(ctx, `SELECT state FROM jobs WHERE id=? LIMIT 1`, jobID).Scan(&state)
+	tl.dbMu.RUnlock()
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("job %d not found", jobID)
+	}
+	if err != nil {
+		return err
+	}
+	switch state {
+	case JobInterrupted, JobPaused, JobAborted, JobFailed:
+	default:
+		return fmt.Errorf("job %d is in %s state and cannot be resumed", jobID, state)
+	}
+
+	return tl.StartJob(ctx, jobID, false)
+}
+
 func scanJob(rows *sql.Rows, repoID string) (Job, error) {
 	var job Job
 	var created, updated, start, end *int64
@@ -1063,6 +1324,40 @@ func scanJob(rows *sql.Rows, repoID string) (Job, error) {
 	return job, nil
 }
 
+// redactedJobConfig returns the configuration of a job (or schedule) of the
+// given type with the values of sensitive data source options, like
+// passwords, redacted, so that it can be shown to users. If the
+// configuration can't be decoded, it is omitted.
+func redactedJobConfig(jobType JobType, config string) string {
+	if jobType != JobTypeImport || config == "" {
+		return config
+	}
+	var importJob ImportJob
+	if err := json.Unmarshal([]byte(config), &importJob); err != nil {
+		return ""
+	}
+	for i, file := range importJob.Plan.Files {
+		ds, ok := dataSources[file.DataSourceName]
+		if !ok || len(file.DataSourceOptions) == 0 {
+			continue
+		}
+		dsOpt, err := ds.UnmarshalOptions(file.DataSourceOptions)
+		if err != nil {
+			return ""
+		}
+		redactedOpt, err := json.Marshal(configValue(reflect.ValueOf(dsOpt)))
+		if err != nil {
+			return ""
+		}
+		importJob.Plan.Files[i].DataSourceOptions = redactedOpt
+	}
+	redacted, err := json.Marshal(importJob)
+	if err != nil {
+		return ""
+	}
+	return string(redacted)
+}
+
 // Job is only to be used for shuttling job data in and out of the DB,
 // it should not be assumed to accurately reflect the current state of the
 // job. Mainly used for inserting a job row and getting a job row for the
@@ -1122,9 +1417,16 @@ type JobAction interface {
 type JobType string
 
 const (
-	JobTypeImport     JobType = "import"
-	JobTypeThumbnails JobType = "thumbnails"
-	JobTypeEmbeddings JobType = "embeddings"
+	JobTypeImport           JobType = "import"
+	JobTypeThumbnails       JobType = "thumbnails"
+	JobTypeEmbeddings       JobType = "embeddings"
+	JobTypeExport           JobType = "export"
+	JobTypeEntityResolution JobType = "entity_resolution"
+	JobTypeSync             JobType = "sync"
+	JobTypePolicies         JobType = "policies"
+	JobTypeEnrichment       JobType = "enrichment"
+	JobTypeBackup           JobType = "backup"
+	JobTypeRestore          JobType = "restore"
 )
 
 type JobState string
@@ -0,0 +1,209 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestResumeJob(t *testing.T) {
+	// an API data source that records which of its plan entries it imports
+	const dsName = "resume_test"
+	imported := make(chan string, 10)
+	dataSources[dsName] = DataSource{
+		Name:           dsName,
+		Title:          "Resume test",
+		NewOptions:     func() any { return new(string) },
+		NewAPIImporter: func() APIImporter { return recordingAPIImporter(imported) },
+	}
+	t.Cleanup(func() { delete(dataSources, dsName) })
+
+	ctx := context.Background()
+	tl, err := Create(ctx, filepath.Join(t.TempDir(), "repo"), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tl.Close() })
+
+	config, err := json.Marshal(ImportJob{Plan: ImportPlan{Files: []FileImport{
+		{DataSourceName: dsName, DataSourceOptions: json.RawMessage(`"first"`)},
+		{DataSourceName: dsName, DataSourceOptions: json.RawMessage(`"second"`)},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the job failed while importing the second entry of the plan
+	mustExec(t, tl, `INSERT INTO jobs (id, type, configuration, state, checkpoint) VALUES (1, ?, ?, ?, ?)`,
+		JobTypeImport, string(config), JobFailed, []byte(`{"outer_index":1,"data_source_checkpoint":"page 3"}`))
+
+	if err := tl.ResumeJob(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	tl.waitForActiveJobs()
+
+	close(imported)
+	var got []string
+	for entry := range imported {
+		got = append(got, entry)
+	}
+	if want := `second from "page 3"`; len(got) != 1 || got[0] != want {
+		t.Errorf("expected only %q to be imported after resuming, got %q", want, got)
+	}
+	var state JobState
+	if err := tl.db.QueryRow(`SELECT state FROM jobs WHERE id=1`).Scan(&state); err != nil || state != JobSucceeded {
+		t.Fatalf("expected resumed job to succeed, got %s (err=%v)", state, err)
+	}
+
+	if err := tl.ResumeJob(ctx, 1); err == nil {
+		t.Error("expected resuming a succeeded job to fail")
+	}
+}
+
+func TestImportPartialSuccess(t *testing.T) {
+	const dsName = "partial_test"
+	dataSources[dsName] = DataSource{
+		Name:  dsName,
+		Title: "Partial success test",
+		NewAPIImporter: func() APIImporter {
+			return graphsAPIImporter{
+				{Item: &Item{ID: "good", Timestamp: time.Now()}},
+				{Item: &Item{ID: "bad"}, Entity: &Entity{Name: "ambiguous"}}, // fails to process
+			}
+		},
+	}
+	t.Cleanup(func() { delete(dataSources, dsName) })
+
+	ctx := context.Background()
+	tl, err := Create(ctx, filepath.Join(t.TempDir(), "repo"), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tl.Close() })
+	tl.SetObfuscationFunc(func() (ObfuscationOptions, bool) { return ObfuscationOptions{}, false })
+
+	conn := new(recordingConn)
+	websocketLogOutputs.addConn(conn, subscriptionFilter{minLevel: zapcore.WarnLevel}, 0, -1)
+	defer websocketLogOutputs.RemoveConn(conn)
+
+	config, err := json.Marshal(ImportJob{Plan: ImportPlan{Files: []FileImport{{DataSourceName: dsName}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, tl, `INSERT INTO jobs (id, type, configuration) VALUES (1, ?, ?)`, JobTypeImport, string(config))
+	if err := tl.StartJob(ctx, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	tl.waitForActiveJobs()
+	if _, err := SyncLogs(time.Second); err != nil {
+		t.Log(err)
+	}
+
+	var outcome struct {
+		Msg       string
+		JobID     uint64 `json:"job_id"`
+		Succeeded int
+		Failed    int
+	}
+	for _, msg := range conn.messages() {
+		if bytes.Contains(msg, []byte(`"completed with warnings"`)) {
+			if err := json.Unmarshal(msg, &outcome); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if outcome.JobID != 1 || outcome.Succeeded != 1 || outcome.Failed != 1 {
+		t.Errorf("expected the job to be logged as completed with 1 item succeeded and 1 failed, got %+v", outcome)
+	}
+}
+
+// graphsAPIImporter sends its graphs down the pipeline.
+type graphsAPIImporter []*Graph
+
+func (graphsAPIImporter) Authenticate(context.Context, Account, any) error { return nil }
+
+func (graphs graphsAPIImporter) APIImport(ctx context.Context, _ Account, params ImportParams) error {
+	for _, g := range graphs {
+		select {
+		case params.Pipeline <- g:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// recordingAPIImporter sends the options and checkpoint of each import
+// on the channel.
+type recordingAPIImporter chan<- string
+
+func (recordingAPIImporter) Authenticate(context.Context, Account, any) error { return nil }
+
+func (imported recordingAPIImporter) APIImport(_ context.Context, _ Account, params ImportParams) error {
+	imported <- *params.DataSourceOptions.(*string) + " from " + string(params.Checkpoint)
+	return nil
+}
+
+func TestRedactedJobConfig(t *testing.T) {
+	type options struct {
+		Username string `json:"username"`
+		Password string `json:"password" sensitive:"true"`
+	}
+	const dsName = "redaction_test"
+	dataSources[dsName] = DataSource{Name: dsName, NewOptions: func() any { return new(options) }}
+	t.Cleanup(func() { delete(dataSources, dsName) })
+
+	config, err := json.Marshal(ImportJob{Plan: ImportPlan{Files: []FileImport{{
+		DataSourceName:    dsName,
+		DataSourceOptions: json.RawMessage(`{"username":"me","password":"hunter2"}`),
+	}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shown := redactedJobConfig(JobTypeImport, string(config))
+	if strings.Contains(shown, "hunter2") {
+		t.Errorf("expected password to be redacted, got %s", shown)
+	}
+	var importJob ImportJob
+	if err := json.Unmarshal([]byte(shown), &importJob); err != nil {
+		t.Fatal(err)
+	}
+	var opt map[string]string
+	if err := json.Unmarshal(importJob.Plan.Files[0].DataSourceOptions, &opt); err != nil {
+		t.Fatal(err)
+	}
+	if opt["username"] != "me" || opt["password"] != redacted {
+		t.Errorf("expected only the password to be redacted, got %v", opt)
+	}
+
+	if got := redactedJobConfig(JobTypeImport, "{"); got != "" {
+		t.Errorf("expected config that can't be decoded to be omitted, got %s", got)
+	}
+	if got := redactedJobConfig(JobTypeThumbnails, `{"x":1}`); got != `{"x":1}` {
+		t.Errorf("expected other job configs to be unchanged, got %s", got)
+	}
+}
@@ -19,12 +19,13 @@
 package timeline
 
 import (
-	"errors"
+	"maps"
 	"os"
-	"sync"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -32,106 +33,288 @@ import (
 // Log is the main process log. All named logs should be derivatives of
 // this logger. All log emissions should be sent through this logger or
 // one of its derivatives.
-var Log = newLogger()
+var Log = newLogger(defaultLogHistorySize)
 
 // newLogger returns a logger that writes to websocketLogOutputs
-// and the console, with JSON and console encoders, respectively.
+// and the console, with JSON and console encoders, respectively,
+// as well as to the log file, if one is set. The most recent
+// historySize messages sent to websocketLogOutputs are kept, so that
+// clients which connect mid-import can be shown what already happened
+// (see SetLogHistorySize).
 // It is intended for setting up the main process logger during
 // the program's init phase.
-func newLogger() *zap.Logger {
-	websocketsSync := zapcore.AddSync(websocketLogOutputs)
+func newLogger(historySize int) *zap.Logger {
+	websocketLogOutputs.history.resize(historySize)
 
-	websocketsOut := zapcore.Lock(websocketsSync)
-	consoleOut := zapcore.Lock(os.Stderr)
+	jsonEncoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+
+	core := newCustomCore(
+		&cliProgressCore{Core: zapcore.NewCore(newConsoleEncoder(), console, consoleLevel)}, // debug by default; see SetConsoleLevel()
+		newCustomizableUICore(jsonEncoder, logPoolFanout{}, uiLevel),                        // sent to web frontend / UI; see SetUIEncoder() and Pool()
+		newFileCore(fileLevel), // only enabled if a log file is set; see SetLogFile()
+		new(sinksCore),         // only enabled if sinks are added; see addLogSink()
+	)
+
+	// caller is only shown on the console if enabled; see SetShowCaller()
+	return zap.New(core, zap.AddCaller(), zap.WithClock(logClock{}))
+}
 
+// newCustomCore returns a core that writes to all the outputs, in order,
+// sampling entries as described by customCore.
+func newCustomCore(outputs ...zapcore.Core) *customCore {
+	core := zapcore.NewTee(outputs...)
+
+	perOutputSampled := make([]zapcore.Core, 0, len(outputs))
+	perOutputLiveJobProgress := make([]zapcore.Core, 0, len(outputs))
+	for _, out := range outputs {
+		perOutputSampled = append(perOutputSampled, newSampledCore(out))
+		perOutputLiveJobProgress = append(perOutputLiveJobProgress, newLiveJobProgressCore(out))
+	}
+
+	return &customCore{
+		Core:                         newSampledCore(core),
+		nonSamplingCore:              core,
+		liveJobProgressCore:          newLiveJobProgressCore(core),
+		perOutputCore:                zapcore.NewTee(perOutputSampled...),
+		perOutputLiveJobProgressCore: zapcore.NewTee(perOutputLiveJobProgress...),
+		progressThrottle:             liveProgressThrottle,
+		sampling:                     &configurableSampling{outputs: outputs},
+	}
+}
+
+// newConsoleEncoder returns the encoder for console output.
+func newConsoleEncoder() zapcore.Encoder {
+	return newConsoleEncoderWithLevels(zapcore.CapitalColorLevelEncoder)
+}
+
+// newConsoleEncoderWithLevels returns an encoder like the one for console
+// output, except that levels are encoded by encodeLevel.
+func newConsoleEncoderWithLevels(encodeLevel zapcore.LevelEncoder) zapcore.Encoder {
 	encCfg := zap.NewProductionEncoderConfig()
 	encCfg.EncodeTime = func(ts time.Time, encoder zapcore.PrimitiveArrayEncoder) {
 		encoder.AppendString(ts.UTC().Format("2006/01/02 15:04:05.000"))
 	}
-	encCfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
-	consoleEncoder := zapcore.NewConsoleEncoder(encCfg)
-	jsonEncoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	encCfg.EncodeLevel = encodeLevel
+	return consoleEncoder{zapcore.NewConsoleEncoder(encCfg)}
+}
 
-	core := zapcore.NewTee(
-		zapcore.NewCore(consoleEncoder, consoleOut, zap.DebugLevel), // TODO: keep at debug? make this optional?
-		zapcore.NewCore(jsonEncoder, websocketsOut, zap.InfoLevel),  // sent to web frontend / UI
-	)
+// eventLog is Log for the exported Log* helpers (such as LogDiscovery) to
+// log their entries with, so that the caller of the helper is reported as
+// the caller of its entries, not the helper itself.
+var eventLog = Log.WithOptions(zap.AddCallerSkip(1))
+
+// internalLog is for problems with the logging system itself. It only
+// writes to the console, so it is safe to use from within the other
+// log outputs (for example, while the websocket output is locked).
+var internalLog = zap.New(zapcore.NewCore(newConsoleEncoder(), console, consoleLevel)).Named("logging")
+
+// console is the output for the console core.
+var console = newConsoleSink(os.Stderr)
 
-	// the embedded core avoids a firehose of logs, but we still need an unsampled core for UI updates and such, where every message is critical
-	// (the critical messages are defined in the Check() method of our Core type)
-	const sampledLogInterval, sampledLiveJobProgressInterval, sampledLiveJobProgressCount = 250 * time.Millisecond, 100 * time.Millisecond, 2
-	return zap.New(&customCore{
-		Core:                zapcore.NewSamplerWithOptions(core, sampledLogInterval, 1, 0),
-		nonSamplingCore:     core,
-		liveJobProgressCore: zapcore.NewSamplerWithOptions(core, sampledLiveJobProgressInterval, sampledLiveJobProgressCount, 0),
-	})
+// The minimum levels of the console, UI, and file outputs, which can be
+// changed at runtime with SetOutputLevels.
+var (
+	consoleLevel = outputLevel(func(levels OutputLevels) zapcore.Level { return levels.Console })
+	uiLevel      = outputLevel(func(levels OutputLevels) zapcore.Level { return levels.UI })
+	fileLevel    = outputLevel(func(levels OutputLevels) zapcore.Level { return levels.File })
+)
+
+// outputLevels are the current levels of all outputs. They are replaced
+// as a whole when they change, so that entries logged concurrently with
+// a change see either the old or the new levels, never a mix of both.
+var outputLevels = func() *atomic.Pointer[OutputLevels] {
+	var p atomic.Pointer[OutputLevels]
+	p.Store(&OutputLevels{Console: zap.DebugLevel, UI: zap.InfoLevel, File: zap.InfoLevel})
+	return &p
+}()
+
+// outputLevel is the minimum level of one of the outputs.
+type outputLevel func(OutputLevels) zapcore.Level
+
+func (l outputLevel) Enabled(level zapcore.Level) bool { return level >= l.Level() }
+
+func (l outputLevel) Level() zapcore.Level { return l(*outputLevels.Load()) }
+
+// the embedded core avoids a firehose of logs, but we still need an unsampled core for UI updates and such, where every message is critical
+// (the critical messages are defined in the Check() method of our Core type)
+const sampledLogInterval, sampledLiveJobProgressInterval, sampledLiveJobProgressCount = 250 * time.Millisecond, 100 * time.Millisecond, 2
+
+// uiCore is like the core returned by zapcore.NewCore(), except that
+// context fields are not encoded until an entry is written, so that
+// fields that are not on the allowlist (if any) can be dropped from
+// the output sent to the UI, regardless of when the fields were added.
+type uiCore struct {
+	zapcore.LevelEnabler
+	enc    zapcore.Encoder
+	out    entryWriter
+	fields []zapcore.Field
+
+	// if true, enc is only the default; see SetUIEncoder
+	customizable bool
+}
+
+// entryWriter is an output that gets the metadata of each entry along
+// with the encoded entry, so that it can route entries without having
+// to decode them. It must be safe for concurrent use.
+type entryWriter interface {
+	writeEntry(ent zapcore.Entry, meta entryMeta, p []byte) error
+	Sync() error
 }
 
-// multiConnWriter is like io.multiWriter from the standard lib,
-// except this supports dynamically adding and removing writers
-// and is specifically for WebSocket connections and Wails
-// application events.
-//
-// This is a "best-effort" multi-writer. If there is an error writing
-// to one conn, it does not abort and will continue to write to the
-// other conns. Write errors are discarded, but write errors that are
-// specifically closed connections will result in that connection
-// being removed from the pool.
-type multiConnWriter struct {
-	conns   []*websocket.Conn
-	connsMu sync.RWMutex
+// entryMeta is information about an entry that is derived from its
+// fields, for routing it to subscribers.
+type entryMeta struct {
+	jobID    uint64 // 0 if the entry is not associated with a job
+	jobState string // the "state" field of job entries, if any
+	itemRef  string // empty if the entry is not associated with an item
 }
 
-func (mw *multiConnWriter) Write(p []byte) (n int, err error) {
-	mw.connsMu.RLock()
-	for _, w := range mw.conns {
-		err = w.WriteMessage(websocket.TextMessage, p)
-		// the handler that added this connection to the pool should
-		// have removed it when it was closed, but just in case we
-		// find out first that it was closed, we can remove it now
-		if errors.Is(err, websocket.ErrCloseSent) {
-			defer mw.RemoveConn(w)
+// newEntryMeta returns the metadata for an entry with the given fields.
+// Like customCore.entryJobID, the job is identified by a "job_id" field,
+// or an "id" field if the logger is a job logger. The item is identified
+// by an "item_ref" field (see ItemLogger), or a string "item_id" field.
+func newEntryMeta(ent zapcore.Entry, fieldLists ...[]zapcore.Field) entryMeta {
+	var meta entryMeta
+	var id uint64
+	var itemID string
+	for _, fields := range fieldLists {
+		for _, f := range fields {
+			switch f.Key {
+			case "job_id":
+				meta.jobID, _ = uint64Field(f)
+			case "id":
+				id, _ = uint64Field(f)
+			case "state":
+				if f.Type == zapcore.StringType {
+					meta.jobState = f.String
+				}
+			case itemRefKey:
+				meta.itemRef = f.String
+			case "item_id":
+				if f.Type == zapcore.StringType {
+					itemID = f.String
+				}
+			}
 		}
 	}
-	mw.connsMu.RUnlock()
-	return len(p), err
+	if meta.jobID == 0 && strings.HasPrefix(ent.LoggerName, "job") {
+		meta.jobID = id
+	}
+	if meta.itemRef == "" {
+		meta.itemRef = itemID
+	}
+	return meta
+}
+
+func newUICore(enc zapcore.Encoder, out entryWriter, enab zapcore.LevelEnabler) *uiCore {
+	return &uiCore{LevelEnabler: enab, enc: enc, out: out}
 }
 
-// AddConn subscribes conn to writes.
-func (mw *multiConnWriter) AddConn(conn *websocket.Conn) {
-	mw.connsMu.Lock()
-	mw.conns = append(mw.conns, conn)
-	mw.connsMu.Unlock()
+// newCustomizableUICore is like newUICore, except that enc is replaced
+// by the encoder set with SetUIEncoder, if any.
+func newCustomizableUICore(enc zapcore.Encoder, out entryWriter, enab zapcore.LevelEnabler) *uiCore {
+	return &uiCore{LevelEnabler: enab, enc: enc, out: out, customizable: true}
 }
 
-// RemoveConn unsubscribes conn from writes, if it is subscribed.
-func (mw *multiConnWriter) RemoveConn(conn *websocket.Conn) {
-	mw.connsMu.Lock()
-	for i, mww := range mw.conns {
-		if mww == conn {
-			mw.conns = append(mw.conns[:i], mw.conns[i+1:]...)
-			break
+func (c *uiCore) With(fields []zapcore.Field) zapcore.Core {
+	return &uiCore{
+		LevelEnabler: c.LevelEnabler,
+		enc:          c.enc,
+		out:          c.out,
+		fields:       append(slices.Clip(c.fields), fields...),
+		customizable: c.customizable,
+	}
+}
+
+func (c *uiCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *uiCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if !uiShowCaller.Load() {
+		ent.Caller = zapcore.EntryCaller{}
+	}
+	meta := newEntryMeta(ent, c.fields, fields)
+	fields = allowedUIFields(c.fields, fields)
+	enc, buf, err := c.encodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	if limit := int(maxWSMessageBytes.Load()); limit > 0 && buf.Len() > limit {
+		// protect the stream from outlier entries by sending a smaller version
+		size := buf.Len()
+		buf.Free()
+		buf, err = encodeOversized(enc, ent, fields, size, limit)
+		if err != nil {
+			return err
 		}
 	}
-	mw.connsMu.Unlock()
+	err = c.out.writeEntry(ent, meta, buf.Bytes())
+	buf.Free()
+	if err != nil {
+		return err
+	}
+	if ent.Level > zapcore.ErrorLevel {
+		// like zapcore's ioCore, sync since we may be about to crash
+		_ = c.out.Sync()
+	}
+	return nil
 }
 
-// websocketLogOutputs mediates the list of active
-// websocket connections that are receiving process
-// logs.
-var websocketLogOutputs = new(multiConnWriter)
+func (c *uiCore) Sync() error { return c.out.Sync() }
 
-// AddLogConn subscribes conn to the log output. When
-// the conn is closed, it should be removed with
-// RemoveLogConn().
-func AddLogConn(conn *websocket.Conn) {
-	websocketLogOutputs.AddConn(conn)
+// SetUIFieldAllowlist restricts the fields sent to the UI (the websocket
+// output) to only those with the given keys; all other fields are dropped.
+// The entry's level, message, logger name, etc. are always included. This
+// reduces bandwidth and leakage of data into a minimal UI stream. Other
+// outputs, such as the console, continue to get all fields. Calling this
+// with no keys (the default) allows all fields.
+func SetUIFieldAllowlist(keys ...string) {
+	var prev *map[string]struct{}
+	if len(keys) == 0 {
+		prev = uiFieldAllowlist.Swap(nil)
+	} else {
+		allowed := make(map[string]struct{}, len(keys))
+		for _, k := range keys {
+			allowed[k] = struct{}{}
+		}
+		prev = uiFieldAllowlist.Swap(&allowed)
+	}
+	var prevKeys []string
+	if prev != nil {
+		prevKeys = slices.Sorted(maps.Keys(*prev))
+	}
+	var newKeys []string
+	if len(keys) > 0 {
+		newKeys = slices.Compact(slices.Sorted(slices.Values(keys)))
+	}
+	logConfigChange("ui_field_allowlist", prevKeys, newKeys)
 }
 
-// RemoveLogConn removes conn from receiving logs.
-// It is idempotent.
-func RemoveLogConn(conn *websocket.Conn) {
-	websocketLogOutputs.RemoveConn(conn)
+var uiFieldAllowlist atomic.Pointer[map[string]struct{}]
+
+// allowedUIFields returns the context and entry fields combined,
+// without any fields that are not on the UI field allowlist.
+func allowedUIFields(context, fields []zapcore.Field) []zapcore.Field {
+	allowlist := uiFieldAllowlist.Load()
+	if allowlist == nil {
+		if len(context) == 0 {
+			return fields
+		}
+		return append(slices.Clip(context), fields...)
+	}
+	allowed := make([]zapcore.Field, 0, len(context)+len(fields))
+	for _, list := range [][]zapcore.Field{context, fields} {
+		for _, f := range list {
+			if _, ok := (*allowlist)[f.Key]; ok {
+				allowed = append(allowed, f)
+			}
+		}
+	}
+	return allowed
 }
 
 // customCore wraps another zapcore.Core and prevents sampling based on logger name.
@@ -139,26 +322,421 @@ type customCore struct {
 	zapcore.Core
 	nonSamplingCore     zapcore.Core
 	liveJobProgressCore zapcore.Core
+
+	// like Core and liveJobProgressCore, except each output is
+	// sampled independently; used unless sampling is consistent
+	perOutputCore                zapcore.Core
+	perOutputLiveJobProgressCore zapcore.Core
+
+	// throttles live job progress further when it comes in too fast
+	// for even the live progress sampler (shared by all derivatives)
+	progressThrottle *adaptiveSampler
+
+	// the samplers used instead of the ones above while sampling is
+	// configured (see SetSamplingConfig); sampling is shared by all
+	// derivatives, and nil if the core can't be configured
+	sampling   *configurableSampling
+	configured atomic.Pointer[samplerSet]
+
+	// values of relevant context fields added with With(), so that
+	// entries can be associated with a job; jobID is from a "job_id"
+	// field, and id is from an "id" field, which the job loggers use
+	jobID, id uint64
+
+	// the context fields added with With(), for matching sampling
+	// exemptions (see ExemptFromSampling)
+	fields []zapcore.Field
+
+	// whether the entries are pinned (see Pinned), because a "pinned"
+	// field was added with With(), so they are never sampled
+	pinned bool
+
+	// whether the global fields (see SetGlobalFields) have been added
+	// to this core; if not, a derivative that has them is cached here
+	hasGlobalFields bool
+	withGlobals     atomic.Pointer[globalFieldsCore]
+
+	// the tags added with With() (see Tags), which are merged instead
+	// of being added as fields until the entry is checked, at which
+	// point a derivative that has them as a field is used (and cached)
+	tags        tagList
+	tagsApplied bool
+	tagged      atomic.Pointer[customCore]
 }
 
 func (c *customCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
-	if ent.LoggerName == "job.status" {
+	if loggingDisabled.Load() {
+		discardedEntries.Add(1)
+		return ce
+	}
+
+	if !c.hasGlobalFields {
+		if fields := globalFields.Load(); fields != nil {
+			return c.withGlobalFields(fields).Check(ent, ce)
+		}
+	}
+	if len(c.tags) > 0 && !c.tagsApplied {
+		return c.withTags().Check(ent, ce)
+	}
+
+	// entries logged in a critical section are held until it's over,
+	// except errors, which are too important to delay or lose (see
+	// WithLogSuppressed)
+	if ent.Level < zapcore.ErrorLevel && c.Enabled(ent.Level) {
+		if held := suppressedLogs(); held != nil {
+			return ce.AddCore(ent, suppressingCore{c, held})
+		}
+	}
+
+	core := c
+
+	// Check is called from the goroutine that is logging the entry
+	if goroutineIDs.Load() {
+		core = core.With([]zapcore.Field{zap.Uint64("goid", goroutineID())}).(*customCore)
+	}
+
+	// known-benign messages may be configured to be logged at a lower
+	// level, and whole subsystems at a different level
+	original := ent.Level
+	if level, ok := overriddenLevel(ent); ok {
+		ent.Level = level
+	}
+	if level, ok := remappedLevel(ent); ok {
+		ent.Level = level
+	}
+	if ent.Level != original {
+		core = core.With([]zapcore.Field{zap.Stringer("level_overridden_from", original)}).(*customCore)
+	}
+
+	// stray errors from a job that was just canceled are usually just
+	// fallout from the cancellation, so don't alarm the user with them
+	if ent.Level == zapcore.ErrorLevel {
+		if jobID := c.entryJobID(ent); jobID > 0 && canceledJobs.contains(jobID) {
+			ent.Level = zapcore.WarnLevel
+			core = core.With([]zapcore.Field{zap.Bool("post_cancel", true)}).(*customCore)
+		}
+	}
+
+	// further errors from a job are usually caused by its first one,
+	// so they can be suppressed to keep the actionable one in focus
+	if ent.Level == zapcore.ErrorLevel && jobFirstErrorOnly.Load() && !isLoggerOrDescendant(ent.LoggerName, "job.status") {
+		if jobID := c.entryJobID(ent); jobID > 0 && !noteJobError(jobID) {
+			ent.Level = zapcore.DebugLevel
+			core = core.With([]zapcore.Field{zap.Bool("suppressed_error", true)}).(*customCore)
+		}
+	}
+
+	// a runaway job can be cut off (see SetJobLogBudget), but its errors and
+	// status updates are still needed, as is the warning that it was cut off
+	if ent.Level < zapcore.ErrorLevel && c.Enabled(ent.Level) && !isLoggerOrDescendant(ent.LoggerName, "job.status") && ent.LoggerName != "job.budget" {
+		if jobID := c.entryJobID(ent); jobID > 0 && !spendJobLogBudget(jobID) {
+			logMetrics.sampledOut.Add(1)
+			return ce
+		}
+	}
+
+	// errors from jobs are probably because of the network if we're offline
+	// (see EnableConnectivityMonitor), which the UI can explain to the user
+	if ent.Level >= zapcore.ErrorLevel && networkOffline.Load() && c.entryJobID(ent) > 0 {
+		core = core.With([]zapcore.Field{zap.Bool("offline", true)}).(*customCore)
+	}
+
+	// milestones stay visible in the UI (see Pinned)
+	if !core.pinned && pinnedByDefault(ent) {
+		core = core.With([]zapcore.Field{PinnedField}).(*customCore)
+	}
+
+	// call sites that format values into messages are only known once
+	// the entry is written (see SetStrictMessages)
+	if strictMessages.Load() && c.Enabled(ent.Level) && interpolatedMessage.MatchString(ent.Message) {
+		ce = ce.AddCore(ent, strictMessageCore{c})
+	}
+
+	return core.check(ent, ce)
+}
+
+// check routes the entry through the transforms, if there are any, or
+// directly to the appropriate core otherwise.
+func (c *customCore) check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		logMetrics.countEntry(ent.Level)
+		logMetrics.countNamedEntry(ent.LoggerName)
+	}
+	transforms := logTransforms.Load()
+	if transforms != nil || samplingExemptions.Load() != nil || logDedup.enabled() {
+		// the fields aren't known until the entry is written, so defer
+		// routing until the transforms have been applied, exemptions
+		// can be matched, and duplicates found (see transformCore)
+		if !c.Enabled(ent.Level) {
+			return ce
+		}
+		var ts []LogTransform
+		if transforms != nil {
+			ts = *transforms
+		}
+		return ce.AddCore(ent, transformCore{c, ts})
+	}
+	return c.route(ent, ce, nil)
+}
+
+// route routes the entry to the appropriate core based on logger name
+// and message. The fields given at the log call site are only known if
+// routing was deferred until the entry is written; otherwise they are nil.
+func (c *customCore) route(ent zapcore.Entry, ce *zapcore.CheckedEntry, fields []zapcore.Field) *zapcore.CheckedEntry {
+	if c.pinned {
+		return ce.AddCore(ent, c.nonSamplingCore)
+	}
+	if _, ok := unsampledLoggers[ent.LoggerName]; ok {
 		// always allow through, no sampling -- otherwise UI gets out of sync
 		return ce.AddCore(ent, c.nonSamplingCore)
 	}
-	if ent.LoggerName == "job.action" && (ent.Message == "finished graph" || ent.Message == "finished thumbnail") {
-		return c.liveJobProgressCore.Check(ent, ce)
+	if ent.LoggerName == "job.checkpoint" && ent.Level >= zapcore.ErrorLevel {
+		// a failing checkpoint breaks resumption, so every one counts
+		return ce.AddCore(ent, c.nonSamplingCore)
+	}
+	cfg := samplingConfig.Load()
+	if cfg != nil {
+		if _, ok := cfg.unsampled[ent.LoggerName]; ok {
+			return ce.AddCore(ent, c.nonSamplingCore)
+		}
+	}
+	if exemptions := samplingExemptions.Load(); exemptions != nil && exemptFromSampling(*exemptions, c.fields, fields) {
+		return c.nonSamplingCore.Check(ent, ce)
+	}
+	sampledCore, liveJobProgressCore := c.Core, c.liveJobProgressCore
+	if !consistentSampling.Load() {
+		sampledCore, liveJobProgressCore = c.perOutputCore, c.perOutputLiveJobProgressCore
+	}
+	if cfg != nil {
+		if s := c.configuredSamplers(cfg); s != nil {
+			sampledCore, liveJobProgressCore = s.sampled, s.liveJobProgress
+			if !consistentSampling.Load() {
+				sampledCore, liveJobProgressCore = s.perOutputSampled, s.perOutputLiveProgress
+			}
+		}
+		if _, ok := cfg.liveProgress[LogMessageRoute{ent.LoggerName, ent.Message}]; ok {
+			if c.progressThrottle != nil && !c.progressThrottle.allow(ent.Message, ent.Time) {
+				logMetrics.sampledOut.Add(1)
+				return ce
+			}
+			return liveJobProgressCore.Check(ent, ce)
+		}
+	}
+	if ent.LoggerName == "job.action" {
+		switch ent.Message {
+		case "finished graph", "finished thumbnail", progressMessage:
+			if c.progressThrottle != nil && !c.progressThrottle.allow(ent.Message, ent.Time) {
+				logMetrics.sampledOut.Add(1)
+				return ce
+			}
+			return liveJobProgressCore.Check(ent, ce)
+		case indeterminateProgressMessage:
+			// there's no bar to keep accurate, just a spinner to keep
+			// alive, so one update per job in each interval is plenty
+			if !indeterminateProgressThrottle.allow(c.entryJobID(ent), ent.Time) {
+				logMetrics.sampledOut.Add(1)
+				return ce
+			}
+			return liveJobProgressCore.Check(ent, ce)
+		case mediaProgressMessage:
+			// the pipeline's numbers change with every asset, so one
+			// update per job in each interval is plenty
+			if !mediaProgressThrottle.allow(c.entryJobID(ent), ent.Time) {
+				logMetrics.sampledOut.Add(1)
+				return ce
+			}
+			return liveJobProgressCore.Check(ent, ce)
+		case fileProgressMessage:
+			// already throttled for each file (see LogFileProgress)
+			return liveJobProgressCore.Check(ent, ce)
+		case fileFinishedMessage:
+			return ce.AddCore(ent, c.nonSamplingCore)
+		}
 	}
-	return c.Core.Check(ent, ce)
+	return sampledCore.Check(ent, ce)
+}
+
+// unsampledLoggers are the names of loggers whose entries are
+// critical for keeping the UI in sync, or that are records which
+// must not be lost (such as the audit stream), so they are never
+// sampled.
+var unsampledLoggers = map[string]struct{}{
+	"job.status":      {},
+	"job.tree":        {},
+	"job.canceled":    {},
+	"job.waiting":     {},
+	"job.conflict":    {},
+	"job.outcome":     {},
+	"job.resume":      {},
+	"job.budget":      {},
+	"log.config":      {},
+	"quota":           {},
+	"audit":           {},
+	"perf":            {},
+	"perf.phase":      {},
+	"startup":         {},
+	"system":          {},
+	"storage":         {},
+	"network":         {},
+	"discovery":       {},
+	"pagination":      {},
+	"migration":       {},
+	"pool":            {},
+	"thumbnail.cache": {},
+	"auth":            {},
 }
 
 // With is a promotion of the embedded Core.With() method so that we can ensure
 // derivative loggers are our type, not the embedded type, to preserve our other
 // promoted methods like Check()...
 func (c *customCore) With(fields []zapcore.Field) zapcore.Core {
-	return &customCore{
+	tags := c.tags
+	if !c.tagsApplied {
+		fields = slices.DeleteFunc(slices.Clone(fields), func(f zapcore.Field) bool {
+			more, ok := tagsFromField(f)
+			if ok {
+				tags = mergeTags(tags, more)
+			}
+			return ok
+		})
+	}
+	derived := &customCore{
 		Core:                c.Core.With(fields),
 		nonSamplingCore:     c.nonSamplingCore.With(fields),
 		liveJobProgressCore: c.liveJobProgressCore.With(fields),
+
+		perOutputCore:                c.perOutputCore.With(fields),
+		perOutputLiveJobProgressCore: c.perOutputLiveJobProgressCore.With(fields),
+
+		progressThrottle: c.progressThrottle,
+		sampling:         c.sampling,
+		jobID:            c.jobID,
+		id:               c.id,
+		fields:           slices.Concat(c.fields, fields),
+		pinned:           c.pinned,
+		hasGlobalFields:  c.hasGlobalFields,
+		tags:             tags,
+		tagsApplied:      c.tagsApplied,
+	}
+	for _, f := range fields {
+		switch f.Key {
+		case "job_id":
+			derived.jobID, _ = uint64Field(f)
+		case "id":
+			derived.id, _ = uint64Field(f)
+		case pinnedKey:
+			derived.pinned = isPinnedField(f)
+		}
+	}
+	return derived
+}
+
+// withGlobalFields returns a derivative of c with the global fields added.
+// The derivative is cached until the global fields are changed.
+func (c *customCore) withGlobalFields(fields *[]zapcore.Field) *customCore {
+	if cached := c.withGlobals.Load(); cached != nil && cached.fields == fields {
+		return cached.core
+	}
+	derived := c.With(*fields).(*customCore)
+	derived.hasGlobalFields = true
+	c.withGlobals.Store(&globalFieldsCore{fields: fields, core: derived})
+	return derived
+}
+
+// globalFieldsCore is a core derived with a set of global fields.
+type globalFieldsCore struct {
+	fields *[]zapcore.Field
+	core   *customCore
+}
+
+// entryJobID returns the ID of the job the entry is associated with, or 0
+// if unknown. The job loggers identify their job with an "id" field, but
+// since that key is generic, it is only honored for loggers named "job...".
+func (c *customCore) entryJobID(ent zapcore.Entry) uint64 {
+	if c.jobID > 0 {
+		return c.jobID
+	}
+	if strings.HasPrefix(ent.LoggerName, "job") {
+		return c.id
+	}
+	return 0
+}
+
+// uint64Field returns the value of f if it is a non-negative integer field.
+func uint64Field(f zapcore.Field) (uint64, bool) {
+	switch f.Type {
+	case zapcore.Uint64Type, zapcore.Uint32Type, zapcore.Uint16Type, zapcore.Uint8Type, zapcore.UintptrType:
+		return uint64(f.Integer), true
+	case zapcore.Int64Type, zapcore.Int32Type, zapcore.Int16Type, zapcore.Int8Type:
+		if f.Integer >= 0 {
+			return uint64(f.Integer), true
+		}
+	}
+	return 0, false
+}
+
+// liveProgressThrottle is the adaptive sampler for live job progress
+// entries; it is package-level so its state can be reported in stats.
+var liveProgressThrottle = newAdaptiveSampler(sampledLiveJobProgressInterval,
+	adaptiveProgressMaxInterval, adaptiveProgressRateThreshold)
+
+// LoggingStats contains statistics about the logging subsystem.
+type LoggingStats struct {
+	// The current sampling interval for each live job progress
+	// message, which is adjusted according to how fast the
+	// messages are being emitted.
+	AdaptiveProgressIntervals map[string]time.Duration `json:"adaptive_progress_intervals,omitempty"`
+
+	// How many items have been skipped during imports, by reason.
+	SkippedItems map[SkipReason]uint64 `json:"skipped_items,omitempty"`
+
+	// How many entries have been logged, by level, and how many
+	// of them were dropped by sampling.
+	Entries    map[zapcore.Level]uint64 `json:"entries,omitempty"`
+	SampledOut uint64                   `json:"sampled_out,omitempty"`
+
+	// How many entries were let through or dropped by sampling, by
+	// the first two segments of the logger name (see EntryCountsByName).
+	Sampling map[string]LogSamplingCounts `json:"sampling,omitempty"`
+
+	// The number of log subscribers (in all pools), how many writes to subscribers
+	// have failed, and how many messages were dropped for subscribers
+	// that could not keep up.
+	Subscribers     int    `json:"subscribers"`
+	WriteErrors     uint64 `json:"write_errors,omitempty"`
+	SubscriberDrops uint64 `json:"subscriber_drops,omitempty"`
+
+	// How many bytes the log history and subscriber queues are using,
+	// the budget for them (see SetLogMemoryBudget), and how many
+	// messages have been evicted or dropped to stay within it.
+	MemoryUsage   int64  `json:"memory_usage"`
+	MemoryBudget  int64  `json:"memory_budget,omitempty"`
+	MemoryEvicted uint64 `json:"memory_evicted,omitempty"`
+
+	// How messages sent to log subscribers have been batched, if
+	// batching has been enabled (see SetLogBatching).
+	Batching *LogBatchStats `json:"batching,omitempty"`
+
+	// The ratio of thumbnails that were already generated
+	// when they were needed, to all that were needed.
+	ThumbnailCacheHitRatio float64 `json:"thumbnail_cache_hit_ratio,omitempty"`
+}
+
+// LogStats returns current statistics about the logging subsystem.
+func LogStats() LoggingStats {
+	return LoggingStats{
+		AdaptiveProgressIntervals: liveProgressThrottle.intervals(),
+		SkippedItems:              SkipCounts(),
+		Entries:                   logMetrics.entriesByLevel(),
+		SampledOut:                logMetrics.sampledOut.Load(),
+		Subscribers:               logSubscriberCount(),
+		Sampling:                  logMetrics.samplingCounts(),
+		WriteErrors:               logMetrics.writeErrors.Load(),
+		SubscriberDrops:           logMetrics.subscriberDrops.Load(),
+		MemoryUsage:               logMemory.usage(),
+		MemoryBudget:              logMemory.budget.Load(),
+		MemoryEvicted:             logMemory.evicted.Load(),
+		Batching:                  logMetrics.batchStats(),
+		ThumbnailCacheHitRatio:    thumbnailCache.hitRatio(),
 	}
 }
@@ -0,0 +1,2165 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestConsistentSampling(t *testing.T) {
+	SetConsistentSampling(true)
+	defer SetConsistentSampling(false)
+
+	// stand-ins for the console, WebSocket, and file outputs
+	console, consoleLogs := observer.New(zapcore.DebugLevel)
+	websocket, websocketLogs := observer.New(zapcore.DebugLevel)
+	file, fileLogs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(console, websocket, file))
+
+	const emitted = 1000
+	for i := range emitted {
+		logger.Info("sampled message", zap.Int("i", i))
+		logger.Named("job.action").Info("finished graph", zap.Int("i", i))
+		logger.Named("job.status").Info("unsampled message", zap.Int("i", i))
+	}
+
+	want := entrySet(consoleLogs.AllUntimed())
+	if len(want) >= 3*emitted {
+		t.Fatalf("expected some entries to be sampled out, but got all %d", len(want))
+	}
+	for name, logs := range map[string]*observer.ObservedLogs{
+		"websocket": websocketLogs,
+		"file":      fileLogs,
+	} {
+		got := entrySet(logs.AllUntimed())
+		if len(got) != len(want) {
+			t.Errorf("%s output has %d entries, but console has %d", name, len(got), len(want))
+		}
+		for key := range want {
+			if _, ok := got[key]; !ok {
+				t.Errorf("%s output is missing entry that console has: %s", name, key)
+			}
+		}
+	}
+}
+
+func entrySet(entries []observer.LoggedEntry) map[string]struct{} {
+	set := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		set[fmt.Sprintf("%s|%s|%v", e.LoggerName, e.Message, e.ContextMap())] = struct{}{}
+	}
+	return set
+}
+
+func TestECSEncoder(t *testing.T) {
+	enc := newECSEncoder()
+	enc.AddString("repo_id", "abc") // context field, as if added with With()
+
+	ent := zapcore.Entry{
+		Level:      zapcore.WarnLevel,
+		Time:       time.Date(2024, 5, 6, 7, 8, 9, 0, time.FixedZone("test", 3600)),
+		LoggerName: "job.action",
+		Message:    "something happened",
+		Caller:     zapcore.NewEntryCaller(0, "timeline/jobs.go", 42, true),
+	}
+	buf, err := enc.EncodeEntry(ent, []zapcore.Field{
+		zap.Int("count", 3),
+		zap.Object("item", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			enc.AddString("id", "xyz")
+			return nil
+		})),
+	})
+	if err != nil {
+		t.Fatalf("encoding entry: %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("entry is not valid JSON: %v: %s", err, buf.String())
+	}
+
+	for _, tc := range []struct {
+		path []string
+		want any
+	}{
+		{path: []string{"@timestamp"}, want: "2024-05-06T06:08:09Z"},
+		{path: []string{"message"}, want: "something happened"},
+		{path: []string{"log", "level"}, want: "warn"},
+		{path: []string{"log", "logger"}, want: "job.action"},
+		{path: []string{"log", "origin", "file", "name"}, want: "timeline/jobs.go"},
+		{path: []string{"log", "origin", "file", "line"}, want: 42.0},
+		{path: []string{"ecs", "version"}, want: ecsSchemaVersion},
+		{path: []string{"repo_id"}, want: "abc"},
+		{path: []string{"count"}, want: 3.0},
+		{path: []string{"item", "id"}, want: "xyz"},
+	} {
+		var val any = got
+		for _, key := range tc.path {
+			obj, ok := val.(map[string]any)
+			if !ok {
+				val = nil
+				break
+			}
+			val = obj[key]
+		}
+		if val != tc.want {
+			t.Errorf("%v = %#v, want %#v (entry: %s)", tc.path, val, tc.want, buf.String())
+		}
+	}
+
+	// the native metadata keys should not be present
+	for _, key := range []string{"ts", "level", "msg", "logger", "caller"} {
+		if _, ok := got[key]; ok {
+			t.Errorf("unexpected non-ECS key %q in entry: %s", key, buf.String())
+		}
+	}
+}
+
+func TestConnErrorThreshold(t *testing.T) {
+	const threshold = 3
+	SetConnErrorThreshold(threshold)
+	defer SetConnErrorThreshold(defaultConnErrorThreshold)
+
+	dropped := make(chan error, 1)
+	SetLogConnDropHandler(func(_ LogSubscriberInfo, err error) { dropped <- err })
+	defer SetLogConnDropHandler(nil)
+
+	for _, tc := range []struct {
+		name        string
+		failures    []bool // whether each write fails
+		wantRemoved bool
+	}{
+		{
+			name:        "below threshold",
+			failures:    []bool{true, true},
+			wantRemoved: false,
+		},
+		{
+			name:        "reaches threshold",
+			failures:    []bool{true, true, true},
+			wantRemoved: true,
+		},
+		{
+			name:        "success resets count",
+			failures:    []bool{true, true, false, true, true, false},
+			wantRemoved: false,
+		},
+		{
+			name:        "reaches threshold after reset",
+			failures:    []bool{true, false, true, true, true},
+			wantRemoved: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mw := new(multiConnWriter)
+			conn := &failingConn{failures: tc.failures}
+			mw.AddConn(conn, subscriptionFilter{})
+			for range tc.failures {
+				_ = mw.writeEntry(zapcore.Entry{}, entryMeta{}, []byte(`{"msg":"test"}`))
+			}
+
+			// writes are asynchronous, so wait for them to happen
+			deadline := time.Now().Add(time.Second)
+			for int(conn.writes.Load()) < len(tc.failures) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := int(conn.writes.Load()); got != len(tc.failures) {
+				t.Fatalf("expected %d writes, got %d", len(tc.failures), got)
+			}
+
+			// removal is also asynchronous
+			removed := func() bool { return len(mw.subscribers()) == 0 }
+			for !removed() && tc.wantRemoved && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if removed() != tc.wantRemoved {
+				t.Errorf("expected removed=%t, got %t", tc.wantRemoved, removed())
+			}
+			mw.RemoveConn(conn)
+
+			if tc.wantRemoved {
+				select {
+				case err := <-dropped:
+					if err == nil {
+						t.Error("expected the drop handler to be given the write error")
+					}
+				case <-time.After(time.Second):
+					t.Error("expected the drop handler to be called")
+				}
+			}
+		})
+	}
+}
+
+// failingConn is a log connection whose writes fail as configured.
+type failingConn struct {
+	failures []bool
+	writes   atomic.Int64
+}
+
+func (c *failingConn) WriteMessage(int, []byte) error {
+	if i := c.writes.Add(1) - 1; int(i) < len(c.failures) && c.failures[i] {
+		return errors.New("write failed")
+	}
+	return nil
+}
+
+func (*failingConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (*failingConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+func TestPingEvictsUnresponsiveConns(t *testing.T) {
+	SetLogPingInterval(5*time.Millisecond, 20*time.Millisecond)
+	defer SetLogPingInterval(0, 0)
+
+	dropped := make(chan error, 1)
+	SetLogConnDropHandler(func(_ LogSubscriberInfo, err error) { dropped <- err })
+	defer SetLogConnDropHandler(nil)
+
+	mw := new(multiConnWriter)
+	alive := &pingConn{answer: true}
+	dead := &pingConn{}
+	mw.addConn(alive, subscriptionFilter{}, 0, -1)
+	mw.addConn(dead, subscriptionFilter{}, 0, -1)
+
+	select {
+	case err := <-dropped:
+		if !errors.Is(err, errLogConnPongTimeout) {
+			t.Errorf("drop handler got error %v, want %v", err, errLogConnPongTimeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("unresponsive conn was not evicted")
+	}
+	if !dead.closed.Load() {
+		t.Error("evicted conn was not closed")
+	}
+	if n := mw.subscriberCount(); n != 1 {
+		t.Errorf("got %d subscribers, want 1", n)
+	}
+
+	// the responsive conn was pinged more than once, and kept
+	time.Sleep(50 * time.Millisecond)
+	if n := alive.pings.Load(); n < 2 {
+		t.Errorf("responsive conn got %d pings, want at least 2", n)
+	}
+	if alive.closed.Load() || mw.subscriberCount() != 1 {
+		t.Error("responsive conn was evicted")
+	}
+
+	// the pinger stops once the pool is empty
+	mw.RemoveConn(alive)
+	deadline := time.Now().Add(time.Second)
+	for {
+		mw.subsMu.RLock()
+		pinging := mw.pinging
+		mw.subsMu.RUnlock()
+		if !pinging {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pinger still running after last conn was removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pingConn is a conn that supports pings, and answers them if answer is set.
+type pingConn struct {
+	recordingConn
+	answer bool
+	pings  atomic.Int64
+	closed atomic.Bool
+
+	writing atomic.Bool // to detect concurrent writes
+	pong    atomic.Pointer[func(string) error]
+}
+
+func (c *pingConn) WriteControl(messageType int, _ []byte, _ time.Time) error {
+	if !c.writing.CompareAndSwap(false, true) {
+		return errors.New("concurrent write")
+	}
+	defer c.writing.Store(false)
+	if c.closed.Load() {
+		return websocket.ErrCloseSent
+	}
+	if messageType == websocket.PingMessage {
+		c.pings.Add(1)
+		if h := c.pong.Load(); c.answer && h != nil {
+			go func() { _ = (*h)("") }()
+		}
+	}
+	return nil
+}
+
+func (c *pingConn) SetPongHandler(h func(string) error) { c.pong.Store(&h) }
+
+func (c *pingConn) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestCustomCoreWithPreservesRouting(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		logger   string
+		message  string
+		wantCore string
+	}{
+		{name: "job status", logger: "job.status", message: "progress", wantCore: "nonSampling"},
+		{name: "job tree", logger: "job.tree", message: "child progress", wantCore: "nonSampling"},
+		{name: "finished graph", logger: "job.action", message: "finished graph", wantCore: "liveJobProgress"},
+		{name: "finished thumbnail", logger: "job.action", message: "finished thumbnail", wantCore: "liveJobProgress"},
+		{name: "progress", logger: "job.action", message: "progress", wantCore: "liveJobProgress"},
+		{name: "file progress", logger: "job.action", message: "file progress", wantCore: "liveJobProgress"},
+		{name: "media progress", logger: "job.action", message: "media progress", wantCore: "liveJobProgress"},
+		{name: "finished file", logger: "job.action", message: "finished file", wantCore: "nonSampling"},
+		{name: "checkpoint saved", logger: "job.checkpoint", message: "checkpoint saved", wantCore: "sampled"},
+		{name: "other job action", logger: "job.action", message: "something else", wantCore: "sampled"},
+		{name: "other logger", logger: "processor", message: "finished graph", wantCore: "sampled"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sampled, sampledLogs := observer.New(zapcore.DebugLevel)
+			nonSampling, nonSamplingLogs := observer.New(zapcore.DebugLevel)
+			liveJobProgress, liveJobProgressLogs := observer.New(zapcore.DebugLevel)
+			core := &customCore{
+				Core:                         sampled,
+				nonSamplingCore:              nonSampling,
+				liveJobProgressCore:          liveJobProgress,
+				perOutputCore:                sampled,
+				perOutputLiveJobProgressCore: liveJobProgress,
+			}
+
+			derived := core.With([]zapcore.Field{zap.String("added", "field")})
+			if _, ok := derived.(*customCore); !ok {
+				t.Fatalf("derived core is %T, not *customCore", derived)
+			}
+			zap.New(derived).Named(tc.logger).Info(tc.message)
+
+			for name, logs := range map[string]*observer.ObservedLogs{
+				"sampled":         sampledLogs,
+				"nonSampling":     nonSamplingLogs,
+				"liveJobProgress": liveJobProgressLogs,
+			} {
+				entries := logs.AllUntimed()
+				if name != tc.wantCore {
+					if len(entries) > 0 {
+						t.Errorf("entry was unexpectedly routed to %s core", name)
+					}
+					continue
+				}
+				if len(entries) != 1 {
+					t.Fatalf("expected 1 entry in %s core, got %d", name, len(entries))
+				}
+				if got := entries[0].ContextMap()["added"]; got != "field" {
+					t.Errorf("expected added field to survive With(), got %v", entries[0].ContextMap())
+				}
+			}
+		})
+	}
+}
+
+func TestIndeterminateProgressRouting(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+	indeterminateProgressThrottle.mu.Lock()
+	clear(indeterminateProgressThrottle.last)
+	indeterminateProgressThrottle.mu.Unlock()
+
+	sampled, sampledLogs := observer.New(zapcore.DebugLevel)
+	liveJobProgress, liveJobProgressLogs := observer.New(zapcore.DebugLevel)
+	core := &customCore{
+		Core:                         sampled,
+		nonSamplingCore:              sampled,
+		liveJobProgressCore:          liveJobProgress,
+		perOutputCore:                sampled,
+		perOutputLiveJobProgressCore: liveJobProgress,
+	}
+	logger := zap.New(core, zap.WithClock(logClock{})).Named("job.action")
+	job1, job2 := logger.With(zap.Uint64("job_id", 1)), logger.With(zap.Uint64("job_id", 2))
+
+	for i := range 3 {
+		job1.Info(indeterminateProgressMessage, zap.Int("progress", i), zap.Bool("indeterminate", true))
+		job2.Info(indeterminateProgressMessage, zap.Int("progress", i), zap.Bool("indeterminate", true))
+	}
+	if got := liveJobProgressLogs.Len(); got != 2 {
+		t.Fatalf("expected 1 indeterminate progress entry per job within the interval, got %d", got)
+	}
+
+	now = now.Add(indeterminateProgressInterval)
+	job1.Info(indeterminateProgressMessage, zap.Int("progress", 3), zap.Bool("indeterminate", true))
+	if got := liveJobProgressLogs.Len(); got != 3 {
+		t.Errorf("expected another entry after the interval, got %d in total", got)
+	}
+	if got := sampledLogs.Len(); got != 0 {
+		t.Errorf("expected indeterminate progress to be routed as live job progress, but %d entries were sampled", got)
+	}
+}
+
+func TestLoggerPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "job", name: "job", want: true},
+		{pattern: "job", name: "job.status", want: true},
+		{pattern: "job", name: "jobs", want: false},
+		{pattern: "job.status", name: "job", want: false},
+		{pattern: "job.status", name: "job.action", want: false},
+		{pattern: "*", name: "anything", want: true},
+		{pattern: "*", name: "", want: false},
+		{pattern: "datasource.*.network", name: "datasource.github.network", want: true},
+		{pattern: "datasource.*.network", name: "datasource.github.network.retry", want: true},
+		{pattern: "datasource.*.network", name: "datasource.github.disk", want: false},
+		{pattern: "datasource.*.network", name: "datasource.github", want: false},
+		{pattern: "datasource.*.network", name: "datasource.network", want: false},
+		{pattern: "*.*.network", name: "datasource.github.network", want: true},
+		{pattern: "*.*.network", name: "a.b.c.network", want: false},
+		{pattern: "datasource.*.*.retry", name: "datasource.github.network.retry", want: true},
+		{pattern: "datasource.*.*.retry", name: "datasource.github.network.backoff", want: false},
+		{pattern: "*.status", name: "job.status", want: true},
+	} {
+		p, err := parseLoggerPattern(tc.pattern)
+		if err != nil {
+			t.Fatalf("parsing pattern %q: %v", tc.pattern, err)
+		}
+		if got := p.matches(tc.name); got != tc.want {
+			t.Errorf("pattern %q matching %q = %t, want %t", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+
+	for _, pattern := range []string{"", ".", "job.", ".job", "job..status", "job*", "job.sta*", "**"} {
+		if _, err := parseLoggerPattern(pattern); !errors.Is(err, ErrInvalidLoggerPattern) {
+			t.Errorf("expected pattern %q to be invalid, got error: %v", pattern, err)
+		}
+	}
+}
+
+func TestMaxWSMessageBytes(t *testing.T) {
+	const limit = 1024
+	SetMaxWSMessageBytes(limit)
+	defer SetMaxWSMessageBytes(defaultMaxWSMessageBytes)
+
+	out := new(capturedEntries)
+	core := newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), out, zapcore.DebugLevel)
+	logger := zap.New(core).Named("processor").With(zap.String("repo", "abc"))
+
+	logger.Info("normal entry", zap.String("small", "value"))
+	logger.Info("huge entry",
+		zap.String("small", "value"),
+		zap.String("huge", strings.Repeat("x", 10*limit)),
+		zap.Int("after", 42))
+
+	if len(out.msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(out.msgs))
+	}
+
+	var normal map[string]any
+	if err := json.Unmarshal(out.msgs[0], &normal); err != nil {
+		t.Fatalf("normal entry is not valid JSON: %v", err)
+	}
+	if _, ok := normal["_oversized"]; ok {
+		t.Errorf("normal entry was unexpectedly marked oversized: %s", out.msgs[0])
+	}
+
+	huge := out.msgs[1]
+	if len(huge) > limit {
+		t.Errorf("oversized entry is %d bytes, exceeding limit of %d", len(huge), limit)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(huge, &got); err != nil {
+		t.Fatalf("oversized entry is not valid JSON: %v (%s)", err, huge)
+	}
+	if got["_oversized"] != true {
+		t.Errorf("expected _oversized marker, got %v", got)
+	}
+	if got["msg"] != "huge entry" || got["logger"] != "processor" {
+		t.Errorf("expected entry metadata to be preserved, got %v", got)
+	}
+	for _, key := range []string{"repo", "small", "after"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("expected field %q to be kept, got %v", key, got)
+		}
+	}
+	if _, ok := got["huge"]; ok {
+		t.Error("expected huge field to be omitted")
+	}
+	if omitted, _ := got["_omitted_fields"].([]any); len(omitted) != 1 || omitted[0] != "huge" {
+		t.Errorf("expected omitted fields to be [huge], got %v", got["_omitted_fields"])
+	}
+}
+
+type capturedEntries struct{ msgs [][]byte }
+
+func (c *capturedEntries) writeEntry(_ zapcore.Entry, _ entryMeta, p []byte) error {
+	c.msgs = append(c.msgs, append([]byte(nil), p...))
+	return nil
+}
+
+func (*capturedEntries) Sync() error { return nil }
+
+func TestLogFileLineRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	cfg := logFileConfig{maxLines: 3}
+
+	writeLines := func(lf *logFile, n int, prefix string) {
+		t.Helper()
+		for i := range n {
+			if _, err := fmt.Fprintf(lf, "%s %d\n", prefix, i); err != nil {
+				t.Fatalf("writing line: %v", err)
+			}
+		}
+	}
+
+	lf, err := openLogFile(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(lf, 4, "first")
+	if err := lf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// after a "restart", the existing line in the file should be counted
+	lf, err = openLogFile(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLines(lf, 3, "second")
+	if err := lf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 files (2 rotated and the current one), got %d", len(entries))
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Count(string(data), "\n")
+		want := 3
+		if entry.Name() == "app.log" {
+			want = 1
+		}
+		if lines != want {
+			t.Errorf("expected %d lines in %s, got %d: %q", want, entry.Name(), lines, data)
+		}
+	}
+}
+
+func TestLogFileRotationCloseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	lf, err := openLogFile(path, logFileConfig{maxLines: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	if _, err := io.WriteString(lf, "first\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// make closing the file for rotation fail
+	if err := lf.file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(lf, "lost\n"); err == nil {
+		t.Fatal("expected rotation to fail")
+	}
+	if _, err := io.WriteString(lf, "second\n"); err != nil {
+		t.Fatalf("expected writes after a failed rotation to succeed, got %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "second\n" {
+		t.Errorf("expected the file to be written to after the failed rotation, got %q (err=%v)", data, err)
+	}
+	rotated, err := rotatedLogFiles(path)
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("expected the reopened file to be rotated, got %v (err=%v)", rotated, err)
+	}
+	if data, err := os.ReadFile(rotated[0].path); err != nil || string(data) != "first\n" {
+		t.Errorf("expected the entry from before the failed rotation to be kept, got %q (err=%v)", data, err)
+	}
+}
+
+func TestClockDrivesSampling(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	out, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(out), zap.WithClock(logClock{})).Named("processor")
+
+	for range 5 {
+		logger.Info("repeated")
+	}
+	if got := logs.Len(); got != 1 {
+		t.Fatalf("expected 1 entry within the first sampling window, got %d", got)
+	}
+
+	now = now.Add(sampledLogInterval)
+	for range 5 {
+		logger.Info("repeated")
+	}
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("expected 1 more entry after advancing the clock, got %d in total", len(entries))
+	}
+	if !entries[1].Time.Equal(now) {
+		t.Errorf("expected entry to be timestamped by the clock (%s), got %s", now, entries[1].Time)
+	}
+}
+
+func TestDedupCustomKey(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	SetDedupWindow(time.Minute)
+	defer SetDedupWindow(0)
+	SetDedupKeyFunc(func(_ zapcore.Entry, fields []zapcore.Field) string {
+		for _, f := range fields {
+			if f.Key == "error_code" {
+				return f.String
+			}
+		}
+		return ""
+	})
+	defer SetDedupKeyFunc(nil)
+
+	out, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(out), zap.WithClock(logClock{})).Named("processor")
+
+	// the messages differ so that sampling doesn't drop any of them
+	logger.Error("fetching page 1", zap.String("error_code", "rate_limited"))
+	logger.Error("fetching page 2", zap.String("error_code", "rate_limited"))
+	logger.Error("fetching page 3", zap.String("error_code", "not_found"))
+	logger.Error("fetching page 4", zap.String("error_code", "rate_limited"))
+	logger.Error("fetching page 5") // no key, so never a duplicate
+	logger.Error("fetching page 6")
+
+	now = now.Add(time.Minute)
+	logger.Error("fetching page 7", zap.String("error_code", "rate_limited"))
+
+	var got []string
+	for _, ent := range logs.All() {
+		got = append(got, fmt.Sprintf("%s %v", ent.Message, ent.ContextMap()["repeated"]))
+	}
+	want := []string{
+		"fetching page 1 <nil>",
+		"fetching page 3 <nil>",
+		"fetching page 5 <nil>",
+		"fetching page 6 <nil>",
+		"fetching page 7 2",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected entries %v, got %v", want, got)
+	}
+}
+
+func TestWithLogSuppressed(t *testing.T) {
+	out, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(out)).Named("processor")
+
+	var fromOther sync.WaitGroup
+	held := WithLogSuppressed(func() {
+		logger.Info("held 1", zap.Int("n", 1))
+		logger.Error("not held")
+		logger.Info("held 2")
+
+		fromOther.Add(1)
+		go func() {
+			defer fromOther.Done()
+			logger.Info("other goroutine")
+		}()
+		fromOther.Wait()
+	})
+
+	var got []string
+	for _, ent := range logs.TakeAll() {
+		got = append(got, ent.Message)
+	}
+	if want := []string{"not held", "other goroutine"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected entries %v while suppressed, got %v", want, got)
+	}
+	if held.Len() != 2 {
+		t.Fatalf("expected 2 held entries, got %d", held.Len())
+	}
+
+	logger.Info("after")
+	held.Flush()
+	got = nil
+	for _, ent := range logs.All() {
+		got = append(got, ent.Message)
+	}
+	if want := []string{"after", "held 1", "held 2"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected entries %v after flushing, got %v", want, got)
+	}
+	if n := logs.All()[1].ContextMap()["n"]; n != int64(1) {
+		t.Errorf("expected held entry to keep its fields, got n=%v", n)
+	}
+}
+
+func TestTagsMerge(t *testing.T) {
+	out, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(out)).Named("processor")
+
+	tagged := WithTags(logger.With(Tags("network", "")), "retry", "network")
+	tagged.With(zap.Int("attempt", 2)).Info("retrying")
+	WithTags(tagged, "auth").Info("refreshing token")
+	logger.Info("untagged")
+
+	entries := logs.All()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, want := range [][]any{{"network", "retry"}, {"network", "retry", "auth"}, nil} {
+		var got []any
+		for _, f := range entries[i].Context {
+			if f.Key != tagsKey {
+				continue
+			}
+			if got != nil {
+				t.Errorf("entry %d: expected one tags field, got several", i)
+			}
+			got, _ = entries[i].ContextMap()[tagsKey].([]any)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("entry %d: expected tags %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestExemptFromSampling(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	ExemptFromSampling("item_id", "42")
+	ExemptFromSampling("repo", "focused")
+	defer RemoveSamplingExemption("item_id", "42")
+	defer RemoveSamplingExemption("repo", "focused")
+
+	out, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(out), zap.WithClock(logClock{})).Named("processor")
+
+	for range 3 {
+		logger.Info("item", zap.Uint64("item_id", 42)) // exempt by call-site field
+		logger.Info("item", zap.Uint64("item_id", 7))  // sampled
+	}
+	focused := logger.With(zap.String("repo", "focused"))
+	for range 3 {
+		focused.Info("item") // exempt by context field
+	}
+
+	counts := make(map[string]int)
+	for _, entry := range logs.AllUntimed() {
+		switch {
+		case entry.ContextMap()["item_id"] == uint64(42):
+			counts["exempt field"]++
+		case entry.ContextMap()["repo"] == "focused":
+			counts["exempt context"]++
+		default:
+			counts["sampled"]++
+		}
+	}
+	if counts["exempt field"] != 3 || counts["exempt context"] != 3 || counts["sampled"] != 1 {
+		t.Errorf("expected 3 exempt entries of each kind and 1 sampled entry, got %v", counts)
+	}
+
+	RemoveSamplingExemption("item_id", "42")
+	RemoveSamplingExemption("repo", "focused")
+	if samplingExemptions.Load() != nil {
+		t.Error("expected no exemptions after removing them all")
+	}
+}
+
+func TestJobSubscription(t *testing.T) {
+	mw := new(multiConnWriter)
+	mw.history.resize(10)
+	logger := zap.New(newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), mw, zapcore.DebugLevel))
+
+	logger.Named("processor").Info("before", zap.Uint64("job_id", 1))
+	logger.Named("processor").Info("before", zap.Uint64("job_id", 2))
+	logger.Named("job.status").With(zap.Uint64("id", 1)).Info("before")
+	logger.Named("processor").With(zap.Uint64("id", 1)).Info("before") // "id" only identifies jobs for job loggers
+
+	conn := new(recordingConn)
+	mw.AddConn(conn, subscriptionFilter{jobIDs: []uint64{1}})
+
+	logger.Named("processor").Info("after", zap.Uint64("job_id", 2))
+	logger.Named("processor").Info("after") // entries without a job are never sent to job subscribers
+	logger.Named("processor").With(zap.Uint64("job_id", 1)).Info("after")
+
+	mw.RemoveConn(conn) // waits for queued messages to be written
+
+	var got []string
+	for _, msg := range conn.messages() {
+		var ent map[string]any
+		if err := json.Unmarshal(msg, &ent); err != nil {
+			t.Fatalf("invalid message: %v", err)
+		}
+		got = append(got, fmt.Sprintf("%v %v", ent["logger"], ent["msg"]))
+	}
+	want := []string{"processor before", "job.status before", "processor after"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected messages %v, got %v", want, got)
+	}
+}
+
+func TestMultiJobSubscription(t *testing.T) {
+	mw := new(multiConnWriter)
+	logger := zap.New(newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), mw, zapcore.DebugLevel))
+
+	conn := new(recordingConn)
+	mw.AddConn(conn, subscriptionFilter{jobIDs: []uint64{1, 3}})
+	for jobID := range uint64(4) {
+		logger.Named("processor").Info("working", zap.Uint64("job_id", jobID))
+	}
+	mw.RemoveConn(conn)
+
+	var got []any
+	for _, msg := range conn.messages() {
+		var ent map[string]any
+		if err := json.Unmarshal(msg, &ent); err != nil {
+			t.Fatalf("invalid message: %v", err)
+		}
+		got = append(got, ent["job_id"])
+	}
+	if want := []any{1.0, 3.0}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected entries for jobs %v, got %v", want, got)
+	}
+}
+
+func TestItemSubscription(t *testing.T) {
+	mw := new(multiConnWriter)
+	logger := zap.New(newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), mw, zapcore.DebugLevel))
+
+	conn := new(recordingConn)
+	mw.AddConn(conn, subscriptionFilter{itemRef: "abc"})
+
+	phase := WithPhase(logger.Named("processor"), "importing")
+	ItemLogger(phase.Logger, "abc").Info("processing item")
+	ItemLogger(phase.Logger, "xyz").Info("processing item")
+	logger.Named("processor").Info("skipping item", zap.String("item_id", "abc"))
+	phase.End()
+
+	mw.RemoveConn(conn)
+
+	msgs := conn.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages for the item, got %d", len(msgs))
+	}
+	var ent map[string]any
+	if err := json.Unmarshal(msgs[0], &ent); err != nil {
+		t.Fatal(err)
+	}
+	if ent["item_ref"] != "abc" || ent["phase"] != "importing" {
+		t.Errorf("expected entry to be tagged with the item and phase, got %v", ent)
+	}
+}
+
+func TestAddConnSince(t *testing.T) {
+	mw := new(multiConnWriter)
+	mw.history.resize(3)
+	for i := range 5 {
+		_ = mw.writeEntry(zapcore.Entry{}, entryMeta{}, []byte(fmt.Sprintf(`{"msg":"%d"}`+"\n", i+1)))
+	}
+
+	for _, test := range []struct {
+		since uint64
+		want  []string
+	}{
+		{since: 0, want: []string{`{"msg":"3","seq":3}`, `{"msg":"4","seq":4}`, `{"msg":"5","seq":5}`}},
+		{since: 4, want: []string{`{"msg":"5","seq":5}`}},
+		{since: 5, want: nil},
+		{since: 1, want: []string{"gap", `{"msg":"3","seq":3}`, `{"msg":"4","seq":4}`, `{"msg":"5","seq":5}`}},
+		{since: 99, want: []string{"gap", `{"msg":"3","seq":3}`, `{"msg":"4","seq":4}`, `{"msg":"5","seq":5}`}},
+	} {
+		conn := new(recordingConn)
+		mw.AddConnSince(conn, subscriptionFilter{}, test.since)
+		mw.RemoveConn(conn)
+
+		var got []string
+		for _, msg := range conn.messages() {
+			if bytes.Contains(msg, []byte(`"replay_gap":true`)) {
+				got = append(got, "gap")
+				continue
+			}
+			got = append(got, string(bytes.TrimSpace(msg)))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("since %d: expected %v, got %v", test.since, test.want, got)
+		}
+	}
+}
+
+func TestReplayFilteredByLogger(t *testing.T) {
+	mw := new(multiConnWriter)
+	mw.history.resize(10)
+	for _, name := range []string{"job.status", "processor", "job.status.detail", "job", "job.action"} {
+		_ = mw.writeEntry(zapcore.Entry{LoggerName: name}, entryMeta{}, []byte(fmt.Sprintf(`{"logger":%q}`+"\n", name)))
+	}
+
+	filter, err := parseLoggerFilter([]string{"job.status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := new(recordingConn)
+	mw.AddConn(conn, subscriptionFilter{loggers: filter})
+	mw.RemoveConn(conn)
+
+	var got []string
+	for _, msg := range conn.messages() {
+		var decoded struct{ Logger string }
+		_ = json.Unmarshal(msg, &decoded)
+		got = append(got, decoded.Logger)
+	}
+	if want := []string{"job.status", "job.status.detail"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected replay of %v, got %v", want, got)
+	}
+}
+
+func TestAddConnFollowOptions(t *testing.T) {
+	mw := new(multiConnWriter)
+	mw.history.resize(10)
+	for i, level := range []zapcore.Level{zapcore.WarnLevel, zapcore.InfoLevel, zapcore.ErrorLevel, zapcore.InfoLevel, zapcore.WarnLevel} {
+		_ = mw.writeEntry(zapcore.Entry{Level: level}, entryMeta{}, []byte(fmt.Sprintf(`{"msg":"%d"}`+"\n", i+1)))
+	}
+
+	for _, test := range []struct {
+		afterSeq uint64
+		limit    int
+		want     []string
+	}{
+		{limit: 0, want: []string{"1", "3", "5"}},
+		{limit: 2, want: []string{"3", "5"}},
+		{limit: -1, want: nil},
+		{afterSeq: 1, limit: 5, want: []string{"3", "5"}},
+		{afterSeq: 3, limit: 0, want: []string{"5"}},
+	} {
+		conn := new(recordingConn)
+		mw.addConn(conn, subscriptionFilter{minLevel: zapcore.WarnLevel}, test.afterSeq, test.limit)
+		_ = mw.writeEntry(zapcore.Entry{Level: zapcore.InfoLevel}, entryMeta{}, []byte(`{"msg":"live info"}`))
+		mw.RemoveConn(conn)
+
+		var got []string
+		for _, msg := range conn.messages() {
+			var decoded struct{ Msg string }
+			_ = json.Unmarshal(msg, &decoded)
+			got = append(got, decoded.Msg)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("after %d, limit %d: expected %v, got %v", test.afterSeq, test.limit, test.want, got)
+		}
+	}
+}
+
+func TestWaitDrained(t *testing.T) {
+	mw := new(multiConnWriter)
+	conn := &blockingConn{release: make(chan struct{})}
+	mw.AddConn(conn, subscriptionFilter{})
+	for range 3 {
+		_ = mw.writeEntry(zapcore.Entry{}, entryMeta{}, []byte(`{"msg":"test"}`))
+	}
+
+	backlogged := mw.waitDrained(time.Now().Add(20 * time.Millisecond))
+	if len(backlogged) != 1 || backlogged[0].Pending != 3 {
+		t.Fatalf("expected 1 subscriber with 3 pending messages, got %+v", backlogged)
+	}
+
+	close(conn.release)
+	if backlogged := mw.waitDrained(time.Now().Add(time.Second)); len(backlogged) != 0 {
+		t.Errorf("expected no backlog after the conn was unblocked, got %+v", backlogged)
+	}
+	mw.RemoveConn(conn)
+}
+
+func TestSlowSubscriberDropsOldest(t *testing.T) {
+	mw := new(multiConnWriter)
+	conn := &gatedConn{release: make(chan struct{})}
+	mw.AddConn(conn, subscriptionFilter{})
+
+	const extra = 10
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for range logSubscriberQueueSize + 1 + extra {
+			_ = mw.writeEntry(zapcore.Entry{}, entryMeta{}, []byte(`{"msg":"test"}`))
+		}
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked on a slow subscriber")
+	}
+
+	infos := mw.subscribers()
+	if len(infos) != 1 || infos[0].Dropped < extra {
+		t.Fatalf("expected at least %d messages to be dropped, got %+v", extra, infos)
+	}
+	close(conn.release)
+	mw.waitDrained(time.Now().Add(time.Second))
+	mw.RemoveConn(conn)
+
+	var notices int
+	for _, msg := range conn.messages() {
+		var notice logDropNotice
+		if json.Unmarshal(msg, &notice) == nil && notice.Type == "dropped" {
+			notices++
+			if notice.Dropped != int64(infos[0].Dropped) {
+				t.Errorf("expected notice of %d dropped messages, got %d", infos[0].Dropped, notice.Dropped)
+			}
+		}
+	}
+	if notices != 1 {
+		t.Errorf("expected 1 drop notice, got %d", notices)
+	}
+}
+
+func TestReplayLargerThanQueue(t *testing.T) {
+	const total = logSubscriberQueueSize + 300
+	mw := new(multiConnWriter)
+	mw.history.resize(total)
+	for i := range total {
+		_ = mw.writeEntry(zapcore.Entry{}, entryMeta{}, []byte(fmt.Sprintf(`{"msg":"%d"}`+"\n", i+1)))
+	}
+
+	// the client can't receive anything until the whole replay is queued
+	conn := &gatedConn{release: make(chan struct{})}
+	mw.AddConn(conn, subscriptionFilter{})
+	if infos := mw.subscribers(); len(infos) != 1 || infos[0].Dropped != 0 {
+		t.Fatalf("expected nothing to be dropped from the replay, got %+v", infos)
+	}
+	close(conn.release)
+	mw.waitDrained(time.Now().Add(time.Second))
+	mw.RemoveConn(conn)
+
+	msgs := conn.messages()
+	if len(msgs) != total {
+		t.Fatalf("expected %d messages to be replayed, got %d", total, len(msgs))
+	}
+	var first, last struct{ Msg string }
+	_ = json.Unmarshal(msgs[0], &first)
+	_ = json.Unmarshal(msgs[len(msgs)-1], &last)
+	if first.Msg != "1" || last.Msg != fmt.Sprint(total) {
+		t.Errorf("expected messages 1 to %d in order, got %s to %s", total, first.Msg, last.Msg)
+	}
+}
+
+func TestConcurrentWritesToConn(t *testing.T) {
+	defaultPool, otherPool := new(multiConnWriter), new(multiConnWriter)
+	logger := zap.New(zapcore.NewTee(
+		newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), defaultPool, zapcore.DebugLevel),
+		newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), otherPool, zapcore.DebugLevel),
+	))
+
+	// each conn is subscribed to both pools, and more than once to one
+	conns := make([]*exclusiveConn, 4)
+	for i := range conns {
+		conns[i] = new(exclusiveConn)
+		defaultPool.AddConn(conns[i], subscriptionFilter{})
+		defaultPool.AddConn(conns[i], subscriptionFilter{minLevel: zapcore.WarnLevel})
+		otherPool.AddConn(conns[i], subscriptionFilter{})
+	}
+
+	var wg sync.WaitGroup
+	for w := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				logger.Warn("working", zap.Int("worker", w), zap.Int("n", i))
+			}
+		}()
+	}
+	wg.Wait()
+	defaultPool.waitDrained(time.Now().Add(time.Second))
+	otherPool.waitDrained(time.Now().Add(time.Second))
+
+	for _, conn := range conns {
+		defaultPool.RemoveConn(conn)
+		defaultPool.RemoveConn(conn)
+		otherPool.RemoveConn(conn)
+		if conn.concurrent.Load() {
+			t.Error("conn was written to concurrently")
+		}
+		if conn.writes.Load() == 0 {
+			t.Error("expected conn to be written to")
+		}
+	}
+	connWriteLocks.Lock()
+	defer connWriteLocks.Unlock()
+	if len(connWriteLocks.locks) != 0 {
+		t.Errorf("expected write locks to be released with the subscriptions, got %d", len(connWriteLocks.locks))
+	}
+}
+
+// exclusiveConn is a log connection that notes whether it was ever
+// written to by more than one goroutine at a time, which websocket
+// connections do not allow.
+type exclusiveConn struct {
+	writing, concurrent atomic.Bool
+	writes              atomic.Int64
+}
+
+func (c *exclusiveConn) WriteMessage(int, []byte) error {
+	if !c.writing.CompareAndSwap(false, true) {
+		c.concurrent.Store(true)
+		return nil
+	}
+	c.writes.Add(1)
+	time.Sleep(time.Microsecond) // widen the window for overlapping writes
+	c.writing.Store(false)
+	return nil
+}
+
+func (*exclusiveConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (*exclusiveConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+// gatedConn is a recordingConn whose writes block until it is released.
+type gatedConn struct {
+	recordingConn
+	release chan struct{}
+}
+
+func (c *gatedConn) WriteMessage(typ int, data []byte) error {
+	<-c.release
+	return c.recordingConn.WriteMessage(typ, data)
+}
+
+// blockingConn is a log connection whose writes block until it is released.
+type blockingConn struct {
+	release chan struct{}
+}
+
+func (c *blockingConn) WriteMessage(int, []byte) error {
+	<-c.release
+	return nil
+}
+
+func (*blockingConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (*blockingConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+// recordingConn is a log connection that records the messages written to it.
+type recordingConn struct {
+	mu   sync.Mutex
+	msgs [][]byte
+}
+
+func (c *recordingConn) WriteMessage(_ int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, data)
+	return nil
+}
+
+func (c *recordingConn) messages() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.msgs
+}
+
+func (*recordingConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (*recordingConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+func TestExportLogsFiltered(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	mw := new(multiConnWriter)
+	mw.history.resize(10)
+	logger := zap.New(newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), mw, zapcore.DebugLevel),
+		zap.WithClock(logClock{}))
+
+	logger.Warn("too early")
+	now = now.Add(time.Minute)
+	logger.Debug("too verbose")
+	logger.Warn("included", zap.String("path", filepath.Join(home, "file.txt")), zap.String("auth", "Bearer secret"))
+	now = now.Add(time.Minute)
+	logger.Error("too late")
+
+	var buf strings.Builder
+	start := time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC)
+	if err := mw.history.export(&buf, start, start.Add(time.Minute), zapcore.InfoLevel); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 exported entry, got %d: %q", len(lines), buf.String())
+	}
+	var ent map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &ent); err != nil {
+		t.Fatal(err)
+	}
+	if ent["msg"] != "included" {
+		t.Errorf("expected the included entry, got %v", ent)
+	}
+	if want := filepath.Join("~", "file.txt"); ent["path"] != want {
+		t.Errorf("expected home directory to be masked as %q, got %v", want, ent["path"])
+	}
+	if strings.Contains(lines[0], "secret") {
+		t.Errorf("expected token to be redacted: %s", lines[0])
+	}
+}
+
+func TestUnsupportedFormatCounts(t *testing.T) {
+	out, _ := observer.New(zapcore.DebugLevel)
+	root := zap.New(newCustomCore(out))
+	jobLogger := root.Named("job").With(zap.Uint64("id", 42)).Named("action")
+
+	LogUnsupportedFormat(jobLogger, "media", "a.heic", ".heic")
+	LogUnsupportedFormat(jobLogger, "media", "b.heic", ".heic")
+	LogUnsupportedFormat(jobLogger, "media", "c.xyz", ".xyz")
+	LogUnsupportedFormat(root.Named("processor").With(zap.Uint64("id", 42)), "media", "d.heic", ".heic")
+
+	got := unsupportedFormats.take(42)
+	if want := map[string]int{".heic": 2, ".xyz": 1}; !maps.Equal(got, want) {
+		t.Errorf("expected counts %v, got %v", want, got)
+	}
+	if got := unsupportedFormats.take(42); got != nil {
+		t.Errorf("expected counts to be forgotten, got %v", got)
+	}
+}
+
+func TestMergeCounts(t *testing.T) {
+	out, logs := observer.New(zapcore.DebugLevel)
+	jobLogger := zap.New(newCustomCore(out)).Named("job").With(zap.Uint64("id", 44)).Named("action")
+
+	LogMerge(jobLogger, "a", "1", MergeUpdated)
+	LogMerge(jobLogger, "b", "2", MergeUpdated)
+	LogMerge(jobLogger, "c", "3", MergeRetrievalKey)
+
+	if got, want := itemMerges.take(44), map[string]int{"updated": 2, "retrieval_key": 1}; !maps.Equal(got, want) {
+		t.Errorf("expected counts %v, got %v", want, got)
+	}
+	entries := logs.FilterMessage("merged item").All()
+	if len(entries) == 0 {
+		t.Fatal("expected merges to be logged")
+	}
+	if fields := entries[0].ContextMap(); fields["existing_ref"] != "1" || fields["strategy"] != "updated" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}
+
+func TestThumbnailErrorCounts(t *testing.T) {
+	out, logs := observer.New(zapcore.DebugLevel)
+	jobLogger := zap.New(newCustomCore(out)).Named("job").With(zap.Uint64("id", 43)).Named("action")
+
+	LogThumbnailError(jobLogger, "a.cr2", "image/x-canon-cr2", errors.New("unsupported"))
+	LogThumbnailError(jobLogger, "b.cr2", "image/x-canon-cr2", errors.New("unsupported"))
+	LogThumbnailError(jobLogger, "c.mp4", "video/mp4", errors.New("ffmpeg exited"))
+
+	if got, want := thumbnailFailures.take(43), map[string]int{"image/x-canon-cr2": 2, "video/mp4": 1}; !maps.Equal(got, want) {
+		t.Errorf("expected counts %v, got %v", want, got)
+	}
+	entries := logs.FilterMessage("thumbnail generation failed").All()
+	if len(entries) == 0 {
+		t.Fatal("expected thumbnail errors to be logged")
+	}
+	if fields := entries[0].ContextMap(); fields["format"] != "image/x-canon-cr2" || fields["item_ref"] != "a.cr2" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}
+
+func TestAddPlainConsole(t *testing.T) {
+	var buf bytes.Buffer
+	remove := AddPlainConsole(&buf, zapcore.InfoLevel)
+	logger := zap.New(new(sinksCore)).Named("embedder")
+
+	logger.Debug("too verbose")
+	logger.Warn("shown", zap.Int("n", 1))
+	remove()
+	logger.Warn("after removal")
+	remove() // no-op
+
+	out := buf.String()
+	if !strings.Contains(out, "WARN\tembedder\tshown\t{\"n\": 1}") {
+		t.Errorf("expected plain warning in output, got %q", out)
+	}
+	if strings.Contains(out, "\x1b[") {
+		t.Errorf("expected no ANSI escape codes, got %q", out)
+	}
+	if strings.Contains(out, "too verbose") || strings.Contains(out, "after removal") {
+		t.Errorf("expected only one entry, got %q", out)
+	}
+}
+
+func TestEntryCountsByName(t *testing.T) {
+	out, _ := observer.New(zapcore.DebugLevel)
+	root := zap.New(newCustomCore(out))
+
+	before := EntryCountsByName()
+	root.Named("datasource").Named("count_test").Info("one")
+	root.Named("datasource").Named("count_test").Named("albums").Info("two")
+	root.Named("count_test").Debug("three")
+
+	after := EntryCountsByName()
+	for name, want := range map[string]uint64{"datasource.count_test": 2, "count_test": 1} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("expected %d more entries for %q, got %d", want, name, got)
+		}
+	}
+	if _, ok := after["datasource.count_test.albums"]; ok {
+		t.Error("expected entries to be counted by the first two segments of the logger name only")
+	}
+}
+
+func TestJobLogBudget(t *testing.T) {
+	SetJobLogBudget(7, 2)
+	defer forgetJobLogBudget(7)
+
+	out, logs := observer.New(zapcore.DebugLevel)
+	root := zap.New(newCustomCore(out))
+	jobLog := root.Named("processor").With(zap.Uint64("job_id", 7))
+
+	// the messages differ so that sampling doesn't drop any of them
+	jobLog.Info("one")
+	jobLog.Info("two")
+	jobLog.Info("three")
+	jobLog.Error("four")
+	jobLog.Info("five")
+	root.Named("job.status").With(zap.Uint64("job_id", 7)).Info("six")
+	root.Named("processor").With(zap.Uint64("job_id", 8)).Info("seven")
+
+	var got []string
+	for _, ent := range logs.All() {
+		got = append(got, ent.Message)
+	}
+	if want := []string{"one", "two", "four", "six", "seven"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected entries %v, got %v", want, got)
+	}
+	if dropped := forgetJobLogBudget(7); dropped != 2 {
+		t.Errorf("expected 2 dropped entries, got %d", dropped)
+	}
+}
+
+func TestUICaller(t *testing.T) {
+	out := new(capturedEntries)
+	core := newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), out, zapcore.DebugLevel)
+	newLogger := func() *zap.Logger {
+		// a new core for each call, so that sampling doesn't drop the skips
+		return zap.New(newCustomCore(core), zap.AddCaller()).Named("processor")
+	}
+
+	newLogger().Info("hidden")
+	SetUICaller(true)
+	defer SetUICaller(false)
+	_, file, line, _ := runtime.Caller(0)
+	newLogger().Info("direct")
+	LogSkip(newLogger(), "item", SkipEmpty)
+	LogUnsupportedFormat(newLogger(), "test", "f.xyz", ".xyz")
+
+	if len(out.msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(out.msgs))
+	}
+	for i, msg := range out.msgs {
+		var got struct{ Caller string }
+		if err := json.Unmarshal(msg, &got); err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf("%s:%d", filepath.Base(file), line+i)
+		if i == 0 {
+			want = "" // not enabled yet
+		}
+		if got.Caller != want && filepath.Base(got.Caller) != want {
+			t.Errorf("entry %d: expected caller %q, got %q", i, want, got.Caller)
+		}
+	}
+}
+
+func TestProgressRate(t *testing.T) {
+	var r progressRate
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if _, ok := r.update(0, start); ok {
+		t.Fatal("expected no rate for the first update")
+	}
+	if rate, ok := r.update(10, start.Add(time.Second)); !ok || rate != 10 {
+		t.Fatalf("expected a rate of 10/sec, got %v (ok=%t)", rate, ok)
+	}
+	rate, _ := r.update(40, start.Add(2*time.Second))
+	if want := progressRateSmoothing*30 + (1-progressRateSmoothing)*10; rate != want {
+		t.Errorf("expected smoothed rate of %v, got %v", want, rate)
+	}
+	if _, ok := r.update(5, start.Add(3*time.Second)); ok {
+		t.Error("expected no rate after progress was reset")
+	}
+}
+
+func TestPinned(t *testing.T) {
+	sampled, sampledLogs := observer.New(zapcore.DebugLevel)
+	nonSampling, nonSamplingLogs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(&customCore{
+		Core:                         sampled,
+		nonSamplingCore:              nonSampling,
+		liveJobProgressCore:          sampled,
+		perOutputCore:                sampled,
+		perOutputLiveJobProgressCore: sampled,
+	})
+
+	Pinned(logger.Named("processor")).With(zap.Int("n", 1)).Info("import started")
+	logger.Named("job.status").Info(string(JobSucceeded))
+	logger.Named("processor").Info("routine")
+
+	var pinned []string
+	for _, ent := range nonSamplingLogs.All() {
+		if ent.ContextMap()[pinnedKey] != true {
+			t.Errorf("expected entry %q to have pinned field", ent.Message)
+		}
+		pinned = append(pinned, ent.Message)
+	}
+	if want := []string{"import started", string(JobSucceeded)}; fmt.Sprint(pinned) != fmt.Sprint(want) {
+		t.Errorf("expected pinned entries %v, got %v", want, pinned)
+	}
+	if entries := sampledLogs.All(); len(entries) != 1 || entries[0].ContextMap()[pinnedKey] != nil {
+		t.Errorf("expected one unpinned, sampled entry, got %v", entries)
+	}
+}
+
+func TestSetLoggingEnabled(t *testing.T) {
+	out, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(out)).Named("processor")
+
+	SetLoggingEnabled(false)
+	logger.Info("discarded")
+	logger.Error("also discarded")
+	SetLoggingEnabled(true)
+	logger.Info("kept")
+
+	if entries := logs.All(); len(entries) != 1 || entries[0].Message != "kept" {
+		t.Errorf("expected only the entry logged while enabled, got %v", entries)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	posts := make(chan webhookPayload, 10)
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable) // retried
+			return
+		}
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		posts <- payload
+	}))
+	defer srv.Close()
+
+	if _, err := AddWebhookSink("ftp://example.com", zapcore.ErrorLevel, WebhookOptions{}); err == nil {
+		t.Error("expected error for non-HTTP URL")
+	}
+
+	remove, err := AddWebhookSink(srv.URL, zapcore.ErrorLevel, WebhookOptions{
+		BatchSize:   2,
+		BatchDelay:  time.Minute,
+		MinInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zap.New(new(sinksCore)).Named("webhook_test")
+	logger.Warn("below level")
+	logger.Error("first error", zap.Int("n", 1))
+	logger.Error("second error", zap.String("url", "https://example.com/?access_token=s3cret"))
+	logger.Error("after batch")
+	remove()
+	logger.Error("after removal")
+
+	var got []string
+	for len(posts) > 0 {
+		payload := <-posts
+		for _, entry := range payload.Entries {
+			if strings.Contains(string(entry), "s3cret") {
+				t.Errorf("expected token to be redacted from posted entry: %s", entry)
+			}
+			var decoded struct{ Msg string }
+			_ = json.Unmarshal(entry, &decoded)
+			got = append(got, decoded.Msg)
+		}
+		if len(got) == 2 && payload.Text != "[ERROR] first error (webhook_test) and 1 more" {
+			t.Errorf("unexpected summary: %q", payload.Text)
+		}
+	}
+	if want := []string{"first error", "second error", "after batch"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected posted entries %v, got %v", want, got)
+	}
+}
+
+func TestEncodeJournalEntry(t *testing.T) {
+	ent := zapcore.Entry{Level: zapcore.WarnLevel, LoggerName: "job.action", Message: "slow"}
+	got := encodeJournalEntry("test", ent, []zapcore.Field{
+		zap.Uint64("job_id", 3),
+		zap.String("_private", "x"),
+		zap.String("detail", "two\nlines"),
+	})
+
+	want := "MESSAGE=slow\nPRIORITY=4\nSYSLOG_IDENTIFIER=test\nLOGGER=job.action\n" +
+		"F_PRIVATE=x\nDETAIL\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\nJOB_ID=3\n"
+	if string(got) != want {
+		t.Errorf("expected:\n%q\ngot:\n%q", want, got)
+	}
+}
+
+func TestMappedUIEncoder(t *testing.T) {
+	out := new(capturedEntries)
+	SetUIEncoder(NewMappedUIEncoder(UIFieldMapping{
+		LevelKey:   "severity",
+		MessageKey: "text",
+		FieldsKey:  "data",
+		Fields:     map[string]string{"item_ref": "item"},
+	}))
+	defer SetUIEncoder(nil)
+
+	zap.New(newCustomizableUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), out, zapcore.DebugLevel)).
+		Info("hello", zap.String("item_ref", "a.jpg"), zap.Int("n", 2))
+	zap.New(newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), out, zapcore.DebugLevel)).
+		Info("default")
+
+	if len(out.msgs) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(out.msgs))
+	}
+	if got, want := strings.TrimSpace(string(out.msgs[0])), `{"severity":"info","text":"hello","data":{"item":"a.jpg","n":2}}`; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if !strings.Contains(string(out.msgs[1]), `"msg":"default"`) {
+		t.Errorf("expected non-customizable core to use default encoder, got %s", out.msgs[1])
+	}
+}
+
+func TestLogMemoryBudget(t *testing.T) {
+	mw := new(multiConnWriter)
+	mw.history.resize(10)
+	defer mw.history.resize(0)
+
+	// the budget is shared with the rest of the logging system, so set it
+	// only after SetLogMemoryBudget has logged the change, and don't log
+	// the warning about reaching it, so that only our messages count
+	SetLogMemoryBudget(1 << 30)
+	defer SetLogMemoryBudget(0)
+	defer logMemory.warned.Store(logMemory.warned.Swap(true))
+
+	// each message is 20 bytes once its sequence number is added
+	logMemory.budget.Store(logMemory.usage() + 40)
+	for i := range 5 {
+		_ = mw.writeEntry(zapcore.Entry{}, entryMeta{}, []byte(fmt.Sprintf(`{"msg":"%d"}`+"\n", i+1)))
+	}
+
+	msgs, missed := mw.history.since(0)
+	if len(msgs) != 2 || missed != 3 {
+		t.Fatalf("expected 2 messages in history and 3 evicted, got %d and %d", len(msgs), missed)
+	}
+	if got := string(bytes.TrimSpace(msgs[0].data)); got != `{"msg":"4","seq":4}` {
+		t.Errorf("expected oldest messages to be evicted, got %s", got)
+	}
+	if stats := LogStats(); stats.MemoryEvicted < 3 || stats.MemoryBudget == 0 {
+		t.Errorf("expected evictions in stats, got %+v", stats)
+	}
+}
+
+func TestLogConfigChange(t *testing.T) {
+	sink := &configChangeSink{changeSetting: func() { SetJobFirstErrorOnly(!jobFirstErrorOnly.Load()) }}
+	remove := addLogSink(sink)
+	defer remove()
+	defer SetJobFirstErrorOnly(false)
+
+	SetStrictMessages(true)
+	SetStrictMessages(true) // unchanged
+	SetStrictMessages(false)
+
+	// changes made while logging a change are not logged, rather than recursing
+	if len(sink.changes) != 2 {
+		t.Fatalf("expected 2 logged changes, got %v", sink.changes)
+	}
+	if got := sink.changes[0]; got != "strict_messages: false -> true" {
+		t.Errorf("unexpected first change: %s", got)
+	}
+	if got := sink.changes[1]; got != "strict_messages: true -> false" {
+		t.Errorf("unexpected second change: %s", got)
+	}
+}
+
+// configChangeSink records the config changes that are logged, and
+// calls changeSetting for each one.
+type configChangeSink struct {
+	changes       []string
+	changeSetting func()
+}
+
+func (*configChangeSink) Enabled(zapcore.Level) bool { return true }
+
+func (s *configChangeSink) writeEntry(ent zapcore.Entry, fields []zapcore.Field) error {
+	if ent.LoggerName != "log.config" {
+		return nil
+	}
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	s.changes = append(s.changes, fmt.Sprintf("%s: %v -> %v", enc.Fields["setting"], enc.Fields["old"], enc.Fields["new"]))
+	s.changeSetting()
+	return nil
+}
+
+func (*configChangeSink) Sync() error { return nil }
+
+func TestExportLogsAsItems(t *testing.T) {
+	mw := new(multiConnWriter)
+	mw.history.resize(10)
+	logger := zap.New(newUICore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), mw, zapcore.DebugLevel)).Named("processor")
+	logger.Info("imported item", zap.String("data_source", "gpx"))
+
+	var buf bytes.Buffer
+	if err := mw.history.exportItems(&buf, time.Time{}, time.Time{}, zapcore.DebugLevel); err != nil {
+		t.Fatal(err)
+	}
+	var exported ExportedItem
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("decoding exported item %q: %v", buf.String(), err)
+	}
+	if exported.Content.Text != "imported item" || exported.Classification != ClassNote.Name || exported.ID == "" {
+		t.Errorf("unexpected item: %+v", exported)
+	}
+	if exported.Metadata["Data source"] != "gpx" || exported.Metadata["Logger"] != "processor" || exported.Metadata["Level"] != "info" {
+		t.Errorf("unexpected metadata: %v", exported.Metadata)
+	}
+	if item := exported.Item(); item.Classification.Name != ClassNote.Name || !item.Timestamp.Equal(exported.Timestamp) {
+		t.Errorf("unexpected item: %+v", item)
+	}
+
+	if err := ExportLogsAsItems(io.Discard, time.Time{}, time.Time{}, zapcore.DebugLevel); !errors.Is(err, ErrLogItemExportDisabled) {
+		t.Errorf("expected export to be disabled by default, got %v", err)
+	}
+}
+
+func TestLogBatching(t *testing.T) {
+	SetLogBatching(time.Hour, 3)
+	defer SetLogBatching(0, 0)
+	before := logMetrics.batchStats()
+
+	mw := new(multiConnWriter)
+	conn := new(recordingConn)
+	mw.AddConn(conn, subscriptionFilter{})
+	for i := range 5 {
+		_ = mw.writeEntry(zapcore.Entry{}, entryMeta{}, []byte(fmt.Sprintf(`{"msg":"%d"}`+"\n", i+1)))
+	}
+	mw.flushBatches()
+	for deadline := time.Now().Add(time.Second); len(conn.messages()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	mw.RemoveConn(conn)
+
+	var sizes []int
+	for _, frame := range conn.messages() {
+		sizes = append(sizes, bytes.Count(frame, []byte("\n")))
+	}
+	if fmt.Sprint(sizes) != "[3 2]" {
+		t.Fatalf("expected frames of 3 and 2 messages, got %v", sizes)
+	}
+
+	stats := logMetrics.batchStats()
+	var prevFrames, prevEntries uint64
+	if before != nil {
+		prevFrames, prevEntries = before.Frames, before.Entries
+	}
+	if stats.Frames-prevFrames != 2 || stats.Entries-prevEntries != 5 {
+		t.Errorf("expected 2 frames with 5 entries to be counted, got %+v", stats)
+	}
+	if stats.FlushReasons["full"] == 0 || stats.FlushReasons["forced"] == 0 {
+		t.Errorf("expected full and forced flushes, got %v", stats.FlushReasons)
+	}
+}
+
+func TestLogPools(t *testing.T) {
+	pool := Pool("test-notifications")
+	if Pool("test-notifications") != pool || LookupPool("test-notifications") != pool {
+		t.Fatal("expected the same pool for the same name")
+	}
+	if LookupPool("test-unknown") != nil {
+		t.Error("expected no pool for an unknown name")
+	}
+	if err := pool.SetFilter(zapcore.WarnLevel); err != nil {
+		t.Fatal(err)
+	}
+	if err := Pool("").SetFilter(zapcore.WarnLevel); err == nil {
+		t.Error("expected the default pool to reject a filter")
+	}
+
+	conn := new(recordingConn)
+	pool.mw.AddConn(conn, subscriptionFilter{})
+	var fanout logPoolFanout
+	_ = fanout.writeEntry(zapcore.Entry{Level: zapcore.InfoLevel}, entryMeta{}, []byte(`{"msg":"info"}`+"\n"))
+	_ = fanout.writeEntry(zapcore.Entry{Level: zapcore.WarnLevel}, entryMeta{}, []byte(`{"msg":"warn"}`+"\n"))
+	pool.mw.RemoveConn(conn)
+
+	msgs := conn.messages()
+	if len(msgs) != 1 || !bytes.Contains(msgs[0], []byte(`"msg":"warn"`)) {
+		t.Errorf("expected only the warning in the pool, got %q", msgs)
+	}
+}
+
+func TestSyncLogsCoversPools(t *testing.T) {
+	pool := Pool("test-sync")
+	before := LogStats().Subscribers
+	conn := &blockingConn{release: make(chan struct{})}
+	pool.mw.AddConn(conn, subscriptionFilter{})
+	defer pool.mw.RemoveConn(conn)
+	if got := LogStats().Subscribers; got != before+1 {
+		t.Errorf("expected the pool's subscriber to be counted (%d), got %d", before+1, got)
+	}
+
+	for range 2 {
+		_ = pool.mw.writeEntry(zapcore.Entry{Level: zapcore.InfoLevel}, entryMeta{}, []byte(`{"msg":"pooled"}`))
+	}
+	if backlogged, _ := SyncLogs(50 * time.Millisecond); len(backlogged) == 0 {
+		t.Error("expected the pool's stuck subscriber to be reported as backlogged")
+	}
+	close(conn.release)
+	if backlogged, _ := SyncLogs(time.Second); len(backlogged) != 0 {
+		t.Errorf("expected the pool's subscriber to be drained, got backlog %+v", backlogged)
+	}
+}
+
+func TestPhaseCosts(t *testing.T) {
+	out, _ := observer.New(zapcore.DebugLevel)
+	jobLogger := zap.New(newCustomCore(out)).Named("job").With(zap.Uint64("id", 45)).Named("action")
+
+	for range 2 {
+		phase := WithPhase(jobLogger, "indexing")
+		phase.AddItems(3)
+		_ = make([]byte, 1<<20)
+		phase.End()
+	}
+	WithPhase(jobLogger, "thumbnails").End()
+
+	costs := jobPhaseCosts.take(45)
+	if len(costs) != 2 {
+		t.Fatalf("expected costs for 2 phases, got %v", costs)
+	}
+	if cost := costs["indexing"]; cost.Items != 6 || cost.Duration <= 0 {
+		t.Errorf("expected summed cost of both indexing phases, got %+v", cost)
+	}
+	if costs := jobPhaseCosts.take(45); costs != nil {
+		t.Errorf("expected costs to be forgotten once taken, got %v", costs)
+	}
+}
+
+func TestReconfigureWhileLogging(t *testing.T) {
+	out, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(out))
+	status, noise := logger.Named("job.status"), logger.Named("job.action")
+
+	levels := OutputLevelsSnapshot()
+	t.Cleanup(func() {
+		SetOutputLevels(levels)
+		SetConsistentSampling(false)
+		SetGlobalFields()
+		EnableGoroutineID(false)
+		RemoveSamplingExemption("worker", "0")
+		SetDedupWindow(0)
+		SetStrictMessages(false)
+		SetJobFirstErrorOnly(false)
+	})
+
+	const workers, perWorker = 16, 200
+	done := make(chan struct{})
+	var reconfigured sync.WaitGroup
+	reconfigured.Add(1)
+	go func() {
+		defer reconfigured.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			on := i%2 == 0
+			SetConsistentSampling(on)
+			EnableGoroutineID(on)
+			SetStrictMessages(on)
+			SetJobFirstErrorOnly(on)
+			if on {
+				SetOutputLevels(OutputLevels{Console: zapcore.DebugLevel, UI: zapcore.DebugLevel, File: zapcore.DebugLevel})
+				SetGlobalFields(zap.Int("generation", i))
+				ExemptFromSampling("worker", "0")
+				SetDedupWindow(time.Millisecond)
+			} else {
+				SetOutputLevels(levels)
+				SetGlobalFields()
+				RemoveSamplingExemption("worker", "0")
+				SetDedupWindow(0)
+			}
+		}
+	}()
+
+	var emitted sync.WaitGroup
+	for w := range workers {
+		emitted.Add(1)
+		go func() {
+			defer emitted.Done()
+			for i := range perWorker {
+				status.Info("job progress", zap.Int("worker", w), zap.Int("n", i))
+				noise.Debug("working on item", zap.Int("worker", w), zap.Int("n", i))
+			}
+		}()
+	}
+	emitted.Wait()
+	close(done)
+	reconfigured.Wait()
+
+	if got := logs.FilterMessage("job progress").Len(); got != workers*perWorker {
+		t.Errorf("expected all %d status entries to be logged, got %d", workers*perWorker, got)
+	}
+}
+
+func TestCloseLog(t *testing.T) {
+	conn := new(recordingConn)
+	websocketLogOutputs.addConn(conn, subscriptionFilter{}, 0, -1) // no replay of earlier tests' messages
+	websocketLogOutputs.addConn(conn, subscriptionFilter{minLevel: zapcore.WarnLevel}, 0, -1)
+	for range 3 {
+		_ = websocketLogOutputs.writeEntry(zapcore.Entry{Level: zapcore.WarnLevel}, entryMeta{}, []byte(`{"msg":"closing"}`))
+	}
+
+	for range 2 { // closing again is a no-op
+		if backlogged, err := CloseLog(time.Second); len(backlogged) != 0 {
+			t.Fatalf("expected all messages to be delivered, got backlog %+v (err=%v)", backlogged, err)
+		}
+	}
+	if n := websocketLogOutputs.subscriberCount(); n != 0 {
+		t.Errorf("expected no subscribers after closing, got %d", n)
+	}
+	var delivered int
+	for _, msg := range conn.messages() {
+		if bytes.Contains(msg, []byte(`"msg":"closing"`)) {
+			delivered++
+		}
+	}
+	if delivered != 6 {
+		t.Errorf("expected 6 messages to be delivered before closing, got %d", delivered)
+	}
+}
+
+func TestSetConsoleLevel(t *testing.T) {
+	levels := OutputLevelsSnapshot()
+	defer SetOutputLevels(levels)
+
+	SetConsoleLevel(zapcore.WarnLevel)
+	if got := OutputLevelsSnapshot(); got.Console != zapcore.WarnLevel || got.UI != levels.UI || got.File != levels.File {
+		t.Errorf("expected only the console level to change, got %+v (was %+v)", got, levels)
+	}
+	if consoleLevel.Enabled(zapcore.InfoLevel) || !consoleLevel.Enabled(zapcore.ErrorLevel) {
+		t.Error("expected the console level to take effect immediately")
+	}
+}
+
+func TestLogEventEmitter(t *testing.T) {
+	if AddLogEventEmitter("logs", nil) != nil {
+		t.Error("expected no emitter without an emit function")
+	}
+	RemoveLogEventEmitter(nil)
+
+	var mu sync.Mutex
+	var events []string
+	emitter := AddLogEventEmitter("logs", func(eventName string, data ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf("%s %s", eventName, data[0]))
+	})
+	_ = websocketLogOutputs.writeEntry(zapcore.Entry{}, entryMeta{}, []byte(`{"msg":"emitted"}`+"\n"))
+	RemoveLogEventEmitter(emitter)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var found bool
+	for _, event := range events {
+		found = found || strings.HasPrefix(event, `logs {"msg":"emitted"`)
+	}
+	if !found {
+		t.Errorf("expected the entry to be emitted as an event, got %v", events)
+	}
+}
+
+func TestSamplingCounts(t *testing.T) {
+	out, _ := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(out)).Named("samplingtest.counts")
+	before := logMetrics.samplingCounts()["samplingtest.counts"]
+	for range 10 {
+		logger.Info("same message")
+	}
+
+	counts := logMetrics.samplingCounts()["samplingtest.counts"]
+	passed, dropped := counts.Passed-before.Passed, counts.Dropped-before.Dropped
+	if passed+dropped != 10 || dropped == 0 {
+		t.Errorf("expected 10 sampling decisions with some dropped, got %d passed and %d dropped", passed, dropped)
+	}
+}
+
+func TestSamplingConfig(t *testing.T) {
+	out, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newCustomCore(out)).With(zap.String("data_source", "test"))
+	defer SetSamplingConfig(SamplingConfig{})
+
+	emit := func() {
+		for range 5 {
+			logger.Named("transcoder").Info("finished transcode")
+			logger.Named("indexer").Info("indexed")
+			logger.Named("other").Info("same message")
+		}
+	}
+
+	SetSamplingConfig(SamplingConfig{
+		UnsampledLoggers:  []string{"indexer"},
+		LiveProgress:      []LogMessageRoute{{Logger: "transcoder", Message: "finished transcode"}},
+		LiveProgressCount: 5,
+	})
+	emit()
+	if n := logs.FilterMessage("indexed").Len(); n != 5 {
+		t.Errorf("expected entries from unsampled logger to all be logged, got %d", n)
+	}
+	if n := logs.FilterMessage("finished transcode").Len(); n < 2 {
+		t.Errorf("expected progress entries to be sampled leniently, got %d", n)
+	}
+	if n := logs.FilterMessage("same message").Len(); n != 1 {
+		t.Errorf("expected other entries to be sampled, got %d", n)
+	}
+
+	// the default sampling is restored by the zero config
+	SetSamplingConfig(SamplingConfig{})
+	logs.TakeAll()
+	emit()
+	if n := logs.FilterMessage("indexed").Len(); n != 1 {
+		t.Errorf("expected default sampling after resetting the config, got %d", n)
+	}
+}
+
+func TestLogFileRotationRetention(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	if err := SetLogFile(path, WithLogFileSizeRotation(256), WithLogFileRetention(2, 0)); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLogFile("")
+
+	logger := zap.New(newFileCore(zapcore.DebugLevel))
+	for i := range 50 {
+		logger.Info("imported item", zap.Int("n", i))
+	}
+	if err := SetLogFile(""); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 files (2 rotated and the current one), got %d", len(entries))
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if !json.Valid([]byte(line)) {
+				t.Errorf("invalid JSON line in %s: %q", entry.Name(), line)
+			}
+		}
+	}
+}
+
+func TestQueryLogs(t *testing.T) {
+	if _, err := QueryLogs(context.Background(), LogQuery{}); !errors.Is(err, ErrNoLogFile) {
+		t.Fatalf("expected ErrNoLogFile without a log file, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "app.log")
+	start := time.Now()
+	writeEntries := func(schema JSONSchema, from int) {
+		SetJSONSchema(schema)
+		defer SetJSONSchema(SchemaNative)
+		if err := SetLogFile(path, WithLogFileLineRotation(3)); err != nil {
+			t.Fatal(err)
+		}
+		logger := zap.New(newFileCore(zapcore.DebugLevel))
+		for i := from; i < from+5; i++ {
+			logger.Named("job.action").With(zap.Uint64("id", uint64(1+i%2))).Info("working", zap.Int("n", i))
+			logger.Named("processor").Warn("odd item", zap.Int("n", i), zap.Uint64("job_id", 1))
+		}
+	}
+	writeEntries(SchemaNative, 0)
+	writeEntries(SchemaECS, 5) // entries from before a restart may have a different schema
+	defer SetLogFile("")
+	zap.New(newFileCore(zapcore.DebugLevel)).Named("verbose").Debug("detail", zap.Int("n", 10), zap.Uint64("id", 2))
+
+	info, warn := zapcore.InfoLevel, zapcore.WarnLevel
+	for _, test := range []struct {
+		query LogQuery
+		want  []int
+	}{
+		{query: LogQuery{Logger: "job", JobID: 1}, want: []int{0, 2, 4, 6, 8}},
+		{query: LogQuery{Logger: "job", JobID: 1, Limit: 2}, want: []int{6, 8}},
+		{query: LogQuery{JobID: 2}, want: []int{1, 3, 5, 7, 9}}, // only a job logger's "id" is its job
+		{query: LogQuery{Level: &warn, Limit: 3}, want: []int{7, 8, 9}},
+		{query: LogQuery{Logger: "verbose"}, want: []int{10}}, // all levels by default
+		{query: LogQuery{Logger: "verbose", Level: &info}, want: nil},
+		{query: LogQuery{Since: start.Add(time.Hour)}, want: nil},
+		{query: LogQuery{Until: start.Add(-time.Hour)}, want: nil},
+		{query: LogQuery{Logger: "processor", Since: start, Until: start.Add(time.Hour), Limit: 100}, want: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+	} {
+		results, err := QueryLogs(context.Background(), test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, result := range results {
+			var ent struct{ N int }
+			if err := json.Unmarshal(result, &ent); err != nil {
+				t.Fatalf("invalid entry %s: %v", result, err)
+			}
+			got = append(got, ent.N)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("query %+v: expected entries %v, got %v", test.query, test.want, got)
+		}
+	}
+}
+
+func TestQueryLogsDefaultLimit(t *testing.T) {
+	if err := SetLogFile(filepath.Join(t.TempDir(), "app.log")); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLogFile("")
+	logger := zap.New(newFileCore(zapcore.DebugLevel))
+	for i := range DefaultLogQueryLimit + 5 {
+		logger.Info("entry", zap.Int("n", i))
+	}
+
+	results, err := QueryLogs(context.Background(), LogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != DefaultLogQueryLimit {
+		t.Fatalf("expected %d entries without a limit, got %d", DefaultLogQueryLimit, len(results))
+	}
+	var last struct{ N int }
+	if err := json.Unmarshal(results[len(results)-1], &last); err != nil || last.N != DefaultLogQueryLimit+4 {
+		t.Errorf("expected the most recent entries, but the last is %d (err=%v)", last.N, err)
+	}
+}
+
+func TestResourceLogging(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		threshold uint64
+		want      zapcore.Level
+	}{
+		{name: "below threshold", threshold: math.MaxUint64, want: zapcore.DebugLevel},
+		{name: "above threshold", threshold: 1, want: zapcore.WarnLevel},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, logs := observer.New(zapcore.DebugLevel)
+			logger := zap.New(out).Named("resource")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				logResources(ctx, logger, time.Millisecond, tc.threshold)
+				close(done)
+			}()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for logs.Len() < 2 {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected periodic samples, got %d", logs.Len())
+				}
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected sampling to stop when the context is canceled")
+			}
+
+			entries := logs.All()
+			for _, entry := range entries {
+				if entry.Message != "memory usage" || entry.Level != tc.want {
+					t.Errorf("expected %s 'memory usage' entry, got %s '%s'", tc.want, entry.Level, entry.Message)
+				}
+				if _, ok := entry.ContextMap()["heap_alloc"]; !ok {
+					t.Errorf("expected heap_alloc field, got %v", entry.ContextMap())
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			if logs.Len() != len(entries) {
+				t.Errorf("expected no samples after stopping, got %d more", logs.Len()-len(entries))
+			}
+		})
+	}
+}
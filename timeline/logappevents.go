@@ -0,0 +1,89 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// AddLogEventEmitter subscribes an application event system to the log
+// output, in the default pool (see Pool), so that a UI which isn't
+// connected by a WebSocket, such as that of a desktop build, receives
+// the same stream of entries as WebSocket subscribers (see AddLogConn).
+// Each entry is emitted as an event with the given name, whose data is
+// the JSON entry; emit is typically the Wails runtime's EventsEmit with
+// its context bound. Like any subscriber, the emitter is sent messages
+// from its own goroutine, so emit may block without holding up logging.
+// Emitters and WebSocket connections can be subscribed at the same time.
+//
+// If emit is nil, such as when there is no application runtime, nothing
+// is subscribed and nil is returned, which RemoveLogEventEmitter ignores.
+func AddLogEventEmitter(eventName string, emit func(eventName string, data ...any)) *LogEventEmitter {
+	if emit == nil {
+		return nil
+	}
+	e := &LogEventEmitter{eventName: eventName, emit: emit}
+	websocketLogOutputs.AddConn(e, subscriptionFilter{})
+	return e
+}
+
+// RemoveLogEventEmitter unsubscribes an emitter that was added with
+// AddLogEventEmitter. It returns after any entries already being
+// emitted are done.
+func RemoveLogEventEmitter(e *LogEventEmitter) {
+	if e == nil {
+		return
+	}
+	websocketLogOutputs.RemoveConn(e)
+}
+
+// LogEventEmitter is a log subscriber that emits entries as application
+// events (see AddLogEventEmitter).
+type LogEventEmitter struct {
+	eventName string
+	emit      func(eventName string, data ...any)
+}
+
+// WriteMessage emits each JSON message in data as an event. (Batched
+// messages, see SetLogBatching, are emitted one by one, since their
+// data would not be valid JSON otherwise.) The message type is ignored.
+func (e *LogEventEmitter) WriteMessage(_ int, data []byte) error {
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			e.emit(e.eventName, json.RawMessage(line))
+		}
+	}
+	return nil
+}
+
+// SetWriteDeadline is a no-op, since emitting events has no deadline.
+func (*LogEventEmitter) SetWriteDeadline(time.Time) error { return nil }
+
+// RemoteAddr returns a pseudo-address that identifies the emitter's
+// events, such as in LogSubscribers.
+func (e *LogEventEmitter) RemoteAddr() net.Addr { return logEventAddr(e.eventName) }
+
+// logEventAddr is the pseudo-address of a LogEventEmitter.
+type logEventAddr string
+
+func (logEventAddr) Network() string  { return "event" }
+func (a logEventAddr) String() string { return "event:" + string(a) }
@@ -0,0 +1,193 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// SetLogBatching sets whether the messages sent to each log subscriber
+// are batched. When enabled, the messages that are queued for a
+// subscriber within window of the first one, up to maxEntries of them,
+// are sent together in one WebSocket frame, one message per line, which
+// saves frames (and writes) when entries are logged in bursts. A batch
+// is also sent early once it reaches the maximum message size (see
+// SetMaxWSMessageBytes). Subscribers must split each frame into lines.
+// A window of 0 or less (the default) disables batching, so that every
+// message is its own frame. If maxEntries is not positive, a default is
+// used. LogStats reports how well batching is working.
+func SetLogBatching(window time.Duration, maxEntries int) {
+	if maxEntries <= 0 {
+		maxEntries = defaultLogBatchMaxEntries
+	}
+	prevWindow := time.Duration(logBatchWindow.Swap(int64(max(window, 0))))
+	prevMax := logBatchMaxEntries.Swap(int64(maxEntries))
+	logConfigChange("log_batch_window", prevWindow, max(window, 0))
+	logConfigChange("log_batch_max_entries", prevMax, int64(maxEntries))
+}
+
+var logBatchWindow, logBatchMaxEntries = func() (*atomic.Int64, *atomic.Int64) {
+	var window, maxEntries atomic.Int64
+	maxEntries.Store(defaultLogBatchMaxEntries)
+	return &window, &maxEntries
+}()
+
+// FlushLogBatches sends the batches that are being collected for log
+// subscribers right away, instead of when their window ends (see
+// SetLogBatching). This is mostly useful for tests; SyncLogs does it
+// when waiting for subscribers to be sent their messages.
+func FlushLogBatches() { websocketLogOutputs.flushBatches() }
+
+func (mw *multiConnWriter) flushBatches() {
+	mw.subsMu.RLock()
+	defer mw.subsMu.RUnlock()
+	for _, sub := range mw.subs {
+		select {
+		case sub.flush <- struct{}{}:
+		default: // already signaled
+		}
+	}
+}
+
+// batchFlushReason is why a batch was sent.
+type batchFlushReason int
+
+const (
+	batchFlushTimer  batchFlushReason = iota // its window ended
+	batchFlushFull                           // it reached its maximum number of entries or size
+	batchFlushForced                         // FlushLogBatches was called
+	batchFlushClosed                         // the subscriber was removed
+	numBatchFlushReasons
+)
+
+func (r batchFlushReason) String() string {
+	switch r {
+	case batchFlushTimer:
+		return "timer"
+	case batchFlushFull:
+		return "full"
+	case batchFlushForced:
+		return "forced"
+	case batchFlushClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// collectBatch returns first, along with the messages that are queued
+// after it within the batch window (up to the maximum per batch), as a
+// single frame, and how many messages are in it.
+func (sub *logSubscriber) collectBatch(first []byte, window time.Duration) (frame []byte, n int, reason batchFlushReason) {
+	frame, n = first, 1
+	maxEntries, maxBytes := int(logBatchMaxEntries.Load()), int(maxWSMessageBytes.Load())
+	add := func(msg []byte) (full bool) {
+		logMemory.queued.Add(-int64(len(msg)))
+		// clip so that appending copies, since queued messages are
+		// shared with the history and other subscribers
+		frame = slices.Clip(frame)
+		if len(frame) > 0 && frame[len(frame)-1] != '\n' {
+			frame = append(frame, '\n')
+		}
+		frame = append(frame, msg...)
+		n++
+		return n >= maxEntries || (maxBytes > 0 && len(frame) >= maxBytes)
+	}
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for n < maxEntries {
+		// prefer messages that are already queued, so that a flush
+		// doesn't leave them for the next batch
+		select {
+		case msg, ok := <-sub.queue:
+			if !ok {
+				return frame, n, batchFlushClosed
+			}
+			if add(msg) {
+				return frame, n, batchFlushFull
+			}
+			continue
+		default:
+		}
+		select {
+		case msg, ok := <-sub.queue:
+			if !ok {
+				return frame, n, batchFlushClosed
+			}
+			if add(msg) {
+				return frame, n, batchFlushFull
+			}
+		case <-timer.C:
+			return frame, n, batchFlushTimer
+		case <-sub.flush:
+			return frame, n, batchFlushForced
+		}
+	}
+	return frame, n, batchFlushFull
+}
+
+// countBatch counts a frame of n messages sent for the reason.
+func (m *logMetricsCounters) countBatch(n int, reason batchFlushReason) {
+	m.batchFrames.Add(1)
+	m.batchEntries.Add(uint64(n))
+	m.batchFlushes[reason].Add(1)
+}
+
+// LogBatchStats describes how the messages sent to log subscribers have
+// been batched into frames (see SetLogBatching).
+type LogBatchStats struct {
+	Frames      uint64  `json:"frames"`
+	Entries     uint64  `json:"entries"`
+	AverageSize float64 `json:"average_size"`
+
+	// how many frames would have been sent without batching, minus
+	// how many were sent
+	FramesSaved uint64 `json:"frames_saved"`
+
+	// how many batches were sent for each reason: "timer" (the batch
+	// window ended), "full", "forced" (see FlushLogBatches), or
+	// "closed" (the subscriber was removed)
+	FlushReasons map[string]uint64 `json:"flush_reasons,omitempty"`
+}
+
+// batchStats returns the batching statistics, or nil if no batches have
+// been sent.
+func (m *logMetricsCounters) batchStats() *LogBatchStats {
+	frames, entries := m.batchFrames.Load(), m.batchEntries.Load()
+	if frames == 0 {
+		return nil
+	}
+	stats := &LogBatchStats{
+		Frames:       frames,
+		Entries:      entries,
+		AverageSize:  float64(entries) / float64(frames),
+		FramesSaved:  entries - min(frames, entries),
+		FlushReasons: make(map[string]uint64),
+	}
+	for reason := range numBatchFlushReasons {
+		if count := m.batchFlushes[reason].Load(); count > 0 {
+			stats.FlushReasons[reason.String()] = count
+		}
+	}
+	return stats
+}
+
+const defaultLogBatchMaxEntries = 100
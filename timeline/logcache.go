@@ -0,0 +1,114 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ObserveThumbnailCache records whether a thumbnail was found already
+// generated (a hit) or had to be generated (a miss). Periodically, if
+// there were any lookups, a summary of the hit ratio during the interval
+// and overall is logged under the "thumbnail.cache" logger (never
+// sampled), which helps users understand how much work re-imports incur.
+// The overall ratio is also available in LogStats, and lookups are
+// counted in the thumbnail cache metric (see MetricsSnapshot).
+func ObserveThumbnailCache(hit bool) {
+	thumbnailCache.observe(hit)
+	if hit {
+		thumbnailCacheMetric.add(1, "hit")
+	} else {
+		thumbnailCacheMetric.add(1, "miss")
+	}
+}
+
+// SetThumbnailCacheReportInterval sets how often the thumbnail cache
+// summary is logged (see ObserveThumbnailCache). It takes effect after
+// the current interval. If d is not positive, a default interval is used.
+func SetThumbnailCacheReportInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultThumbnailCacheReportInterval
+	}
+	thumbnailCacheReportInterval.Store(int64(d))
+}
+
+var thumbnailCacheReportInterval = func() *atomic.Int64 {
+	var d atomic.Int64
+	d.Store(int64(defaultThumbnailCacheReportInterval))
+	return &d
+}()
+
+var thumbnailCache = new(cacheCounter)
+
+// cacheCounter counts the hits and misses of a cache, both overall
+// and for the current reporting interval.
+type cacheCounter struct {
+	hits, misses             atomic.Uint64
+	windowHits, windowMisses atomic.Uint64
+	started                  sync.Once
+}
+
+func (cc *cacheCounter) observe(hit bool) {
+	cc.started.Do(func() { go cc.run() })
+	if hit {
+		cc.hits.Add(1)
+		cc.windowHits.Add(1)
+	} else {
+		cc.misses.Add(1)
+		cc.windowMisses.Add(1)
+	}
+}
+
+// hitRatio returns the overall ratio of hits to lookups.
+func (cc *cacheCounter) hitRatio() float64 {
+	return ratio(cc.hits.Load(), cc.misses.Load())
+}
+
+func (cc *cacheCounter) run() {
+	logger := Log.Named("thumbnail.cache")
+	for {
+		time.Sleep(time.Duration(thumbnailCacheReportInterval.Load()))
+
+		hits, misses := cc.windowHits.Swap(0), cc.windowMisses.Swap(0)
+		if hits+misses == 0 {
+			continue
+		}
+		logger.Info("cache summary",
+			zap.Uint64("hits", hits),
+			zap.Uint64("misses", misses),
+			zap.Float64("hit_ratio", ratio(hits, misses)),
+			zap.Uint64("total_hits", cc.hits.Load()),
+			zap.Uint64("total_misses", cc.misses.Load()),
+			zap.Float64("total_hit_ratio", cc.hitRatio()))
+	}
+}
+
+// ratio returns the ratio of hits to all lookups, or 0 if there were none.
+func ratio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+const defaultThumbnailCacheReportInterval = time.Minute
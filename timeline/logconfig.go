@@ -0,0 +1,396 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// SetShowCaller sets whether the console output includes the
+// file and line of the log call. It is disabled by default to
+// keep the console readable for non-developers. It does not
+// affect the JSON output, which always has full metadata
+// (except for the UI; see SetUICaller).
+func SetShowCaller(show bool) {
+	logConfigChange("show_caller", consoleShowCaller.Swap(show), show)
+}
+
+// SetUICaller sets whether the entries sent to the UI include the
+// file and line of the log call, in a "caller" field, so that builds
+// of the UI for developers can link entries to the code. It is disabled
+// by default, since users have no use for it and it makes every entry
+// bigger. Entries logged by the exported Log* helpers, such as LogSkip,
+// have the caller of the helper as their caller. It does not affect
+// the console or the log file.
+func SetUICaller(show bool) {
+	logConfigChange("ui_caller", uiShowCaller.Swap(show), show)
+}
+
+// SetShowLoggerName sets whether the console output includes
+// the name of the logger. It is enabled by default. It does not
+// affect the JSON output, which always has full metadata.
+func SetShowLoggerName(show bool) {
+	logConfigChange("show_logger_name", !consoleHideLoggerName.Swap(!show), show)
+}
+
+// (the logger name is stored inverted so that the zero value is the default)
+var consoleShowCaller, consoleHideLoggerName atomic.Bool
+
+var uiShowCaller atomic.Bool
+
+// consoleEncoder wraps the console's encoder so that the
+// display of some entry metadata can be toggled at runtime.
+type consoleEncoder struct {
+	zapcore.Encoder
+}
+
+func (enc consoleEncoder) Clone() zapcore.Encoder {
+	return consoleEncoder{enc.Encoder.Clone()}
+}
+
+func (enc consoleEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	if !consoleShowCaller.Load() {
+		ent.Caller = zapcore.EntryCaller{}
+	}
+	if consoleHideLoggerName.Load() {
+		ent.LoggerName = ""
+	}
+	return enc.Encoder.EncodeEntry(ent, fields)
+}
+
+// SetLoggingEnabled is an emergency switch for when logging itself is
+// causing problems, such as filling the disk or using too much CPU. When
+// logging is disabled, all entries are discarded before they reach any
+// of the outputs: the console, the UI, and the log file. That includes
+// errors, so disabling logging should be a last resort. A single notice
+// is written to the console when logging is disabled, and when it is
+// enabled again (along with the number of entries that were discarded).
+// Logging is enabled by default.
+func SetLoggingEnabled(enabled bool) {
+	if !enabled && !loggingDisabled.Load() {
+		// log the change while it can still be logged
+		logConfigChange("logging_enabled", true, false)
+	}
+	if loggingDisabled.Swap(!enabled) == !enabled {
+		return // unchanged
+	}
+	if !enabled {
+		internalLog.Warn("logging disabled; all entries, including errors, will be discarded until it is enabled again")
+		return
+	}
+	internalLog.Info("logging enabled", zap.Uint64("discarded_entries", discardedEntries.Swap(0)))
+	logConfigChange("logging_enabled", false, true)
+}
+
+var (
+	loggingDisabled  atomic.Bool
+	discardedEntries atomic.Uint64 // while logging was disabled
+)
+
+// SetGlobalFields sets fields to add to all log entries, such as the active
+// user or account, so that logs are attributable in multi-user setups. The
+// fields apply to Log and all of its derivatives, including those that were
+// created before the fields were set, so no loggers or log subscribers need
+// to be recreated. Calling SetGlobalFields again replaces the global fields;
+// calling it with no fields removes them.
+func SetGlobalFields(fields ...zap.Field) {
+	var prev *[]zapcore.Field
+	if len(fields) == 0 {
+		prev = globalFields.Swap(nil)
+	} else {
+		fields = slices.Clone(fields)
+		prev = globalFields.Swap(&fields)
+	}
+	// only the keys are logged, since the values may be sensitive
+	var prevKeys []string
+	if prev != nil {
+		prevKeys = fieldKeys(*prev)
+	}
+	logConfigChange("global_fields", prevKeys, fieldKeys(fields))
+}
+
+// fieldKeys returns the keys of fields, or nil if there are none.
+func fieldKeys(fields []zapcore.Field) []string {
+	var keys []string
+	for _, f := range fields {
+		keys = append(keys, f.Key)
+	}
+	return keys
+}
+
+var globalFields atomic.Pointer[[]zapcore.Field]
+
+// EnableGoroutineID sets whether log entries have a "goid" field with
+// the ID of the goroutine that logged them, which helps to untangle the
+// interleaved logs of parallel workers when debugging concurrency bugs
+// like deadlocks. This is only meant for debugging, since getting the
+// ID requires capturing part of the stack for every entry. It is
+// disabled by default.
+func EnableGoroutineID(enable bool) {
+	logConfigChange("goroutine_id", goroutineIDs.Swap(enable), enable)
+}
+
+var goroutineIDs atomic.Bool
+
+// goroutineID returns the ID of the current goroutine, which the runtime
+// doesn't expose, except in the first line of a stack trace, in the form
+// "goroutine 123 [running]:".
+func goroutineID() uint64 {
+	var buf [64]byte
+	trace := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	end := bytes.IndexByte(trace, ' ')
+	if end < 0 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(trace[:end]), 10, 64)
+	return id
+}
+
+// SetClock sets the function that provides the current time for log
+// entries. Since the samplers measure their windows by the timestamps
+// of entries, this also drives sampling, so tests can advance time
+// deterministically instead of sleeping. A nil function restores the
+// real clock, which is the default.
+func SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	logClockFunc.Store(&now)
+}
+
+// logClock is the zapcore.Clock for the process log; see SetClock.
+type logClock struct{}
+
+func (logClock) Now() time.Time                         { return (*logClockFunc.Load())() }
+func (logClock) NewTicker(d time.Duration) *time.Ticker { return time.NewTicker(d) }
+
+var logClockFunc = func() *atomic.Pointer[func() time.Time] {
+	var p atomic.Pointer[func() time.Time]
+	now := time.Now
+	p.Store(&now)
+	return &p
+}()
+
+// BoostVerbosity lowers the minimum level of all outputs
+// to level for the duration d, after which the previous levels are
+// restored automatically. This is useful for "reproduce once with full
+// logging" workflows, without the risk of forgetting to turn debug logs
+// back off. A boost never makes an output less verbose than it already
+// is. If a boost is already active, the boosts are merged: the more
+// verbose level is used, and the boost lasts until the later of the
+// two end times.
+func BoostVerbosity(level zapcore.Level, d time.Duration) {
+	verbosityBoost.Lock()
+
+	now := time.Now()
+	until := now.Add(d)
+
+	if verbosityBoost.timer == nil {
+		verbosityBoost.saved = currentOutputLevels()
+		verbosityBoost.level = level
+		verbosityBoost.until = until
+	} else {
+		verbosityBoost.timer.Stop()
+		verbosityBoost.level = min(verbosityBoost.level, level)
+		verbosityBoost.until = maxTime(verbosityBoost.until, until)
+	}
+
+	boosted := verbosityBoost.saved.boosted(verbosityBoost.level)
+	prev := applyOutputLevels(boosted)
+
+	verbosityBoost.timer = time.AfterFunc(verbosityBoost.until.Sub(now), endVerbosityBoost)
+	verbosityBoost.Unlock()
+
+	// (changes are logged after unlocking, in case they are observed
+	// by something that changes the levels)
+	logConfigChange("output_levels", prev, boosted)
+}
+
+func endVerbosityBoost() {
+	verbosityBoost.Lock()
+	if verbosityBoost.timer == nil || time.Now().Before(verbosityBoost.until) {
+		verbosityBoost.Unlock()
+		return // boost was extended or already ended
+	}
+	restored := verbosityBoost.saved
+	prev := applyOutputLevels(restored)
+	verbosityBoost.timer = nil
+	verbosityBoost.Unlock()
+
+	logConfigChange("output_levels", prev, restored)
+}
+
+// verbosityBoostRemaining returns how much time is left on the current boost, if any.
+func verbosityBoostRemaining() time.Duration {
+	verbosityBoost.Lock()
+	defer verbosityBoost.Unlock()
+	if verbosityBoost.timer == nil {
+		return 0
+	}
+	return max(time.Until(verbosityBoost.until), 0)
+}
+
+var verbosityBoost struct {
+	sync.Mutex             // also guards changes to the output levels
+	timer      *time.Timer // nil if no boost is active
+	level      zapcore.Level
+	until      time.Time
+	saved      OutputLevels // the levels to restore when the boost ends
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// OutputLevels are the minimum levels of each log output. Each output
+// is independent of the others: for example, the console can show debug
+// logs while the UI only receives info and above.
+type OutputLevels struct {
+	Console zapcore.Level `json:"console"`
+	UI      zapcore.Level `json:"ui"`
+	File    zapcore.Level `json:"file"`
+}
+
+// boosted returns the levels after applying a verbosity boost to level.
+func (levels OutputLevels) boosted(level zapcore.Level) OutputLevels {
+	return OutputLevels{
+		Console: min(levels.Console, level),
+		UI:      min(levels.UI, level),
+		File:    min(levels.File, level),
+	}
+}
+
+// SetOutputLevels sets the minimum levels of all outputs at once. The
+// levels take effect immediately for all loggers, without needing to
+// reconnect any subscribers. If a verbosity boost is active, the new
+// levels are the ones restored when it ends, and are boosted until then.
+func SetOutputLevels(levels OutputLevels) {
+	updateOutputLevels(func(l *OutputLevels) { *l = levels })
+}
+
+// SetConsoleLevel sets the minimum level of the console output, leaving
+// the levels of the other outputs as they are (see SetOutputLevels). The
+// console shows debug logs by default, which is a lot of output during
+// imports, so production deployments may prefer info or higher, and turn
+// it back down to debug only while troubleshooting.
+func SetConsoleLevel(level zapcore.Level) {
+	updateOutputLevels(func(l *OutputLevels) { l.Console = level })
+}
+
+// updateOutputLevels changes the levels of the outputs with update. If a
+// verbosity boost is active, update changes the levels that are restored
+// when it ends, which are boosted until then.
+func updateOutputLevels(update func(*OutputLevels)) {
+	verbosityBoost.Lock()
+	levels := currentOutputLevels()
+	if verbosityBoost.timer != nil {
+		levels = verbosityBoost.saved
+	}
+	update(&levels)
+	if verbosityBoost.timer != nil {
+		verbosityBoost.saved = levels
+		levels = levels.boosted(verbosityBoost.level)
+	}
+	prev := applyOutputLevels(levels)
+	verbosityBoost.Unlock()
+
+	logConfigChange("output_levels", prev, levels)
+}
+
+// OutputLevelsSnapshot returns the current minimum levels of all
+// outputs, including the effects of any active verbosity boost.
+func OutputLevelsSnapshot() OutputLevels {
+	verbosityBoost.Lock()
+	defer verbosityBoost.Unlock()
+	return currentOutputLevels()
+}
+
+func currentOutputLevels() OutputLevels {
+	return *outputLevels.Load()
+}
+
+// applyOutputLevels sets the levels of the outputs and returns the
+// previous levels.
+func applyOutputLevels(levels OutputLevels) (prev OutputLevels) {
+	return *outputLevels.Swap(&levels)
+}
+
+// LogSettings describes the current configuration of the logging subsystem.
+type LogSettings struct {
+	ConsoleLevel            zapcore.Level `json:"console_level"`
+	UILevel                 zapcore.Level `json:"ui_level"`
+	FileLevel               zapcore.Level `json:"file_level"`
+	VerbosityBoostRemaining time.Duration `json:"verbosity_boost_remaining,omitempty"`
+}
+
+// CurrentLogSettings returns a snapshot of the current logging configuration.
+func CurrentLogSettings() LogSettings {
+	levels := OutputLevelsSnapshot()
+	return LogSettings{
+		ConsoleLevel:            levels.Console,
+		UILevel:                 levels.UI,
+		FileLevel:               levels.File,
+		VerbosityBoostRemaining: verbosityBoostRemaining(),
+	}
+}
+
+// logConfigChange logs that a setting that affects logging was changed
+// from oldValue to newValue, for an audit trail of who changed logging
+// behavior (such as turning on debug logs) and when. The entries are
+// logged at info level under the "log.config" logger, which is never
+// sampled, and their caller is the caller of the setter. Nothing is
+// logged if the value is unchanged, or while a change is already being
+// logged by the same goroutine (for example, if a log transform or sink
+// changes a setting), which would recurse.
+func logConfigChange(setting string, oldValue, newValue any) {
+	if reflect.DeepEqual(oldValue, newValue) {
+		return
+	}
+	gid := goroutineID()
+	if _, loggingChange := loggingConfigChanges.LoadOrStore(gid, struct{}{}); loggingChange {
+		return
+	}
+	defer loggingConfigChanges.Delete(gid)
+	configChangeLog.Info("setting changed",
+		zap.String("setting", setting),
+		zap.Any("old", oldValue),
+		zap.Any("new", newValue))
+}
+
+// configChangeLog is the logger for logConfigChange, which skips the
+// setter so the caller of the setter is the caller of the entry.
+var configChangeLog = Log.WithOptions(zap.AddCallerSkip(2)).Named("log.config") //nolint:mnd // logConfigChange and the setter
+
+// loggingConfigChanges is the set of goroutines (by ID) that are
+// logging a config change.
+var loggingConfigChanges sync.Map
@@ -0,0 +1,1280 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// multiConnWriter is like io.multiWriter from the standard lib,
+// except this supports dynamically adding and removing writers
+// and is specifically for WebSocket connections and Wails
+// application events (see AddLogEventEmitter).
+//
+// This is a "best-effort" multi-writer. If there is an error writing
+// to one conn, it does not abort and will continue to write to the
+// other conns. Write errors are discarded, but write errors that are
+// specifically closed connections will result in that connection
+// being removed from the pool.
+//
+// Each conn has its own send queue which is drained by its own
+// goroutine, so that one slow client does not hold up the others.
+// Messages are never blocked on a full queue; instead, the oldest
+// messages in it are dropped, and the client is told how many were
+// dropped before it is sent the next one (see drain).
+type multiConnWriter struct {
+	subs   []*logSubscriber
+	subsMu sync.RWMutex
+
+	writeMu sync.Mutex    // keeps messages in order
+	backoff fanoutBackoff // guarded by writeMu
+
+	// recent messages, which are replayed to new subscribers
+	history logHistory
+
+	// starts sending heartbeats to subscribers
+	heartbeats sync.Once
+
+	// whether pingSubscribers is running; guarded by subsMu
+	pinging bool
+
+	// the most recent status update of each job
+	jobStatuses jobStatusRegistry
+}
+
+// logConn is the part of a websocket connection that log
+// subscribers need.
+type logConn interface {
+	WriteMessage(messageType int, data []byte) error
+	SetWriteDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+}
+
+func (mw *multiConnWriter) writeEntry(ent zapcore.Entry, meta entryMeta, p []byte) error {
+	msg := logMessage{
+		logger:    ent.LoggerName,
+		level:     ent.Level,
+		time:      ent.Time,
+		entryMeta: meta,
+	}
+
+	mw.writeMu.Lock()
+	defer mw.writeMu.Unlock()
+
+	// the sequence number is stable since writeMu serializes additions
+	// to the history; appending it also copies p, which the caller may
+	// reuse after we return, even though the message is written later
+	msg.seq = mw.history.nextSeq()
+	msg.data = appendSeq(p, msg.seq)
+	if ent.LoggerName == "job.status" && meta.jobID > 0 {
+		mw.jobStatuses.record(ent.Message, msg)
+	}
+
+	mw.subsMu.RLock()
+	defer mw.subsMu.RUnlock()
+	mw.history.add(msg)
+	if mw.backoff.paused(mw.subs, time.Now()) {
+		return nil
+	}
+	for _, sub := range mw.subs {
+		if sub.filter.allows(msg) {
+			sub.enqueue(msg.data)
+		}
+	}
+	return nil
+}
+
+// fanoutBackoff pauses delivery of messages to subscribers while all of
+// them are failing, such as during a network blip, so that we don't
+// waste effort on every entry during heavy logging. While paused, one
+// message is let through after each delay, which doubles each time, as
+// a probe. Delivery resumes as soon as a write succeeds or a new
+// subscriber is added.
+type fanoutBackoff struct {
+	delay time.Duration // 0 if not backing off
+	until time.Time
+
+	resume atomic.Bool // set when backing off should stop
+}
+
+// paused reports whether delivery of a message to subs is paused.
+func (b *fanoutBackoff) paused(subs []*logSubscriber, now time.Time) bool {
+	if b.resume.Swap(false) && b.delay > 0 {
+		b.delay, b.until = 0, time.Time{}
+		internalLog.Info("resuming delivery of logs to subscribers")
+	}
+	if len(subs) == 0 {
+		return false
+	}
+	if now.Before(b.until) {
+		return true
+	}
+	initial, maxDelay := fanoutBackoffParams()
+	if b.delay > 0 {
+		// the delay has elapsed; let this message through as a probe
+		b.delay = min(b.delay*2, maxDelay)
+		b.until = now.Add(b.delay)
+		return false
+	}
+	for _, sub := range subs {
+		if sub.failing.Load() < allFailingThreshold {
+			return false
+		}
+	}
+	b.delay = initial
+	b.until = now.Add(b.delay)
+	internalLog.Warn("writes to all log subscribers are failing; pausing delivery with backoff",
+		zap.Int("subscribers", len(subs)))
+	return true
+}
+
+// SetFanoutBackoff sets the initial and maximum delays for pausing the
+// delivery of logs to subscribers while all of them are failing. If
+// either is not positive, its default is used.
+func SetFanoutBackoff(initial, maxDelay time.Duration) {
+	if initial <= 0 {
+		initial = defaultFanoutBackoffInitial
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultFanoutBackoffMax
+	}
+	fanoutBackoffInitial.Store(int64(initial))
+	fanoutBackoffMax.Store(int64(max(initial, maxDelay)))
+}
+
+var fanoutBackoffInitial, fanoutBackoffMax = func() (*atomic.Int64, *atomic.Int64) {
+	var initial, maxDelay atomic.Int64
+	initial.Store(int64(defaultFanoutBackoffInitial))
+	maxDelay.Store(int64(defaultFanoutBackoffMax))
+	return &initial, &maxDelay
+}()
+
+func fanoutBackoffParams() (initial, maxDelay time.Duration) {
+	return time.Duration(fanoutBackoffInitial.Load()), time.Duration(fanoutBackoffMax.Load())
+}
+
+// Sync is a no-op, since messages are written to each conn in the background.
+func (*multiConnWriter) Sync() error { return nil }
+
+// logMessage is an encoded log entry, along with the metadata
+// needed to decide which subscribers get it.
+type logMessage struct {
+	data   []byte
+	seq    uint64 // see logHistory
+	logger string
+	level  zapcore.Level
+	time   time.Time
+	entryMeta
+}
+
+// subscriptionFilter decides which messages a subscriber gets.
+type subscriptionFilter struct {
+	loggers  loggerFilter
+	jobIDs   []uint64             // if set, only messages for these jobs are allowed
+	itemRef  string               // if set, only messages for this item are allowed
+	minLevel zapcore.LevelEnabler // if set, only messages at enabled levels are allowed
+}
+
+func (f subscriptionFilter) allows(msg logMessage) bool {
+	return f.loggers.allows(msg.logger) &&
+		(len(f.jobIDs) == 0 || slices.Contains(f.jobIDs, msg.jobID)) &&
+		(f.itemRef == "" || f.itemRef == msg.itemRef) &&
+		(f.minLevel == nil || f.minLevel.Enabled(msg.level))
+}
+
+// AddConn subscribes conn to writes that pass filter. Recent messages in
+// the history, if enabled, are replayed to conn first. The handoff from
+// replay to live messages happens while writes are blocked, so none are
+// duplicated or missed in between.
+func (mw *multiConnWriter) AddConn(conn logConn, filter subscriptionFilter) {
+	mw.AddConnSince(conn, filter, 0)
+}
+
+// AddConnSince is like AddConn, except only messages in the history with
+// a sequence number greater than afterSeq are replayed.
+func (mw *multiConnWriter) AddConnSince(conn logConn, filter subscriptionFilter, afterSeq uint64) {
+	mw.addConn(conn, filter, afterSeq, 0)
+}
+
+// addConn is like AddConnSince, except if replayLimit is positive, no more
+// than that many of the most recent messages that pass filter are replayed,
+// and if it is negative, none are.
+func (mw *multiConnWriter) addConn(conn logConn, filter subscriptionFilter, afterSeq uint64, replayLimit int) {
+	writeMu := acquireConnWriteLock(conn)
+	mw.heartbeats.Do(func() { go mw.sendHeartbeats() })
+
+	mw.backoff.resume.Store(true) // a new subscriber may be able to receive logs
+
+	mw.subsMu.Lock()
+	defer mw.subsMu.Unlock()
+
+	var replay [][]byte
+	if replayLimit >= 0 {
+		replay = mw.replay(filter, afterSeq, replayLimit)
+	}
+
+	// the queue has room for the whole replay on top of its usual
+	// capacity, so a client doesn't drop its backlog upon connecting
+	sub := &logSubscriber{
+		conn:   conn,
+		filter: filter,
+		queue:  make(chan []byte, logSubscriberQueueSize+len(replay)),
+		done:   make(chan struct{}),
+		flush:  make(chan struct{}, 1),
+		since:  time.Now(),
+
+		writeMu: writeMu,
+	}
+	for _, data := range replay {
+		sub.enqueue(data)
+	}
+	go sub.drain(mw)
+	mw.subs = append(mw.subs, sub)
+	if !mw.pinging {
+		mw.pinging = true
+		go mw.pingSubscribers()
+	}
+}
+
+// replay returns the messages to replay to a new subscriber, as described
+// by addConn. It must be called while writes are blocked.
+func (mw *multiConnWriter) replay(filter subscriptionFilter, afterSeq uint64, limit int) [][]byte {
+	var msgs [][]byte
+	history, missed := mw.history.since(afterSeq)
+	if missed > 0 && afterSeq > 0 {
+		// let the UI know that the history it got is incomplete; a new
+		// client didn't ask to resume, so it isn't missing anything
+		if marker := replayGapMessage(missed); marker != nil {
+			msgs = append(msgs, marker)
+		}
+	}
+	replayed := len(msgs)
+	if replayJobStatuses.Load() {
+		// status updates that are in the history are replayed with it
+		beforeSeq := mw.history.nextSeq()
+		if len(history) > 0 {
+			beforeSeq = history[0].seq
+		}
+		for _, msg := range mw.jobStatuses.messagesBetween(afterSeq, beforeSeq) {
+			if filter.allows(msg) {
+				msgs = append(msgs, msg.data)
+			}
+		}
+	}
+	for _, msg := range history {
+		if filter.allows(msg) {
+			msgs = append(msgs, msg.data)
+		}
+	}
+	if limit > 0 && len(msgs)-replayed > limit {
+		// keep the gap marker, if any, since even more is missing now
+		msgs = append(msgs[:replayed], msgs[len(msgs)-limit:]...)
+	}
+	return msgs
+}
+
+// RemoveConn unsubscribes conn from writes, if it is subscribed.
+// It returns after any messages already being written to conn
+// are done, so it is safe to close conn afterward.
+func (mw *multiConnWriter) RemoveConn(conn logConn) {
+	mw.subsMu.RLock()
+	var sub *logSubscriber
+	for _, s := range mw.subs {
+		if s.conn == conn {
+			sub = s
+			break
+		}
+	}
+	mw.subsMu.RUnlock()
+	if sub == nil {
+		return
+	}
+	mw.removeSubscriber(sub)
+	<-sub.done
+}
+
+// removeSubscriber removes sub from the pool and stops its drain
+// goroutine once its queue is empty. It is idempotent.
+func (mw *multiConnWriter) removeSubscriber(sub *logSubscriber) {
+	mw.subsMu.Lock()
+	defer mw.subsMu.Unlock()
+	for i, s := range mw.subs {
+		if s == sub {
+			mw.subs = append(mw.subs[:i], mw.subs[i+1:]...)
+			// no writer can be sending to the queue now, since
+			// writers hold the read lock while enqueueing
+			close(sub.queue)
+			return
+		}
+	}
+}
+
+// subscribers returns information about each subscriber. It only
+// reads the channel length and atomic counters, so it does not
+// contend with the drain goroutines.
+func (mw *multiConnWriter) subscribers() []LogSubscriberInfo {
+	mw.subsMu.RLock()
+	defer mw.subsMu.RUnlock()
+	infos := make([]LogSubscriberInfo, 0, len(mw.subs))
+	for _, sub := range mw.subs {
+		infos = append(infos, sub.info())
+	}
+	return infos
+}
+
+// info returns information about the subscriber.
+func (sub *logSubscriber) info() LogSubscriberInfo {
+	return LogSubscriberInfo{
+		RemoteAddr:    sub.conn.RemoteAddr().String(),
+		QueueDepth:    len(sub.queue),
+		QueueCapacity: cap(sub.queue),
+		HighWater:     int(sub.highWater.Load()),
+		Pending:       int(sub.pending.Load()),
+		Dropped:       int(sub.dropped.Load()),
+		Since:         sub.since,
+	}
+}
+
+// logSubscriber is a single connection that is receiving logs.
+type logSubscriber struct {
+	conn   logConn
+	filter subscriptionFilter
+	queue  chan []byte
+	done   chan struct{}
+	flush  chan struct{} // signals that the current batch should be sent (see FlushLogBatches)
+	since  time.Time
+
+	// held while writing to conn, which may have other subscriptions
+	// (see acquireConnWriteLock)
+	writeMu *connWriteLock
+
+	// the largest queue depth observed
+	highWater atomic.Int64
+
+	// the number of consecutive failed writes
+	failing atomic.Int64
+
+	// the number of messages that have been enqueued but not yet
+	// written (or given up on), including any being written now
+	pending atomic.Int64
+
+	// the number of messages that were dropped because the queue
+	// was full (or the log memory budget was exceeded)
+	dropped atomic.Int64
+
+	// when the queue became nearly full (and has remained so),
+	// and when we last warned about it, as unix nanoseconds;
+	// nearFullSince is 0 when the queue is not nearly full
+	nearFullSince atomic.Int64
+	lastWarn      atomic.Int64
+}
+
+// enqueue adds msg to the subscriber's queue without blocking. If the
+// queue is full, or the log memory budget is exceeded, the oldest message
+// in the queue (if any) is dropped to make room, so a client that can't
+// keep up misses messages instead of holding up logging for everyone.
+func (sub *logSubscriber) enqueue(msg []byte) {
+	if logMemory.overBudget() && sub.dropOldest() {
+		logMemory.evicting()
+	}
+	sub.pending.Add(1)
+	logMemory.queued.Add(int64(len(msg)))
+	for {
+		select {
+		case sub.queue <- msg:
+		default:
+			// the drain goroutine may have made room in the meantime,
+			// in which case there is nothing to drop, so just try again
+			sub.dropOldest()
+			continue
+		}
+		break
+	}
+
+	depth := int64(len(sub.queue))
+	for {
+		hw := sub.highWater.Load()
+		if depth <= hw || sub.highWater.CompareAndSwap(hw, depth) {
+			break
+		}
+	}
+
+	if depth < int64(cap(sub.queue))*logSubscriberNearFullPercent/100 {
+		sub.nearFullSince.Store(0)
+		return
+	}
+	now := time.Now().UnixNano()
+	if sub.nearFullSince.CompareAndSwap(0, now) {
+		return
+	}
+	if now-sub.nearFullSince.Load() < int64(logSubscriberSlowAfter) {
+		return
+	}
+	last := sub.lastWarn.Load()
+	if now-last < int64(logSubscriberWarnInterval) || !sub.lastWarn.CompareAndSwap(last, now) {
+		return
+	}
+	internalLog.Warn("log subscriber is not keeping up; its send queue is nearly full",
+		zap.Stringer("remote_addr", sub.conn.RemoteAddr()),
+		zap.Int64("queue_depth", depth),
+		zap.Int("queue_capacity", cap(sub.queue)),
+		zap.Duration("near_capacity_for", time.Duration(now-sub.nearFullSince.Load())))
+}
+
+// dropOldest removes the oldest message from the queue, if there is one,
+// and returns whether it did.
+func (sub *logSubscriber) dropOldest() bool {
+	select {
+	case dropped := <-sub.queue:
+		sub.pending.Add(-1)
+		logMemory.queued.Add(-int64(len(dropped)))
+		sub.dropped.Add(1)
+		logMetrics.subscriberDrops.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+// tryEnqueue adds msg to the subscriber's queue if there is room,
+// and returns whether it did.
+func (sub *logSubscriber) tryEnqueue(msg []byte) bool {
+	sub.pending.Add(1)
+	logMemory.queued.Add(int64(len(msg)))
+	select {
+	case sub.queue <- msg:
+		return true
+	default:
+		sub.pending.Add(-1)
+		logMemory.queued.Add(-int64(len(msg)))
+		return false
+	}
+}
+
+// drain writes queued messages to the connection until the queue is
+// closed. If messages were dropped since the last one was written (see
+// enqueue), the next one is preceded by a notice of how many, which is a
+// JSON object with a "type" of "dropped", so the client knows there is a
+// gap in the logs, without being sent a notice for every dropped message.
+func (sub *logSubscriber) drain(mw *multiConnWriter) {
+	defer close(sub.done)
+	defer releaseConnWriteLock(sub.conn)
+	var closed bool
+	var consecutiveErrors int
+	var notifiedDrops int64
+	for msg := range sub.queue {
+		logMemory.queued.Add(-int64(len(msg)))
+		if closed {
+			sub.pending.Add(-1)
+			continue // keep draining so writers don't get blocked
+		}
+		if dropped := sub.dropped.Load(); dropped > notifiedDrops {
+			notice, err := json.Marshal(logDropNotice{
+				Type:    "dropped",
+				Time:    time.Now(),
+				Dropped: dropped - notifiedDrops,
+			})
+			if err == nil {
+				_ = sub.write(append(notice, '\n'))
+			}
+			notifiedDrops = dropped
+		}
+		n := 1
+		if window := time.Duration(logBatchWindow.Load()); window > 0 {
+			var reason batchFlushReason
+			msg, n, reason = sub.collectBatch(msg, window)
+			logMetrics.countBatch(n, reason)
+		}
+		err := sub.write(msg)
+		sub.pending.Add(-int64(n))
+		if err == nil {
+			if consecutiveErrors > 0 {
+				consecutiveErrors = 0
+				sub.failing.Store(0)
+				mw.backoff.resume.Store(true)
+			}
+			continue
+		}
+		consecutiveErrors++
+		sub.failing.Store(int64(consecutiveErrors))
+		logMetrics.writeErrors.Add(1)
+
+		// the handler that added this connection to the pool should
+		// have removed it when it was closed, but just in case we
+		// find out first that it was closed, we can remove it now
+		// (asynchronously, since a writer may be blocked on our
+		// queue while holding the read lock); similarly, a conn
+		// that keeps failing is probably dead even though it was
+		// never closed properly
+		threshold := int(connErrorThreshold.Load())
+		tooManyErrors := threshold > 0 && consecutiveErrors >= threshold
+		if errors.Is(err, websocket.ErrCloseSent) || tooManyErrors {
+			closed = true
+			info := sub.info()
+			go func() {
+				mw.removeSubscriber(sub)
+				if handle := logConnDropHandler.Load(); handle != nil {
+					(*handle)(info, err)
+				}
+			}()
+		}
+		if tooManyErrors {
+			internalLog.Warn("removing log subscriber after repeated write errors",
+				zap.Stringer("remote_addr", sub.conn.RemoteAddr()),
+				zap.Int("consecutive_errors", consecutiveErrors),
+				zap.Error(err))
+		} else if closed {
+			internalLog.Debug("removing log subscriber whose connection was closed",
+				zap.Stringer("remote_addr", sub.conn.RemoteAddr()))
+		}
+	}
+}
+
+// SetLogConnDropHandler sets a function that is called when a log
+// subscriber is removed because writing to it failed, either because
+// its connection was closed or because it had too many consecutive
+// write errors (see SetConnErrorThreshold), rather than by RemoveLogConn.
+// It is given the subscriber as it was when it was dropped, and the last
+// write error. It is called from its own goroutine, after the subscriber
+// has been removed, so it may log. A nil handler (the default) disables
+// it; drops are still logged to the console.
+func SetLogConnDropHandler(handle func(LogSubscriberInfo, error)) {
+	if handle == nil {
+		logConnDropHandler.Store(nil)
+		return
+	}
+	logConnDropHandler.Store(&handle)
+}
+
+var logConnDropHandler atomic.Pointer[func(LogSubscriberInfo, error)]
+
+// SetConnErrorThreshold sets how many consecutive write errors a log
+// subscriber may have before it is removed. A successful write resets
+// the count. This cleans up connections that are dead but were never
+// closed properly. A threshold of 0 or less disables removal based on
+// write errors, in which case only connections that are known to be
+// closed are removed.
+func SetConnErrorThreshold(n int) {
+	logConfigChange("conn_error_threshold", connErrorThreshold.Swap(int64(n)), int64(n))
+}
+
+var connErrorThreshold = func() *atomic.Int64 {
+	var n atomic.Int64
+	n.Store(defaultConnErrorThreshold)
+	return &n
+}()
+
+// sendHeartbeats periodically sends each subscriber a heartbeat, so that
+// the UI can show the health of its connection and detect a stalled
+// server. Heartbeats are JSON objects with a "type" of "heartbeat",
+// which distinguishes them from log entries, along with the server's
+// time and current number of subscribers. Subscribers that are backed
+// up or failing are skipped, since they have bigger problems.
+func (mw *multiConnWriter) sendHeartbeats() {
+	for {
+		time.Sleep(time.Duration(logHeartbeatInterval.Load()))
+
+		mw.subsMu.RLock()
+		heartbeat, err := json.Marshal(logHeartbeat{
+			Type:        "heartbeat",
+			Time:        time.Now(),
+			Subscribers: len(mw.subs),
+		})
+		if err == nil {
+			heartbeat = append(heartbeat, '\n')
+			for _, sub := range mw.subs {
+				if sub.failing.Load() == 0 {
+					sub.tryEnqueue(heartbeat)
+				}
+			}
+		}
+		mw.subsMu.RUnlock()
+	}
+}
+
+// write writes msg to the connection as a text message.
+func (sub *logSubscriber) write(msg []byte) error {
+	sub.writeMu.Lock()
+	defer sub.writeMu.Unlock()
+	_ = sub.conn.SetWriteDeadline(time.Now().Add(logConnWriteTimeout))
+	return sub.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// connWriteLocks are the write locks of the conns that are subscribed to
+// logs. Websocket connections allow only one writer at a time, and while
+// each subscriber is written to only by its own drain goroutine, a conn
+// can have more than one subscription (such as to the default pool and
+// another pool, see Pool), so its subscribers share one lock.
+var connWriteLocks = struct {
+	sync.Mutex
+	locks map[logConn]*connWriteLock
+}{locks: make(map[logConn]*connWriteLock)}
+
+type connWriteLock struct {
+	sync.Mutex
+	refs int // the number of subscriptions of the conn
+
+	// when the conn last answered a ping (unix nanoseconds), if
+	// it supports pings (see pingSubscribers)
+	lastPong atomic.Int64
+}
+
+// acquireConnWriteLock returns the write lock of conn, which must be
+// released with releaseConnWriteLock when the subscription ends.
+func acquireConnWriteLock(conn logConn) *connWriteLock {
+	connWriteLocks.Lock()
+	defer connWriteLocks.Unlock()
+	lock, ok := connWriteLocks.locks[conn]
+	if !ok {
+		lock = new(connWriteLock)
+		connWriteLocks.locks[conn] = lock
+		if c, ok := conn.(pingableConn); ok {
+			// the handler that subscribed the conn reads from it,
+			// which is what calls the pong handler
+			lock.lastPong.Store(time.Now().UnixNano())
+			c.SetPongHandler(func(string) error {
+				lock.lastPong.Store(time.Now().UnixNano())
+				return nil
+			})
+		}
+	}
+	lock.refs++
+	return lock
+}
+
+func releaseConnWriteLock(conn logConn) {
+	connWriteLocks.Lock()
+	defer connWriteLocks.Unlock()
+	if lock, ok := connWriteLocks.locks[conn]; ok {
+		if lock.refs--; lock.refs <= 0 {
+			delete(connWriteLocks.locks, conn)
+		}
+	}
+}
+
+// logDropNotice is sent to a subscriber before the next message after
+// messages were dropped for it (see drain).
+type logDropNotice struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Dropped int64     `json:"dropped"`
+}
+
+// logHeartbeat is sent to subscribers periodically (see sendHeartbeats).
+type logHeartbeat struct {
+	Type        string    `json:"type"`
+	Time        time.Time `json:"time"`
+	Subscribers int       `json:"subscribers"`
+}
+
+// SetLogHeartbeatInterval sets how often log subscribers are sent a
+// heartbeat message. It takes effect after the current interval. If d
+// is not positive, a default interval is used. (WebSocket pings from
+// the client are answered with pongs as long as the connection is read
+// from, which the handler that subscribes it must do anyway to notice
+// when it closes.)
+func SetLogHeartbeatInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultLogHeartbeatInterval
+	}
+	logHeartbeatInterval.Store(int64(d))
+}
+
+var logHeartbeatInterval = func() *atomic.Int64 {
+	var d atomic.Int64
+	d.Store(int64(defaultLogHeartbeatInterval))
+	return &d
+}()
+
+// pingableConn is a conn that supports WebSocket pings, like
+// *websocket.Conn.
+type pingableConn interface {
+	logConn
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
+
+// pingSubscribers periodically sends a WebSocket ping to each conn that
+// supports it, and evicts conns that fail the ping or that don't answer
+// with a pong within the timeout (see SetLogPingInterval). This detects
+// dead connections that were never closed, which otherwise may take a
+// long time to fail writes, if they ever do, since most of the time
+// nothing is being logged. Pings are written while holding the conn's
+// write lock, like log messages. Evicted conns are closed, so that the
+// handler reading from them finds out too. It runs while the pool has
+// subscribers, and is started again by addConn when it gets one.
+func (mw *multiConnWriter) pingSubscribers() {
+	for {
+		time.Sleep(time.Duration(logPingInterval.Load()))
+
+		mw.subsMu.Lock()
+		if len(mw.subs) == 0 {
+			mw.pinging = false
+			mw.subsMu.Unlock()
+			return
+		}
+		subs := slices.Clone(mw.subs)
+		mw.subsMu.Unlock()
+
+		pinged := make(map[logConn]time.Time)
+		for _, sub := range subs {
+			conn, ok := sub.conn.(pingableConn)
+			if !ok {
+				continue
+			}
+			if _, ok := pinged[conn]; ok {
+				continue // more than one subscription to this pool
+			}
+			now := time.Now()
+			sub.writeMu.Lock()
+			err := conn.WriteControl(websocket.PingMessage, nil, now.Add(wsControlWriteTimeout))
+			sub.writeMu.Unlock()
+			if err != nil {
+				mw.evictConn(subs, conn, err)
+				continue
+			}
+			pinged[conn] = now
+		}
+		if len(pinged) == 0 {
+			continue
+		}
+
+		time.Sleep(time.Duration(logPongTimeout.Load()))
+
+		evicted := make(map[logConn]struct{})
+		for _, sub := range subs {
+			pingedAt, ok := pinged[sub.conn]
+			if !ok {
+				continue
+			}
+			if _, ok := evicted[sub.conn]; ok {
+				continue
+			}
+			if sub.writeMu.lastPong.Load() < pingedAt.UnixNano() {
+				evicted[sub.conn] = struct{}{}
+				mw.evictConn(subs, sub.conn.(pingableConn), errLogConnPongTimeout)
+			}
+		}
+	}
+}
+
+// evictConn removes the subscribers of conn that are in subs, notifies
+// the drop handler (see SetLogConnDropHandler), and closes conn.
+func (mw *multiConnWriter) evictConn(subs []*logSubscriber, conn pingableConn, err error) {
+	internalLog.Warn("removing unresponsive log subscriber",
+		zap.Stringer("remote_addr", conn.RemoteAddr()),
+		zap.Error(err))
+	for _, sub := range subs {
+		if sub.conn != conn {
+			continue
+		}
+		info := sub.info()
+		mw.removeSubscriber(sub)
+		if handle := logConnDropHandler.Load(); handle != nil {
+			go (*handle)(info, err)
+		}
+	}
+	// closing the conn also unblocks a drain goroutine that is stuck
+	// writing to it
+	_ = conn.Close()
+}
+
+// errLogConnPongTimeout is the error given to the drop handler when a
+// conn is evicted for not answering a ping in time.
+var errLogConnPongTimeout = errors.New("log subscriber did not answer ping in time")
+
+// SetLogPingInterval sets how often log subscribers are sent a WebSocket
+// ping, and how long they have to answer it with a pong before they are
+// removed and their connection closed (see pingSubscribers). Non-positive
+// values are replaced with defaults. It takes effect after the current
+// interval.
+func SetLogPingInterval(interval, pongTimeout time.Duration) {
+	if interval <= 0 {
+		interval = defaultLogPingInterval
+	}
+	if pongTimeout <= 0 {
+		pongTimeout = defaultLogPongTimeout
+	}
+	logPingInterval.Store(int64(interval))
+	logPongTimeout.Store(int64(pongTimeout))
+}
+
+var (
+	logPingInterval = func() *atomic.Int64 {
+		var d atomic.Int64
+		d.Store(int64(defaultLogPingInterval))
+		return &d
+	}()
+	logPongTimeout = func() *atomic.Int64 {
+		var d atomic.Int64
+		d.Store(int64(defaultLogPongTimeout))
+		return &d
+	}()
+)
+
+// waitDrained waits until every subscriber has been sent all the messages
+// queued for it, or until the deadline, whichever is first. It returns
+// information about the subscribers that still have pending messages.
+func (mw *multiConnWriter) waitDrained(deadline time.Time) []LogSubscriberInfo {
+	for {
+		var backlogged []LogSubscriberInfo
+		for _, info := range mw.subscribers() {
+			if info.Pending > 0 {
+				backlogged = append(backlogged, info)
+			}
+		}
+		if len(backlogged) == 0 || !time.Now().Before(deadline) {
+			return backlogged
+		}
+		mw.flushBatches() // don't wait for batch windows to end
+		time.Sleep(min(time.Until(deadline), drainPollInterval))
+	}
+}
+
+// SyncLogs flushes buffered log output, such as asynchronous console
+// writes (see SetAsyncConsole) and the log file, returning any error
+// from doing so. If timeout is positive, it then waits up to timeout
+// for every log subscriber, in every pool (see Pool), to be sent all
+// the messages queued for it, and returns the subscribers that still
+// had a backlog when the time ran out (whose Pending counts say how
+// many messages they had left). This gives shutdown code certainty
+// about what was delivered.
+func SyncLogs(timeout time.Duration) ([]LogSubscriberInfo, error) {
+	err := Log.Sync()
+	if timeout <= 0 {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	var backlogged []LogSubscriberInfo
+	for _, mw := range logPools.writers() {
+		backlogged = append(backlogged, mw.waitDrained(deadline)...)
+	}
+	return backlogged, err
+}
+
+// CloseLog tears down the log output for shutdown: like SyncLogs, it
+// flushes buffered output and waits up to timeout for the subscribers of
+// every pool (see Pool) to be sent their queued messages, returning those
+// that still had a backlog. Then it removes all subscribers, and tells
+// each one that the stream is ending: WebSocket connections are sent a
+// close message, and Server-Sent Event streams (see LogSSEHandler) are
+// sent an "end" event and ended. It is safe to call more than once, and
+// while entries are being logged, which are still written to the other
+// outputs, like the console and log file.
+func CloseLog(timeout time.Duration) ([]LogSubscriberInfo, error) {
+	backlogged, err := SyncLogs(timeout)
+	for _, mw := range logPools.writers() {
+		mw.closeAll()
+	}
+	return backlogged, err
+}
+
+// closeAll removes all subscribers, waits for their drain goroutines to
+// finish, and then tells each conn that the stream is ending.
+func (mw *multiConnWriter) closeAll() {
+	mw.subsMu.Lock()
+	subs := mw.subs
+	mw.subs = nil
+	for _, sub := range subs {
+		close(sub.queue)
+	}
+	mw.subsMu.Unlock()
+
+	closed := make(map[logConn]struct{}, len(subs))
+	for _, sub := range subs {
+		<-sub.done
+		if _, ok := closed[sub.conn]; ok {
+			continue // more than one subscription to this pool
+		}
+		closed[sub.conn] = struct{}{}
+		closeLogStream(sub.conn)
+	}
+}
+
+// closeLogStream tells conn that no more log messages will be sent.
+func closeLogStream(conn logConn) {
+	switch c := conn.(type) {
+	case *websocket.Conn:
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "log stream closed")
+		_ = c.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(wsControlWriteTimeout))
+	case *sseConn:
+		c.end()
+	}
+}
+
+// subscriberCount returns the number of subscribers.
+func (mw *multiConnWriter) subscriberCount() int {
+	mw.subsMu.RLock()
+	defer mw.subsMu.RUnlock()
+	return len(mw.subs)
+}
+
+// LogSubscriberInfo describes a connection that is receiving logs.
+type LogSubscriberInfo struct {
+	RemoteAddr string `json:"remote_addr"`
+
+	// The number of messages waiting to be sent, and how many
+	// messages can be waiting before the oldest are dropped.
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity"`
+
+	// The largest queue depth since the connection was added.
+	HighWater int `json:"high_water"`
+
+	// The number of messages not yet sent, including those in
+	// the queue and any that are being written right now.
+	Pending int `json:"pending"`
+
+	// The number of messages that were dropped because the
+	// client could not keep up.
+	Dropped int `json:"dropped,omitempty"`
+
+	// When the connection was added.
+	Since time.Time `json:"since"`
+}
+
+// LogSubscribers returns information about the connections that
+// are currently receiving logs, including the depth of their send
+// queues. A queue that is consistently near capacity indicates the
+// client is slow, rather than the logger.
+func LogSubscribers() []LogSubscriberInfo {
+	return websocketLogOutputs.subscribers()
+}
+
+const (
+	logSubscriberQueueSize       = 256
+	logSubscriberNearFullPercent = 90
+	logSubscriberSlowAfter       = 5 * time.Second
+	logSubscriberWarnInterval    = 30 * time.Second
+	logConnWriteTimeout          = 10 * time.Second
+	drainPollInterval            = 10 * time.Millisecond
+	defaultConnErrorThreshold    = 10
+	defaultLogHeartbeatInterval  = 15 * time.Second
+	defaultLogPingInterval       = 30 * time.Second
+	defaultLogPongTimeout        = 10 * time.Second
+
+	// how many consecutive errors each subscriber must have
+	// before delivery is paused (see fanoutBackoff)
+	allFailingThreshold = 3
+
+	defaultFanoutBackoffInitial = 100 * time.Millisecond
+	defaultFanoutBackoffMax     = 5 * time.Second
+)
+
+// websocketLogOutputs mediates the list of active
+// websocket connections that are receiving process
+// logs.
+var websocketLogOutputs = new(multiConnWriter)
+
+// AddLogConn subscribes conn to the log output, in the
+// default pool (see Pool). When the conn is closed, it
+// should be removed with RemoveLogConn(). If an authorizer is set (see
+// SetLogAuthorizer) and it rejects conn, the conn is
+// closed and ErrLogConnUnauthorized is returned.
+//
+// Optionally, conn only receives entries at or above minLevel, such as
+// zapcore.WarnLevel for a client that only shows warnings and errors.
+// Each message is checked against the level of its entry before it is
+// sent to the conn, so entries below its level are never sent at all.
+// Since the level of the UI output still applies to all conns (see
+// SetOutputLevels), a minimum level below it has no effect; without
+// one, conn receives everything the UI output does.
+func AddLogConn(conn *websocket.Conn, minLevel ...zapcore.Level) error {
+	if len(minLevel) > 0 {
+		return addLogConn(conn, subscriptionFilter{minLevel: minLevel[0]}, 0)
+	}
+	return AddLogConnFiltered(conn)
+}
+
+// AddLogConnFiltered is like AddLogConn, except conn only receives
+// entries from loggers that match at least one of the patterns (all
+// entries, if there are no patterns). A pattern is a dotted logger
+// name, such as "job.status", which matches that logger and all of
+// its descendants; any segment may be "*" to match any one segment,
+// as in "datasource.*.network". An error is returned if a pattern is
+// invalid.
+func AddLogConnFiltered(conn *websocket.Conn, patterns ...string) error {
+	loggers, err := parseLoggerFilter(patterns)
+	if err != nil {
+		return err
+	}
+	return addLogConn(conn, subscriptionFilter{loggers: loggers}, 0)
+}
+
+// AddLogConnSince is like AddLogConn, except only the entries in the
+// recent history (see SetLogHistorySize) with a sequence number greater
+// than seq are replayed before live entries. Each entry sent to
+// subscribers has its sequence number in a "seq" field, so a client
+// that reconnects after a drop can pass the last one it saw to resume
+// the stream without duplicates or gaps. If some of the entries after
+// seq are no longer retained, the replay starts with an entry that has
+// a "replay_gap" field, along with the number of "missed_entries". A
+// seq that is newer than any entry (such as one from before a restart,
+// when sequence numbers start over) replays the whole history.
+func AddLogConnSince(conn *websocket.Conn, seq uint64) error {
+	return addLogConn(conn, subscriptionFilter{}, seq)
+}
+
+// AddJobLogConn is like AddLogConn, except conn only receives entries
+// for the job with the given ID: those with a "job_id" field, or a job
+// logger's "id" field, with that value. Recent history (see
+// SetLogHistorySize) is likewise filtered before it is replayed. When
+// the conn is closed, it should be removed with RemoveJobLogConn().
+//
+// The job of each entry is found from its fields when the entry is
+// written, before it is encoded, and kept with the encoded message, so
+// each subscription's filter can be applied without decoding it again.
+// Entries that aren't associated with any job are never sent to conn,
+// but they are still sent to subscribers that aren't limited to a job.
+func AddJobLogConn(conn *websocket.Conn, jobID uint64) error {
+	return addLogConn(conn, subscriptionFilter{jobIDs: []uint64{jobID}}, 0)
+}
+
+// AddLogConnForItem is like AddLogConn, except conn only receives
+// entries for the item with the given reference (see ItemLogger), so
+// that users can follow one item's journey through all the phases of
+// an import. Recent history is likewise filtered before it is replayed.
+func AddLogConnForItem(conn *websocket.Conn, itemRef string) error {
+	return addLogConn(conn, subscriptionFilter{itemRef: itemRef}, 0)
+}
+
+// FollowOptions configures a subscription to the log output made with
+// AddLogConnFollow. The filters (MinLevel, Loggers, JobID, and ItemRef)
+// apply equally to the entries replayed from the recent history (see
+// SetLogHistorySize) and to live entries; an entry must pass all of them.
+// Which entries are replayed is determined by AfterSeq first, then by
+// Replay: Replay limits the replay to the most recent of the entries
+// after AfterSeq that pass the filters, so that both can be used at once
+// and the newest entries are never the ones left out. The zero value
+// subscribes to all entries and replays the whole history, like
+// AddLogConn.
+type FollowOptions struct {
+	// If positive, at most this many entries are replayed; if negative,
+	// none are, and only live entries are sent. Zero replays all that
+	// are retained.
+	Replay int
+
+	// If nonzero, only entries with a greater sequence number are
+	// replayed; see AddLogConnSince.
+	AfterSeq uint64
+
+	// If set, only entries at levels it enables are sent, for example
+	// zapcore.WarnLevel to follow only warnings and errors.
+	MinLevel zapcore.LevelEnabler
+
+	// If set, only entries from loggers that match at least one of
+	// these patterns are sent; see AddLogConnFiltered.
+	Loggers []string
+
+	// If nonzero, only entries for this job are sent; see AddJobLogConn.
+	JobID uint64
+
+	// If set, only entries for any of these jobs are sent, along with
+	// those for JobID, if it is set. This lets one conn follow a few
+	// related jobs, such as an import and the jobs it starts.
+	JobIDs []uint64
+
+	// If set, only entries for this item are sent; see AddLogConnForItem.
+	ItemRef string
+}
+
+// AddLogConnFollow subscribes conn to the log output as configured by
+// opts, which combines the options of the other AddLogConn variants in
+// one call, so that a client can replay history and follow live entries
+// with one consistent set of filters. An error is returned if any of the
+// logger patterns are invalid, or if an authorizer rejects conn (see
+// AddLogConn). When the conn is closed, it should be removed with
+// RemoveLogConn().
+func AddLogConnFollow(conn *websocket.Conn, opts FollowOptions) error {
+	return addLogConnFollow(websocketLogOutputs, conn, opts)
+}
+
+// addLogConnFollow is like AddLogConnFollow, except it subscribes conn to mw.
+func addLogConnFollow(mw *multiConnWriter, conn *websocket.Conn, opts FollowOptions) error {
+	loggers, err := parseLoggerFilter(opts.Loggers)
+	if err != nil {
+		return err
+	}
+	jobIDs := slices.Clone(opts.JobIDs)
+	if opts.JobID > 0 {
+		jobIDs = append(jobIDs, opts.JobID)
+	}
+	filter := subscriptionFilter{
+		loggers:  loggers,
+		jobIDs:   jobIDs,
+		itemRef:  opts.ItemRef,
+		minLevel: opts.MinLevel,
+	}
+	return addLogConnReplaying(mw, conn, filter, opts.AfterSeq, opts.Replay)
+}
+
+// RemoveJobLogConn removes a conn added with AddJobLogConn.
+func RemoveJobLogConn(conn *websocket.Conn) {
+	RemoveLogConn(conn)
+}
+
+// addLogConn subscribes conn to log messages that pass filter, replaying
+// those in the history after afterSeq, if the authorizer allows it.
+func addLogConn(conn *websocket.Conn, filter subscriptionFilter, afterSeq uint64) error {
+	return addLogConnReplaying(websocketLogOutputs, conn, filter, afterSeq, 0)
+}
+
+// addLogConnReplaying is like addLogConn, except conn is subscribed to
+// mw, and the replay is limited to replayLimit messages, as described by
+// multiConnWriter.addConn.
+func addLogConnReplaying(mw *multiConnWriter, conn *websocket.Conn, filter subscriptionFilter, afterSeq uint64, replayLimit int) error {
+	if authorize := logAuthorizer.Load(); authorize != nil && !(*authorize)(conn) {
+		closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized")
+		_ = conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(wsControlWriteTimeout))
+		_ = conn.Close()
+		return ErrLogConnUnauthorized
+	}
+	mw.addConn(conn, filter, afterSeq, replayLimit)
+	return nil
+}
+
+// SetLogAuthorizer sets a function that is consulted before a
+// connection is subscribed to the log output with AddLogConn.
+// Since logs may contain sensitive data, networked deployments
+// can use this to integrate with whatever authentication the
+// HTTP layer has established. Connections for which authorize
+// returns false are rejected. A nil authorizer (the default)
+// allows all connections.
+func SetLogAuthorizer(authorize func(*websocket.Conn) bool) {
+	if authorize == nil {
+		logAuthorizer.Store(nil)
+		return
+	}
+	logAuthorizer.Store(&authorize)
+}
+
+var logAuthorizer atomic.Pointer[func(*websocket.Conn) bool]
+
+// ErrLogConnUnauthorized is returned when a connection is
+// not allowed to subscribe to the log output.
+var ErrLogConnUnauthorized = errors.New("connection is not authorized to receive logs")
+
+// wsControlWriteTimeout is how long to allow for writing a
+// control message, such as a close frame, to a websocket.
+const wsControlWriteTimeout = 5 * time.Second
+
+// RemoveLogConn removes conn from receiving logs.
+// It is idempotent.
+func RemoveLogConn(conn *websocket.Conn) {
+	websocketLogOutputs.RemoveConn(conn)
+}
+
+// SetMaxWSMessageBytes sets the maximum size of a log message sent to
+// subscribers. An entry that is larger when encoded, such as because of
+// a huge field, is sent without the fields that don't fit (and with
+// its message truncated, if necessary), along with an "_oversized"
+// marker and the names of the omitted fields, instead of failing the
+// write. A limit of 0 or less disables the guard.
+func SetMaxWSMessageBytes(n int) {
+	logConfigChange("max_ws_message_bytes", maxWSMessageBytes.Swap(int64(n)), int64(n))
+}
+
+var maxWSMessageBytes = func() *atomic.Int64 {
+	var n atomic.Int64
+	n.Store(defaultMaxWSMessageBytes)
+	return &n
+}()
+
+// encodeOversized encodes ent with enc, with as many of its fields as
+// fit within limit bytes, plus a marker indicating that it has been
+// shrunk, since its full encoding is size bytes.
+func encodeOversized(enc zapcore.Encoder, ent zapcore.Entry, fields []zapcore.Field, size, limit int) (*buffer.Buffer, error) {
+	if maxLen := limit / oversizedMessageFraction; len(ent.Message) > maxLen {
+		ent.Message = truncateUTF8(ent.Message, maxLen) + "…"
+	}
+
+	base, err := enc.EncodeEntry(ent, nil)
+	if err != nil {
+		return nil, err
+	}
+	budget := limit - base.Len() - oversizedMarkerReserve
+	base.Free()
+
+	kept := make([]zapcore.Field, 0, len(fields)+3) //nolint:mnd // the marker fields
+	var omitted []string
+	for _, f := range fields {
+		if fieldSize := encodedFieldSize(f); fieldSize <= budget {
+			kept = append(kept, f)
+			budget -= fieldSize
+		} else {
+			omitted = append(omitted, f.Key)
+		}
+	}
+	kept = append(kept,
+		zap.Bool("_oversized", true),
+		zap.Int("_original_size", size),
+		zap.Strings("_omitted_fields", omitted))
+
+	return enc.EncodeEntry(ent, kept)
+}
+
+// encodedFieldSize returns approximately how many bytes f takes up in a
+// JSON-encoded entry.
+func encodedFieldSize(f zapcore.Field) int {
+	buf, err := fieldSizeEncoder.EncodeEntry(zapcore.Entry{}, []zapcore.Field{f})
+	if err != nil {
+		return math.MaxInt
+	}
+	defer buf.Free()
+	return buf.Len()
+}
+
+// fieldSizeEncoder encodes only fields, no entry metadata.
+var fieldSizeEncoder = zapcore.NewJSONEncoder(zapcore.EncoderConfig{})
+
+// truncateUTF8 returns the longest prefix of s that is at most n bytes
+// and does not split a UTF-8 sequence.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+const (
+	defaultMaxWSMessageBytes = 1 << 20 // 1 MiB
+
+	// the message may take up at most this fraction (1/n) of an oversized entry
+	oversizedMessageFraction = 4
+
+	// space reserved for the marker fields and their values
+	oversizedMarkerReserve = 256
+)
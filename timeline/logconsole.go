@@ -0,0 +1,252 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// consoleSink is the output of the console core. It writes directly
+// to the underlying writer, unless async mode is enabled, in which
+// case writes are buffered and written in the background.
+type consoleSink struct {
+	out   atomic.Pointer[consoleWriter]
+	async atomic.Pointer[asyncWriter]
+
+	mu sync.Mutex // serializes configuration changes
+}
+
+// consoleWriter is a writer for the console.
+type consoleWriter struct {
+	zapcore.WriteSyncer
+	terminal bool // whether it is a terminal (character device)
+}
+
+func newConsoleWriter(w io.Writer) *consoleWriter {
+	var terminal bool
+	if f, ok := w.(*os.File); ok {
+		info, err := f.Stat()
+		terminal = err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+	// writers are not necessarily safe for concurrent use
+	return &consoleWriter{WriteSyncer: zapcore.Lock(zapcore.AddSync(w)), terminal: terminal}
+}
+
+func newConsoleSink(w io.Writer) *consoleSink {
+	cs := new(consoleSink)
+	cs.out.Store(newConsoleWriter(w))
+	return cs
+}
+
+func (cs *consoleSink) Write(p []byte) (int, error) {
+	if cliProgress.Load() {
+		// make room for the log line, then redraw the progress bar below it
+		return cliProgressBar.writeAbove(cs, p)
+	}
+	return cs.write(p)
+}
+
+func (cs *consoleSink) write(p []byte) (int, error) {
+	if aw := cs.async.Load(); aw != nil {
+		return aw.Write(p)
+	}
+	return cs.out.Load().Write(p)
+}
+
+func (cs *consoleSink) Sync() error {
+	if aw := cs.async.Load(); aw != nil {
+		aw.Sync()
+	}
+	return cs.out.Load().Sync()
+}
+
+// isTerminal returns whether the console is writing to a terminal.
+func (cs *consoleSink) isTerminal() bool { return cs.out.Load().terminal }
+
+// SetConsoleWriter sets the writer for the console output, for example
+// to write logs to stdout for container log collection, or to a file or
+// buffer. The writer does not need to be safe for concurrent use. Only
+// the console output is affected. If w is nil, the default (stderr) is
+// restored. Pending asynchronous writes (see SetAsyncConsole) are flushed
+// to the previous writer first.
+func SetConsoleWriter(w io.Writer) {
+	if w == nil {
+		w = os.Stderr
+	}
+	out := newConsoleWriter(w)
+
+	console.mu.Lock()
+	defer console.mu.Unlock()
+
+	prevAsync := console.async.Load()
+	if prevAsync != nil {
+		console.async.Store(newAsyncWriter(out))
+	}
+	console.out.Store(out)
+	if prevAsync != nil {
+		prevAsync.close()
+	}
+
+	// the progress bar only makes sense on a terminal
+	if !out.terminal {
+		SetCLIProgress(false)
+	}
+}
+
+// SetAsyncConsole enables or disables asynchronous writes to the console.
+// Writing to stderr synchronously can stall the logging path if it is a
+// slow pipe; in async mode, console writes are batched and written by a
+// background goroutine, which flushes periodically and when the logger is
+// synced. Ordering is preserved. Before returning, disabling async mode
+// flushes all pending writes. For local development, synchronous writes
+// (the default) are fine.
+func SetAsyncConsole(enabled bool) {
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	if enabled {
+		if console.async.Load() == nil {
+			console.async.Store(newAsyncWriter(console.out.Load()))
+		}
+		return
+	}
+	if aw := console.async.Swap(nil); aw != nil {
+		aw.close()
+	}
+}
+
+// asyncWriter buffers writes to an underlying writer, which are written
+// in batches by a background goroutine. Its buffer is bounded: if it is
+// full, writes block until there is room, so nothing is lost.
+type asyncWriter struct {
+	out      zapcore.WriteSyncer
+	queue    chan []byte
+	flushReq chan chan struct{}
+	done     chan struct{}
+
+	mu     sync.RWMutex // the write lock is only obtained to close
+	closed bool
+}
+
+func newAsyncWriter(out zapcore.WriteSyncer) *asyncWriter {
+	aw := &asyncWriter{
+		out:      out,
+		queue:    make(chan []byte, asyncConsoleQueueSize),
+		flushReq: make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go aw.run()
+	return aw
+}
+
+func (aw *asyncWriter) Write(p []byte) (int, error) {
+	aw.mu.RLock()
+	defer aw.mu.RUnlock()
+	if aw.closed {
+		return aw.out.Write(p)
+	}
+	// the caller may reuse p after we return, so copy it
+	aw.queue <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// Sync blocks until all buffered writes have been written.
+func (aw *asyncWriter) Sync() {
+	aw.mu.RLock()
+	defer aw.mu.RUnlock()
+	if aw.closed {
+		return
+	}
+	flushed := make(chan struct{})
+	aw.flushReq <- flushed
+	<-flushed
+}
+
+// close flushes all buffered writes and stops the background goroutine.
+// Any subsequent writes go directly to the underlying writer.
+func (aw *asyncWriter) close() {
+	aw.mu.Lock()
+	if aw.closed {
+		aw.mu.Unlock()
+		return
+	}
+	aw.closed = true
+	close(aw.queue)
+	aw.mu.Unlock()
+	<-aw.done
+}
+
+func (aw *asyncWriter) run() {
+	defer close(aw.done)
+
+	ticker := time.NewTicker(asyncConsoleFlushInterval)
+	defer ticker.Stop()
+
+	var batch bytes.Buffer
+	flush := func() {
+		if batch.Len() > 0 {
+			_, _ = aw.out.Write(batch.Bytes())
+			batch.Reset()
+		}
+	}
+
+	for {
+		select {
+		case p, ok := <-aw.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch.Write(p)
+			if batch.Len() >= asyncConsoleMaxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case flushed := <-aw.flushReq:
+			// drain whatever is queued right now, then flush it all
+		drain:
+			for {
+				select {
+				case p, ok := <-aw.queue:
+					if !ok {
+						break drain
+					}
+					batch.Write(p)
+				default:
+					break drain
+				}
+			}
+			flush()
+			close(flushed)
+		}
+	}
+}
+
+const (
+	asyncConsoleQueueSize     = 1024
+	asyncConsoleMaxBatchSize  = 32 * 1024
+	asyncConsoleFlushInterval = 100 * time.Millisecond
+)
@@ -0,0 +1,145 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SetDedupWindow enables deduplication of log entries: an entry that is a
+// duplicate of one that was logged less than d ago is dropped, and the
+// next one that is logged after that has a "repeated" field with how many
+// duplicates were dropped. This keeps a single root cause from flooding
+// the logs with the same entry. By default, entries are duplicates if
+// they have the same level, logger name, and message; see SetDedupKeyFunc
+// to customize that. Entries that are never sampled, such as job status
+// updates, are never deduplicated. A window of 0 (the default) disables
+// deduplication.
+func SetDedupWindow(d time.Duration) {
+	logDedup.mu.Lock()
+	prev := time.Duration(logDedup.window.Swap(int64(max(d, 0))))
+	clear(logDedup.seen)
+	logDedup.mu.Unlock()
+
+	logConfigChange("dedup_window", prev, max(d, 0))
+}
+
+// SetDedupKeyFunc sets the function that computes the key used for
+// deduplicating entries (see SetDedupWindow): entries with the same key
+// are duplicates, and entries for which the key is "" are never
+// deduplicated. The fields are those given at the log call site, so an
+// entry can be keyed on a field such as an error code instead of its
+// message. The function is called for every entry while the entry is
+// being written, so it must be fast and safe for concurrent use, and
+// it must not log. A nil function restores the default key, which is
+// the level, logger name, and message.
+func SetDedupKeyFunc(keyFunc func(zapcore.Entry, []zapcore.Field) string) {
+	if keyFunc == nil {
+		keyFunc = defaultDedupKey
+	}
+	logDedup.keyFunc.Store(&keyFunc)
+}
+
+func defaultDedupKey(ent zapcore.Entry, _ []zapcore.Field) string {
+	return ent.Level.String() + "\x00" + ent.LoggerName + "\x00" + ent.Message
+}
+
+var logDedup = func() *dedupFilter {
+	df := &dedupFilter{seen: make(map[string]*dedupState)}
+	keyFunc := defaultDedupKey
+	df.keyFunc.Store(&keyFunc)
+	return df
+}()
+
+// dedupFilter drops entries that are duplicates of recent ones.
+type dedupFilter struct {
+	window  atomic.Int64 // changed while holding mu, so that seen is reset with it
+	keyFunc atomic.Pointer[func(zapcore.Entry, []zapcore.Field) string]
+
+	mu   sync.Mutex
+	seen map[string]*dedupState
+}
+
+// dedupState is when an entry was last allowed through,
+// and how many duplicates have been dropped since.
+type dedupState struct {
+	allowed time.Time
+	dropped int
+}
+
+// enabled returns true if entries are being deduplicated.
+func (df *dedupFilter) enabled() bool { return df.window.Load() > 0 }
+
+// filter returns false if the entry should be dropped as a duplicate.
+// Otherwise, it returns the fields to write, which include the number
+// of duplicates that were dropped, if any.
+func (df *dedupFilter) filter(ent zapcore.Entry, fields []zapcore.Field) (bool, []zapcore.Field) {
+	window := time.Duration(df.window.Load())
+	if window <= 0 {
+		return true, fields
+	}
+	if _, ok := unsampledLoggers[ent.LoggerName]; ok {
+		return true, fields
+	}
+	key := (*df.keyFunc.Load())(ent, fields)
+	if key == "" {
+		return true, fields
+	}
+
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	state, ok := df.seen[key]
+	if ok && ent.Time.Sub(state.allowed) < window {
+		state.dropped++
+		return false, fields
+	}
+	if !ok {
+		if len(df.seen) >= maxDedupKeys {
+			df.prune(ent.Time, window)
+		}
+		state = new(dedupState)
+		df.seen[key] = state
+	}
+	if state.dropped > 0 {
+		fields = append(fields, zap.Int("repeated", state.dropped))
+	}
+	state.allowed, state.dropped = ent.Time, 0
+	return true, fields
+}
+
+// prune forgets about entries that were last allowed longer ago than
+// the window, since any duplicates of them won't be dropped anyway.
+// This forgets how many duplicates of them were dropped, but keeps
+// memory bounded when entries have many different keys.
+func (df *dedupFilter) prune(now time.Time, window time.Duration) {
+	for key, state := range df.seen {
+		if now.Sub(state.allowed) >= window {
+			delete(df.seen, key)
+		}
+	}
+}
+
+// maxDedupKeys is how many keys are remembered before pruning old ones.
+const maxDedupKeys = 10000
@@ -0,0 +1,138 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// JSONSchema is a layout for JSON log entries.
+type JSONSchema int
+
+const (
+	// SchemaNative is zap's JSON layout, which the UI expects.
+	SchemaNative JSONSchema = iota
+
+	// SchemaECS is the Elastic Common Schema, for shipping
+	// logs to Elasticsearch without a transform.
+	SchemaECS
+)
+
+// String returns the name of the schema.
+func (s JSONSchema) String() string {
+	if s == SchemaECS {
+		return "ecs"
+	}
+	return "native"
+}
+
+// SetJSONSchema sets the schema of JSON entries written to file and
+// forwarding outputs. It applies to outputs created afterward. The
+// WebSocket output always uses the native schema, since that is what
+// the UI expects.
+func SetJSONSchema(schema JSONSchema) {
+	logConfigChange("json_schema", JSONSchema(jsonSchema.Swap(int32(schema))), schema)
+}
+
+var jsonSchema atomic.Int32
+
+// newForwardingEncoder returns an encoder for file and forwarding
+// outputs, according to the configured JSON schema.
+func newForwardingEncoder() zapcore.Encoder {
+	if JSONSchema(jsonSchema.Load()) == SchemaECS {
+		return newECSEncoder()
+	}
+	return zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+}
+
+// ecsEncoder wraps a JSON encoder to emit entries in the Elastic Common
+// Schema: the timestamp and message are at "@timestamp" and "message",
+// the rest of the entry metadata is nested under "log", and the schema
+// version is at "ecs.version". Fields are emitted as-is.
+type ecsEncoder struct {
+	zapcore.Encoder
+}
+
+func newECSEncoder() zapcore.Encoder {
+	return ecsEncoder{zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+		TimeKey:        "@timestamp",
+		MessageKey:     "message",
+		StacktraceKey:  "error.stack_trace",
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeTime:     zapcore.TimeEncoderOfLayout(time.RFC3339Nano),
+		EncodeDuration: zapcore.NanosDurationEncoder,
+	})}
+}
+
+func (enc ecsEncoder) Clone() zapcore.Encoder {
+	return ecsEncoder{enc.Encoder.Clone()}
+}
+
+func (enc ecsEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	ent.Time = ent.Time.UTC()
+	meta := []zapcore.Field{
+		zap.Object("log", ecsLog(ent)),
+		zap.Object("ecs", ecsVersion{}),
+	}
+	return enc.Encoder.EncodeEntry(ent, append(meta, fields...))
+}
+
+// ecsLog is the "log" object of an ECS entry.
+type ecsLog zapcore.Entry
+
+func (l ecsLog) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("level", l.Level.String())
+	if l.LoggerName != "" {
+		enc.AddString("logger", l.LoggerName)
+	}
+	if l.Caller.Defined {
+		return enc.AddObject("origin", ecsOrigin(l.Caller))
+	}
+	return nil
+}
+
+// ecsOrigin is the "log.origin" object of an ECS entry.
+type ecsOrigin zapcore.EntryCaller
+
+func (o ecsOrigin) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	if o.Function != "" {
+		enc.AddString("function", o.Function)
+	}
+	return enc.AddObject("file", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		enc.AddString("name", o.File)
+		enc.AddInt("line", o.Line)
+		return nil
+	}))
+}
+
+// ecsVersion is the "ecs" object of an ECS entry.
+type ecsVersion struct{}
+
+func (ecsVersion) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("version", ecsSchemaVersion)
+	return nil
+}
+
+// ecsSchemaVersion is the version of ECS that entries conform to.
+const ecsSchemaVersion = "8.11.0"
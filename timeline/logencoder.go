@@ -0,0 +1,180 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// SetUIEncoder sets the encoder for entries sent to the UI (the websocket
+// output), so that the UI protocol can have a different shape than zap's
+// JSON layout; see NewMappedUIEncoder for an easy way to build one. A nil
+// encoder restores the default.
+//
+// The encoder's EncodeEntry method may be called concurrently, and it
+// must encode each entry as exactly one self-delimited message with no
+// line breaks, except for an optional trailing newline, since each
+// encoded entry is sent as its own websocket message. (Entries that are
+// not encoded this way are sent with the default encoder instead.) If
+// the message is a JSON object, its sequence number is added to it as
+// "seq", so the UI can resume the stream after reconnecting. Context
+// fields are only given to EncodeEntry, never added to the encoder.
+func SetUIEncoder(enc zapcore.Encoder) {
+	var prev *uiEncoderRef
+	if enc == nil {
+		prev = uiEncoderOverride.Swap(nil)
+	} else {
+		prev = uiEncoderOverride.Swap(&uiEncoderRef{enc})
+	}
+	logConfigChange("custom_ui_encoder", prev != nil, enc != nil)
+}
+
+// uiEncoderOverride is the encoder set with SetUIEncoder, if any.
+var uiEncoderOverride atomic.Pointer[uiEncoderRef]
+
+type uiEncoderRef struct{ zapcore.Encoder }
+
+// encoder returns the encoder to encode entries with.
+func (c *uiCore) encoder() zapcore.Encoder {
+	if c.customizable {
+		if ref := uiEncoderOverride.Load(); ref != nil {
+			return ref.Encoder
+		}
+	}
+	return c.enc
+}
+
+// encodeEntry encodes the entry with the configured encoder, or the
+// default encoder if the configured one does not uphold its contract
+// (see SetUIEncoder).
+func (c *uiCore) encodeEntry(ent zapcore.Entry, fields []zapcore.Field) (zapcore.Encoder, *buffer.Buffer, error) {
+	enc := c.encoder()
+	buf, err := enc.EncodeEntry(ent, fields)
+	if enc == c.enc || err != nil {
+		return enc, buf, err
+	}
+	if msg := bytes.TrimRight(buf.Bytes(), "\r\n"); len(msg) == 0 || bytes.ContainsAny(msg, "\r\n") {
+		buf.Free()
+		if !warnedBadUIEncoder.Swap(true) {
+			internalLog.Warn("custom UI encoder produced an empty or multi-line message; using default encoder",
+				zap.String("logger", ent.LoggerName),
+				zap.String("message", ent.Message))
+		}
+		buf, err = c.enc.EncodeEntry(ent, fields)
+		return c.enc, buf, err
+	}
+	return enc, buf, nil
+}
+
+// warnedBadUIEncoder is true once a custom UI encoder has been found to
+// break its contract, so that the warning is only logged once.
+var warnedBadUIEncoder atomic.Bool
+
+// UIFieldMapping describes the JSON layout of UI entries for
+// NewMappedUIEncoder. Each key (such as MessageKey) is the name of that
+// part of the entry in the output; an empty key omits it.
+type UIFieldMapping struct {
+	TimeKey       string
+	LevelKey      string
+	NameKey       string
+	MessageKey    string
+	CallerKey     string
+	StacktraceKey string
+
+	// If set, the entry's fields are nested in an object with this key
+	// instead of being at the top level next to the entry metadata.
+	FieldsKey string
+
+	// Fields renames fields by their key; fields that are not in the map
+	// keep their keys.
+	Fields map[string]string
+
+	// TimeLayout is the layout of the time; if empty, the time is encoded
+	// in milliseconds since the Unix epoch.
+	TimeLayout string
+}
+
+// NewMappedUIEncoder returns a JSON encoder for SetUIEncoder that lays
+// out entries as described by mapping.
+func NewMappedUIEncoder(mapping UIFieldMapping) zapcore.Encoder {
+	encodeTime := zapcore.EpochMillisTimeEncoder
+	if mapping.TimeLayout != "" {
+		encodeTime = zapcore.TimeEncoderOfLayout(mapping.TimeLayout)
+	}
+	return mappedEncoder{
+		Encoder: zapcore.NewJSONEncoder(zapcore.EncoderConfig{
+			TimeKey:        mapping.TimeKey,
+			LevelKey:       mapping.LevelKey,
+			NameKey:        mapping.NameKey,
+			MessageKey:     mapping.MessageKey,
+			CallerKey:      mapping.CallerKey,
+			StacktraceKey:  mapping.StacktraceKey,
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeTime:     encodeTime,
+			EncodeLevel:    zapcore.LowercaseLevelEncoder,
+			EncodeDuration: zapcore.MillisDurationEncoder,
+			EncodeCaller:   zapcore.ShortCallerEncoder,
+		}),
+		fieldsKey: mapping.FieldsKey,
+		renames:   mapping.Fields,
+	}
+}
+
+// mappedEncoder wraps a JSON encoder to rename and nest fields.
+type mappedEncoder struct {
+	zapcore.Encoder
+	fieldsKey string
+	renames   map[string]string
+}
+
+func (enc mappedEncoder) Clone() zapcore.Encoder {
+	return mappedEncoder{enc.Encoder.Clone(), enc.fieldsKey, enc.renames}
+}
+
+func (enc mappedEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	if len(enc.renames) > 0 {
+		renamed := make([]zapcore.Field, len(fields))
+		for i, f := range fields {
+			if key, ok := enc.renames[f.Key]; ok {
+				f.Key = key
+			}
+			renamed[i] = f
+		}
+		fields = renamed
+	}
+	if enc.fieldsKey != "" && len(fields) > 0 {
+		fields = []zapcore.Field{zap.Object(enc.fieldsKey, fieldObject(fields))}
+	}
+	return enc.Encoder.EncodeEntry(ent, fields)
+}
+
+// fieldObject marshals fields as an object.
+type fieldObject []zapcore.Field
+
+func (fo fieldObject) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, f := range fo {
+		f.AddTo(enc)
+	}
+	return nil
+}
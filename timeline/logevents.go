@@ -0,0 +1,1105 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/oauth2"
+)
+
+// ChildJobLogger returns a logger for a job that was spawned by another
+// job, so that the UI can render a tree of jobs. Its entries carry both
+// the job_id and the parent_job_id, and, like job status updates, they
+// are never sampled.
+func ChildJobLogger(parentID, childID uint64) *zap.Logger {
+	return Log.Named("job.tree").With(
+		zap.Uint64("job_id", childID),
+		zap.Uint64("parent_job_id", parentID))
+}
+
+// ItemLogger returns a logger derived from logger whose entries carry
+// the item reference (such as the item's ID from its data source) in
+// an "item_ref" field, so a single item can be traced end-to-end through
+// the import pipeline (see AddLogConnForItem). It composes with phases,
+// since a Phase is a logger: ItemLogger(phase.Logger, ref) tags entries
+// with both the phase and the item.
+func ItemLogger(logger *zap.Logger, itemRef string) *zap.Logger {
+	return logger.With(zap.String(itemRefKey, itemRef))
+}
+
+// itemRefKey is the standard field key for referencing an item in logs.
+const itemRefKey = "item_ref"
+
+// LogChildProgress records the progress of a child job and emits the
+// aggregate progress of all the parent's children, so that the UI can
+// show overall progress of an operation that fans out into multiple
+// jobs (for example, a multi-source import). Once all known children
+// of a parent are complete, the parent's aggregate state is forgotten.
+func LogChildProgress(parentID, childID uint64, progress, total int) {
+	childProgress.mu.Lock()
+	children, ok := childProgress.parents[parentID]
+	if !ok {
+		children = make(map[uint64]jobProgress)
+		childProgress.parents[parentID] = children
+	}
+	children[childID] = jobProgress{progress, total}
+
+	var sumProgress, sumTotal, done int
+	for _, p := range children {
+		sumProgress += p.progress
+		sumTotal += p.total
+		if p.total > 0 && p.progress >= p.total {
+			done++
+		}
+	}
+	numChildren := len(children)
+	if done == numChildren {
+		delete(childProgress.parents, parentID)
+	}
+	childProgress.mu.Unlock()
+
+	eventLog.Named("job.tree").Info("aggregate progress",
+		zap.Uint64("job_id", parentID),
+		zap.Uint64("child_job_id", childID),
+		zap.Int("progress", sumProgress),
+		zap.Int("total", sumTotal),
+		zap.Int("children", numChildren),
+		zap.Int("children_done", done))
+}
+
+// LogProgress emits a live progress update for the job, such as for a
+// phase of its work, which is throttled like other live job progress.
+// If the total is not known (as when scanning an archive), total should
+// be -1, in which case the entry is marked as indeterminate, so the UI
+// can show a spinner instead of a bar, and it is throttled to one per
+// job in each interval, since only the progress changes.
+func LogProgress(jobID uint64, progress, total int) {
+	logger := eventLog.Named("job.action").With(zap.Uint64("job_id", jobID))
+	if total < 0 {
+		logger.Info(indeterminateProgressMessage,
+			zap.Int("progress", progress),
+			zap.Bool("indeterminate", true))
+		return
+	}
+	logger.Info(progressMessage,
+		zap.Int("progress", progress),
+		zap.Int("total", total))
+}
+
+// LogFileProgress emits a live progress update for a single file that is
+// being processed by the job, such as a large archive, so the UI can show
+// the progress of the current file along with the overall progress of the
+// job. Updates are throttled by an adaptive sampler for each file, so that
+// updates for one file don't crowd out those of another. Once current
+// reaches total, the file is finished: a final entry is emitted, which is
+// never sampled, and the throttle state for the file is released.
+func LogFileProgress(jobID uint64, fileRef string, current, total int64) {
+	logger := eventLog.Named("job.action").With(
+		zap.Uint64("job_id", jobID),
+		zap.String("file", fileRef))
+	key := strconv.FormatUint(jobID, 10) + ":" + fileRef
+	if total >= 0 && current >= total {
+		fileProgressThrottle.forget(key)
+		logger.Info(fileFinishedMessage, zap.Int64("total", total))
+		return
+	}
+	if !fileProgressThrottle.allow(key, logClock{}.Now()) {
+		logMetrics.sampledOut.Add(1)
+		return
+	}
+	logger.Info(fileProgressMessage,
+		zap.Int64("progress", current),
+		zap.Int64("total", total))
+}
+
+// LogMediaProgress emits a live progress update for the job after the media
+// pipeline finished an asset for it (such as a thumbnail or video preview),
+// with how many tasks are queued and running in the pipeline, so the UI can
+// show why a job is waiting. It is throttled to one per job in each interval.
+func LogMediaProgress(jobID uint64, kind string, queued, running int) {
+	eventLog.Named("job.action").Info(mediaProgressMessage,
+		zap.Uint64("job_id", jobID),
+		zap.String("kind", kind),
+		zap.Int("queued", queued),
+		zap.Int("running", running))
+}
+
+// The messages of entries emitted by LogProgress, LogFileProgress, and LogMediaProgress.
+const (
+	progressMessage              = "progress"
+	indeterminateProgressMessage = "indeterminate progress"
+	fileProgressMessage          = "file progress"
+	fileFinishedMessage          = "finished file"
+	mediaProgressMessage         = "media progress"
+)
+
+type jobProgress struct {
+	progress, total int
+}
+
+// childProgress maps parent job IDs to the progress of their children.
+var childProgress = struct {
+	mu      sync.Mutex
+	parents map[uint64]map[uint64]jobProgress
+}{
+	parents: make(map[uint64]map[uint64]jobProgress),
+}
+
+// LogJobCanceled emits an entry that marks the job as canceled, so the UI
+// can show it as "Canceled" rather than "Failed". For a little while after,
+// any errors logged by the canceled job are downgraded to warnings and tagged
+// with post_cancel, since they are most likely fallout from the cancellation.
+func LogJobCanceled(jobID uint64, reason string) {
+	canceledJobs.add(jobID)
+	eventLog.Named("job.canceled").Info("canceled",
+		zap.Uint64("job_id", jobID),
+		zap.String("reason", reason))
+}
+
+// LogJobWaiting emits an entry that marks the job as waiting (or blocked)
+// for the given reason, such as a rate limit, a lock, or user input, so the
+// UI can show it as waiting rather than running without progress. Call
+// LogJobResumed when the job is no longer waiting. If the job is already
+// waiting, the new reason replaces the old one, but the waiting duration
+// continues from when it started waiting.
+func LogJobWaiting(jobID uint64, reason string) {
+	waitingJobs.Lock()
+	w, ok := waitingJobs.jobs[jobID]
+	if !ok {
+		w.since = time.Now()
+	}
+	w.reason = reason
+	waitingJobs.jobs[jobID] = w
+	waitingJobs.Unlock()
+
+	eventLog.Named("job.waiting").Info("waiting",
+		zap.Uint64("job_id", jobID),
+		zap.String("reason", reason),
+		zap.Time("since", w.since))
+}
+
+// LogJobResumed emits an entry that marks the job as no longer waiting,
+// including how long it waited. It does nothing if the job isn't waiting.
+func LogJobResumed(jobID uint64) {
+	waitingJobs.Lock()
+	w, ok := waitingJobs.jobs[jobID]
+	delete(waitingJobs.jobs, jobID)
+	waitingJobs.Unlock()
+	if !ok {
+		return
+	}
+
+	eventLog.Named("job.waiting").Info("resumed",
+		zap.Uint64("job_id", jobID),
+		zap.String("reason", w.reason),
+		zap.Duration("waited", time.Since(w.since)))
+}
+
+// LogConflict emits an entry reporting that the job conflicted with
+// another job over a resource (such as an account, a file, or a range of
+// items that both jobs are importing), and how the conflict was resolved,
+// so the UI can explain why an import is waiting or why something was
+// skipped. If the job waits for the other job, it is also marked as
+// waiting (see LogJobWaiting), so LogJobResumed should be called when it
+// stops waiting. These entries are logged under the "job.conflict" logger
+// and are never sampled.
+func LogConflict(jobID, otherJobID uint64, resource string, resolution ConflictResolution) {
+	eventLog.Named("job.conflict").Info("conflict",
+		zap.Uint64("job_id", jobID),
+		zap.Uint64("other_job_id", otherJobID),
+		zap.String("resource", resource),
+		zap.String("resolution", string(resolution)))
+	if resolution == ConflictWaited {
+		LogJobWaiting(jobID, fmt.Sprintf("waiting for job %d to finish with %s", otherJobID, resource))
+	}
+}
+
+// ConflictResolution is how a conflict between jobs was resolved.
+type ConflictResolution string
+
+// Resolutions of conflicts between jobs.
+const (
+	ConflictWaited  ConflictResolution = "waited"  // the job waits for the other job to finish with the resource
+	ConflictSkipped ConflictResolution = "skipped" // the job skipped the resource, leaving it to the other job
+	ConflictMerged  ConflictResolution = "merged"  // the job's work on the resource was combined with the other job's
+)
+
+// waitingJobs keeps track of jobs that are waiting, and why.
+var waitingJobs = struct {
+	sync.Mutex
+	jobs map[uint64]jobWait
+}{
+	jobs: make(map[uint64]jobWait),
+}
+
+type jobWait struct {
+	reason string
+	since  time.Time
+}
+
+// canceledJobs keeps track of recently-canceled jobs.
+var canceledJobs = &recentJobs{jobs: make(map[uint64]time.Time), ttl: postCancelWindow}
+
+// recentJobs is a set of job IDs, each of which expires after ttl.
+type recentJobs struct {
+	mu   sync.RWMutex
+	jobs map[uint64]time.Time // value is when the job was added
+	ttl  time.Duration
+}
+
+func (r *recentJobs) add(jobID uint64) {
+	now := time.Now()
+	r.mu.Lock()
+	for id, added := range r.jobs {
+		if now.Sub(added) > r.ttl {
+			delete(r.jobs, id)
+		}
+	}
+	r.jobs[jobID] = now
+	r.mu.Unlock()
+}
+
+func (r *recentJobs) contains(jobID uint64) bool {
+	r.mu.RLock()
+	added, ok := r.jobs[jobID]
+	r.mu.RUnlock()
+	return ok && time.Since(added) <= r.ttl
+}
+
+// postCancelWindow is how long after a job is canceled that its errors are downgraded.
+const postCancelWindow = 5 * time.Minute
+
+// SetJobFirstErrorOnly enables or disables a mode in which only the first
+// error logged by each job is logged as an error; any after that are
+// logged at debug level with a "suppressed_error" field, since they are
+// usually fallout from the same root cause, and would bury the actionable
+// error in the UI. The number of suppressed errors is included in the
+// job's final status update, in a "suppressed_errors" field. Job status
+// updates are never suppressed.
+func SetJobFirstErrorOnly(enabled bool) {
+	logConfigChange("job_first_error_only", jobFirstErrorOnly.Swap(enabled), enabled)
+}
+
+var jobFirstErrorOnly atomic.Bool
+
+// jobErrors counts the errors logged by each job while in first-error-only
+// mode. The count includes the first error, which is not suppressed.
+var jobErrors = struct {
+	sync.Mutex
+	counts map[uint64]int
+}{
+	counts: make(map[uint64]int),
+}
+
+// noteJobError counts an error logged by the job, and returns true
+// if it is the job's first one.
+func noteJobError(jobID uint64) (first bool) {
+	jobErrors.Lock()
+	defer jobErrors.Unlock()
+	jobErrors.counts[jobID]++
+	return jobErrors.counts[jobID] == 1
+}
+
+// takeSuppressedErrors returns how many of the job's errors were
+// suppressed, and forgets the job's errors.
+func takeSuppressedErrors(jobID uint64) int {
+	jobErrors.Lock()
+	defer jobErrors.Unlock()
+	n := jobErrors.counts[jobID]
+	delete(jobErrors.counts, jobID)
+	return max(n-1, 0)
+}
+
+// SetJobLogBudget limits the number of entries the job may log to
+// maxEntries, as a safety valve for a runaway job that would otherwise
+// flood the UI and fill the log file. Once the budget is exhausted, a
+// single "log budget exceeded" warning is logged under the "job.budget"
+// logger, and the job's further entries are dropped, except for errors
+// and job status updates. Entries count toward the budget before they
+// are sampled. The budget is forgotten when the job ends. A maxEntries
+// that is not positive removes the job's budget.
+func SetJobLogBudget(jobID uint64, maxEntries int) {
+	jobLogBudgets.Lock()
+	defer jobLogBudgets.Unlock()
+	if maxEntries <= 0 {
+		delete(jobLogBudgets.jobs, jobID)
+	} else {
+		jobLogBudgets.jobs[jobID] = &jobLogBudget{max: maxEntries}
+	}
+	jobLogBudgets.active.Store(len(jobLogBudgets.jobs) > 0)
+}
+
+type jobLogBudget struct {
+	max, used int
+}
+
+// jobLogBudgets are the log budgets of jobs, by job ID. Since nearly all
+// jobs don't have a budget, active is false when there are none, so that
+// the lookup can be skipped.
+var jobLogBudgets = struct {
+	sync.Mutex
+	jobs   map[uint64]*jobLogBudget
+	active atomic.Bool
+}{
+	jobs: make(map[uint64]*jobLogBudget),
+}
+
+// spendJobLogBudget counts an entry toward the job's log budget, if it
+// has one, and returns false if the entry should be dropped because the
+// budget is exhausted.
+func spendJobLogBudget(jobID uint64) bool {
+	if !jobLogBudgets.active.Load() {
+		return true
+	}
+	jobLogBudgets.Lock()
+	budget, ok := jobLogBudgets.jobs[jobID]
+	if !ok {
+		jobLogBudgets.Unlock()
+		return true
+	}
+	budget.used++
+	used, maxEntries := budget.used, budget.max
+	jobLogBudgets.Unlock()
+
+	if used == maxEntries+1 {
+		Log.Named("job.budget").Warn("log budget exceeded",
+			zap.Uint64("job_id", jobID),
+			zap.Int("max_entries", maxEntries))
+	}
+	return used <= maxEntries
+}
+
+// forgetJobLogBudget removes the job's log budget, if it has one, and
+// returns how many of its entries were dropped because of it.
+func forgetJobLogBudget(jobID uint64) (dropped int) {
+	if !jobLogBudgets.active.Load() {
+		return 0
+	}
+	jobLogBudgets.Lock()
+	defer jobLogBudgets.Unlock()
+	if budget, ok := jobLogBudgets.jobs[jobID]; ok {
+		dropped = max(budget.used-budget.max, 0)
+		delete(jobLogBudgets.jobs, jobID)
+	}
+	jobLogBudgets.active.Store(len(jobLogBudgets.jobs) > 0)
+	return dropped
+}
+
+// LogNoop emits an entry indicating that the job finished successfully
+// without adding or updating anything, for the given reason (such as
+// "already up to date"), so the UI can show a clear "no new items" state
+// that is distinct from both importing items and failing. The checked
+// timeframe is included if it is bounded. These entries are never
+// sampled.
+func LogNoop(jobID uint64, reason string, checked Timeframe) {
+	fields := []zap.Field{
+		zap.Uint64("job_id", jobID),
+		zap.String("reason", reason),
+	}
+	if checked.Since != nil {
+		fields = append(fields, zap.Time("checked_since", *checked.Since))
+	}
+	if checked.Until != nil {
+		fields = append(fields, zap.Time("checked_until", *checked.Until))
+	}
+	eventLog.Named("job.outcome").Info("no new items", fields...)
+}
+
+// LogJobPartialSuccess emits an entry indicating that the job finished,
+// but only some of its items succeeded, so the UI can show it as
+// "completed with warnings" (a yellow state), distinct from both a clean
+// success and a failure. The entry has an "errors" field that refers to
+// the job's errors in the logs (the job ID and minimum level to follow
+// with, such as by AddLogConnFollow), for showing a summary of what went
+// wrong. These entries are never sampled.
+func LogJobPartialSuccess(jobID uint64, succeeded, failed int) {
+	eventLog.Named("job.outcome").Warn("completed with warnings",
+		zap.Uint64("job_id", jobID),
+		zap.Int("succeeded", succeeded),
+		zap.Int("failed", failed),
+		zap.Int("total", succeeded+failed),
+		zap.Object("errors", zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			enc.AddUint64("job_id", jobID)
+			enc.AddString("min_level", zapcore.ErrorLevel.String())
+			return nil
+		})))
+}
+
+// LogResumeImport emits an entry that marks the import job as resuming
+// after it was interrupted (such as by a crash), rather than starting over,
+// so the UI can reassure the user. fromCheckpoint describes where it is
+// resuming from, and processed is how much of the job's work was already
+// done. These entries are logged under the "job.resume" logger and are
+// never sampled.
+func LogResumeImport(jobID uint64, fromCheckpoint string, processed int) {
+	eventLog.Named("job.resume").Info("resuming interrupted import",
+		zap.Uint64("job_id", jobID),
+		zap.String("from_checkpoint", fromCheckpoint),
+		zap.Int("already_processed", processed))
+}
+
+// LogPagination emits an entry reporting that a data source fetched a
+// page of results from a paginated API, so the UI can show feedback like
+// "page 5 of ~40" while a source is fetching, before (or between) batches
+// of items being processed. If the total number of pages is not known,
+// totalPages should be 0 or less, in which case the entry is marked as
+// indeterminate. Entries for each source are throttled if pages come in
+// faster than the UI can usefully show them (except the last page, if
+// known), but are otherwise never sampled. These entries are logged under
+// the "pagination" logger.
+func LogPagination(source string, page, totalPages, itemsThisPage int) {
+	lastPage := totalPages > 0 && page >= totalPages
+	if !paginationThrottle.allow(source, logClock{}.Now()) && !lastPage {
+		logMetrics.sampledOut.Add(1)
+		return
+	}
+	fields := []zap.Field{
+		zap.String("data_source", source),
+		zap.Int("page", page),
+		zap.Int("items", itemsThisPage),
+	}
+	if totalPages > 0 {
+		fields = append(fields, zap.Int("total_pages", totalPages))
+	} else {
+		fields = append(fields, zap.Bool("indeterminate", true))
+	}
+	eventLog.Named("pagination").Info("fetched page", fields...)
+}
+
+// LogCheckpoint emits an entry reporting whether the job's checkpoint,
+// from which it can resume if it is interrupted, was saved, so that
+// checkpointing can be seen to be healthy; if it's failing, the job
+// will have to start over after an interruption, so err is logged as
+// an error which is never sampled. seq identifies the checkpoint, and
+// since describes the work that was done since the last checkpoint
+// (zero values are omitted). Successful checkpoints are logged at debug
+// level. These entries are logged under the "job.checkpoint" logger.
+func LogCheckpoint(jobID uint64, seq string, since CheckpointProgress, err error) {
+	fields := []zap.Field{
+		zap.Uint64("job_id", jobID),
+		zap.String("checkpoint", seq),
+	}
+	if since.Items != 0 {
+		fields = append(fields, zap.Int64("items_since_last", since.Items))
+	}
+	if since.Bytes != 0 {
+		fields = append(fields, zap.Int64("bytes_since_last", since.Bytes))
+	}
+	logger := eventLog.Named("job.checkpoint")
+	if err != nil {
+		logger.Error("checkpoint failed", append(fields, zap.Error(err))...)
+		return
+	}
+	logger.Debug("checkpoint saved", fields...)
+}
+
+// CheckpointProgress is the work a job did between checkpoints.
+type CheckpointProgress struct {
+	Items int64 // units of job progress, which for imports are items
+	Bytes int64
+}
+
+// LogDiscovery emits an entry reporting that a data source found the
+// given number of things of some kind (such as "albums" or "folders")
+// while enumerating what it will import, which can take a while before
+// any items are processed, so the UI can show feedback like "Found 42
+// albums" during the scan. elapsed is how long the scan took so far.
+// These entries are logged under the "discovery" logger and are never
+// sampled.
+func LogDiscovery(source string, found int, kind string, elapsed time.Duration) {
+	eventLog.Named("discovery").Info("discovered",
+		zap.String("data_source", source),
+		zap.Int("found", found),
+		zap.String("kind", kind),
+		zap.Duration("elapsed", elapsed))
+}
+
+// MigrationStatus is the status of a database migration step.
+type MigrationStatus int
+
+const (
+	// MigrationStarted means the step has begun.
+	MigrationStarted MigrationStatus = iota
+	// MigrationSucceeded means the step finished successfully.
+	MigrationSucceeded
+	// MigrationFailed means the step failed.
+	MigrationFailed
+	// MigrationsComplete means all the steps are done, and the
+	// database is at the given version.
+	MigrationsComplete
+)
+
+func (s MigrationStatus) String() string {
+	switch s {
+	case MigrationStarted:
+		return "started"
+	case MigrationSucceeded:
+		return "succeeded"
+	case MigrationFailed:
+		return "failed"
+	case MigrationsComplete:
+		return "complete"
+	}
+	return "unknown"
+}
+
+// LogMigration emits an entry for a step of migrating the database to the
+// given schema version, so the UI can show the progress of (and wait for)
+// schema upgrades that take a while, instead of appearing to hang. Each
+// step is reported when it starts and again when it succeeds or fails,
+// including how long it took; once all steps are done, report
+// MigrationsComplete with the final version, which includes how long all
+// the steps took. These entries are logged under the "migration" logger
+// and are never sampled.
+func LogMigration(version int, description string, status MigrationStatus) {
+	now := time.Now()
+	fields := []zap.Field{
+		zap.Int("version", version),
+		zap.String("description", description),
+		zap.Stringer("status", status),
+	}
+
+	migrations.Lock()
+	if migrations.started.IsZero() {
+		migrations.started = now
+	}
+	switch status {
+	case MigrationStarted:
+		migrations.steps[version] = now
+	case MigrationSucceeded, MigrationFailed:
+		if start, ok := migrations.steps[version]; ok {
+			fields = append(fields, zap.Duration("duration", now.Sub(start)))
+			delete(migrations.steps, version)
+		}
+	case MigrationsComplete:
+		fields = append(fields, zap.Duration("total_duration", now.Sub(migrations.started)))
+		migrations.started = time.Time{}
+		clear(migrations.steps)
+	}
+	migrations.Unlock()
+
+	logger := eventLog.Named("migration")
+	switch status {
+	case MigrationFailed:
+		logger.Error("migration failed", fields...)
+	case MigrationsComplete:
+		logger.Info("migrations complete", fields...)
+	default:
+		logger.Info("migration "+status.String(), fields...)
+	}
+}
+
+// migrations keeps track of when the current migration steps started.
+var migrations = struct {
+	sync.Mutex
+	started time.Time         // when the first step started
+	steps   map[int]time.Time // keyed by version
+}{
+	steps: make(map[int]time.Time),
+}
+
+// SyntheticEntry describes a made-up log entry. See EmitSynthetic.
+type SyntheticEntry struct {
+	Level   zapcore.Level  `json:"level"`
+	Logger  string         `json:"logger,omitempty"`
+	Message string         `json:"msg"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// SetAllowSynthetic enables or disables EmitSynthetic. It is disabled by
+// default so that crafted entries can't be injected in production.
+func SetAllowSynthetic(allow bool) { allowSynthetic.Store(allow) }
+
+var allowSynthetic atomic.Bool
+
+// EmitSynthetic pushes a crafted entry through the normal logging pipeline,
+// so it flows to subscribers exactly like a real one would, including the
+// routing and sampling special cases for certain logger names and messages.
+// This is useful for exercising the UI's log handling without running real
+// imports. It returns an error unless it has been enabled with
+// SetAllowSynthetic.
+func EmitSynthetic(entry SyntheticEntry) error {
+	if !allowSynthetic.Load() {
+		return ErrSyntheticDisabled
+	}
+	logger := Log
+	if entry.Logger != "" {
+		logger = logger.Named(entry.Logger)
+	}
+	checked := logger.Check(entry.Level, entry.Message)
+	if checked == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(entry.Fields))
+	for k := range entry.Fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys) // for deterministic output
+	fields := make([]zap.Field, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, zap.Any(k, entry.Fields[k]))
+	}
+	checked.Write(fields...)
+	return nil
+}
+
+// ErrSyntheticDisabled is returned by EmitSynthetic when synthetic log entries are not allowed.
+var ErrSyntheticDisabled = errors.New("synthetic log entries are not allowed")
+
+// LogQuota emits an entry describing the remaining API quota for a data
+// source, so the UI can show an accurate quota indicator. These entries
+// are never sampled. If remaining is at or below the warning threshold
+// (see SetQuotaWarnThreshold), the entry is a warning. If the quota is
+// exhausted and resets in the future, the entry indicates that we are
+// backing off until then.
+func LogQuota(source string, remaining int, resetAt time.Time) {
+	level := zapcore.InfoLevel
+	if remaining <= int(quotaWarnThreshold.Load()) {
+		level = zapcore.WarnLevel
+	}
+	backingOff := remaining <= 0 && time.Now().Before(resetAt)
+	if checked := eventLog.Named("quota").Check(level, "quota"); checked != nil {
+		checked.Write(
+			zap.String("data_source_name", source),
+			zap.Int("remaining", remaining),
+			zap.Time("reset_at", resetAt),
+			zap.Bool("backing_off", backingOff))
+	}
+}
+
+// SetQuotaWarnThreshold sets the remaining quota at or below which LogQuota
+// entries are emitted as warnings.
+func SetQuotaWarnThreshold(remaining int) { quotaWarnThreshold.Store(int64(remaining)) }
+
+var quotaWarnThreshold = func() *atomic.Int64 {
+	v := new(atomic.Int64)
+	v.Store(defaultQuotaWarnThreshold)
+	return v
+}()
+
+const defaultQuotaWarnThreshold = 10
+
+// LogTokenRefresh emits an entry describing the outcome of refreshing
+// the OAuth2 token of an account for a data source, so that the UI can
+// prompt the user to re-authenticate when needed. These entries are
+// never sampled. On success, expiry is the expiration time of the new
+// token, if known; on failure, the entry is an error and notes whether
+// the provider rejected the authorization (such that re-authenticating
+// is required). Tokens that appear in the error are redacted.
+func LogTokenRefresh(source, account string, success bool, err error, expiry time.Time) {
+	logger := eventLog.Named("auth")
+	if success {
+		fields := []zap.Field{
+			zap.String("data_source_name", source),
+			zap.String("account", account),
+		}
+		if !expiry.IsZero() {
+			fields = append(fields, zap.Time("expiry", expiry))
+		}
+		logger.Info("token refreshed", fields...)
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("data_source_name", source),
+		zap.String("account", account),
+		zap.Bool("reauth_required", reauthRequired(err)),
+	}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		// the response body may contain tokens, so only log its known-safe parts
+		if retrieveErr.Response != nil {
+			fields = append(fields, zap.Int("status_code", retrieveErr.Response.StatusCode))
+		}
+		fields = append(fields,
+			zap.String("error_code", retrieveErr.ErrorCode),
+			zap.String("error_description", retrieveErr.ErrorDescription))
+	} else if err != nil {
+		fields = append(fields, zap.String("error", redactTokens(err.Error())))
+	}
+	logger.Error("token refresh failed", fields...)
+}
+
+// reauthRequired returns true if err indicates that the provider no
+// longer accepts the authorization, so refreshing can only succeed
+// after the user re-authenticates.
+func reauthRequired(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+	switch retrieveErr.ErrorCode {
+	case "invalid_grant", "invalid_client", "unauthorized_client":
+		return true
+	}
+	return retrieveErr.Response != nil &&
+		(retrieveErr.Response.StatusCode == http.StatusUnauthorized || retrieveErr.Response.StatusCode == http.StatusForbidden)
+}
+
+// redactTokens replaces the values of token-like parameters in s.
+func redactTokens(s string) string {
+	return tokenPattern.ReplaceAllString(s, "${1}${2}${3}[REDACTED]")
+}
+
+// tokenPattern matches token values in JSON ("access_token": "...") and
+// form-encoded or query (refresh_token=...) text, as well as bearer tokens.
+var tokenPattern = regexp.MustCompile(`(?i)("(?:access|refresh|id)_token"\s*:\s*")[^"]*|((?:access|refresh|id)_token=)[^&\s"]*|(bearer\s+)[^\s"]+`)
+
+// SkipReason is why an item was skipped during an import.
+type SkipReason string
+
+// Reasons for skipping items.
+const (
+	SkipDuplicate   SkipReason = "duplicate"   // item is already in the timeline and does not need to be updated
+	SkipUnsupported SkipReason = "unsupported" // item's type or format is not supported
+	SkipFiltered    SkipReason = "filtered"    // item was excluded by the import options, such as the timeframe
+	SkipInvalid     SkipReason = "invalid"     // item's data is malformed or incomplete
+	SkipEmpty       SkipReason = "empty"       // item has no meaningful content
+	SkipDeleted     SkipReason = "deleted"     // item was deleted or redacted from the timeline, and is remembered
+)
+
+// LogSkip emits a consistent entry for an item that was skipped, so the UI
+// can tally skips by reason. Since skips can be numerous, these entries are
+// sampled like any other, but a count of every skip is kept per reason;
+// see SkipCounts.
+func LogSkip(logger *zap.Logger, itemRef string, reason SkipReason, fields ...zap.Field) {
+	skipCounts.Lock()
+	skipCounts.counts[reason]++
+	skipCounts.Unlock()
+
+	if checked := logger.WithOptions(zap.AddCallerSkip(1)).Check(zapcore.InfoLevel, "skipped item"); checked != nil {
+		checked.Write(append([]zap.Field{
+			zap.String("item_ref", itemRef),
+			zap.String("reason", string(reason)),
+		}, fields...)...)
+	}
+}
+
+// SkipCounts returns how many items have been skipped for each reason.
+func SkipCounts() map[SkipReason]uint64 {
+	skipCounts.Lock()
+	defer skipCounts.Unlock()
+	counts := make(map[SkipReason]uint64, len(skipCounts.counts))
+	for reason, n := range skipCounts.counts {
+		counts[reason] = n
+	}
+	return counts
+}
+
+var skipCounts = struct {
+	sync.Mutex
+	counts map[SkipReason]uint64
+}{
+	counts: make(map[SkipReason]uint64),
+}
+
+// MergeStrategy is how an incoming item was merged into an existing one.
+type MergeStrategy string
+
+// Merge strategies.
+const (
+	MergeUpdated      MergeStrategy = "updated"       // existing item was updated according to the import's update preferences
+	MergeRetrievalKey MergeStrategy = "retrieval_key" // part of an item was pieced together with the existing part by its retrieval key
+	MergeKeptExisting MergeStrategy = "kept_existing" // existing item matched, but none of its fields were updated
+)
+
+// LogMerge emits a consistent entry for an item that was merged into an
+// existing item instead of being added, which helps explain why item
+// counts differ from file counts. Like skips, these entries are sampled,
+// but every one is counted by strategy, and if logger belongs to a job,
+// the counts are included in the job's final status entry as "merges".
+func LogMerge(logger *zap.Logger, itemRef, existingRef string, strategy MergeStrategy) {
+	itemMerges.add(loggerJobID(logger), string(strategy))
+	logger.WithOptions(zap.AddCallerSkip(1)).Info("merged item",
+		zap.String("item_ref", itemRef),
+		zap.String("existing_ref", existingRef),
+		zap.String("strategy", string(strategy)))
+}
+
+// LogUnsupportedFormat emits a skip entry (see LogSkip) for a file that
+// the data source can't handle, along with the type that was detected
+// (such as a MIME type or "HEIC"), so that gaps in an import are not
+// silent. Like other skips, these entries are sampled, but every one is
+// counted by type, and if logger belongs to a job (as the logger in the
+// import parameters does), the counts are included in the job's final
+// status entry as "unsupported_formats", so the UI can say something
+// like "23 HEIC files were skipped (unsupported)".
+func LogUnsupportedFormat(logger *zap.Logger, source, fileRef, detectedType string) {
+	unsupportedFormats.add(loggerJobID(logger), detectedType)
+	LogSkip(logger.WithOptions(zap.AddCallerSkip(1)), fileRef, SkipUnsupported,
+		zap.String("data_source", source),
+		zap.String("detected_type", detectedType))
+}
+
+// loggerJobID returns the ID of the job that logger belongs to, or 0 if
+// none, the same way customCore.entryJobID does for its entries.
+func loggerJobID(logger *zap.Logger) uint64 {
+	core, ok := logger.Core().(*customCore)
+	if !ok {
+		return 0
+	}
+	return core.entryJobID(zapcore.Entry{LoggerName: logger.Name()})
+}
+
+// LogThumbnailError emits an error entry for a thumbnail that couldn't be
+// generated for the item, along with the format of its data (such as its
+// MIME type), since thumbnailing is most likely to fail on unusual formats.
+// These entries are sampled, but every one is counted by format, and if
+// logger belongs to a job (as the logger of a thumbnail job does), the
+// counts are included in the job's final status entry as
+// "thumbnail_failures", so the UI can say something like "12 RAW files
+// couldn't be thumbnailed".
+func LogThumbnailError(logger *zap.Logger, itemRef, format string, err error) {
+	thumbnailFailures.add(loggerJobID(logger), format)
+	logger.WithOptions(zap.AddCallerSkip(1)).Error("thumbnail generation failed",
+		zap.String("item_ref", itemRef),
+		zap.String("format", format),
+		zap.Error(err))
+}
+
+// unsupportedFormats counts the files of each unsupported type by job,
+// thumbnailFailures counts the thumbnails that couldn't be generated
+// for each format by job, and itemMerges counts the merged items by
+// strategy by job.
+var unsupportedFormats, thumbnailFailures, itemMerges jobTypeCounts
+
+// jobTypeCounts counts occurrences of something for each job by type.
+type jobTypeCounts struct {
+	mu   sync.Mutex
+	jobs map[uint64]map[string]int
+}
+
+// add counts an occurrence of typ for the job, unless jobID is 0.
+func (c *jobTypeCounts) add(jobID uint64, typ string) {
+	if jobID == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.jobs == nil {
+		c.jobs = make(map[uint64]map[string]int)
+	}
+	counts, ok := c.jobs[jobID]
+	if !ok {
+		counts = make(map[string]int)
+		c.jobs[jobID] = counts
+	}
+	counts[typ]++
+}
+
+// take returns the counts for the job by type, and forgets them.
+func (c *jobTypeCounts) take(jobID uint64) map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.jobs[jobID]
+	delete(c.jobs, jobID)
+	return counts
+}
+
+// ImportPlanSummary describes what an import job is about to do.
+// It is logged before the job starts importing items, so that the
+// user can confirm the import is configured as intended.
+type ImportPlanSummary struct {
+	// The data sources, their options, and the files to import with them.
+	Files []FileImport `json:"files,omitempty"`
+
+	// The date range items are constrained to, if any.
+	Timeframe Timeframe `json:"timeframe"`
+
+	// The estimated number of items, if the size was estimated.
+	EstimatedItems *int64 `json:"estimated_items,omitempty"`
+
+	// Processing options that significantly change the outcome.
+	Integrity   bool `json:"integrity,omitempty"`
+	Overwrite   bool `json:"overwrite_local_changes,omitempty"`
+	Interactive bool `json:"interactive,omitempty"`
+	Bulk        bool `json:"bulk,omitempty"`
+
+	// Whether the job is resuming from a checkpoint.
+	Resuming bool `json:"resuming,omitempty"`
+}
+
+// LogImportPlan logs the plan for the import job with the given ID
+// under the "audit" logger, which is never sampled.
+func LogImportPlan(jobID uint64, plan ImportPlanSummary) {
+	dataSources := make([]string, 0, len(plan.Files))
+	var fileCount int
+	for _, fi := range plan.Files {
+		if !slices.Contains(dataSources, fi.DataSourceName) {
+			dataSources = append(dataSources, fi.DataSourceName)
+		}
+		fileCount += len(fi.Filenames)
+	}
+	eventLog.Named("audit").Info("import plan",
+		zap.Uint64("job_id", jobID),
+		zap.Strings("data_sources", dataSources),
+		zap.Int("file_count", fileCount),
+		zap.Any("plan", plan))
+}
+
+// LogStartupConfig logs the effective configuration of the process, once
+// at startup, so there is a reliable record of how it was configured. cfg
+// should be a struct (or pointer to one); its exported fields are logged
+// by their JSON names, honoring "-" and omitempty. The values of fields
+// tagged `sensitive:"true"` are redacted.
+func LogStartupConfig(cfg any) {
+	var fields []zap.Field
+	if options, ok := configValue(reflect.ValueOf(cfg)).(map[string]any); ok {
+		keys := slices.Sorted(maps.Keys(options))
+		fields = make([]zap.Field, 0, len(keys))
+		for _, key := range keys {
+			fields = append(fields, zap.Any(key, options[key]))
+		}
+	}
+	eventLog.Named("startup").Info("configuration", fields...)
+}
+
+// LogSystemLocale logs the local timezone and locale of the system, once
+// at startup. Timestamps in the logs are UTC, so this helps with
+// correlating them with the system clock, and the UI can use the
+// "utc_offset_seconds" field to display local times if it wants.
+func LogSystemLocale() {
+	now := time.Now()
+	zone, offset := now.Zone()
+	eventLog.Named("system").Info("locale",
+		zap.String("timezone", time.Local.String()),
+		zap.String("zone", zone),
+		zap.String("utc_offset", now.Format("-07:00")),
+		zap.Int("utc_offset_seconds", offset),
+		zap.String("locale", systemLocale()))
+}
+
+// systemLocale returns the locale from the environment, according to
+// the usual precedence of the POSIX locale variables, or an empty
+// string if it is not set.
+func systemLocale() string {
+	for _, key := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(key); locale != "" {
+			return locale
+		}
+	}
+	return ""
+}
+
+// configValue returns a loggable representation of v, where structs
+// are maps of their JSON field names to values, and sensitive values
+// are redacted.
+func configValue(v reflect.Value) any {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if tm, ok := v.Interface().(encoding.TextMarshaler); ok {
+		if text, err := tm.MarshalText(); err == nil {
+			return string(text)
+		}
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		options := make(map[string]any)
+		addConfigFields(options, v)
+		return options
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		list := make([]any, v.Len())
+		for i := range list {
+			list[i] = configValue(v.Index(i))
+		}
+		return list
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := make(map[string]any, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			m[fmt.Sprint(iter.Key().Interface())] = configValue(iter.Value())
+		}
+		return m
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	default:
+		return v.Interface()
+	}
+}
+
+// addConfigFields adds the fields of struct value v to options, flattening
+// embedded structs like encoding/json does.
+func addConfigFields(options map[string]any, v reflect.Value) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				addConfigFields(options, fv)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fv := v.Field(i)
+		if slices.Contains(strings.Split(opts, ","), "omitempty") && fv.IsZero() {
+			continue
+		}
+		if sensitive, _ := strconv.ParseBool(field.Tag.Get("sensitive")); sensitive {
+			if !fv.IsZero() {
+				options[name] = redacted
+			}
+			continue
+		}
+		options[name] = configValue(fv)
+	}
+}
+
+// redacted replaces the values of sensitive fields.
+const redacted = "[REDACTED]"
@@ -0,0 +1,156 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// ExemptFromSampling causes entries that have a field with the given
+// key and value (for example, a particular "item_id") to bypass
+// sampling, like a breakpoint in the log stream for focused debugging.
+// String, integer, boolean, and Stringer fields can match; the value is
+// compared to the field's value formatted as a string. The field can
+// be a context field added with With() or one given at the call site.
+// Multiple exemptions can be registered at once; remove them with
+// RemoveSamplingExemption.
+//
+// While any exemptions are registered, sampling decisions are made when
+// entries are written instead of when they are checked, since only then
+// are all the fields known; this costs some efficiency, as entries that
+// end up sampled out are still constructed.
+func ExemptFromSampling(field, value string) {
+	samplingExemptionsMu.Lock()
+	exemptions := make(map[string]map[string]struct{})
+	current := samplingExemptions.Load()
+	if current != nil {
+		for k, values := range *current {
+			exemptions[k] = maps.Clone(values)
+		}
+	}
+	if exemptions[field] == nil {
+		exemptions[field] = make(map[string]struct{})
+	}
+	exemptions[field][value] = struct{}{}
+	samplingExemptions.Store(&exemptions)
+	samplingExemptionsMu.Unlock()
+
+	logConfigChange("sampling_exemptions", exemptionList(current), exemptionList(&exemptions))
+}
+
+// RemoveSamplingExemption removes an exemption added by ExemptFromSampling.
+func RemoveSamplingExemption(field, value string) {
+	samplingExemptionsMu.Lock()
+	current := samplingExemptions.Load()
+	if current == nil {
+		samplingExemptionsMu.Unlock()
+		return
+	}
+	if _, ok := (*current)[field][value]; !ok {
+		samplingExemptionsMu.Unlock()
+		return
+	}
+	exemptions := make(map[string]map[string]struct{}, len(*current))
+	for k, values := range *current {
+		values = maps.Clone(values)
+		if k == field {
+			delete(values, value)
+			if len(values) == 0 {
+				continue
+			}
+		}
+		exemptions[k] = values
+	}
+	updated := &exemptions
+	if len(exemptions) == 0 {
+		updated = nil
+	}
+	samplingExemptions.Store(updated)
+	samplingExemptionsMu.Unlock()
+
+	logConfigChange("sampling_exemptions", exemptionList(current), exemptionList(updated))
+}
+
+// exemptionList returns the exemptions as a sorted list of strings in
+// the form "field=value", for logging.
+func exemptionList(exemptions *map[string]map[string]struct{}) []string {
+	if exemptions == nil {
+		return nil
+	}
+	var list []string
+	for field, values := range *exemptions {
+		for value := range values {
+			list = append(list, field+"="+value)
+		}
+	}
+	slices.Sort(list)
+	return list
+}
+
+var (
+	// field key -> set of values; nil if there are no exemptions
+	samplingExemptions   atomic.Pointer[map[string]map[string]struct{}]
+	samplingExemptionsMu sync.Mutex // serializes changes to samplingExemptions
+)
+
+// exemptFromSampling returns true if any of the fields match an exemption.
+// Only fields with registered keys are formatted, to keep this cheap.
+func exemptFromSampling(exemptions map[string]map[string]struct{}, fieldLists ...[]zapcore.Field) bool {
+	for _, fields := range fieldLists {
+		for _, f := range fields {
+			values, ok := exemptions[f.Key]
+			if !ok {
+				continue
+			}
+			if v, ok := fieldValueString(f); ok {
+				if _, ok := values[v]; ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// fieldValueString returns the value of f as a string, if it is a
+// field type that can be compared to a string.
+func fieldValueString(f zapcore.Field) (string, bool) {
+	switch f.Type {
+	case zapcore.StringType:
+		return f.String, true
+	case zapcore.Int64Type, zapcore.Int32Type, zapcore.Int16Type, zapcore.Int8Type:
+		return strconv.FormatInt(f.Integer, 10), true
+	case zapcore.Uint64Type, zapcore.Uint32Type, zapcore.Uint16Type, zapcore.Uint8Type, zapcore.UintptrType:
+		return strconv.FormatUint(uint64(f.Integer), 10), true
+	case zapcore.BoolType:
+		return strconv.FormatBool(f.Integer == 1), true
+	case zapcore.StringerType:
+		if s, ok := f.Interface.(fmt.Stringer); ok {
+			return s.String(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,468 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SetLogFile enables the file output, which writes log entries as JSON
+// lines (see SetJSONSchema) to the file at path, appending to it if it
+// already exists. Entries are sampled like the other outputs, and only
+// written if they are at or above the file output's level (see
+// SetOutputLevels). Any previous log file is closed. An empty path
+// disables the file output.
+//
+// By default, the file grows without bound; use the options to rotate
+// it. When a file is rotated, it is renamed with the current time in
+// its name, and a new file is started at path. Rotated files are kept
+// forever, unless a retention option limits them.
+func SetLogFile(path string, opts ...LogFileOption) error {
+	var set *logFileSet
+	if path != "" {
+		var cfg logFileConfig
+		for _, opt := range opts {
+			opt(&cfg)
+		}
+		var err error
+		set, err = openLogFileSet(path, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	prev := logFileOutput.Swap(set)
+	var prevPath string
+	if prev != nil {
+		prevPath = prev.path
+	}
+	logConfigChange("log_file", prevPath, path)
+	if prev != nil {
+		return prev.Close()
+	}
+	return nil
+}
+
+// LogFileOption configures the file output.
+type LogFileOption func(*logFileConfig)
+
+// WithLogFileSizeRotation rotates the log file when writing an entry
+// would make it larger than maxBytes. The size of an existing file is
+// taken into account when it is opened.
+func WithLogFileSizeRotation(maxBytes int64) LogFileOption {
+	return func(cfg *logFileConfig) { cfg.maxBytes = maxBytes }
+}
+
+// WithLogFileLineRotation rotates the log file after it has maxLines
+// entries, which keeps file counts predictable even when entries vary
+// wildly in size. Lines in an existing file are counted when it is
+// opened, so the count is accurate across restarts. If size rotation
+// is also enabled, the file is rotated when either threshold is hit.
+func WithLogFileLineRotation(maxLines int) LogFileOption {
+	return func(cfg *logFileConfig) { cfg.maxLines = maxLines }
+}
+
+// WithLeveledLogFiles additionally writes the entries at or above each
+// level to the file at the corresponding path, such as errors to
+// "errors.log" alongside all entries in "app.log". An entry is encoded
+// only once, no matter how many files it is written to. The rotation
+// options apply to each file separately. Like the main file, these only
+// get entries at or above the file output's level.
+func WithLeveledLogFiles(files map[zapcore.Level]string) LogFileOption {
+	return func(cfg *logFileConfig) { cfg.leveled = files }
+}
+
+// WithLogFileRetention limits which rotated log files are kept: after
+// each rotation, rotated files beyond the most recent maxBackups, and
+// those last written to more than maxAge ago, are deleted. A limit of
+// 0 disables that limit. The current log file is never deleted.
+func WithLogFileRetention(maxBackups int, maxAge time.Duration) LogFileOption {
+	return func(cfg *logFileConfig) { cfg.maxBackups, cfg.maxAge = maxBackups, maxAge }
+}
+
+type logFileConfig struct {
+	maxBytes   int64                    // 0 means no limit
+	maxLines   int                      // 0 means no limit
+	maxBackups int                      // 0 means no limit
+	maxAge     time.Duration            // 0 means no limit
+	leveled    map[zapcore.Level]string // more files, by minimum level
+}
+
+// logFileOutput is the current set of log files, or nil if the file output is disabled.
+var logFileOutput atomic.Pointer[logFileSet]
+
+// logFileSet is the files that the file output writes to, which
+// share the encoder, since each entry is encoded only once.
+type logFileSet struct {
+	path  string
+	enc   zapcore.Encoder
+	files []*logFile
+}
+
+func openLogFileSet(path string, cfg logFileConfig) (*logFileSet, error) {
+	set := &logFileSet{path: path, enc: newForwardingEncoder()}
+	paths := map[string]zapcore.Level{path: zapcore.DebugLevel}
+	for level, leveledPath := range cfg.leveled {
+		if _, ok := paths[leveledPath]; ok {
+			return nil, fmt.Errorf("log file %s is configured more than once", leveledPath)
+		}
+		paths[leveledPath] = level
+	}
+	for p, level := range paths {
+		lf, err := openLogFile(p, cfg)
+		if err != nil {
+			set.Close()
+			return nil, err
+		}
+		lf.minLevel = level
+		set.files = append(set.files, lf)
+	}
+	return set, nil
+}
+
+// Write writes the encoded entry ent to each file that gets entries at
+// its level.
+func (set *logFileSet) Write(ent zapcore.Entry, p []byte) error {
+	var errs []error
+	for _, lf := range set.files {
+		if ent.Level < lf.minLevel {
+			continue
+		}
+		if _, err := lf.Write(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (set *logFileSet) Sync() error {
+	var errs []error
+	for _, lf := range set.files {
+		errs = append(errs, lf.Sync())
+	}
+	return errors.Join(errs...)
+}
+
+func (set *logFileSet) Close() error {
+	var errs []error
+	for _, lf := range set.files {
+		errs = append(errs, lf.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// fileCore writes entries to the current log file. Like uiCore,
+// context fields are not encoded until an entry is written, since
+// the log file (and its encoder) can change at any time.
+type fileCore struct {
+	zapcore.LevelEnabler
+	fields []zapcore.Field
+}
+
+func newFileCore(enab zapcore.LevelEnabler) *fileCore {
+	return &fileCore{LevelEnabler: enab}
+}
+
+func (c *fileCore) Enabled(level zapcore.Level) bool {
+	return logFileOutput.Load() != nil && c.LevelEnabler.Enabled(level)
+}
+
+func (c *fileCore) With(fields []zapcore.Field) zapcore.Core {
+	return &fileCore{
+		LevelEnabler: c.LevelEnabler,
+		fields:       slices.Concat(c.fields, fields),
+	}
+}
+
+func (c *fileCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *fileCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	// if the file is swapped out while writing, write to the new one
+	for {
+		f := logFileOutput.Load()
+		if f == nil {
+			return nil
+		}
+		buf, err := f.enc.EncodeEntry(ent, slices.Concat(c.fields, fields))
+		if err != nil {
+			return err
+		}
+		err = f.Write(ent, buf.Bytes())
+		buf.Free()
+		if errors.Is(err, os.ErrClosed) && logFileOutput.Load() != f {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ent.Level > zapcore.ErrorLevel {
+			// the process may be about to exit
+			return f.Sync()
+		}
+		return nil
+	}
+}
+
+func (c *fileCore) Sync() error {
+	if f := logFileOutput.Load(); f != nil {
+		return f.Sync()
+	}
+	return nil
+}
+
+// logFile is a log file that rotates itself according to its config.
+// Each call to Write must be exactly one entry.
+type logFile struct {
+	path     string
+	cfg      logFileConfig
+	minLevel zapcore.Level // the lowest level of entries written to this file
+
+	mu    sync.Mutex
+	file  *os.File // nil after closing
+	size  int64
+	lines int
+}
+
+func openLogFile(path string, cfg logFileConfig) (*logFile, error) {
+	lf := &logFile{path: path, cfg: cfg}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating log folder: %w", err)
+	}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// open opens the file at lf.path and measures it. lf.mu must be held
+// or lf must not be shared yet.
+func (lf *logFile) open() error {
+	f, err := os.OpenFile(lf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("getting log file info: %w", err)
+	}
+	var lines int
+	if lf.cfg.maxLines > 0 && info.Size() > 0 {
+		if lines, err = countLines(lf.path); err != nil {
+			f.Close()
+			return fmt.Errorf("counting lines in log file: %w", err)
+		}
+	}
+	lf.file, lf.size, lf.lines = f, info.Size(), lines
+	return nil
+}
+
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.shouldRotate(len(p)) {
+		if err := lf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.file.Write(p)
+	lf.size += int64(n)
+	lf.lines++
+	return n, err
+}
+
+// shouldRotate returns true if the file should be rotated before
+// writing an entry of n bytes to it.
+func (lf *logFile) shouldRotate(n int) bool {
+	if lf.size == 0 {
+		return false // never leave an empty file behind
+	}
+	return (lf.cfg.maxBytes > 0 && lf.size+int64(n) > lf.cfg.maxBytes) ||
+		(lf.cfg.maxLines > 0 && lf.lines >= lf.cfg.maxLines)
+}
+
+// rotate renames the current file out of the way and opens a new one.
+// lf.mu must be held.
+func (lf *logFile) rotate() error {
+	err := lf.file.Close()
+	lf.file = nil
+	if err != nil {
+		// the file can't be written to anymore, so reopen it rather
+		// than failing every write after this one
+		if openErr := lf.open(); openErr != nil {
+			return errors.Join(fmt.Errorf("closing log file for rotation: %w", err), openErr)
+		}
+		return fmt.Errorf("closing log file for rotation: %w", err)
+	}
+	if err := os.Rename(lf.path, rotatedLogFilePath(lf.path, time.Now())); err != nil {
+		// keep writing to the same file rather than losing entries
+		internalLog.Error("rotating log file", zap.String("path", lf.path), zap.Error(err))
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	if lf.cfg.maxBackups > 0 || lf.cfg.maxAge > 0 {
+		lf.pruneRotated(time.Now())
+	}
+	return nil
+}
+
+// pruneRotated deletes the rotated files that are not retained.
+// lf.mu must be held.
+func (lf *logFile) pruneRotated(now time.Time) {
+	rotated, err := rotatedLogFiles(lf.path)
+	if err != nil {
+		internalLog.Error("listing rotated log files", zap.String("path", lf.path), zap.Error(err))
+		return
+	}
+	for i, file := range rotated {
+		tooMany := lf.cfg.maxBackups > 0 && i >= lf.cfg.maxBackups
+		tooOld := lf.cfg.maxAge > 0 && now.Sub(file.modTime) > lf.cfg.maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			internalLog.Error("deleting rotated log file", zap.String("path", file.path), zap.Error(err))
+		}
+	}
+}
+
+// rotatedLogFile is a log file that was rotated (see rotatedLogFilePath).
+type rotatedLogFile struct {
+	path    string
+	modTime time.Time
+}
+
+// rotatedLogFiles returns the files that the log file at path was rotated
+// to, newest first. Other files that happen to have a similar name, such
+// as "app-errors.log" next to "app.log", are not included.
+func rotatedLogFiles(path string) ([]rotatedLogFile, error) {
+	ext := filepath.Ext(path)
+	prefix := filepath.Base(strings.TrimSuffix(path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	var rotated []rotatedLogFile
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, prefix)
+		if !ok || !strings.HasSuffix(name, ext) || len(stamp) < len(rotatedLogFileTimeLayout) {
+			continue
+		}
+		if _, err := time.Parse(rotatedLogFileTimeLayout, stamp[:len(rotatedLogFileTimeLayout)]); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // probably deleted in the meantime
+		}
+		rotated = append(rotated, rotatedLogFile{
+			path:    filepath.Join(filepath.Dir(path), name),
+			modTime: info.ModTime(),
+		})
+	}
+	slices.SortFunc(rotated, func(a, b rotatedLogFile) int {
+		return cmp.Or(b.modTime.Compare(a.modTime), strings.Compare(b.path, a.path))
+	})
+	return rotated, nil
+}
+
+func (lf *logFile) Sync() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.file == nil {
+		return nil
+	}
+	return lf.file.Sync()
+}
+
+func (lf *logFile) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.file == nil {
+		return nil
+	}
+	err := lf.file.Close()
+	lf.file = nil
+	return err
+}
+
+// rotatedLogFilePath returns the path to move a log file at path to
+// when it is rotated at time t; for example, "logs/app.log" becomes
+// "logs/app-2006-01-02T15-04-05.000.log". If that file already exists
+// (because of multiple rotations within the same millisecond), a
+// counter is added to the name.
+func rotatedLogFilePath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext) + "-" + t.UTC().Format(rotatedLogFileTimeLayout)
+	rotated := base + ext
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); errors.Is(err, fs.ErrNotExist) {
+			return rotated
+		}
+		rotated = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+// this layout sorts chronologically and is valid in file names on all platforms
+const rotatedLogFileTimeLayout = "2006-01-02T15-04-05.000"
+
+func countLines(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var lines int
+	buf := make([]byte, 32*1024) //nolint:mnd
+	for {
+		n, err := f.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		if errors.Is(err, io.EOF) {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
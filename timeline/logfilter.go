@@ -0,0 +1,95 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// loggerFilter allows entries from loggers that match any of its
+// patterns. An empty filter allows all entries.
+type loggerFilter []loggerPattern
+
+func parseLoggerFilter(patterns []string) (loggerFilter, error) {
+	var filter loggerFilter
+	for _, pattern := range patterns {
+		p, err := parseLoggerPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, p)
+	}
+	return filter, nil
+}
+
+func (f loggerFilter) allows(loggerName string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, p := range f {
+		if p.matches(loggerName) {
+			return true
+		}
+	}
+	return false
+}
+
+// loggerPattern matches dotted logger names. It is a list of segments,
+// each of which is either a literal name or "*", which matches any one
+// segment. A pattern matches a logger whose name begins with segments
+// that match the pattern's segments, so it also matches descendants.
+type loggerPattern []string
+
+func parseLoggerPattern(pattern string) (loggerPattern, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("%w: empty pattern", ErrInvalidLoggerPattern)
+	}
+	segments := strings.Split(pattern, ".")
+	for _, seg := range segments {
+		if seg == "" {
+			return nil, fmt.Errorf("%w: %q has an empty segment", ErrInvalidLoggerPattern, pattern)
+		}
+		if seg != "*" && strings.Contains(seg, "*") {
+			return nil, fmt.Errorf("%w: %q: wildcard must be an entire segment", ErrInvalidLoggerPattern, pattern)
+		}
+	}
+	return segments, nil
+}
+
+func (p loggerPattern) matches(loggerName string) bool {
+	rest, end := loggerName, loggerName == ""
+	for _, seg := range p {
+		if end {
+			return false // the name is shorter than the pattern
+		}
+		var head string
+		var more bool
+		head, rest, more = strings.Cut(rest, ".")
+		if seg != "*" && seg != head {
+			return false
+		}
+		end = !more
+	}
+	return true
+}
+
+// ErrInvalidLoggerPattern is returned when a logger name pattern is invalid.
+var ErrInvalidLoggerPattern = errors.New("invalid logger pattern")
@@ -0,0 +1,242 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SetLogHistorySize sets how many of the most recent messages sent to log
+// subscribers are kept in memory, to be replayed to new subscribers so
+// they can show recent history. By default, defaultLogHistorySize
+// messages are kept; a size of 0 disables the history. Resizing the
+// history discards the messages in it.
+func SetLogHistorySize(size int) {
+	prev := websocketLogOutputs.history.resize(size)
+	logConfigChange("log_history_size", prev, max(size, 0))
+}
+
+// defaultLogHistorySize is how many messages are kept in the history
+// of the default pool unless changed with SetLogHistorySize.
+const defaultLogHistorySize = 500
+
+// logHistory is a ring buffer of the most recent log messages. Each
+// message has a sequence number, in the order they were added, so
+// that it can tell how many messages a subscriber missed since it last
+// saw a message. Sequence numbers start at 1, so the messages after
+// sequence number seq start at index seq (see since).
+type logHistory struct {
+	mu    sync.Mutex
+	buf   []logMessage
+	start int    // index in buf of the oldest message
+	len   int    // number of messages in buf
+	next  uint64 // sequence number of the next message to be added
+	bytes int64  // total size of the messages in buf
+}
+
+// resize discards the messages in the history and changes its size,
+// and returns its previous size.
+func (h *logHistory) resize(size int) (prev int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev = len(h.buf)
+	h.buf = make([]logMessage, max(size, 0))
+	h.start, h.len = 0, 0
+	logMemory.history.Add(-h.bytes)
+	h.bytes = 0
+	return prev
+}
+
+// nextSeq returns the sequence number of the next message to be added.
+func (h *logHistory) nextSeq() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.next + 1
+}
+
+// add adds msg to the history, evicting the oldest message if it is full,
+// or the oldest messages (but never msg) if the log memory budget is
+// exceeded. msg must not be modified afterward.
+func (h *logHistory) add(msg logMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.next++
+	if len(h.buf) == 0 {
+		return
+	}
+	if h.len == len(h.buf) {
+		h.evictOldest()
+	}
+	h.buf[(h.start+h.len)%len(h.buf)] = msg
+	h.len++
+	h.account(int64(len(msg.data)))
+	for h.len > 1 && logMemory.overBudget() {
+		h.evictOldest()
+		logMemory.evicting()
+	}
+}
+
+// evictOldest removes the oldest message from the history, which must
+// not be empty.
+func (h *logHistory) evictOldest() {
+	h.account(-int64(len(h.buf[h.start].data)))
+	h.buf[h.start] = logMessage{}
+	h.start = (h.start + 1) % len(h.buf)
+	h.len--
+}
+
+// account adds n to the size of the messages in the history.
+func (h *logHistory) account(n int64) {
+	h.bytes += n
+	logMemory.history.Add(n)
+}
+
+// since returns the messages in the history with a sequence number of
+// at least seq, oldest first, and how many of those messages have
+// already been evicted from the history (the size of the gap).
+func (h *logHistory) since(seq uint64) (msgs []logMessage, missed uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.buf) == 0 {
+		return nil, 0 // history is disabled
+	}
+	if seq > h.next {
+		// sequence numbers have started over since seq was seen
+		// (probably because of a restart), so all are newer
+		seq = 0
+	}
+	oldest := h.next - uint64(h.len)
+	if seq < oldest {
+		missed = oldest - seq
+		seq = oldest
+	}
+	msgs = make([]logMessage, 0, h.next-seq)
+	for i := int(seq - oldest); i < h.len; i++ {
+		msgs = append(msgs, h.buf[(h.start+i)%len(h.buf)])
+	}
+	return msgs, missed
+}
+
+// appendSeq returns a copy of the encoded JSON object p with a "seq"
+// field for the sequence number added to it. If p is not a JSON
+// object, it is copied unchanged.
+func appendSeq(p []byte, seq uint64) []byte {
+	obj := bytes.TrimRight(p, "\r\n")
+	if len(obj) < 2 || obj[0] != '{' || obj[len(obj)-1] != '}' {
+		return append([]byte(nil), p...)
+	}
+	out := make([]byte, 0, len(p)+len(`,"seq":`)+20) //nolint:mnd // max length of a uint64
+	out = append(out, obj[:len(obj)-1]...)
+	if len(obj) > 2 {
+		out = append(out, ',')
+	}
+	out = append(out, `"seq":`...)
+	out = strconv.AppendUint(out, seq, 10)
+	out = append(out, '}')
+	return append(out, p[len(obj):]...)
+}
+
+// seqOf returns the sequence number that appendSeq added to the
+// encoded JSON object p, if it has one.
+func seqOf(p []byte) (uint64, bool) {
+	obj := bytes.TrimRight(p, "\r\n")
+	i := bytes.LastIndex(obj, []byte(`"seq":`))
+	if i < 0 || len(obj) == 0 || obj[len(obj)-1] != '}' {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(string(obj[i+len(`"seq":`):len(obj)-1]), 10, 64)
+	return seq, err == nil
+}
+
+// replayGapMessage returns a log message that marks a gap in replayed
+// history, since the UI would otherwise not know that some is missing.
+func replayGapMessage(missed uint64) []byte {
+	ent := zapcore.Entry{
+		Level:      zapcore.WarnLevel,
+		Time:       time.Now(),
+		LoggerName: "logging",
+		Message:    "log history is incomplete; older entries are no longer available",
+	}
+	buf, err := replayGapEncoder.EncodeEntry(ent, []zapcore.Field{
+		zap.Bool("replay_gap", true),
+		zap.Uint64("missed_entries", missed),
+	})
+	if err != nil {
+		return nil
+	}
+	defer buf.Free()
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+var replayGapEncoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+
+// ExportLogsFiltered writes the entries in the log history (see
+// SetLogHistorySize) that are at or above minLevel and were logged
+// within the time range to w as newline-delimited JSON, oldest first,
+// for attaching to bug reports. A zero since or until leaves that end
+// of the range unbounded. Tokens are redacted, and the user's home
+// directory is replaced with "~" so that paths don't reveal the user
+// name. Entries are written to w one at a time, rather than being
+// assembled in memory first.
+func ExportLogsFiltered(w io.Writer, since, until time.Time, minLevel zapcore.Level) error {
+	return websocketLogOutputs.history.export(w, since, until, minLevel)
+}
+
+func (h *logHistory) export(w io.Writer, since, until time.Time, minLevel zapcore.Level) error {
+	msgs, _ := h.since(0)
+	mask := newExportMasker()
+	for _, msg := range msgs {
+		if msg.level < minLevel ||
+			(!since.IsZero() && msg.time.Before(since)) ||
+			(!until.IsZero() && !msg.time.Before(until)) {
+			continue
+		}
+		if _, err := w.Write(mask(msg.data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newExportMasker returns a function that redacts sensitive values
+// from an encoded log message for export (or for posting elsewhere,
+// such as to a webhook).
+func newExportMasker() func([]byte) []byte {
+	var home []byte
+	if dir, err := os.UserHomeDir(); err == nil && len(dir) > 1 {
+		// paths are escaped in JSON (notably, backslashes on Windows)
+		quoted := strconv.Quote(dir)
+		home = []byte(quoted[1 : len(quoted)-1])
+	}
+	return func(data []byte) []byte {
+		data = []byte(redactTokens(string(data)))
+		if home != nil {
+			data = bytes.ReplaceAll(data, home, []byte("~"))
+		}
+		return data
+	}
+}
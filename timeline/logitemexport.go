@@ -0,0 +1,134 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// EnableLogItemExport sets whether ExportLogsAsItems may be used. Since
+// browsing the app's own activity on a timeline is a niche use, and the
+// exported logs may reveal more than the user expects once imported
+// into a timeline, it is disabled by default.
+func EnableLogItemExport(enable bool) {
+	logConfigChange("log_item_export", logItemExport.Swap(enable), enable)
+}
+
+var logItemExport atomic.Bool
+
+// ErrLogItemExportDisabled is returned by ExportLogsAsItems unless it was
+// enabled with EnableLogItemExport.
+var ErrLogItemExportDisabled = errors.New("exporting logs as items is not enabled")
+
+// ExportLogsAsItems is like ExportLogsFiltered, except the entries are
+// written as items (one ExportedItem per line) that can be imported
+// into a timeline, so users can browse the app's own activity on it.
+// Files of exported items should have the LogItemsExt extension, so
+// that the importer recognizes them. It must be enabled first with
+// EnableLogItemExport.
+func ExportLogsAsItems(w io.Writer, since, until time.Time, minLevel zapcore.Level) error {
+	if !logItemExport.Load() {
+		return ErrLogItemExportDisabled
+	}
+	return websocketLogOutputs.history.exportItems(w, since, until, minLevel)
+}
+
+// LogItemsExt is the file extension of exported log items.
+const LogItemsExt = ".tlzlog"
+
+func (h *logHistory) exportItems(w io.Writer, since, until time.Time, minLevel zapcore.Level) error {
+	msgs, _ := h.since(0)
+	mask := newExportMasker()
+	enc := json.NewEncoder(w)
+	for _, msg := range msgs {
+		if msg.level < minLevel ||
+			(!since.IsZero() && msg.time.Before(since)) ||
+			(!until.IsZero() && !msg.time.Before(until)) {
+			continue
+		}
+		item, err := newExportedItem(msg, mask(msg.data))
+		if err != nil {
+			continue // not a JSON entry (probably from a custom UI encoder)
+		}
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportedItem is a log entry exported as an item. Its layout mirrors
+// that of Item, except that the content is always text.
+type ExportedItem struct {
+	ID             string              `json:"id"`
+	Classification string              `json:"classification"`
+	Timestamp      time.Time           `json:"timestamp"`
+	Content        ExportedItemContent `json:"content"`
+	Metadata       Metadata            `json:"metadata,omitempty"`
+}
+
+// ExportedItemContent is the content of an ExportedItem.
+type ExportedItemContent struct {
+	MediaType string `json:"media_type,omitempty"`
+	Text      string `json:"text"`
+}
+
+// newExportedItem maps the encoded log message, which is a JSON entry
+// in zap's layout, to an item: the message is the content, and the
+// rest of the entry (its level, logger name, and fields) is metadata.
+func newExportedItem(msg logMessage, data []byte) (ExportedItem, error) {
+	var entry map[string]any
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return ExportedItem{}, err
+	}
+	text, _ := entry["msg"].(string)
+	for _, key := range []string{"ts", "msg", "seq"} {
+		delete(entry, key)
+	}
+	return ExportedItem{
+		// sequence numbers start over when the process restarts,
+		// so the time makes the ID unique among exports
+		ID:             strconv.FormatInt(msg.time.UnixNano(), 36) + "-" + strconv.FormatUint(msg.seq, 10),
+		Classification: ClassNote.Name,
+		Timestamp:      msg.time,
+		Content:        ExportedItemContent{MediaType: "text/plain", Text: text},
+		Metadata:       Metadata(entry).HumanizeKeys(),
+	}, nil
+}
+
+// Item returns the item to import for the exported item.
+func (ei ExportedItem) Item() *Item {
+	return &Item{
+		ID:             ei.ID,
+		Classification: getClassification(ei.Classification),
+		Timestamp:      ei.Timestamp,
+		Content: ItemData{
+			MediaType: ei.Content.MediaType,
+			Data:      StringData(ei.Content.Text),
+		},
+		Metadata: ei.Metadata,
+	}
+}
@@ -0,0 +1,158 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JobStatus is the most recent status update of a job (see
+// CurrentJobStatuses).
+type JobStatus struct {
+	JobID uint64 `json:"job_id"`
+
+	// The message of the status update, such as "progress",
+	// and the state of the job, if the update has one.
+	Message string `json:"msg"`
+	State   string `json:"state,omitempty"`
+
+	// When the update was logged.
+	Time time.Time `json:"time"`
+
+	// Whether the job is no longer running.
+	Finished bool `json:"finished,omitempty"`
+
+	// The update as it was sent to log subscribers.
+	Entry json.RawMessage `json:"entry"`
+}
+
+// CurrentJobStatuses returns the most recent status update of each job
+// that is running or finished recently, ordered by job ID, so that a UI
+// that just connected can show the state of all jobs without waiting
+// for their next updates.
+func CurrentJobStatuses() []JobStatus {
+	return websocketLogOutputs.jobStatuses.current(time.Now())
+}
+
+// SetReplayJobStatuses sets whether new log subscribers are sent the
+// most recent status update of each job (see CurrentJobStatuses) when
+// they connect, if they receive job status updates at all. Updates that
+// are in the recent history (see SetLogHistorySize) are replayed with
+// it anyway, so they are not sent twice. It is disabled by default.
+func SetReplayJobStatuses(replay bool) { replayJobStatuses.Store(replay) }
+
+var replayJobStatuses atomic.Bool
+
+// jobStatusRegistry keeps the most recent status update of each job.
+type jobStatusRegistry struct {
+	mu   sync.Mutex
+	jobs map[uint64]jobStatusEntry
+}
+
+type jobStatusEntry struct {
+	msg      logMessage
+	message  string
+	finished time.Time // zero if the job is still running
+}
+
+// record keeps msg, a status update with the given message, as its job's
+// most recent status, and forgets jobs that finished a while ago.
+func (r *jobStatusRegistry) record(message string, msg logMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.jobs == nil {
+		r.jobs = make(map[uint64]jobStatusEntry)
+	}
+	entry := jobStatusEntry{msg: msg, message: message}
+	if isFinalJobState(msg.jobState) || isFinalJobState(message) {
+		entry.finished = msg.time
+		if prev, ok := r.jobs[msg.jobID]; ok && !prev.finished.IsZero() {
+			entry.finished = prev.finished
+		}
+	}
+	r.jobs[msg.jobID] = entry
+	r.prune(msg.time)
+}
+
+// prune forgets jobs that finished longer ago than the grace period.
+// r.mu must be locked.
+func (r *jobStatusRegistry) prune(now time.Time) {
+	for id, entry := range r.jobs {
+		if !entry.finished.IsZero() && now.Sub(entry.finished) > finishedJobStatusGracePeriod {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+func (r *jobStatusRegistry) current(now time.Time) []JobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(now)
+	statuses := make([]JobStatus, 0, len(r.jobs))
+	for id, entry := range r.jobs {
+		state := entry.msg.jobState
+		if state == "" && isFinalJobState(entry.message) {
+			state = entry.message // the final update is named after the state
+		}
+		statuses = append(statuses, JobStatus{
+			JobID:    id,
+			Message:  entry.message,
+			State:    state,
+			Time:     entry.msg.time,
+			Finished: !entry.finished.IsZero(),
+			Entry:    json.RawMessage(entry.msg.data),
+		})
+	}
+	slices.SortFunc(statuses, func(a, b JobStatus) int { return cmp.Compare(a.JobID, b.JobID) })
+	return statuses
+}
+
+// messagesBetween returns the most recent status updates with sequence
+// numbers in the range (afterSeq, beforeSeq), ordered by sequence number.
+func (r *jobStatusRegistry) messagesBetween(afterSeq, beforeSeq uint64) []logMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var msgs []logMessage
+	for _, entry := range r.jobs {
+		if entry.msg.seq > afterSeq && entry.msg.seq < beforeSeq {
+			msgs = append(msgs, entry.msg)
+		}
+	}
+	slices.SortFunc(msgs, func(a, b logMessage) int { return cmp.Compare(a.seq, b.seq) })
+	return msgs
+}
+
+// isFinalJobState returns true if state is a state of a job that is
+// not running anymore.
+func isFinalJobState(state string) bool {
+	switch JobState(state) {
+	case JobSucceeded, JobFailed, JobAborted, JobInterrupted:
+		return true
+	}
+	return false
+}
+
+// finishedJobStatusGracePeriod is how long the status of a finished job
+// is kept, so that a UI that connects soon after still sees the outcome.
+const finishedJobStatusGracePeriod = 5 * time.Minute
@@ -0,0 +1,201 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// EnableJournald adds an output that sends entries to the systemd journal
+// using its native protocol, when the process is running under systemd
+// (as a service), so that journalctl shows them with the proper severity
+// (PRIORITY) and with their fields as structured journal fields, whose
+// names are the field keys in upper case (for example, JOB_ID). The
+// output uses the minimum level of the file output (see SetOutputLevels).
+// The other outputs are not affected. If the process is not running
+// under systemd, or the journal can't be reached, nothing is added and ok
+// is false; disable is never nil, so it can be called either way.
+func EnableJournald() (disable func(), ok bool) {
+	conn, err := dialJournal()
+	if err != nil {
+		if !errors.Is(err, errJournalUnavailable) {
+			internalLog.Warn("connecting to systemd journal; not logging to it", zap.Error(err))
+		}
+		return func() {}, false
+	}
+	remove := addLogSink(&journaldSink{conn: conn, identifier: journalIdentifier})
+	return func() {
+		remove()
+		conn.Close()
+	}, true
+}
+
+// errJournalUnavailable is returned by dialJournal if the process is not
+// running under systemd, or the platform doesn't have it.
+var errJournalUnavailable = errors.New("systemd journal is not available")
+
+// journalIdentifier is the SYSLOG_IDENTIFIER of journal entries.
+const journalIdentifier = "timelinize"
+
+// journaldSink writes entries to the systemd journal.
+type journaldSink struct {
+	conn       io.WriteCloser // each write is one datagram
+	identifier string
+}
+
+func (js *journaldSink) Enabled(level zapcore.Level) bool { return fileLevel.Enabled(level) }
+
+func (js *journaldSink) writeEntry(ent zapcore.Entry, fields []zapcore.Field) error {
+	_, err := js.conn.Write(encodeJournalEntry(js.identifier, ent, fields))
+	return err
+}
+
+func (*journaldSink) Sync() error { return nil }
+
+// encodeJournalEntry encodes the entry in the native journal protocol:
+// a list of fields, each of which is either NAME=value followed by a
+// newline, or, for values that contain a newline, the name followed by
+// a newline, the length of the value as a little-endian uint64, the
+// value, and a newline.
+func encodeJournalEntry(identifier string, ent zapcore.Entry, fields []zapcore.Field) []byte {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", ent.Message)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(journalPriority(ent.Level)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", identifier)
+	if ent.LoggerName != "" {
+		writeJournalField(&buf, "LOGGER", ent.LoggerName)
+	}
+	if ent.Caller.Defined {
+		writeJournalField(&buf, "CODE_FILE", ent.Caller.File)
+		writeJournalField(&buf, "CODE_LINE", strconv.Itoa(ent.Caller.Line))
+		if ent.Caller.Function != "" {
+			writeJournalField(&buf, "CODE_FUNC", ent.Caller.Function)
+		}
+	}
+	if ent.Stack != "" {
+		writeJournalField(&buf, "STACKTRACE", ent.Stack)
+	}
+
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	keys := make([]string, 0, len(enc.Fields))
+	for key := range enc.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := journalFieldName(key)
+		if name == "" {
+			continue
+		}
+		writeJournalField(&buf, name, journalFieldValue(enc.Fields[key]))
+	}
+	return buf.Bytes()
+}
+
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalPriority returns the syslog priority for level.
+func journalPriority(level zapcore.Level) int {
+	switch {
+	case level <= zapcore.DebugLevel:
+		return 7 // debug
+	case level == zapcore.InfoLevel:
+		return 6 // info
+	case level == zapcore.WarnLevel:
+		return 4 // warning
+	case level == zapcore.ErrorLevel:
+		return 3 // err
+	default:
+		return 2 // crit
+	}
+}
+
+// journalFieldName returns the journal field name for a field key: the key
+// in upper case, with characters that aren't allowed replaced by underscores.
+// Names may not start with an underscore (those are trusted fields set by
+// the journal) or a digit, so those are prefixed; they are limited to 64
+// characters. An empty string is returned if the key has no usable name.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	if name == "" {
+		return ""
+	}
+	if name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+		name = "F" + name
+	}
+	const maxJournalFieldNameLen = 64
+	if len(name) > maxJournalFieldNameLen {
+		name = name[:maxJournalFieldNameLen]
+	}
+	return name
+}
+
+// journalFieldValue returns the value of a field, as encoded by a
+// zapcore.MapObjectEncoder, as a string: strings as they are, and
+// anything else as JSON.
+func journalFieldValue(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	if len(b) > 1 && b[0] == '"' {
+		// like a time, which is more readable without the quotes
+		if s, err := strconv.Unquote(string(b)); err == nil {
+			return s
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"net"
+	"os"
+)
+
+// dialJournal connects to the socket of the systemd journal, if the
+// process is running under systemd, which sets INVOCATION_ID (or
+// JOURNAL_STREAM, if the output streams are connected to the journal)
+// for the processes of its services.
+func dialJournal() (*net.UnixConn, error) {
+	if os.Getenv("INVOCATION_ID") == "" && os.Getenv("JOURNAL_STREAM") == "" {
+		return nil, errJournalUnavailable
+	}
+	if _, err := os.Stat(journalSocket); err != nil {
+		return nil, errJournalUnavailable
+	}
+	return net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+}
+
+const journalSocket = "/run/systemd/journal/socket"
@@ -0,0 +1,78 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// SetLogMemoryBudget sets roughly how many bytes of memory the logging
+// system may use for the encoded messages it holds: those in the log
+// history (see SetLogHistorySize) and those queued for log subscribers,
+// which is where nearly all of its memory goes under heavy load. When
+// the budget is reached, the oldest messages in the history are evicted,
+// and the oldest queued messages of a subscriber that isn't keeping up
+// are dropped, so that logging doesn't contribute to running out of
+// memory during huge imports. A warning is logged the first time this
+// happens. Messages that are both in the history and queued are counted
+// for each, so the usage is an upper bound. A budget of 0 (the default)
+// is unlimited.
+func SetLogMemoryBudget(bytes int) {
+	prev := logMemory.budget.Swap(int64(max(bytes, 0)))
+	logConfigChange("log_memory_budget", prev, int64(max(bytes, 0)))
+}
+
+// logMemory accounts for the memory used by the logging system.
+var logMemory logMemoryUsage
+
+type logMemoryUsage struct {
+	budget  atomic.Int64
+	history atomic.Int64 // bytes of messages in the log history
+	queued  atomic.Int64 // bytes of messages in subscriber queues
+
+	// how many messages have been evicted or dropped to stay within
+	// the budget, and whether we've warned about it
+	evicted atomic.Uint64
+	warned  atomic.Bool
+}
+
+// usage returns how many bytes are in use.
+func (m *logMemoryUsage) usage() int64 {
+	return m.history.Load() + m.queued.Load()
+}
+
+// overBudget returns true if there is a budget and it is exceeded.
+func (m *logMemoryUsage) overBudget() bool {
+	budget := m.budget.Load()
+	return budget > 0 && m.usage() > budget
+}
+
+// evicting records that a message was evicted or dropped to stay
+// within the budget.
+func (m *logMemoryUsage) evicting() {
+	m.evicted.Add(1)
+	if !m.warned.Swap(true) {
+		internalLog.Warn("log memory budget reached; evicting oldest log history and dropping queued messages",
+			zap.Int64("budget_bytes", m.budget.Load()),
+			zap.Int64("history_bytes", m.history.Load()),
+			zap.Int64("queued_bytes", m.queued.Load()))
+	}
+}
@@ -0,0 +1,193 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// logMetrics are counters of logging activity.
+var logMetrics logMetricsCounters
+
+type logMetricsCounters struct {
+	// entries by level, indexed from zapcore.DebugLevel
+	entries [zapcore.FatalLevel - zapcore.DebugLevel + 1]atomic.Uint64
+
+	// entries dropped by sampling or throttling
+	sampledOut atomic.Uint64
+
+	// failed writes to log subscribers
+	writeErrors atomic.Uint64
+
+	// messages dropped from the queues of log subscribers
+	subscriberDrops atomic.Uint64
+
+	// frames of batched messages sent to log subscribers, how many
+	// messages were in them, and how many were sent for each reason
+	// (see SetLogBatching)
+	batchFrames, batchEntries atomic.Uint64
+	batchFlushes              [numBatchFlushReasons]atomic.Uint64
+
+	// entries by the top of their logger name (see metricsLoggerName);
+	// values are *atomic.Uint64
+	entriesByName sync.Map
+
+	// decisions of the samplers, by the top of the logger name of the
+	// entries; values are *samplingCounters
+	samplingByName sync.Map
+}
+
+// samplingCounters count the decisions of the main sampler and the more
+// lenient sampler for live job progress entries.
+type samplingCounters struct {
+	passed, dropped                         atomic.Uint64
+	liveProgressPassed, liveProgressDropped atomic.Uint64
+}
+
+// countSampling counts a decision of a sampler about an entry from the
+// logger with the given name.
+func (m *logMetricsCounters) countSampling(loggerName string, liveProgress bool, dec zapcore.SamplingDecision) {
+	name := metricsLoggerName(loggerName)
+	c, ok := m.samplingByName.Load(name)
+	if !ok {
+		c, _ = m.samplingByName.LoadOrStore(name, new(samplingCounters))
+	}
+	counters := c.(*samplingCounters)
+	dropped := dec&zapcore.LogDropped != 0
+	switch {
+	case liveProgress && dropped:
+		counters.liveProgressDropped.Add(1)
+	case liveProgress:
+		counters.liveProgressPassed.Add(1)
+	case dropped:
+		counters.dropped.Add(1)
+	default:
+		counters.passed.Add(1)
+	}
+}
+
+// LogSamplingCounts are how many entries from a logger were let through
+// (passed) or dropped by sampling. Entries that are never sampled, such
+// as job status updates, aren't counted, so the total number of entries
+// from the logger (see EntryCountsByName) may be greater than the sum.
+type LogSamplingCounts struct {
+	// by the sampler for most entries
+	Passed  uint64 `json:"passed,omitempty"`
+	Dropped uint64 `json:"dropped,omitempty"`
+
+	// by the more lenient sampler for live job progress entries
+	LiveProgressPassed  uint64 `json:"live_progress_passed,omitempty"`
+	LiveProgressDropped uint64 `json:"live_progress_dropped,omitempty"`
+}
+
+// samplingCounts returns the sampling counts by logger name (see
+// metricsLoggerName).
+func (m *logMetricsCounters) samplingCounts() map[string]LogSamplingCounts {
+	counts := make(map[string]LogSamplingCounts)
+	m.samplingByName.Range(func(name, c any) bool {
+		counters := c.(*samplingCounters)
+		counts[name.(string)] = LogSamplingCounts{
+			Passed:              counters.passed.Load(),
+			Dropped:             counters.dropped.Load(),
+			LiveProgressPassed:  counters.liveProgressPassed.Load(),
+			LiveProgressDropped: counters.liveProgressDropped.Load(),
+		}
+		return true
+	})
+	return counts
+}
+
+// countEntry counts an entry at level, if it is a valid level.
+func (m *logMetricsCounters) countEntry(level zapcore.Level) {
+	if level >= zapcore.DebugLevel && level <= zapcore.FatalLevel {
+		m.entries[level-zapcore.DebugLevel].Add(1)
+	}
+}
+
+// countNamedEntry counts an entry from the logger with the given name.
+func (m *logMetricsCounters) countNamedEntry(loggerName string) {
+	name := metricsLoggerName(loggerName)
+	counter, ok := m.entriesByName.Load(name)
+	if !ok {
+		counter, _ = m.entriesByName.LoadOrStore(name, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// metricsLoggerName returns the first two segments of a logger name (such
+// as "datasource.google_photos" or "job.action"), which identify the source
+// of an entry well enough, without one counter for every derived logger.
+func metricsLoggerName(loggerName string) string {
+	if first := strings.IndexByte(loggerName, '.'); first >= 0 {
+		if second := strings.IndexByte(loggerName[first+1:], '.'); second >= 0 {
+			return loggerName[:first+1+second]
+		}
+	}
+	return loggerName
+}
+
+// EntryCountsByName returns the number of entries that have been logged,
+// keyed by the first two segments of the logger name; for example, entries
+// from "datasource.google_photos" and "datasource.google_photos.albums"
+// are both counted under "datasource.google_photos". Entries from the root
+// logger are counted under "". Like the other logging metrics, entries are
+// counted before sampling. This is useful for finding which sources of logs
+// are the noisiest. The returned map is a snapshot owned by the caller.
+func EntryCountsByName() map[string]uint64 {
+	counts := make(map[string]uint64)
+	logMetrics.entriesByName.Range(func(name, counter any) bool {
+		counts[name.(string)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
+
+// countSamplingDecision is a hook for the main sampler that counts its
+// decisions. When outputs are sampled independently (see
+// SetConsistentSampling), an entry is counted once per output.
+func countSamplingDecision(ent zapcore.Entry, dec zapcore.SamplingDecision) {
+	if dec&zapcore.LogDropped != 0 {
+		logMetrics.sampledOut.Add(1)
+	}
+	logMetrics.countSampling(ent.LoggerName, false, dec)
+}
+
+// countLiveProgressSamplingDecision is like countSamplingDecision, but
+// for the sampler of live job progress entries.
+func countLiveProgressSamplingDecision(ent zapcore.Entry, dec zapcore.SamplingDecision) {
+	if dec&zapcore.LogDropped != 0 {
+		logMetrics.sampledOut.Add(1)
+	}
+	logMetrics.countSampling(ent.LoggerName, true, dec)
+}
+
+// entriesByLevel returns the number of entries logged at each level.
+func (m *logMetricsCounters) entriesByLevel() map[zapcore.Level]uint64 {
+	counts := make(map[zapcore.Level]uint64, len(m.entries))
+	for i := range m.entries {
+		if n := m.entries[i].Load(); n > 0 {
+			counts[zapcore.DebugLevel+zapcore.Level(i)] = n
+		}
+	}
+	return counts
+}
@@ -0,0 +1,103 @@
+//go:build prometheus
+
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterLogMetrics registers metrics about logging with reg: the total
+// number of entries by level, entries dropped by sampling (in total, and
+// the decisions of each sampler by logger name), the number of log
+// subscribers, and failed writes to subscribers. The values come from
+// the same counters as LogStats.
+//
+// This is only available when built with the "prometheus" build tag, so
+// that logging doesn't otherwise depend on the Prometheus client.
+func RegisterLogMetrics(reg prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		logEntriesCollector{},
+		logSamplingCollector{},
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "timelinize",
+			Subsystem: "log",
+			Name:      "sampled_out_entries_total",
+			Help:      "Number of log entries dropped by sampling.",
+		}, func() float64 { return float64(logMetrics.sampledOut.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "timelinize",
+			Subsystem: "log",
+			Name:      "subscribers",
+			Help:      "Number of connections receiving logs.",
+		}, func() float64 { return float64(logSubscriberCount()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "timelinize",
+			Subsystem: "log",
+			Name:      "subscriber_write_errors_total",
+			Help:      "Number of failed writes to connections receiving logs.",
+		}, func() float64 { return float64(logMetrics.writeErrors.Load()) }),
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logEntriesCollector collects the number of entries logged by level.
+type logEntriesCollector struct{}
+
+var logEntriesDesc = prometheus.NewDesc("timelinize_log_entries_total",
+	"Number of log entries, by level.", []string{"level"}, nil)
+
+func (logEntriesCollector) Describe(ch chan<- *prometheus.Desc) { ch <- logEntriesDesc }
+
+func (logEntriesCollector) Collect(ch chan<- prometheus.Metric) {
+	for level, n := range logMetrics.entriesByLevel() {
+		ch <- prometheus.MustNewConstMetric(logEntriesDesc, prometheus.CounterValue, float64(n), level.String())
+	}
+}
+
+// logSamplingCollector collects the decisions of the samplers by logger.
+type logSamplingCollector struct{}
+
+var logSamplingDesc = prometheus.NewDesc("timelinize_log_sampling_decisions_total",
+	"Number of log entries let through or dropped by sampling, by logger, sampler, and decision.",
+	[]string{"logger", "sampler", "decision"}, nil)
+
+func (logSamplingCollector) Describe(ch chan<- *prometheus.Desc) { ch <- logSamplingDesc }
+
+func (logSamplingCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, counts := range logMetrics.samplingCounts() {
+		for _, c := range []struct {
+			sampler, decision string
+			n                 uint64
+		}{
+			{"main", "passed", counts.Passed},
+			{"main", "dropped", counts.Dropped},
+			{"live_progress", "passed", counts.LiveProgressPassed},
+			{"live_progress", "dropped", counts.LiveProgressDropped},
+		} {
+			ch <- prometheus.MustNewConstMetric(logSamplingDesc, prometheus.CounterValue, float64(c.n), name, c.sampler, c.decision)
+		}
+	}
+}
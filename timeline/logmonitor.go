@@ -0,0 +1,227 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EnableResourceLogging starts a background sampler that periodically logs
+// memory statistics under the "resource" logger until ctx is canceled. This
+// is useful for correlating slowdowns or crashes during large imports with
+// memory pressure. Samples are logged at debug level, unless the heap has
+// grown beyond heapWarnThreshold bytes, in which case they are logged as
+// warnings. A threshold of 0 disables the escalation. If interval is not
+// positive, a default interval is used.
+func EnableResourceLogging(ctx context.Context, interval time.Duration, heapWarnThreshold uint64) {
+	if interval <= 0 {
+		interval = defaultResourceLogInterval
+	}
+	go logResources(ctx, Log.Named("resource"), interval, heapWarnThreshold)
+}
+
+// logResources logs memory statistics to logger every interval, as
+// described by EnableResourceLogging, until ctx is canceled.
+func logResources(ctx context.Context, logger *zap.Logger, interval time.Duration, heapWarnThreshold uint64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prevNumGC uint32
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+
+		// PauseNs is a circular buffer; the most recent pause is at (NumGC+255)%256
+		var lastPause time.Duration
+		if ms.NumGC > 0 {
+			lastPause = time.Duration(ms.PauseNs[(ms.NumGC+255)%uint32(len(ms.PauseNs))])
+		}
+
+		level := zap.DebugLevel
+		if heapWarnThreshold > 0 && ms.HeapAlloc > heapWarnThreshold {
+			level = zap.WarnLevel
+		}
+
+		if checked := logger.Check(level, "memory usage"); checked != nil {
+			checked.Write(
+				zap.Uint64("heap_alloc", ms.HeapAlloc),
+				zap.Uint64("heap_sys", ms.HeapSys),
+				zap.Uint64("heap_objects", ms.HeapObjects),
+				zap.Uint64("sys", ms.Sys),
+				zap.Uint32("num_gc", ms.NumGC),
+				zap.Uint32("gcs_since_last_sample", ms.NumGC-prevNumGC),
+				zap.Duration("last_gc_pause", lastPause),
+				zap.Duration("total_gc_pause", time.Duration(ms.PauseTotalNs)),
+				zap.Int("goroutines", runtime.NumGoroutine()))
+		}
+
+		prevNumGC = ms.NumGC
+	}
+}
+
+const defaultResourceLogInterval = 30 * time.Second
+
+// EnableStorageMonitor starts a background check that periodically logs
+// the available disk space for the file system that contains path (for
+// example, the data directory of a timeline) under the "storage" logger
+// until ctx is canceled, so that large imports don't fail silently when
+// the disk fills up. Entries are logged at debug level while space is
+// plentiful, as warnings once the available space drops below warnBytes,
+// and as errors once it drops below criticalBytes; the "state" field is
+// "ok", "low", or "critical", so the UI can warn the user (and perhaps
+// pause imports). These entries are never sampled. A threshold of 0
+// disables that level of escalation.
+func EnableStorageMonitor(ctx context.Context, path string, warnBytes, criticalBytes int64) {
+	logger := Log.Named("storage").With(zap.String("path", path))
+
+	check := func() {
+		space, err := diskSpace(path)
+		if err != nil {
+			if !errors.Is(err, errDiskSpaceUnsupported) {
+				logger.Error("checking available storage space", zap.Error(err))
+			}
+			return
+		}
+
+		level, state := zap.DebugLevel, "ok"
+		switch {
+		case criticalBytes > 0 && space.available < uint64(criticalBytes):
+			level, state = zap.ErrorLevel, "critical"
+		case warnBytes > 0 && space.available < uint64(warnBytes):
+			level, state = zap.WarnLevel, "low"
+		}
+
+		if checked := logger.Check(level, "storage space"); checked != nil {
+			checked.Write(
+				zap.String("state", state),
+				zap.Uint64("available_bytes", space.available),
+				zap.Uint64("total_bytes", space.total),
+				zap.Int64("warn_bytes", warnBytes),
+				zap.Int64("critical_bytes", criticalBytes))
+		}
+	}
+
+	go func() {
+		check()
+
+		ticker := time.NewTicker(storageMonitorInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
+
+// storageSpace describes the capacity of a file system.
+type storageSpace struct {
+	available uint64 // bytes available to this (unprivileged) process
+	total     uint64
+}
+
+// errDiskSpaceUnsupported is returned by diskSpace on platforms where
+// it is not implemented.
+var errDiskSpaceUnsupported = errors.New("checking disk space is not supported on this platform")
+
+const storageMonitorInterval = time.Minute
+
+// EnableConnectivityMonitor starts a background check that periodically
+// probes whether the machine can reach the internet, until ctx is canceled.
+// Transitions between online and offline are logged under the "network"
+// logger (never sampled), and while offline, errors logged by jobs (such
+// as imports from online sources) have an "offline" field set to true,
+// so the UI can tell the user they're offline instead of showing a
+// generic error. If interval is not positive, a default interval is used.
+func EnableConnectivityMonitor(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultConnectivityCheckInterval
+	}
+	logger := Log.Named("network")
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		changed := time.Now()
+		for {
+			offline := !probeConnectivity(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if networkOffline.Swap(offline) != offline {
+				now := time.Now()
+				if offline {
+					logger.Warn("offline", zap.Strings("probed", connectivityProbeAddrs))
+				} else {
+					logger.Info("online", zap.Duration("offline_for", now.Sub(changed)))
+				}
+				changed = now
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// probeConnectivity returns true if any of the probe addresses can be reached.
+func probeConnectivity(ctx context.Context) bool {
+	dialer := net.Dialer{Timeout: connectivityProbeTimeout}
+	for _, addr := range connectivityProbeAddrs {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// networkOffline is true if the connectivity monitor last found the machine to be offline.
+var networkOffline atomic.Bool
+
+// connectivityProbeAddrs are well-known, highly available addresses (public
+// DNS resolvers) that are reachable if the machine has internet access.
+var connectivityProbeAddrs = []string{"1.1.1.1:53", "8.8.8.8:53"}
+
+const (
+	defaultConnectivityCheckInterval = 30 * time.Second
+	connectivityProbeTimeout         = 5 * time.Second
+)
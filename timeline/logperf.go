@@ -0,0 +1,137 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ObserveItemLatency records how long it took to process an item in the
+// given category (such as its classification). Periodically, a summary
+// of the latencies in each category (percentiles) is logged under the
+// "perf" logger, and the recorded latencies are reset. Latencies are
+// also counted in the item store duration metric (see MetricsSnapshot).
+func ObserveItemLatency(category string, d time.Duration) {
+	itemLatencies.observe(category, d)
+	itemStoreDurationMetric.observe(d.Seconds(), category)
+}
+
+// SetLatencyFlushInterval sets how often the summary of item latencies
+// is logged (see ObserveItemLatency). It takes effect after the current
+// window. If d is not positive, a default interval is used.
+func SetLatencyFlushInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultLatencyFlushInterval
+	}
+	latencyFlushInterval.Store(int64(d))
+}
+
+var latencyFlushInterval = func() *atomic.Int64 {
+	var d atomic.Int64
+	d.Store(int64(defaultLatencyFlushInterval))
+	return &d
+}()
+
+var itemLatencies = &latencyAggregator{windows: make(map[string]*latencyWindow)}
+
+// latencyAggregator collects latencies by category for each window.
+type latencyAggregator struct {
+	mu      sync.Mutex
+	windows map[string]*latencyWindow
+	started sync.Once
+}
+
+// latencyWindow is the latencies observed in one category during a window.
+// If there are too many to keep, a uniform sample of them is kept instead.
+type latencyWindow struct {
+	count   int
+	longest time.Duration
+	samples []time.Duration
+}
+
+func (la *latencyAggregator) observe(category string, d time.Duration) {
+	la.started.Do(func() { go la.run() })
+
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	w, ok := la.windows[category]
+	if !ok {
+		w = new(latencyWindow)
+		la.windows[category] = w
+	}
+	w.count++
+	w.longest = max(w.longest, d)
+	if len(w.samples) < maxLatencySamples {
+		w.samples = append(w.samples, d)
+		return
+	}
+	// reservoir sampling
+	if i := rand.IntN(w.count); i < maxLatencySamples { //nolint:gosec // not used for security
+		w.samples[i] = d
+	}
+}
+
+func (la *latencyAggregator) run() {
+	logger := Log.Named("perf")
+	for {
+		time.Sleep(time.Duration(latencyFlushInterval.Load()))
+
+		la.mu.Lock()
+		windows := la.windows
+		la.windows = make(map[string]*latencyWindow, len(windows))
+		la.mu.Unlock()
+
+		for category, w := range windows {
+			slices.Sort(w.samples)
+			fields := []zap.Field{
+				zap.String("category", category),
+				zap.Int("count", w.count),
+			}
+			for _, p := range latencyPercentiles {
+				fields = append(fields, zap.Duration(fmt.Sprintf("p%d", p), percentile(w.samples, p)))
+			}
+			fields = append(fields, zap.Duration("max", w.longest))
+			logger.Info("item latency", fields...)
+		}
+	}
+}
+
+// latencyPercentiles are the percentiles of item latency that are logged.
+var latencyPercentiles = []int{50, 95, 99}
+
+// percentile returns the pth percentile of sorted, using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100 //nolint:mnd // ceil(p/100 * n)
+	return sorted[max(rank, 1)-1]
+}
+
+const (
+	defaultLatencyFlushInterval = time.Minute
+	maxLatencySamples           = 4096
+)
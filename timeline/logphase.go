@@ -0,0 +1,219 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Phase is a logger for a phase of work, such as estimating the size
+// of an import or generating thumbnails. All entries logged with it
+// have a "phase" field, so the UI can filter by phase without each
+// call site having to tag its entries. Phases can be nested, in which
+// case the phase field is the path of phase names, separated by "/".
+//
+// The idiom is:
+//
+//	phase := WithPhase(logger, "thumbnailing")
+//	defer phase.End()
+//
+// and then log with phase (or derivatives of it) instead of logger.
+//
+// When a phase ends, what it cost is logged under the "perf.phase"
+// logger (which is never sampled), and if the phase belongs to a job,
+// the costs of the job's phases are summed by phase and included in
+// the job's final status entry as "phase_costs", for a breakdown of
+// where the job spent its time.
+type Phase struct {
+	*zap.Logger
+
+	base   *zap.Logger // the logger without the phase field
+	parent *zap.Logger // the logger to return to when the phase ends
+	path   []string
+	start  time.Time
+
+	startUsage resourceUsage
+	items      atomic.Int64
+}
+
+// WithPhase starts a phase named name, returning a logger derived from
+// logger whose entries are tagged with the phase. End the phase by
+// calling End, typically in a defer.
+func WithPhase(logger *zap.Logger, name string) *Phase {
+	return newPhase(logger, logger, []string{name})
+}
+
+// WithPhase starts a phase nested within p. Entries logged with the
+// returned phase are tagged with the full path of the phase, such as
+// "import/thumbnailing".
+func (p *Phase) WithPhase(name string) *Phase {
+	return newPhase(p.base, p.Logger, append(p.path[:len(p.path):len(p.path)], name))
+}
+
+func newPhase(base, parent *zap.Logger, path []string) *Phase {
+	// derive from the base logger so nested phases don't repeat the phase field
+	return &Phase{
+		Logger: base.With(zap.String("phase", strings.Join(path, "/"))),
+		base:   base,
+		parent: parent,
+		path:   path,
+		start:  time.Now(),
+
+		startUsage: readResourceUsage(),
+	}
+}
+
+// AddItems counts n items as processed during the phase, for its cost.
+// It is safe for concurrent use.
+func (p *Phase) AddItems(n int) { p.items.Add(int64(n)) }
+
+// Name returns the full path of the phase.
+func (p *Phase) Name() string { return strings.Join(p.path, "/") }
+
+// End logs that the phase has ended and how long it took, along with
+// its cost, and returns the logger the phase was started from (the "pop"
+// to WithPhase's "push").
+func (p *Phase) End() *zap.Logger {
+	usage := readResourceUsage()
+	cost := phaseCost{
+		Duration:     time.Since(p.start),
+		Items:        p.items.Load(),
+		AllocBytes:   usage.allocBytes - p.startUsage.allocBytes,
+		AllocObjects: usage.allocObjects - p.startUsage.allocObjects,
+		CPUTime:      usage.cpuTime - p.startUsage.cpuTime,
+	}
+	p.Debug("phase ended", zap.Duration("duration", cost.Duration))
+
+	fields := []zap.Field{zap.String("phase", p.Name())}
+	if jobID := loggerJobID(p.base); jobID > 0 {
+		jobPhaseCosts.add(jobID, p.Name(), cost)
+		fields = append(fields, zap.Uint64("job_id", jobID))
+	}
+	eventLog.Named("perf.phase").Info("phase cost", append(fields, zap.Inline(cost))...)
+
+	return p.parent
+}
+
+// phaseCost is what a phase cost. The allocations and CPU time are
+// measured for the whole process, so they include the cost of any work
+// that was done concurrently, and are only approximately attributable
+// to the phase.
+type phaseCost struct {
+	Duration     time.Duration
+	Items        int64
+	AllocBytes   uint64
+	AllocObjects uint64
+	CPUTime      time.Duration
+}
+
+func (c phaseCost) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddDuration("duration", c.Duration)
+	enc.AddInt64("items", c.Items)
+	enc.AddUint64("alloc_bytes", c.AllocBytes)
+	enc.AddUint64("alloc_objects", c.AllocObjects)
+	enc.AddDuration("cpu_time", c.CPUTime)
+	return nil
+}
+
+// add returns the sum of the costs.
+func (c phaseCost) add(other phaseCost) phaseCost {
+	return phaseCost{
+		Duration:     c.Duration + other.Duration,
+		Items:        c.Items + other.Items,
+		AllocBytes:   c.AllocBytes + other.AllocBytes,
+		AllocObjects: c.AllocObjects + other.AllocObjects,
+		CPUTime:      c.CPUTime + other.CPUTime,
+	}
+}
+
+// phaseCosts are the costs of phases by name.
+type phaseCosts map[string]phaseCost
+
+func (pc phaseCosts) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for name, cost := range pc {
+		if err := enc.AddObject(name, cost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobPhaseCosts sums the costs of each job's phases by phase name.
+var jobPhaseCosts = &phaseCostTotals{jobs: make(map[uint64]phaseCosts)}
+
+type phaseCostTotals struct {
+	mu   sync.Mutex
+	jobs map[uint64]phaseCosts
+}
+
+func (t *phaseCostTotals) add(jobID uint64, phase string, cost phaseCost) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	costs, ok := t.jobs[jobID]
+	if !ok {
+		costs = make(phaseCosts)
+		t.jobs[jobID] = costs
+	}
+	costs[phase] = costs[phase].add(cost)
+}
+
+// take returns the costs of the job's phases, and forgets them.
+func (t *phaseCostTotals) take(jobID uint64) phaseCosts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	costs := t.jobs[jobID]
+	delete(t.jobs, jobID)
+	return costs
+}
+
+// resourceUsage is a reading of the cumulative resource usage of the
+// process, from the runtime's metrics (which, unlike runtime.MemStats,
+// can be read without stopping the world).
+type resourceUsage struct {
+	allocBytes, allocObjects uint64
+	cpuTime                  time.Duration
+}
+
+func readResourceUsage() resourceUsage {
+	samples := []metrics.Sample{
+		{Name: "/gc/heap/allocs:bytes"},
+		{Name: "/gc/heap/allocs:objects"},
+		{Name: "/cpu/classes/user:cpu-seconds"},
+	}
+	metrics.Read(samples)
+
+	var usage resourceUsage
+	if samples[0].Value.Kind() == metrics.KindUint64 {
+		usage.allocBytes = samples[0].Value.Uint64()
+	}
+	if samples[1].Value.Kind() == metrics.KindUint64 {
+		usage.allocObjects = samples[1].Value.Uint64()
+	}
+	if samples[2].Value.Kind() == metrics.KindFloat64 {
+		usage.cpuTime = time.Duration(samples[2].Value.Float64() * float64(time.Second))
+	}
+	return usage
+}
@@ -0,0 +1,61 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Pinned returns a logger derived from logger whose entries are pinned:
+// they have a "pinned" field set to true, so the UI can keep them in a
+// sticky area where they stay visible as the rest of the stream scrolls,
+// and they are never sampled. This is for milestones, not for routine
+// entries.
+//
+// Some entries are pinned by default (see pinnedByDefault): the status
+// updates for when a job starts running and when it ends, and the
+// outcomes of jobs (see LogNoop). Errors are not pinned by default,
+// since they can come in floods; the failure of a job is pinned as its
+// final status, though.
+func Pinned(logger *zap.Logger) *zap.Logger {
+	return logger.With(PinnedField)
+}
+
+// PinnedField pins the logger it is added to with With; see Pinned.
+var PinnedField = zap.Bool(pinnedKey, true)
+
+const pinnedKey = "pinned"
+
+// pinnedByDefault returns true if the entry is one of the milestones
+// that are pinned even if they were not logged as pinned.
+func pinnedByDefault(ent zapcore.Entry) bool {
+	switch ent.LoggerName {
+	case "job.status":
+		return ent.Message == "running" || isFinalJobState(ent.Message)
+	case "job.outcome":
+		return true
+	}
+	return false
+}
+
+// isPinnedField returns true if f pins the entry (see Pinned).
+func isPinnedField(f zapcore.Field) bool {
+	return f.Key == pinnedKey && f.Type == zapcore.BoolType && f.Integer == 1
+}
@@ -0,0 +1,63 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"io"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// AddPlainConsole adds an output that writes human-readable entries like
+// the console does, but without colors (ANSI escape codes), to w, for
+// entries at or above the given level. It's meant for embedding the
+// application in another one that shows the logs in its own view, such
+// as a terminal UI, where writing to stderr would interfere. The primary
+// console is not affected; it can be redirected or silenced separately
+// (see SetConsoleWriter and SetOutputLevels). The writer does not need
+// to be safe for concurrent use. Any number of plain consoles may be
+// added; each is removed by calling the returned function, after which
+// nothing more is written to w.
+func AddPlainConsole(w io.Writer, level zapcore.Level) (remove func()) {
+	return addLogSink(&plainConsole{
+		out:   zapcore.Lock(zapcore.AddSync(w)),
+		level: level,
+		enc:   newConsoleEncoderWithLevels(zapcore.CapitalLevelEncoder),
+	})
+}
+
+type plainConsole struct {
+	out   zapcore.WriteSyncer
+	level zapcore.Level
+	enc   zapcore.Encoder
+}
+
+func (pc *plainConsole) Enabled(level zapcore.Level) bool { return pc.level.Enabled(level) }
+
+func (pc *plainConsole) writeEntry(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := pc.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	_, err = pc.out.Write(buf.Bytes())
+	buf.Free()
+	return err
+}
+
+func (pc *plainConsole) Sync() error { return pc.out.Sync() }
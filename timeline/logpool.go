@@ -0,0 +1,122 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ObserveWorkerPool records the current state of the worker pool with the
+// given name: how many workers are active, how many tasks are queued
+// (waiting for a worker), and the size of the pool. Call it whenever the
+// state changes. Periodically, a summary of each pool that was observed
+// during the interval is logged under the "pool" logger (never sampled),
+// including its current state and its peak and average usage, so users
+// can tell whether more parallelism would help: a pool that is always
+// fully active with tasks queued is a bottleneck. The current state is
+// also available as a metric (see MetricsSnapshot).
+func ObserveWorkerPool(name string, active, queued, size int) {
+	workerPools.observe(name, active, queued, size)
+	workerPoolMetric.set(float64(active), name, "active")
+	workerPoolMetric.set(float64(queued), name, "queued")
+	workerPoolMetric.set(float64(size), name, "size")
+}
+
+// SetPoolReportInterval sets how often the worker pool summary is logged
+// (see ObserveWorkerPool). It takes effect after the current interval.
+// If d is not positive, a default interval is used.
+func SetPoolReportInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultPoolReportInterval
+	}
+	poolReportInterval.Store(int64(d))
+}
+
+var poolReportInterval = func() *atomic.Int64 {
+	var d atomic.Int64
+	d.Store(int64(defaultPoolReportInterval))
+	return &d
+}()
+
+var workerPools = &poolAggregator{pools: make(map[string]*poolWindow)}
+
+// poolAggregator collects the states of each worker pool for each interval.
+type poolAggregator struct {
+	mu      sync.Mutex
+	pools   map[string]*poolWindow
+	started sync.Once
+}
+
+// poolWindow is the observed states of one pool during an interval.
+type poolWindow struct {
+	active, queued, size  int // as of the latest observation
+	peakActive, peakQueue int
+	observations          int
+	utilization           float64 // sum of active/size of each observation
+}
+
+func (pa *poolAggregator) observe(name string, active, queued, size int) {
+	pa.started.Do(func() { go pa.run() })
+
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	w, ok := pa.pools[name]
+	if !ok {
+		w = new(poolWindow)
+		pa.pools[name] = w
+	}
+	w.active, w.queued, w.size = active, queued, size
+	w.peakActive = max(w.peakActive, active)
+	w.peakQueue = max(w.peakQueue, queued)
+	w.observations++
+	if size > 0 {
+		w.utilization += float64(active) / float64(size)
+	}
+}
+
+func (pa *poolAggregator) run() {
+	logger := Log.Named("pool")
+	for {
+		time.Sleep(time.Duration(poolReportInterval.Load()))
+
+		pa.mu.Lock()
+		pools := pa.pools
+		pa.pools = make(map[string]*poolWindow, len(pools))
+		pa.mu.Unlock()
+
+		for name, w := range pools {
+			logger.Info("worker pool",
+				zap.String("name", name),
+				zap.Int("size", w.size),
+				zap.Int("active", w.active),
+				zap.Int("idle", max(w.size-w.active, 0)),
+				zap.Int("queued", w.queued),
+				zap.Int("peak_active", w.peakActive),
+				zap.Int("peak_queued", w.peakQueue),
+				zap.Float64("avg_utilization", w.utilization/float64(w.observations)),
+				zap.Int("observations", w.observations))
+		}
+	}
+}
+
+const defaultPoolReportInterval = 30 * time.Second
@@ -0,0 +1,197 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"errors"
+	"maps"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogPool is a set of log subscribers with its own filter, history, and
+// delivery state, so that each surface of the UI (such as a job panel,
+// a debug console, or notifications) can have a stream that is built
+// for its purpose, instead of all of them sharing one set of subscribers
+// with a filter for each. Every entry sent to the UI output (see
+// SetOutputLevels) is fanned out to every pool whose filter allows it.
+// The pool named "" is the default pool, to which the package-level
+// functions like AddLogConn subscribe connections.
+type LogPool struct {
+	name   string
+	mw     *multiConnWriter
+	filter atomic.Pointer[subscriptionFilter]
+}
+
+// Pool returns the pool with the given name, creating it if it doesn't
+// exist yet. Pools live for the life of the process, so they should be
+// created for fixed purposes, not for each connection.
+func Pool(name string) *LogPool {
+	if pool := LookupPool(name); pool != nil {
+		return pool
+	}
+	logPools.Lock()
+	defer logPools.Unlock()
+	pools := logPools.load()
+	if pool, ok := pools[name]; ok {
+		return pool // created while we were waiting for the lock
+	}
+	pool := &LogPool{name: name, mw: new(multiConnWriter)}
+	updated := maps.Clone(pools)
+	if updated == nil {
+		updated = make(map[string]*LogPool)
+	}
+	updated[name] = pool
+	logPools.named.Store(&updated)
+	return pool
+}
+
+// LookupPool returns the pool with the given name, or nil if it has not
+// been created with Pool. This is useful for letting clients choose a
+// pool without letting them create new ones.
+func LookupPool(name string) *LogPool {
+	if name == "" {
+		return defaultLogPool
+	}
+	return logPools.load()[name]
+}
+
+// logPools is the registry of the named pools.
+var logPools logPoolRegistry
+
+// logPoolRegistry holds the named pools in a map that is replaced
+// whenever a pool is added, so that writers can load it without
+// locking; changes to it are serialized by the mutex.
+type logPoolRegistry struct {
+	sync.Mutex
+	named atomic.Pointer[map[string]*LogPool]
+}
+
+// load returns the named pools.
+func (r *logPoolRegistry) load() map[string]*LogPool {
+	if pools := r.named.Load(); pools != nil {
+		return *pools
+	}
+	return nil
+}
+
+// writers returns the subscriber writers of the default pool and of
+// every named pool.
+func (r *logPoolRegistry) writers() []*multiConnWriter {
+	named := r.load()
+	writers := make([]*multiConnWriter, 0, 1+len(named))
+	writers = append(writers, websocketLogOutputs)
+	for _, pool := range named {
+		writers = append(writers, pool.mw)
+	}
+	return writers
+}
+
+// logSubscriberCount returns the number of subscribers in all the pools.
+func logSubscriberCount() int {
+	var n int
+	for _, mw := range logPools.writers() {
+		n += mw.subscriberCount()
+	}
+	return n
+}
+
+var defaultLogPool = &LogPool{mw: websocketLogOutputs}
+
+// Name returns the name of the pool.
+func (p *LogPool) Name() string { return p.name }
+
+// SetFilter sets which entries are sent to the pool: only those at
+// levels enabled by minLevel (if not nil), from loggers that match at
+// least one of the patterns (if any; see AddLogConnFiltered). The
+// filter of each subscriber applies on top of it. The default filter
+// allows all entries. An error is returned if a pattern is invalid.
+func (p *LogPool) SetFilter(minLevel zapcore.LevelEnabler, patterns ...string) error {
+	if p == defaultLogPool {
+		return errDefaultPoolFilter
+	}
+	loggers, err := parseLoggerFilter(patterns)
+	if err != nil {
+		return err
+	}
+	p.filter.Store(&subscriptionFilter{loggers: loggers, minLevel: minLevel})
+	return nil
+}
+
+// errDefaultPoolFilter is returned when setting the filter of the
+// default pool, whose subscribers expect all entries.
+var errDefaultPoolFilter = errors.New("the default log pool cannot be filtered")
+
+// SetHistorySize is like SetLogHistorySize, but for the pool.
+func (p *LogPool) SetHistorySize(size int) {
+	prev := p.mw.history.resize(size)
+	logConfigChange("log_pool_history_size."+p.name, prev, max(size, 0))
+}
+
+// AddConn is like AddLogConn, but subscribes conn to the pool.
+func (p *LogPool) AddConn(conn *websocket.Conn) error {
+	return addLogConnReplaying(p.mw, conn, subscriptionFilter{}, 0, 0)
+}
+
+// AddConnFollow is like AddLogConnFollow, but subscribes conn to the pool.
+func (p *LogPool) AddConnFollow(conn *websocket.Conn, opts FollowOptions) error {
+	return addLogConnFollow(p.mw, conn, opts)
+}
+
+// RemoveConn removes a conn that was added to the pool.
+func (p *LogPool) RemoveConn(conn *websocket.Conn) { p.mw.RemoveConn(conn) }
+
+// Subscribers returns information about each subscriber of the pool.
+func (p *LogPool) Subscribers() []LogSubscriberInfo { return p.mw.subscribers() }
+
+// allows returns true if the pool's filter allows msg.
+func (p *LogPool) allows(msg logMessage) bool {
+	filter := p.filter.Load()
+	return filter == nil || filter.allows(msg)
+}
+
+// logPoolFanout is the output of the UI core, which writes each entry to
+// the default pool and to every named pool that allows it.
+type logPoolFanout struct{}
+
+func (logPoolFanout) writeEntry(ent zapcore.Entry, meta entryMeta, p []byte) error {
+	err := websocketLogOutputs.writeEntry(ent, meta, p)
+	pools := logPools.load()
+	if len(pools) == 0 {
+		return err
+	}
+	msg := logMessage{logger: ent.LoggerName, level: ent.Level, time: ent.Time, entryMeta: meta}
+	for _, pool := range pools {
+		if pool.allows(msg) {
+			err = errors.Join(err, pool.mw.writeEntry(ent, meta, p))
+		}
+	}
+	return err
+}
+
+func (logPoolFanout) Sync() error {
+	err := websocketLogOutputs.Sync()
+	for _, pool := range logPools.load() {
+		err = errors.Join(err, pool.mw.Sync())
+	}
+	return err
+}
@@ -0,0 +1,207 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// SetCLIProgress sets whether job progress is shown on the console as a
+// live progress bar, rather than as scrolling log lines. This is useful
+// when running headless without the UI. The bar is drawn at the bottom
+// of the console, below regular log lines, and is redrawn after each
+// one. It is only enabled if the console is writing to a terminal.
+func SetCLIProgress(enable bool) {
+	if enable && !console.isTerminal() {
+		return
+	}
+	wasEnabled := cliProgress.Swap(enable)
+	if wasEnabled && !enable {
+		cliProgressBar.reset(console) // clear the bar
+	}
+	logConfigChange("cli_progress", wasEnabled, enable)
+}
+
+var cliProgress atomic.Bool
+
+// cliProgressCore wraps the console core so that, when the CLI progress
+// bar is enabled, job progress updates are drawn on the bar instead of
+// being written as log lines. These are the same progress entries that
+// the UI consumes.
+type cliProgressCore struct {
+	zapcore.Core
+
+	// the job the logger is for, from the "id" field, and
+	// whether the job has ended (its logger has an "ended" field)
+	jobID uint64
+	ended bool
+}
+
+func (c *cliProgressCore) With(fields []zapcore.Field) zapcore.Core {
+	derived := &cliProgressCore{
+		Core:  c.Core.With(fields),
+		jobID: c.jobID,
+		ended: c.ended,
+	}
+	for _, f := range fields {
+		switch f.Key {
+		case "id":
+			derived.jobID, _ = uint64Field(f)
+		case "ended":
+			derived.ended = true
+		}
+	}
+	return derived
+}
+
+func (c *cliProgressCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if cliProgress.Load() && c.jobID > 0 && ent.LoggerName == "job.status" && ent.Message == "progress" {
+		if c.Enabled(ent.Level) {
+			return ce.AddCore(ent, c)
+		}
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+func (c *cliProgressCore) Write(_ zapcore.Entry, fields []zapcore.Field) error {
+	jp := cliJobProgress{id: c.jobID}
+	for _, f := range fields {
+		switch f.Key {
+		case "progress":
+			if f.Type == zapcore.Int64Type {
+				jp.progress = int(f.Integer)
+			}
+		case "total":
+			if f.Type == zapcore.Int64Type {
+				jp.total = int(f.Integer)
+			}
+		case "message":
+			if f.Type == zapcore.StringType {
+				jp.message = f.String
+			}
+		}
+	}
+	cliProgressBar.update(console, jp, c.ended)
+	return nil
+}
+
+// cliJobProgress is the progress of one job, as shown on the bar.
+type cliJobProgress struct {
+	id              uint64
+	progress, total int
+	message         string
+}
+
+// progressBar is the state of the CLI progress bar. It shows the job
+// that was most recently updated, and how many other jobs are active.
+type progressBar struct {
+	mu    sync.Mutex
+	jobs  []cliJobProgress // in order of most recent update last
+	drawn string           // the line currently on the screen, if any
+}
+
+var cliProgressBar = new(progressBar)
+
+// writeAbove writes p, which is a complete log line, to cs, then redraws the bar.
+func (pb *progressBar) writeAbove(cs *consoleSink, p []byte) (int, error) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if pb.drawn == "" {
+		return cs.write(p)
+	}
+	buf := make([]byte, 0, len(clearLine)+len(p)+len(pb.drawn))
+	buf = append(buf, clearLine...)
+	buf = append(buf, p...)
+	buf = append(buf, pb.drawn...)
+	if _, err := cs.write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (pb *progressBar) update(cs *consoleSink, jp cliJobProgress, ended bool) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.jobs = slices.DeleteFunc(pb.jobs, func(other cliJobProgress) bool { return other.id == jp.id })
+	if !ended {
+		pb.jobs = append(pb.jobs, jp)
+	}
+	pb.redraw(cs)
+}
+
+func (pb *progressBar) reset(cs *consoleSink) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.jobs = nil
+	pb.redraw(cs)
+}
+
+func (pb *progressBar) redraw(cs *consoleSink) {
+	line := pb.render()
+	if line == pb.drawn {
+		return
+	}
+	_, _ = cs.write([]byte(clearLine + line))
+	pb.drawn = line
+}
+
+// render returns the bar for the most recently updated job,
+// or an empty string if there are no active jobs.
+func (pb *progressBar) render() string {
+	if len(pb.jobs) == 0 {
+		return ""
+	}
+	jp := pb.jobs[len(pb.jobs)-1]
+
+	var sb strings.Builder
+	if jp.total > 0 {
+		filled := min(cliProgressBarWidth*jp.progress/jp.total, cliProgressBarWidth)
+		sb.WriteString("[" + strings.Repeat("=", filled) + strings.Repeat(" ", cliProgressBarWidth-filled) + "]")
+		fmt.Fprintf(&sb, " %3d%% %d/%d", min(100*jp.progress/jp.total, 100), jp.progress, jp.total) //nolint:mnd
+	} else {
+		fmt.Fprintf(&sb, "[job %d] %d", jp.id, jp.progress)
+	}
+	if jp.message != "" {
+		msg := []rune(jp.message)
+		if len(msg) > cliProgressMaxMessageLen {
+			// a line that wraps can't be cleared with a carriage return
+			msg = append(msg[:cliProgressMaxMessageLen-1], '…')
+		}
+		sb.WriteString(" " + string(msg))
+	}
+	if others := len(pb.jobs) - 1; others > 0 {
+		fmt.Fprintf(&sb, " (+%d more)", others)
+	}
+	return sb.String()
+}
+
+// clearLine returns the cursor to the start of the line and clears it.
+const clearLine = "\r\x1b[K"
+
+const (
+	cliProgressBarWidth      = 30
+	cliProgressMaxMessageLen = 50
+)
@@ -0,0 +1,225 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// LogQuery selects entries from the log file for QueryLogs. An entry
+// must match all of the criteria that are set.
+type LogQuery struct {
+	// Only entries logged within this time range are returned. A zero
+	// Since or Until leaves that end of the range unbounded.
+	Since time.Time `json:"since,omitempty"`
+	Until time.Time `json:"until,omitempty"`
+
+	// If set, only entries at or above this level are returned;
+	// otherwise, entries at all levels are.
+	Level *zapcore.Level `json:"level,omitempty"`
+
+	// If set, only entries from loggers that match this pattern are
+	// returned; see AddLogConnFiltered.
+	Logger string `json:"logger,omitempty"`
+
+	// If nonzero, only entries for this job are returned: those with
+	// a "job_id" field, or a job logger's "id" field, with this value.
+	JobID uint64 `json:"job_id,omitempty"`
+
+	// Only the most recent Limit matching entries are returned. If it
+	// is not positive, DefaultLogQueryLimit is used, so that a query
+	// that matches much of a large log file doesn't buffer all of it.
+	Limit int `json:"limit,omitempty"`
+}
+
+// DefaultLogQueryLimit is the maximum number of entries QueryLogs returns
+// if the query doesn't have a limit.
+const DefaultLogQueryLimit = 1000
+
+// QueryLogs returns the entries in the log file (see SetLogFile),
+// including the files it was rotated to, that match q, oldest first.
+// Since the log file persists across restarts, this can be used to
+// look into problems that happened before the process was restarted,
+// such as a failed overnight import, unlike the log history (see
+// ExportLogsFiltered), which is only in memory. Each entry is a line
+// of JSON, as it was written to the file; entries written with either
+// JSON schema (see SetJSONSchema) can be queried. Lines that can't be
+// parsed, such as one that was cut off by a crash, are skipped.
+//
+// The log file is the log store, so it is opt-in: there is nothing to
+// query until SetLogFile is called with a path (in the app, by setting
+// log_file in the config). Until then, ErrNoLogFile is returned.
+func QueryLogs(ctx context.Context, q LogQuery) ([]json.RawMessage, error) {
+	set := logFileOutput.Load()
+	if set == nil {
+		return nil, ErrNoLogFile
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultLogQueryLimit
+	}
+	var loggers loggerFilter
+	if q.Logger != "" {
+		var err error
+		if loggers, err = parseLoggerFilter([]string{q.Logger}); err != nil {
+			return nil, err
+		}
+	}
+	rotated, err := rotatedLogFiles(set.path)
+	if err != nil {
+		return nil, fmt.Errorf("listing rotated log files: %w", err)
+	}
+
+	// read the oldest file first, so entries are in order
+	paths := []string{set.path}
+	for _, file := range rotated {
+		paths = append(paths, file.path)
+	}
+	slices.Reverse(paths)
+
+	match := func(line []byte) bool {
+		var ent storedLogEntry
+		if err := json.Unmarshal(line, &ent); err != nil {
+			return false
+		}
+		ts, level, logger := ent.metadata()
+		return (q.Level == nil || level >= *q.Level) &&
+			(q.Since.IsZero() || !ts.Before(q.Since)) &&
+			(q.Until.IsZero() || ts.Before(q.Until)) &&
+			loggers.allows(logger) &&
+			(q.JobID == 0 || string(ent.jobID(logger)) == strconv.FormatUint(q.JobID, 10))
+	}
+
+	// results is a ring buffer of the most recent entries once
+	// it is full, and oldest is its oldest entry
+	var results []json.RawMessage
+	var oldest int
+	for _, path := range paths {
+		err := scanLogFile(ctx, path, func(line []byte) {
+			if !match(line) {
+				return
+			}
+			ent := json.RawMessage(bytes.Clone(line))
+			if len(results) == q.Limit {
+				results[oldest] = ent
+				oldest = (oldest + 1) % q.Limit
+				return
+			}
+			results = append(results, ent)
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue // probably pruned after rotation in the meantime
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return slices.Concat(results[oldest:], results[:oldest]), nil
+}
+
+// ErrNoLogFile is returned by QueryLogs when the file output, which is
+// where the logs it queries are stored, is disabled.
+var ErrNoLogFile = errors.New("log store not enabled: no log file is configured")
+
+// scanLogFile calls fn with each line of the file at path, without the
+// line ending. The line is only valid during the call.
+func scanLogFile(ctx context.Context, path string, fn func([]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for i := 0; ; i++ {
+		if i%logQueryCancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		line, err := r.ReadBytes('\n')
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+			fn(line)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading log file %s: %w", path, err)
+		}
+	}
+}
+
+// storedLogEntry is the entry metadata that QueryLogs needs from a line
+// in the log file, in either JSON schema.
+type storedLogEntry struct {
+	// native schema
+	TS     float64 `json:"ts"`
+	Level  string  `json:"level"`
+	Logger string  `json:"logger"`
+
+	// ECS
+	Timestamp time.Time `json:"@timestamp"`
+	Log       struct {
+		Level  string `json:"level"`
+		Logger string `json:"logger"`
+	} `json:"log"`
+
+	// kept raw, since they're compared as strings and the
+	// fields could be anything in an entry that isn't a job's
+	JobID json.RawMessage `json:"job_id"`
+	ID    json.RawMessage `json:"id"`
+}
+
+// jobID returns the raw ID of the job the entry is for, if any. Like
+// newEntryMeta, it is the "job_id" field, or the "id" field if the
+// entry is from a job logger.
+func (e storedLogEntry) jobID(logger string) json.RawMessage {
+	if len(e.JobID) == 0 && strings.HasPrefix(logger, "job") {
+		return e.ID
+	}
+	return e.JobID
+}
+
+// metadata returns the time, level, and logger name of the entry.
+func (e storedLogEntry) metadata() (time.Time, zapcore.Level, string) {
+	if !e.Timestamp.IsZero() {
+		level, _ := zapcore.ParseLevel(e.Log.Level)
+		return e.Timestamp, level, e.Log.Logger
+	}
+	sec, frac := math.Modf(e.TS)
+	level, _ := zapcore.ParseLevel(e.Level)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), level, e.Logger
+}
+
+// how many lines to read between checks for cancellation
+const logQueryCancelCheckInterval = 1000
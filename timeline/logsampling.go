@@ -0,0 +1,379 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// SetConsistentSampling sets whether a single sampling decision is made
+// for each entry and applied to all outputs (console, UI, etc.), so that
+// every output has exactly the same set of entries. By default, each
+// output is sampled independently, so an entry that is sampled out of
+// one output may still appear in another; this is confusing when
+// comparing the console with the UI. The tradeoff is that outputs lose
+// their sampling independence: the console, for example, drops exactly
+// the entries that are sampled out of the UI stream, even if it would
+// have kept them on its own. Entries that are never sampled (such as
+// job status updates) are unaffected either way.
+func SetConsistentSampling(consistent bool) {
+	logConfigChange("consistent_sampling", consistentSampling.Swap(consistent), consistent)
+}
+
+var consistentSampling atomic.Bool
+
+// SamplingConfig customizes how log entries are sampled (see
+// SetSamplingConfig). Zero values leave the defaults in place.
+type SamplingConfig struct {
+	// Names of loggers whose entries are never sampled, in addition
+	// to the built-in ones that keep the UI in sync (like "job.status").
+	UnsampledLoggers []string
+
+	// Entries to sample as live progress, in addition to the built-in
+	// ones (like "finished graph" from "job.action"): the sampler for
+	// them is more lenient, so progress bars stay in sync, and their
+	// rate is throttled adaptively instead.
+	LiveProgress []LogMessageRoute
+
+	// The sampling interval for most entries, in which only the first
+	// entry with each message is let through.
+	Interval time.Duration
+
+	// The sampling interval for live progress entries, and how many
+	// entries with each message are let through in it.
+	LiveProgressInterval time.Duration
+	LiveProgressCount    int
+}
+
+// LogMessageRoute identifies entries by logger name and message.
+type LogMessageRoute struct {
+	Logger  string
+	Message string
+}
+
+// SetSamplingConfig customizes how log entries are sampled, so that new
+// kinds of high-frequency entries (such as the progress of a long-running
+// processor) can be kept from being sampled as aggressively as the rest.
+// It applies to Log and all of its derivatives, including those created
+// before it was called, and can be called again to change the config;
+// the zero value restores the default sampling. Changing the intervals
+// starts the samplers over, so they let through more entries at first.
+func SetSamplingConfig(cfg SamplingConfig) {
+	var next *activeSamplingConfig
+	if !cfg.isZero() {
+		next = newActiveSamplingConfig(cfg)
+	}
+	logConfigChange("sampling", samplingConfig.Swap(next).config(), next.config())
+}
+
+func (cfg SamplingConfig) isZero() bool {
+	return len(cfg.UnsampledLoggers) == 0 && len(cfg.LiveProgress) == 0 &&
+		cfg.Interval == 0 && cfg.LiveProgressInterval == 0 && cfg.LiveProgressCount == 0
+}
+
+// samplingConfig is the active sampling config, or nil for the defaults.
+var samplingConfig atomic.Pointer[activeSamplingConfig]
+
+// activeSamplingConfig is a SamplingConfig that is in effect, with the
+// defaults filled in.
+type activeSamplingConfig struct {
+	SamplingConfig
+	unsampled    map[string]struct{}
+	liveProgress map[LogMessageRoute]struct{}
+}
+
+// config returns the config, or the zero value if a is nil.
+func (a *activeSamplingConfig) config() SamplingConfig {
+	if a == nil {
+		return SamplingConfig{}
+	}
+	return a.SamplingConfig
+}
+
+func newActiveSamplingConfig(cfg SamplingConfig) *activeSamplingConfig {
+	active := &activeSamplingConfig{
+		SamplingConfig: cfg,
+		unsampled:      make(map[string]struct{}, len(cfg.UnsampledLoggers)),
+		liveProgress:   make(map[LogMessageRoute]struct{}, len(cfg.LiveProgress)),
+	}
+	for _, name := range cfg.UnsampledLoggers {
+		active.unsampled[name] = struct{}{}
+	}
+	for _, route := range cfg.LiveProgress {
+		active.liveProgress[route] = struct{}{}
+	}
+	if active.Interval <= 0 {
+		active.Interval = sampledLogInterval
+	}
+	if active.LiveProgressInterval <= 0 {
+		active.LiveProgressInterval = sampledLiveJobProgressInterval
+	}
+	if active.LiveProgressCount <= 0 {
+		active.LiveProgressCount = sampledLiveJobProgressCount
+	}
+	return active
+}
+
+// samplerSet is a set of samplers like those of a customCore.
+type samplerSet struct {
+	config                                  *activeSamplingConfig
+	sampled, liveJobProgress                zapcore.Core
+	perOutputSampled, perOutputLiveProgress zapcore.Core
+}
+
+func (s *samplerSet) with(fields []zapcore.Field) *samplerSet {
+	return &samplerSet{
+		config:                s.config,
+		sampled:               s.sampled.With(fields),
+		liveJobProgress:       s.liveJobProgress.With(fields),
+		perOutputSampled:      s.perOutputSampled.With(fields),
+		perOutputLiveProgress: s.perOutputLiveProgress.With(fields),
+	}
+}
+
+// configurableSampling builds the samplers of a customCore and its
+// derivatives for the active sampling config (see SetSamplingConfig).
+// The samplers for a config are built from the outputs once, and each
+// derivative adds its fields to them, so that they share their counts,
+// just like derivatives of the default samplers do.
+type configurableSampling struct {
+	outputs []zapcore.Core
+	base    atomic.Pointer[samplerSet]
+}
+
+// samplers returns the samplers for cfg, without any fields.
+func (cs *configurableSampling) samplers(cfg *activeSamplingConfig) *samplerSet {
+	prev := cs.base.Load()
+	if prev != nil && prev.config == cfg {
+		return prev
+	}
+	core := zapcore.NewTee(cs.outputs...)
+	perOutputSampled := make([]zapcore.Core, 0, len(cs.outputs))
+	perOutputLiveProgress := make([]zapcore.Core, 0, len(cs.outputs))
+	for _, out := range cs.outputs {
+		perOutputSampled = append(perOutputSampled, newSampler(out, cfg.Interval, 1, countSamplingDecision))
+		perOutputLiveProgress = append(perOutputLiveProgress,
+			newSampler(out, cfg.LiveProgressInterval, cfg.LiveProgressCount, countLiveProgressSamplingDecision))
+	}
+	base := &samplerSet{
+		config:                cfg,
+		sampled:               newSampler(core, cfg.Interval, 1, countSamplingDecision),
+		liveJobProgress:       newSampler(core, cfg.LiveProgressInterval, cfg.LiveProgressCount, countLiveProgressSamplingDecision),
+		perOutputSampled:      zapcore.NewTee(perOutputSampled...),
+		perOutputLiveProgress: zapcore.NewTee(perOutputLiveProgress...),
+	}
+	// if another goroutine built them at the same time, use theirs,
+	// so that there is only one set of counts
+	if !cs.base.CompareAndSwap(prev, base) {
+		if current := cs.base.Load(); current != nil && current.config == cfg {
+			return current
+		}
+	}
+	return base
+}
+
+// configuredSamplers returns c's samplers for cfg, or nil if c can't
+// be configured (because it wasn't made by newCustomCore).
+func (c *customCore) configuredSamplers(cfg *activeSamplingConfig) *samplerSet {
+	if c.sampling == nil {
+		return nil
+	}
+	if cached := c.configured.Load(); cached != nil && cached.config == cfg {
+		return cached
+	}
+	s := c.sampling.samplers(cfg).with(c.fields)
+	c.configured.Store(s)
+	return s
+}
+
+// newSampledCore returns core wrapped with the sampler for most entries.
+func newSampledCore(core zapcore.Core) zapcore.Core {
+	return newSampler(core, sampledLogInterval, 1, countSamplingDecision)
+}
+
+// newLiveJobProgressCore returns core wrapped with the sampler for live
+// job progress entries, which is more lenient so the UI stays lively.
+func newLiveJobProgressCore(core zapcore.Core) zapcore.Core {
+	return newSampler(core, sampledLiveJobProgressInterval, sampledLiveJobProgressCount, countLiveProgressSamplingDecision)
+}
+
+// newSampler returns core wrapped with a sampler that lets through the
+// first entries with each message in each interval, whose decisions are
+// passed to hook.
+func newSampler(core zapcore.Core, interval time.Duration, first int, hook func(zapcore.Entry, zapcore.SamplingDecision)) zapcore.Core {
+	return zapcore.NewSamplerWithOptions(core, interval, first, 0, zapcore.SamplerHook(hook))
+}
+
+// indeterminateProgressThrottle is the throttle for indeterminate progress
+// entries (see LogProgress), keyed by job.
+var indeterminateProgressThrottle = &intervalThrottle{
+	interval: indeterminateProgressInterval,
+	last:     make(map[uint64]time.Time),
+}
+
+// mediaProgressThrottle is the throttle for media pipeline progress
+// entries (see LogMediaProgress), keyed by job.
+var mediaProgressThrottle = &intervalThrottle{
+	interval: indeterminateProgressInterval,
+	last:     make(map[uint64]time.Time),
+}
+
+// fileProgressThrottle is the adaptive sampler for file progress entries
+// (see LogFileProgress), keyed by job and file rather than by message.
+var fileProgressThrottle = newAdaptiveSampler(sampledLiveJobProgressInterval,
+	adaptiveProgressMaxInterval, adaptiveProgressRateThreshold)
+
+// paginationThrottle is the adaptive sampler for pagination entries
+// (see LogPagination), keyed by data source.
+var paginationThrottle = newAdaptiveSampler(sampledLiveJobProgressInterval,
+	adaptiveProgressMaxInterval, adaptiveProgressRateThreshold)
+
+// intervalThrottle allows at most one entry per key in each interval.
+type intervalThrottle struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[uint64]time.Time // when an entry was last allowed, by key
+}
+
+func (t *intervalThrottle) allow(key uint64, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.last[key]; ok && now.Sub(last) < t.interval {
+		return false
+	}
+	if len(t.last) >= maxThrottleKeys {
+		for k, last := range t.last {
+			if now.Sub(last) >= t.interval {
+				delete(t.last, k)
+			}
+		}
+	}
+	t.last[key] = now
+	return true
+}
+
+const (
+	indeterminateProgressInterval = 500 * time.Millisecond
+	maxThrottleKeys               = 1000
+)
+
+// adaptiveSampler throttles high-frequency progress messages by
+// adjusting a per-message interval according to the rate at which
+// the message is being logged. While the rate is below the threshold,
+// the sampler allows everything through (leaving the regular live
+// progress sampler to do its job); once the rate exceeds it, the
+// interval doubles each window (up to a max) and only one entry is
+// allowed per interval. The interval relaxes as the rate drops. The
+// goal is smooth UI updates regardless of how fast a phase is going.
+type adaptiveSampler struct {
+	base, max     time.Duration
+	rateThreshold float64 // entries per second
+
+	mu       sync.Mutex
+	messages map[string]*adaptiveState
+}
+
+type adaptiveState struct {
+	interval    time.Duration
+	windowStart time.Time
+	windowCount int
+	lastAllowed time.Time
+}
+
+func newAdaptiveSampler(base, maxInterval time.Duration, rateThreshold float64) *adaptiveSampler {
+	return &adaptiveSampler{
+		base:          base,
+		max:           maxInterval,
+		rateThreshold: rateThreshold,
+		messages:      make(map[string]*adaptiveState),
+	}
+}
+
+// allow returns true if an entry with the given message, logged at
+// time now, should be allowed through.
+func (s *adaptiveSampler) allow(msg string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.messages[msg]
+	if !ok {
+		if len(s.messages) >= maxThrottleKeys {
+			// keys that aren't messages, like files, may never be forgotten
+			for k, st := range s.messages {
+				if now.Sub(st.windowStart) >= adaptiveSamplerIdle {
+					delete(s.messages, k)
+				}
+			}
+		}
+		st = &adaptiveState{interval: s.base, windowStart: now}
+		s.messages[msg] = st
+	}
+	st.windowCount++
+
+	// at the end of each window, adjust the interval based on the observed rate
+	if elapsed := now.Sub(st.windowStart); elapsed >= adaptiveSamplerWindow {
+		rate := float64(st.windowCount) / elapsed.Seconds()
+		switch {
+		case rate > s.rateThreshold:
+			st.interval = min(st.interval*2, s.max)
+		case rate < s.rateThreshold/2:
+			st.interval = max(st.interval/2, s.base)
+		}
+		st.windowStart, st.windowCount = now, 0
+	}
+
+	if st.interval <= s.base {
+		return true
+	}
+	if now.Sub(st.lastAllowed) < st.interval {
+		return false
+	}
+	st.lastAllowed = now
+	return true
+}
+
+// forget releases the state for msg, once no more entries with it are expected.
+func (s *adaptiveSampler) forget(msg string) {
+	s.mu.Lock()
+	delete(s.messages, msg)
+	s.mu.Unlock()
+}
+
+// intervals returns the current interval for each message.
+func (s *adaptiveSampler) intervals() map[string]time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]time.Duration, len(s.messages))
+	for msg, st := range s.messages {
+		m[msg] = st.interval
+	}
+	return m
+}
+
+const (
+	adaptiveSamplerWindow         = time.Second
+	adaptiveSamplerIdle           = time.Minute
+	adaptiveProgressMaxInterval   = 2 * time.Second
+	adaptiveProgressRateThreshold = 40 // entries per second
+)
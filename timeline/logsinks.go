@@ -0,0 +1,129 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// logSink is an additional output of the process log that can be added
+// and removed at runtime, such as a plain console (see AddPlainConsole).
+// It must be safe for concurrent use.
+type logSink interface {
+	zapcore.LevelEnabler
+	writeEntry(ent zapcore.Entry, fields []zapcore.Field) error
+	Sync() error
+}
+
+// addLogSink adds sink to the outputs of the process log. The returned
+// function removes it; it is idempotent.
+func addLogSink(sink logSink) (remove func()) {
+	logSinks.Lock()
+	var sinks []logSink
+	if current := logSinks.list.Load(); current != nil {
+		sinks = slices.Clone(*current)
+	}
+	sinks = append(sinks, sink)
+	logSinks.list.Store(&sinks)
+	logSinks.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			logSinks.Lock()
+			defer logSinks.Unlock()
+			sinks := slices.DeleteFunc(slices.Clone(*logSinks.list.Load()), func(other logSink) bool {
+				return other == sink
+			})
+			if len(sinks) == 0 {
+				logSinks.list.Store(nil)
+			} else {
+				logSinks.list.Store(&sinks)
+			}
+		})
+	}
+}
+
+// logSinks is the list of added sinks. It is copied on write, so that
+// writing entries doesn't require locking.
+var logSinks struct {
+	sync.Mutex
+	list atomic.Pointer[[]logSink]
+}
+
+// sinksCore writes entries to the added sinks, if any.
+type sinksCore struct {
+	fields []zapcore.Field
+}
+
+func (c *sinksCore) Enabled(level zapcore.Level) bool {
+	sinks := logSinks.list.Load()
+	if sinks == nil {
+		return false
+	}
+	for _, sink := range *sinks {
+		if sink.Enabled(level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *sinksCore) With(fields []zapcore.Field) zapcore.Core {
+	return &sinksCore{fields: slices.Concat(c.fields, fields)}
+}
+
+func (c *sinksCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *sinksCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	sinks := logSinks.list.Load()
+	if sinks == nil {
+		return nil
+	}
+	fields = slices.Concat(c.fields, fields)
+	var errs []error
+	for _, sink := range *sinks {
+		if sink.Enabled(ent.Level) {
+			errs = append(errs, sink.writeEntry(ent, fields))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *sinksCore) Sync() error {
+	sinks := logSinks.list.Load()
+	if sinks == nil {
+		return nil
+	}
+	var errs []error
+	for _, sink := range *sinks {
+		errs = append(errs, sink.Sync())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,151 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LogSSEHandler streams logs to the client as Server-Sent Events, as an
+// alternative to a WebSocket connection (see AddLogConn) for environments
+// whose proxies don't support WebSockets. Each event's data is the same
+// JSON entry that WebSocket subscribers get, and its ID is the entry's
+// sequence number, so a client that reconnects with a Last-Event-ID
+// header (or a "since" query parameter) resumes where it left off, as
+// with AddLogConnSince. Like AddLogConnFiltered, the stream can be
+// limited to certain loggers with "logger" query parameters. The handler
+// returns when the client disconnects, or after sending an "end" event
+// when the log output is closed (see CloseLog).
+//
+// The log authorizer (see SetLogAuthorizer) only applies to WebSocket
+// connections, so this handler should only be reachable through HTTP
+// middleware that authenticates the client.
+func LogSSEHandler(w http.ResponseWriter, r *http.Request) {
+	loggers, err := parseLoggerFilter(r.URL.Query()["logger"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var since uint64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("since")
+	}
+	if lastEventID != "" {
+		since, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid sequence number: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn := &sseConn{
+		w:      w,
+		rc:     http.NewResponseController(w),
+		remote: sseAddr(r.RemoteAddr),
+		ended:  make(chan struct{}),
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // tell nginx and the like not to buffer the stream
+	if err := conn.rc.Flush(); err != nil {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	defer conn.detach() // in case the stream is being ended right now
+	websocketLogOutputs.AddConnSince(conn, subscriptionFilter{loggers: loggers}, since)
+	defer websocketLogOutputs.RemoveConn(conn) // waits for writes to finish, so w isn't used after we return
+
+	select {
+	case <-r.Context().Done():
+	case <-conn.ended:
+	}
+}
+
+// sseConn is a log subscriber's connection that writes
+// messages as Server-Sent Events.
+type sseConn struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	remote sseAddr
+
+	ended   chan struct{} // closed when the stream has ended (see end)
+	endOnce sync.Once
+}
+
+// end sends an "end" event, which tells the client not to reconnect,
+// and ends the stream. It must not be called while messages are being
+// written, and no messages may be written after it.
+func (c *sseConn) end() {
+	c.endOnce.Do(func() {
+		if _, err := c.w.Write([]byte("event: end\ndata: \n\n")); err == nil {
+			_ = c.rc.Flush()
+		}
+		close(c.ended)
+	})
+}
+
+// detach ensures the stream won't be ended (see end) after the handler
+// has returned, by waiting for it to end if it is being ended now.
+func (c *sseConn) detach() {
+	c.endOnce.Do(func() { close(c.ended) })
+}
+
+// WriteMessage writes data, which is a JSON message, as an event. The
+// message type is ignored.
+func (c *sseConn) WriteMessage(_ int, data []byte) error {
+	data = bytes.TrimRight(data, "\r\n")
+	buf := make([]byte, 0, len(data)+len("id: \ndata: \n\n")+20) //nolint:mnd // max length of a uint64
+	if seq, ok := seqOf(data); ok {
+		buf = append(buf, "id: "...)
+		buf = strconv.AppendUint(buf, seq, 10)
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, "data: "...)
+	buf = append(buf, data...)
+	buf = append(buf, "\n\n"...)
+	if _, err := c.w.Write(buf); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+func (c *sseConn) SetWriteDeadline(t time.Time) error {
+	if err := c.rc.SetWriteDeadline(t); !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+func (c *sseConn) RemoteAddr() net.Addr { return c.remote }
+
+// sseAddr is the remote address of an HTTP request.
+type sseAddr string
+
+func (sseAddr) Network() string  { return "tcp" }
+func (a sseAddr) String() string { return string(a) }
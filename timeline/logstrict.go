@@ -0,0 +1,69 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SetStrictMessages enables or disables a development aid that looks for
+// log messages which appear to have values interpolated into them (for
+// example, with fmt.Sprintf), such as numbers or file paths. Messages like
+// that defeat deduplication and fingerprinting of messages, since every
+// one is different; the values should instead be structured fields. When
+// such a message is found, a warning that points to the caller is written
+// to the console, once per call site. This is disabled by default.
+func SetStrictMessages(enabled bool) {
+	logConfigChange("strict_messages", strictMessages.Swap(enabled), enabled)
+}
+
+var strictMessages atomic.Bool
+
+// interpolatedMessage matches messages that likely have values formatted
+// into them: long runs of digits (IDs, sizes, timestamps), file paths,
+// and fmt's markers for bad formatting verbs.
+var interpolatedMessage = regexp.MustCompile(`\d{3,}|(?:^|[\s'"(])(?:[A-Za-z]:)?[\\/][^\s\\/]+[\\/]|%!`)
+
+// reportedInterpolations is the set of call sites (PCs) that have been
+// warned about by strictMessageCore.
+var reportedInterpolations sync.Map
+
+// strictMessageCore is added to entries that have a suspicious message,
+// so that the warning can point to the caller, which isn't known until the
+// entry is written. It doesn't write the entry.
+type strictMessageCore struct{ zapcore.Core }
+
+func (strictMessageCore) Write(ent zapcore.Entry, _ []zapcore.Field) error {
+	if !ent.Caller.Defined {
+		return nil
+	}
+	if _, reported := reportedInterpolations.LoadOrStore(ent.Caller.PC, struct{}{}); reported {
+		return nil
+	}
+	internalLog.Warn("log message appears to have values interpolated into it; use structured fields instead",
+		zap.String("caller", ent.Caller.TrimmedPath()),
+		zap.String("logger", ent.LoggerName),
+		zap.String("message", ent.Message))
+	return nil
+}
@@ -0,0 +1,154 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// WithLogSuppressed calls fn with logging suppressed for the calling
+// goroutine, for latency-sensitive critical sections where the cost
+// of encoding entries and fanning them out to the outputs would add
+// jitter. While fn runs, entries logged by the calling goroutine are
+// held in memory instead of being written; errors are still captured,
+// since they're written immediately as usual. Entries logged by other
+// goroutines, including ones started by fn, are not affected.
+//
+// The held entries are returned so the caller can Flush them once the
+// critical section is over, or simply discard them. At most
+// maxSuppressedEntries entries are held; any beyond that are dropped.
+//
+// Suppressions may be nested; each one holds the entries logged while
+// it is the innermost.
+func WithLogSuppressed(fn func()) *SuppressedLogs {
+	held := new(SuppressedLogs)
+	goid := goroutineID()
+
+	logSuppressions.Lock()
+	outer := logSuppressions.goroutines[goid]
+	logSuppressions.goroutines[goid] = held
+	logSuppressions.active.Store(int64(len(logSuppressions.goroutines)))
+	logSuppressions.Unlock()
+
+	defer func() {
+		logSuppressions.Lock()
+		if outer != nil {
+			logSuppressions.goroutines[goid] = outer
+		} else {
+			delete(logSuppressions.goroutines, goid)
+		}
+		logSuppressions.active.Store(int64(len(logSuppressions.goroutines)))
+		logSuppressions.Unlock()
+	}()
+
+	fn()
+	return held
+}
+
+// SuppressedLogs holds the entries that were logged while logging was
+// suppressed by WithLogSuppressed.
+type SuppressedLogs struct {
+	mu      sync.Mutex
+	entries []suppressedEntry
+	dropped int
+}
+
+// Len returns the number of entries held.
+func (s *SuppressedLogs) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Flush writes the held entries, with their original timestamps, as if
+// they had just been logged, and releases them. If any entries were
+// dropped, a warning with the number of them is written after the rest.
+func (s *SuppressedLogs) Flush() {
+	s.mu.Lock()
+	entries, dropped := s.entries, s.dropped
+	s.entries, s.dropped = nil, 0
+	s.mu.Unlock()
+
+	for _, held := range entries {
+		if ce := held.core.Check(held.ent, nil); ce != nil {
+			ce.Write(held.fields...)
+		}
+	}
+	if dropped > 0 {
+		Log.Warn("dropped log entries while logging was suppressed", zap.Int("dropped", dropped))
+	}
+}
+
+func (s *SuppressedLogs) hold(core *customCore, ent zapcore.Entry, fields []zapcore.Field) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) >= maxSuppressedEntries {
+		s.dropped++
+		return
+	}
+	s.entries = append(s.entries, suppressedEntry{core, ent, fields})
+}
+
+type suppressedEntry struct {
+	core   *customCore
+	ent    zapcore.Entry
+	fields []zapcore.Field
+}
+
+// logSuppressions maps the IDs of goroutines that are in a call to
+// WithLogSuppressed to the entries being held for them. Since finding
+// the ID of the logging goroutine isn't free, the number of goroutines
+// in the map is kept in active, so the lookup can be skipped entirely
+// when nothing is suppressed, which is nearly always.
+var logSuppressions = struct {
+	sync.Mutex
+	goroutines map[uint64]*SuppressedLogs
+	active     atomic.Int64
+}{goroutines: make(map[uint64]*SuppressedLogs)}
+
+// suppressedLogs returns the entries being held for the calling goroutine,
+// or nil if logging isn't suppressed for it.
+func suppressedLogs() *SuppressedLogs {
+	if logSuppressions.active.Load() == 0 {
+		return nil
+	}
+	goid := goroutineID()
+	logSuppressions.Lock()
+	defer logSuppressions.Unlock()
+	return logSuppressions.goroutines[goid]
+}
+
+// suppressingCore is added to entries logged while logging is suppressed,
+// so that they can be held along with their fields, which aren't known
+// until the entry is written. It doesn't write the entry.
+type suppressingCore struct {
+	*customCore
+	held *SuppressedLogs
+}
+
+func (sc suppressingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	sc.held.hold(sc.customCore, ent, fields)
+	return nil
+}
+
+const maxSuppressedEntries = 1000
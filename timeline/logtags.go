@@ -0,0 +1,108 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"slices"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Tags returns a field that tags an entry, or all entries from a logger
+// when added with With, with short labels (like "retry" or "network") to
+// group it with related entries across the codebase. The tags are always
+// a string array in the "tags" field, where the UI looks for them to
+// show filters. Blank and duplicate tags are omitted.
+//
+// The tags of a logger derived from a tagged logger are merged with the
+// tags of its parent, rather than replacing them. However, tags given at
+// the call site of a tagged logger are not merged; use WithTags instead.
+func Tags(tags ...string) zap.Field {
+	return zap.Array(tagsKey, mergeTags(nil, tags))
+}
+
+// WithTags returns a logger derived from logger with the tags added to
+// any tags it already has (see Tags).
+func WithTags(logger *zap.Logger, tags ...string) *zap.Logger {
+	return logger.With(Tags(tags...))
+}
+
+const tagsKey = "tags"
+
+// mergeTags returns the tags in a followed by any tags in b that are not
+// in a, without blank tags. It does not modify a.
+func mergeTags(a tagList, b []string) tagList {
+	merged := slices.Clip(a)
+	for _, tag := range b {
+		if tag != "" && !slices.Contains(merged, tag) {
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
+
+// tagList is the type of the value of a tags field, so that tags fields
+// can be recognized (by type, not just key) and merged.
+type tagList []string
+
+func (tl tagList) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, tag := range tl {
+		enc.AppendString(tag)
+	}
+	return nil
+}
+
+// tagsFromField returns the tags in f, if it's a tags field created with Tags.
+func tagsFromField(f zapcore.Field) (tagList, bool) {
+	if f.Key != tagsKey || f.Type != zapcore.ArrayMarshalerType {
+		return nil, false
+	}
+	tags, ok := f.Interface.(tagList)
+	return tags, ok
+}
+
+// withTags returns a derivative of c with its tags added as a field to
+// the underlying cores. The derivative is cached.
+func (c *customCore) withTags() *customCore {
+	if cached := c.tagged.Load(); cached != nil {
+		return cached
+	}
+	field := zap.Array(tagsKey, c.tags)
+	derived := &customCore{
+		Core:                c.Core.With([]zapcore.Field{field}),
+		nonSamplingCore:     c.nonSamplingCore.With([]zapcore.Field{field}),
+		liveJobProgressCore: c.liveJobProgressCore.With([]zapcore.Field{field}),
+
+		perOutputCore:                c.perOutputCore.With([]zapcore.Field{field}),
+		perOutputLiveJobProgressCore: c.perOutputLiveJobProgressCore.With([]zapcore.Field{field}),
+
+		progressThrottle: c.progressThrottle,
+		sampling:         c.sampling,
+		jobID:            c.jobID,
+		id:               c.id,
+		fields:           append(slices.Clip(c.fields), field),
+		pinned:           c.pinned,
+		hasGlobalFields:  c.hasGlobalFields,
+		tags:             c.tags,
+		tagsApplied:      true,
+	}
+	c.tagged.Store(derived)
+	return derived
+}
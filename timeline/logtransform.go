@@ -0,0 +1,224 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// LogTransform is a function that can modify a log entry before it is
+// written to any output. It may change the entry in place (for example,
+// to rewrite the message) and returns the fields to write, which may
+// have been added to, changed, or removed from. It returns keep=false
+// to drop the entry entirely.
+//
+// The fields are those given at the log call site; context fields that
+// were added to the logger with With() are not included.
+type LogTransform func(ent *zapcore.Entry, fields []zapcore.Field) (keep bool, outFields []zapcore.Field)
+
+// AddLogTransform appends transform to the pipeline of transforms that
+// are applied to every log entry. Transforms are applied in the order
+// they were added, each receiving the output of the previous one, and
+// before the entry is routed to outputs, so a transform that changes
+// the logger name or message also changes how the entry is sampled.
+// An entry dropped by one transform is not seen by later ones.
+//
+// Transforms are called synchronously for every enabled entry, while
+// the entry is being written, so they must be fast and safe for
+// concurrent use, and they must not log (the result is undefined). They
+// should not retain the fields slice, but may modify and return it.
+// If there are no transforms, there is no overhead.
+func AddLogTransform(transform LogTransform) {
+	logTransformsMu.Lock()
+	var transforms []LogTransform
+	if current := logTransforms.Load(); current != nil {
+		transforms = slices.Clone(*current)
+	}
+	transforms = append(transforms, transform)
+	logTransforms.Store(&transforms)
+	logTransformsMu.Unlock()
+
+	logConfigChange("log_transforms", len(transforms)-1, len(transforms))
+}
+
+var (
+	logTransforms   atomic.Pointer[[]LogTransform]
+	logTransformsMu sync.Mutex // serializes changes to logTransforms
+)
+
+// transformCore applies transforms to an entry when it is written,
+// and drops it if it is a duplicate (see SetDedupWindow), then routes
+// the resulting entry, whose fields are now known, through the custom
+// core.
+type transformCore struct {
+	*customCore
+	transforms []LogTransform
+}
+
+func (c transformCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	for _, transform := range c.transforms {
+		var keep bool
+		keep, fields = transform(&ent, fields)
+		if !keep {
+			return nil
+		}
+	}
+	keep, fields := logDedup.filter(ent, fields)
+	if !keep {
+		return nil
+	}
+	if ce := c.route(ent, nil, fields); ce != nil {
+		ce.Write(fields...)
+	}
+	return nil
+}
+
+// DowngradeMessage causes entries whose message matches pattern to be
+// logged at level to instead, if that is lower than their level. This
+// can tame known-benign errors logged by dependencies (for example,
+// "file already exists") without changing the call sites. The pattern
+// matches if it is a substring of the message, unless it is enclosed
+// in slashes, as in "/^file .* exists$/", in which case it is a regular
+// expression. Entries that are downgraded have a "level_overridden_from"
+// field with their original level. Entries above error level are never
+// downgraded, since they have side effects (like exiting the program).
+func DowngradeMessage(pattern string, to zapcore.Level) error {
+	override := levelOverride{substring: pattern, level: to}
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return fmt.Errorf("invalid message pattern: %w", err)
+		}
+		override = levelOverride{regexp: re, level: to}
+	}
+
+	levelOverridesMu.Lock()
+	defer levelOverridesMu.Unlock()
+	var overrides []levelOverride
+	if current := levelOverrides.Load(); current != nil {
+		overrides = slices.Clone(*current)
+	}
+	overrides = append(overrides, override)
+	levelOverrides.Store(&overrides)
+	return nil
+}
+
+// levelOverride changes the level of entries with matching messages.
+type levelOverride struct {
+	substring string
+	regexp    *regexp.Regexp
+	level     zapcore.Level
+}
+
+func (o levelOverride) matches(msg string) bool {
+	if o.regexp != nil {
+		return o.regexp.MatchString(msg)
+	}
+	return strings.Contains(msg, o.substring)
+}
+
+// overriddenLevel returns the level ent should be logged at instead,
+// if it matches any overrides (the first one that matches is used).
+func overriddenLevel(ent zapcore.Entry) (zapcore.Level, bool) {
+	overrides := levelOverrides.Load()
+	if overrides == nil || ent.Level > zapcore.ErrorLevel {
+		return ent.Level, false
+	}
+	for _, o := range *overrides {
+		if o.matches(ent.Message) {
+			return o.level, o.level < ent.Level
+		}
+	}
+	return ent.Level, false
+}
+
+var (
+	levelOverrides   atomic.Pointer[[]levelOverride]
+	levelOverridesMu sync.Mutex // serializes changes to levelOverrides
+)
+
+// RemapLevel shifts the level of entries from the logger named namePrefix,
+// and its descendants, by delta levels: a negative delta lowers the level
+// (for example, -1 logs a verbose subsystem's warnings as info) and a
+// positive delta raises it. This is finer-grained than muting a logger.
+// The result is limited to the range of debug to error levels, and, as
+// with DowngradeMessage, entries above error level are never remapped.
+// Remapped entries have a "level_overridden_from" field with their
+// original level. If remappings overlap, the one with the longest prefix
+// applies. A delta of 0 removes the remapping for namePrefix. Job status
+// updates are never remapped, since the UI depends on them.
+func RemapLevel(namePrefix string, delta int) {
+	levelRemapsMu.Lock()
+	defer levelRemapsMu.Unlock()
+	var remaps []levelRemap
+	if current := levelRemaps.Load(); current != nil {
+		remaps = slices.Clone(*current)
+	}
+	remaps = slices.DeleteFunc(remaps, func(r levelRemap) bool { return r.prefix == namePrefix })
+	if delta != 0 {
+		remaps = append(remaps, levelRemap{prefix: namePrefix, delta: delta})
+		slices.SortStableFunc(remaps, func(a, b levelRemap) int { return len(b.prefix) - len(a.prefix) })
+	}
+	if len(remaps) == 0 {
+		levelRemaps.Store(nil)
+		return
+	}
+	levelRemaps.Store(&remaps)
+}
+
+// levelRemap shifts the level of entries from loggers with a name prefix.
+type levelRemap struct {
+	prefix string
+	delta  int
+}
+
+// remappedLevel returns the level ent should be logged at instead,
+// according to the remapping with the longest matching prefix.
+func remappedLevel(ent zapcore.Entry) (zapcore.Level, bool) {
+	remaps := levelRemaps.Load()
+	if remaps == nil || ent.Level > zapcore.ErrorLevel || isLoggerOrDescendant(ent.LoggerName, "job.status") {
+		return ent.Level, false
+	}
+	for _, r := range *remaps {
+		if isLoggerOrDescendant(ent.LoggerName, r.prefix) {
+			level := zapcore.Level(min(max(int(ent.Level)+r.delta, int(zapcore.DebugLevel)), int(zapcore.ErrorLevel)))
+			return level, level != ent.Level
+		}
+	}
+	return ent.Level, false
+}
+
+// isLoggerOrDescendant returns true if name is the dotted logger name
+// prefix or one of its descendants.
+func isLoggerOrDescendant(name, prefix string) bool {
+	return prefix == "" || name == prefix ||
+		(strings.HasPrefix(name, prefix) && name[len(prefix)] == '.')
+}
+
+var (
+	levelRemaps   atomic.Pointer[[]levelRemap] // sorted with the longest prefix first
+	levelRemapsMu sync.Mutex                   // serializes changes to levelRemaps
+)
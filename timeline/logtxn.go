@@ -0,0 +1,59 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// NewTxnID returns a new ID for a database transaction or operation,
+// unique within this process, for correlating logs with storage-layer
+// diagnostics such as slow-query analysis.
+func NewTxnID() uint64 { return txnSeq.Add(1) }
+
+var txnSeq atomic.Uint64
+
+// WithTxnID returns a copy of ctx that carries the transaction ID, so
+// that code further down the call stack can log it consistently.
+func WithTxnID(ctx context.Context, txnID uint64) context.Context {
+	return context.WithValue(ctx, txnIDCtxKey{}, txnID)
+}
+
+// TxnIDFromContext returns the transaction ID carried by ctx, if any.
+func TxnIDFromContext(ctx context.Context) (uint64, bool) {
+	txnID, ok := ctx.Value(txnIDCtxKey{}).(uint64)
+	return txnID, ok
+}
+
+// TxnField returns the field that identifies a transaction in log entries.
+func TxnField(txnID uint64) zap.Field { return zap.Uint64("txn_id", txnID) }
+
+// LoggerWithTxn returns logger with the txn_id field of the transaction
+// carried by ctx, or logger itself if ctx doesn't carry one.
+func LoggerWithTxn(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	if txnID, ok := TxnIDFromContext(ctx); ok {
+		return logger.With(TxnField(txnID))
+	}
+	return logger
+}
+
+type txnIDCtxKey struct{}
@@ -0,0 +1,358 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// WebhookOptions configures a webhook sink (see AddWebhookSink). Zero
+// values are replaced by defaults.
+type WebhookOptions struct {
+	// The maximum number of entries in each post. Default: 20.
+	BatchSize int
+
+	// How long to wait for more entries to batch with the first one that
+	// is queued, before posting. Default: 5 seconds.
+	BatchDelay time.Duration
+
+	// The minimum time between posts, to avoid flooding the receiver
+	// (and getting rate-limited by it). Default: 30 seconds.
+	MinInterval time.Duration
+
+	// The timeout of each attempt to post. Default: 10 seconds.
+	Timeout time.Duration
+
+	// How many times a failed post is retried, with exponential backoff,
+	// before its entries are dropped. Default: 3.
+	Retries int
+
+	// How many entries may be queued for posting; if the queue is full,
+	// further entries are dropped (and counted in the next post). Default: 1000.
+	QueueSize int
+
+	// Headers to add to each request, such as for authorization.
+	Header http.Header
+
+	// The client to post with. Default: http.DefaultClient.
+	Client *http.Client
+}
+
+func (opts *WebhookOptions) setDefaults() {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 20
+	}
+	if opts.BatchDelay <= 0 {
+		opts.BatchDelay = 5 * time.Second
+	}
+	if opts.MinInterval <= 0 {
+		opts.MinInterval = 30 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = 3
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1000
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+}
+
+// AddWebhookSink adds an output that POSTs entries at or above minLevel
+// to a webhook at webhookURL, as an alerting source for unattended
+// deployments. Entries are batched and posted as a JSON object with
+// a "text" (and "content") summary, which Slack and Discord webhooks
+// show as the message, along with the "entries" themselves and how many
+// were "dropped" since the last post. Posts are rate-limited and retried
+// as configured by opts. Like exported logs, entries have token values
+// redacted and the home directory replaced with "~".
+//
+// Posting happens in the background, so it never slows down or fails
+// the logging path: if the queue is full, entries are dropped. Failures
+// to post are reported on the console only. The returned function
+// removes the sink, after which it makes a final attempt (and one retry)
+// to post any queued entries.
+func AddWebhookSink(webhookURL string, minLevel zapcore.Level, opts WebhookOptions) (remove func(), err error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webhook URL: scheme must be http or https: %s", webhookURL)
+	}
+	opts.setDefaults()
+
+	ws := &webhookSink{
+		url:   webhookURL,
+		level: minLevel,
+		opts:  opts,
+		enc:   zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		mask:  newExportMasker(),
+		queue: make(chan []byte, opts.QueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go ws.run()
+
+	removeSink := addLogSink(ws)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			removeSink()
+			close(ws.stop)
+			<-ws.done
+		})
+	}, nil
+}
+
+type webhookSink struct {
+	url   string
+	level zapcore.Level
+	opts  WebhookOptions
+	enc   zapcore.Encoder
+	mask  func([]byte) []byte
+
+	queue   chan []byte
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func (ws *webhookSink) Enabled(level zapcore.Level) bool { return ws.level.Enabled(level) }
+
+func (ws *webhookSink) writeEntry(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := ws.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	// the entry leaves the machine, so it gets the same masking as exports
+	entry := ws.mask(bytes.TrimSpace(buf.Bytes()))
+	select {
+	case ws.queue <- append([]byte(nil), entry...):
+	default:
+		ws.dropped.Add(1)
+	}
+	buf.Free()
+	return nil
+}
+
+// Sync does not wait for queued entries to be posted, since that can
+// take a long time, and syncing the logger shouldn't.
+func (*webhookSink) Sync() error { return nil }
+
+// run batches queued entries and posts them until the sink is stopped.
+func (ws *webhookSink) run() {
+	defer close(ws.done)
+
+	var lastPost time.Time
+	for {
+		// wait for the first entry of the next batch
+		var batch []json.RawMessage
+		select {
+		case entry := <-ws.queue:
+			batch = append(batch, entry)
+		case <-ws.stop:
+			ws.postRemaining()
+			return
+		}
+
+		// give more entries a chance to join it
+		deadline := time.After(ws.opts.BatchDelay)
+		stopped := false
+	collect:
+		for len(batch) < ws.opts.BatchSize {
+			select {
+			case entry := <-ws.queue:
+				batch = append(batch, entry)
+			case <-deadline:
+				break collect
+			case <-ws.stop:
+				stopped = true
+				break collect
+			}
+		}
+
+		// respect the rate limit
+		if wait := time.Until(lastPost.Add(ws.opts.MinInterval)); wait > 0 && !stopped {
+			select {
+			case <-time.After(wait):
+			case <-ws.stop:
+				stopped = true
+			}
+		}
+
+		ws.post(batch)
+		lastPost = time.Now()
+		if stopped {
+			ws.postRemaining()
+			return
+		}
+	}
+}
+
+// postRemaining posts the entries left in the queue once the sink is
+// stopped, which means that a failed post is only retried once.
+func (ws *webhookSink) postRemaining() {
+	var batch []json.RawMessage
+	for drained := false; !drained; {
+		select {
+		case entry := <-ws.queue:
+			batch = append(batch, entry)
+		default:
+			drained = true
+		}
+	}
+	if len(batch) > 0 || ws.dropped.Load() > 0 {
+		ws.post(batch)
+	}
+}
+
+// post posts the batch, retrying with exponential backoff if it fails.
+// If the sink is stopped while waiting to retry, it retries immediately,
+// one last time.
+func (ws *webhookSink) post(batch []json.RawMessage) {
+	body := ws.payload(batch)
+	backoff := time.Second
+	for attempt, stopped := 0, false; ; attempt++ {
+		err := ws.attempt(body)
+		if err == nil {
+			return
+		}
+		var statusErr webhookStatusError
+		if attempt >= ws.opts.Retries || stopped || (errors.As(err, &statusErr) && !statusErr.retryable()) {
+			internalLog.Error("posting log entries to webhook",
+				zap.Int("entries", len(batch)),
+				zap.Int("attempts", attempt+1),
+				zap.Error(err))
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ws.stop:
+			stopped = true
+		}
+		backoff *= 2
+	}
+}
+
+func (ws *webhookSink) payload(batch []json.RawMessage) []byte {
+	dropped := ws.dropped.Swap(0)
+	summary := webhookSummary(batch, dropped)
+	body, err := json.Marshal(webhookPayload{
+		Text:    summary,
+		Content: summary,
+		Entries: batch,
+		Dropped: dropped,
+	})
+	if err != nil {
+		// the entries are valid JSON, so this shouldn't happen
+		internalLog.Error("encoding webhook payload", zap.Error(err))
+	}
+	return body
+}
+
+// attempt posts body to the webhook once.
+func (ws *webhookSink) attempt(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ws.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, vals := range ws.opts.Header {
+		req.Header[key] = vals
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ws.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return webhookStatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookPayload is the body of a post to a webhook.
+type webhookPayload struct {
+	Text    string            `json:"text"`    // for Slack
+	Content string            `json:"content"` // for Discord
+	Entries []json.RawMessage `json:"entries"`
+	Dropped int64             `json:"dropped,omitempty"`
+}
+
+// webhookSummary returns a short, human-readable summary of the entries,
+// with the message of the first one, since chat apps only show the text.
+func webhookSummary(batch []json.RawMessage, dropped int64) string {
+	var sb strings.Builder
+	if len(batch) > 0 {
+		var first struct {
+			Level  string `json:"level"`
+			Logger string `json:"logger"`
+			Msg    string `json:"msg"`
+		}
+		_ = json.Unmarshal(batch[0], &first)
+		fmt.Fprintf(&sb, "[%s] %s", strings.ToUpper(first.Level), first.Msg)
+		if first.Logger != "" {
+			fmt.Fprintf(&sb, " (%s)", first.Logger)
+		}
+		if len(batch) > 1 {
+			fmt.Fprintf(&sb, " and %d more", len(batch)-1)
+		}
+	}
+	if dropped > 0 {
+		if sb.Len() > 0 {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "%d entries dropped", dropped)
+	}
+	return sb.String()
+}
+
+// webhookStatusError is an unsuccessful HTTP status from a webhook.
+type webhookStatusError int
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook responded with HTTP %d %s", int(e), http.StatusText(int(e)))
+}
+
+// retryable returns true if the post may succeed if it's tried again.
+func (e webhookStatusError) retryable() bool {
+	return e == http.StatusTooManyRequests || e >= http.StatusInternalServerError
+}
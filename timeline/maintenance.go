@@ -174,8 +174,21 @@ func (tl *Timeline) deleteThumbnails(ctx context.Context, itemRowIDs []uint64, d
 			return fmt.Errorf("unable to delete thumbnail row for data file %s: %w", dataFile, err)
 		}
 	}
+	assetPaths, err := deleteMediaAssets(ctx, thumbsTx, dataFiles)
+	if err != nil {
+		return err
+	}
+
+	if err := thumbsTx.Commit(); err != nil {
+		return err
+	}
 
-	return thumbsTx.Commit()
+	for _, assetPath := range assetPaths {
+		if err := tl.deleteRepoFile(assetPath); err != nil {
+			Log.Error("deleting media asset file", zap.String("path", assetPath), zap.Error(err))
+		}
+	}
+	return nil
 }
 
 func (tl *Timeline) findExpiredDeletedItems(ctx context.Context, tx *sql.Tx) (rowIDs []uint64, dataFilesToDelete []string, err error) {
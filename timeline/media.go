@@ -0,0 +1,621 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"container/heap"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// mediaPipeline generates media assets -- thumbnails, video previews, and
+// web-viewable conversions of images -- with a bounded pool of workers, so
+// that thumbnailing a large import doesn't compete with the import itself
+// (or with the UI) for the whole machine. Tasks are run in priority order:
+// assets for items that are visible in the UI are generated before those
+// requested by background jobs, and slow video transcodes are done last.
+// Identical tasks are coalesced, so an item that is both in a job's queue
+// and on the screen is only processed once, but at the higher priority.
+type mediaPipeline struct {
+	ctx     context.Context // canceled when the timeline is closed
+	workers int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   mediaQueue
+	pending map[mediaTaskKey]*mediaTask // queued or running
+	running int
+	seq     uint64
+	wg      sync.WaitGroup
+}
+
+// newMediaPipeline starts a media pipeline with the given number of
+// workers, which stop when ctx is canceled.
+func newMediaPipeline(ctx context.Context, workers int) *mediaPipeline {
+	mp := &mediaPipeline{
+		ctx:     ctx,
+		workers: max(workers, 1),
+		pending: make(map[mediaTaskKey]*mediaTask),
+	}
+	mp.cond = sync.NewCond(&mp.mu)
+	context.AfterFunc(ctx, func() {
+		mp.mu.Lock()
+		mp.cond.Broadcast()
+		mp.mu.Unlock()
+	})
+	mp.wg.Add(mp.workers)
+	for range mp.workers {
+		go mp.worker()
+	}
+	return mp
+}
+
+// defaultMediaWorkers is the size of a timeline's media pipeline. Each
+// worker may run ffmpeg, which is itself multi-threaded, so we leave
+// room for imports and everything else.
+var defaultMediaWorkers = max(runtime.NumCPU()/2, 1)
+
+// do runs fn as the task identified by key with the given priority, and
+// waits for it to finish or for ctx to be done, whichever is first. If an
+// identical task is already queued or running, do waits for that one
+// instead (raising its priority, if needed), and fn is not called. If ctx
+// is done while the task is still queued and nothing else is waiting for
+// it, the task is abandoned. If mp is nil, fn is simply called.
+func (mp *mediaPipeline) do(ctx context.Context, key mediaTaskKey, priority mediaPriority, fn func(context.Context) error) error {
+	if mp == nil {
+		return fn(ctx)
+	}
+
+	mp.mu.Lock()
+	if err := mp.ctx.Err(); err != nil {
+		mp.mu.Unlock()
+		return err
+	}
+	task, ok := mp.pending[key]
+	if ok {
+		if priority > task.priority {
+			task.priority = priority
+			if task.index >= 0 {
+				heap.Fix(&mp.queue, task.index)
+			}
+		}
+	} else {
+		mp.seq++
+		task = &mediaTask{
+			key:      key,
+			run:      fn,
+			priority: priority,
+			seq:      mp.seq,
+			done:     make(chan struct{}),
+		}
+		mp.pending[key] = task
+		heap.Push(&mp.queue, task)
+		mp.cond.Signal()
+	}
+	task.waiters++
+	mp.observe()
+	mp.mu.Unlock()
+
+	select {
+	case <-task.done:
+		return task.err
+	case <-ctx.Done():
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	task.waiters--
+	if task.waiters == 0 && task.index >= 0 {
+		heap.Remove(&mp.queue, task.index)
+		delete(mp.pending, key)
+		mp.observe()
+	}
+	return ctx.Err()
+}
+
+func (mp *mediaPipeline) worker() {
+	defer mp.wg.Done()
+	for {
+		mp.mu.Lock()
+		for mp.queue.Len() == 0 && mp.ctx.Err() == nil {
+			mp.cond.Wait()
+		}
+		if err := mp.ctx.Err(); err != nil {
+			// fail whatever is left, so nothing waits forever
+			for mp.queue.Len() > 0 {
+				task := heap.Pop(&mp.queue).(*mediaTask)
+				delete(mp.pending, task.key)
+				task.err = err
+				close(task.done)
+			}
+			mp.mu.Unlock()
+			return
+		}
+		task := heap.Pop(&mp.queue).(*mediaTask)
+		mp.running++
+		mp.observe()
+		mp.mu.Unlock()
+
+		err := task.run(mp.ctx)
+
+		mp.mu.Lock()
+		mp.running--
+		delete(mp.pending, task.key)
+		task.err = err
+		close(task.done)
+		mp.observe()
+		mp.mu.Unlock()
+	}
+}
+
+// stats returns the number of tasks that are queued and running.
+func (mp *mediaPipeline) stats() (queued, running int) {
+	if mp == nil {
+		return 0, 0
+	}
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.queue.Len(), mp.running
+}
+
+// observe reports the state of the pool. The lock must be held.
+func (mp *mediaPipeline) observe() {
+	ObserveWorkerPool("media", mp.running, mp.queue.Len(), mp.workers)
+}
+
+// wait blocks until all the workers have stopped, after the
+// pipeline's context has been canceled.
+func (mp *mediaPipeline) wait() {
+	if mp != nil {
+		mp.wg.Wait()
+	}
+}
+
+// mediaPriority orders tasks in the media pipeline; higher goes first.
+type mediaPriority int
+
+const (
+	// video transcodes are slow, and the original can usually be
+	// played (or transcoded live) in the meantime
+	mediaPriorityTranscode mediaPriority = iota
+
+	// assets needed by background jobs, like thumbnailing an import
+	mediaPriorityBackground
+
+	// assets for items the user is looking at
+	mediaPriorityVisible
+)
+
+// mediaTaskKey identifies a task, so identical tasks can be coalesced.
+type mediaTaskKey struct {
+	kind     mediaAssetKind
+	dataFile string
+	dataID   int64
+	variant  string // such as the thumbnail type
+}
+
+type mediaTask struct {
+	key      mediaTaskKey
+	run      func(context.Context) error
+	priority mediaPriority
+	seq      uint64 // for FIFO order within a priority
+	index    int    // position in the queue, or -1 if not queued
+	waiters  int
+	done     chan struct{} // closed when finished; err is then set
+	err      error
+}
+
+// mediaQueue is a priority queue of tasks (see container/heap).
+type mediaQueue []*mediaTask
+
+func (q mediaQueue) Len() int { return len(q) }
+
+func (q mediaQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q mediaQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *mediaQueue) Push(x any) {
+	task := x.(*mediaTask)
+	task.index = len(*q)
+	*q = append(*q, task)
+}
+
+func (q *mediaQueue) Pop() any {
+	old := *q
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	task.index = -1
+	*q = old[:n-1]
+	return task
+}
+
+// mediaAssetKind is a kind of asset derived from an item's media.
+type mediaAssetKind string
+
+const (
+	mediaThumbnail    mediaAssetKind = "thumbnail"
+	mediaVideoPreview mediaAssetKind = "video_preview"
+	mediaWebImage     mediaAssetKind = "web_image"
+)
+
+// Statuses of media assets in the media_assets table.
+const (
+	mediaAssetDone   = "done"
+	mediaAssetFailed = "failed"
+)
+
+// mediaAsset is the stored status of a media asset of a data file.
+type mediaAsset struct {
+	Status   string
+	Path     string // relative to the repo root
+	MIMEType string
+	Updated  int64
+}
+
+// currentFor returns true if the asset was generated (or failed) after the
+// item that it was generated for was stored or last modified.
+func (ma mediaAsset) currentFor(task thumbnailTask) bool {
+	return ma.Status != "" &&
+		ma.Updated >= task.itemStored &&
+		(task.itemModified == nil || ma.Updated >= *task.itemModified) &&
+		(task.modJobEnded == nil || ma.Updated >= *task.modJobEnded)
+}
+
+// mediaAsset returns the status of the asset of the given kind for the data
+// file. If there is none, the returned Status is empty and err is nil.
+func (tl *Timeline) mediaAsset(ctx context.Context, q rowQueryer, kind mediaAssetKind, dataFile string) (mediaAsset, error) {
+	var ma mediaAsset
+	var assetPath, mimeType *string
+	err := q.QueryRowContext(ctx,
+		`SELECT status, path, mime_type, updated FROM media_assets WHERE data_file=? AND kind=? LIMIT 1`,
+		dataFile, kind).Scan(&ma.Status, &assetPath, &mimeType, &ma.Updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return mediaAsset{}, nil
+	}
+	if err != nil {
+		return mediaAsset{}, fmt.Errorf("querying %s status of %s: %w", kind, dataFile, err)
+	}
+	if assetPath != nil {
+		ma.Path = *assetPath
+	}
+	if mimeType != nil {
+		ma.MIMEType = *mimeType
+	}
+	return ma, nil
+}
+
+// storeMediaAsset records the result of generating the asset of the given kind
+// for the data file: if genErr is nil, the asset is done (and stored at the
+// given path, if not in the thumbnails table); otherwise, it failed, and won't
+// be tried again until the item changes or regeneration is requested.
+func (tl *Timeline) storeMediaAsset(ctx context.Context, kind mediaAssetKind, dataFile, assetPath, mimeType string, genErr error) error {
+	status := mediaAssetDone
+	var pathToStore, mimeTypeToStore, errToStore *string
+	if genErr != nil {
+		status = mediaAssetFailed
+		errStr := genErr.Error()
+		errToStore = &errStr
+	} else {
+		if assetPath != "" {
+			pathToStore = &assetPath
+		}
+		if mimeType != "" {
+			mimeTypeToStore = &mimeType
+		}
+	}
+
+	tl.thumbsMu.Lock()
+	defer tl.thumbsMu.Unlock()
+
+	_, err := tl.thumbs.ExecContext(ctx, `
+		INSERT INTO media_assets (data_file, kind, status, path, mime_type, error, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (data_file, kind) DO UPDATE
+		SET status=excluded.status, path=excluded.path, mime_type=excluded.mime_type,
+			error=excluded.error, updated=excluded.updated, attempts=attempts+1`,
+		dataFile, kind, status, pathToStore, mimeTypeToStore, errToStore, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("storing %s status of %s: %w", kind, dataFile, err)
+	}
+	return nil
+}
+
+// deleteMediaAssets deletes the records and files of the media assets of the
+// given data files, within the tx on the thumbnails DB. It returns the paths
+// of the asset files, which should be deleted once the tx is committed.
+func deleteMediaAssets(ctx context.Context, tx *sql.Tx, dataFiles []string) ([]string, error) {
+	var assetPaths []string
+	for _, dataFile := range dataFiles {
+		rows, err := tx.QueryContext(ctx,
+			`DELETE FROM media_assets WHERE data_file=? RETURNING path`, dataFile)
+		if err != nil {
+			return nil, fmt.Errorf("deleting media assets of %s: %w", dataFile, err)
+		}
+		for rows.Next() {
+			var assetPath *string
+			if err := rows.Scan(&assetPath); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scanning deleted media asset path: %w", err)
+			}
+			if assetPath != nil {
+				assetPaths = append(assetPaths, *assetPath)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("iterating deleted media assets: %w", err)
+		}
+	}
+	return assetPaths, nil
+}
+
+// VideoPreview returns the path (relative to the repo root) of the preview of
+// the video in the data file, which is a transcode that browsers can play, and
+// true if there is one; otherwise it returns false.
+func (tl *Timeline) VideoPreview(ctx context.Context, dataFile string) (string, bool) {
+	tl.thumbsMu.RLock()
+	ma, err := tl.mediaAsset(ctx, tl.thumbs, mediaVideoPreview, dataFile)
+	tl.thumbsMu.RUnlock()
+	if err != nil || ma.Status != mediaAssetDone || ma.Path == "" {
+		return "", false
+	}
+	if _, err := os.Stat(tl.FullPath(ma.Path)); err != nil {
+		return "", false
+	}
+	return ma.Path, true
+}
+
+// generateVideoPreview transcodes the video in the data file to a preview that
+// browsers can play (H.264/AAC in MP4, which can be streamed), in the media
+// pipeline with the given priority, and records its status.
+func (tl *Timeline) generateVideoPreview(ctx context.Context, dataFile string, priority mediaPriority) error {
+	key := mediaTaskKey{kind: mediaVideoPreview, dataFile: dataFile}
+	return tl.media.do(ctx, key, priority, func(ctx context.Context) error {
+		assetPath := previewAssetPath(dataFile, ".mp4")
+		err := tl.writeAsset(assetPath, func(tmpPath string) error {
+			inputPath, done, err := tl.DecryptedPath(dataFile)
+			if err != nil {
+				return err
+			}
+			defer done()
+			//nolint:gosec
+			cmd := exec.CommandContext(ctx, "ffmpeg",
+				"-y",
+				"-i", inputPath,
+				"-map", "0:v:0",
+				"-map", "0:a:0?", // include audio, if any
+				"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", maxVideoPreviewDimension),
+				"-c:v", "libx264",
+				"-preset", "veryfast",
+				"-crf", "26",
+				"-pix_fmt", "yuv420p", // most compatible with browsers
+				"-c:a", "aac",
+				"-b:a", "128k",
+				"-movflags", "+faststart", // allows playback before the whole file is loaded
+				"-f", "mp4",
+				tmpPath,
+			)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("transcoding video: %w: %s", err, lastLines(out, 3))
+			}
+			return nil
+		})
+		if ctx.Err() != nil {
+			return err // don't record cancellation as failure; it can be tried again
+		}
+		if storeErr := tl.storeMediaAsset(ctx, mediaVideoPreview, dataFile, assetPath, "video/mp4", err); storeErr != nil {
+			return errors.Join(err, storeErr)
+		}
+		return err
+	})
+}
+
+// webImage returns the path (relative to the repo root) of a copy of the image
+// in the data file in a format that browsers (and our image library) can work
+// with, like JPEG. It is generated, if it doesn't exist yet. This is used for
+// formats like HEIC and RAW. It is not run in the media pipeline because it is
+// needed as an input for other tasks, which already run in the pipeline.
+func (tl *Timeline) webImage(ctx context.Context, dataFile string) (string, error) {
+	mediaAssetMapMu.Lock(dataFile)
+	defer mediaAssetMapMu.Unlock(dataFile)
+
+	tl.thumbsMu.RLock()
+	ma, err := tl.mediaAsset(ctx, tl.thumbs, mediaWebImage, dataFile)
+	tl.thumbsMu.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	if ma.Status == mediaAssetDone && ma.Path != "" {
+		if _, err := os.Stat(tl.FullPath(ma.Path)); err == nil {
+			return ma.Path, nil
+		}
+	}
+
+	assetPath := previewAssetPath(dataFile, extJpg)
+	err = tl.writeAsset(assetPath, func(tmpPath string) error {
+		inputPath, done, err := tl.DecryptedPath(dataFile)
+		if err != nil {
+			return err
+		}
+		defer done()
+		return convertToWebImage(ctx, inputPath, tmpPath)
+	})
+	if ctx.Err() != nil {
+		return "", err
+	}
+	if storeErr := tl.storeMediaAsset(ctx, mediaWebImage, dataFile, assetPath, ImageJPEG, err); storeErr != nil {
+		return "", errors.Join(err, storeErr)
+	}
+	if err != nil {
+		return "", err
+	}
+	return assetPath, nil
+}
+
+var mediaAssetMapMu = newMapMutex()
+
+// convertToWebImage converts the image at inputPath to a full-size JPEG at outputPath.
+// It tries vips first, and falls back to ffmpeg, which can decode some formats (like
+// certain HEIC variants) that vips may not have been compiled with.
+func convertToWebImage(ctx context.Context, inputPath, outputPath string) error {
+	vipsErr := func() error {
+		defer acquireCPUIntensiveThrottle()()
+		img, err := loadImageVips(inputPath, nil)
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+		ep := vips.NewJpegExportParams()
+		ep.StripMetadata = true // rotation is already applied when loading
+		ep.Quality = 90
+		ep.Interlace = true
+		imgBytes, _, err := img.ExportJpeg(ep)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(outputPath, imgBytes, 0600)
+	}()
+	if vipsErr == nil {
+		return nil
+	}
+
+	//nolint:gosec
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-y",
+		"-i", inputPath,
+		"-frames:v", "1",
+		"-q:v", "2",
+		"-f", "image2",
+		outputPath,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("converting image with vips: %w; then with ffmpeg: %w: %s", vipsErr, err, lastLines(out, 3))
+	}
+	return nil
+}
+
+// writeAsset calls write with a temporary file path to write the asset to, then
+// moves it into place at assetPath (relative to the repo root), so that readers
+// never see a partial asset. If encryption is enabled, the temporary file is
+// outside the repo, and it is encrypted into place.
+func (tl *Timeline) writeAsset(assetPath string, write func(tmpPath string) error) error {
+	fullPath := tl.FullPath(assetPath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0700); err != nil {
+		return fmt.Errorf("making asset folder: %w", err)
+	}
+	tmpPath := fullPath + ".partial"
+	if key := tl.fileKey(); key != nil {
+		tmpDir, err := os.MkdirTemp("", "timelinize_asset_")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		plainPath := filepath.Join(tmpDir, path.Base(assetPath))
+		if err := write(plainPath); err != nil {
+			return err
+		}
+		if err := encryptFile(key, plainPath, tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("encrypting asset: %w", err)
+		}
+	} else if err := write(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("moving asset into place: %w", err)
+	}
+	return nil
+}
+
+// previewAssetPath returns the path (relative to the repo root) of an asset
+// derived from the data file, with the given extension.
+func previewAssetPath(dataFile, ext string) string {
+	return path.Join(PreviewsFolderName, strings.TrimPrefix(dataFile, DataFolderName+"/")+ext)
+}
+
+// needsVideoPreview returns true if the video data type is one that
+// browsers can't be relied upon to play, so a preview should be made.
+func needsVideoPreview(dataType string) bool {
+	dataType = strings.ToLower(dataType)
+	return strings.HasPrefix(dataType, "video/") &&
+		dataType != "video/mp4" && dataType != VideoWebM
+}
+
+// needsWebImage returns true if the image data type is one that browsers
+// (and sometimes our image library) can't display, like HEIC or camera RAW,
+// so a web-viewable copy should be made to display and thumbnail.
+func needsWebImage(dataType string) bool {
+	dataType = strings.ToLower(dataType)
+	switch dataType {
+	case "image/heic", "image/heif", "image/dng", "image/x-dcraw":
+		return true
+	}
+	for _, t := range commonFileTypes {
+		// the camera RAW formats we know of are all "image/x-*"
+		if t == dataType && strings.HasPrefix(t, "image/x-") {
+			return true
+		}
+	}
+	return false
+}
+
+// logMediaProgress emits a progress update for the job after the media
+// pipeline finished an asset of the given kind for it.
+func logMediaProgress(job *ActiveJob, kind mediaAssetKind) {
+	queued, running := job.tl.media.stats()
+	LogMediaProgress(job.ID(), string(kind), queued, running)
+}
+
+// lastLines returns the last n lines of output, which for ffmpeg is usually
+// where the reason for an error is.
+func lastLines(out []byte, n int) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Maximum dimension of video previews, which are meant for
+// playing in the browser rather than archival.
+const maxVideoPreviewDimension = 1280
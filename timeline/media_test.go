@@ -0,0 +1,164 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMediaPipeline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mp := newMediaPipeline(ctx, 1)
+	defer func() {
+		cancel()
+		mp.wait()
+	}()
+
+	// occupy the only worker so the rest are queued
+	release, started := make(chan struct{}), make(chan struct{})
+	go mp.do(ctx, mediaTaskKey{dataFile: "blocker"}, mediaPriorityBackground, func(context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	var mu sync.Mutex
+	var ran []string
+	var wg sync.WaitGroup
+	submit := func(ctx context.Context, name string, priority mediaPriority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = mp.do(ctx, mediaTaskKey{dataFile: name}, priority, func(context.Context) error {
+				mu.Lock()
+				ran = append(ran, name)
+				mu.Unlock()
+				return nil
+			})
+		}()
+		waitForQueue(t, mp, name)
+	}
+
+	abandonCtx, abandon := context.WithCancel(ctx)
+	submit(ctx, "transcode", mediaPriorityTranscode)
+	submit(ctx, "background1", mediaPriorityBackground)
+	submit(abandonCtx, "abandoned", mediaPriorityVisible)
+	submit(ctx, "background2", mediaPriorityBackground)
+	submit(ctx, "visible", mediaPriorityVisible)
+	submit(ctx, "background2", mediaPriorityVisible) // same task, raises its priority
+
+	abandon()
+	for {
+		mp.mu.Lock()
+		_, ok := mp.pending[mediaTaskKey{dataFile: "abandoned"}]
+		mp.mu.Unlock()
+		if !ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	expected := []string{"background2", "visible", "background1", "transcode"}
+	if !slices.Equal(ran, expected) {
+		t.Errorf("expected tasks to run in order %v, got %v", expected, ran)
+	}
+}
+
+// waitForQueue waits until the task for the data file is pending.
+func waitForQueue(t *testing.T, mp *mediaPipeline, dataFile string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mp.mu.Lock()
+		_, ok := mp.pending[mediaTaskKey{dataFile: dataFile}]
+		mp.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("task %s was never queued", dataFile)
+}
+
+func TestMediaAssetStatus(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+
+	tl, err := Create(ctx, repo, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	const dataFile = "data/broken.jpg"
+	if err := tl.storeMediaAsset(ctx, mediaThumbnail, dataFile, "", "", errors.New("corrupt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tl.Thumbnail(ctx, 0, dataFile, ImageJPEG, ImageAVIF); !errors.Is(err, errThumbnailFailed) {
+		t.Errorf("expected previously failed thumbnail not to be retried, got: %v", err)
+	}
+
+	// a failure is current until the item changes
+	ma, err := tl.mediaAsset(ctx, tl.thumbs, mediaThumbnail, dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ma.currentFor(thumbnailTask{itemStored: ma.Updated}) {
+		t.Error("expected failure to be current for unchanged item")
+	}
+	modified := ma.Updated + 1
+	if ma.currentFor(thumbnailTask{itemStored: ma.Updated, itemModified: &modified}) {
+		t.Error("expected failure to be stale after item was modified")
+	}
+
+	// deleting the thumbnails of a data file deletes its assets too
+	previewPath := previewAssetPath("data/video.mov", ".mp4")
+	if err := os.MkdirAll(filepath.Dir(tl.FullPath(previewPath)), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tl.FullPath(previewPath), []byte("video"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.storeMediaAsset(ctx, mediaVideoPreview, "data/video.mov", previewPath, "video/mp4", nil); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := tl.VideoPreview(ctx, "data/video.mov"); !ok || p != previewPath {
+		t.Errorf("expected video preview %s, got %q (ok=%t)", previewPath, p, ok)
+	}
+	if err := tl.deleteThumbnails(ctx, nil, []string{"data/video.mov"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tl.VideoPreview(ctx, "data/video.mov"); ok {
+		t.Error("expected video preview to be deleted")
+	}
+	if _, err := os.Stat(tl.FullPath(previewPath)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected video preview file to be deleted, got: %v", err)
+	}
+}
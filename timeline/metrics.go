@@ -0,0 +1,370 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	runtimemetrics "runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics of the job engine, data sources, database, and media processing.
+// They are process-wide (like the log aggregators), so if multiple timelines
+// are open, their activity is counted together. They are exposed in the
+// Prometheus text format by MetricsHandler, and as values by MetricsSnapshot.
+var (
+	jobsStartedMetric = newMetric("timelinize_jobs_started_total",
+		"Number of jobs that started running, by type.",
+		metricCounter, nil, "type")
+	jobsFinishedMetric = newMetric("timelinize_jobs_finished_total",
+		"Number of jobs that stopped running, by type and final state.",
+		metricCounter, nil, "type", "state")
+	jobsRunningMetric = newMetric("timelinize_jobs_running",
+		"Number of jobs that are currently running, by type.",
+		metricGauge, nil, "type")
+	jobDurationMetric = newMetric("timelinize_job_duration_seconds",
+		"How long jobs ran before they stopped, by type.",
+		metricHistogram, jobDurationBuckets, "type")
+
+	itemsReadMetric = newMetric("timelinize_datasource_items_read_total",
+		"Number of items (including those related to other items) read from data sources.",
+		metricCounter, nil, "data_source")
+	itemsProcessedMetric = newMetric("timelinize_datasource_items_processed_total",
+		"Number of items from data sources that were stored or failed to be stored, by data source and result.",
+		metricCounter, nil, "data_source", "result")
+	itemStoreDurationMetric = newMetric("timelinize_item_store_duration_seconds",
+		"How long it took to store items in the database, by classification.",
+		metricHistogram, itemStoreBuckets, "category")
+
+	dbLockWaitMetric = newMetric("timelinize_db_lock_wait_seconds",
+		"How long writes waited to acquire the database lock, by operation.",
+		metricHistogram, dbBuckets, "operation")
+	dbTransactionMetric = newMetric("timelinize_db_transaction_duration_seconds",
+		"How long committed write transactions took, by operation.",
+		metricHistogram, dbBuckets, "operation")
+
+	workerPoolMetric = newMetric("timelinize_worker_pool_tasks",
+		"State of worker pools (including the media and thumbnail workers): active and queued tasks, and pool size.",
+		metricGauge, nil, "pool", "state")
+	thumbnailCacheMetric = newMetric("timelinize_thumbnail_cache_lookups_total",
+		"Number of thumbnails that were already generated (hit) or had to be generated (miss).",
+		metricCounter, nil, "result")
+
+	_ = newRuntimeMetric("timelinize_go_goroutines",
+		"Number of goroutines.", metricGauge, "/sched/goroutines:goroutines")
+	_ = newRuntimeMetric("timelinize_go_heap_bytes",
+		"Memory occupied by live and not-yet-freed heap objects.", metricGauge, "/memory/classes/heap/objects:bytes")
+	_ = newRuntimeMetric("timelinize_go_memory_bytes",
+		"All memory mapped by the Go runtime.", metricGauge, "/memory/classes/total:bytes")
+	_ = newRuntimeMetric("timelinize_go_gc_cycles_total",
+		"Number of completed garbage collection cycles.", metricCounter, "/gc/cycles/total:gc-cycles")
+)
+
+// Histogram buckets, in seconds.
+var (
+	jobDurationBuckets = []float64{1, 5, 15, 60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600}
+	itemStoreBuckets   = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1}
+	dbBuckets          = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// observeJobStart records that a job of type t started running.
+func observeJobStart(t JobType) {
+	jobsStartedMetric.add(1, string(t))
+	jobsRunningMetric.add(1, string(t))
+}
+
+// observeJobEnd records that a job of type t stopped running in state
+// after running for d.
+func observeJobEnd(t JobType, state JobState, d time.Duration) {
+	jobsRunningMetric.add(-1, string(t))
+	jobsFinishedMetric.add(1, string(t), string(state))
+	jobDurationMetric.observe(d.Seconds(), string(t))
+}
+
+// observeDBWrite records how long a write operation waited for the
+// database lock, and how long its transaction took; a transaction
+// duration of 0 means it didn't commit, and is not recorded.
+func observeDBWrite(operation string, lockWait, txn time.Duration) {
+	dbLockWaitMetric.observe(lockWait.Seconds(), operation)
+	if txn > 0 {
+		dbTransactionMetric.observe(txn.Seconds(), operation)
+	}
+}
+
+// Metric is the current value(s) of a metric, as returned by MetricsSnapshot.
+type Metric struct {
+	Name    string         `json:"name"`
+	Help    string         `json:"help"`
+	Type    string         `json:"type"` // counter, gauge, or histogram
+	Samples []MetricSample `json:"samples,omitempty"`
+}
+
+// MetricSample is the value of a metric with one set of labels. Counters
+// and gauges have a Value; histograms have a Count, Sum, and Buckets.
+type MetricSample struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Value   float64           `json:"value"`
+	Count   uint64            `json:"count,omitempty"`
+	Sum     float64           `json:"sum,omitempty"`
+	Buckets []MetricBucket    `json:"buckets,omitempty"`
+}
+
+// MetricBucket is the number of observations of a histogram that were at
+// most UpperBound (buckets are cumulative, and the last one, which isn't
+// included, would be +Inf with the total count).
+type MetricBucket struct {
+	UpperBound float64 `json:"upper_bound"`
+	Count      uint64  `json:"count"`
+}
+
+// MetricsSnapshot returns the current values of all metrics, sorted by
+// name, so that the UI can poll them. The returned values are owned by
+// the caller.
+func MetricsSnapshot() []Metric {
+	out := make([]Metric, 0, len(allMetrics))
+	for _, m := range allMetrics {
+		out = append(out, m.snapshot())
+	}
+	slices.SortFunc(out, func(a, b Metric) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// MetricsHandler returns an HTTP handler that serves all metrics in the
+// Prometheus text exposition format, suitable for a /metrics endpoint.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, m := range MetricsSnapshot() {
+			writePrometheusMetric(bw, m)
+		}
+		bw.Flush()
+	})
+}
+
+// writePrometheusMetric writes m in the Prometheus text format.
+func writePrometheusMetric(w *bufio.Writer, m Metric) {
+	w.WriteString("# HELP " + m.Name + " " + prometheusHelpEscaper.Replace(m.Help) + "\n")
+	w.WriteString("# TYPE " + m.Name + " " + m.Type + "\n")
+	for _, s := range m.Samples {
+		if m.Type != metricHistogram {
+			writePrometheusSample(w, m.Name, s.Labels, "", "", s.Value)
+			continue
+		}
+		for _, b := range s.Buckets {
+			writePrometheusSample(w, m.Name+"_bucket", s.Labels, "le", formatMetricValue(b.UpperBound), float64(b.Count))
+		}
+		writePrometheusSample(w, m.Name+"_bucket", s.Labels, "le", "+Inf", float64(s.Count))
+		writePrometheusSample(w, m.Name+"_sum", s.Labels, "", "", s.Sum)
+		writePrometheusSample(w, m.Name+"_count", s.Labels, "", "", float64(s.Count))
+	}
+}
+
+// writePrometheusSample writes one line with the given name, labels (plus
+// an extra label, if extraName is not empty), and value.
+func writePrometheusSample(w *bufio.Writer, name string, labels map[string]string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		names := make([]string, 0, len(labels))
+		for k := range labels {
+			names = append(names, k)
+		}
+		slices.Sort(names)
+		w.WriteByte('{')
+		for i, k := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(k + `="` + prometheusLabelEscaper.Replace(labels[k]) + `"`)
+		}
+		if extraName != "" {
+			if len(names) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + formatMetricValue(value) + "\n")
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	prometheusHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// Metric types, named as in the Prometheus text format.
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// allMetrics are all the metrics, in the order they were created.
+var allMetrics []*metric
+
+// metric is a counter, gauge, or histogram with zero or more labels. Each
+// combination of label values is a series; series are created when they
+// are first used. A metric may instead have a function that returns its
+// value, in which case it has no labels.
+type metric struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64 // upper bounds, for histograms
+	value            func() float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries // keyed by the joined label values
+}
+
+// metricSeries is the value of a metric with one set of label values.
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counters and gauges
+	count       uint64   // histograms
+	sum         float64  // histograms
+	counts      []uint64 // histograms: observations in each bucket (not cumulative)
+}
+
+// newMetric creates a metric and adds it to the list of all metrics.
+func newMetric(name, help, kind string, buckets []float64, labels ...string) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+// newRuntimeMetric creates a metric whose value is the runtime metric
+// with the given name (see the runtime/metrics package), which must be
+// a uint64 value.
+func newRuntimeMetric(name, help, kind, runtimeName string) *metric {
+	m := newMetric(name, help, kind, nil)
+	m.value = func() float64 {
+		sample := []runtimemetrics.Sample{{Name: runtimeName}}
+		runtimemetrics.Read(sample)
+		if sample[0].Value.Kind() != runtimemetrics.KindUint64 {
+			return 0
+		}
+		return float64(sample[0].Value.Uint64())
+	}
+	return m
+}
+
+// get returns the series with the given label values, creating it if
+// necessary. m.mu must be locked.
+func (m *metric) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: slices.Clone(labelValues)}
+		if m.kind == metricHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds delta to the value of a counter or gauge.
+func (m *metric) add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value += delta
+	m.mu.Unlock()
+}
+
+// set sets the value of a gauge.
+func (m *metric) set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value = value
+	m.mu.Unlock()
+}
+
+// observe adds an observation to a histogram.
+func (m *metric) observe(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	s.count++
+	s.sum += value
+	if i, _ := slices.BinarySearch(m.buckets, value); i < len(s.counts) {
+		s.counts[i]++
+	}
+}
+
+// snapshot returns the current values of m, with series sorted by their
+// label values.
+func (m *metric) snapshot() Metric {
+	out := Metric{Name: m.name, Help: m.help, Type: m.kind}
+	if m.value != nil {
+		out.Samples = []MetricSample{{Value: m.value()}}
+		return out
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		sample := MetricSample{Value: s.value}
+		if len(m.labels) > 0 {
+			sample.Labels = make(map[string]string, len(m.labels))
+			for i, name := range m.labels {
+				sample.Labels[name] = s.labelValues[i]
+			}
+		}
+		if m.kind == metricHistogram {
+			sample.Value = 0
+			sample.Count, sample.Sum = s.count, s.sum
+			sample.Buckets = make([]MetricBucket, len(m.buckets))
+			var cumulative uint64
+			for i, bound := range m.buckets {
+				cumulative += s.counts[i]
+				sample.Buckets[i] = MetricBucket{UpperBound: bound, Count: cumulative}
+			}
+		}
+		out.Samples = append(out.Samples, sample)
+	}
+	return out
+}
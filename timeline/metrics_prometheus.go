@@ -0,0 +1,72 @@
+//go:build prometheus
+
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterMetrics registers the metrics of the job engine, data sources,
+// database, and media processing (see MetricsSnapshot) with reg, for
+// programs that serve their own Prometheus registry instead of using
+// MetricsHandler.
+//
+// This is only available when built with the "prometheus" build tag.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	return reg.Register(metricsCollector{})
+}
+
+// metricsCollector collects the values of all metrics.
+type metricsCollector struct{}
+
+func (metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range allMetrics {
+		ch <- m.desc()
+	}
+}
+
+func (metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range allMetrics {
+		desc := m.desc()
+		for _, s := range m.snapshot().Samples {
+			labelValues := make([]string, len(m.labels))
+			for i, name := range m.labels {
+				labelValues[i] = s.Labels[name]
+			}
+			switch m.kind {
+			case metricCounter:
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, s.Value, labelValues...)
+			case metricGauge:
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, s.Value, labelValues...)
+			case metricHistogram:
+				buckets := make(map[float64]uint64, len(s.Buckets))
+				for _, b := range s.Buckets {
+					buckets[b.UpperBound] = b.Count
+				}
+				ch <- prometheus.MustNewConstHistogram(desc, s.Count, s.Sum, buckets, labelValues...)
+			}
+		}
+	}
+}
+
+func (m *metric) desc() *prometheus.Desc {
+	return prometheus.NewDesc(m.name, m.help, m.labels, nil)
+}
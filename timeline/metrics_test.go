@@ -0,0 +1,111 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	// metrics are global to the process, so use labels that are unique to
+	// this run of the test, in case it is run more than once (-count)
+	label := "metrics_test_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	jobType := JobType(label)
+	observeJobStart(jobType)
+	observeJobStart(jobType)
+	observeJobEnd(jobType, JobSucceeded, 3*time.Second)
+	dbLockWaitMetric.observe(0.002, label)
+	dbLockWaitMetric.observe(0.02, label)
+	dbLockWaitMetric.observe(60, label)
+	workerPoolMetric.set(2, `metrics "test"`, "active")
+
+	find := func(name string, labels map[string]string) MetricSample {
+		t.Helper()
+		for _, m := range MetricsSnapshot() {
+			if m.Name != name {
+				continue
+			}
+		samples:
+			for _, s := range m.Samples {
+				for k, v := range labels {
+					if s.Labels[k] != v {
+						continue samples
+					}
+				}
+				return s
+			}
+		}
+		t.Fatalf("no sample of %s with labels %v", name, labels)
+		return MetricSample{}
+	}
+
+	if s := find("timelinize_jobs_started_total", map[string]string{"type": string(jobType)}); s.Value != 2 {
+		t.Errorf("expected 2 jobs started, got %v", s.Value)
+	}
+	if s := find("timelinize_jobs_running", map[string]string{"type": string(jobType)}); s.Value != 1 {
+		t.Errorf("expected 1 job running, got %v", s.Value)
+	}
+	if s := find("timelinize_jobs_finished_total", map[string]string{"type": string(jobType), "state": string(JobSucceeded)}); s.Value != 1 {
+		t.Errorf("expected 1 job finished, got %v", s.Value)
+	}
+
+	s := find("timelinize_db_lock_wait_seconds", map[string]string{"operation": label})
+	if s.Count != 3 || s.Sum != 60.022 {
+		t.Errorf("expected 3 observations summing to 60.022, got %d and %v", s.Count, s.Sum)
+	}
+	for _, b := range s.Buckets {
+		var expected uint64
+		switch {
+		case b.UpperBound >= 0.02:
+			expected = 2
+		case b.UpperBound >= 0.002:
+			expected = 1
+		}
+		if b.Count != expected {
+			t.Errorf("expected %d observations at most %v, got %d", expected, b.UpperBound, b.Count)
+		}
+	}
+
+	if s := find("timelinize_go_goroutines", nil); s.Value < 1 {
+		t.Errorf("expected at least 1 goroutine, got %v", s.Value)
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, line := range []string{
+		"# TYPE timelinize_jobs_started_total counter",
+		`timelinize_jobs_started_total{type="` + label + `"} 2`,
+		`timelinize_jobs_finished_total{state="succeeded",type="` + label + `"} 1`,
+		"# TYPE timelinize_db_lock_wait_seconds histogram",
+		`timelinize_db_lock_wait_seconds_bucket{operation="` + label + `",le="0.005"} 1`,
+		`timelinize_db_lock_wait_seconds_bucket{operation="` + label + `",le="+Inf"} 3`,
+		`timelinize_db_lock_wait_seconds_count{operation="` + label + `"} 3`,
+		`timelinize_worker_pool_tasks{pool="metrics \"test\"",state="active"} 2`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected line %q in metrics output:\n%s", line, body)
+		}
+	}
+}
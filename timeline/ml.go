@@ -265,7 +265,11 @@ func (ej embeddingJob) generateEmbeddingForItem(ctx context.Context, job *Active
 
 	// convert data file path (if there is one) into a full filename
 	if dataFile != nil {
-		fn := job.tl.FullPath(*dataFile)
+		fn, done, err := job.tl.DecryptedPath(*dataFile)
+		if err != nil {
+			return fmt.Errorf("opening data file: %w", err)
+		}
+		defer done()
 		filename = &fn
 	}
 	// if the item is text content in the DB, set the data as it so it gets passed in for an embedding
@@ -352,8 +356,7 @@ func generateEmbedding(ctx context.Context, dataType string, data []byte, filena
 	req.Header.Set("Content-Type", dataType)
 
 	// throttle expensive operation
-	cpuIntensiveThrottle <- struct{}{}
-	defer func() { <-cpuIntensiveThrottle }()
+	defer acquireCPUIntensiveThrottle()()
 
 	// check here in case the job was cancelled while we waited on the throttle
 	if err := ctx.Err(); err != nil {
@@ -22,6 +22,8 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/timelinize/timelinize/oauth2client"
 	"golang.org/x/oauth2"
@@ -84,10 +86,11 @@ func (acc Account) NewOAuth2HTTPClient(ctx context.Context, oa OAuth2) (*http.Cl
 	// but wrapping the underlying token source so we can persist any
 	// changes to the database
 	return oauth2.NewClient(ctx, &persistedTokenSource{
-		tl:        acc.tl,
-		ts:        src,
-		accountID: acc.ID,
-		token:     tkn,
+		tl:         acc.tl,
+		ts:         src,
+		providerID: oa.ProviderID,
+		accountID:  acc.ID,
+		token:      tkn,
 	}), nil
 }
 
@@ -106,21 +109,24 @@ func authorizeWithOAuth2(ctx context.Context, oc OAuth2) ([]byte, error) {
 // a particular account and persists any changes
 // to the account's token to the database.
 type persistedTokenSource struct {
-	tl        *Timeline
-	ts        oauth2.TokenSource
-	accountID int64
-	token     *oauth2.Token
+	tl         *Timeline
+	ts         oauth2.TokenSource
+	providerID string
+	accountID  int64
+	token      *oauth2.Token
 }
 
 func (ps *persistedTokenSource) Token() (*oauth2.Token, error) {
 	tkn, err := ps.ts.Token()
 	if err != nil {
+		LogTokenRefresh(ps.providerID, strconv.FormatInt(ps.accountID, 10), false, err, time.Time{})
 		return tkn, err
 	}
 
 	// store an updated token in the DB
-	if tkn.AccessToken != ps.token.AccessToken {
+	if ps.token == nil || tkn.AccessToken != ps.token.AccessToken {
 		ps.token = tkn
+		LogTokenRefresh(ps.providerID, strconv.FormatInt(ps.accountID, 10), true, nil, tkn.Expiry)
 
 		authBytes, err := marshalGob(tkn)
 		if err != nil {
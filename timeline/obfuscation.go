@@ -322,6 +322,7 @@ func (sr *SearchResult) Anonymize(opts ObfuscationOptions) {
 
 	sr.ItemRow.Anonymize(opts)
 	sr.Entity.Anonymize(opts)
+	sr.Snippet = "" // excerpt of the real content
 
 	for _, rel := range sr.Related {
 		rel.FromEntity.Anonymize(opts)
@@ -423,14 +424,9 @@ func (ir *ItemRow) Anonymize(opts ObfuscationOptions) {
 	faker := gofakeit.New(ir.ID)
 
 	if ir.Latitude != nil && ir.Longitude != nil {
-		for _, locob := range opts.Locations {
-			if locob.Contains(*ir.Latitude, *ir.Longitude) {
-				lat, lon := locob.Obfuscate(*ir.Latitude, *ir.Longitude, ir.ID)
-				ir.Latitude = &lat
-				ir.Longitude = &lon
-				break
-			}
-		}
+		lat, lon := opts.obfuscateLocation(*ir.Latitude, *ir.Longitude, ir.ID)
+		ir.Latitude = &lat
+		ir.Longitude = &lon
 	}
 
 	if ir.DataText != nil {
@@ -580,6 +576,89 @@ type ObfuscatedLocation struct {
 	RadiusMeters int     `json:"radius_meters,omitempty"`
 }
 
+// obfuscateLocation returns the obfuscated coordinates if they are in one of
+// the obfuscated locations; otherwise it returns them unchanged. The seed
+// makes the obfuscation consistent, so it should be the ID of the item.
+func (opts ObfuscationOptions) obfuscateLocation(lat, lon float64, seed uint64) (float64, float64) {
+	for _, locob := range opts.Locations {
+		if locob.Contains(lat, lon) {
+			return locob.Obfuscate(lat, lon, seed)
+		}
+	}
+	return lat, lon
+}
+
+// Anonymize obfuscates the location.
+func (p *GeoPoint) Anonymize(opts ObfuscationOptions) {
+	p.Latitude, p.Longitude = opts.obfuscateLocation(p.Latitude, p.Longitude, p.ItemID)
+}
+
+// Anonymize obfuscates the location and extent of the cluster.
+func (c *GeoCluster) Anonymize(opts ObfuscationOptions) {
+	c.Latitude, c.Longitude = opts.obfuscateLocation(c.Latitude, c.Longitude, c.ItemID)
+	c.Bounds.MinLatitude, c.Bounds.MinLongitude = opts.obfuscateLocation(c.Bounds.MinLatitude, c.Bounds.MinLongitude, c.ItemID)
+	c.Bounds.MaxLatitude, c.Bounds.MaxLongitude = opts.obfuscateLocation(c.Bounds.MaxLatitude, c.Bounds.MaxLongitude, c.ItemID)
+}
+
+// Anonymize obfuscates the coordinates of the path.
+func (p *GeoPath) Anonymize(opts ObfuscationOptions) {
+	seed := uint64(p.Start.UnixMilli()) //nolint:gosec // just a seed
+	for i, coord := range p.Coordinates {
+		lat, lon := opts.obfuscateLocation(coord[1], coord[0], seed+uint64(i)) //nolint:gosec
+		p.Coordinates[i] = [2]float64{lon, lat}
+	}
+}
+
+// Anonymize clears the identifying details of where the merged item came from.
+func (src *ItemSource) Anonymize(_ ObfuscationOptions) {
+	src.OriginalID, src.OriginalLocation, src.IntermediateLocation = nil, nil, nil
+	src.Filename, src.Metadata = nil, nil
+}
+
+// Anonymize obfuscates the entities of the suggestion.
+func (s *MergeSuggestion) Anonymize() {
+	s.Entity.Anonymize()
+	s.OtherEntity.Anonymize()
+}
+
+// Anonymize obfuscates the name of the merged entity the same way as the entity itself.
+func (m *EntityMerge) Anonymize() {
+	merged := Entity{ID: m.MergedEntityID, Name: m.MergedName}
+	merged.Anonymize()
+	m.MergedName = merged.Name
+}
+
+// Anonymize obfuscates the name of the node the same way as the entity or
+// item text itself.
+func (n *GraphNode) Anonymize(opts ObfuscationOptions) {
+	if n.Name == "" {
+		return
+	}
+	if n.EntityID != 0 {
+		ent := Entity{ID: n.EntityID, Name: n.Name}
+		ent.Anonymize()
+		n.Name = ent.Name
+		return
+	}
+	ir := ItemRow{ID: n.ItemID, DataText: &n.Name}
+	ir.Anonymize(opts)
+	n.Name = *ir.DataText
+}
+
+// Anonymize obfuscates the nodes of the results.
+func (gr *GraphResults) Anonymize(opts ObfuscationOptions) {
+	for i := range gr.Nodes {
+		gr.Nodes[i].Anonymize(opts)
+	}
+}
+
+// Anonymize obfuscates the entities of the co-occurrence.
+func (co *CoOccurrence) Anonymize(opts ObfuscationOptions) {
+	for i := range co.Entities {
+		co.Entities[i].Anonymize(opts)
+	}
+}
+
 // Contains returns true if the circle approximately contains the given coordinate.
 func (l ObfuscatedLocation) Contains(lat, lon float64) bool {
 	return haversineDistanceMeters(l.Lat, l.Lon, lat, lon) < float64(l.RadiusMeters)
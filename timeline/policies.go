@@ -0,0 +1,544 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Policy is a rule for purging a class of data from the timeline, like
+// "delete browser history older than a year" or "redact items that
+// mention this person". Policies are stored in the timeline and enforced
+// by jobs (see EnforcePolicies and SchedulePolicies); use PolicyDryRun to
+// see what a policy would affect first.
+//
+// An item is affected if it matches all the criteria that are set; at
+// least one must be set.
+type Policy struct {
+	ID           uint64     `json:"id,omitempty"`
+	Name         string     `json:"name,omitempty"`
+	Created      time.Time  `json:"created,omitempty"`
+	LastEnforced *time.Time `json:"last_enforced,omitempty"`
+
+	Action PolicyAction `json:"action"`
+
+	// Items from these data sources (by name).
+	DataSources []string `json:"data_sources,omitempty"`
+
+	// Items of these classifications (by name).
+	Classifications []string `json:"classifications,omitempty"`
+
+	// Items whose timestamp is longer ago than this.
+	OlderThan time.Duration `json:"older_than,omitempty"`
+
+	// Items that mention any of these entities: those that are attributed
+	// to them, that are related to them (like messages sent to them), or
+	// whose text has their name in it.
+	Entities []uint64 `json:"entities,omitempty"`
+
+	// For PolicyDelete, how long deleted items stay in the trash before
+	// they are erased (see DeleteOptions).
+	Retain *time.Duration `json:"retain,omitempty"`
+}
+
+// PolicyAction is what a policy does to the items it affects.
+type PolicyAction string
+
+const (
+	// PolicyDelete deletes the items, remembering them so that they
+	// aren't imported again (see DeleteOptions.Remember).
+	PolicyDelete PolicyAction = "delete"
+
+	// PolicyRedact erases the content of the items (text, data file,
+	// metadata, and location), but keeps the items themselves, with
+	// their timestamps and relationships. Redacted items are not
+	// restored by imports.
+	PolicyRedact PolicyAction = "redact"
+)
+
+func (pol Policy) validate() error {
+	switch pol.Action {
+	case PolicyDelete, PolicyRedact:
+	default:
+		return fmt.Errorf("unknown policy action: %q", pol.Action)
+	}
+	if len(pol.DataSources) == 0 && len(pol.Classifications) == 0 && pol.OlderThan == 0 && len(pol.Entities) == 0 {
+		return errors.New("a policy needs at least one criterion, so it doesn't affect every item")
+	}
+	if pol.OlderThan < 0 {
+		return fmt.Errorf("invalid age: %s", pol.OlderThan)
+	}
+	return nil
+}
+
+// PolicyReport is what a policy affects (or would affect, in a dry run).
+type PolicyReport struct {
+	PolicyID  uint64         `json:"policy_id,omitempty"`
+	Items     int            `json:"items"`
+	DataFiles int            `json:"data_files"`                  // files of the items in the repo
+	ByClass   map[string]int `json:"by_classification,omitempty"` // item counts by classification
+}
+
+// AddPolicy validates and stores the policy, and returns its ID. It does
+// not enforce the policy.
+func (tl *Timeline) AddPolicy(ctx context.Context, pol Policy) (uint64, error) {
+	if err := pol.validate(); err != nil {
+		return 0, err
+	}
+	pol.ID, pol.Created, pol.LastEnforced = 0, time.Time{}, nil // these are columns of their own
+	definition, err := json.Marshal(pol)
+	if err != nil {
+		return 0, fmt.Errorf("JSON-encoding policy: %w", err)
+	}
+
+	tl.dbMu.Lock()
+	var id uint64
+	err = tl.db.QueryRowContext(ctx, `INSERT INTO policies (name, definition) VALUES (?, ?) RETURNING id`,
+		nullString(pol.Name), string(definition)).Scan(&id)
+	tl.dbMu.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("inserting policy: %w", err)
+	}
+
+	Log.Named("policy").Info("added policy",
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("policy_id", id),
+		zap.String("action", string(pol.Action)))
+
+	return id, nil
+}
+
+// Policies returns the policies with the given IDs, or all of them if none
+// are given.
+func (tl *Timeline) Policies(ctx context.Context, ids ...uint64) ([]Policy, error) {
+	query := `SELECT id, definition, created, last_enforced FROM policies`
+	var args []any
+	if len(ids) > 0 {
+		var in string
+		in, args = sqlArray(ids)
+		query += ` WHERE id IN ` + in
+	}
+	query += ` ORDER BY id`
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []Policy
+	for rows.Next() {
+		var id uint64
+		var definition string
+		var created int64
+		var enforced *int64
+		if err := rows.Scan(&id, &definition, &created, &enforced); err != nil {
+			return nil, fmt.Errorf("scanning policy: %w", err)
+		}
+		var pol Policy
+		if err := json.Unmarshal([]byte(definition), &pol); err != nil {
+			return nil, fmt.Errorf("decoding policy %d: %w", id, err)
+		}
+		pol.ID = id
+		pol.Created = time.Unix(created, 0)
+		if enforced != nil {
+			t := time.Unix(*enforced, 0)
+			pol.LastEnforced = &t
+		}
+		policies = append(policies, pol)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 && len(policies) != len(ids) {
+		return nil, fmt.Errorf("found %d of %d policies", len(policies), len(ids))
+	}
+	return policies, nil
+}
+
+// DeletePolicy deletes the policy with the given ID. Items that it already
+// deleted or redacted stay that way.
+func (tl *Timeline) DeletePolicy(ctx context.Context, id uint64) error {
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+	_, err := tl.db.ExecContext(ctx, `DELETE FROM policies WHERE id=?`, id)
+	return err
+}
+
+// PolicyDryRun reports what the policy would affect if it was enforced now,
+// without changing anything. The policy doesn't have to be stored.
+func (tl *Timeline) PolicyDryRun(ctx context.Context, pol Policy) (PolicyReport, error) {
+	if err := pol.validate(); err != nil {
+		return PolicyReport{}, err
+	}
+	where, args, err := tl.policyCriteria(ctx, pol, time.Now())
+	if err != nil {
+		return PolicyReport{}, err
+	}
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `
+		SELECT coalesce(classifications.name, ''), count(), count(items.data_file)
+		FROM items
+		LEFT JOIN data_sources ON data_sources.id = items.data_source_id
+		LEFT JOIN classifications ON classifications.id = items.classification_id
+		WHERE `+where+`
+		GROUP BY items.classification_id`, args...)
+	if err != nil {
+		return PolicyReport{}, fmt.Errorf("counting affected items: %w", err)
+	}
+	defer rows.Close()
+
+	report := PolicyReport{PolicyID: pol.ID, ByClass: make(map[string]int)}
+	for rows.Next() {
+		var class string
+		var items, dataFiles int
+		if err := rows.Scan(&class, &items, &dataFiles); err != nil {
+			return PolicyReport{}, err
+		}
+		report.Items += items
+		report.DataFiles += dataFiles
+		report.ByClass[class] += items
+	}
+	return report, rows.Err()
+}
+
+// EnforcePolicies creates a job that enforces the policies with the given
+// IDs, or all of them if none are given, and returns its ID. If dryRun is
+// true, the job only logs what the policies would affect.
+func (tl *Timeline) EnforcePolicies(policyIDs []uint64, dryRun bool) (uint64, error) {
+	return tl.CreateJob(policyJob{PolicyIDs: policyIDs, DryRun: dryRun}, time.Time{}, 0, 0, 0)
+}
+
+// SchedulePolicies creates a schedule that enforces the policies with the
+// given IDs (or all of them, as of each run, if none are given) when spec
+// calls for it, and returns its ID (see CreateSchedule).
+func (tl *Timeline) SchedulePolicies(ctx context.Context, policyIDs []uint64, spec ScheduleSpec) (uint64, error) {
+	return tl.CreateSchedule(ctx, policyJob{PolicyIDs: policyIDs}, spec)
+}
+
+// policyCriteria returns the WHERE clause, and its arguments, that selects
+// the items (aliased as items, joined with data_sources and classifications)
+// that pol affects. Items that were deleted are never affected, nor are
+// redacted items by redaction.
+func (tl *Timeline) policyCriteria(ctx context.Context, pol Policy, now time.Time) (string, []any, error) {
+	clauses := []string{"items.deleted IS NULL"}
+	var args []any
+
+	if pol.Action == PolicyRedact {
+		clauses = append(clauses, "items.id NOT IN (SELECT item_id FROM redacted_items)")
+	}
+	if len(pol.DataSources) > 0 {
+		clauses = append(clauses, "data_sources.name IN "+sqlPlaceholders(len(pol.DataSources)))
+		for _, ds := range pol.DataSources {
+			args = append(args, ds)
+		}
+	}
+	if len(pol.Classifications) > 0 {
+		clauses = append(clauses, "classifications.name IN "+sqlPlaceholders(len(pol.Classifications)))
+		for _, class := range pol.Classifications {
+			args = append(args, class)
+		}
+	}
+	if pol.OlderThan > 0 {
+		clauses = append(clauses, "items.timestamp < ?")
+		args = append(args, now.Add(-pol.OlderThan).UnixMilli())
+	}
+	if len(pol.Entities) > 0 {
+		entityIn, entityArgs := sqlArray(pol.Entities)
+		attributes := `(SELECT attribute_id FROM entity_attributes WHERE entity_id IN ` + entityIn + `)`
+		mentions := []string{
+			"items.attribute_id IN " + attributes,
+			"items.id IN (SELECT from_item_id FROM relationships WHERE to_attribute_id IN " + attributes + ")",
+			"items.id IN (SELECT to_item_id FROM relationships WHERE from_attribute_id IN " + attributes + ")",
+		}
+		for range 3 {
+			args = append(args, entityArgs...)
+		}
+
+		// the names are looked up now, rather than in a subquery, since FTS can't
+		// match a phrase that isn't known when the statement is prepared
+		names, err := tl.entityNames(ctx, pol.Entities)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, name := range names {
+			if phrase := ftsQuery(`"` + strings.ReplaceAll(name, `"`, " ") + `"`); phrase != "" {
+				mentions = append(mentions, "items.id IN (SELECT docid FROM items_fts WHERE data_text MATCH ?)")
+				args = append(args, phrase)
+			}
+		}
+
+		clauses = append(clauses, "("+strings.Join(mentions, " OR ")+")")
+	}
+
+	return strings.Join(clauses, " AND "), args, nil
+}
+
+// entityNames returns the names of the entities that have them.
+func (tl *Timeline) entityNames(ctx context.Context, entityIDs []uint64) ([]string, error) {
+	in, args := sqlArray(entityIDs)
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT name FROM entities WHERE name IS NOT NULL AND name != '' AND id IN `+in, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying entity names: %w", err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// affectedItems returns the IDs of the items that pol affects.
+func (tl *Timeline) affectedItems(ctx context.Context, pol Policy, now time.Time) ([]uint64, error) {
+	where, args, err := tl.policyCriteria(ctx, pol, now)
+	if err != nil {
+		return nil, err
+	}
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	ids, err := selectIDs(ctx, tl.db, `
+		SELECT items.id
+		FROM items
+		LEFT JOIN data_sources ON data_sources.id = items.data_source_id
+		LEFT JOIN classifications ON classifications.id = items.classification_id
+		WHERE `+where+`
+		ORDER BY items.id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("selecting affected items: %w", err)
+	}
+	itemIDs := make([]uint64, len(ids))
+	for i, id := range ids {
+		itemIDs[i] = uint64(id)
+	}
+	return itemIDs, nil
+}
+
+// redactItems erases the content of the items, and records that the
+// policy redacted them, so that imports don't restore it. Data files that
+// aren't used by other items anymore are deleted.
+func (tl *Timeline) redactItems(ctx context.Context, itemIDs []uint64, policyID uint64) error {
+	if len(itemIDs) == 0 {
+		return nil
+	}
+	in, args := sqlArray(itemIDs)
+	now := time.Now()
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var dataFiles []string
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT data_file FROM items WHERE data_file IS NOT NULL AND id IN `+in, args...)
+	if err != nil {
+		return fmt.Errorf("selecting data files of items to redact: %w", err)
+	}
+	for rows.Next() {
+		var dataFile string
+		if err := rows.Scan(&dataFile); err != nil {
+			rows.Close()
+			return err
+		}
+		dataFiles = append(dataFiles, dataFile)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE items
+		SET original_location=NULL, intermediate_location=NULL, filename=NULL,
+			data_type=NULL, data_text=NULL, data_file=NULL, data_hash=NULL, metadata=NULL,
+			longitude=NULL, latitude=NULL, altitude=NULL, coordinate_system=NULL, coordinate_uncertainty=NULL,
+			modified=?
+		WHERE id IN `+in, append([]any{now.UnixMilli()}, args...)...)
+	if err != nil {
+		return fmt.Errorf("erasing content of items: %w", err)
+	}
+	for _, id := range itemIDs {
+		_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO redacted_items (item_id, policy_id, redacted) VALUES (?, ?, ?)`,
+			id, policyID, now.Unix())
+		if err != nil {
+			return fmt.Errorf("recording redaction: %w", err)
+		}
+		// what enrichment found was derived from the content, so it goes too
+		if err := deleteEnrichments(ctx, tx, id, nil); err != nil {
+			return err
+		}
+	}
+
+	// only delete data files that other items don't use
+	var unusedFiles []string
+	for _, dataFile := range dataFiles {
+		var count int
+		if err := tx.QueryRowContext(ctx, `SELECT count() FROM items WHERE data_file=? LIMIT 1`, dataFile).Scan(&count); err != nil {
+			return fmt.Errorf("counting items that use data file: %w", err)
+		}
+		if count == 0 {
+			unusedFiles = append(unusedFiles, dataFile)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction (no data files have been deleted yet): %w", err)
+	}
+
+	if _, err := tl.deleteRepoFiles(ctx, Log, unusedFiles); err != nil {
+		Log.Error("deleting data files of redacted items (items have already been redacted in DB)", zap.Error(err))
+	}
+	if tl.thumbs != nil {
+		if err := tl.deleteThumbnails(ctx, itemIDs, unusedFiles); err != nil {
+			Log.Error("unable to delete thumbnails of redacted items", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// itemRedacted returns true if the item's content was redacted by a policy.
+func itemRedacted(ctx context.Context, tx *sql.Tx, itemID uint64) (bool, error) {
+	var count int
+	err := tx.QueryRowContext(ctx, `SELECT count() FROM redacted_items WHERE item_id=? LIMIT 1`, itemID).Scan(&count)
+	return count > 0, err
+}
+
+// policyJob is the job action that enforces policies.
+type policyJob struct {
+	// the policies to enforce; if empty, all of them
+	PolicyIDs []uint64 `json:"policy_ids,omitempty"`
+
+	// only log what the policies would affect
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+func (pj policyJob) Run(job *ActiveJob, _ []byte) error {
+	policies, err := job.tl.Policies(job.ctx, pj.PolicyIDs...)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		job.Logger().Info("no policies to enforce")
+		return nil
+	}
+
+	if pj.DryRun {
+		for _, pol := range policies {
+			report, err := job.tl.PolicyDryRun(job.ctx, pol)
+			if err != nil {
+				return fmt.Errorf("policy %d: %w", pol.ID, err)
+			}
+			job.Logger().Info("dry run of policy",
+				zap.Uint64("policy_id", pol.ID),
+				zap.String("action", string(pol.Action)),
+				zap.Int("items", report.Items),
+				zap.Int("data_files", report.DataFiles),
+				zap.Any("by_classification", report.ByClass))
+		}
+		return nil
+	}
+
+	// find every affected item up front, so that progress can be shown
+	now := time.Now()
+	affected := make([][]uint64, len(policies))
+	var total int
+	for i, pol := range policies {
+		if affected[i], err = job.tl.affectedItems(job.ctx, pol, now); err != nil {
+			return fmt.Errorf("policy %d: %w", pol.ID, err)
+		}
+		total += len(affected[i])
+	}
+	job.SetTotal(total)
+
+	for i, pol := range policies {
+		// an earlier policy may have deleted some of the items already
+		if i > 0 {
+			before := len(affected[i])
+			if affected[i], err = job.tl.affectedItems(job.ctx, pol, now); err != nil {
+				return fmt.Errorf("policy %d: %w", pol.ID, err)
+			}
+			if len(affected[i]) != before {
+				total -= before - len(affected[i])
+				job.SetTotal(total)
+			}
+		}
+
+		for chunk := range slices.Chunk(affected[i], policyChunkSize) {
+			if err := job.Continue(); err != nil {
+				return err
+			}
+			switch pol.Action {
+			case PolicyDelete:
+				err = job.tl.DeleteItems(job.ctx, chunk, DeleteOptions{Remember: true, Retain: pol.Retain})
+			case PolicyRedact:
+				err = job.tl.redactItems(job.ctx, chunk, pol.ID)
+			}
+			if err != nil {
+				return fmt.Errorf("policy %d: %w", pol.ID, err)
+			}
+			job.Progress(len(chunk))
+		}
+
+		job.tl.dbMu.Lock()
+		_, err = job.tl.db.ExecContext(job.ctx, `UPDATE policies SET last_enforced=? WHERE id=?`, now.Unix(), pol.ID)
+		job.tl.dbMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("recording enforcement of policy %d: %w", pol.ID, err)
+		}
+
+		job.Logger().Info("enforced policy",
+			zap.Uint64("policy_id", pol.ID),
+			zap.String("action", string(pol.Action)),
+			zap.Int("items", len(affected[i])))
+	}
+
+	return nil
+}
+
+// policyChunkSize is how many items a policy job changes per transaction.
+const policyChunkSize = 500
@@ -0,0 +1,178 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPolicies(t *testing.T) {
+	ctx := context.Background()
+	tl := newTestTimeline(t)
+
+	// Alice sent an old message and a new one, and is mentioned in another
+	// new message; there is also an old note, from no data source
+	old := time.Now().AddDate(-2, 0, 0).UnixMilli()
+	recent := time.Now().Add(-time.Hour).UnixMilli()
+	if err := os.WriteFile(tl.FullPath("data/photo.jpg"), []byte("photo"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, tl, `
+		INSERT INTO attributes (id, name, value) VALUES (1, 'phone_number', '+15550001');
+		INSERT INTO entities (id, type_id, name) VALUES (1, (SELECT id FROM entity_types WHERE name='person'), 'Alice');
+		INSERT INTO entity_attributes (entity_id, attribute_id) VALUES (1, 1);
+		INSERT INTO items (id, data_source_id, original_id, attribute_id, timestamp, data_type, data_text) VALUES
+			(1, (SELECT id FROM data_sources WHERE name='sms'), 'msg1', 1, ?, 'text/plain', 'Old hello'),
+			(2, (SELECT id FROM data_sources WHERE name='sms'), 'msg2', 1, ?, 'text/plain', 'New hello'),
+			(3, (SELECT id FROM data_sources WHERE name='sms'), 'msg3', NULL, ?, 'text/plain', 'Ran into Alice today');
+		INSERT INTO items (id, timestamp, data_type, data_file, latitude, longitude) VALUES
+			(4, ?, 'image/jpeg', 'data/photo.jpg', 40.0, -105.0);`, old, recent, recent, old)
+
+	deleteOld := Policy{Action: PolicyDelete, DataSources: []string{"sms"}, OlderThan: 365 * 24 * time.Hour}
+	redactAlice := Policy{Action: PolicyRedact, Entities: []uint64{1}}
+
+	if _, err := tl.AddPolicy(ctx, Policy{Action: PolicyDelete}); err == nil {
+		t.Error("expected policy without criteria to be rejected")
+	}
+
+	for _, tc := range []struct {
+		policy Policy
+		items  []uint64
+	}{
+		{deleteOld, []uint64{1}},
+		{redactAlice, []uint64{1, 2, 3}},
+		{Policy{Action: PolicyRedact, OlderThan: 365 * 24 * time.Hour}, []uint64{1, 4}},
+	} {
+		report, err := tl.PolicyDryRun(ctx, tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Items != len(tc.items) {
+			t.Errorf("expected policy %+v to affect %d items, got %d", tc.policy, len(tc.items), report.Items)
+		}
+		affected, err := tl.affectedItems(ctx, tc.policy, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(affected) != len(tc.items) {
+			t.Errorf("expected policy %+v to affect items %v, got %v", tc.policy, tc.items, affected)
+		}
+	}
+
+	// a dry run didn't change anything
+	var count int
+	if err := tl.db.QueryRow(`SELECT count() FROM items WHERE deleted IS NULL AND data_text IS NOT NULL`).Scan(&count); err != nil || count != 3 {
+		t.Fatalf("expected items to be unchanged by dry runs, found %d with text (%v)", count, err)
+	}
+
+	deleteID, err := tl.AddPolicy(ctx, deleteOld)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redactID, err := tl.AddPolicy(ctx, redactAlice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enforce := func(ids ...uint64) {
+		t.Helper()
+		job := &ActiveJob{ctx: ctx, tl: tl, logger: zap.NewNop(), statusLog: zap.NewNop()}
+		if err := (policyJob{PolicyIDs: ids}).Run(job, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enforce()
+
+	// the old message was deleted, so it isn't redacted too
+	var deleted *int64
+	if err := tl.db.QueryRow(`SELECT deleted FROM items WHERE id=1`).Scan(&deleted); err != nil {
+		t.Fatal(err)
+	}
+	if deleted == nil {
+		t.Error("expected old message to be deleted")
+	}
+	if ok, err := tl.isRedacted(ctx, 1); err != nil || ok {
+		t.Errorf("expected deleted message not to be redacted (%v)", err)
+	}
+	for _, id := range []uint64{2, 3} {
+		var text *string
+		var modified *int64
+		if err := tl.db.QueryRow(`SELECT data_text, modified FROM items WHERE id=?`, id).Scan(&text, &modified); err != nil {
+			t.Fatal(err)
+		}
+		if text != nil || modified == nil {
+			t.Errorf("expected item %d to be redacted, got text %v", id, deref(text))
+		}
+		if ok, err := tl.isRedacted(ctx, id); err != nil || !ok {
+			t.Errorf("expected redaction of item %d to be recorded (%v)", id, err)
+		}
+	}
+	if ok, err := tl.isRedacted(ctx, 4); err != nil || ok {
+		t.Errorf("expected unrelated item not to be redacted (%v)", err)
+	}
+
+	policies, err := tl.Policies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || policies[0].ID != deleteID || policies[1].ID != redactID || policies[1].LastEnforced == nil {
+		t.Errorf("expected both policies to be enforced, got %+v", policies)
+	}
+
+	// enforcing again affects nothing new
+	if report, err := tl.PolicyDryRun(ctx, redactAlice); err != nil || report.Items != 0 {
+		t.Errorf("expected no items left to redact, got %d (%v)", report.Items, err)
+	}
+
+	// redacting an item deletes its data file
+	redactPhotos := Policy{Action: PolicyRedact, OlderThan: 365 * 24 * time.Hour}
+	photoID, err := tl.AddPolicy(ctx, redactPhotos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enforce(photoID)
+	if _, err := os.Stat(tl.FullPath("data/photo.jpg")); !os.IsNotExist(err) {
+		t.Errorf("expected data file of redacted item to be deleted, got: %v", err)
+	}
+	var lat *float64
+	if err := tl.db.QueryRow(`SELECT latitude FROM items WHERE id=4`).Scan(&lat); err != nil || lat != nil {
+		t.Errorf("expected location of redacted item to be erased, got %v (%v)", lat, err)
+	}
+
+	// redactions outlive the policy
+	if err := tl.DeletePolicy(ctx, redactID); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := tl.isRedacted(ctx, 2); err != nil || !ok {
+		t.Errorf("expected redaction to remain after deleting its policy (%v)", err)
+	}
+}
+
+func (tl *Timeline) isRedacted(ctx context.Context, itemID uint64) (bool, error) {
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	return itemRedacted(ctx, tx, itemID)
+}
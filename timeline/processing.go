@@ -28,11 +28,14 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"maps"
 	"mime"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -48,12 +51,25 @@ import (
 // if not specified by the user. See the docs for batch size on ProcessingOoptions.
 const defaultBatchSize = 10
 
+// defaultBulkBatchSize is the default batch size of bulk imports.
+const defaultBulkBatchSize = 500
+
+// defaultFlushInterval is how long a batch that isn't full waits for more
+// items before it is processed, if not specified by the user.
+const defaultFlushInterval = time.Second
+
 func (p *processor) beginProcessing(ctx context.Context, po ProcessingOptions, countOnly bool, done <-chan struct{}) (*sync.WaitGroup, chan<- *Graph) {
 	wg := new(sync.WaitGroup)
 	ch := make(chan *Graph)
 
 	if po.BatchSize <= 0 {
 		po.BatchSize = defaultBatchSize
+		if po.Bulk {
+			po.BatchSize = defaultBulkBatchSize
+		}
+	}
+	if po.FlushInterval == 0 {
+		po.FlushInterval = defaultFlushInterval
 	}
 
 	wg.Add(1)
@@ -109,6 +125,15 @@ func (p *processor) beginProcessing(ctx context.Context, po ProcessingOptions, c
 			}
 		}
 
+		// a batch that isn't full is processed anyway when this fires
+		var flushTimer *time.Timer
+		var flush <-chan time.Time
+		defer func() {
+			if flushTimer != nil {
+				flushTimer.Stop()
+			}
+		}()
+
 		// read all incoming graphs and add them to a batch, and'
 		// process the batch if it is full
 		for {
@@ -147,13 +172,37 @@ func (p *processor) beginProcessing(ctx context.Context, po ProcessingOptions, c
 					atomic.AddInt64(p.estimatedCount, int64(g.Size()))
 					continue
 				}
+				if p.ij.preview != nil {
+					p.previewGraph(ctx, g)
+					p.ij.job.Progress(g.Size())
+					p.ij.flushPreview(false)
+					continue
+				}
 				if po.Interactive != nil {
 					if err := p.interactiveGraph(ctx, g, po.Interactive); err != nil {
 						p.log.Error("sending interactive graph", zap.Error(err))
 					}
 					continue
 				}
+				itemsReadMetric.add(float64(g.Size()), p.ds.Name)
 				addToBatch(g)
+
+				// start the flush timer when a batch starts filling up
+				switch {
+				case len(p.batch) == 0 && flush != nil:
+					flushTimer.Stop()
+					flush = nil
+				case len(p.batch) > 0 && flush == nil && po.FlushInterval > 0:
+					if flushTimer == nil {
+						flushTimer = time.NewTimer(po.FlushInterval)
+					} else {
+						flushTimer.Reset(po.FlushInterval)
+					}
+					flush = flushTimer.C
+				}
+			case <-flush:
+				flush = nil
+				addToBatch(nil)
 			}
 		}
 	}()
@@ -292,7 +341,17 @@ func (p *processor) tempGraphFolder() string {
 		fmt.Sprintf("job-%d", p.ij.job.ID()))
 }
 
-func (p *processor) pipeline(ctx context.Context, batch []*Graph) error {
+func (p *processor) pipeline(ctx context.Context, batch []*Graph) (err error) {
+	// count the graphs that failed, so the outcome of the job can say so
+	defer func() {
+		atomic.AddInt64(p.ij.graphCount, int64(len(batch)))
+		for _, g := range batch {
+			if err != nil || g.err != nil {
+				atomic.AddInt64(p.ij.failedGraphCount, 1)
+			}
+		}
+	}()
+
 	// During large imports, I've found that running ANALYZE every so often
 	// can be helpful for improving performance, since an import is much more
 	// than just an INSERT, there's lots of SELECTs along the way that use
@@ -305,7 +364,7 @@ func (p *processor) pipeline(ctx context.Context, batch []*Graph) error {
 		p.tl.optimizeDB(p.log.Named("optimizer"))
 	}
 
-	err := p.phase1(ctx, batch)
+	err = p.phase1(ctx, batch)
 	if err != nil {
 		return err
 	}
@@ -330,24 +389,43 @@ func (p *processor) phase1(ctx context.Context, batch []*Graph) error {
 	// TODO: maybe if we first go through the batch in a readlock, we can determine what are
 	// duplicates, before acquiring a write lock, and that could help for faster resumption
 	// (especially if we have even more workers)
+	lockStart := time.Now()
 	p.tl.dbMu.Lock()
 	defer p.tl.dbMu.Unlock()
 
+	var txnDuration time.Duration
+	txnStart := time.Now()
+	defer func() { observeDBWrite("import_items", txnStart.Sub(lockStart), txnDuration) }()
+
 	tx, err := p.tl.db.Begin()
 	if err != nil {
 		return fmt.Errorf("beginning transaction for batch: %w", err)
 	}
 	defer tx.Rollback()
 
+	txnID := NewTxnID()
+	ctx = WithTxnID(ctx, txnID)
+
+	p.addedItemIDs = nil
 	for _, g := range batch {
 		if err = p.processGraph(ctx, tx, g); err != nil {
-			p.log.Error("processing graph", zap.String("graph", g.String()), zap.Error(err))
+			p.log.Error("processing graph", zap.String("graph", g.String()), TxnField(txnID), zap.Error(err))
 			g.err = err
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("committing transaction for batch: %w", err)
+		return fmt.Errorf("committing transaction %d for batch: %w", txnID, err)
+	}
+	txnDuration = time.Since(txnStart)
+
+	if len(p.addedItemIDs) > 0 {
+		p.tl.publishEvent(EventItemsAdded, ItemsAddedEvent{
+			JobID:      p.ij.job.id,
+			DataSource: p.ds.Name,
+			ItemIDs:    p.addedItemIDs,
+		})
+		p.addedItemIDs = nil
 	}
 
 	return nil
@@ -376,28 +454,37 @@ func (p *processor) phase2(ctx context.Context, batch []*Graph) error {
 
 // phase3 updates the DB with info about the data files that were downloaded in phase 2.
 func (p *processor) phase3(ctx context.Context, batch []*Graph) error {
+	lockStart := time.Now()
 	p.tl.dbMu.Lock()
 	defer p.tl.dbMu.Unlock()
 
+	var txnDuration time.Duration
+	txnStart := time.Now()
+	defer func() { observeDBWrite("import_data_files", txnStart.Sub(lockStart), txnDuration) }()
+
 	tx, err := p.tl.db.Begin()
 	if err != nil {
 		return fmt.Errorf("beginning transaction for batch phase 3: %w", err)
 	}
 	defer tx.Rollback()
 
+	txnID := NewTxnID()
+	ctx = WithTxnID(ctx, txnID)
+
 	for _, g := range batch {
 		if g.err != nil {
 			continue
 		}
 		if err := p.finishProcessingDataFiles(ctx, tx, g); err != nil {
-			p.log.Error("finalizing data files in graph", zap.Error(err))
+			p.log.Error("finalizing data files in graph", TxnField(txnID), zap.Error(err))
 			g.err = err
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("committing transaction for batch phase 3: %w", err)
+		return fmt.Errorf("committing transaction %d for batch phase 3: %w", txnID, err)
 	}
+	txnDuration = time.Since(txnStart)
 
 	return nil
 }
@@ -440,7 +527,7 @@ func (p *processor) finishProcessingDataFiles(ctx context.Context, tx *sql.Tx, g
 		// if it will, in fact, be logged (we sample logs to increase efficiency,
 		// but those gains are most realized when we avoid our own processing if
 		// a particular log entry will be dropped too, hence the call to Check())
-		if checkedLog := p.log.Check(zapcore.InfoLevel, "finished graph"); checkedLog != nil {
+		if checkedLog := LoggerWithTxn(ctx, p.log).Check(zapcore.InfoLevel, "finished graph"); checkedLog != nil {
 			graphType := "item"
 			if g.Entity != nil {
 				graphType = "entity"
@@ -590,7 +677,7 @@ func (p *processor) processGraph(ctx context.Context, tx *sql.Tx, ig *Graph) err
 	for _, r := range ig.Edges {
 		err := p.processRelationship(ctx, tx, r, ig)
 		if err != nil {
-			p.log.Error("processing relationship",
+			LoggerWithTxn(ctx, p.log).Error("processing relationship",
 				zap.Uint64("item_or_attribute_row_id", ig.rowID.id()),
 				zap.Error(err))
 		}
@@ -606,7 +693,7 @@ func (p *processor) processItem(ctx context.Context, tx *sql.Tx, it *Item) (late
 	// TODO: also consider Timespan
 	if !it.Timestamp.IsZero() {
 		if !p.ij.ProcessingOptions.Timeframe.Contains(it.Timestamp) {
-			p.log.Warn("ignoring item outside of designated timeframe (data source should not send this item; it is probably being less efficient than it could be)",
+			LoggerWithTxn(ctx, p.log).Warn("ignoring item outside of designated timeframe (data source should not send this item; it is probably being less efficient than it could be)",
 				zap.String("item_id", it.ID),
 				zap.Timep("tf_since", p.ij.ProcessingOptions.Timeframe.Since),
 				zap.Timep("tf_until", p.ij.ProcessingOptions.Timeframe.Until),
@@ -622,14 +709,26 @@ func (p *processor) processItem(ctx context.Context, tx *sql.Tx, it *Item) (late
 		}
 	}
 
+	start := time.Now()
 	itemRowID, err := p.storeItem(ctx, tx, it)
 	if err != nil {
+		itemsProcessedMetric.add(1, p.ds.Name, "failed")
 		return latentID{itemID: itemRowID}, err
 	}
+	itemsProcessedMetric.add(1, p.ds.Name, "stored")
+	ObserveItemLatency(itemLatencyCategory(it), time.Since(start))
 
 	return latentID{itemID: itemRowID}, nil
 }
 
+// itemLatencyCategory returns the category of it for latency statistics.
+func itemLatencyCategory(it *Item) string {
+	if it.Classification.Name == "" {
+		return "unclassified"
+	}
+	return it.Classification.Name
+}
+
 // TODO: godoc about return value of 0, nil
 func (p *processor) storeItem(ctx context.Context, tx *sql.Tx, it *Item) (uint64, error) {
 	// keep count of number of items processed, mainly for logging
@@ -670,16 +769,7 @@ func (p *processor) storeItem(ctx context.Context, tx *sql.Tx, it *Item) (uint64
 				// the buffered reader when we save the file
 				it.dataFileIn = io.NopCloser(fileReader)
 
-				// if the item classification is missing, but the item is clearly
-				// a common media type, we can probably classify the item anyway
-				// TODO: not sure if a good idea... ho hum.
-				if it.Classification.Name == "" {
-					if strings.HasPrefix(it.Content.MediaType, "image/") ||
-						strings.HasPrefix(it.Content.MediaType, "video/") ||
-						strings.HasPrefix(it.Content.MediaType, "audio/") {
-						it.Classification = ClassMedia
-					}
-				}
+				inferMediaClassification(it)
 			}
 
 			if it.Content.isPlainTextOrMarkdown() {
@@ -757,6 +847,23 @@ func (p *processor) storeItem(ctx context.Context, tx *sql.Tx, it *Item) (uint64
 			it.existingRow = ir // we might need this in phase 3
 		}
 
+		// items that were deleted or redacted stay that way, even if the
+		// data source still has them (or gives us more of them)
+		tombstone := ir.Deleted != nil
+		if !tombstone {
+			if tombstone, err = itemRedacted(ctx, tx, ir.ID); err != nil {
+				return 0, fmt.Errorf("checking whether item was redacted: %w", err)
+			}
+		}
+		if tombstone {
+			processDataFile = false
+			atomic.AddInt64(p.ij.skippedItemCount, 1)
+			LogSkip(p.log, it.ID, SkipDeleted, zap.Uint64("row_id", ir.ID))
+			ir.howStored = itemSkipped
+			it.row = ir
+			return ir.ID, nil
+		}
+
 		// now determine if we should process this duplicate/existing item at all
 		var reprocessItem, reprocessDataFile bool
 		reprocessItem, reprocessDataFile = p.shouldProcessExistingItem(it, ir, processDataFile)
@@ -767,10 +874,9 @@ func (p *processor) storeItem(ctx context.Context, tx *sql.Tx, it *Item) (uint64
 			processDataFile = false
 
 			atomic.AddInt64(p.ij.skippedItemCount, 1)
-			p.log.Debug("skipping processing of existing item",
+			LogSkip(p.log, it.ID, SkipDuplicate,
 				zap.Uint64("row_id", ir.ID),
-				zap.String("filename", it.Content.Filename),
-				zap.String("item_original_id", it.ID))
+				zap.String("filename", it.Content.Filename))
 			ir.howStored = itemSkipped
 			it.row = ir
 			return ir.ID, nil
@@ -813,10 +919,21 @@ func (p *processor) storeItem(ctx context.Context, tx *sql.Tx, it *Item) (uint64
 	// with its original ID, we can still link a relationship, but if the incoming item has no content we
 	// should not zero out any existing version of the item in the database; the intent by the data source is
 	// to merely link the item by ID (or create a placeholder item), not zero it out!
+	existing := ir.ID > 0
 	ir.ID, ir.howStored, err = p.insertOrUpdateItem(ctx, tx, ir, startingDataFile, it.HasContent(), it.fieldUpdatePolicies)
 	if err != nil {
 		return 0, fmt.Errorf("storing item in database: %w (row_id=%d item_id=%v)", err, ir.ID, ir.OriginalID)
 	}
+	if existing {
+		strategy := MergeKeptExisting
+		switch {
+		case ir.howStored == itemUpdated && len(it.Retrieval.key) > 0:
+			strategy = MergeRetrievalKey
+		case ir.howStored == itemUpdated:
+			strategy = MergeUpdated
+		}
+		LogMerge(p.log, it.ID, strconv.FormatUint(ir.ID, 10), strategy)
+	}
 
 	it.row = ir
 
@@ -966,10 +1083,7 @@ func (tl *Timeline) deleteDataFileAndThumbnailIfUnreferenced(ctx context.Context
 	if err := tl.deleteRepoFile(dataFilePath); err != nil {
 		return fmt.Errorf("deleting unused data file: %w", err)
 	}
-	tl.thumbsMu.Lock()
-	_, err = tl.thumbs.ExecContext(ctx, "DELETE FROM thumbnails WHERE data_file=?", dataFilePath)
-	tl.thumbsMu.Unlock()
-	if err != nil {
+	if err := tl.deleteThumbnails(ctx, nil, []string{dataFilePath}); err != nil {
 		return fmt.Errorf("deleting unused data file's thumbnail: %w", err)
 	}
 	return nil
@@ -986,7 +1100,7 @@ func (p *processor) integrityCheck(dbItem ItemRow) error {
 	}
 
 	// file must open successfully
-	datafile, err := os.Open(p.tl.FullPath(*dbItem.DataFile))
+	datafile, err := p.tl.OpenRepoFile(*dbItem.DataFile)
 	if err != nil {
 		return fmt.Errorf("opening existing data file: %w", err)
 	}
@@ -1408,11 +1522,21 @@ func (tl *Timeline) loadItemRow(ctx context.Context, tx *sql.Tx, rowID uint64, i
 		// compares every configured field.
 
 		if dataSourceName != nil && it.ID != "" {
-			row := tx.QueryRow(`SELECT `+itemDBColumns+`
+			row := tl.txQueryRow(ctx, tx, `SELECT `+itemDBColumns+`
 				FROM extended_items AS items
 				WHERE data_source_name=? AND original_id=?
 				LIMIT 1`, dataSourceName, &it.ID)
 			ir, err := scanItemRow(row, nil)
+			if err == nil && ir.ID == 0 {
+				// the item may have been merged into another as a duplicate
+				row = tl.txQueryRow(ctx, tx, `SELECT `+itemDBColumns+`
+					FROM extended_items AS items
+					JOIN item_sources ON item_sources.item_id = items.id
+					JOIN data_sources ON data_sources.id = item_sources.data_source_id
+					WHERE data_sources.name=? AND item_sources.original_id=?
+					LIMIT 1`, dataSourceName, &it.ID)
+				ir, err = scanItemRow(row, nil)
+			}
 			if err == nil {
 				return ir, nil
 			}
@@ -1455,8 +1579,11 @@ func (tl *Timeline) loadItemRow(ctx context.Context, tx *sql.Tx, rowID uint64, i
 		}
 
 		// iterate each field to be selected on to finish building WHERE clause
+		// (in a consistent order, so the query is the same for every item and
+		// its prepared statement can be reused)
 		firstIter := true
-		for field, strictNull := range uniqueConstraints {
+		for _, field := range slices.Sorted(maps.Keys(uniqueConstraints)) {
+			strictNull := uniqueConstraints[field]
 			if !firstIter {
 				sb.WriteString(" AND ")
 			}
@@ -1571,7 +1698,7 @@ func (tl *Timeline) loadItemRow(ctx context.Context, tx *sql.Tx, rowID uint64, i
 
 	sb.WriteString(" LIMIT 1")
 
-	row := tx.QueryRowContext(ctx, sb.String(), args...)
+	row := tl.txQueryRow(ctx, tx, sb.String(), args...)
 
 	return scanItemRow(row, nil)
 }
@@ -1583,7 +1710,7 @@ func (p *processor) insertOrUpdateItem(ctx context.Context, tx *sql.Tx, ir ItemR
 	if ir.ID == 0 {
 		var rowID uint64
 
-		err := tx.QueryRowContext(ctx,
+		err := p.tl.txQueryRow(ctx, tx,
 			`INSERT INTO items
 				(data_source_id, job_id, attribute_id, classification_id,
 				original_id, original_location, intermediate_location, filename,
@@ -1603,6 +1730,9 @@ func (p *processor) insertOrUpdateItem(ctx context.Context, tx *sql.Tx, ir ItemR
 		).Scan(&rowID)
 
 		atomic.AddInt64(p.ij.newItemCount, 1)
+		if err == nil {
+			p.addedItemIDs = append(p.addedItemIDs, rowID)
+		}
 
 		return rowID, itemInserted, err
 	}
@@ -1744,7 +1874,7 @@ func (p *processor) insertOrUpdateItem(ctx context.Context, tx *sql.Tx, ir ItemR
 	sb.WriteString(" WHERE id=?")
 	args = append(args, ir.ID)
 
-	_, err := tx.ExecContext(ctx, sb.String(), args...)
+	_, err := p.tl.txExec(ctx, tx, sb.String(), args...)
 	if err != nil {
 		return 0, "", fmt.Errorf("updating item row: %w", err)
 	}
@@ -1765,6 +1895,19 @@ func (p *processor) insertOrUpdateItem(ctx context.Context, tx *sql.Tx, ir ItemR
 	return ir.ID, itemUpdated, nil
 }
 
+// inferMediaClassification classifies the item as media if its
+// classification is missing, but it is clearly a common media type.
+// TODO: not sure if a good idea... ho hum.
+func inferMediaClassification(it *Item) {
+	if it.Classification.Name == "" {
+		if strings.HasPrefix(it.Content.MediaType, "image/") ||
+			strings.HasPrefix(it.Content.MediaType, "video/") ||
+			strings.HasPrefix(it.Content.MediaType, "audio/") {
+			it.Classification = ClassMedia
+		}
+	}
+}
+
 // detectContentType strives to detect the media type of the item using the
 // peeked bytes. It sets it.Content.MediaType.
 func detectContentType(peekedBytes []byte, it *Item) {
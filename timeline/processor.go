@@ -48,6 +48,9 @@ type processor struct {
 	batch     []*Graph
 	batchSize int // size is at least len(batch) but edges on a graph can add to it
 
+	// IDs of the items inserted by the current batch, for the items-added event
+	addedItemIDs []uint64
+
 	// counter used for periodic DB optimization during an import
 	// TODO: this should ideally be global per timeline, even if multiple jobs run simultaneously
 	rootGraphCount int
@@ -94,12 +97,53 @@ func (p processor) process(ctx context.Context, dirEntry DirEntry, dsCheckpoint
 		return nil
 	}
 
+	// even if we estimated size above, use a fresh file importer to avoid any potentially reused state (TODO: necessary?)
+	return p.run(ctx, params, func(params ImportParams) error {
+		return p.ds.NewFileImporter().FileImport(ctx, dirEntry, params)
+	})
+}
+
+// processAPI imports data from the data source's API. Importing from an
+// API is not estimated, since that would download all the data twice.
+func (p processor) processAPI(ctx context.Context, dsCheckpoint json.RawMessage) error {
+	if p.estimatedCount != nil {
+		return nil
+	}
+	if p.ij.preview != nil {
+		// previewing would download all the data too
+		p.ij.preview.report.Skipped = append(p.ij.preview.report.Skipped, p.ds.Name)
+		return nil
+	}
+
+	params := ImportParams{
+		Log:               p.log,
+		Timeframe:         p.ij.ProcessingOptions.Timeframe,
+		Checkpoint:        dsCheckpoint,
+		DataSourceOptions: p.dsOpt,
+	}
+	acc := Account{DataSource: p.ds, tl: p.tl}
+
+	return p.run(ctx, params, func(params ImportParams) error {
+		return p.ds.NewAPIImporter().APIImport(ctx, acc, params)
+	})
+}
+
+// run runs importFn with params (plus the pipeline and import state)
+// and processes the items it sends until it returns and they are all
+// processed. Then, unless ctx was canceled or the import is a preview,
+// it stores the import state.
+func (p processor) run(ctx context.Context, params ImportParams, importFn func(ImportParams) error) error {
+	state, err := p.tl.loadImportState(ctx, p.dsRowID)
+	if err != nil {
+		return err
+	}
+	params.State = state
+
 	done := make(chan struct{})
 	wg, graphs := p.beginProcessing(ctx, p.ij.ProcessingOptions, false, done)
 	params.Pipeline = graphs
 
-	// even if we estimated size above, use a fresh file importer to avoid any potentially reused state (TODO: necessary?)
-	err := p.ds.NewFileImporter().FileImport(ctx, dirEntry, params)
+	err = importFn(params)
 	// handle error in a little bit (see below)
 
 	// sending on the pipeline must be complete by now; signal to workers to exit
@@ -110,5 +154,13 @@ func (p processor) process(ctx context.Context, dirEntry DirEntry, dsCheckpoint
 	// wait for all processing workers to complete
 	wg.Wait()
 
+	// the last batch isn't processed if the import was canceled, so the
+	// state saved by the data source may describe items that weren't stored
+	if ctx.Err() == nil && p.ij.preview == nil {
+		if stateErr := p.tl.storeImportState(ctx, p.dsRowID, state); stateErr != nil {
+			params.Log.Error("storing import state", zap.Error(stateErr))
+		}
+	}
+
 	return err
 }
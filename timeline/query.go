@@ -0,0 +1,665 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Query is a parsed query of the query language, which can be written
+// naturally, like:
+//
+//	photos with Mom in Spain during summer 2019
+//
+// or with fields, like:
+//
+//	class:media type:image with:"Mom" in:Spain date:"summer 2019"
+//
+// or any mix of the two. All the terms of a query must match an item.
+// The words of names that contain keywords (like "with" or "in") must
+// be quoted, and words that aren't part of any term are searched for
+// in the text of items.
+//
+// These are the fields; prefixing a field with "-" negates it, as does
+// "not" or "without" before a natural term:
+//
+//	with:<entity>     the item is from, to, or otherwise related to the entity
+//	from:<entity>     the item is from the entity (the item's owner), or from
+//	                  the data source with the given name or title
+//	to:<entity>       the item was sent to the entity
+//	in:<place>        the item's location is in the place, which is a place
+//	                  entity or a country (also at:)
+//	date:<phrase>     the item's timestamp is in the period of the date phrase
+//	                  (also during: and on:)
+//	after:<phrase>    the item's timestamp is after the period
+//	since:<phrase>    the item's timestamp is at or after the start of the period
+//	before:<phrase>   the item's timestamp is before the period
+//	source:<name>     the item is from the data source
+//	class:<name>      the item has the classification (also is:)
+//	type:<type>       the item's data has the media type, like "image" or "image/png"
+//	tag:<label>       enrichment tagged the item with the label
+//	text:<words>      the item's text has the words
+//	order:<dir>       "oldest" or "newest" first (the default)
+//
+// Entities are referred to by name, by an attribute like an email address,
+// or by ID (like "#12"). Date phrases are years ("2019"), decades ("1990s"),
+// months ("June 2019"), seasons ("summer 2019"), dates ("2019-06-15" or
+// "June 15, 2019"), or relative to now ("today", "yesterday", "last week",
+// "this year", "past 30 days").
+type Query struct {
+	Terms []QueryTerm `json:"terms"`
+	Sort  SortDir     `json:"sort,omitempty"`
+}
+
+// QueryField is the kind of predicate of a query term.
+type QueryField string
+
+const (
+	QueryWith   QueryField = "with"
+	QueryFrom   QueryField = "from"
+	QueryTo     QueryField = "to"
+	QueryPlace  QueryField = "in"
+	QueryDate   QueryField = "date"
+	QuerySource QueryField = "source"
+	QueryClass  QueryField = "class"
+	QueryType   QueryField = "type"
+	QueryTag    QueryField = "tag"
+	QueryText   QueryField = "text"
+)
+
+// QueryTerm is one predicate of a query.
+type QueryTerm struct {
+	Field   QueryField `json:"field"`
+	Value   string     `json:"value,omitempty"`
+	Negated bool       `json:"negated,omitempty"`
+
+	// For date terms, the period (the end is exclusive); one may be nil.
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+
+	// For class terms from nouns like "photos", the media type that is
+	// implied, like "image/".
+	DataType string `json:"data_type,omitempty"`
+
+	// terms written naturally fall back to being searched as text if the
+	// names in them can't be resolved
+	natural bool
+}
+
+// ParseQuery parses the input in the query language. Relative dates are
+// relative to now, and dates are in the location of now.
+func ParseQuery(input string, now time.Time) (Query, error) {
+	tokens, err := tokenizeQuery(input)
+	if err != nil {
+		return Query{}, err
+	}
+	p := queryParser{tokens: tokens, now: now}
+	if err := p.parse(); err != nil {
+		return Query{}, err
+	}
+	if len(p.query.Terms) == 0 {
+		return Query{}, fmt.Errorf("query has no terms: %q", input)
+	}
+	return p.query, nil
+}
+
+// queryToken is a word of a query, or a quoted phrase, or a field.
+type queryToken struct {
+	text    string
+	quoted  bool
+	field   string // for field:value tokens
+	negated bool   // for field:value tokens prefixed with "-"
+}
+
+func (t queryToken) lower() string {
+	if t.quoted || t.field != "" {
+		return ""
+	}
+	return strings.ToLower(t.text)
+}
+
+func tokenizeQuery(input string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		var tok queryToken
+		var sb strings.Builder
+		for i < len(runes) && !unicode.IsSpace(runes[i]) {
+			if runes[i] == '"' {
+				end := slices.Index(runes[i+1:], '"')
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated quote at position %d", i)
+				}
+				sb.WriteString(string(runes[i+1 : i+1+end]))
+				tok.quoted = true
+				i += end + 2
+				continue
+			}
+			if runes[i] == ':' && tok.field == "" && !tok.quoted {
+				if field := strings.ToLower(sb.String()); queryFieldKey(strings.TrimPrefix(field, "-")) {
+					tok.negated = strings.HasPrefix(field, "-")
+					tok.field = strings.TrimPrefix(field, "-")
+					sb.Reset()
+					i++
+					continue
+				}
+			}
+			sb.WriteRune(runes[i])
+			i++
+		}
+		tok.text = sb.String()
+		if tok.text == "" && tok.field == "" {
+			continue
+		}
+		tokens = append(tokens, tok)
+	}
+	return tokens, nil
+}
+
+func queryFieldKey(key string) bool {
+	switch key {
+	case "with", "from", "to", "in", "at", "date", "during", "on", "after", "since", "before",
+		"source", "class", "is", "type", "tag", "text", "order":
+		return true
+	}
+	return false
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	now    time.Time
+	query  Query
+	text   []string // words to search for in the text, in the FTS syntax of ftsQuery
+}
+
+func (p *queryParser) parse() error {
+	negateNext := false
+	for p.pos < len(p.tokens) {
+		tok := p.tokens[p.pos]
+		p.pos++
+
+		if tok.field != "" {
+			if err := p.fieldTerm(tok); err != nil {
+				return err
+			}
+			continue
+		}
+
+		word := tok.lower()
+		switch {
+		case word == "not" || word == "without":
+			negateNext = true
+			if word == "without" {
+				p.naturalTerm(QueryWith, true)
+				negateNext = false
+			}
+			continue
+		case queryStopWords[word]:
+			continue
+		case queryKeywords[word] != "":
+			p.naturalTerm(queryKeywords[word], negateNext)
+		case queryNouns[word].class != "":
+			noun := queryNouns[word]
+			p.query.Terms = append(p.query.Terms, QueryTerm{Field: QueryClass, Value: noun.class, DataType: noun.dataType, Negated: negateNext, natural: true})
+		case word == "between":
+			p.naturalTerm(QueryDate, negateNext)
+		default:
+			p.addText(tok, negateNext)
+		}
+		negateNext = false
+	}
+
+	if len(p.text) > 0 {
+		p.query.Terms = append(p.query.Terms, QueryTerm{Field: QueryText, Value: strings.Join(p.text, " ")})
+	}
+	return nil
+}
+
+func (p *queryParser) addText(tok queryToken, negated bool) {
+	text := tok.text
+	if tok.quoted {
+		text = `"` + text + `"`
+	} else if strings.HasPrefix(text, "-") && len(text) > 1 {
+		negated = true
+		text = text[1:]
+	}
+	if negated {
+		p.query.Terms = append(p.query.Terms, QueryTerm{Field: QueryText, Value: text, Negated: true})
+		return
+	}
+	p.text = append(p.text, text)
+}
+
+// fieldTerm adds the term of a field:value token.
+func (p *queryParser) fieldTerm(tok queryToken) error {
+	if tok.text == "" {
+		return fmt.Errorf("field %s has no value", tok.field)
+	}
+	term := QueryTerm{Value: tok.text, Negated: tok.negated}
+	switch tok.field {
+	case "with":
+		term.Field = QueryWith
+	case "from":
+		term.Field = QueryFrom
+	case "to":
+		term.Field = QueryTo
+	case "in", "at":
+		term.Field = QueryPlace
+	case "source":
+		term.Field = QuerySource
+	case "class", "is":
+		term.Field = QueryClass
+		if noun, ok := queryNouns[strings.ToLower(tok.text)]; ok {
+			term.Value, term.DataType = noun.class, noun.dataType
+		}
+	case "type":
+		term.Field = QueryType
+	case "tag":
+		term.Field = QueryTag
+	case "text":
+		term.Field = QueryText
+		if tok.quoted {
+			term.Value = `"` + tok.text + `"`
+		}
+	case "order":
+		switch strings.ToLower(tok.text) {
+		case "oldest", "asc":
+			p.query.Sort = SortAsc
+		case "newest", "desc":
+			p.query.Sort = SortDesc
+		default:
+			return fmt.Errorf("unknown order: %s (expecting oldest or newest)", tok.text)
+		}
+		return nil
+	case "date", "during", "on", "after", "since", "before":
+		start, end, ok := parseDatePhrase(strings.Fields(strings.ToLower(tok.text)), p.now)
+		if !ok {
+			return fmt.Errorf("unrecognized date: %s", tok.text)
+		}
+		term.Field = QueryDate
+		switch tok.field {
+		case "after":
+			start, end = end, time.Time{}
+		case "since":
+			end = time.Time{}
+		case "before":
+			start, end = time.Time{}, start
+		}
+		term.Start, term.End = timePtr(start), timePtr(end)
+	}
+	p.query.Terms = append(p.query.Terms, term)
+	return nil
+}
+
+// naturalTerm adds the term(s) that follow a keyword, like "with Mom and Dad"
+// or "in June 2019". If a date phrase doesn't parse, its words are searched
+// for as text instead.
+func (p *queryParser) naturalTerm(field QueryField, negated bool) {
+	keyword := p.tokens[p.pos-1].lower()
+
+	for {
+		phrase := p.phrase()
+		if len(phrase) == 0 {
+			return
+		}
+
+		switch {
+		case field == QueryDate || field == QueryPlace || field == QueryFrom:
+			words := make([]string, len(phrase))
+			for i, tok := range phrase {
+				words[i] = strings.ToLower(tok.text)
+			}
+			start, end, ok := parseDatePhrase(words, p.now)
+			if !ok && field == QueryDate {
+				for _, tok := range phrase {
+					p.addText(tok, negated)
+				}
+				break
+			}
+			if !ok {
+				p.query.Terms = append(p.query.Terms, QueryTerm{Field: field, Value: phraseText(phrase), Negated: negated, natural: true})
+				break
+			}
+
+			// a range, like "between 2019 and 2021" or "from May to June 2019"
+			if (keyword == "between" && p.peek() == "and") || (keyword == "from" && (p.peek() == "to" || p.peek() == "until")) {
+				p.pos++
+				rest := p.phrase()
+				restWords := make([]string, len(rest))
+				for i, tok := range rest {
+					restWords[i] = strings.ToLower(tok.text)
+				}
+				if restStart, restEnd, ok := parseDatePhrase(restWords, p.now); ok {
+					end = restEnd
+					// "from May to June 2019" starts in May 2019
+					if !start.Before(end) {
+						words = append(words, strconv.Itoa(restStart.Year()))
+						if yearStart, _, ok := parseDatePhrase(words, p.now); ok {
+							start = yearStart
+						}
+					}
+				} else {
+					p.pos -= len(rest) + 1
+				}
+			}
+			switch keyword {
+			case "after":
+				start, end = end, time.Time{}
+			case "since":
+				end = time.Time{}
+			case "before", "until":
+				start, end = time.Time{}, start
+			}
+			p.query.Terms = append(p.query.Terms, QueryTerm{Field: QueryDate, Start: timePtr(start), End: timePtr(end), Negated: negated, natural: true})
+		default:
+			p.query.Terms = append(p.query.Terms, QueryTerm{Field: field, Value: phraseText(phrase), Negated: negated, natural: true})
+		}
+
+		// "with Mom and Dad" is two terms
+		if p.peek() != "and" || field == QueryDate || p.pos+1 >= len(p.tokens) || p.boundary(p.tokens[p.pos+1]) {
+			return
+		}
+		p.pos++
+	}
+}
+
+// phrase consumes and returns the tokens up to the next keyword.
+func (p *queryParser) phrase() []queryToken {
+	start := p.pos
+	for p.pos < len(p.tokens) && !p.boundary(p.tokens[p.pos]) {
+		p.pos++
+	}
+	return p.tokens[start:p.pos]
+}
+
+// boundary returns true if tok ends a phrase.
+func (p *queryParser) boundary(tok queryToken) bool {
+	word := tok.lower()
+	return tok.field != "" || queryKeywords[word] != "" || queryNouns[word].class != "" ||
+		word == "and" || word == "not" || word == "without" || word == "between"
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].lower()
+	}
+	return ""
+}
+
+func phraseText(phrase []queryToken) string {
+	words := make([]string, len(phrase))
+	for i, tok := range phrase {
+		words[i] = tok.text
+	}
+	return strings.Join(words, " ")
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// parseDatePhrase returns the period (with an exclusive end) that the words
+// of a date phrase describe, and whether they are a date phrase.
+func parseDatePhrase(words []string, now time.Time) (start, end time.Time, ok bool) {
+	loc := now.Location()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	words = slices.DeleteFunc(slices.Clone(words), func(w string) bool { return w == "the" || w == "of" })
+	for i, w := range words {
+		words[i] = strings.Trim(w, ",.")
+	}
+
+	switch len(words) {
+	case 1:
+		w := words[0]
+		switch w {
+		case "today":
+			return today, today.AddDate(0, 0, 1), true
+		case "yesterday":
+			return today.AddDate(0, 0, -1), today, true
+		}
+		if year, ok := parseQueryYear(w); ok {
+			return time.Date(year, 1, 1, 0, 0, 0, 0, loc), time.Date(year+1, 1, 1, 0, 0, 0, 0, loc), true
+		}
+		if decade, ok := strings.CutSuffix(w, "s"); ok {
+			decade = strings.Trim(decade, "'")
+			year, ok := parseQueryYear(decade)
+			if n, err := strconv.Atoi(decade); len(decade) == 2 && err == nil {
+				// "90s" is the 1990s, and "20s" is the 2020s
+				year, ok = 2000+n, true
+				if n >= 30 { //nolint:mnd
+					year -= 100
+				}
+			}
+			if ok && year%10 == 0 {
+				return time.Date(year, 1, 1, 0, 0, 0, 0, loc), time.Date(year+10, 1, 1, 0, 0, 0, 0, loc), true
+			}
+		}
+		for _, layout := range []string{"2006-01-02", "2006/01/02", "2006-01", "2006/01"} {
+			if t, err := time.ParseInLocation(layout, w, loc); err == nil {
+				if len(layout) == len("2006-01") {
+					return t, t.AddDate(0, 1, 0), true
+				}
+				return t, t.AddDate(0, 0, 1), true
+			}
+		}
+		if month, ok := queryMonths[w]; ok {
+			// the most recent one
+			year := now.Year()
+			if month > now.Month() {
+				year--
+			}
+			start := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+			return start, start.AddDate(0, 1, 0), true
+		}
+		if season, ok := querySeasons[w]; ok {
+			year := now.Year()
+			if start := time.Date(year, season, 1, 0, 0, 0, 0, loc); start.After(now) {
+				year--
+			}
+			start := time.Date(year, season, 1, 0, 0, 0, 0, loc)
+			return start, start.AddDate(0, 3, 0), true
+		}
+
+	case 2:
+		// "this year", "last month", "next week"...
+		if offset, ok := map[string]int{"this": 0, "last": -1, "past": -1, "next": 1}[words[0]]; ok {
+			switch words[1] {
+			case "week":
+				weekStart := today.AddDate(0, 0, -int(today.Weekday()))
+				weekStart = weekStart.AddDate(0, 0, 7*offset)
+				return weekStart, weekStart.AddDate(0, 0, 7), true
+			case "month":
+				monthStart := time.Date(now.Year(), now.Month()+time.Month(offset), 1, 0, 0, 0, 0, loc)
+				return monthStart, monthStart.AddDate(0, 1, 0), true
+			case "year":
+				yearStart := time.Date(now.Year()+offset, 1, 1, 0, 0, 0, 0, loc)
+				return yearStart, yearStart.AddDate(1, 0, 0), true
+			}
+			if _, ok := querySeasons[words[1]]; ok {
+				// relative to the most recent one, which may be ongoing
+				start, end, _ := parseDatePhrase(words[1:], now)
+				ongoing := now.Before(end)
+				switch {
+				case offset > 0, offset == 0 && !ongoing:
+					start, end = start.AddDate(1, 0, 0), end.AddDate(1, 0, 0)
+				case offset < 0 && ongoing:
+					start, end = start.AddDate(-1, 0, 0), end.AddDate(-1, 0, 0)
+				}
+				return start, end, true
+			}
+		}
+		year, yearOK := parseQueryYear(words[1])
+		if !yearOK {
+			break
+		}
+		if month, ok := queryMonths[words[0]]; ok {
+			start := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+			return start, start.AddDate(0, 1, 0), true
+		}
+		if season, ok := querySeasons[words[0]]; ok {
+			// winter starts in December of the year
+			start := time.Date(year, season, 1, 0, 0, 0, 0, loc)
+			return start, start.AddDate(0, 3, 0), true
+		}
+
+	case 3:
+		// "past 30 days", "last 2 weeks"
+		if words[0] == "past" || words[0] == "last" {
+			n, err := strconv.Atoi(words[1])
+			if err != nil || n <= 0 {
+				break
+			}
+			switch strings.TrimSuffix(words[2], "s") {
+			case "day":
+				return today.AddDate(0, 0, -n+1), today.AddDate(0, 0, 1), true
+			case "week":
+				return today.AddDate(0, 0, -7*n+1), today.AddDate(0, 0, 1), true
+			case "month":
+				return today.AddDate(0, -n, 1), today.AddDate(0, 0, 1), true
+			case "year":
+				return today.AddDate(-n, 0, 1), today.AddDate(0, 0, 1), true
+			}
+			break
+		}
+		// "June 15 2019" or "15 June 2019"
+		year, yearOK := parseQueryYear(words[2])
+		if !yearOK {
+			break
+		}
+		month, day := queryMonths[words[0]], words[1]
+		if month == 0 {
+			month, day = queryMonths[words[1]], words[0]
+		}
+		d, err := strconv.Atoi(strings.TrimRightFunc(day, unicode.IsLetter)) // allow "15th"
+		if month == 0 || err != nil || d < 1 || d > 31 {
+			break
+		}
+		start := time.Date(year, month, d, 0, 0, 0, 0, loc)
+		if start.Month() != month {
+			break // no such day in the month
+		}
+		return start, start.AddDate(0, 0, 1), true
+	}
+
+	return time.Time{}, time.Time{}, false
+}
+
+func parseQueryYear(s string) (int, bool) {
+	if len(s) != 4 { //nolint:mnd
+		return 0, false
+	}
+	year, err := strconv.Atoi(s)
+	return year, err == nil && year > 0
+}
+
+// words that introduce terms written naturally
+var queryKeywords = map[string]QueryField{
+	"with":      QueryWith,
+	"featuring": QueryWith,
+	"of":        QueryWith,
+	"from":      QueryFrom,
+	"by":        QueryFrom,
+	"in":        QueryPlace,
+	"at":        QueryPlace,
+	"during":    QueryDate,
+	"on":        QueryDate,
+	"after":     QueryDate,
+	"since":     QueryDate,
+	"before":    QueryDate,
+	"until":     QueryDate,
+	"to":        QueryTo,
+}
+
+// words that are ignored, unless quoted
+var queryStopWords = map[string]bool{
+	"show": true, "me": true, "find": true, "all": true, "my": true, "the": true, "a": true, "an": true,
+	"any": true, "some": true, "and": true, "that": true, "which": true, "were": true, "was": true, "taken": true,
+	"sent": true, "received": true,
+}
+
+type queryNoun struct {
+	class    string
+	dataType string
+}
+
+// nouns that stand for classifications of items
+var queryNouns = func() map[string]queryNoun {
+	nouns := make(map[string]queryNoun)
+	for _, n := range []struct {
+		words []string
+		noun  queryNoun
+	}{
+		{[]string{"photo", "picture", "pic", "image"}, queryNoun{ClassMedia.Name, "image/"}},
+		{[]string{"video", "movie"}, queryNoun{ClassMedia.Name, "video/"}},
+		{[]string{"recording"}, queryNoun{ClassMedia.Name, "audio/"}},
+		{[]string{"media"}, queryNoun{ClassMedia.Name, ""}},
+		{[]string{"message", "text", "chat", "sms"}, queryNoun{ClassMessage.Name, ""}},
+		{[]string{"email", "e-mail"}, queryNoun{ClassEmail.Name, ""}},
+		{[]string{"post", "tweet"}, queryNoun{ClassSocial.Name, ""}},
+		{[]string{"location"}, queryNoun{ClassLocation.Name, ""}},
+		{[]string{"note"}, queryNoun{ClassNote.Name, ""}},
+		{[]string{"document", "doc"}, queryNoun{ClassDocument.Name, ""}},
+		{[]string{"bookmark"}, queryNoun{ClassBookmark.Name, ""}},
+		{[]string{"event"}, queryNoun{ClassEvent.Name, ""}},
+		{[]string{"album", "collection"}, queryNoun{ClassCollection.Name, ""}},
+	} {
+		for _, word := range n.words {
+			nouns[word] = n.noun
+			nouns[word+"s"] = n.noun
+		}
+	}
+	nouns["pageview"] = queryNoun{ClassPageView.Name, ""}
+	nouns["pageviews"] = queryNoun{ClassPageView.Name, ""}
+	delete(nouns, "medias")
+	return nouns
+}()
+
+var queryMonths = func() map[string]time.Month {
+	months := make(map[string]time.Month)
+	for m := time.January; m <= time.December; m++ {
+		name := strings.ToLower(m.String())
+		months[name] = m
+		months[name[:3]] = m
+	}
+	months["sept"] = time.September
+	return months
+}()
+
+// the month each season starts in (in the northern hemisphere)
+var querySeasons = map[string]time.Month{
+	"spring": time.March,
+	"summer": time.June,
+	"fall":   time.September,
+	"autumn": time.September,
+	"winter": time.December,
+}
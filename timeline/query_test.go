@@ -0,0 +1,274 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	now := time.Date(2024, time.July, 10, 15, 0, 0, 0, time.UTC)
+	date := func(year int, month time.Month, day int) *time.Time {
+		d := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		return &d
+	}
+	// compares terms without the unexported field
+	format := func(terms []QueryTerm) string {
+		var sb strings.Builder
+		for _, term := range terms {
+			fmt.Fprintf(&sb, "%s:%q", term.Field, term.Value)
+			if term.Negated {
+				sb.WriteString(" negated")
+			}
+			if term.DataType != "" {
+				fmt.Fprintf(&sb, " %s", term.DataType)
+			}
+			if term.Start != nil {
+				fmt.Fprintf(&sb, " from %s", term.Start.Format(time.DateOnly))
+			}
+			if term.End != nil {
+				fmt.Fprintf(&sb, " to %s", term.End.Format(time.DateOnly))
+			}
+			sb.WriteString("; ")
+		}
+		return sb.String()
+	}
+
+	for i, tc := range []struct {
+		input  string
+		expect []QueryTerm
+		sort   SortDir
+	}{
+		{
+			input: "photos with Mom in Spain during summer 2019",
+			expect: []QueryTerm{
+				{Field: QueryClass, Value: ClassMedia.Name, DataType: "image/"},
+				{Field: QueryWith, Value: "Mom"},
+				{Field: QueryPlace, Value: "Spain"},
+				{Field: QueryDate, Start: date(2019, time.June, 1), End: date(2019, time.September, 1)},
+			},
+		},
+		{
+			input: `class:media type:image with:"Aunt Mary" in:"New Zealand" date:"summer 2019"`,
+			expect: []QueryTerm{
+				{Field: QueryClass, Value: ClassMedia.Name},
+				{Field: QueryType, Value: "image"},
+				{Field: QueryWith, Value: "Aunt Mary"},
+				{Field: QueryPlace, Value: "New Zealand"},
+				{Field: QueryDate, Value: "summer 2019", Start: date(2019, time.June, 1), End: date(2019, time.September, 1)},
+			},
+		},
+		{
+			input: "messages from Bob and Alice to Carol in June 2019",
+			expect: []QueryTerm{
+				{Field: QueryClass, Value: ClassMessage.Name},
+				{Field: QueryFrom, Value: "Bob"},
+				{Field: QueryFrom, Value: "Alice"},
+				{Field: QueryTo, Value: "Carol"},
+				{Field: QueryDate, Start: date(2019, time.June, 1), End: date(2019, time.July, 1)},
+			},
+		},
+		{
+			input: "show me emails about the trip between 2019 and 2021 order:oldest",
+			expect: []QueryTerm{
+				{Field: QueryClass, Value: ClassEmail.Name},
+				{Field: QueryDate, Start: date(2019, time.January, 1), End: date(2022, time.January, 1)},
+				{Field: QueryText, Value: "about trip"},
+			},
+			sort: SortAsc,
+		},
+		{
+			input: "videos not in France without Bob -source:sms -tag:dog -cat",
+			expect: []QueryTerm{
+				{Field: QueryClass, Value: ClassMedia.Name, DataType: "video/"},
+				{Field: QueryPlace, Value: "France", Negated: true},
+				{Field: QueryWith, Value: "Bob", Negated: true},
+				{Field: QuerySource, Value: "sms", Negated: true},
+				{Field: QueryTag, Value: "dog", Negated: true},
+				{Field: QueryText, Value: "cat", Negated: true},
+			},
+		},
+		{
+			input: "from May to June 2019",
+			expect: []QueryTerm{
+				{Field: QueryDate, Start: date(2019, time.May, 1), End: date(2019, time.July, 1)},
+			},
+		},
+		{
+			input: "after 2020 before:2023-03 on \"the beach\"",
+			expect: []QueryTerm{
+				{Field: QueryDate, Start: date(2021, time.January, 1)},
+				{Field: QueryDate, Value: "2023-03", End: date(2023, time.March, 1)},
+				{Field: QueryText, Value: `"the beach"`},
+			},
+		},
+		{
+			input: "since last week",
+			expect: []QueryTerm{
+				{Field: QueryDate, Start: date(2024, time.June, 30)},
+			},
+		},
+	} {
+		query, err := ParseQuery(tc.input, now)
+		if err != nil {
+			t.Errorf("Test %d (%q): unexpected error: %v", i, tc.input, err)
+			continue
+		}
+		if actual, expect := format(query.Terms), format(tc.expect); actual != expect {
+			t.Errorf("Test %d (%q):\nexpected %s\n     got %s", i, tc.input, expect, actual)
+		}
+		if query.Sort != tc.sort {
+			t.Errorf("Test %d (%q): expected sort %q, got %q", i, tc.input, tc.sort, query.Sort)
+		}
+	}
+
+	for _, input := range []string{"", "  the ", `with:"Mom`, "date:someday", "order:sideways", "with:"} {
+		if _, err := ParseQuery(input, now); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestParseDatePhrase(t *testing.T) {
+	now := time.Date(2024, time.July, 10, 15, 0, 0, 0, time.UTC) // a Wednesday
+
+	for i, tc := range []struct {
+		input      string
+		start, end string
+	}{
+		{"2019", "2019-01-01", "2020-01-01"},
+		{"1990s", "1990-01-01", "2000-01-01"},
+		{"'90s", "1990-01-01", "2000-01-01"},
+		{"20s", "2020-01-01", "2030-01-01"},
+		{"2019-06-15", "2019-06-15", "2019-06-16"},
+		{"2019-06", "2019-06-01", "2019-07-01"},
+		{"today", "2024-07-10", "2024-07-11"},
+		{"yesterday", "2024-07-09", "2024-07-10"},
+		{"june", "2024-06-01", "2024-07-01"},
+		{"december", "2023-12-01", "2024-01-01"},
+		{"june 2019", "2019-06-01", "2019-07-01"},
+		{"winter 2019", "2019-12-01", "2020-03-01"},
+		{"summer", "2024-06-01", "2024-09-01"},
+		{"fall", "2023-09-01", "2023-12-01"},
+		{"this summer", "2024-06-01", "2024-09-01"},
+		{"last summer", "2023-06-01", "2023-09-01"},
+		{"next winter", "2024-12-01", "2025-03-01"},
+		{"this week", "2024-07-07", "2024-07-14"},
+		{"last month", "2024-06-01", "2024-07-01"},
+		{"next year", "2025-01-01", "2026-01-01"},
+		{"past 30 days", "2024-06-11", "2024-07-11"},
+		{"june 15, 2019", "2019-06-15", "2019-06-16"},
+		{"15th of june 2019", "2019-06-15", "2019-06-16"},
+	} {
+		start, end, ok := parseDatePhrase(strings.Fields(tc.input), now)
+		if !ok {
+			t.Errorf("Test %d (%q): expected a date phrase", i, tc.input)
+			continue
+		}
+		if s, e := start.Format(time.DateOnly), end.Format(time.DateOnly); s != tc.start || e != tc.end {
+			t.Errorf("Test %d (%q): expected %s to %s, got %s to %s", i, tc.input, tc.start, tc.end, s, e)
+		}
+	}
+
+	for _, input := range []string{"mom", "june 31 2019", "1995s", "past zero days", "spain 2019"} {
+		if _, _, ok := parseDatePhrase(strings.Fields(input), now); ok {
+			t.Errorf("expected %q not to be a date phrase", input)
+		}
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	ctx := context.Background()
+	tl := newTestTimeline(t)
+
+	ts := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, 12, 0, 0, 0, time.Local).UnixMilli()
+	}
+	mustExec(t, tl, `
+		INSERT INTO entities (id, type_id, name) VALUES
+			(1, (SELECT id FROM entity_types WHERE name='person'), 'Mom'),
+			(2, (SELECT id FROM entity_types WHERE name='person'), 'Bob'),
+			(3, (SELECT id FROM entity_types WHERE name='place'), 'Grandma''s House');
+		INSERT INTO attributes (id, name, value, latitude1, longitude1) VALUES
+			(1, 'phone_number', '+15555550001', NULL, NULL),
+			(2, 'phone_number', '+15555550002', NULL, NULL),
+			(3, '_entity', '3', 40.0, -111.0);
+		INSERT INTO entity_attributes (entity_id, attribute_id) VALUES (1, 1), (2, 2), (3, 3);
+		INSERT INTO relations (label, directed) VALUES ('sent', true) ON CONFLICT DO NOTHING;`)
+	mustExec(t, tl, `
+		INSERT INTO items (id, data_source_id, classification_id, attribute_id, timestamp, data_type, data_text, latitude, longitude) VALUES
+			(1, 1, (SELECT id FROM classifications WHERE name='media'), 1, ?, 'image/jpeg', 'paella on the beach', 39.5, -0.4),
+			(2, 1, (SELECT id FROM classifications WHERE name='media'), 2, ?, 'image/jpeg', NULL, 41.4, 2.2),
+			(3, 1, (SELECT id FROM classifications WHERE name='media'), 2, ?, 'video/mp4', NULL, 40.0005, -111.0005),
+			(4, 1, (SELECT id FROM classifications WHERE name='message'), 2, ?, 'text/plain', 'see you at the beach', NULL, NULL);
+		INSERT INTO relationships (relation_id, from_item_id, to_attribute_id) VALUES
+			((SELECT id FROM relations WHERE label='sent'), 4, 1);`,
+		ts(2019, time.July, 4), ts(2019, time.August, 1), ts(2020, time.June, 20), ts(2019, time.July, 5))
+
+	for i, tc := range []struct {
+		query  string
+		expect []uint64
+	}{
+		{"photos with Mom in Spain during summer 2019", []uint64{1}},
+		{"photos in Spain during summer 2019", []uint64{2, 1}},
+		{"with Mom", []uint64{4, 1}},
+		{"from Bob order:oldest", []uint64{4, 2, 3}},
+		{"to:Mom", []uint64{4}},
+		{"messages to +15555550001", []uint64{4}},
+		{"with #2 not in Spain", []uint64{3, 4}},
+		{`at "Grandma's House"`, []uint64{3}},
+		{"videos in 2020", []uint64{3}},
+		{"from:SMS type:video", []uint64{3}},
+		{"beach", []uint64{4, 1}},
+		{"beach -paella", []uint64{4}},
+		{"with Zelda", nil}, // no such entity, so it's searched as text
+	} {
+		results, err := tl.SearchQuery(ctx, QuerySearchParams{Query: tc.query})
+		if err != nil {
+			t.Errorf("Test %d (%q): unexpected error: %v", i, tc.query, err)
+			continue
+		}
+		var ids []uint64
+		for _, sr := range results.Items {
+			ids = append(ids, sr.ID)
+		}
+		if !slices.Equal(ids, tc.expect) || results.Total != len(tc.expect) {
+			t.Errorf("Test %d (%q): expected %v, got %v (total %d)", i, tc.query, tc.expect, ids, results.Total)
+		}
+	}
+
+	plan, err := tl.PlanQuery(ctx, "with Zelda in Atlantis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Notes) != 2 {
+		t.Errorf("expected notes about falling back to text, got %v", plan.Notes)
+	}
+
+	for _, query := range []string{"with:Zelda", "source:nope", "class:nope", "in:Atlantis"} {
+		if _, err := tl.PlanQuery(ctx, query); err == nil {
+			t.Errorf("expected error for %q", query)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import "strings"
+
+// queryCountry returns the bounds of the country with the given name, if
+// known. The bounds are rough rectangles around the country's mainland,
+// so they include bits of the neighboring countries and leave out far-off
+// islands and territories. This is good enough to find the photos from a
+// trip, and it doesn't require a geocoding service, which would reveal
+// what is being searched for.
+func queryCountry(name string) (GeoBounds, bool) {
+	name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "the "))
+	if canonical, ok := queryCountryAliases[name]; ok {
+		name = canonical
+	}
+	b, ok := queryCountries[name]
+	return b, ok
+}
+
+var queryCountryAliases = map[string]string{
+	"usa":                      "united states",
+	"us":                       "united states",
+	"u.s.":                     "united states",
+	"u.s.a.":                   "united states",
+	"america":                  "united states",
+	"united states of america": "united states",
+	"uk":                       "united kingdom",
+	"u.k.":                     "united kingdom",
+	"great britain":            "united kingdom",
+	"britain":                  "united kingdom",
+	"holland":                  "netherlands",
+	"czech republic":           "czechia",
+	"korea":                    "south korea",
+	"uae":                      "united arab emirates",
+	"españa":                   "spain",
+	"deutschland":              "germany",
+	"italia":                   "italy",
+	"nippon":                   "japan",
+}
+
+// the approximate bounds of countries, by lowercase name
+var queryCountries = map[string]GeoBounds{
+	"argentina":            {MinLatitude: -55.1, MaxLatitude: -21.8, MinLongitude: -73.6, MaxLongitude: -53.6},
+	"australia":            {MinLatitude: -43.7, MaxLatitude: -10.7, MinLongitude: 113.3, MaxLongitude: 153.6},
+	"austria":              {MinLatitude: 46.4, MaxLatitude: 49.0, MinLongitude: 9.5, MaxLongitude: 17.2},
+	"belgium":              {MinLatitude: 49.5, MaxLatitude: 51.5, MinLongitude: 2.5, MaxLongitude: 6.4},
+	"brazil":               {MinLatitude: -33.8, MaxLatitude: 5.3, MinLongitude: -74.0, MaxLongitude: -34.8},
+	"canada":               {MinLatitude: 41.7, MaxLatitude: 83.1, MinLongitude: -141.0, MaxLongitude: -52.6},
+	"chile":                {MinLatitude: -56.0, MaxLatitude: -17.5, MinLongitude: -75.7, MaxLongitude: -66.4},
+	"china":                {MinLatitude: 18.2, MaxLatitude: 53.6, MinLongitude: 73.5, MaxLongitude: 134.8},
+	"colombia":             {MinLatitude: -4.2, MaxLatitude: 12.5, MinLongitude: -79.0, MaxLongitude: -66.9},
+	"croatia":              {MinLatitude: 42.4, MaxLatitude: 46.6, MinLongitude: 13.5, MaxLongitude: 19.5},
+	"czechia":              {MinLatitude: 48.5, MaxLatitude: 51.1, MinLongitude: 12.1, MaxLongitude: 18.9},
+	"denmark":              {MinLatitude: 54.5, MaxLatitude: 57.8, MinLongitude: 8.0, MaxLongitude: 15.2},
+	"egypt":                {MinLatitude: 22.0, MaxLatitude: 31.7, MinLongitude: 24.7, MaxLongitude: 36.9},
+	"england":              {MinLatitude: 49.9, MaxLatitude: 55.8, MinLongitude: -6.4, MaxLongitude: 1.8},
+	"finland":              {MinLatitude: 59.8, MaxLatitude: 70.1, MinLongitude: 20.5, MaxLongitude: 31.6},
+	"france":               {MinLatitude: 41.3, MaxLatitude: 51.1, MinLongitude: -5.2, MaxLongitude: 9.6},
+	"germany":              {MinLatitude: 47.2, MaxLatitude: 55.1, MinLongitude: 5.8, MaxLongitude: 15.1},
+	"greece":               {MinLatitude: 34.8, MaxLatitude: 41.8, MinLongitude: 19.4, MaxLongitude: 29.7},
+	"hungary":              {MinLatitude: 45.7, MaxLatitude: 48.6, MinLongitude: 16.1, MaxLongitude: 22.9},
+	"iceland":              {MinLatitude: 63.3, MaxLatitude: 66.6, MinLongitude: -24.6, MaxLongitude: -13.5},
+	"india":                {MinLatitude: 6.7, MaxLatitude: 35.5, MinLongitude: 68.1, MaxLongitude: 97.4},
+	"indonesia":            {MinLatitude: -11.0, MaxLatitude: 6.1, MinLongitude: 95.0, MaxLongitude: 141.0},
+	"ireland":              {MinLatitude: 51.4, MaxLatitude: 55.4, MinLongitude: -10.5, MaxLongitude: -6.0},
+	"israel":               {MinLatitude: 29.5, MaxLatitude: 33.3, MinLongitude: 34.3, MaxLongitude: 35.9},
+	"italy":                {MinLatitude: 35.4, MaxLatitude: 47.1, MinLongitude: 6.6, MaxLongitude: 18.6},
+	"japan":                {MinLatitude: 24.0, MaxLatitude: 45.6, MinLongitude: 122.9, MaxLongitude: 145.9},
+	"kenya":                {MinLatitude: -4.7, MaxLatitude: 5.0, MinLongitude: 33.9, MaxLongitude: 41.9},
+	"mexico":               {MinLatitude: 14.5, MaxLatitude: 32.7, MinLongitude: -118.4, MaxLongitude: -86.7},
+	"morocco":              {MinLatitude: 27.7, MaxLatitude: 35.9, MinLongitude: -13.2, MaxLongitude: -1.0},
+	"netherlands":          {MinLatitude: 50.7, MaxLatitude: 53.6, MinLongitude: 3.3, MaxLongitude: 7.3},
+	"new zealand":          {MinLatitude: -47.3, MaxLatitude: -34.4, MinLongitude: 166.4, MaxLongitude: 178.6},
+	"norway":               {MinLatitude: 57.9, MaxLatitude: 71.2, MinLongitude: 4.6, MaxLongitude: 31.1},
+	"peru":                 {MinLatitude: -18.4, MaxLatitude: 0.0, MinLongitude: -81.4, MaxLongitude: -68.7},
+	"philippines":          {MinLatitude: 4.6, MaxLatitude: 21.1, MinLongitude: 116.9, MaxLongitude: 126.6},
+	"poland":               {MinLatitude: 49.0, MaxLatitude: 54.9, MinLongitude: 14.1, MaxLongitude: 24.2},
+	"portugal":             {MinLatitude: 36.9, MaxLatitude: 42.2, MinLongitude: -9.6, MaxLongitude: -6.2},
+	"scotland":             {MinLatitude: 54.6, MaxLatitude: 60.9, MinLongitude: -8.7, MaxLongitude: -0.7},
+	"south africa":         {MinLatitude: -34.8, MaxLatitude: -22.1, MinLongitude: 16.5, MaxLongitude: 32.9},
+	"south korea":          {MinLatitude: 33.1, MaxLatitude: 38.6, MinLongitude: 124.6, MaxLongitude: 131.9},
+	"spain":                {MinLatitude: 35.9, MaxLatitude: 43.8, MinLongitude: -9.4, MaxLongitude: 4.4},
+	"sweden":               {MinLatitude: 55.3, MaxLatitude: 69.1, MinLongitude: 11.0, MaxLongitude: 24.2},
+	"switzerland":          {MinLatitude: 45.8, MaxLatitude: 47.8, MinLongitude: 5.9, MaxLongitude: 10.5},
+	"thailand":             {MinLatitude: 5.6, MaxLatitude: 20.5, MinLongitude: 97.3, MaxLongitude: 105.6},
+	"turkey":               {MinLatitude: 35.8, MaxLatitude: 42.1, MinLongitude: 26.0, MaxLongitude: 44.8},
+	"united arab emirates": {MinLatitude: 22.6, MaxLatitude: 26.1, MinLongitude: 51.6, MaxLongitude: 56.4},
+	"united kingdom":       {MinLatitude: 49.9, MaxLatitude: 60.9, MinLongitude: -8.7, MaxLongitude: 1.8},
+	"united states":        {MinLatitude: 24.5, MaxLatitude: 49.4, MinLongitude: -124.8, MaxLongitude: -66.9}, // contiguous states
+	"vietnam":              {MinLatitude: 8.6, MaxLatitude: 23.4, MinLongitude: 102.1, MaxLongitude: 109.5},
+}
@@ -0,0 +1,398 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuerySearchParams describes a search for items with the query language.
+type QuerySearchParams struct {
+	// The UUID of the open timeline to search.
+	Repo string `json:"repo,omitempty"`
+
+	// The query, in the query language (see Query).
+	Query string `json:"query"`
+
+	Limit  int `json:"limit,omitempty"` // default 100
+	Offset int `json:"offset,omitempty"`
+}
+
+// QueryPlan is how a query is carried out: the terms of the query, how the
+// names in them were resolved, and the SQL that selects the matching items.
+type QueryPlan struct {
+	Query Query    `json:"query"`
+	Notes []string `json:"notes,omitempty"`
+	SQL   string   `json:"sql"`
+	Args  []any    `json:"args,omitempty"`
+}
+
+// SearchQuery finds the items that match the query, newest first unless the
+// query says otherwise. The total is the number of matching items.
+func (tl *Timeline) SearchQuery(ctx context.Context, params QuerySearchParams) (SearchResults, error) {
+	plan, err := tl.PlanQuery(ctx, params.Query)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+
+	tl.dbMu.RLock()
+	var total int
+	err = tl.db.QueryRowContext(ctx, `SELECT count() FROM (`+plan.SQL+`)`, plan.Args...).Scan(&total)
+	if err != nil {
+		tl.dbMu.RUnlock()
+		return SearchResults{}, fmt.Errorf("counting matching items: %w", err)
+	}
+	ids, err := selectIDs(ctx, tl.db, plan.SQL+` LIMIT ? OFFSET ?`, append(plan.Args, params.Limit, params.Offset)...)
+	tl.dbMu.RUnlock()
+	if err != nil {
+		return SearchResults{}, fmt.Errorf("querying matching items: %w", err)
+	}
+	if len(ids) == 0 {
+		return SearchResults{Total: total, Items: make([]*SearchResult, 0)}, nil
+	}
+
+	results, err := tl.Search(ctx, ItemSearchParams{RowID: ids, Limit: -1})
+	if err != nil {
+		return SearchResults{}, err
+	}
+	byID := make(map[uint64]*SearchResult, len(results.Items))
+	for _, sr := range results.Items {
+		byID[sr.ID] = sr
+	}
+	items := make([]*SearchResult, 0, len(ids))
+	for _, id := range ids {
+		if sr, ok := byID[uint64(id)]; ok { //nolint:gosec // row IDs are positive
+			items = append(items, sr)
+		}
+	}
+
+	return SearchResults{Total: total, Items: items}, nil
+}
+
+// PlanQuery parses the query, resolves the names of entities, places, data
+// sources, and classifications in it, and compiles it to SQL. Names in terms
+// that were written naturally (like "with Mom") that can't be resolved are
+// searched for in the text instead; names in fields (like "with:Mom") must
+// resolve.
+func (tl *Timeline) PlanQuery(ctx context.Context, input string) (QueryPlan, error) {
+	query, err := ParseQuery(input, time.Now())
+	if err != nil {
+		return QueryPlan{}, err
+	}
+
+	plan := QueryPlan{Query: query}
+	clauses := []string{"items.deleted IS NULL", "items.hidden IS NULL"}
+
+	for _, term := range query.Terms {
+		clause, args, err := tl.planQueryTerm(ctx, &plan, term)
+		if err != nil {
+			return QueryPlan{}, err
+		}
+		if clause == "" {
+			continue
+		}
+		if term.Negated {
+			// items for which the clause is NULL (like items without an owner) don't match it either
+			clause = "NOT coalesce(" + clause + ", false)"
+		}
+		clauses = append(clauses, clause)
+		plan.Args = append(plan.Args, args...)
+	}
+
+	sortDir := SortDesc
+	if query.Sort != "" {
+		sortDir = query.Sort
+	}
+	plan.SQL = "SELECT items.id FROM items\n\tWHERE " + strings.Join(clauses, "\n\t\tAND ") +
+		"\n\tORDER BY items.timestamp " + string(sortDir) + ", items.id " + string(sortDir)
+
+	return plan, nil
+}
+
+// planQueryTerm returns the SQL clause, and its arguments, that matches the
+// items the term describes.
+func (tl *Timeline) planQueryTerm(ctx context.Context, plan *QueryPlan, term QueryTerm) (string, []any, error) {
+	switch term.Field {
+	case QueryWith, QueryFrom, QueryTo:
+		if term.Field == QueryFrom {
+			if name, ok, err := tl.queryDataSource(ctx, term.Value); err != nil {
+				return "", nil, err
+			} else if ok {
+				plan.Notes = append(plan.Notes, fmt.Sprintf("%q is the data source %s", term.Value, name))
+				return "items.data_source_id = (SELECT id FROM data_sources WHERE name=?)", []any{name}, nil
+			}
+		}
+
+		entities, attrIDs, err := tl.queryEntities(ctx, term.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(attrIDs) == 0 {
+			return tl.planQueryFallback(ctx, plan, term, "no entity has that name")
+		}
+		plan.Notes = append(plan.Notes, fmt.Sprintf("%q is %s", term.Value, strings.Join(entities, ", ")))
+
+		in, args := sqlArray(attrIDs)
+		switch term.Field {
+		case QueryFrom:
+			return "items.attribute_id IN " + in, args, nil
+		case QueryTo:
+			return "items.id IN (SELECT from_item_id FROM relationships WHERE to_attribute_id IN " + in + ")", args, nil
+		default:
+			return "(items.attribute_id IN " + in +
+					" OR items.id IN (SELECT from_item_id FROM relationships WHERE to_attribute_id IN " + in + ")" +
+					" OR items.id IN (SELECT to_item_id FROM relationships WHERE from_attribute_id IN " + in + "))",
+				append(append(args, args...), args...), nil
+		}
+
+	case QueryPlace:
+		bounds, what, err := tl.queryPlace(ctx, term.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(bounds) == 0 {
+			return tl.planQueryFallback(ctx, plan, term, "no place or country has that name")
+		}
+		plan.Notes = append(plan.Notes, fmt.Sprintf("%q is %s", term.Value, what))
+
+		// the spatial index finds the candidates, and the actual coordinates are checked
+		var boxes []string
+		var args []any
+		for _, b := range bounds {
+			boxes = append(boxes, `(items.latitude BETWEEN ? AND ? AND items.longitude BETWEEN ? AND ?
+				AND items.id IN (SELECT id FROM items_rtree WHERE max_lat >= ? AND min_lat <= ? AND max_lon >= ? AND min_lon <= ?))`)
+			args = append(args,
+				b.MinLatitude, b.MaxLatitude, b.MinLongitude, b.MaxLongitude,
+				b.MinLatitude, b.MaxLatitude, b.MinLongitude, b.MaxLongitude)
+		}
+		return "(" + strings.Join(boxes, " OR ") + ")", args, nil
+
+	case QueryDate:
+		var clauses []string
+		var args []any
+		if term.Start != nil {
+			clauses = append(clauses, "items.timestamp >= ?")
+			args = append(args, term.Start.UnixMilli())
+		}
+		if term.End != nil {
+			clauses = append(clauses, "items.timestamp < ?")
+			args = append(args, term.End.UnixMilli())
+		}
+		if len(clauses) == 0 {
+			return "", nil, nil
+		}
+		return "(" + strings.Join(clauses, " AND ") + ")", args, nil
+
+	case QuerySource:
+		name, ok, err := tl.queryDataSource(ctx, term.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		if !ok {
+			return "", nil, fmt.Errorf("unknown data source: %s", term.Value)
+		}
+		return "items.data_source_id = (SELECT id FROM data_sources WHERE name=?)", []any{name}, nil
+
+	case QueryClass:
+		classID, err := tl.classificationNameToID(term.Value)
+		if err != nil {
+			return "", nil, fmt.Errorf("unknown classification: %s", term.Value)
+		}
+		if term.DataType != "" {
+			return "(items.classification_id = ? AND items.data_type LIKE ?)", []any{classID, term.DataType + "%"}, nil
+		}
+		return "items.classification_id = ?", []any{classID}, nil
+
+	case QueryType:
+		if strings.Contains(term.Value, "/") {
+			return "items.data_type = ?", []any{strings.ToLower(term.Value)}, nil
+		}
+		return "items.data_type LIKE ?", []any{strings.ToLower(term.Value) + "/%"}, nil
+
+	case QueryTag:
+		return "items.id IN (SELECT item_id FROM item_enrichments WHERE kind=? AND value=?)",
+			[]any{enrichmentKindTag, strings.ToLower(term.Value)}, nil
+
+	case QueryText:
+		match := ftsQuery(term.Value)
+		if match == "" {
+			return "", nil, nil
+		}
+		return "items.id IN (SELECT docid FROM items_fts WHERE items_fts MATCH ?)", []any{match}, nil
+	}
+
+	return "", nil, fmt.Errorf("unknown query field: %s", term.Field)
+}
+
+// planQueryFallback searches for the words of a natural term that couldn't be
+// resolved in the text, or returns an error if the term was a field.
+func (tl *Timeline) planQueryFallback(ctx context.Context, plan *QueryPlan, term QueryTerm, reason string) (string, []any, error) {
+	if !term.natural {
+		return "", nil, fmt.Errorf("%s: %s", reason, term.Value)
+	}
+	var words []string
+	for _, word := range strings.Fields(term.Value) {
+		if !queryStopWords[strings.ToLower(word)] {
+			words = append(words, word)
+		}
+	}
+	plan.Notes = append(plan.Notes, fmt.Sprintf("%s (%q), so searching the text for it", reason, term.Value))
+	return tl.planQueryTerm(ctx, plan, QueryTerm{Field: QueryText, Value: strings.Join(words, " "), Negated: term.Negated})
+}
+
+// queryEntities returns the names of the entities that a reference in a
+// query refers to (by name, attribute value, or "#ID"), and the IDs of the
+// attributes of those entities.
+func (tl *Timeline) queryEntities(ctx context.Context, ref string) ([]string, []uint64, error) {
+	q := `SELECT id, name FROM entities
+		WHERE deleted IS NULL AND (name=? COLLATE NOCASE OR id IN (
+			SELECT entity_attributes.entity_id
+			FROM entity_attributes
+			JOIN attributes ON attributes.id = entity_attributes.attribute_id
+			WHERE attributes.value=? AND attributes.name != ?))`
+	args := []any{ref, ref, passThruAttribute}
+	if id, err := strconv.ParseUint(strings.TrimPrefix(ref, "#"), 10, 64); err == nil && strings.HasPrefix(ref, "#") {
+		q = `SELECT id, name FROM entities WHERE deleted IS NULL AND id=?`
+		args = []any{id}
+	}
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolving entity %q: %w", ref, err)
+	}
+	var names []string
+	var entityIDs []uint64
+	for rows.Next() {
+		var id uint64
+		var name *string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		entityIDs = append(entityIDs, id)
+		names = append(names, fmt.Sprintf("entity %d (%s)", id, deref(name)))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(entityIDs) == 0 {
+		return nil, nil, nil
+	}
+
+	in, inArgs := sqlArray(entityIDs)
+	attrIDs, err := selectIDs(ctx, tl.db, `SELECT DISTINCT attribute_id FROM entity_attributes WHERE entity_id IN `+in, inArgs...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("selecting attributes of entities: %w", err)
+	}
+	ids := make([]uint64, len(attrIDs))
+	for i, id := range attrIDs {
+		ids[i] = uint64(id) //nolint:gosec // row IDs are positive
+	}
+	return names, ids, nil
+}
+
+// queryPlace returns the bounds of the place with the given name, which is
+// one or more place entities with coordinates, or else a country.
+func (tl *Timeline) queryPlace(ctx context.Context, name string) ([]GeoBounds, string, error) {
+	tl.dbMu.RLock()
+	rows, err := tl.db.QueryContext(ctx, `
+		SELECT attributes.latitude1, attributes.longitude1, attributes.latitude2, attributes.longitude2
+		FROM entities
+		JOIN entity_types ON entity_types.id = entities.type_id
+		JOIN entity_attributes ON entity_attributes.entity_id = entities.id
+		JOIN attributes ON attributes.id = entity_attributes.attribute_id
+		WHERE entity_types.name='place' AND entities.deleted IS NULL AND entities.name=? COLLATE NOCASE
+			AND attributes.latitude1 IS NOT NULL AND attributes.longitude1 IS NOT NULL`, name)
+	if err != nil {
+		tl.dbMu.RUnlock()
+		return nil, "", fmt.Errorf("resolving place %q: %w", name, err)
+	}
+	var bounds []GeoBounds
+	for rows.Next() {
+		var lat1, lon1 float64
+		var lat2, lon2 *float64
+		if err := rows.Scan(&lat1, &lon1, &lat2, &lon2); err != nil {
+			rows.Close()
+			tl.dbMu.RUnlock()
+			return nil, "", err
+		}
+		if lat2 != nil && lon2 != nil {
+			bounds = append(bounds, GeoBounds{
+				MinLatitude: min(lat1, *lat2), MaxLatitude: max(lat1, *lat2),
+				MinLongitude: min(lon1, *lon2), MaxLongitude: max(lon1, *lon2),
+			})
+			continue
+		}
+		// a point; include its surroundings
+		latDelta := queryPlaceRadiusMeters / metersPerDegreeLatitude
+		lonDelta := latDelta / max(math.Cos(lat1*math.Pi/180), 0.01) //nolint:mnd
+		bounds = append(bounds, GeoBounds{
+			MinLatitude: lat1 - latDelta, MaxLatitude: lat1 + latDelta,
+			MinLongitude: lon1 - lonDelta, MaxLongitude: lon1 + lonDelta,
+		})
+	}
+	rows.Close()
+	tl.dbMu.RUnlock()
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(bounds) > 0 {
+		return bounds, "a place", nil
+	}
+
+	if b, ok := queryCountry(name); ok {
+		return []GeoBounds{b}, "a country", nil
+	}
+	return nil, "", nil
+}
+
+// queryDataSource returns the name of the data source with the given name or
+// title, and whether there is one.
+func (tl *Timeline) queryDataSource(ctx context.Context, nameOrTitle string) (string, bool, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	var name string
+	err := tl.db.QueryRowContext(ctx, `SELECT name FROM data_sources WHERE name=? COLLATE NOCASE OR title=? COLLATE NOCASE LIMIT 1`,
+		nameOrTitle, nameOrTitle).Scan(&name)
+	if err == nil {
+		return name, true, nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return "", false, fmt.Errorf("resolving data source %q: %w", nameOrTitle, err)
+}
+
+// how far around a place, given as a point, its items may be
+const queryPlaceRadiusMeters = 250
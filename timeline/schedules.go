@@ -0,0 +1,633 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Schedule creates jobs automatically, either on a cron schedule or at
+// a fixed interval, such as an import from an export folder that is
+// updated every night. Like Job, it is only for shuttling schedule data
+// in and out of the DB.
+type Schedule struct {
+	// not a field in the DB, but useful for bookkeeping where multiple timelines are open
+	RepoID string `json:"repo_id"`
+
+	ID        uint64        `json:"id"`
+	Name      *string       `json:"name,omitempty"`
+	Type      JobType       `json:"type"`
+	Config    string        `json:"config,omitempty"` // JSON encoding of the job action
+	Cron      string        `json:"cron,omitempty"`
+	Interval  time.Duration `json:"interval,omitempty"`
+	Paused    bool          `json:"paused"`
+	Created   time.Time     `json:"created"`
+	NextRun   *time.Time    `json:"next_run,omitempty"` // nil if it will never run again
+	LastJobID *uint64       `json:"last_job_id,omitempty"`
+}
+
+// ScheduleSpec describes when a schedule creates jobs. Exactly one of
+// Cron or Interval must be set.
+type ScheduleSpec struct {
+	// An optional name for the schedule.
+	Name string `json:"name,omitempty"`
+
+	// A cron expression in local time, with 5 fields: minute, hour,
+	// day of month, month, and day of week (0 or 7 is Sunday). Fields
+	// may be "*", values, ranges, and steps, separated by commas, as in
+	// "0 3 * * 1-5" for 3 AM on weekdays. The shorthands @hourly, @daily
+	// (or @midnight), @weekly, @monthly, and @yearly (or @annually) may
+	// be used instead.
+	Cron string `json:"cron,omitempty"`
+
+	// How long after a job is created to create the next one; at
+	// least a minute.
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+// nextFunc returns a function that returns the first time after a given
+// time that a job should be created, or the zero time if never.
+func (spec ScheduleSpec) nextFunc() (func(time.Time) time.Time, error) {
+	switch {
+	case spec.Cron != "" && spec.Interval != 0:
+		return nil, errors.New("a schedule cannot have both a cron expression and an interval")
+	case spec.Cron != "":
+		cron, err := parseCron(spec.Cron)
+		if err != nil {
+			return nil, err
+		}
+		return cron.next, nil
+	case spec.Interval >= minScheduleInterval:
+		return func(t time.Time) time.Time { return t.Add(spec.Interval) }, nil
+	case spec.Interval > 0:
+		return nil, fmt.Errorf("schedule interval must be at least %s", minScheduleInterval)
+	default:
+		return nil, errors.New("a schedule needs a cron expression or an interval")
+	}
+}
+
+// CreateSchedule creates a schedule that creates jobs that run action
+// when spec calls for them (see CreateJob), and returns its ID. The
+// first job is created at the first time after now that spec calls for.
+func (tl *Timeline) CreateSchedule(ctx context.Context, action JobAction, spec ScheduleSpec) (uint64, error) {
+	jobType, err := jobTypeOf(action)
+	if err != nil {
+		return 0, err
+	}
+	config, err := json.Marshal(action)
+	if err != nil {
+		return 0, fmt.Errorf("JSON-encoding job action: %w", err)
+	}
+	next, err := spec.nextFunc()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	nextRun := next(now)
+
+	tl.dbMu.Lock()
+	var id uint64
+	err = tl.db.QueryRowContext(ctx, `
+		INSERT INTO schedules (name, type, configuration, cron, interval, created, next_run)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`,
+		nullString(spec.Name), jobType, string(config), nullString(spec.Cron), intervalSeconds(spec.Interval),
+		now.UnixMilli(), unixMilliOrNil(nextRun)).Scan(&id)
+	tl.dbMu.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("inserting new schedule row: %w", err)
+	}
+
+	Log.Named("schedule").Info("created schedule",
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("schedule_id", id),
+		zap.String("type", string(jobType)),
+		zap.Time("next_run", nextRun))
+
+	tl.notifySchedulesChanged()
+
+	return id, nil
+}
+
+// UpdateSchedule changes when the schedule with the given ID creates jobs.
+// The next job is created at the first time after now that spec calls for.
+func (tl *Timeline) UpdateSchedule(ctx context.Context, scheduleID uint64, spec ScheduleSpec) error {
+	next, err := spec.nextFunc()
+	if err != nil {
+		return err
+	}
+	nextRun := next(time.Now())
+	err = tl.updateSchedule(ctx, scheduleID,
+		`UPDATE schedules SET name=?, cron=?, interval=?, next_run=? WHERE id=?`,
+		nullString(spec.Name), nullString(spec.Cron), intervalSeconds(spec.Interval), unixMilliOrNil(nextRun), scheduleID)
+	if err != nil {
+		return err
+	}
+	Log.Named("schedule").Info("updated schedule",
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("schedule_id", scheduleID),
+		zap.Time("next_run", nextRun))
+	return nil
+}
+
+// PauseSchedule stops the schedule with the given ID from creating jobs
+// until it is unpaused. Jobs that it already created are not affected.
+func (tl *Timeline) PauseSchedule(ctx context.Context, scheduleID uint64) error {
+	err := tl.updateSchedule(ctx, scheduleID, `UPDATE schedules SET paused=1 WHERE id=?`, scheduleID)
+	if err != nil {
+		return err
+	}
+	Log.Named("schedule").Info("paused schedule",
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("schedule_id", scheduleID))
+	return nil
+}
+
+// UnpauseSchedule resumes the schedule with the given ID. Jobs that it
+// would have created while it was paused are skipped; the next job is
+// created at the first time after now that it calls for.
+func (tl *Timeline) UnpauseSchedule(ctx context.Context, scheduleID uint64) error {
+	tl.dbMu.RLock()
+	var cron *string
+	var interval *int64
+	err := tl.db.QueryRowContext(ctx, `SELECT cron, interval FROM schedules WHERE id=? LIMIT 1`, scheduleID).Scan(&cron, &interval)
+	tl.dbMu.RUnlock()
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("schedule %d not found", scheduleID)
+	}
+	if err != nil {
+		return err
+	}
+	next, err := scheduleSpecOf(cron, interval).nextFunc()
+	if err != nil {
+		return fmt.Errorf("schedule %d: %w", scheduleID, err)
+	}
+	nextRun := next(time.Now())
+	err = tl.updateSchedule(ctx, scheduleID,
+		`UPDATE schedules SET paused=0, next_run=? WHERE id=?`, unixMilliOrNil(nextRun), scheduleID)
+	if err != nil {
+		return err
+	}
+	Log.Named("schedule").Info("unpaused schedule",
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("schedule_id", scheduleID),
+		zap.Time("next_run", nextRun))
+	return nil
+}
+
+// DeleteSchedule deletes the schedule with the given ID. Jobs that it
+// already created are not affected.
+func (tl *Timeline) DeleteSchedule(ctx context.Context, scheduleID uint64) error {
+	err := tl.updateSchedule(ctx, scheduleID, `DELETE FROM schedules WHERE id=?`, scheduleID)
+	if err != nil {
+		return err
+	}
+	Log.Named("schedule").Info("deleted schedule",
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("schedule_id", scheduleID))
+	return nil
+}
+
+// updateSchedule runs the query, which must change the schedule with the
+// given ID, and notifies the schedule loop.
+func (tl *Timeline) updateSchedule(ctx context.Context, scheduleID uint64, query string, args ...any) error {
+	tl.dbMu.Lock()
+	result, err := tl.db.ExecContext(ctx, query, args...)
+	tl.dbMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("updating schedule %d: %w", scheduleID, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("schedule %d not found", scheduleID)
+	}
+	tl.notifySchedulesChanged()
+	return nil
+}
+
+// GetSchedules returns all the schedules in the timeline, with sensitive
+// values in their configurations redacted.
+func (tl *Timeline) GetSchedules(ctx context.Context) ([]Schedule, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `
+		SELECT id, name, type, configuration, cron, interval, paused, created, next_run, last_job_id
+		FROM schedules
+		ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("querying schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		var sched Schedule
+		var cron *string
+		var interval, nextRun *int64
+		var created int64
+		err := rows.Scan(&sched.ID, &sched.Name, &sched.Type, &sched.Config, &cron, &interval,
+			&sched.Paused, &created, &nextRun, &sched.LastJobID)
+		if err != nil {
+			return nil, fmt.Errorf("scanning schedule fields: %w", err)
+		}
+		spec := scheduleSpecOf(cron, interval)
+		sched.Cron, sched.Interval = spec.Cron, spec.Interval
+		sched.Created = time.UnixMilli(created)
+		if nextRun != nil {
+			ts := time.UnixMilli(*nextRun)
+			sched.NextRun = &ts
+		}
+		sched.RepoID = tl.id.String()
+		sched.Config = redactedJobConfig(sched.Type, sched.Config)
+		schedules = append(schedules, sched)
+	}
+	return schedules, rows.Err()
+}
+
+// notifySchedulesChanged tells the schedule loop to look at the schedules again.
+func (tl *Timeline) notifySchedulesChanged() {
+	select {
+	case tl.schedulesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// scheduleLoop creates the jobs of schedules when they are due, while the
+// timeline is open. If a schedule came due while the timeline was closed,
+// its job is created (once) right away.
+func (tl *Timeline) scheduleLoop() {
+	logger := Log.Named("schedule")
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-tl.ctx.Done():
+			return
+		case <-timer.C:
+		case <-tl.schedulesChanged:
+		}
+
+		wait, err := tl.runDueSchedules(logger)
+		if err != nil {
+			if tl.ctx.Err() != nil {
+				return
+			}
+			logger.Error("running due schedules", zap.Error(err))
+		}
+		timer.Reset(wait)
+	}
+}
+
+// runDueSchedules creates the jobs of the schedules that are due, and
+// returns how long to wait until the next one is.
+func (tl *Timeline) runDueSchedules(logger *zap.Logger) (time.Duration, error) {
+	now := time.Now()
+
+	tl.dbMu.RLock()
+	due, err := tl.dueSchedules(now)
+	tl.dbMu.RUnlock()
+	if err != nil {
+		return schedulePollInterval, err
+	}
+
+	for _, sched := range due {
+		if err := tl.runSchedule(logger, sched, now); err != nil {
+			logger.Error("running schedule",
+				zap.String("repo_id", tl.ID().String()),
+				zap.Uint64("schedule_id", sched.id),
+				zap.Error(err))
+		}
+	}
+
+	var nextRun *int64
+	tl.dbMu.RLock()
+	err = tl.db.QueryRowContext(tl.ctx, `SELECT min(next_run) FROM schedules WHERE paused=0`).Scan(&nextRun)
+	tl.dbMu.RUnlock()
+	if err != nil {
+		return schedulePollInterval, fmt.Errorf("finding next schedule: %w", err)
+	}
+	if nextRun == nil {
+		return schedulePollInterval, nil
+	}
+	// check again every so often anyway, in case the clock changes
+	return min(max(time.Until(time.UnixMilli(*nextRun)), 0), schedulePollInterval), nil
+}
+
+// dueSchedule is a schedule that is due to create a job.
+type dueSchedule struct {
+	id           uint64
+	jobType      JobType
+	config       string
+	spec         ScheduleSpec
+	lastJobID    *uint64
+	lastJobState *JobState // nil if there is no last job
+}
+
+// dueSchedules returns the schedules that are due at now. A read lock
+// MUST be obtained on the timeline database when calling this function!
+func (tl *Timeline) dueSchedules(now time.Time) ([]dueSchedule, error) {
+	rows, err := tl.db.QueryContext(tl.ctx, `
+		SELECT s.id, s.type, s.configuration, s.cron, s.interval, s.last_job_id, j.state
+		FROM schedules AS s
+		LEFT JOIN jobs AS j ON j.id = s.last_job_id
+		WHERE s.paused=0 AND s.next_run <= ?`, now.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("querying due schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var due []dueSchedule
+	for rows.Next() {
+		var sched dueSchedule
+		var cron *string
+		var interval *int64
+		err := rows.Scan(&sched.id, &sched.jobType, &sched.config, &cron, &interval, &sched.lastJobID, &sched.lastJobState)
+		if err != nil {
+			return nil, fmt.Errorf("scanning due schedule: %w", err)
+		}
+		sched.spec = scheduleSpecOf(cron, interval)
+		due = append(due, sched)
+	}
+	return due, rows.Err()
+}
+
+// runSchedule creates the job of sched, unless the job it created last
+// time hasn't finished yet, in which case this run is skipped, and then
+// sets when it is next due. Both are reported through the job status
+// logger, so the UI can show them.
+func (tl *Timeline) runSchedule(logger *zap.Logger, sched dueSchedule, now time.Time) error {
+	// set the next run first, so that a schedule that fails
+	// to create its job doesn't try again right away
+	var nextRun time.Time
+	next, err := sched.spec.nextFunc()
+	if err == nil {
+		nextRun = next(now)
+	}
+	tl.dbMu.Lock()
+	_, updateErr := tl.db.ExecContext(tl.ctx, `UPDATE schedules SET next_run=? WHERE id=?`, unixMilliOrNil(nextRun), sched.id)
+	tl.dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if updateErr != nil {
+		return fmt.Errorf("updating next run: %w", updateErr)
+	}
+
+	statusLog := Log.Named("job.status").With(
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("schedule_id", sched.id),
+		zap.Time("next_run", nextRun))
+
+	if sched.lastJobState != nil {
+		switch *sched.lastJobState {
+		case JobQueued, JobStarted, JobPaused, JobInterrupted:
+			statusLog.Warn("skipped scheduled job",
+				zap.Uint64p("last_job_id", sched.lastJobID),
+				zap.String("last_job_state", string(*sched.lastJobState)))
+			return nil
+		}
+	}
+
+	action, err := decodeJobAction(sched.jobType, sched.config)
+	if err != nil {
+		return err
+	}
+	jobID, err := tl.CreateJob(action, time.Time{}, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("creating job: %w", err)
+	}
+	if jobID == 0 {
+		// an identical job is already queued
+		logger.Debug("scheduled job is already queued", zap.Uint64("schedule_id", sched.id))
+		return nil
+	}
+
+	tl.dbMu.Lock()
+	_, err = tl.db.ExecContext(tl.ctx, `UPDATE schedules SET last_job_id=? WHERE id=?`, jobID, sched.id)
+	tl.dbMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("recording scheduled job %d: %w", jobID, err)
+	}
+
+	statusLog.Info("scheduled", zap.Uint64("id", jobID))
+
+	return nil
+}
+
+// scheduleSpecOf returns the spec of a schedule from its DB columns.
+func scheduleSpecOf(cron *string, interval *int64) ScheduleSpec {
+	var spec ScheduleSpec
+	if cron != nil {
+		spec.Cron = *cron
+	}
+	if interval != nil {
+		spec.Interval = time.Duration(*interval) * time.Second
+	}
+	return spec
+}
+
+// intervalSeconds returns the number of seconds in d for the DB, or nil if d is 0.
+func intervalSeconds(d time.Duration) *int64 {
+	if d == 0 {
+		return nil
+	}
+	secs := int64(d / time.Second)
+	return &secs
+}
+
+func unixMilliOrNil(t time.Time) *int64 {
+	if t.IsZero() {
+		return nil
+	}
+	ms := t.UnixMilli()
+	return &ms
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// cronSchedule is a parsed cron expression. Each field is a bit set
+// of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// whether the day of month and the day of week are restricted; if
+	// both are, a day matches if either one does, as in standard cron
+	domRestricted, dowRestricted bool
+}
+
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 1 {
+		if full, ok := cronShorthands[strings.ToLower(fields[0])]; ok {
+			fields = strings.Fields(full)
+		}
+	}
+	if len(fields) != 5 { //nolint:mnd
+		return cronSchedule{}, fmt.Errorf("cron expression %q must have 5 fields: minute, hour, day of month, month, and day of week", expr)
+	}
+
+	var cron cronSchedule
+	for i, f := range []struct {
+		name     string
+		min, max int
+		set      *uint64
+	}{
+		{"minute", 0, 59, &cron.minute},
+		{"hour", 0, 23, &cron.hour},
+		{"day of month", 1, 31, &cron.dom},
+		{"month", 1, 12, &cron.month},
+		{"day of week", 0, 7, &cron.dow},
+	} {
+		set, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("%s in cron expression %q: %w", f.name, expr, err)
+		}
+		*f.set = set
+	}
+	if cron.dow&(1<<7) != 0 {
+		cron.dow = cron.dow&^(1<<7) | 1 // 7 is also Sunday
+	}
+	cron.domRestricted = !strings.HasPrefix(fields[2], "*")
+	cron.dowRestricted = !strings.HasPrefix(fields[4], "*")
+
+	if cron.next(time.Now()).IsZero() {
+		return cronSchedule{}, fmt.Errorf("cron expression %q never matches", expr)
+	}
+	return cron, nil
+}
+
+// parseCronField parses a field of a cron expression whose values
+// range from lo to hi, into a bit set of the values it matches.
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		values, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		start, end := lo, hi
+		if values != "*" {
+			first, last, isRange := strings.Cut(values, "-")
+			var err error
+			if start, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			switch {
+			case isRange:
+				if end, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			case !hasStep:
+				end = start
+			} // otherwise, as in "5/15", the step starts at the value
+			if start < lo || end > hi || start > end {
+				return 0, fmt.Errorf("%q is not within %d-%d", values, lo, hi)
+			}
+		}
+		for v := start; v <= end; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// next returns the first time after t, to the minute, that matches the
+// cron expression, in t's location, or the zero time if there is none
+// within the next few years (such as for February 30).
+func (cron cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+	for t.Before(limit) {
+		var next time.Time
+		switch {
+		case cron.month&(1<<int(t.Month())) == 0:
+			next = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !cron.dayMatches(t):
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case cron.hour&(1<<t.Hour()) == 0:
+			next = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case cron.minute&(1<<t.Minute()) == 0:
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		// around daylight saving time changes, the wall clock time
+		// may not be what we asked for, but we must always move on
+		if !next.After(t) {
+			next = t.Add(time.Minute)
+		}
+		// like cron, run jobs that are in an hour that is skipped when
+		// the clock springs forward as soon as it does
+		if next.YearDay() == t.YearDay() && next.Hour() > t.Hour()+1 {
+			for h := t.Hour() + 1; h < next.Hour(); h++ {
+				if cron.hour&(1<<h) != 0 {
+					return next
+				}
+			}
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+func (cron cronSchedule) dayMatches(t time.Time) bool {
+	dom := cron.dom&(1<<t.Day()) != 0
+	dow := cron.dow&(1<<int(t.Weekday())) != 0
+	if cron.domRestricted && cron.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+const (
+	minScheduleInterval  = time.Minute
+	schedulePollInterval = time.Hour
+	cronSearchYears      = 5
+)
@@ -0,0 +1,81 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+	after := time.Date(2025, time.March, 7, 10, 30, 0, 0, loc) // a Friday
+
+	for _, test := range []struct {
+		expr string
+		want time.Time
+	}{
+		{expr: "* * * * *", want: time.Date(2025, time.March, 7, 10, 31, 0, 0, loc)},
+		{expr: "0 3 * * *", want: time.Date(2025, time.March, 8, 3, 0, 0, 0, loc)},
+		{expr: "@hourly", want: time.Date(2025, time.March, 7, 11, 0, 0, 0, loc)},
+		{expr: "*/20 * * * *", want: time.Date(2025, time.March, 7, 10, 40, 0, 0, loc)},
+		{expr: "5/20 10 * * *", want: time.Date(2025, time.March, 7, 10, 45, 0, 0, loc)},
+		{expr: "0 9 * * 1-5", want: time.Date(2025, time.March, 10, 9, 0, 0, 0, loc)},
+		{expr: "0 0 * * 7", want: time.Date(2025, time.March, 9, 0, 0, 0, 0, loc)},
+		{expr: "0 0 1,15 * *", want: time.Date(2025, time.March, 15, 0, 0, 0, 0, loc)},
+		{expr: "0 0 29 2 *", want: time.Date(2028, time.February, 29, 0, 0, 0, 0, loc)},
+		{expr: "0 0 13 * 5", want: time.Date(2025, time.March, 13, 0, 0, 0, 0, loc)}, // day of month or week
+		{expr: "30 2 * * *", want: time.Date(2025, time.March, 8, 2, 30, 0, 0, loc)},
+		{expr: "30 2 9 3 *", want: time.Date(2025, time.March, 9, 3, 0, 0, 0, loc)}, // 2:30 doesn't exist that day
+		{expr: "@yearly", want: time.Date(2026, time.January, 1, 0, 0, 0, 0, loc)},
+	} {
+		cron, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if got := cron.next(after); !got.Equal(test.want) {
+			t.Errorf("%q: expected %s, got %s", test.expr, test.want, got)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"0 0 30 2 *",
+		"@fortnightly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
@@ -58,6 +58,21 @@ CREATE TABLE IF NOT EXISTS "jobs" (
 	FOREIGN KEY ("parent_job_id") REFERENCES "jobs"("id") ON UPDATE CASCADE ON DELETE SET NULL
 ) STRICT;
 
+-- Schedules create jobs automatically, such as an import from an export folder every night.
+CREATE TABLE IF NOT EXISTS "schedules" (
+	"id" INTEGER PRIMARY KEY,
+	"name" TEXT, -- an optional user-assigned name
+	"type" TEXT NOT NULL, -- type of job to create (same as jobs.type)
+	"configuration" TEXT NOT NULL, -- configuration of the job to create, encoded as JSON
+	"cron" TEXT, -- when to create jobs, as a cron expression in local time...
+	"interval" INTEGER, -- ...or how many seconds apart (exactly one of the two is set)
+	"paused" INTEGER NOT NULL DEFAULT 0, -- 1 if jobs should not be created for now
+	"created" INTEGER NOT NULL, -- timestamp in unix milliseconds UTC
+	"next_run" INTEGER, -- timestamp in unix milliseconds UTC when the next job is to be created
+	"last_job_id" INTEGER, -- the most recent job that was created, so we can tell if it is still running
+	FOREIGN KEY ("last_job_id") REFERENCES "jobs"("id") ON UPDATE CASCADE ON DELETE SET NULL
+) STRICT;
+
 -- TODO: Update comment; should the embedding just be stored in the items table now??
 --
 -- Embeddings enable "intelligent" search using ML models to derive semantics and meaning.
@@ -210,6 +225,7 @@ CREATE TABLE IF NOT EXISTS "items" (
 ) STRICT;
 
 CREATE INDEX IF NOT EXISTS "idx_items_timestamp" ON "items"("timestamp");
+CREATE INDEX IF NOT EXISTS "idx_items_attribute_id" ON "items"("attribute_id");
 
 -- Relationships may exist between and across items and entities. A row
 -- in this table is an actual connection between items and/or entities.
@@ -237,6 +253,14 @@ CREATE TABLE IF NOT EXISTS "relationships" (
 -- and this way only 1 index is necessary, not multiple on the various fields we check for uniqueness
 CREATE INDEX IF NOT EXISTS "idx_relationships_from_item_id" ON "relationships"("from_item_id");
 
+-- These are for traversing the graph of items and entities (see graphquery.go), which
+-- has to find the relationships at either end of a node
+CREATE INDEX IF NOT EXISTS "idx_relationships_to_item_id" ON "relationships"("to_item_id");
+CREATE INDEX IF NOT EXISTS "idx_relationships_from_attribute_id" ON "relationships"("from_attribute_id");
+CREATE INDEX IF NOT EXISTS "idx_relationships_to_attribute_id" ON "relationships"("to_attribute_id");
+CREATE INDEX IF NOT EXISTS "idx_entity_attributes_entity_id" ON "entity_attributes"("entity_id");
+CREATE INDEX IF NOT EXISTS "idx_entity_attributes_attribute_id" ON "entity_attributes"("attribute_id");
+
 -- Relations define the way relationships connect. They are described by natural
 -- language phrases such as "in reply to", "picture of", or "attached to"; or could
 -- be words like "siblings", "coworkers", or "related". Relations will either be
@@ -354,6 +378,211 @@ CREATE TABLE IF NOT EXISTS "settings" (
 	FOREIGN KEY ("data_source_id") REFERENCES "data_sources"("id") ON UPDATE CASCADE ON DELETE CASCADE
 );
 
+-- When duplicate items are merged, the items that were merged into another are deleted,
+-- but where they came from is preserved here, so the item that was kept still has the
+-- provenance of each source, and so importing them again doesn't duplicate them again.
+CREATE TABLE IF NOT EXISTS "item_sources" (
+	"id" INTEGER PRIMARY KEY,
+	"item_id" INTEGER NOT NULL, -- the item that was kept
+	"data_source_id" INTEGER,
+	"job_id" INTEGER, -- the import job that originally inserted the merged item
+	"original_id" TEXT,
+	"original_location" TEXT,
+	"intermediate_location" TEXT,
+	"filename" TEXT,
+	"data_hash" BLOB, -- BLAKE3 checksum of the data file of the merged item, which may have been different
+	"metadata" TEXT, -- metadata of the merged item, encoded as JSON
+	"merged" INTEGER NOT NULL DEFAULT (unixepoch()), -- when the item was merged (unix seconds)
+	FOREIGN KEY ("item_id") REFERENCES "items"("id") ON UPDATE CASCADE ON DELETE CASCADE,
+	FOREIGN KEY ("data_source_id") REFERENCES "data_sources"("id") ON UPDATE CASCADE,
+	FOREIGN KEY ("job_id") REFERENCES "jobs"("id") ON UPDATE CASCADE ON DELETE SET NULL,
+	UNIQUE ("data_source_id", "original_id")
+) STRICT;
+
+CREATE INDEX IF NOT EXISTS "idx_item_sources_item_id" ON "item_sources"("item_id");
+
+-- Perceptual hashes of the images of items, computed from their thumbnails, for finding
+-- images that look the same but aren't byte-for-byte identical (resized or re-encoded).
+CREATE TABLE IF NOT EXISTS "perceptual_hashes" (
+	"item_id" INTEGER PRIMARY KEY,
+	"hash" INTEGER NOT NULL, -- 64-bit difference hash (dHash)
+	FOREIGN KEY ("item_id") REFERENCES "items"("id") ON UPDATE CASCADE ON DELETE CASCADE
+) STRICT;
+
+CREATE INDEX IF NOT EXISTS "idx_items_data_hash" ON "items"("data_hash");
+
+-- The history of entity merges, so merges can be undone. Each row records the merge of one
+-- entity into another, along with what is needed to restore the merged entity (see
+-- entityresolution.go). The kept entity is not a foreign key, so the history outlives it.
+CREATE TABLE IF NOT EXISTS "entity_merges" (
+	"id" INTEGER PRIMARY KEY,
+	"entity_id" INTEGER NOT NULL, -- the entity that was kept
+	"merged_entity_id" INTEGER NOT NULL, -- the entity that was merged into it (and deleted)
+	"merged" INTEGER NOT NULL DEFAULT (unixepoch()), -- when the merge happened (unix seconds)
+	"undone" INTEGER, -- when the merge was undone (unix seconds), if it was
+	"undo" TEXT NOT NULL -- the state of the entities before the merge, encoded as JSON
+) STRICT;
+
+CREATE INDEX IF NOT EXISTS "idx_entity_merges_entity_id" ON "entity_merges"("entity_id");
+
+-- Pairs of entities that are likely the same person (or thing), as scored by entity resolution.
+-- Suggestions are refreshed after imports; dismissed suggestions are kept so they aren't suggested again.
+CREATE TABLE IF NOT EXISTS "entity_merge_suggestions" (
+	"id" INTEGER PRIMARY KEY,
+	"entity_id" INTEGER NOT NULL,
+	"other_entity_id" INTEGER NOT NULL, -- always greater than entity_id
+	"confidence" REAL NOT NULL, -- 0 to 1
+	"reasons" TEXT, -- the attributes that matched, encoded as a JSON array
+	"updated" INTEGER NOT NULL DEFAULT (unixepoch()),
+	"dismissed" INTEGER, -- when the user indicated these are not the same entity (unix seconds)
+	FOREIGN KEY ("entity_id") REFERENCES "entities"("id") ON UPDATE CASCADE ON DELETE CASCADE,
+	FOREIGN KEY ("other_entity_id") REFERENCES "entities"("id") ON UPDATE CASCADE ON DELETE CASCADE,
+	UNIQUE ("entity_id", "other_entity_id")
+) STRICT;
+
+-- The version vector of each item for syncing with other timelines (see sync.go). The uid
+-- identifies the item across timelines. When an item is deleted from the table, its row stays
+-- behind as a tombstone (with a NULL item_id), so that the deletion is synced too.
+CREATE TABLE IF NOT EXISTS "sync_items" (
+	"id" INTEGER PRIMARY KEY,
+	"item_id" INTEGER UNIQUE,
+	"uid" TEXT NOT NULL UNIQUE,
+	"vector" TEXT NOT NULL, -- JSON object of replica (repo ID) => sequence number of its latest change
+	"hash" BLOB, -- hash of the item's content when its vector was last updated
+	"changed" INTEGER NOT NULL, -- when the item was last changed, as far as sync is concerned (unix ms)
+	FOREIGN KEY ("item_id") REFERENCES "items"("id") ON UPDATE CASCADE ON DELETE SET NULL
+) STRICT;
+
+-- Remote timelines this timeline syncs with.
+CREATE TABLE IF NOT EXISTS "sync_peers" (
+	"id" INTEGER PRIMARY KEY,
+	"url" TEXT NOT NULL UNIQUE,
+	"token" TEXT, -- bearer token to authenticate with the remote
+	"conflict_policy" TEXT NOT NULL DEFAULT 'newest',
+	"repo_id" TEXT, -- ID of the remote timeline, once known
+	"last_synced" INTEGER -- unix seconds
+) STRICT;
+
+-- State that data sources keep across imports, so they can import incrementally
+-- (for example, which messages in a mailbox have already been imported).
+CREATE TABLE IF NOT EXISTS "import_state" (
+	"data_source_id" INTEGER NOT NULL,
+	"key" TEXT NOT NULL, -- chosen by the data source (e.g. an account and folder)
+	"value" TEXT NOT NULL, -- JSON
+	"updated" INTEGER NOT NULL, -- unix milliseconds
+	PRIMARY KEY ("data_source_id", "key"),
+	FOREIGN KEY ("data_source_id") REFERENCES "data_sources"("id") ON UPDATE CASCADE ON DELETE CASCADE
+) STRICT;
+
+-- Rules for deleting or redacting classes of items, like old browser history (see policies.go).
+CREATE TABLE IF NOT EXISTS "policies" (
+	"id" INTEGER PRIMARY KEY,
+	"name" TEXT, -- an optional user-assigned name
+	"definition" TEXT NOT NULL, -- the action and criteria of the policy, encoded as JSON
+	"created" INTEGER NOT NULL DEFAULT (unixepoch()),
+	"last_enforced" INTEGER -- unix seconds
+) STRICT;
+
+-- Items whose content was erased by a policy; the rows are tombstones, so
+-- that imports don't restore the content. The policy is not a foreign key,
+-- so the tombstones outlive it.
+CREATE TABLE IF NOT EXISTS "redacted_items" (
+	"item_id" INTEGER PRIMARY KEY,
+	"policy_id" INTEGER,
+	"redacted" INTEGER NOT NULL, -- unix seconds
+	FOREIGN KEY ("item_id") REFERENCES "items"("id") ON UPDATE CASCADE ON DELETE CASCADE
+) STRICT;
+
+-- Grants of read-only access to part of the timeline (see sharing.go). Only the hash
+-- of each token is stored; grants are revoked rather than deleted, for reference.
+CREATE TABLE IF NOT EXISTS "share_grants" (
+	"id" INTEGER PRIMARY KEY,
+	"name" TEXT, -- an optional user-assigned name, like who it was shared with
+	"token_hash" TEXT NOT NULL UNIQUE, -- hex-encoded SHA-256 of the token
+	"scope" TEXT NOT NULL, -- what the grant gives access to, encoded as JSON
+	"created" INTEGER NOT NULL DEFAULT (unixepoch()),
+	"expires" INTEGER, -- unix seconds
+	"revoked" INTEGER, -- unix seconds
+	"last_used" INTEGER -- unix seconds
+) STRICT;
+
+-- What on-device analysis of an item's content found (see enrichment.go):
+-- text recognized in it, and tags of the objects and scenes it depicts.
+CREATE TABLE IF NOT EXISTS "item_enrichments" (
+	"id" INTEGER PRIMARY KEY,
+	"item_id" INTEGER NOT NULL,
+	"kind" TEXT NOT NULL, -- "ocr" or "tag"
+	"value" TEXT NOT NULL, -- the recognized text, or the tag's label
+	"score" REAL, -- confidence, from 0 to 1
+	"generated" INTEGER NOT NULL DEFAULT (unixepoch()),
+	FOREIGN KEY ("item_id") REFERENCES "items"("id") ON UPDATE CASCADE ON DELETE CASCADE
+) STRICT;
+
+CREATE INDEX IF NOT EXISTS "idx_item_enrichments_item_id" ON "item_enrichments"("item_id");
+CREATE INDEX IF NOT EXISTS "idx_item_enrichments_kind_value" ON "item_enrichments"("kind", "value");
+
+-- Groups of similar faces, which are probably of the same person. Once a cluster
+-- is linked to an entity, the items with its faces are related to the entity.
+CREATE TABLE IF NOT EXISTS "face_clusters" (
+	"id" INTEGER PRIMARY KEY,
+	"entity_id" INTEGER,
+	"centroid" BLOB NOT NULL, -- mean of the embeddings of its faces, as a float32 vector
+	FOREIGN KEY ("entity_id") REFERENCES "entities"("id") ON UPDATE CASCADE ON DELETE SET NULL
+) STRICT;
+
+-- Faces detected in items, with the box around each face relative to the
+-- dimensions of the image (from 0 to 1).
+CREATE TABLE IF NOT EXISTS "faces" (
+	"id" INTEGER PRIMARY KEY,
+	"item_id" INTEGER NOT NULL,
+	"cluster_id" INTEGER,
+	"left" REAL NOT NULL,
+	"top" REAL NOT NULL,
+	"right" REAL NOT NULL,
+	"bottom" REAL NOT NULL,
+	"score" REAL, -- confidence of the detection
+	"embedding" BLOB NOT NULL, -- float32 vector
+	"generated" INTEGER NOT NULL DEFAULT (unixepoch()),
+	FOREIGN KEY ("item_id") REFERENCES "items"("id") ON UPDATE CASCADE ON DELETE CASCADE,
+	FOREIGN KEY ("cluster_id") REFERENCES "face_clusters"("id") ON UPDATE CASCADE ON DELETE SET NULL
+) STRICT;
+
+CREATE INDEX IF NOT EXISTS "idx_faces_item_id" ON "faces"("item_id");
+CREATE INDEX IF NOT EXISTS "idx_faces_cluster_id" ON "faces"("cluster_id");
+
+-- Where backups of the timeline are stored (see backup.go).
+CREATE TABLE IF NOT EXISTS "backup_targets" (
+	"id" INTEGER PRIMARY KEY,
+	"name" TEXT, -- an optional user-assigned name
+	"config" TEXT NOT NULL, -- the location and credentials of the target, encoded as JSON
+	"created" INTEGER NOT NULL DEFAULT (unixepoch())
+) STRICT;
+
+-- The catalog of snapshots of the timeline; each target also has a catalog of its own,
+-- along with the manifests of the snapshots, which list their files. The job is not a
+-- foreign key, since jobs are kept when a snapshot is restored anyway.
+CREATE TABLE IF NOT EXISTS "backup_snapshots" (
+	"id" TEXT PRIMARY KEY,
+	"target_id" INTEGER NOT NULL,
+	"created" INTEGER NOT NULL, -- unix milliseconds
+	"job_id" INTEGER,
+	"database_hash" TEXT NOT NULL, -- BLAKE3 hash of the snapshot of the database
+	"database_size" INTEGER NOT NULL,
+	"files" INTEGER NOT NULL, -- how many data files and assets are in the snapshot
+	"size" INTEGER NOT NULL, -- total bytes of the database and files
+	"uploaded" INTEGER NOT NULL, -- bytes copied to the target; the rest were already there
+	FOREIGN KEY ("target_id") REFERENCES "backup_targets"("id") ON UPDATE CASCADE ON DELETE CASCADE
+) STRICT;
+
+CREATE INDEX IF NOT EXISTS "idx_backup_snapshots_target_created" ON "backup_snapshots"("target_id", "created");
+
+-- The reports of import previews (dry runs), which are kept with their jobs.
+CREATE TABLE IF NOT EXISTS "import_previews" (
+	"job_id" INTEGER PRIMARY KEY,
+	"report" TEXT NOT NULL, -- PreviewReport encoded as JSON
+	FOREIGN KEY ("job_id") REFERENCES "jobs"("id") ON UPDATE CASCADE ON DELETE CASCADE
+) STRICT;
+
 -- TODO: this is convenient -- will probably keep this, because the db-based enums like data sources and classifications
 -- don't get translated earlier; maybe we could, but I still need to think on that... if we do keep this,
 -- I wonder if it'd be useful to loop in the attribute name and value as well? for item de-duplication in loadItemRow()....
@@ -384,4 +613,111 @@ CREATE TRIGGER IF NOT EXISTS prevent_stray_attributes
 			(SELECT id FROM entity_attributes WHERE attribute_id=OLD.attribute_id OR autolink_attribute_id=OLD.attribute_id LIMIT 1)) = 0
 	BEGIN
 		DELETE FROM attributes WHERE id=OLD.attribute_id;
-	END;
\ No newline at end of file
+	END;
+
+-- Full-text search index of items (see SearchText). The docid of each
+-- row is the ID of the item it indexes. It is kept up to date by the
+-- triggers below, and is built for existing items when it is created.
+-- (FTS5 would be nicer, but it is not compiled into the driver by default.)
+CREATE VIRTUAL TABLE IF NOT EXISTS "items_fts" USING fts4("data_text", "filename", "entity_name", "metadata", tokenize=unicode61);
+
+-- The content of items as it is indexed (including the names of the
+-- entities the items are attributed to).
+CREATE VIEW IF NOT EXISTS "items_fts_source" AS
+	SELECT
+		items.id,
+		items.data_text,
+		items.filename,
+		(SELECT group_concat(DISTINCT entities.name)
+			FROM entity_attributes
+			JOIN entities ON entities.id = entity_attributes.entity_id
+			WHERE entity_attributes.attribute_id = items.attribute_id) AS entity_name,
+		items.metadata
+	FROM items;
+
+CREATE TRIGGER IF NOT EXISTS items_fts_insert
+	AFTER INSERT ON items
+	BEGIN
+		INSERT INTO items_fts (docid, data_text, filename, entity_name, metadata)
+			SELECT id, data_text, filename, entity_name, metadata FROM items_fts_source WHERE id=NEW.id;
+	END;
+
+CREATE TRIGGER IF NOT EXISTS items_fts_update
+	AFTER UPDATE OF id, data_text, filename, attribute_id, metadata ON items
+	BEGIN
+		DELETE FROM items_fts WHERE docid=OLD.id;
+		INSERT INTO items_fts (docid, data_text, filename, entity_name, metadata)
+			SELECT id, data_text, filename, entity_name, metadata FROM items_fts_source WHERE id=NEW.id;
+	END;
+
+CREATE TRIGGER IF NOT EXISTS items_fts_delete
+	AFTER DELETE ON items
+	BEGIN
+		DELETE FROM items_fts WHERE docid=OLD.id;
+	END;
+
+-- When entities are renamed, merged, or get or lose attributes, the
+-- entity names of items attributed to them have to be re-indexed.
+CREATE TRIGGER IF NOT EXISTS items_fts_entity_rename
+	AFTER UPDATE OF name ON entities
+	BEGIN
+		UPDATE items_fts
+			SET entity_name=(SELECT entity_name FROM items_fts_source WHERE id=items_fts.docid)
+			WHERE docid IN (SELECT items.id FROM items
+				JOIN entity_attributes ON entity_attributes.attribute_id = items.attribute_id
+				WHERE entity_attributes.entity_id=NEW.id);
+	END;
+
+CREATE TRIGGER IF NOT EXISTS items_fts_entity_attribute_insert
+	AFTER INSERT ON entity_attributes
+	BEGIN
+		UPDATE items_fts
+			SET entity_name=(SELECT entity_name FROM items_fts_source WHERE id=items_fts.docid)
+			WHERE docid IN (SELECT id FROM items WHERE attribute_id=NEW.attribute_id);
+	END;
+
+CREATE TRIGGER IF NOT EXISTS items_fts_entity_attribute_update
+	AFTER UPDATE OF entity_id, attribute_id ON entity_attributes
+	BEGIN
+		UPDATE items_fts
+			SET entity_name=(SELECT entity_name FROM items_fts_source WHERE id=items_fts.docid)
+			WHERE docid IN (SELECT id FROM items WHERE attribute_id=OLD.attribute_id OR attribute_id=NEW.attribute_id);
+	END;
+
+CREATE TRIGGER IF NOT EXISTS items_fts_entity_attribute_delete
+	AFTER DELETE ON entity_attributes
+	BEGIN
+		UPDATE items_fts
+			SET entity_name=(SELECT entity_name FROM items_fts_source WHERE id=items_fts.docid)
+			WHERE docid IN (SELECT id FROM items WHERE attribute_id=OLD.attribute_id);
+	END;
+
+-- Spatial index of the coordinates of items (see geo.go), so that items
+-- in an area can be found without scanning the whole table. The id of
+-- each row is the ID of the item, which is a point, so its min and max
+-- coordinates are the same. Like the search index, it is kept up to date
+-- by the triggers below, and is built for existing items when created.
+CREATE VIRTUAL TABLE IF NOT EXISTS "items_rtree" USING rtree("id", "min_lat", "max_lat", "min_lon", "max_lon");
+
+CREATE TRIGGER IF NOT EXISTS items_rtree_insert
+	AFTER INSERT ON items
+	WHEN NEW.latitude IS NOT NULL AND NEW.longitude IS NOT NULL
+	BEGIN
+		INSERT INTO items_rtree (id, min_lat, max_lat, min_lon, max_lon)
+			VALUES (NEW.id, NEW.latitude, NEW.latitude, NEW.longitude, NEW.longitude);
+	END;
+
+CREATE TRIGGER IF NOT EXISTS items_rtree_update
+	AFTER UPDATE OF id, latitude, longitude ON items
+	BEGIN
+		DELETE FROM items_rtree WHERE id=OLD.id;
+		INSERT INTO items_rtree (id, min_lat, max_lat, min_lon, max_lon)
+			SELECT NEW.id, NEW.latitude, NEW.latitude, NEW.longitude, NEW.longitude
+			WHERE NEW.latitude IS NOT NULL AND NEW.longitude IS NOT NULL;
+	END;
+
+CREATE TRIGGER IF NOT EXISTS items_rtree_delete
+	AFTER DELETE ON items
+	BEGIN
+		DELETE FROM items_rtree WHERE id=OLD.id;
+	END;
@@ -325,7 +325,12 @@ func (tl *Timeline) Search(ctx context.Context, params ItemSearchParams) (Search
 			if !strings.HasPrefix(*result.DataType, "image/") {
 				continue
 			}
-			itemFiles[result.ID] = tl.FullPath(*result.DataFile)
+			fn, done, err := tl.DecryptedPath(*result.DataFile)
+			if err != nil {
+				return SearchResults{}, fmt.Errorf("opening data file: %w", err)
+			}
+			defer done()
+			itemFiles[result.ID] = fn
 		}
 
 		scores, err := classify(ctx, itemFiles, []string{params.SemanticText})
@@ -659,6 +664,17 @@ func (tl *Timeline) prepareSearchQuery(ctx context.Context, params ItemSearchPar
 				or("items.longitude "+lt+" ?", params.MaxLongitude)
 			})
 		}
+		// narrow down the candidates of a box using the spatial index; it stores
+		// 32-bit floats, so it is only approximate, but the exact comparisons
+		// above still apply (this can't be OR'ed with other fields, though)
+		if params.MinLatitude != nil && params.MaxLatitude != nil &&
+			params.MinLongitude != nil && params.MaxLongitude != nil && !params.OrFields {
+			and(func() {
+				or("items.id IN (SELECT id FROM items_rtree WHERE max_lat >= ? AND min_lat <= ? AND max_lon >= ? AND min_lon <= ?)",
+					params.MinLatitude)
+				args = append(args, params.MaxLatitude, params.MinLongitude, params.MaxLongitude)
+			})
+		}
 	}
 
 	// skip deleted items unless we are explicitly supposed to include them
@@ -980,9 +996,13 @@ type SearchResult struct {
 	Related []Related      `json:"related,omitempty"`
 	Size    int64          `json:"size,omitempty"`
 
-	// from ML model
+	// from ML model, or the relevance of a full-text search
 	Distance float64 `json:"distance,omitempty"`
 	Score    float64 `json:"score,omitempty"`
+
+	// from full-text search: an HTML excerpt of the item
+	// with the matching terms highlighted (see SearchText)
+	Snippet string `json:"snippet,omitempty"`
 }
 
 // TODO: Finish making this work
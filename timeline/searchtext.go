@@ -0,0 +1,325 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// TextSearchParams describes a full-text search for items.
+type TextSearchParams struct {
+	// The UUID of the open timeline to search.
+	Repo string `json:"repo,omitempty"`
+
+	// The words to search for, all of which must appear in an item's
+	// text, filename, metadata, or the name of the entity it's
+	// attributed to. Words ending in "*" match by prefix, and words
+	// in double quotes must appear together as a phrase.
+	Query string `json:"query"`
+
+	// Only include items in this date range, from these data sources,
+	// of these classifications, or attributed to these entities.
+	StartTimestamp *time.Time `json:"start_timestamp,omitempty"`
+	EndTimestamp   *time.Time `json:"end_timestamp,omitempty"`
+	DataSourceName []string   `json:"data_source,omitempty"`
+	Classification []string   `json:"classification,omitempty"`
+	EntityID       []uint64   `json:"entity_id,omitempty"`
+
+	Limit  int `json:"limit,omitempty"` // default 100
+	Offset int `json:"offset,omitempty"`
+}
+
+// SearchText finds the items that contain the words of the query, ordered
+// by relevance (best first). The score of each result is its relevance,
+// and its snippet is an excerpt of the matching content in which the
+// terms are highlighted with <mark> elements (the rest is escaped, so it
+// is safe to use as HTML). The total is the number of matching items.
+func (tl *Timeline) SearchText(ctx context.Context, params TextSearchParams) (SearchResults, error) {
+	match := ftsQuery(params.Query)
+	if match == "" {
+		return SearchResults{}, errors.New("search query has no words")
+	}
+	if params.Limit <= 0 {
+		params.Limit = 100
+	}
+
+	ranked, err := tl.rankTextMatches(ctx, match, params)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	total := len(ranked)
+	if params.Offset >= total {
+		return SearchResults{Total: total, Items: make([]*SearchResult, 0)}, nil
+	}
+	ranked = ranked[params.Offset:min(params.Offset+params.Limit, total)]
+
+	rowIDs := make([]int64, len(ranked))
+	for i, m := range ranked {
+		rowIDs[i] = int64(m.itemID) //nolint:gosec // row IDs are positive
+	}
+	snippets, err := tl.textSnippets(ctx, match, rowIDs)
+	if err != nil {
+		return SearchResults{}, err
+	}
+
+	results, err := tl.Search(ctx, ItemSearchParams{RowID: rowIDs, Limit: -1})
+	if err != nil {
+		return SearchResults{}, err
+	}
+	byID := make(map[uint64]*SearchResult, len(results.Items))
+	for _, sr := range results.Items {
+		byID[sr.ID] = sr
+	}
+	items := make([]*SearchResult, 0, len(ranked))
+	for _, m := range ranked {
+		sr, ok := byID[m.itemID]
+		if !ok {
+			continue // hidden item, or deleted since we ranked it
+		}
+		sr.Score = m.score
+		sr.Snippet = snippets[m.itemID]
+		items = append(items, sr)
+	}
+
+	return SearchResults{Total: total, Items: items}, nil
+}
+
+// textMatch is an item that matched a full-text search.
+type textMatch struct {
+	itemID uint64
+	score  float64
+}
+
+// rankTextMatches returns all the items that match the full-text query,
+// with the filters of params applied, ordered by relevance.
+func (tl *Timeline) rankTextMatches(ctx context.Context, match string, params TextSearchParams) ([]textMatch, error) {
+	q := `SELECT items_fts.docid, matchinfo(items_fts, 'pcnalx')
+		FROM items_fts
+		JOIN items ON items.id = items_fts.docid`
+	where := []string{"items_fts MATCH ?", "items.deleted IS NULL"}
+	args := []any{match}
+
+	if len(params.DataSourceName) > 0 {
+		q += "\n\t\tJOIN data_sources ON data_sources.id = items.data_source_id"
+		where = append(where, "data_sources.name IN "+sqlPlaceholders(len(params.DataSourceName)))
+		for _, name := range params.DataSourceName {
+			args = append(args, name)
+		}
+	}
+	if len(params.Classification) > 0 {
+		q += "\n\t\tJOIN classifications ON classifications.id = items.classification_id"
+		where = append(where, "classifications.name IN "+sqlPlaceholders(len(params.Classification)))
+		for _, name := range params.Classification {
+			args = append(args, name)
+		}
+	}
+	if len(params.EntityID) > 0 {
+		where = append(where, "items.attribute_id IN (SELECT attribute_id FROM entity_attributes WHERE entity_id IN "+
+			sqlPlaceholders(len(params.EntityID))+")")
+		for _, id := range params.EntityID {
+			args = append(args, id)
+		}
+	}
+	if params.StartTimestamp != nil {
+		where = append(where, "items.timestamp >= ?")
+		args = append(args, params.StartTimestamp.UnixMilli())
+	}
+	if params.EndTimestamp != nil {
+		where = append(where, "items.timestamp <= ?")
+		args = append(args, params.EndTimestamp.UnixMilli())
+	}
+	q += "\n\t\tWHERE " + strings.Join(where, " AND ")
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying search index: %w", err)
+	}
+	defer rows.Close()
+
+	var matches []textMatch
+	for rows.Next() {
+		var m textMatch
+		var info []byte
+		if err := rows.Scan(&m.itemID, &info); err != nil {
+			return nil, err
+		}
+		m.score = bm25(info, ftsColumnWeights)
+		matches = append(matches, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating search matches: %w", err)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].itemID > matches[j].itemID // prefer newer items
+	})
+
+	return matches, nil
+}
+
+// textSnippets returns the highlighted snippets of the given items for
+// the full-text query, keyed by item ID.
+func (tl *Timeline) textSnippets(ctx context.Context, match string, rowIDs []int64) (map[uint64]string, error) {
+	args := []any{snippetStart, snippetEnd, snippetEllipsis, snippetTokens, match}
+	for _, id := range rowIDs {
+		args = append(args, id)
+	}
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT docid, snippet(items_fts, ?, ?, ?, -1, ?)
+		FROM items_fts
+		WHERE items_fts MATCH ? AND docid IN `+sqlPlaceholders(len(rowIDs)), args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying search snippets: %w", err)
+	}
+	defer rows.Close()
+
+	snippets := make(map[uint64]string, len(rowIDs))
+	for rows.Next() {
+		var id uint64
+		var snippet string
+		if err := rows.Scan(&id, &snippet); err != nil {
+			return nil, err
+		}
+		snippets[id] = highlightSnippet(snippet)
+	}
+	return snippets, rows.Err()
+}
+
+// highlightSnippet escapes the snippet for use as HTML, and replaces
+// the markers around the matching terms with <mark> elements.
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, snippetStart, "<mark>")
+	return strings.ReplaceAll(snippet, snippetEnd, "</mark>")
+}
+
+// ftsQuery converts a user's search query into an FTS query that matches
+// all of its words, so that punctuation and operators in the query can't
+// cause syntax errors. It returns an empty string if there are no words.
+func ftsQuery(query string) string {
+	var terms []string
+	addTerm := func(term string, phrase bool) {
+		prefix := !phrase && strings.HasSuffix(term, "*")
+		term = strings.Map(func(r rune) rune {
+			if r == '"' || r == '*' || unicode.IsControl(r) {
+				return ' '
+			}
+			return r
+		}, term)
+		if term = strings.TrimSpace(term); term == "" {
+			return
+		}
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, `"`+term+`"`)
+	}
+
+	for {
+		before, after, found := strings.Cut(query, `"`)
+		for _, word := range strings.Fields(before) {
+			addTerm(word, false)
+		}
+		if !found {
+			break
+		}
+		phrase, rest, _ := strings.Cut(after, `"`)
+		addTerm(phrase, true)
+		query = rest
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// bm25 computes the Okapi BM25 relevance of a row from its FTS4 matchinfo
+// with the 'pcnalx' format, weighting each column by the given weights.
+func bm25(matchinfo []byte, weights []float64) float64 {
+	const k1, b = 1.2, 0.75
+
+	// matchinfo is an array of 32-bit unsigned integers in native byte order
+	info := make([]float64, len(matchinfo)/4)
+	for i := range info {
+		info[i] = float64(binary.NativeEndian.Uint32(matchinfo[i*4:]))
+	}
+	if len(info) < 3 {
+		return 0
+	}
+	phrases, cols, rows := int(info[0]), int(info[1]), info[2]
+	if len(info) < 3+2*cols+3*phrases*cols {
+		return 0
+	}
+	avgLen, rowLen, hits := info[3:3+cols], info[3+cols:3+2*cols], info[3+2*cols:]
+
+	var score float64
+	for i := range phrases {
+		for j := range cols {
+			hit := hits[3*(i*cols+j):]
+			freq, rowsWithHits := hit[0], hit[2]
+			if freq == 0 {
+				continue
+			}
+			// terms that appear in most rows would have a negative IDF; they still count a little
+			idf := max(math.Log((rows-rowsWithHits+0.5)/(rowsWithHits+0.5)), 1e-6)
+			weight := 1.0
+			if j < len(weights) {
+				weight = weights[j]
+			}
+			norm := 1 - b + b*rowLen[j]/max(avgLen[j], 1)
+			score += weight * idf * freq * (k1 + 1) / (freq + k1*norm)
+		}
+	}
+	return score
+}
+
+// sqlPlaceholders returns a parenthesized list of n query placeholders.
+func sqlPlaceholders(n int) string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?,", n), ",") + ")"
+}
+
+// weights of the columns of the search index, in order: data_text,
+// filename, entity_name, and metadata (matches in names are more
+// telling than matches in the depths of metadata)
+var ftsColumnWeights = []float64{1, 2, 1.5, 0.5}
+
+// markers around the matching terms in snippets, which are replaced with
+// HTML after the rest of the snippet is escaped; and the other snippet options
+const (
+	snippetStart    = "\x02"
+	snippetEnd      = "\x03"
+	snippetEllipsis = "…"
+	snippetTokens   = 16
+)
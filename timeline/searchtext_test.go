@@ -0,0 +1,205 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFTSQuery(t *testing.T) {
+	for i, tc := range []struct {
+		input, expect string
+	}{
+		{input: "", expect: ""},
+		{input: "  ", expect: ""},
+		{input: "hello", expect: `"hello"`},
+		{input: "hello world", expect: `"hello" "world"`},
+		{input: "hel*", expect: `"hel*"`},
+		{input: `"hello world" again`, expect: `"hello world" "again"`},
+		{input: `say "hi*`, expect: `"say" "hi"`},
+		{input: `AND OR NOT (x) -y`, expect: `"AND" "OR" "NOT" "(x)" "-y"`},
+		{input: `* "" **`, expect: ``},
+	} {
+		if actual := ftsQuery(tc.input); actual != tc.expect {
+			t.Errorf("Test %d (%q): expected %s, got %s", i, tc.input, tc.expect, actual)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	ctx := context.Background()
+	db, err := openAndProvisionDB(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tl := &Timeline{db: db}
+
+	mustExec := func(q string, args ...any) {
+		t.Helper()
+		if _, err := db.ExecContext(ctx, q, args...); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	mustExec(`INSERT INTO entities (id, type_id, name) VALUES (1, (SELECT id FROM entity_types LIMIT 1), 'Ada Lovelace')`)
+	mustExec(`INSERT INTO attributes (id, name, value) VALUES (1, 'email_address', 'ada@example.com')`)
+	mustExec(`INSERT INTO entity_attributes (entity_id, attribute_id) VALUES (1, 1)`)
+	mustExec(`INSERT INTO items (id, attribute_id, timestamp, data_text, filename) VALUES
+		(1, 1, 1000, 'the analytical engine weaves algebraic patterns', NULL),
+		(2, NULL, 2000, 'a note about engines', 'engine.txt'),
+		(3, NULL, 3000, 'nothing to see <here>', NULL)`)
+
+	search := func(query string, params TextSearchParams) []uint64 {
+		t.Helper()
+		matches, err := tl.rankTextMatches(ctx, ftsQuery(query), params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []uint64
+		for _, m := range matches {
+			ids = append(ids, m.itemID)
+		}
+		return ids
+	}
+	expect := func(query string, params TextSearchParams, expected ...uint64) {
+		t.Helper()
+		actual := search(query, params)
+		if len(actual) != len(expected) {
+			t.Errorf("%q: expected items %v, got %v", query, expected, actual)
+			return
+		}
+		for i := range actual {
+			if actual[i] != expected[i] {
+				t.Errorf("%q: expected items %v, got %v", query, expected, actual)
+				return
+			}
+		}
+	}
+
+	expect("engine", TextSearchParams{}, 2, 1) // the filename counts more
+	expect("engin*", TextSearchParams{}, 2, 1)
+	expect("analytical engine", TextSearchParams{}, 1)
+	expect(`"engine weaves"`, TextSearchParams{}, 1)
+	expect(`"weaves engine"`, TextSearchParams{})
+	expect("lovelace", TextSearchParams{}, 1)
+	expect("engine", TextSearchParams{EntityID: []uint64{1}}, 1)
+	end := time.UnixMilli(1500)
+	expect("engin*", TextSearchParams{EndTimestamp: &end}, 1)
+
+	// the index follows changes to items and entities
+	mustExec(`UPDATE items SET data_text='the difference engine' WHERE id=3`)
+	mustExec(`UPDATE items SET data_text=NULL, deleted=1 WHERE id=2`)
+	expect("engine", TextSearchParams{}, 3, 1)
+	mustExec(`DELETE FROM items WHERE id=3`)
+	expect("engine", TextSearchParams{}, 1)
+	mustExec(`UPDATE entities SET name='Augusta King' WHERE id=1`)
+	expect("lovelace", TextSearchParams{})
+	expect("augusta", TextSearchParams{}, 1)
+
+	// timelines that predate the index get it built when opened
+	mustExec(`DELETE FROM items_fts`)
+	mustExec(`DELETE FROM repo WHERE key=?`, "search_index")
+	if err := buildItemIndexes(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	expect("augusta engine", TextSearchParams{}, 1)
+
+	snippets, err := tl.textSnippets(ctx, ftsQuery("algebraic"), []int64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(snippets[1], "<mark>algebraic</mark>") {
+		t.Errorf("expected highlighted snippet, got %q", snippets[1])
+	}
+	if actual := highlightSnippet("<b>" + snippetStart + "x" + snippetEnd); actual != "&lt;b&gt;<mark>x</mark>" {
+		t.Errorf("expected snippet to be escaped, got %q", actual)
+	}
+}
+
+func TestDeferredItemIndexing(t *testing.T) {
+	ctx := context.Background()
+	db, err := openAndProvisionDB(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tl := &Timeline{db: db}
+
+	mustExec := func(q string, args ...any) {
+		t.Helper()
+		if _, err := db.ExecContext(ctx, q, args...); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	indexed := func() (search, location int) {
+		t.Helper()
+		err := db.QueryRowContext(ctx, `SELECT
+			(SELECT count() FROM items_fts),
+			(SELECT count() FROM items_rtree)`).Scan(&search, &location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expect := func(search, location int) {
+		t.Helper()
+		if s, l := indexed(); s != search || l != location {
+			t.Errorf("expected %d items in search index and %d in location index, got %d and %d", search, location, s, l)
+		}
+	}
+
+	mustExec(`INSERT INTO items (id, timestamp, data_text, latitude, longitude) VALUES (1, 1000, 'before', 1, 2)`)
+	expect(1, 1)
+
+	// deferring nests, and items inserted in the meantime aren't indexed until the end
+	for range 2 {
+		if err := tl.deferItemIndexing(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustExec(`INSERT INTO items (id, timestamp, data_text, latitude, longitude) VALUES (2, 2000, 'during', 3, 4)`)
+	mustExec(`UPDATE items SET data_text='before, changed' WHERE id=1`)
+	expect(1, 1)
+	if err := tl.resumeItemIndexing(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect(1, 1)
+	if err := tl.resumeItemIndexing(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect(2, 2)
+	mustExec(`INSERT INTO items (id, timestamp, data_text) VALUES (3, 3000, 'after')`)
+	expect(3, 2)
+
+	// if the app stops while indexing is deferred, the items are indexed when it's opened again
+	if err := tl.deferItemIndexing(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(`INSERT INTO items (id, timestamp, data_text) VALUES (4, 4000, 'crashed')`)
+	expect(3, 2)
+	if err := provisionDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	expect(4, 2)
+	mustExec(`INSERT INTO items (id, timestamp, data_text) VALUES (5, 5000, 'reopened')`)
+	expect(5, 2)
+}
@@ -0,0 +1,557 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ShareScope is the part of a timeline that a share grant gives access
+// to: the items that match all the criteria that are set. An empty scope
+// is the whole timeline.
+type ShareScope struct {
+	// Items whose timestamp is in this date range.
+	Since *time.Time `json:"since,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+
+	// Items from these data sources (by name).
+	DataSources []string `json:"data_sources,omitempty"`
+
+	// Items of these classifications (by name).
+	Classifications []string `json:"classifications,omitempty"`
+}
+
+// ShareGrant gives read-only access to a scope of the timeline to whoever
+// has its token, through the ShareHandler. The token is only known when
+// the grant is created (see CreateShareGrant); only its hash is stored.
+type ShareGrant struct {
+	ID       uint64     `json:"id"`
+	Name     string     `json:"name,omitempty"`
+	Scope    ShareScope `json:"scope"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Revoked  *time.Time `json:"revoked,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// active returns true if the grant gives access at time t.
+func (g ShareGrant) active(t time.Time) bool {
+	return g.Revoked == nil && (g.Expires == nil || t.Before(*g.Expires))
+}
+
+// CreateShareGrant creates a grant of read-only access to the scope of
+// the timeline, and returns it along with its token, which is not stored
+// and cannot be retrieved later. If expires is set, the grant stops
+// working then.
+func (tl *Timeline) CreateShareGrant(ctx context.Context, name string, scope ShareScope, expires *time.Time) (ShareGrant, string, error) {
+	if scope.Since != nil && scope.Until != nil && scope.Until.Before(*scope.Since) {
+		return ShareGrant{}, "", errors.New("scope ends before it starts")
+	}
+	scopeJSON, err := json.Marshal(scope)
+	if err != nil {
+		return ShareGrant{}, "", fmt.Errorf("JSON-encoding scope: %w", err)
+	}
+
+	random := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(random); err != nil {
+		return ShareGrant{}, "", fmt.Errorf("generating token: %w", err)
+	}
+	token := hex.EncodeToString(random)
+
+	var expiresUnix *int64
+	if expires != nil {
+		ts := expires.Unix()
+		expiresUnix = &ts
+	}
+
+	tl.dbMu.Lock()
+	grant, err := scanShareGrant(tl.db.QueryRowContext(ctx, `
+		INSERT INTO share_grants (name, token_hash, scope, expires) VALUES (?, ?, ?, ?)
+		RETURNING id, name, scope, created, expires, revoked, last_used`,
+		nullString(name), shareTokenHash(token), string(scopeJSON), expiresUnix))
+	tl.dbMu.Unlock()
+	if err != nil {
+		return ShareGrant{}, "", fmt.Errorf("inserting share grant: %w", err)
+	}
+
+	Log.Named("share").Info("created share grant",
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("grant_id", grant.ID),
+		zap.Timep("expires", expires))
+
+	return grant, token, nil
+}
+
+// ShareGrants returns all the share grants of the timeline, including
+// those that were revoked or have expired.
+func (tl *Timeline) ShareGrants(ctx context.Context) ([]ShareGrant, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT id, name, scope, created, expires, revoked, last_used FROM share_grants ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("querying share grants: %w", err)
+	}
+	defer rows.Close()
+
+	var grants []ShareGrant
+	for rows.Next() {
+		grant, err := scanShareGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+// RevokeShareGrant revokes the share grant, so its token stops working
+// immediately. The grant is kept for reference.
+func (tl *Timeline) RevokeShareGrant(ctx context.Context, grantID uint64) error {
+	tl.dbMu.Lock()
+	res, err := tl.db.ExecContext(ctx, `UPDATE share_grants SET revoked=? WHERE id=? AND revoked IS NULL`, time.Now().Unix(), grantID)
+	tl.dbMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("revoking share grant: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no active share grant with ID %d", grantID)
+	}
+
+	Log.Named("share").Info("revoked share grant",
+		zap.String("repo_id", tl.ID().String()),
+		zap.Uint64("grant_id", grantID))
+
+	return nil
+}
+
+func scanShareGrant(row sqlScanner) (ShareGrant, error) {
+	var grant ShareGrant
+	var name *string
+	var scope string
+	var created int64
+	var expires, revoked, lastUsed *int64
+	if err := row.Scan(&grant.ID, &name, &scope, &created, &expires, &revoked, &lastUsed); err != nil {
+		return grant, err
+	}
+	if err := json.Unmarshal([]byte(scope), &grant.Scope); err != nil {
+		return grant, fmt.Errorf("decoding scope of share grant %d: %w", grant.ID, err)
+	}
+	grant.Name = deref(name)
+	grant.Created = time.Unix(created, 0)
+	grant.Expires = unixTimePtr(expires)
+	grant.Revoked = unixTimePtr(revoked)
+	grant.LastUsed = unixTimePtr(lastUsed)
+	return grant, nil
+}
+
+func unixTimePtr(sec *int64) *time.Time {
+	if sec == nil {
+		return nil
+	}
+	t := time.Unix(*sec, 0)
+	return &t
+}
+
+func shareTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// restrictItemSearch narrows the search to the scope. It returns false if
+// nothing in the scope can match the search.
+func (s ShareScope) restrictItemSearch(params *ItemSearchParams) bool {
+	var ok bool
+	if params.DataSourceName, ok = intersectScope(params.DataSourceName, s.DataSources); !ok {
+		return false
+	}
+	if params.Classification, ok = intersectScope(params.Classification, s.Classifications); !ok {
+		return false
+	}
+	if s.Since != nil && (params.StartTimestamp == nil || params.StartTimestamp.Before(*s.Since)) {
+		params.StartTimestamp = s.Since
+		params.StrictStartTimestamp = true
+	}
+	if s.Until != nil && (params.EndTimestamp == nil || params.EndTimestamp.After(*s.Until)) {
+		params.EndTimestamp = s.Until
+		params.StrictEndTimestamp = true
+	}
+
+	// the criteria of the scope must all apply, and related items (which
+	// may be out of scope) are not included
+	params.OrFields = false
+	params.Related = 0
+	params.Deleted = false
+
+	return true
+}
+
+// restrictTextSearch narrows the search to the scope. It returns false if
+// nothing in the scope can match the search.
+func (s ShareScope) restrictTextSearch(params *TextSearchParams) bool {
+	var ok bool
+	if params.DataSourceName, ok = intersectScope(params.DataSourceName, s.DataSources); !ok {
+		return false
+	}
+	if params.Classification, ok = intersectScope(params.Classification, s.Classifications); !ok {
+		return false
+	}
+	if s.Since != nil && (params.StartTimestamp == nil || params.StartTimestamp.Before(*s.Since)) {
+		params.StartTimestamp = s.Since
+	}
+	if s.Until != nil && (params.EndTimestamp == nil || params.EndTimestamp.After(*s.Until)) {
+		params.EndTimestamp = s.Until
+	}
+	return true
+}
+
+// intersectScope returns the values that were requested and are allowed,
+// or all the allowed values if none were requested. If either list is
+// empty, there is no restriction. It returns false if none of the
+// requested values are allowed.
+func intersectScope(requested, allowed []string) ([]string, bool) {
+	if len(allowed) == 0 {
+		return requested, true
+	}
+	if len(requested) == 0 {
+		return allowed, true
+	}
+	var both []string
+	for _, val := range requested {
+		if slices.Contains(allowed, val) {
+			both = append(both, val)
+		}
+	}
+	return both, len(both) > 0
+}
+
+// where returns the WHERE clause, and its arguments, that selects the
+// items (joined with data_sources and classifications) in the scope.
+func (s ShareScope) where() (string, []any) {
+	clauses := []string{"items.deleted IS NULL"}
+	var args []any
+	if s.Since != nil {
+		clauses = append(clauses, "items.timestamp >= ?")
+		args = append(args, s.Since.UnixMilli())
+	}
+	if s.Until != nil {
+		clauses = append(clauses, "items.timestamp <= ?")
+		args = append(args, s.Until.UnixMilli())
+	}
+	if len(s.DataSources) > 0 {
+		clauses = append(clauses, "data_sources.name IN "+sqlPlaceholders(len(s.DataSources)))
+		for _, ds := range s.DataSources {
+			args = append(args, ds)
+		}
+	}
+	if len(s.Classifications) > 0 {
+		clauses = append(clauses, "classifications.name IN "+sqlPlaceholders(len(s.Classifications)))
+		for _, class := range s.Classifications {
+			args = append(args, class)
+		}
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// inScope returns the IDs of the given items that are in the scope.
+func (tl *Timeline) inScope(ctx context.Context, scope ShareScope, itemIDs []uint64) (map[uint64]bool, error) {
+	allowed := make(map[uint64]bool, len(itemIDs))
+	if len(itemIDs) == 0 {
+		return allowed, nil
+	}
+	where, args := scope.where()
+	in, idArgs := sqlArray(itemIDs)
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	ids, err := selectIDs(ctx, tl.db, `
+		SELECT items.id
+		FROM items
+		LEFT JOIN data_sources ON data_sources.id = items.data_source_id
+		LEFT JOIN classifications ON classifications.id = items.classification_id
+		WHERE items.id IN `+in+` AND `+where, append(idArgs, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("checking scope of items: %w", err)
+	}
+	for _, id := range ids {
+		allowed[uint64(id)] = true
+	}
+	return allowed, nil
+}
+
+// scopedDataFile returns the data type of an item in the scope that has
+// the data file (or, if the data file is empty, of the item with the ID);
+// it returns false if there is none.
+func (tl *Timeline) scopedDataFile(ctx context.Context, scope ShareScope, dataFile string, itemID int64) (string, bool, error) {
+	where, args := scope.where()
+	match := "items.data_file=?"
+	var key any = dataFile
+	if dataFile == "" {
+		match, key = "items.id=?", itemID
+	}
+
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	var dataType *string
+	err := tl.db.QueryRowContext(ctx, `
+		SELECT items.data_type
+		FROM items
+		LEFT JOIN data_sources ON data_sources.id = items.data_source_id
+		LEFT JOIN classifications ON classifications.id = items.classification_id
+		WHERE `+match+` AND `+where+`
+		LIMIT 1`, append([]any{key}, args...)...).Scan(&dataType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return deref(dataType), true, nil
+}
+
+// filterScope removes the results that are out of scope. The search was
+// already restricted to the scope, so this is only a safeguard.
+func (tl *Timeline) filterScope(ctx context.Context, scope ShareScope, results *SearchResults) error {
+	ids := make([]uint64, len(results.Items))
+	for i, sr := range results.Items {
+		ids[i] = sr.ID
+	}
+	allowed, err := tl.inScope(ctx, scope, ids)
+	if err != nil {
+		return err
+	}
+	results.Items = slices.DeleteFunc(results.Items, func(sr *SearchResult) bool {
+		if !allowed[sr.ID] {
+			return true
+		}
+		sr.Related = nil
+		return false
+	})
+	return nil
+}
+
+// ShareHandler returns the handler that share grants give access to the
+// timeline through. Requests must present the token of an active grant,
+// either as a bearer token or in the "token" query parameter (so that
+// media can be linked to directly); everything they can read is limited
+// to the scope of the grant. Paths are relative to where it is mounted,
+// so the handler should be mounted with http.StripPrefix:
+//
+//	GET  /grant        the grant (including its scope)
+//	POST /search       ItemSearchParams, returns SearchResults
+//	POST /search-text  TextSearchParams, returns SearchResults
+//	GET  /data/...     a data file
+//	GET  /thumbnail    the thumbnail of a data file (data_file or data_id,
+//	                   data_type, and type=video for a video thumbnail)
+func (tl *Timeline) ShareHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /grant", tl.serveShareGrant)
+	mux.HandleFunc("POST /search", tl.serveShareSearch)
+	mux.HandleFunc("POST /search-text", tl.serveShareSearchText)
+	mux.HandleFunc("GET /"+DataFolderName+"/", tl.serveShareDataFile)
+	mux.HandleFunc("GET /thumbnail", tl.serveShareThumbnail)
+	return tl.authorizeShare(mux)
+}
+
+func (tl *Timeline) authorizeShare(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get("token")
+		}
+		if token == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// the token is looked up by its hash, so comparing it in constant
+		// time wouldn't hide anything
+		tl.dbMu.RLock()
+		grant, err := scanShareGrant(tl.db.QueryRowContext(r.Context(),
+			`SELECT id, name, scope, created, expires, revoked, last_used FROM share_grants WHERE token_hash=?`,
+			shareTokenHash(token)))
+		tl.dbMu.RUnlock()
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			shareLogger(r).Error("loading share grant", zap.Error(err))
+		}
+		now := time.Now()
+		if err != nil || !grant.active(now) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// recording every use would mean a write for every thumbnail
+		if grant.LastUsed == nil || now.Sub(*grant.LastUsed) > time.Minute {
+			tl.dbMu.Lock()
+			_, err := tl.db.ExecContext(r.Context(), `UPDATE share_grants SET last_used=? WHERE id=?`, now.Unix(), grant.ID)
+			tl.dbMu.Unlock()
+			if err != nil {
+				shareLogger(r).Error("recording use of share grant", zap.Uint64("grant_id", grant.ID), zap.Error(err))
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), shareGrantCtxKey{}, grant)))
+	})
+}
+
+type shareGrantCtxKey struct{}
+
+func shareGrantOf(r *http.Request) ShareGrant {
+	grant, _ := r.Context().Value(shareGrantCtxKey{}).(ShareGrant)
+	return grant
+}
+
+func (tl *Timeline) serveShareGrant(w http.ResponseWriter, r *http.Request) {
+	writeSyncJSON(w, shareGrantOf(r))
+}
+
+func (tl *Timeline) serveShareSearch(w http.ResponseWriter, r *http.Request) {
+	var params ItemSearchParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scope := shareGrantOf(r).Scope
+	if !scope.restrictItemSearch(&params) {
+		writeSyncJSON(w, SearchResults{Items: []*SearchResult{}})
+		return
+	}
+	params.Repo = tl.ID().String()
+
+	results, err := tl.Search(r.Context(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tl.filterScope(r.Context(), scope, &results); err != nil {
+		shareError(w, r, "filtering search results", err)
+		return
+	}
+	writeSyncJSON(w, results)
+}
+
+func (tl *Timeline) serveShareSearchText(w http.ResponseWriter, r *http.Request) {
+	var params TextSearchParams
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scope := shareGrantOf(r).Scope
+	if !scope.restrictTextSearch(&params) {
+		writeSyncJSON(w, SearchResults{Items: []*SearchResult{}})
+		return
+	}
+	params.Repo = tl.ID().String()
+
+	results, err := tl.SearchText(r.Context(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tl.filterScope(r.Context(), scope, &results); err != nil {
+		shareError(w, r, "filtering search results", err)
+		return
+	}
+	writeSyncJSON(w, results)
+}
+
+func (tl *Timeline) serveShareDataFile(w http.ResponseWriter, r *http.Request) {
+	dataFile := strings.TrimPrefix(r.URL.Path, "/")
+	dataType, ok, err := tl.scopedDataFile(r.Context(), shareGrantOf(r).Scope, dataFile, 0)
+	if err != nil {
+		shareError(w, r, "looking up data file", err)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if dataType != "" {
+		w.Header().Set("Content-Type", dataType)
+	}
+	http.ServeFileFS(w, r, tl.RepoFS(), dataFile)
+}
+
+func (tl *Timeline) serveShareThumbnail(w http.ResponseWriter, r *http.Request) {
+	dataFile := r.FormValue("data_file")
+	var itemDataID int64
+	if idStr := r.FormValue("data_id"); idStr != "" {
+		var err error
+		if itemDataID, err = strconv.ParseInt(idStr, 10, 64); err != nil || itemDataID < 0 {
+			http.Error(w, "invalid item data ID: "+idStr, http.StatusBadRequest)
+			return
+		}
+	}
+	if dataFile == "" && itemDataID == 0 {
+		http.Error(w, "data_file or data_id is required", http.StatusBadRequest)
+		return
+	}
+	dataType, ok, err := tl.scopedDataFile(r.Context(), shareGrantOf(r).Scope, dataFile, itemDataID)
+	if err != nil {
+		shareError(w, r, "looking up item", err)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	thumbType := ImageAVIF
+	if r.FormValue("type") == "video" {
+		thumbType = VideoWebM
+	}
+	thumb, err := tl.Thumbnail(r.Context(), itemDataID, dataFile, dataType, thumbType)
+	if err != nil {
+		shareError(w, r, "providing thumbnail", err)
+		return
+	}
+	if thumb.MediaType != "" {
+		w.Header().Set("Content-Type", thumb.MediaType)
+	}
+	http.ServeContent(w, r, thumb.Name, thumb.ModTime, bytes.NewReader(thumb.Content))
+}
+
+func shareLogger(r *http.Request) *zap.Logger {
+	return Log.Named("share").With(zap.String("remote_addr", r.RemoteAddr))
+}
+
+func shareError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	shareLogger(r).Error(msg, zap.Error(err))
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// shareTokenBytes is how many random bytes a share token has.
+const shareTokenBytes = 32
@@ -0,0 +1,167 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareHandler(t *testing.T) {
+	ctx := context.Background()
+	tl := newTestTimeline(t)
+
+	// a message and a photo from the trip, a message from before it,
+	// and a photo from another data source during it
+	tripStart := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	tripEnd := tripStart.AddDate(0, 0, 14)
+	during, before := tripStart.AddDate(0, 0, 3).UnixMilli(), tripStart.AddDate(0, -1, 0).UnixMilli()
+	for _, name := range []string{"trip.jpg", "other.jpg"} {
+		if err := os.WriteFile(tl.FullPath("data/"+name), []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustExec(t, tl, `
+		INSERT INTO data_sources (name, title) VALUES ('photos', 'Photos');
+		INSERT INTO items (id, data_source_id, original_id, timestamp, data_type, data_text) VALUES
+			(1, (SELECT id FROM data_sources WHERE name='sms'), 'msg1', ?, 'text/plain', 'Landed in Lisbon'),
+			(2, (SELECT id FROM data_sources WHERE name='sms'), 'msg2', ?, 'text/plain', 'Booked Lisbon flights');
+		INSERT INTO items (id, data_source_id, original_id, timestamp, data_type, data_file) VALUES
+			(3, (SELECT id FROM data_sources WHERE name='sms'), 'mms3', ?, 'image/jpeg', 'data/trip.jpg'),
+			(4, (SELECT id FROM data_sources WHERE name='photos'), 'photo4', ?, 'image/jpeg', 'data/other.jpg');`,
+		during, before, during, during)
+
+	grant, token, err := tl.CreateShareGrant(ctx, "family", ShareScope{
+		Since:       &tripStart,
+		Until:       &tripEnd,
+		DataSources: []string{"sms"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(tl.ShareHandler())
+	defer server.Close()
+
+	request := func(method, path, token string, body any) *http.Response {
+		t.Helper()
+		var reqBody io.Reader
+		if body != nil {
+			b, _ := json.Marshal(body)
+			reqBody = strings.NewReader(string(b))
+		}
+		req, err := http.NewRequestWithContext(ctx, method, server.URL+path, reqBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	search := func(path string, params any) []uint64 {
+		t.Helper()
+		resp := request(http.MethodPost, path, token, params)
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("%s: expected status 200, got %d: %s", path, resp.StatusCode, body)
+		}
+		var results SearchResults
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			t.Fatal(err)
+		}
+		var ids []uint64
+		for _, sr := range results.Items {
+			ids = append(ids, sr.ID)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+
+	if resp := request(http.MethodPost, "/search", "", ItemSearchParams{}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected request without token to be unauthorized, got %d", resp.StatusCode)
+	}
+	if resp := request(http.MethodPost, "/search", "wrong", ItemSearchParams{}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected request with wrong token to be unauthorized, got %d", resp.StatusCode)
+	}
+
+	// only items in the scope are found, however broad the search
+	if ids := search("/search", ItemSearchParams{Astructured: true}); !slices.Equal(ids, []uint64{1, 3}) {
+		t.Errorf("expected items in scope, got %v", ids)
+	}
+	if ids := search("/search", ItemSearchParams{DataSourceName: []string{"photos"}, OrFields: true}); len(ids) != 0 {
+		t.Errorf("expected no items from data source out of scope, got %v", ids)
+	}
+	if ids := search("/search", ItemSearchParams{RowID: []int64{2, 4}}); len(ids) != 0 {
+		t.Errorf("expected no items out of scope by ID, got %v", ids)
+	}
+	if ids := search("/search-text", TextSearchParams{Query: "lisbon"}); !slices.Equal(ids, []uint64{1}) {
+		t.Errorf("expected text search to find item in scope, got %v", ids)
+	}
+
+	// media is served only if its item is in the scope, and the token may be in the query
+	if resp := request(http.MethodGet, "/data/trip.jpg?token="+token, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected data file in scope to be served, got %d", resp.StatusCode)
+	} else if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("expected data type of item, got %q", ct)
+	}
+	if resp := request(http.MethodGet, "/data/other.jpg", token, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected data file out of scope not to be found, got %d", resp.StatusCode)
+	}
+	if resp := request(http.MethodGet, "/thumbnail?data_file=data/other.jpg", token, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected thumbnail out of scope not to be found, got %d", resp.StatusCode)
+	}
+
+	grants, err := tl.ShareGrants(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 1 || grants[0].ID != grant.ID || grants[0].LastUsed == nil || grants[0].Scope.DataSources[0] != "sms" {
+		t.Errorf("expected the grant, used, got %+v", grants)
+	}
+
+	// revoked and expired grants don't work
+	if err := tl.RevokeShareGrant(ctx, grant.ID); err != nil {
+		t.Fatal(err)
+	}
+	if resp := request(http.MethodGet, "/grant", token, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected revoked grant to be unauthorized, got %d", resp.StatusCode)
+	}
+	expired := time.Now().Add(-time.Minute)
+	_, expiredToken, err := tl.CreateShareGrant(ctx, "", ShareScope{}, &expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := request(http.MethodGet, "/grant", expiredToken, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected expired grant to be unauthorized, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,1512 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SyncConflictPolicy decides what happens to an item that was changed
+// on both timelines since they last synced.
+type SyncConflictPolicy string
+
+const (
+	SyncNewestWins SyncConflictPolicy = "newest"    // the most recently changed version is kept (default)
+	SyncKeepBoth   SyncConflictPolicy = "keep_both" // the most recently changed version is kept, and the other is kept as a copy
+)
+
+// SyncRemote describes a remote timeline to sync with.
+type SyncRemote struct {
+	// The URL of the remote's sync handler, like
+	// "https://example.com:12003/sync/<repo_id>".
+	URL string `json:"url"`
+
+	// The token to authenticate with the remote (see SetSyncToken).
+	// It is remembered, so it can be omitted after the first sync.
+	Token string `json:"token,omitempty"`
+
+	ConflictPolicy SyncConflictPolicy `json:"conflict_policy,omitempty"`
+}
+
+// SyncPeer is a remote timeline that this timeline has synced with.
+type SyncPeer struct {
+	ID             uint64             `json:"id"`
+	URL            string             `json:"url"`
+	ConflictPolicy SyncConflictPolicy `json:"conflict_policy"`
+	RepoID         string             `json:"repo_id,omitempty"` // known after the first sync
+	LastSynced     *time.Time         `json:"last_synced,omitempty"`
+
+	token string
+}
+
+// Sync starts a job that syncs the timeline with the remote timeline, and
+// returns its ID. Syncing goes both ways: the items that were added, changed,
+// or deleted on either timeline since they last synced are sent to the other,
+// along with their data files, relationships, and the entities they involve.
+// Each item has a version vector that tracks which timeline changed it, so an
+// item that was changed on both sides is detected as a conflict, which is
+// resolved by the conflict policy. The remote must serve SyncHandler. It is
+// remembered, so later syncs can leave out the token.
+func (tl *Timeline) Sync(ctx context.Context, remote SyncRemote) (uint64, error) {
+	u, err := url.Parse(remote.URL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sync URL: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return 0, fmt.Errorf("sync URL must be HTTP or HTTPS: %s", remote.URL)
+	}
+	switch remote.ConflictPolicy {
+	case "":
+		remote.ConflictPolicy = SyncNewestWins
+	case SyncNewestWins, SyncKeepBoth:
+	default:
+		return 0, fmt.Errorf("unknown conflict policy: %s", remote.ConflictPolicy)
+	}
+
+	var peerID uint64
+	var token *string
+	tl.dbMu.Lock()
+	err = tl.db.QueryRowContext(ctx, `INSERT INTO sync_peers (url, token, conflict_policy) VALUES (?, nullif(?, ''), ?)
+		ON CONFLICT (url) DO UPDATE SET token=coalesce(excluded.token, token), conflict_policy=excluded.conflict_policy
+		RETURNING id, token`, strings.TrimSuffix(remote.URL, "/"), remote.Token, remote.ConflictPolicy).Scan(&peerID, &token)
+	tl.dbMu.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("storing sync peer: %w", err)
+	}
+	if token == nil {
+		return 0, errors.New("a token is required to sync with a new remote")
+	}
+
+	return tl.CreateJob(syncJob{PeerID: peerID}, time.Time{}, 0, 0, 0)
+}
+
+// SyncPeers returns the remote timelines this timeline syncs with.
+func (tl *Timeline) SyncPeers(ctx context.Context) ([]SyncPeer, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT id, url, token, conflict_policy, repo_id, last_synced FROM sync_peers ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var peers []SyncPeer
+	for rows.Next() {
+		peer, err := scanSyncPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		peer.token = ""
+		peers = append(peers, peer)
+	}
+	return peers, rows.Err()
+}
+
+func (tl *Timeline) loadSyncPeer(ctx context.Context, peerID uint64) (SyncPeer, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+	return scanSyncPeer(tl.db.QueryRowContext(ctx,
+		`SELECT id, url, token, conflict_policy, repo_id, last_synced FROM sync_peers WHERE id=?`, peerID))
+}
+
+func scanSyncPeer(row sqlScanner) (SyncPeer, error) {
+	var peer SyncPeer
+	var token, repoID *string
+	var lastSynced *int64
+	if err := row.Scan(&peer.ID, &peer.URL, &token, &peer.ConflictPolicy, &repoID, &lastSynced); err != nil {
+		return peer, err
+	}
+	peer.token, peer.RepoID = deref(token), deref(repoID)
+	if lastSynced != nil {
+		ts := time.Unix(*lastSynced, 0)
+		peer.LastSynced = &ts
+	}
+	return peer, nil
+}
+
+// SetSyncToken sets the token that remote timelines must present to sync
+// with this timeline through its SyncHandler. Only a hash of the token is
+// stored. An empty token disables syncing with this timeline.
+func (tl *Timeline) SetSyncToken(ctx context.Context, token string) error {
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	if token == "" {
+		_, err := tl.db.ExecContext(ctx, `DELETE FROM repo WHERE key=?`, syncTokenHashKey)
+		return err
+	}
+	sum := sha256.Sum256([]byte(token))
+	_, err := tl.db.ExecContext(ctx, `INSERT INTO repo (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value=excluded.value`, syncTokenHashKey, hex.EncodeToString(sum[:]))
+	return err
+}
+
+// VersionVector maps the ID of each timeline (replica) that changed an
+// item to the sequence number of its latest change to the item. Every
+// timeline numbers its own changes, so comparing the vectors of two
+// versions of an item tells whether one is derived from the other, or
+// whether they were changed independently (a conflict).
+type VersionVector map[string]uint64
+
+// vectorOrder is how two version vectors compare.
+type vectorOrder int
+
+const (
+	vectorEqual      vectorOrder = iota
+	vectorBefore                 // the other vector has seen all changes of this one, and more
+	vectorAfter                  // this vector has seen all changes of the other one, and more
+	vectorConcurrent             // each vector has changes the other hasn't seen
+)
+
+func (v VersionVector) compare(other VersionVector) vectorOrder {
+	var before, after bool
+	for replica, seq := range v {
+		if seq > other[replica] {
+			after = true
+		} else if seq < other[replica] {
+			before = true
+		}
+	}
+	for replica, seq := range other {
+		if _, ok := v[replica]; !ok && seq > 0 {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return vectorConcurrent
+	case before:
+		return vectorBefore
+	case after:
+		return vectorAfter
+	default:
+		return vectorEqual
+	}
+}
+
+// merge returns a vector with the latest changes of both vectors.
+func (v VersionVector) merge(other VersionVector) VersionVector {
+	merged := maps.Clone(v)
+	if merged == nil {
+		merged = make(VersionVector, len(other))
+	}
+	for replica, seq := range other {
+		merged[replica] = max(merged[replica], seq)
+	}
+	return merged
+}
+
+// newerThan returns true if the vector has a change that is not in knowledge,
+// which is the vector of the latest changes a timeline has all of.
+func (v VersionVector) newerThan(knowledge VersionVector) bool {
+	for replica, seq := range v {
+		if seq > knowledge[replica] {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncItem is a version of an item that is exchanged when syncing.
+type SyncItem struct {
+	UID     string        `json:"uid"`
+	Vector  VersionVector `json:"vector"`
+	Changed time.Time     `json:"changed"`
+	Hash    []byte        `json:"hash"` // of the content (see contentHash)
+	Deleted bool          `json:"deleted,omitempty"`
+
+	// The content of the item, if not deleted. Items are referred to by
+	// their UIDs, and its data file is the path on the sending timeline.
+	Item          *ArchiveItem          `json:"item,omitempty"`
+	DataHash      []byte                `json:"data_hash,omitempty"`
+	Relationships []ArchiveRelationship `json:"relationships,omitempty"`
+
+	// The entities that have the attributes of the item and its relationships.
+	Entities []ArchiveEntity `json:"entities,omitempty"`
+}
+
+// contentHash returns the hash of the synced content of the item, which
+// is the same on both timelines if the item is the same. It doesn't
+// depend on where the data file is stored, or on which data source the
+// item came from, since that may not be known on the other timeline.
+func (si SyncItem) contentHash() ([]byte, error) {
+	if si.Deleted || si.Item == nil {
+		return syncTombstoneHash, nil
+	}
+
+	item := *si.Item
+	item.UID, item.DataSource, item.OriginalID, item.DataFile = "", "", "", ""
+	item.Timestamp, item.Timespan, item.Timeframe = utcTime(item.Timestamp), utcTime(item.Timespan), utcTime(item.Timeframe)
+
+	// relationships are in no particular order
+	rels := make([]string, 0, len(si.Relationships))
+	for _, rel := range si.Relationships {
+		rel.Start, rel.End = utcTime(rel.Start), utcTime(rel.End)
+		relJSON, err := json.Marshal(rel)
+		if err != nil {
+			return nil, err
+		}
+		rels = append(rels, string(relJSON))
+	}
+	slices.Sort(rels)
+
+	content, err := json.Marshal(struct {
+		Item          ArchiveItem `json:"item"`
+		DataHash      []byte      `json:"data_hash"`
+		Relationships []string    `json:"relationships"`
+	}{item, si.DataHash, rels})
+	if err != nil {
+		return nil, err
+	}
+	h := newHash()
+	_, _ = h.Write(content)
+	return h.Sum(nil), nil
+}
+
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+// syncRecord is the row of an item in the sync_items table.
+type syncRecord struct {
+	id      uint64 // 0 if not stored yet
+	itemID  uint64 // 0 if the item was erased (a tombstone)
+	uid     string
+	vector  VersionVector
+	hash    []byte
+	changed time.Time
+}
+
+func loadSyncRecord(ctx context.Context, q rowQueryer, uid string) (syncRecord, error) {
+	rec := syncRecord{uid: uid}
+	var itemID *uint64
+	var vector string
+	var changed int64
+	err := q.QueryRowContext(ctx, `SELECT id, item_id, vector, hash, changed FROM sync_items WHERE uid=?`, uid).
+		Scan(&rec.id, &itemID, &vector, &rec.hash, &changed)
+	if err != nil {
+		return rec, err
+	}
+	rec.itemID, rec.changed = deref(itemID), time.UnixMilli(changed)
+	if err := json.Unmarshal([]byte(vector), &rec.vector); err != nil {
+		return rec, fmt.Errorf("decoding version vector of %s: %w", uid, err)
+	}
+	return rec, nil
+}
+
+func storeSyncRecord(ctx context.Context, tx *sql.Tx, rec *syncRecord) error {
+	vector, err := json.Marshal(rec.vector)
+	if err != nil {
+		return err
+	}
+	var itemID *uint64
+	if rec.itemID != 0 {
+		itemID = &rec.itemID
+	}
+	if rec.id == 0 {
+		return tx.QueryRowContext(ctx, `INSERT INTO sync_items (item_id, uid, vector, hash, changed) VALUES (?, ?, ?, ?, ?) RETURNING id`,
+			itemID, rec.uid, string(vector), rec.hash, rec.changed.UnixMilli()).Scan(&rec.id)
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE sync_items SET item_id=?, uid=?, vector=?, hash=?, changed=? WHERE id=?`,
+		itemID, rec.uid, string(vector), rec.hash, rec.changed.UnixMilli(), rec.id)
+	return err
+}
+
+// bumpSyncRecord records a change to the item by this timeline.
+func (tl *Timeline) bumpSyncRecord(ctx context.Context, tx *sql.Tx, rec *syncRecord) error {
+	seq, err := nextSyncSeq(ctx, tx)
+	if err != nil {
+		return err
+	}
+	rec.vector = maps.Clone(rec.vector)
+	if rec.vector == nil {
+		rec.vector = make(VersionVector)
+	}
+	rec.vector[tl.id.String()] = seq
+	rec.changed = time.Now()
+	return nil
+}
+
+// nextSyncSeq returns the sequence number of the next change by this timeline.
+func nextSyncSeq(ctx context.Context, tx *sql.Tx) (uint64, error) {
+	var seq uint64
+	err := tx.QueryRowContext(ctx, `INSERT INTO repo (key, value) VALUES (?, 1)
+		ON CONFLICT (key) DO UPDATE SET value=value+1
+		RETURNING value`, syncSeqKey).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("incrementing sync sequence: %w", err)
+	}
+	return seq, nil
+}
+
+// syncKnowledge returns the version vector of the latest changes that
+// this timeline has all of, including all of its own.
+func (tl *Timeline) syncKnowledge(ctx context.Context, q rowQueryer) (VersionVector, error) {
+	knowledge := make(VersionVector)
+	var value string
+	err := q.QueryRowContext(ctx, `SELECT value FROM repo WHERE key=?`, syncKnowledgeKey).Scan(&value)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &knowledge); err != nil {
+			return nil, fmt.Errorf("decoding sync knowledge: %w", err)
+		}
+	}
+	var seq uint64
+	err = q.QueryRowContext(ctx, `SELECT value FROM repo WHERE key=?`, syncSeqKey).Scan(&seq)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	knowledge[tl.id.String()] = seq
+	return knowledge, nil
+}
+
+// learnSyncKnowledge adds knowledge, which must have been received from a
+// remote timeline whose changes have all been applied, to this timeline's.
+func (tl *Timeline) learnSyncKnowledge(ctx context.Context, knowledge VersionVector) error {
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := tl.syncKnowledge(ctx, tx)
+	if err != nil {
+		return err
+	}
+	merged := current.merge(knowledge)
+	delete(merged, tl.id.String()) // our own changes are counted by the sequence
+	value, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO repo (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value=excluded.value`, syncKnowledgeKey, string(value))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanSyncChanges records a change by this timeline for each item whose
+// content changed since it was last scanned, including new items and items
+// that were deleted, and returns how many there were.
+func (tl *Timeline) scanSyncChanges(ctx context.Context) (int, error) {
+	var total int
+	var lastID uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		var changes []syncRecord
+		var err error
+		lastID, changes, err = tl.scanSyncPage(ctx, lastID)
+		if err != nil {
+			return total, err
+		}
+		if lastID == 0 {
+			break
+		}
+		if err := tl.recordSyncChanges(ctx, changes); err != nil {
+			return total, err
+		}
+		total += len(changes)
+	}
+
+	// items that were erased entirely only have their tombstones left
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return total, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT uid FROM sync_items WHERE item_id IS NULL AND (hash IS NULL OR hash != ?)`, syncTombstoneHash)
+	if err != nil {
+		return total, err
+	}
+	var erased []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			rows.Close()
+			return total, err
+		}
+		erased = append(erased, uid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return total, err
+	}
+	for _, uid := range erased {
+		rec, err := loadSyncRecord(ctx, tx, uid)
+		if err != nil {
+			return total, err
+		}
+		if err := tl.bumpSyncRecord(ctx, tx, &rec); err != nil {
+			return total, err
+		}
+		rec.hash = syncTombstoneHash
+		if err := storeSyncRecord(ctx, tx, &rec); err != nil {
+			return total, err
+		}
+	}
+
+	return total + len(erased), tx.Commit()
+}
+
+// scanSyncPage loads a page of the items after the given row ID, and returns
+// the row ID of the last one (0 if there are no more), along with the
+// records of the items that changed, which have their new hashes.
+func (tl *Timeline) scanSyncPage(ctx context.Context, afterID uint64) (uint64, []syncRecord, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+
+	rows, err := tl.db.QueryContext(ctx, `SELECT `+itemDBColumns+`, sync_items.id, sync_items.uid, sync_items.vector, sync_items.hash
+		FROM extended_items AS items
+		LEFT JOIN sync_items ON sync_items.item_id = items.id
+		WHERE items.id > ?
+		ORDER BY items.id
+		LIMIT ?`, afterID, syncPageSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	type scanned struct {
+		ir  ItemRow
+		rec syncRecord
+	}
+	var page []scanned
+	for rows.Next() {
+		var recID *uint64
+		var uid, vector *string
+		var hash []byte
+		ir, err := scanItemRow(rows, []any{&recID, &uid, &vector, &hash})
+		if err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		rec := syncRecord{id: deref(recID), itemID: ir.ID, uid: deref(uid), hash: hash}
+		if vector != nil {
+			if err := json.Unmarshal([]byte(*vector), &rec.vector); err != nil {
+				rows.Close()
+				return 0, nil, fmt.Errorf("decoding version vector of item %d: %w", ir.ID, err)
+			}
+		}
+		if rec.uid == "" {
+			rec.uid = tl.defaultSyncUID(ir.DataSourceName, ir.OriginalID, ir.ID)
+		}
+		page = append(page, scanned{ir, rec})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if len(page) == 0 {
+		return 0, nil, nil
+	}
+
+	var changes []syncRecord
+	for _, s := range page {
+		si, err := tl.loadSyncItem(ctx, tl.db, s.ir, s.rec.uid, false)
+		if err != nil {
+			return 0, nil, fmt.Errorf("loading item %d: %w", s.ir.ID, err)
+		}
+		if !bytes.Equal(si.Hash, s.rec.hash) {
+			s.rec.hash = si.Hash
+			changes = append(changes, s.rec)
+		}
+	}
+
+	return page[len(page)-1].ir.ID, changes, nil
+}
+
+// recordSyncChanges records a change by this timeline for each record.
+func (tl *Timeline) recordSyncChanges(ctx context.Context, changes []syncRecord) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, rec := range changes {
+		if rec.id == 0 {
+			// an item with this UID may have been erased before, in which
+			// case this is a new version of it
+			if old, err := loadSyncRecord(ctx, tx, rec.uid); err == nil {
+				rec.id, rec.vector = old.id, old.vector
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+		if err := tl.bumpSyncRecord(ctx, tx, &rec); err != nil {
+			return err
+		}
+		if err := storeSyncRecord(ctx, tx, &rec); err != nil {
+			return fmt.Errorf("storing sync record of %s: %w", rec.uid, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// defaultSyncUID returns the UID of an item that doesn't have one yet. It is
+// derived from the data source and the ID it gave to the item, so the item
+// is recognized if it is imported into both timelines, or if it has none,
+// the timeline and the item's row ID (the same as in exports).
+func (tl *Timeline) defaultSyncUID(dataSourceName, originalID *string, rowID uint64) string {
+	if dataSourceName != nil && originalID != nil && *dataSourceName != "" && *originalID != "" {
+		return *dataSourceName + "/" + *originalID
+	}
+	return tl.id.String() + "/" + strconv.FormatUint(rowID, 10)
+}
+
+// syncUIDOfItem returns the UID of the item with the given row ID.
+func (tl *Timeline) syncUIDOfItem(ctx context.Context, q rowQueryer, rowID uint64) (string, error) {
+	var uid, dataSourceName, originalID *string
+	err := q.QueryRowContext(ctx, `SELECT sync_items.uid, data_sources.name, items.original_id
+		FROM items
+		LEFT JOIN sync_items ON sync_items.item_id = items.id
+		LEFT JOIN data_sources ON data_sources.id = items.data_source_id
+		WHERE items.id=?`, rowID).Scan(&uid, &dataSourceName, &originalID)
+	if err != nil {
+		return "", err
+	}
+	if uid != nil {
+		return *uid, nil
+	}
+	return tl.defaultSyncUID(dataSourceName, originalID, rowID), nil
+}
+
+// loadSyncItem loads the synced content of the item row, and computes its hash.
+// If withEntities is true, the entities that have the attributes of the item
+// and its relationships are loaded too, which are needed to send the item.
+// The vector and time of the change are not set.
+func (tl *Timeline) loadSyncItem(ctx context.Context, q queryer, ir ItemRow, uid string, withEntities bool) (SyncItem, error) {
+	si := SyncItem{UID: uid}
+	if ir.Deleted != nil {
+		si.Deleted = true
+		si.Hash = syncTombstoneHash
+		return si, nil
+	}
+
+	item := newArchiveItem(ir)
+	item.UID = uid
+	item.DataFile = deref(ir.DataFile)
+	si.DataHash = ir.DataHash
+
+	var attrIDs []uint64
+	if ir.AttributeID != nil {
+		attr, err := loadArchiveAttribute(ctx, q, *ir.AttributeID)
+		if err != nil {
+			return si, err
+		}
+		item.Attribute = attr
+		attrIDs = append(attrIDs, *ir.AttributeID)
+	}
+	si.Item = &item
+
+	rels, relAttrIDs, err := tl.loadSyncRelationships(ctx, q, ir.ID, uid)
+	if err != nil {
+		return si, fmt.Errorf("loading relationships: %w", err)
+	}
+	si.Relationships = rels
+
+	if withEntities {
+		si.Entities, err = loadSyncEntities(ctx, q, append(attrIDs, relAttrIDs...))
+		if err != nil {
+			return si, fmt.Errorf("loading entities: %w", err)
+		}
+	}
+
+	si.Hash, err = si.contentHash()
+	return si, err
+}
+
+// loadSyncRelationships loads the relationships that belong to the item: those
+// from the item, and those from an entity to the item. It also returns the row
+// IDs of the attributes in the relationships.
+func (tl *Timeline) loadSyncRelationships(ctx context.Context, q queryer, itemID uint64, uid string) ([]ArchiveRelationship, []uint64, error) {
+	type relRow struct {
+		rel              ArchiveRelationship
+		fromItem, toItem *uint64
+		fromAttr, toAttr *uint64
+		start, end       *int64
+		metadata         *string
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT relations.label, relations.directed, relations.subordinating, relationships.value,
+			relationships.from_item_id, relationships.from_attribute_id, relationships.to_item_id, relationships.to_attribute_id,
+			relationships.start, relationships.end, relationships.metadata
+		FROM relationships
+		JOIN relations ON relations.id = relationships.relation_id
+		WHERE relationships.from_item_id=? OR (relationships.to_item_id=? AND relationships.from_item_id IS NULL)
+		ORDER BY relationships.id`, itemID, itemID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var relRows []relRow
+	for rows.Next() {
+		var r relRow
+		err := rows.Scan(&r.rel.Label, &r.rel.Directed, &r.rel.Subordinating, &r.rel.Value,
+			&r.fromItem, &r.fromAttr, &r.toItem, &r.toAttr, &r.start, &r.end, &r.metadata)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		relRows = append(relRows, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	uidOf := func(rowID *uint64) (string, error) {
+		if rowID == nil {
+			return "", nil
+		}
+		if *rowID == itemID {
+			return uid, nil
+		}
+		return tl.syncUIDOfItem(ctx, q, *rowID)
+	}
+
+	rels := make([]ArchiveRelationship, 0, len(relRows))
+	var attrIDs []uint64
+	for _, r := range relRows {
+		rel := r.rel
+		if rel.FromItem, err = uidOf(r.fromItem); err != nil {
+			return nil, nil, err
+		}
+		if rel.ToItem, err = uidOf(r.toItem); err != nil {
+			return nil, nil, err
+		}
+		if r.fromAttr != nil {
+			if rel.FromAttribute, err = loadArchiveAttribute(ctx, q, *r.fromAttr); err != nil {
+				return nil, nil, err
+			}
+			attrIDs = append(attrIDs, *r.fromAttr)
+		}
+		if r.toAttr != nil {
+			if rel.ToAttribute, err = loadArchiveAttribute(ctx, q, *r.toAttr); err != nil {
+				return nil, nil, err
+			}
+			attrIDs = append(attrIDs, *r.toAttr)
+		}
+		if r.start != nil {
+			start := time.Unix(*r.start, 0)
+			rel.Start = &start
+		}
+		if r.end != nil {
+			end := time.Unix(*r.end, 0)
+			rel.End = &end
+		}
+		if r.metadata != nil {
+			rel.Metadata = json.RawMessage(*r.metadata)
+		}
+		if (rel.FromItem == "" && rel.FromAttribute == nil) || (rel.ToItem == "" && rel.ToAttribute == nil) {
+			continue // dangling
+		}
+		rels = append(rels, rel)
+	}
+	return rels, attrIDs, nil
+}
+
+// loadSyncEntities loads the entities that have the attributes with the
+// given row IDs. Their pictures are not synced.
+func loadSyncEntities(ctx context.Context, q queryer, attrIDs []uint64) ([]ArchiveEntity, error) {
+	var entities []ArchiveEntity
+	seen := make(map[uint64]struct{})
+	for _, attrID := range attrIDs {
+		var entityID uint64
+		err := q.QueryRowContext(ctx, `SELECT entity_id FROM entity_attributes WHERE attribute_id=? ORDER BY id LIMIT 1`, attrID).Scan(&entityID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[entityID]; ok {
+			continue
+		}
+		seen[entityID] = struct{}{}
+		entity, err := loadArchiveEntity(ctx, q, entityID)
+		if err != nil {
+			return nil, err
+		}
+		entity.Picture = ""
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+// syncChangesSince calls fn with each item that has a change that is not in
+// knowledge, in order, along with the total number of them.
+func (tl *Timeline) syncChangesSince(ctx context.Context, knowledge VersionVector, fn func(si SyncItem, total int) error) error {
+	// find the changes first, so the total is known
+	type change struct {
+		uid     string
+		itemID  uint64
+		vector  VersionVector
+		changed time.Time
+	}
+	var changes []change
+	err := func() error {
+		tl.dbMu.RLock()
+		defer tl.dbMu.RUnlock()
+		rows, err := tl.db.QueryContext(ctx, `SELECT uid, item_id, vector, changed FROM sync_items ORDER BY id`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var c change
+			var itemID *uint64
+			var vector string
+			var changed int64
+			if err := rows.Scan(&c.uid, &itemID, &vector, &changed); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(vector), &c.vector); err != nil {
+				return fmt.Errorf("decoding version vector of %s: %w", c.uid, err)
+			}
+			if c.vector.newerThan(knowledge) {
+				c.itemID, c.changed = deref(itemID), time.UnixMilli(changed)
+				changes = append(changes, c)
+			}
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		si := SyncItem{UID: c.uid, Deleted: true, Hash: syncTombstoneHash}
+		if c.itemID != 0 {
+			si, err = tl.loadSyncItemByID(ctx, c.itemID, c.uid)
+			if err != nil {
+				return fmt.Errorf("loading item %d: %w", c.itemID, err)
+			}
+		}
+		si.Vector, si.Changed = c.vector, c.changed
+		if err := fn(si, len(changes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSyncItemByID loads the item with the given row ID, with its entities, to send it.
+func (tl *Timeline) loadSyncItemByID(ctx context.Context, itemID uint64, uid string) (SyncItem, error) {
+	tl.dbMu.RLock()
+	defer tl.dbMu.RUnlock()
+	ir, err := scanItemRow(tl.db.QueryRowContext(ctx, `SELECT `+itemDBColumns+`
+		FROM extended_items AS items
+		WHERE items.id=?`, itemID), nil)
+	if err != nil {
+		return SyncItem{}, err
+	}
+	return tl.loadSyncItem(ctx, tl.db, ir, uid, true)
+}
+
+// syncApplier applies the changes received from a remote timeline.
+type syncApplier struct {
+	tl     *Timeline
+	policy SyncConflictPolicy
+	logger *zap.Logger
+
+	// writes the data file of the item, as stored on the remote
+	fetch func(ctx context.Context, si SyncItem, w io.Writer) error
+
+	// the relationships of the stored items, keyed by UID, which are stored
+	// once all the items are, so they can refer to each other
+	relationships map[string]SyncItem
+
+	// data files of the stored items that may need thumbnails
+	thumbnails []thumbnailTask
+
+	stats SyncStats
+}
+
+// SyncStats summarizes the changes applied from a remote timeline.
+type SyncStats struct {
+	Received  int `json:"received"`
+	Inserted  int `json:"inserted"`
+	Updated   int `json:"updated"`
+	Deleted   int `json:"deleted"`
+	Conflicts int `json:"conflicts"`
+	Copies    int `json:"copies"`
+}
+
+func (tl *Timeline) newSyncApplier(policy SyncConflictPolicy, logger *zap.Logger, fetch func(context.Context, SyncItem, io.Writer) error) *syncApplier {
+	return &syncApplier{
+		tl:            tl,
+		policy:        policy,
+		logger:        logger,
+		fetch:         fetch,
+		relationships: make(map[string]SyncItem),
+	}
+}
+
+// apply applies a version of an item received from the remote timeline.
+func (sa *syncApplier) apply(ctx context.Context, remote SyncItem) error {
+	tl := sa.tl
+	sa.stats.Received++
+
+	if remote.UID == "" {
+		return errors.New("synced item has no UID")
+	}
+	if !remote.Deleted && remote.Item == nil {
+		return fmt.Errorf("synced item %s has no content", remote.UID)
+	}
+
+	tl.dbMu.RLock()
+	local, err := loadSyncRecord(ctx, tl.db, remote.UID)
+	if errors.Is(err, sql.ErrNoRows) && remote.Item != nil && remote.Item.DataSource != "" && remote.Item.OriginalID != "" {
+		// the item may have been imported here too, but not scanned yet, in which
+		// case it's as if it were never changed here
+		err = tl.db.QueryRowContext(ctx, `SELECT items.id FROM items
+			JOIN data_sources ON data_sources.id = items.data_source_id
+			WHERE data_sources.name=? AND items.original_id=?`,
+			remote.Item.DataSource, remote.Item.OriginalID).Scan(&local.itemID)
+	}
+	tl.dbMu.RUnlock()
+	if errors.Is(err, sql.ErrNoRows) {
+		// new to us
+		if remote.Deleted {
+			return sa.storeDeleted(ctx, syncRecord{uid: remote.UID}, remote.Vector, remote.Changed)
+		}
+		sa.stats.Inserted++
+		return sa.store(ctx, syncRecord{uid: remote.UID}, remote, remote.Vector, remote.Changed)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch remote.Vector.compare(local.vector) {
+	case vectorEqual, vectorBefore:
+		return nil // we have it already
+
+	case vectorAfter:
+		return sa.overwrite(ctx, local, remote, remote.Vector, remote.Changed)
+
+	default:
+		sa.stats.Conflicts++
+		merged := remote.Vector.merge(local.vector)
+		if bytes.Equal(remote.Hash, local.hash) {
+			// changed the same way on both sides
+			return sa.storeVector(ctx, local, merged)
+		}
+
+		remoteWins := remote.Changed.After(local.changed) ||
+			(remote.Changed.Equal(local.changed) && bytes.Compare(remote.Hash, local.hash) > 0)
+
+		sa.logger.Info("sync conflict",
+			zap.String("uid", remote.UID),
+			zap.String("policy", string(sa.policy)),
+			zap.Bool("remote_wins", remoteWins))
+
+		if sa.policy == SyncKeepBoth {
+			loser := remote
+			if remoteWins {
+				if local.itemID == 0 {
+					loser = SyncItem{Deleted: true}
+				} else if loser, err = tl.loadSyncItemByID(ctx, local.itemID, local.uid); err != nil {
+					return fmt.Errorf("loading conflicting item: %w", err)
+				}
+			}
+			if err := sa.storeCopy(ctx, loser); err != nil {
+				return fmt.Errorf("keeping copy of conflicting item: %w", err)
+			}
+		}
+
+		if !remoteWins {
+			return sa.storeVector(ctx, local, merged)
+		}
+		return sa.overwrite(ctx, local, remote, merged, remote.Changed)
+	}
+}
+
+// overwrite replaces the local version of the item with the remote version.
+func (sa *syncApplier) overwrite(ctx context.Context, local syncRecord, remote SyncItem, vector VersionVector, changed time.Time) error {
+	if remote.Deleted {
+		if local.itemID != 0 {
+			if err := sa.tl.DeleteItems(ctx, []uint64{local.itemID}, DeleteOptions{Remember: true}); err != nil {
+				return fmt.Errorf("deleting synced item: %w", err)
+			}
+			sa.stats.Deleted++
+		}
+		return sa.storeDeleted(ctx, local, vector, changed)
+	}
+	if local.itemID == 0 {
+		sa.stats.Inserted++
+	} else {
+		sa.stats.Updated++
+	}
+	return sa.store(ctx, local, remote, vector, changed)
+}
+
+// storeCopy stores the losing version of a conflicting item as a new item,
+// as a change by this timeline, so the copy is synced to the other side too.
+func (sa *syncApplier) storeCopy(ctx context.Context, loser SyncItem) error {
+	if loser.Deleted || loser.Item == nil {
+		return nil // nothing to keep
+	}
+	uid := loser.UID + "~" + hex.EncodeToString(loser.Hash[:min(len(loser.Hash), 6)])
+
+	tl := sa.tl
+	tl.dbMu.RLock()
+	_, err := loadSyncRecord(ctx, tl.db, uid)
+	tl.dbMu.RUnlock()
+	if err == nil {
+		return nil // already copied
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	item := *loser.Item
+	item.UID, item.DataSource, item.OriginalID = uid, "", ""
+	copied := loser
+	copied.UID, copied.Item = uid, &item
+	copied.Relationships = make([]ArchiveRelationship, len(loser.Relationships))
+	for i, rel := range loser.Relationships {
+		if rel.FromItem == loser.UID {
+			rel.FromItem = uid
+		}
+		if rel.ToItem == loser.UID {
+			rel.ToItem = uid
+		}
+		copied.Relationships[i] = rel
+	}
+
+	sa.stats.Copies++
+	return sa.store(ctx, syncRecord{uid: uid}, copied, nil, time.Now())
+}
+
+// storeVector updates only the version vector of the item.
+func (sa *syncApplier) storeVector(ctx context.Context, local syncRecord, vector VersionVector) error {
+	tl := sa.tl
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	local.vector = vector
+	if err := storeSyncRecord(ctx, tx, &local); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// storeDeleted records that the item is deleted.
+func (sa *syncApplier) storeDeleted(ctx context.Context, local syncRecord, vector VersionVector, changed time.Time) error {
+	local.vector, local.hash, local.changed = vector, syncTombstoneHash, changed
+	return sa.storeVector(ctx, local, vector)
+}
+
+// store stores the content of the synced item, replacing the local item of the
+// record, if any, and records the vector. If vector is nil, it is stored as a
+// change by this timeline.
+func (sa *syncApplier) store(ctx context.Context, local syncRecord, si SyncItem, vector VersionVector, changed time.Time) error {
+	tl := sa.tl
+	item := si.Item
+
+	// resolve everything that takes its own locks first
+	var classificationID *uint64
+	if item.Classification != "" {
+		if id, err := tl.classificationNameToID(item.Classification); err == nil {
+			classificationID = &id
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+	entityTypes := make(map[string]uint64)
+	for _, entity := range si.Entities {
+		if _, ok := entityTypes[entity.Type]; ok {
+			continue
+		}
+		id, err := tl.entityTypeNameToID(entity.Type)
+		if errors.Is(err, sql.ErrNoRows) {
+			id, err = tl.entityTypeNameToID("person")
+		}
+		if err != nil {
+			return fmt.Errorf("entity type %q: %w", entity.Type, err)
+		}
+		entityTypes[entity.Type] = id
+	}
+
+	// find the current data file of the item, and the local file with the
+	// synced content, which is fetched from the remote if we don't have it
+	var currentDataFile *string
+	var dataSourceID *uint64
+	tl.dbMu.RLock()
+	err := func() error {
+		if local.itemID != 0 {
+			return tl.db.QueryRowContext(ctx, `SELECT data_file FROM items WHERE id=?`, local.itemID).Scan(&currentDataFile)
+		}
+		if item.DataSource == "" {
+			return nil
+		}
+		err := tl.db.QueryRowContext(ctx, `SELECT id FROM data_sources WHERE name=?`, item.DataSource).Scan(&dataSourceID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}()
+	tl.dbMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	var dataFile *string
+	if item.DataFile != "" && len(si.DataHash) > 0 {
+		file, err := sa.dataFile(ctx, si)
+		if err != nil {
+			return fmt.Errorf("data file of %s: %w", si.UID, err)
+		}
+		dataFile = &file
+	}
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var attrID *uint64
+	if item.Attribute != nil {
+		id, err := sa.storeAttribute(ctx, tx, *item.Attribute, si.Entities, entityTypes)
+		if err != nil {
+			return fmt.Errorf("storing attribute of %s: %w", si.UID, err)
+		}
+		attrID = &id
+	}
+
+	ir := ItemRow{Timestamp: item.Timestamp, Timespan: item.Timespan, Timeframe: item.Timeframe}
+	var metadata *string
+	if len(item.Metadata) > 0 {
+		meta := string(item.Metadata)
+		metadata = &meta
+	}
+	cols := []string{"classification_id", "attribute_id", "original_location", "intermediate_location", "filename",
+		"timestamp", "timespan", "timeframe", "time_offset", "time_uncertainty", "data_type", "data_text",
+		"data_file", "data_hash", "metadata", "longitude", "latitude", "altitude", "coordinate_system",
+		"coordinate_uncertainty", "note", "starred", "deleted"}
+	vals := []any{classificationID, attrID, nullString(item.OriginalLocation), nullString(item.IntermediateLocation),
+		nullString(item.Filename), ir.timestampUnix(), ir.timespanUnix(), ir.timeframeUnix(), item.TimeOffset,
+		item.TimeUncertainty, nullString(item.DataType), item.DataText, dataFile, si.DataHash, metadata,
+		item.Longitude, item.Latitude, item.Altitude, item.CoordinateSystem, item.CoordinateUncertainty,
+		nullString(item.Note), item.Starred, nil}
+
+	if local.itemID == 0 {
+		var originalID *string
+		if dataSourceID != nil {
+			originalID = nullString(item.OriginalID)
+		}
+		cols = append(cols, "data_source_id", "original_id")
+		vals = append(vals, dataSourceID, originalID)
+		err = tx.QueryRowContext(ctx, `INSERT INTO items (`+strings.Join(cols, ", ")+`) VALUES `+sqlPlaceholders(len(cols))+` RETURNING id`,
+			vals...).Scan(&local.itemID)
+		if err != nil {
+			return fmt.Errorf("inserting synced item %s: %w", si.UID, err)
+		}
+	} else {
+		_, err = tx.ExecContext(ctx, `UPDATE items SET `+strings.Join(cols, "=?, ")+`=? WHERE id=?`, //nolint:gosec // column names are constant
+			append(vals, local.itemID)...)
+		if err != nil {
+			return fmt.Errorf("updating synced item %s: %w", si.UID, err)
+		}
+		// existing relationships of the item are kept, since they may have been
+		// added here; new ones are added when the sync finishes
+		if currentDataFile != nil && (dataFile == nil || *currentDataFile != *dataFile) {
+			if err := tl.deleteDataFileAndThumbnailIfUnreferenced(ctx, tx, *currentDataFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	local.hash, local.changed = si.Hash, changed
+	if vector == nil {
+		if err := tl.bumpSyncRecord(ctx, tx, &local); err != nil {
+			return err
+		}
+	} else {
+		local.vector = vector
+	}
+	if err := storeSyncRecord(ctx, tx, &local); err != nil {
+		return fmt.Errorf("storing sync record of %s: %w", si.UID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	sa.relationships[si.UID] = si
+	if dataFile != nil && qualifiesForThumbnail(&item.DataType) {
+		sa.thumbnails = append(sa.thumbnails, thumbnailTask{
+			DataFile:  *dataFile,
+			DataType:  item.DataType,
+			ThumbType: thumbnailType(item.DataType, false),
+		})
+	}
+	return nil
+}
+
+// dataFile returns the path of a local data file with the content of the
+// synced item: either a file we have already, or one fetched from the remote.
+func (sa *syncApplier) dataFile(ctx context.Context, si SyncItem) (string, error) {
+	tl := sa.tl
+
+	var existing string
+	tl.dbMu.RLock()
+	err := tl.db.QueryRowContext(ctx, `SELECT data_file FROM items WHERE data_hash=? AND data_file IS NOT NULL LIMIT 1`, si.DataHash).Scan(&existing)
+	tl.dbMu.RUnlock()
+	if err == nil {
+		if _, err := os.Stat(tl.FullPath(existing)); err == nil {
+			return existing, nil
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	// store it at the same path as on the remote, if possible
+	dest := tl.syncDataFilePath(si.Item.DataFile)
+	for i := 0; ; i++ {
+		_, err := os.Stat(tl.FullPath(dest))
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		ext := path.Ext(dest)
+		base := strings.TrimSuffix(tl.syncDataFilePath(si.Item.DataFile), ext)
+		dest = base + "-" + hex.EncodeToString(si.DataHash[:min(len(si.DataHash), 4)])
+		if i > 0 {
+			dest += "-" + strconv.Itoa(i)
+		}
+		dest += ext
+	}
+
+	fullPath := tl.FullPath(dest)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), ".sync-*")
+	if err != nil {
+		return "", err
+	}
+	h := newHash()
+	out, err := tl.encryptingWriter(tmp)
+	if err == nil {
+		err = sa.fetch(ctx, si, io.MultiWriter(out, h))
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !bytes.Equal(h.Sum(nil), si.DataHash) {
+		err = errors.New("received data file does not match its hash")
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fullPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return dest, nil
+}
+
+// syncDataFilePath returns the path in the repo for a data file that has the
+// given path on the remote timeline; it is the same path if it's safe to use.
+func (tl *Timeline) syncDataFilePath(remotePath string) string {
+	parts := strings.Split(path.Clean(remotePath), "/")
+	safe := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part = tl.safePathComponent(part); part != "" {
+			safe = append(safe, part)
+		}
+	}
+	if len(safe) < 2 || safe[0] != DataFolderName {
+		name := "file"
+		if len(safe) > 0 {
+			name = safe[len(safe)-1]
+		}
+		safe = []string{DataFolderName, "sync", name}
+	}
+	return path.Join(safe...)
+}
+
+// storeAttribute returns the row ID of the attribute, storing it if we don't
+// have it: it is linked to the entity that has any of the attributes of the
+// synced entity that has it, or a new entity if there is none.
+func (sa *syncApplier) storeAttribute(ctx context.Context, tx *sql.Tx, attr ArchiveAttribute, entities []ArchiveEntity, entityTypes map[string]uint64) (uint64, error) {
+	newAttr := Attribute{Name: attr.Name, Value: attr.Value, AltValue: attr.AltValue}
+	var attrID uint64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM attributes WHERE name=? AND value=? LIMIT 1`,
+		newAttr.Name, newAttr.valueForDB()).Scan(&attrID)
+	if err == nil {
+		return attrID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	entity := ArchiveEntity{Type: "person", Attributes: []ArchiveAttribute{attr}}
+	for _, e := range entities {
+		if slices.ContainsFunc(e.Attributes, func(a ArchiveAttribute) bool {
+			return a.Name == attr.Name && fmt.Sprint(a.Value) == fmt.Sprint(attr.Value)
+		}) {
+			entity = e
+			break
+		}
+	}
+
+	var entityID uint64
+	for _, other := range entity.Attributes {
+		err := tx.QueryRowContext(ctx, `SELECT entity_attributes.entity_id
+			FROM attributes
+			JOIN entity_attributes ON entity_attributes.attribute_id = attributes.id
+			WHERE attributes.name=? AND attributes.value=?
+			LIMIT 1`, other.Name, Attribute{Value: other.Value}.valueForDB()).Scan(&entityID)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+	}
+
+	if entityID == 0 {
+		typeID, ok := entityTypes[entity.Type]
+		if !ok {
+			if typeID, ok = entityTypes["person"]; !ok {
+				if err := tx.QueryRowContext(ctx, `SELECT id FROM entity_types WHERE name='person'`).Scan(&typeID); err != nil {
+					return 0, err
+				}
+			}
+		}
+		var metadata *string
+		if len(entity.Metadata) > 0 {
+			meta := string(entity.Metadata)
+			metadata = &meta
+		}
+		err := tx.QueryRowContext(ctx, `INSERT INTO entities (type_id, name, metadata) VALUES (?, ?, ?) RETURNING id`,
+			typeID, nullString(entity.Name), metadata).Scan(&entityID)
+		if err != nil {
+			return 0, fmt.Errorf("inserting entity: %w", err)
+		}
+		for _, other := range entity.Attributes {
+			_, err := storeLinkBetweenEntityAndNonIDAttribute(ctx, tx, entityID,
+				Attribute{Name: other.Name, Value: other.Value, AltValue: other.AltValue})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return storeLinkBetweenEntityAndNonIDAttribute(ctx, tx, entityID, newAttr)
+}
+
+// finish stores the relationships of the stored items, and updates their
+// hashes to the content as stored here, so they don't look changed when
+// this timeline is scanned next.
+func (sa *syncApplier) finish(ctx context.Context) error {
+	if len(sa.relationships) == 0 {
+		return nil
+	}
+	tl := sa.tl
+
+	// resolve entity types before locking
+	entityTypes := make(map[string]uint64)
+	for _, si := range sa.relationships {
+		for _, entity := range si.Entities {
+			if _, ok := entityTypes[entity.Type]; ok {
+				continue
+			}
+			if id, err := tl.entityTypeNameToID(entity.Type); err == nil {
+				entityTypes[entity.Type] = id
+			}
+		}
+	}
+
+	tl.dbMu.Lock()
+	defer tl.dbMu.Unlock()
+
+	tx, err := tl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	itemID := func(uid string) (*uint64, error) {
+		if uid == "" {
+			return nil, nil
+		}
+		rec, err := loadSyncRecord(ctx, tx, uid)
+		if err != nil || rec.itemID == 0 {
+			return nil, err
+		}
+		return &rec.itemID, nil
+	}
+	attrID := func(attr *ArchiveAttribute, entities []ArchiveEntity) (*uint64, error) {
+		if attr == nil {
+			return nil, nil
+		}
+		id, err := sa.storeAttribute(ctx, tx, *attr, entities, entityTypes)
+		return &id, err
+	}
+
+	for uid, si := range sa.relationships {
+		for _, rel := range si.Relationships {
+			raw := rawRelationship{Relation: rel.Relation, value: rel.Value}
+			if raw.fromItemID, err = itemID(rel.FromItem); err != nil {
+				return err
+			}
+			if raw.toItemID, err = itemID(rel.ToItem); err != nil {
+				return err
+			}
+			if raw.fromAttributeID, err = attrID(rel.FromAttribute, si.Entities); err != nil {
+				return err
+			}
+			if raw.toAttributeID, err = attrID(rel.ToAttribute, si.Entities); err != nil {
+				return err
+			}
+			if (raw.fromItemID == nil && raw.fromAttributeID == nil) || (raw.toItemID == nil && raw.toAttributeID == nil) {
+				continue // the other item isn't here (yet)
+			}
+			if rel.Start != nil {
+				start := rel.Start.Unix()
+				raw.start = &start
+			}
+			if rel.End != nil {
+				end := rel.End.Unix()
+				raw.end = &end
+			}
+			raw.metadata = rel.Metadata
+			if err := tl.storeRelationship(ctx, tx, raw); err != nil {
+				return fmt.Errorf("storing relationship of %s: %w", uid, err)
+			}
+		}
+	}
+
+	for uid := range sa.relationships {
+		rec, err := loadSyncRecord(ctx, tx, uid)
+		if err != nil {
+			return err
+		}
+		if rec.itemID == 0 {
+			continue
+		}
+		ir, err := scanItemRow(tx.QueryRowContext(ctx, `SELECT `+itemDBColumns+`
+			FROM extended_items AS items
+			WHERE items.id=?`, rec.itemID), nil)
+		if err != nil {
+			return err
+		}
+		si, err := tl.loadSyncItem(ctx, tx, ir, uid, false)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE sync_items SET hash=? WHERE id=?`, si.Hash, rec.id); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	clear(sa.relationships)
+	return nil
+}
+
+// generateThumbnails starts a job that generates the thumbnails of the stored items, if any.
+func (sa *syncApplier) generateThumbnails(parentJobID uint64) {
+	if len(sa.thumbnails) == 0 {
+		return
+	}
+	if _, err := sa.tl.CreateJob(thumbnailJob{Tasks: sa.thumbnails, Previews: true}, time.Time{}, 0, 0, parentJobID); err != nil {
+		sa.logger.Error("creating thumbnail job for synced items", zap.Error(err))
+	}
+	sa.thumbnails = nil
+}
+
+// syncTombstoneHash is the hash of deleted items.
+var syncTombstoneHash = []byte("deleted")
+
+// Keys in the repo table.
+const (
+	syncSeqKey       = "sync_seq"        // the sequence number of the latest change by this timeline
+	syncKnowledgeKey = "sync_knowledge"  // the vector of the latest changes of other timelines that this one has all of
+	syncTokenHashKey = "sync_token_hash" // the SHA-256 of the token remote timelines must present
+)
+
+const syncPageSize = 1000
@@ -0,0 +1,223 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestVersionVectorCompare(t *testing.T) {
+	for i, tc := range []struct {
+		a, b   VersionVector
+		expect vectorOrder
+	}{
+		{a: VersionVector{}, b: VersionVector{}, expect: vectorEqual},
+		{a: VersionVector{"a": 1}, b: VersionVector{"a": 1}, expect: vectorEqual},
+		{a: VersionVector{"a": 1}, b: VersionVector{"a": 2}, expect: vectorBefore},
+		{a: VersionVector{"a": 1}, b: VersionVector{"a": 1, "b": 1}, expect: vectorBefore},
+		{a: VersionVector{"a": 2, "b": 1}, b: VersionVector{"a": 1}, expect: vectorAfter},
+		{a: VersionVector{"a": 2}, b: VersionVector{"a": 1, "b": 1}, expect: vectorConcurrent},
+	} {
+		if actual := tc.a.compare(tc.b); actual != tc.expect {
+			t.Errorf("test %d: expected %v, got %v", i, tc.expect, actual)
+		}
+	}
+
+	merged := VersionVector{"a": 2}.merge(VersionVector{"a": 1, "b": 3})
+	if merged["a"] != 2 || merged["b"] != 3 {
+		t.Errorf("unexpected merged vector: %v", merged)
+	}
+	if (VersionVector{"a": 2, "b": 1}).newerThan(VersionVector{"a": 2, "b": 1}) {
+		t.Error("vector should not be newer than knowledge that has all of its changes")
+	}
+	if !(VersionVector{"a": 2, "c": 1}).newerThan(VersionVector{"a": 2, "b": 1}) {
+		t.Error("vector should be newer than knowledge that lacks one of its changes")
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	local, remote := newTestTimeline(t), newTestTimeline(t)
+
+	// the local timeline has a message sent by a person, with an attached
+	// note (in a data file), and the remote timeline has another message
+	note := []byte("a note")
+	h := newHash()
+	_, _ = h.Write(note)
+	if err := os.MkdirAll(local.FullPath("data/notes"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(local.FullPath("data/notes/note.txt"), note, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, local, `
+		INSERT INTO attributes (id, name, value) VALUES (1, 'phone_number', '+15550001');
+		INSERT INTO entities (id, type_id, name) VALUES (1, (SELECT id FROM entity_types WHERE name='person'), 'Alice');
+		INSERT INTO entity_attributes (entity_id, attribute_id) VALUES (1, 1);
+		INSERT INTO items (id, data_source_id, original_id, attribute_id, timestamp, data_type, data_text) VALUES
+			(1, (SELECT id FROM data_sources WHERE name='sms'), 'msg1', 1, 1700000000000, 'text/plain', 'Hello');
+		INSERT INTO items (id, timestamp, data_type, data_file, data_hash) VALUES
+			(2, 1700000000000, 'text/plain', 'data/notes/note.txt', ?);
+		INSERT INTO relations (id, label) VALUES (100, 'test_attached');
+		INSERT INTO relationships (relation_id, from_item_id, to_item_id) VALUES (100, 1, 2);`, h.Sum(nil))
+	mustExec(t, remote, `
+		INSERT INTO items (id, data_source_id, original_id, timestamp, data_type, data_text) VALUES
+			(1, (SELECT id FROM data_sources WHERE name='sms'), 'msg2', 1700000001000, 'text/plain', 'Hi');`)
+
+	if err := remote.SetSyncToken(ctx, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(remote.SyncHandler())
+	defer server.Close()
+
+	mustExec(t, local, `INSERT INTO sync_peers (id, url, token) VALUES (1, ?, 'wrong'), (2, ?, 'secret')`, server.URL, server.URL+"/")
+	sync := func(peerID uint64) error {
+		job := &ActiveJob{ctx: ctx, tl: local, logger: zap.NewNop(), statusLog: zap.NewNop()}
+		return syncJob{PeerID: peerID}.Run(job, nil)
+	}
+	if err := sync(1); err == nil {
+		t.Fatal("expected sync with the wrong token to fail")
+	}
+	if err := sync(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// both timelines have all the items now
+	if text := syncTestText(t, remote, "msg1"); text != "Hello" {
+		t.Errorf("expected message to be synced to remote, got %q", text)
+	}
+	if text := syncTestText(t, local, "msg2"); text != "Hi" {
+		t.Errorf("expected message to be synced from remote, got %q", text)
+	}
+	var entityName, dataFile string
+	err := remote.db.QueryRow(`SELECT entities.name FROM items
+		JOIN entity_attributes ON entity_attributes.attribute_id = items.attribute_id
+		JOIN entities ON entities.id = entity_attributes.entity_id
+		WHERE items.original_id='msg1'`).Scan(&entityName)
+	if err != nil || entityName != "Alice" {
+		t.Errorf("expected synced message to be attributed to its sender, got %q (%v)", entityName, err)
+	}
+	err = remote.db.QueryRow(`SELECT attached.data_file FROM items
+		JOIN relationships ON relationships.from_item_id = items.id
+		JOIN items AS attached ON attached.id = relationships.to_item_id
+		WHERE items.original_id='msg1'`).Scan(&dataFile)
+	if err != nil {
+		t.Fatalf("expected relationship to be synced: %v", err)
+	}
+	if content, err := os.ReadFile(remote.FullPath(dataFile)); err != nil || string(content) != string(note) {
+		t.Errorf("expected data file to be synced, got %q (%v)", content, err)
+	}
+
+	// an item changed on one side is updated on the other side
+	mustExec(t, local, `UPDATE items SET data_text='Hello again' WHERE original_id='msg1'`)
+	if err := sync(2); err != nil {
+		t.Fatal(err)
+	}
+	if text := syncTestText(t, remote, "msg1"); text != "Hello again" {
+		t.Errorf("expected change to be synced, got %q", text)
+	}
+
+	// an item changed on both sides is a conflict, which the newest change wins;
+	// changes are dated when they're scanned, so the remote's is scanned later
+	scanConflict := func() {
+		t.Helper()
+		if _, err := local.scanSyncChanges(ctx); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+		if _, err := remote.scanSyncChanges(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustExec(t, local, `UPDATE items SET data_text='Hi from local' WHERE original_id='msg2'`)
+	mustExec(t, remote, `UPDATE items SET data_text='Hi from remote' WHERE original_id='msg2'`)
+	scanConflict()
+	if err := sync(2); err != nil {
+		t.Fatal(err)
+	}
+	for _, tl := range []*Timeline{local, remote} {
+		if text := syncTestText(t, tl, "msg2"); text != "Hi from remote" {
+			t.Errorf("expected newest change to win, got %q", text)
+		}
+	}
+
+	// if both are kept, the local change is kept as a copy, on both sides
+	mustExec(t, local, `UPDATE sync_peers SET conflict_policy='keep_both' WHERE id=2`)
+	mustExec(t, local, `UPDATE items SET data_text='Bye from local' WHERE original_id='msg2'`)
+	mustExec(t, remote, `UPDATE items SET data_text='Bye from remote' WHERE original_id='msg2'`)
+	scanConflict()
+	if err := sync(2); err != nil {
+		t.Fatal(err)
+	}
+	for _, tl := range []*Timeline{local, remote} {
+		if text := syncTestText(t, tl, "msg2"); text != "Bye from remote" {
+			t.Errorf("expected newest change to win, got %q", text)
+		}
+		var count int
+		if err := tl.db.QueryRow(`SELECT count() FROM items WHERE data_text='Bye from local'`).Scan(&count); err != nil || count != 1 {
+			t.Errorf("expected a copy of the losing change, found %d (%v)", count, err)
+		}
+	}
+
+	// deleting an item deletes it on the other side
+	var rowID uint64
+	if err := remote.db.QueryRow(`SELECT id FROM items WHERE original_id='msg1'`).Scan(&rowID); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.DeleteItems(ctx, []uint64{rowID}, DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync(2); err != nil {
+		t.Fatal(err)
+	}
+	var deleted *int64
+	if err := local.db.QueryRow(`SELECT deleted FROM items WHERE original_id='msg1'`).Scan(&deleted); err != nil || deleted == nil {
+		t.Errorf("expected deletion to be synced (%v)", err)
+	}
+
+	// nothing changes when syncing again
+	var before, after int
+	if err := local.db.QueryRow(`SELECT value FROM repo WHERE key=?`, syncSeqKey).Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.db.QueryRow(`SELECT value FROM repo WHERE key=?`, syncSeqKey).Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Errorf("expected no new changes after syncing twice, but sequence went from %d to %d", before, after)
+	}
+}
+
+func syncTestText(t *testing.T, tl *Timeline, originalID string) string {
+	t.Helper()
+	var text *string
+	if err := tl.db.QueryRow(`SELECT data_text FROM items WHERE original_id=?`, originalID).Scan(&text); err != nil {
+		t.Fatalf("loading item %s: %v", originalID, err)
+	}
+	return deref(text)
+}
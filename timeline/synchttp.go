@@ -0,0 +1,642 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SyncHandler returns the handler that remote timelines sync with this
+// timeline through (see Sync). Requests must present the token set with
+// SetSyncToken as a bearer token; if no token is set, all requests are
+// refused. Paths are relative to the URL that remotes sync with, so the
+// handler should be mounted with http.StripPrefix.
+func (tl *Timeline) SyncHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /hello", tl.serveSyncHello)
+	mux.HandleFunc("POST /changes", tl.serveSyncChanges)
+	mux.HandleFunc("POST /have", tl.serveSyncHave)
+	mux.HandleFunc("PUT /files", tl.serveSyncUpload)
+	mux.HandleFunc("GET /files", tl.serveSyncDownload)
+	mux.HandleFunc("POST /apply", tl.serveSyncApply)
+	return tl.authorizeSync(mux)
+}
+
+func (tl *Timeline) authorizeSync(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		var tokenHash string
+		tl.dbMu.RLock()
+		err := tl.db.QueryRowContext(r.Context(), `SELECT value FROM repo WHERE key=?`, syncTokenHashKey).Scan(&tokenHash)
+		tl.dbMu.RUnlock()
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			syncLogger(r).Error("loading sync token", zap.Error(err))
+		}
+
+		sum := sha256.Sum256([]byte(token))
+		if !ok || tokenHash == "" || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(tokenHash)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// syncHeader is the first line of a stream of synced items, and the body
+// of the hello request and response.
+type syncHeader struct {
+	Replica   string             `json:"replica"`
+	Knowledge VersionVector      `json:"knowledge,omitempty"`
+	Policy    SyncConflictPolicy `json:"policy,omitempty"`
+	Count     int                `json:"count,omitempty"` // of items in the stream
+}
+
+// syncStreamEnd is the last line of a stream of synced items. A stream
+// without it was cut short.
+type syncStreamEnd struct {
+	Done  bool   `json:"done,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// serveSyncHello scans the timeline for changes, so the knowledge it
+// responds with covers them.
+func (tl *Timeline) serveSyncHello(w http.ResponseWriter, r *http.Request) {
+	var req syncHeader
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tl.syncMu.Lock()
+	changes, err := tl.scanSyncChanges(r.Context())
+	tl.syncMu.Unlock()
+	if err != nil {
+		syncError(w, r, "scanning for changes", err)
+		return
+	}
+
+	tl.dbMu.RLock()
+	knowledge, err := tl.syncKnowledge(r.Context(), tl.db)
+	tl.dbMu.RUnlock()
+	if err != nil {
+		syncError(w, r, "loading knowledge", err)
+		return
+	}
+
+	syncLogger(r).Info("remote connected", zap.String("replica", req.Replica), zap.Int("changes", changes))
+	writeSyncJSON(w, syncHeader{Replica: tl.id.String(), Knowledge: knowledge})
+}
+
+// serveSyncChanges streams the items that changed since the knowledge in the request.
+func (tl *Timeline) serveSyncChanges(w http.ResponseWriter, r *http.Request) {
+	var req syncHeader
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tl.dbMu.RLock()
+	knowledge, err := tl.syncKnowledge(r.Context(), tl.db)
+	tl.dbMu.RUnlock()
+	if err != nil {
+		syncError(w, r, "loading knowledge", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	err = tl.writeSyncChanges(r.Context(), w, syncHeader{Replica: tl.id.String(), Knowledge: knowledge}, req.Knowledge)
+	if err != nil {
+		syncLogger(r).Error("sending changes", zap.Error(err))
+	}
+}
+
+// serveSyncHave responds with the data file hashes in the request that
+// the timeline has already, so they don't have to be uploaded.
+func (tl *Timeline) serveSyncHave(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Hashes [][]byte `json:"hashes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	have := make([][]byte, 0, len(req.Hashes))
+	tl.dbMu.RLock()
+	for _, h := range req.Hashes {
+		var count int
+		err := tl.db.QueryRowContext(r.Context(), `SELECT count() FROM items WHERE data_hash=? AND data_file IS NOT NULL LIMIT 1`, h).Scan(&count)
+		if err != nil {
+			tl.dbMu.RUnlock()
+			syncError(w, r, "looking up data file", err)
+			return
+		}
+		if count > 0 {
+			have = append(have, h)
+		} else if _, err := os.Stat(tl.syncStagingPath(h)); err == nil {
+			have = append(have, h)
+		}
+	}
+	tl.dbMu.RUnlock()
+
+	writeSyncJSON(w, map[string]any{"have": have})
+}
+
+// serveSyncUpload stages an uploaded data file until the items that
+// have it are applied.
+func (tl *Timeline) serveSyncUpload(w http.ResponseWriter, r *http.Request) {
+	dataHash, err := hex.DecodeString(r.URL.Query().Get("hash"))
+	if err != nil || len(dataHash) == 0 {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	dest := tl.syncStagingPath(dataHash)
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		syncError(w, r, "creating staging folder", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		syncError(w, r, "creating staged file", err)
+		return
+	}
+	h := newHash()
+	out, err := tl.encryptingWriter(tmp)
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(out, h), r.Body)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !bytes.Equal(h.Sum(nil), dataHash) {
+		_ = os.Remove(tmp.Name())
+		http.Error(w, "uploaded file does not match its hash", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		syncError(w, r, "staging uploaded file", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveSyncDownload serves a data file. Only the data files of items can be downloaded.
+func (tl *Timeline) serveSyncDownload(w http.ResponseWriter, r *http.Request) {
+	dataFile := r.URL.Query().Get("path")
+
+	var count int
+	tl.dbMu.RLock()
+	err := tl.db.QueryRowContext(r.Context(), `SELECT count() FROM items WHERE data_file=? LIMIT 1`, dataFile).Scan(&count)
+	tl.dbMu.RUnlock()
+	if err != nil {
+		syncError(w, r, "looking up data file", err)
+		return
+	}
+	if count == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := tl.OpenRepoFile(dataFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		syncError(w, r, "opening data file", err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = io.Copy(w, f)
+}
+
+// serveSyncApply applies the stream of changes pushed by the remote, and
+// responds with the stats of what was applied.
+func (tl *Timeline) serveSyncApply(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := syncLogger(r)
+
+	tl.syncMu.Lock()
+	defer tl.syncMu.Unlock()
+
+	var applier *syncApplier
+	var header syncHeader
+	var staged []string
+	fetch := func(_ context.Context, si SyncItem, w io.Writer) error {
+		stagedPath := tl.syncStagingPath(si.DataHash)
+		f, err := tl.openFile(stagedPath)
+		if err != nil {
+			return fmt.Errorf("data file was not uploaded: %w", err)
+		}
+		defer f.Close()
+		staged = append(staged, stagedPath)
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	err := readSyncStream(r.Body, func(hdr syncHeader) error {
+		header = hdr
+		if header.Policy == "" {
+			header.Policy = SyncNewestWins
+		}
+		applier = tl.newSyncApplier(header.Policy, logger.With(zap.String("replica", hdr.Replica)), fetch)
+		return nil
+	}, func(si SyncItem) error {
+		return applier.apply(ctx, si)
+	})
+	if applier != nil {
+		err = errors.Join(err, applier.finish(ctx))
+	}
+	for _, file := range staged {
+		_ = os.Remove(file)
+	}
+	if err != nil {
+		syncError(w, r, "applying changes", err)
+		return
+	}
+	if err := tl.learnSyncKnowledge(ctx, header.Knowledge); err != nil {
+		syncError(w, r, "storing knowledge", err)
+		return
+	}
+	applier.generateThumbnails(0)
+
+	logger.Info("applied changes from remote",
+		zap.String("replica", header.Replica),
+		zap.Any("stats", applier.stats))
+	writeSyncJSON(w, applier.stats)
+}
+
+// writeSyncChanges writes a stream of the items that have changes that are
+// not in knowledge: the header, followed by the items, and the end.
+func (tl *Timeline) writeSyncChanges(ctx context.Context, w io.Writer, header syncHeader, knowledge VersionVector) error {
+	enc := json.NewEncoder(w)
+	var wroteHeader bool
+	err := tl.syncChangesSince(ctx, knowledge, func(si SyncItem, total int) error {
+		if !wroteHeader {
+			header.Count = total
+			if err := enc.Encode(header); err != nil {
+				return err
+			}
+			wroteHeader = true
+		}
+		return enc.Encode(si)
+	})
+	if err == nil && !wroteHeader {
+		err = enc.Encode(header)
+	}
+	if err != nil {
+		_ = enc.Encode(syncStreamEnd{Error: err.Error()})
+		return err
+	}
+	return enc.Encode(syncStreamEnd{Done: true})
+}
+
+// readSyncStream reads a stream of synced items written by writeSyncChanges.
+func readSyncStream(r io.Reader, header func(syncHeader) error, item func(SyncItem) error) error {
+	dec := json.NewDecoder(r)
+	var hdr syncHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	if err := header(hdr); err != nil {
+		return err
+	}
+	for {
+		var line struct {
+			SyncItem
+			syncStreamEnd
+		}
+		if err := dec.Decode(&line); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("reading synced item: %w", err)
+		}
+		if line.Error != "" {
+			return fmt.Errorf("remote: %s", line.Error)
+		}
+		if line.Done {
+			return nil
+		}
+		if err := item(line.SyncItem); err != nil {
+			return fmt.Errorf("applying %s: %w", line.UID, err)
+		}
+	}
+}
+
+// syncStagingPath returns the path of the staged upload of the data file with the given hash.
+func (tl *Timeline) syncStagingPath(dataHash []byte) string {
+	return filepath.Join(tl.repoDir, syncStagingFolderName, hex.EncodeToString(dataHash))
+}
+
+func syncLogger(r *http.Request) *zap.Logger {
+	return Log.Named("sync").With(zap.String("remote_addr", r.RemoteAddr))
+}
+
+func syncError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	syncLogger(r).Error(msg, zap.Error(err))
+	http.Error(w, msg+": "+err.Error(), http.StatusInternalServerError)
+}
+
+func writeSyncJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// syncClient makes requests to the sync handler of a remote timeline.
+type syncClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (c syncClient) request(ctx context.Context, method, endpoint string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := c.url + endpoint
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		defer resp.Body.Close()
+		const maxErrorLen = 1024
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorLen))
+		return nil, fmt.Errorf("%s %s: HTTP %d: %s", method, endpoint, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (c syncClient) postJSON(ctx context.Context, endpoint string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := c.request(ctx, http.MethodPost, endpoint, nil, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// fetchFile writes the data file of the item on the remote.
+func (c syncClient) fetchFile(ctx context.Context, si SyncItem, w io.Writer) error {
+	resp, err := c.request(ctx, http.MethodGet, "/files", url.Values{"path": {si.Item.DataFile}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// syncJob syncs the timeline with a remote timeline (see Sync).
+type syncJob struct {
+	PeerID uint64 `json:"peer_id"`
+}
+
+func (sj syncJob) Run(job *ActiveJob, _ []byte) error {
+	tl := job.Timeline()
+	ctx := job.Context()
+	self := tl.id.String()
+
+	peer, err := tl.loadSyncPeer(ctx, sj.PeerID)
+	if err != nil {
+		return fmt.Errorf("loading sync remote %d: %w", sj.PeerID, err)
+	}
+	if peer.token == "" {
+		return fmt.Errorf("no token to sync with %s", peer.URL)
+	}
+	logger := job.Logger().With(zap.String("remote", peer.URL))
+	client := syncClient{url: strings.TrimSuffix(peer.URL, "/"), token: peer.token, client: http.DefaultClient}
+
+	job.Message("Scanning for changes")
+	tl.syncMu.Lock()
+	scanned, err := tl.scanSyncChanges(ctx)
+	tl.syncMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("scanning for changes: %w", err)
+	}
+
+	job.Message("Connecting to remote timeline")
+	var hello syncHeader
+	if err := client.postJSON(ctx, "/hello", syncHeader{Replica: self}, &hello); err != nil {
+		return fmt.Errorf("connecting to remote: %w", err)
+	}
+	if hello.Replica == self {
+		return errors.New("cannot sync a timeline with itself")
+	}
+
+	// pull the remote's changes
+	job.Message("Receiving changes")
+	applier := tl.newSyncApplier(peer.ConflictPolicy, logger, client.fetchFile)
+	var remote syncHeader
+	err = func() error {
+		tl.syncMu.Lock()
+		defer tl.syncMu.Unlock()
+
+		tl.dbMu.RLock()
+		knowledge, err := tl.syncKnowledge(ctx, tl.db)
+		tl.dbMu.RUnlock()
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(syncHeader{Replica: self, Knowledge: knowledge})
+		if err != nil {
+			return err
+		}
+		resp, err := client.request(ctx, http.MethodPost, "/changes", nil, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		err = readSyncStream(resp.Body, func(hdr syncHeader) error {
+			remote = hdr
+			job.SetTotal(hdr.Count)
+			return nil
+		}, func(si SyncItem) error {
+			if err := applier.apply(ctx, si); err != nil {
+				return err
+			}
+			job.Progress(1)
+			return nil
+		})
+		return errors.Join(err, applier.finish(ctx))
+	}()
+	if err != nil {
+		return fmt.Errorf("receiving changes: %w", err)
+	}
+	if err := tl.learnSyncKnowledge(ctx, remote.Knowledge); err != nil {
+		return err
+	}
+	applier.generateThumbnails(job.ID())
+
+	// push our changes to the remote
+	sent, err := sj.push(job, client, remote, peer.ConflictPolicy)
+	if err != nil {
+		return fmt.Errorf("sending changes: %w", err)
+	}
+
+	tl.dbMu.Lock()
+	_, err = tl.db.ExecContext(ctx, `UPDATE sync_peers SET repo_id=?, last_synced=? WHERE id=?`,
+		remote.Replica, time.Now().Unix(), peer.ID)
+	tl.dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("synced",
+		zap.String("remote_replica", remote.Replica),
+		zap.Int("local_changes", scanned),
+		zap.Any("received", applier.stats),
+		zap.Any("sent", sent))
+	job.Message(fmt.Sprintf("Received %d and sent %d changes", applier.stats.Received, sent.Received))
+
+	return nil
+}
+
+// push sends the changes that the remote doesn't have, and returns the
+// stats of what the remote applied.
+func (sj syncJob) push(job *ActiveJob, client syncClient, remote syncHeader, policy SyncConflictPolicy) (SyncStats, error) {
+	tl := job.Timeline()
+	ctx := job.Context()
+
+	tl.dbMu.RLock()
+	knowledge, err := tl.syncKnowledge(ctx, tl.db)
+	tl.dbMu.RUnlock()
+	if err != nil {
+		return SyncStats{}, err
+	}
+
+	// upload the data files the remote needs first
+	job.Message("Sending data files")
+	files := make(map[string]string) // hex of hash => data file
+	var hashes [][]byte
+	var count int
+	err = tl.syncChangesSince(ctx, remote.Knowledge, func(si SyncItem, _ int) error {
+		count++
+		if si.Item != nil && si.Item.DataFile != "" && len(si.DataHash) > 0 {
+			key := hex.EncodeToString(si.DataHash)
+			if _, ok := files[key]; !ok {
+				files[key] = si.Item.DataFile
+				hashes = append(hashes, si.DataHash)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return SyncStats{}, err
+	}
+	job.SetTotal(remote.Count + count)
+
+	if len(hashes) > 0 {
+		var have struct {
+			Have [][]byte `json:"have"`
+		}
+		if err := client.postJSON(ctx, "/have", map[string]any{"hashes": hashes}, &have); err != nil {
+			return SyncStats{}, err
+		}
+		for _, h := range have.Have {
+			delete(files, hex.EncodeToString(h))
+		}
+		for key, dataFile := range files {
+			if err := job.Continue(); err != nil {
+				return SyncStats{}, err
+			}
+			f, err := tl.OpenRepoFile(dataFile)
+			if err != nil {
+				return SyncStats{}, fmt.Errorf("opening %s: %w", dataFile, err)
+			}
+			err = client.upload(ctx, key, f)
+			f.Close()
+			if err != nil {
+				return SyncStats{}, fmt.Errorf("uploading %s: %w", dataFile, err)
+			}
+		}
+	}
+
+	job.Message("Sending changes")
+	pr, pw := io.Pipe()
+	go func() {
+		header := syncHeader{Replica: tl.id.String(), Knowledge: knowledge, Policy: policy}
+		err := tl.writeSyncChanges(ctx, pw, header, remote.Knowledge)
+		pw.CloseWithError(err)
+	}()
+	resp, err := client.request(ctx, http.MethodPost, "/apply", nil, pr)
+	_ = pr.Close()
+	if err != nil {
+		return SyncStats{}, err
+	}
+	defer resp.Body.Close()
+
+	var stats SyncStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return stats, err
+	}
+	job.Progress(count)
+	return stats, nil
+}
+
+func (c syncClient) upload(ctx context.Context, hexHash string, file io.Reader) error {
+	resp, err := c.request(ctx, http.MethodPut, "/files", url.Values{"hash": {hexHash}}, file)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// syncStagingFolderName is the folder in the repo where uploads
+// are staged while syncing.
+const syncStagingFolderName = ".sync"
@@ -30,7 +30,6 @@ import (
 	"math"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -53,25 +52,6 @@ func init() {
 	vips.Startup(nil) // Shutdown() is called in a sigtrap for clean shutdowns
 }
 
-/*
-	TODO: A short preview/thumbnail of a video could be made with ffmpeg like this:
-
-	$ ffmpeg -i input.mp4 -vf scale=320:-1 -quality 20 -ss 0 -t 3 ~/Downloads/output.webp
-
-	This is an animated webp image of quite low quality, of the first 3 seconds of the video.
-	Max width 320, scale height to preserve aspect ratio. The quality and size params can be
-	increased but it will go slower. I think '-vcodec libwebp' is implied with the file ext
-	(but then again, specifying -f webp also works if I want to pipe the output)
-
-
-	TODO: To generate a video preview (webm):
-
-	$ ffmpeg -i input.mp4 -vf scale=480:-1 -vcodec libvpx -acodec libvorbis -b:v 1M -ss 0 -t 3 ~/Downloads/output.webm
-
-	Specifying the vcodec and acodec makes it faster. Tune scale and bitrate (-b:v) to
-	satisfaction.
-*/
-
 type thumbnailJob struct {
 	// must make sure there are no duplicate tasks in this slice,
 	// but a slice is important because ordering is important for
@@ -85,6 +65,10 @@ type thumbnailJob struct {
 	// (thumbnails will always be regenerated if the item has
 	// been updated since it was generated, even with this off)
 	RegenerateAll bool `json:"regenerate_all"`
+
+	// if true, also transcode previews of videos that browsers
+	// may not be able to play (see needsVideoPreview)
+	Previews bool `json:"previews,omitempty"`
 }
 
 func (tj thumbnailJob) Run(job *ActiveJob, checkpoint []byte) error {
@@ -284,23 +268,45 @@ func (tj thumbnailJob) iteratePagesOfTasksFromImportJob(job *ActiveJob, precount
 				err := thumbsTx.QueryRowContext(job.ctx,
 					`SELECT generated FROM thumbnails WHERE (data_file=? OR item_data_id=?) LIMIT 1`,
 					task.DataFile, task.DataID).Scan(&thumbGenerated)
-				if errors.Is(err, sql.ErrNoRows) {
-					// no existing thumbnail; carry on
-					continue
-				} else if err != nil {
+				if err != nil && !errors.Is(err, sql.ErrNoRows) {
 					// DB error; probably shouldn't continue
 					thumbsTx.Rollback()
 					job.tl.thumbsMu.RUnlock()
 					return 0, fmt.Errorf("checking for existing thumbnail: %w", err)
 				}
+				hadThumbnail := err == nil
 
 				// if the thumbnail was generated when or after the item was stored, and also after
 				// it was modified (if modified at all), and also after any import job that modified
-				// it completed, then we do not need to generate it, so we can remove it from the
-				// task queue -- this is considered progress anyway
-				if thumbGenerated >= task.itemStored &&
-					(task.itemModified == nil || thumbGenerated >= *task.itemModified) &&
-					(task.modJobEnded == nil || thumbGenerated >= *task.modJobEnded) {
+				// it completed, then we do not need to generate it; the same goes if generating it
+				// failed since then, since it would just fail again
+				current := hadThumbnail && mediaAsset{Status: mediaAssetDone, Updated: thumbGenerated}.currentFor(task)
+				if !current && task.DataFile != "" {
+					failed, err := job.tl.mediaAsset(job.ctx, thumbsTx, mediaThumbnail, task.DataFile)
+					if err != nil {
+						thumbsTx.Rollback()
+						job.tl.thumbsMu.RUnlock()
+						return 0, err
+					}
+					current = failed.Status == mediaAssetFailed && failed.currentFor(task)
+				}
+
+				// even if the thumbnail is current, the video preview might not be
+				if current && tj.Previews && task.DataFile != "" && needsVideoPreview(task.DataType) {
+					preview, err := job.tl.mediaAsset(job.ctx, thumbsTx, mediaVideoPreview, task.DataFile)
+					if err != nil {
+						thumbsTx.Rollback()
+						job.tl.thumbsMu.RUnlock()
+						return 0, err
+					}
+					current = preview.currentFor(task)
+				}
+
+				// if all is current, we can remove it from the task queue -- this is considered progress anyway
+				if current {
+					if !precountMode {
+						ObserveThumbnailCache(true)
+					}
 					pageResults = slices.Delete(pageResults, i, i+1)
 
 					// two possibilities: this could either be a thumbnail we already generated as part of this job,
@@ -318,6 +324,9 @@ func (tj thumbnailJob) iteratePagesOfTasksFromImportJob(job *ActiveJob, precount
 					// at job completion; play demo: https://go.dev/play/p/rH5szSDC2SD
 					// (see how only the last demo visits/prints every element)
 					i--
+				} else if !precountMode {
+					// no existing thumbnail, or the existing one is stale
+					ObserveThumbnailCache(false)
 				}
 			}
 
@@ -345,18 +354,21 @@ func (tj thumbnailJob) iteratePagesOfTasksFromImportJob(job *ActiveJob, precount
 	return taskCount, nil
 }
 
-func (thumbnailJob) processInBatches(job *ActiveJob, tasks []thumbnailTask, startIdx int, checkpoints bool) error {
+func (tj thumbnailJob) processInBatches(job *ActiveJob, tasks []thumbnailTask, startIdx int, checkpoints bool) error {
 	if len(tasks) == 0 {
 		job.Logger().Debug("no thumbnails to generate")
 		return nil
 	}
 
 	// Run each task in a goroutine by batch; this has multiple advantages:
-	// - Goroutines allow parallel computation, finishing the job faster.
+	// - Goroutines allow parallel computation, finishing the job faster. (The actual
+	//   work is done by the timeline's media pipeline, which bounds concurrency across
+	//   all jobs and gives priority to thumbnails the user is waiting on, so these
+	//   goroutines mostly just wait.)
 	// - By waiting at the end of every batch, we know that all goroutines in the batch
 	//   have finished, so we can checkpoint and thus resume correctly from that index,
 	//   without having to worry about some goroutines that haven't finished yet.
-	// - Batching in this way acts as a goroutine throttle, so we don't flood the CPU.
+	// - Batching in this way acts as a goroutine throttle, so we don't flood the pipeline.
 	//
 	// Downside: Videos thumbnails often take much longer to generate than stills, so
 	// it can appear that the whole job has stalled after the still thumbnails are
@@ -417,14 +429,22 @@ func (thumbnailJob) processInBatches(job *ActiveJob, tasks []thumbnailTask, star
 			// show for the user during longer tasks such that it isn't overwritten?
 			job.Message(task.DataFile)
 
-			_, thash, err := task.thumbnailAndThumbhash(job.Context(), task.DataID, task.DataFile)
+			_, thash, err := task.thumbnailAndThumbhash(job.Context(), task.DataID, task.DataFile, mediaPriorityBackground)
 			if err != nil {
-				// don't terminate the job if there's an error
-				// TODO: but we should probably note somewhere in the job's row in the DB that this error happened... maybe?
-				logger.Error("thumbnail/thumbhash generation failed", zap.Error(err))
+				// don't terminate the job if there's an error (the failure is
+				// recorded, so it won't be retried until the item changes)
+				LogThumbnailError(logger, task.DataFile, task.DataType, err)
 			} else {
 				logger.Info("finished thumbnail", zap.Binary("thumb_hash", thash))
 			}
+			logMediaProgress(job, mediaThumbnail)
+
+			if tj.Previews && task.DataFile != "" && needsVideoPreview(task.DataType) {
+				if err := job.tl.generateVideoPreview(job.Context(), task.DataFile, mediaPriorityTranscode); err != nil {
+					logger.Error("transcoding video preview", zap.Error(err))
+				}
+				logMediaProgress(job, mediaVideoPreview)
+			}
 
 			job.Progress(1)
 		}(job, task)
@@ -458,23 +478,48 @@ type thumbnailTask struct {
 }
 
 // thumbnailAndThumbhash returns the thumbnail, even if this returns an error because thumbhash
-// generation fails, the thumbnail is still usable in yhat case.
-func (task thumbnailTask) thumbnailAndThumbhash(ctx context.Context, dataID int64, dataFile string) (Thumbnail, []byte, error) {
+// generation fails, the thumbnail is still usable in yhat case. The work is done in the media
+// pipeline with the given priority. If the thumbnail was being generated by another caller at
+// the same time, the thumbnail is loaded after that finishes, and the thumbhash is nil.
+func (task thumbnailTask) thumbnailAndThumbhash(ctx context.Context, dataID int64, dataFile string, priority mediaPriority) (Thumbnail, []byte, error) {
 	if dataID > 0 && dataFile != "" {
 		// is the content in the DB or a file?? can't be both
 		panic("ambiguous thumbnail task given both dataID and dataFile")
 	}
-	thumb, err := task.generateAndStoreThumbnail(ctx, dataID, dataFile)
+
+	var thumb Thumbnail
+	var thash []byte
+	var thashErr error
+	key := mediaTaskKey{kind: mediaThumbnail, dataFile: dataFile, dataID: dataID, variant: strings.ToLower(task.ThumbType)}
+	err := task.tl.media.do(ctx, key, priority, func(ctx context.Context) error {
+		var err error
+		thumb, err = task.generateAndStoreThumbnail(ctx, dataID, dataFile)
+		if err != nil {
+			err = fmt.Errorf("generating/storing thumbnail: %w", err)
+			if dataFile != "" && ctx.Err() == nil {
+				if storeErr := task.tl.storeMediaAsset(ctx, mediaThumbnail, dataFile, "", "", err); storeErr != nil {
+					Log.Error("recording thumbnail failure", zap.String("data_file", dataFile), zap.Error(storeErr))
+				}
+			}
+			return err
+		}
+		if strings.HasPrefix(thumb.MediaType, "image/") {
+			if thash, err = task.generateAndStoreThumbhash(ctx, dataID, dataFile, thumb.Content); err != nil {
+				thashErr = fmt.Errorf("generating/storing thumbhash: %w", err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return Thumbnail{}, nil, fmt.Errorf("generating/storing thumbnail: %w", err)
+		return Thumbnail{}, nil, err
 	}
-	var thash []byte
-	if strings.HasPrefix(thumb.MediaType, "image/") {
-		if thash, err = task.generateAndStoreThumbhash(ctx, dataID, dataFile, thumb.Content); err != nil {
-			return thumb, thash, fmt.Errorf("generating/storing thumbhash: %w", err)
+	if thumb.Content == nil {
+		// another caller did the work
+		if thumb, err = task.tl.loadThumbnail(ctx, dataID, dataFile, task.ThumbType); err != nil {
+			return Thumbnail{}, nil, fmt.Errorf("loading generated thumbnail: %w", err)
 		}
 	}
-	return thumb, thash, nil
+	return thumb, thash, thashErr
 }
 
 var thumbnailMapMu = newMapMutex()
@@ -506,7 +551,25 @@ func (task thumbnailTask) generateAndStoreThumbnail(ctx context.Context, dataID
 	var inputFilename string
 
 	if dataFile != "" {
-		inputFilename = task.tl.FullPath(dataFile)
+		inputFile := dataFile
+
+		// browsers can't display some formats, and our image library can't always
+		// decode them either, so we convert those first, and thumbnail the copy
+		if needsWebImage(task.DataType) {
+			webImagePath, err := task.tl.webImage(ctx, dataFile)
+			if err != nil {
+				return Thumbnail{}, fmt.Errorf("converting image to web-viewable format: %w (data_file='%s')", err, dataFile)
+			}
+			inputFile = webImagePath
+		}
+
+		var done func()
+		var err error
+		inputFilename, done, err = task.tl.DecryptedPath(inputFile)
+		if err != nil {
+			return Thumbnail{}, fmt.Errorf("decrypting input file: %w (data_file='%s')", err, dataFile)
+		}
+		defer done()
 	} else if dataID > 0 {
 		task.tl.dbMu.RLock()
 		err := task.tl.db.QueryRowContext(ctx,
@@ -571,8 +634,7 @@ func fakeThumbnailFilename(itemDataID int64, dataFile, dataType string) string {
 
 func (task thumbnailTask) generateThumbnail(ctx context.Context, inputFilename string, inputBuf []byte) ([]byte, string, error) {
 	// throttle expensive operation
-	cpuIntensiveThrottle <- struct{}{}
-	defer func() { <-cpuIntensiveThrottle }()
+	defer acquireCPUIntensiveThrottle()()
 
 	// in case task was cancelled while we waited for the throttle
 	if err := ctx.Err(); err != nil {
@@ -724,7 +786,7 @@ func (task thumbnailTask) generateThumbnail(ctx context.Context, inputFilename s
 }
 
 func (task thumbnailTask) generateAndStoreThumbhash(ctx context.Context, dataID int64, dataFile string, thumb []byte) ([]byte, error) {
-	thash, err := task.generateThumbhash(thumb)
+	thash, phash, err := task.generateThumbhash(thumb)
 	if err != nil {
 		return nil, err
 	}
@@ -732,22 +794,31 @@ func (task thumbnailTask) generateAndStoreThumbhash(ctx context.Context, dataID
 	task.tl.dbMu.Lock()
 	defer task.tl.dbMu.Unlock()
 
+	// while we have the decoded image, also store its perceptual hash for finding duplicates
 	if dataID != 0 {
 		_, err = task.tl.db.ExecContext(ctx, `UPDATE items SET thumb_hash=? WHERE data_id=?`, thash, dataID)
+		if err == nil {
+			_, err = task.tl.db.ExecContext(ctx, `INSERT OR REPLACE INTO perceptual_hashes (item_id, hash)
+				SELECT id, ? FROM items WHERE data_id=?`, int64(phash), dataID)
+		}
 	} else {
 		_, err = task.tl.db.ExecContext(ctx, `UPDATE items SET thumb_hash=? WHERE data_file=?`, thash, dataFile)
+		if err == nil {
+			_, err = task.tl.db.ExecContext(ctx, `INSERT OR REPLACE INTO perceptual_hashes (item_id, hash)
+				SELECT id, ? FROM items WHERE data_file=?`, int64(phash), dataFile)
+		}
 	}
 	return thash, err
 }
 
-func (thumbnailTask) generateThumbhash(thumb []byte) ([]byte, error) {
+// generateThumbhash returns the thumbhash and the perceptual hash of the thumbnail.
+func (thumbnailTask) generateThumbhash(thumb []byte) ([]byte, uint64, error) {
 	// throttle expensive operation
-	cpuIntensiveThrottle <- struct{}{}
-	defer func() { <-cpuIntensiveThrottle }()
+	defer acquireCPUIntensiveThrottle()()
 
 	img, format, err := image.Decode(bytes.NewReader(thumb))
 	if err != nil {
-		return nil, fmt.Errorf("decoding thumbnail (format=%s) for thumbhash computation failed: %w", format, err)
+		return nil, 0, fmt.Errorf("decoding thumbnail (format=%s) for thumbhash computation failed: %w", format, err)
 	}
 
 	// thumbhash can recover the _approximate_ aspect ratio, but not
@@ -758,25 +829,40 @@ func (thumbnailTask) generateThumbhash(thumb []byte) ([]byte, error) {
 	// the frontend to split it... hey, it works...
 	aspectRatio := float32(img.Bounds().Dx()) / float32(img.Bounds().Dy())
 
-	return append(float32ToByte(aspectRatio), thumbhash.EncodeImage(img)...), nil
+	return append(float32ToByte(aspectRatio), thumbhash.EncodeImage(img)...), perceptualHash(img), nil
 }
 
 // Thumbnail returns a thumbnail for either the given itemDataID or the dataFile, along with
-// media type. If a thumbnail does not yet exist, one is generated and stored for future use.
+// media type. If a thumbnail does not yet exist, one is generated and stored for future use,
+// ahead of thumbnails for background jobs, since presumably the user is waiting for it. If
+// generating it failed before, it is not tried again (until the item changes).
 func (tl *Timeline) Thumbnail(ctx context.Context, itemDataID int64, dataFile, dataType, thumbType string) (Thumbnail, error) {
 	// first try loading existing thumbnail from DB
 	thumb, err := tl.loadThumbnail(ctx, itemDataID, dataFile, thumbType)
 	if err == nil {
+		ObserveThumbnailCache(true)
 		return thumb, nil // found existing thumbnail!
 	}
 	if errors.Is(err, sql.ErrNoRows) {
+		ObserveThumbnailCache(false)
+		if dataFile != "" {
+			tl.thumbsMu.RLock()
+			ma, err := tl.mediaAsset(ctx, tl.thumbs, mediaThumbnail, dataFile)
+			tl.thumbsMu.RUnlock()
+			if err != nil {
+				return Thumbnail{}, err
+			}
+			if ma.Status == mediaAssetFailed {
+				return Thumbnail{}, fmt.Errorf("%w (data_file='%s')", errThumbnailFailed, dataFile)
+			}
+		}
 		// no existing thumbnail; generate it and return it
 		task := thumbnailTask{
 			tl:        tl,
 			DataType:  dataType,
 			ThumbType: thumbType,
 		}
-		thumb, _, err = task.thumbnailAndThumbhash(ctx, itemDataID, dataFile)
+		thumb, _, err = task.thumbnailAndThumbhash(ctx, itemDataID, dataFile, mediaPriorityVisible)
 		if err != nil {
 			return Thumbnail{}, fmt.Errorf("existing thumbnail not found, so tried generating one, but got error: %w", err)
 		}
@@ -785,6 +871,10 @@ func (tl *Timeline) Thumbnail(ctx context.Context, itemDataID int64, dataFile, d
 	return Thumbnail{}, err
 }
 
+// errThumbnailFailed is returned when a thumbnail is not generated because
+// it failed before.
+var errThumbnailFailed = errors.New("generating thumbnail failed previously")
+
 func (tl *Timeline) loadThumbnail(ctx context.Context, dataID int64, dataFile, thumbType string) (Thumbnail, error) {
 	var mimeType string
 	var modTimeUnix int64
@@ -852,7 +942,12 @@ func (tl *Timeline) AssetImage(_ context.Context, assetPath string, obfuscate bo
 	if obfuscate {
 		size = 120
 	}
-	imageBytes, err := loadAndEncodeImage(tl.FullPath(assetPath), nil, ".jpg", size, obfuscate)
+	inputFilePath, done, err := tl.DecryptedPath(assetPath)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting source file %s: %w", assetPath, err)
+	}
+	defer done()
+	imageBytes, err := loadAndEncodeImage(inputFilePath, nil, ".jpg", size, obfuscate)
 	if err != nil {
 		return nil, fmt.Errorf("opening source file %s: %w", assetPath, err)
 	}
@@ -872,7 +967,21 @@ func (tl *Timeline) GeneratePreviewImage(ctx context.Context, itemRow ItemRow, e
 	var inputFilePath string
 	var inputBuf []byte
 	if itemRow.DataFile != nil {
-		inputFilePath = filepath.Join(tl.repoDir, filepath.FromSlash(*itemRow.DataFile))
+		inputFile := *itemRow.DataFile
+		if itemRow.DataType != nil && needsWebImage(*itemRow.DataType) {
+			webImagePath, err := tl.webImage(ctx, *itemRow.DataFile)
+			if err != nil {
+				return nil, fmt.Errorf("converting image to web-viewable format: %w", err)
+			}
+			inputFile = webImagePath
+		}
+		var done func()
+		var err error
+		inputFilePath, done, err = tl.DecryptedPath(inputFile)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting source file: %w", err)
+		}
+		defer done()
 	} else if itemRow.DataID != nil {
 		tl.dbMu.RLock()
 		err := tl.db.QueryRowContext(ctx,
@@ -40,6 +40,24 @@ CREATE TABLE IF NOT EXISTS "thumbnails" (
 	"content" BLOB NOT NULL-- the actual bytes of the thumbnail/preview
 );
 
+-- the status of media assets generated from data files by the media pipeline: thumbnails
+-- (which are stored in the thumbnails table), video previews that browsers can play, and
+-- web-viewable copies of images in formats like HEIC and RAW (which are stored as files in
+-- the previews folder of the repo); failures are recorded too, so they are not retried on
+-- every restart, only when the item changes or when regenerating is requested
+CREATE TABLE IF NOT EXISTS "media_assets" (
+	"id" INTEGER PRIMARY KEY,
+	"data_file" TEXT NOT NULL COLLATE NOCASE, -- the data file in the repo the asset is generated from (same as items.data_file in the main schema)
+	"kind" TEXT NOT NULL, -- thumbnail, video_preview, or web_image
+	"status" TEXT NOT NULL, -- done or failed
+	"path" TEXT, -- path of the asset file, relative to the repo root (if done and not stored in the DB)
+	"mime_type" TEXT, -- content-type of the asset file
+	"error" TEXT, -- why it failed (if failed)
+	"attempts" INTEGER NOT NULL DEFAULT 1, -- how many times the asset has been generated
+	"updated" INTEGER NOT NULL DEFAULT (unixepoch()), -- when the status was last updated (unix seconds UTC)
+	UNIQUE ("data_file", "kind")
+);
+
 -- ensure this DB remains linked to only one timeline repo
 -- TODO: Ensure this trigger is correct; doing BEFORE INSERT results in errors because it happens before the primary keys is checked (even with OR IGNORE), but is raising AFTER INSERT sufficient to prevent/undo the insert when the table already has a different entry?
 CREATE TRIGGER IF NOT EXISTS only_one_linked_repo
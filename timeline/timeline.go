@@ -35,6 +35,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -67,6 +68,9 @@ type Timeline struct {
 	activeJobs   map[uint64]*ActiveJob
 	activeJobsMu sync.RWMutex
 
+	// signals the schedule loop that schedules were changed
+	schedulesChanged chan struct{}
+
 	// The database handle and its mutex. Why a mutex for a DB handle? Because
 	// high-volume imports can sometimes yield "database is locked" errors,
 	// presumably because of scanning rows (`for rows.Next()`) while trying
@@ -79,8 +83,28 @@ type Timeline struct {
 	dbMu       sync.RWMutex
 	optimizing *int64 // accessed atomically; drops overlapping ANALYZE calls
 
+	// statements that are run for each item during imports, prepared once
+	stmts stmtCache
+
+	// subscribers to changes in the timeline (see Subscribe)
+	events eventBus
+
+	// how many imports have deferred indexing of new items (see deferItemIndexing)
+	deferredIndexing   int
+	deferredIndexingMu sync.Mutex
+
 	thumbs   *sql.DB
 	thumbsMu sync.RWMutex
+
+	// generates thumbnails, video previews, etc. in the background
+	media *mediaPipeline
+
+	// serializes scanning for and applying sync changes
+	syncMu sync.Mutex
+
+	// if set, files are encrypted with this key, and the databases are
+	// encrypted with it when the timeline is closed (see EnableEncryption)
+	encryptionKey atomic.Pointer[[]byte]
 }
 
 func (tl *Timeline) String() string { return fmt.Sprintf("%s:%s", tl.id, tl.repoDir) }
@@ -297,8 +321,16 @@ func AssessFolder(fpath string) FolderAssessment {
 // Open strictly opens an existing timeline at the given repo folder;
 // it does not attempt to create one if it does not already exist.
 // Timelines should always be Close()'d for a clean shutdown when done.
+// If the timeline is encrypted, ErrLocked is returned; use Unlock.
 // TODO: what happens if a timeline folder is (re)moved while it is open?
 func Open(ctx context.Context, repo, cache string) (*Timeline, error) {
+	if IsEncrypted(repo) {
+		return nil, ErrLocked
+	}
+	return openExisting(ctx, repo, cache)
+}
+
+func openExisting(ctx context.Context, repo, cache string) (*Timeline, error) {
 	// construct filenames within this repo folder specifically
 	repoDBFile := filepath.Join(repo, DBFilename)
 	repoDataFolder := filepath.Join(repo, DataFolderName)
@@ -446,7 +478,10 @@ func openTimeline(ctx context.Context, repoDir, cacheDir string, db *sql.DB) (*T
 		entityTypes:     entityTypes,
 		relations:       relations,
 		activeJobs:      make(map[uint64]*ActiveJob),
+
+		schedulesChanged: make(chan struct{}, 1),
 	}
+	tl.media = newMediaPipeline(ctx, defaultMediaWorkers)
 
 	// start maintenance goroutine; this erases items that have been
 	// deleted and have fulfilled their retention period, and optimizes
@@ -466,7 +501,7 @@ func openTimeline(ctx context.Context, repoDir, cacheDir string, db *sql.DB) (*T
 	rows, err := db.QueryContext(ctx,
 		`SELECT id
 		FROM jobs
-		WHERE (state=? OR state=?) AND (hostname=? OR name!=?)
+		WHERE (state=? OR state=?) AND (hostname=? OR type!=?)
 		ORDER BY start, created
 		LIMIT 3`, JobQueued, JobInterrupted, hostname, JobTypeImport)
 	if err != nil {
@@ -492,6 +527,10 @@ func openTimeline(ctx context.Context, repoDir, cacheDir string, db *sql.DB) (*T
 		return nil, fmt.Errorf("iterating rows for resuming jobs: %w", err)
 	}
 
+	// now that the jobs from last time are going, start creating
+	// the jobs of schedules when they are due
+	go tl.scheduleLoop()
+
 	return tl, nil
 }
 
@@ -536,6 +575,13 @@ func (tl *Timeline) Close() error {
 		delete(tl.rateLimiters, key) // TODO: maybe racey?
 	}
 	tl.cancel() // cancel this timeline's context, so anything waiting on it knows we're closing
+	tl.events.close()
+	tl.media.wait()
+	if tl.fileKey() != nil {
+		// canceled jobs may still be writing files and to the database,
+		// which can't be encrypted until they're done
+		tl.waitForActiveJobs()
+	}
 	if tl.thumbs != nil {
 		tl.thumbsMu.Lock()
 		defer tl.thumbsMu.Unlock()
@@ -544,7 +590,13 @@ func (tl *Timeline) Close() error {
 	if tl.db != nil {
 		tl.dbMu.Lock()
 		defer tl.dbMu.Unlock()
-		return tl.db.Close()
+		tl.stmts.close()
+		if err := tl.db.Close(); err != nil {
+			return err
+		}
+	}
+	if tl.fileKey() != nil {
+		return tl.seal()
 	}
 	return nil
 }
@@ -558,7 +610,7 @@ func (tl *Timeline) Empty() bool {
 }
 
 func (tl *Timeline) storeRelationship(ctx context.Context, tx *sql.Tx, rel rawRelationship) error {
-	_, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO relations (label, directed, subordinating) VALUES (?, ?, ?)`,
+	_, err := tl.txExec(ctx, tx, `INSERT OR IGNORE INTO relations (label, directed, subordinating) VALUES (?, ?, ?)`,
 		rel.Label, rel.Directed, rel.Subordinating)
 	if err != nil {
 		return fmt.Errorf("inserting relation: %w (rawRelationship=%s)", err, rel)
@@ -566,7 +618,7 @@ func (tl *Timeline) storeRelationship(ctx context.Context, tx *sql.Tx, rel rawRe
 
 	// we don't use "RETURNING id" because I think that doesn't return anything if the OR IGNORE clause is invoked
 	var relID int64
-	err = tx.QueryRowContext(ctx, `SELECT id FROM relations WHERE label=? LIMIT 1`, rel.Label).Scan(&relID)
+	err = tl.txQueryRow(ctx, tx, `SELECT id FROM relations WHERE label=? LIMIT 1`, rel.Label).Scan(&relID)
 	if err != nil {
 		return fmt.Errorf("loading relation ID: %w (rawRelationship=%s)", err, rel)
 	}
@@ -576,7 +628,7 @@ func (tl *Timeline) storeRelationship(ctx context.Context, tx *sql.Tx, rel rawRe
 	// make it reasonably fast, rather than multiple on the different to/from fields
 	// (I found SELECT 1 to be faster than SELECT count(), but maybe that was just a fluke?)
 	var dupe bool
-	err = tx.QueryRowContext(ctx, `
+	err = tl.txQueryRow(ctx, tx, `
 		SELECT 1
 		FROM relationships
 		WHERE relation_id=?
@@ -596,7 +648,7 @@ func (tl *Timeline) storeRelationship(ctx context.Context, tx *sql.Tx, rel rawRe
 		return nil // already in DB
 	}
 
-	_, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO relationships
+	_, err = tl.txExec(ctx, tx, `INSERT OR IGNORE INTO relationships
 		(relation_id, value,
 			from_item_id, from_attribute_id,
 			to_item_id, to_attribute_id,
@@ -1200,6 +1252,10 @@ func sqlArray(rowIDs []uint64) (string, []any) {
 // file existence, and a table and value within the database.It returns an
 // error only if it is unable to assess whether a valid timeline exists.
 func Valid(ctx context.Context, repo string) (bool, error) {
+	if IsEncrypted(repo) {
+		// the database can't be read without the passphrase
+		return FileExists(filepath.Join(repo, DBFilename)), nil
+	}
 	db, err := openDB(ctx, repo)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
@@ -1290,8 +1346,27 @@ type ProcessingOptions struct {
 	// reduce performance, slowing down imports. Larger batches can be faster, allowing
 	// for more throughput especially when data files are large, but reduces the
 	// granularity of the live progress updates, and the performance benefit gets
-	// smaller as the database gets larger and the items get smaller.
+	// smaller as the database gets larger and the items get smaller. The default
+	// is 10, or 500 for bulk imports.
 	BatchSize int `json:"batch_size,omitempty"`
+
+	// The longest time that items wait in a batch that isn't full before it is
+	// processed anyway, so that items from data sources that arrive slowly (such
+	// as from APIs) don't wait long to be stored. The default is 1 second;
+	// negative values disable it.
+	FlushInterval time.Duration `json:"flush_interval,omitempty"`
+
+	// Optimize for the throughput of large imports (like whole archives of
+	// millions of items), at the expense of live updates: batches are bigger,
+	// and new items are added to the search and location indexes all at once
+	// when the import finishes, instead of as each one is stored (so they can't
+	// be found by text or on the map until then).
+	Bulk bool `json:"bulk,omitempty"`
+
+	// Enrich the imported images when the import finishes, by recognizing
+	// text, tagging what they depict, and clustering the faces in them.
+	// This runs on the local ML server, so it can take a while.
+	Enrich bool `json:"enrich,omitempty"`
 }
 
 type InteractiveImport struct {
@@ -1416,7 +1491,12 @@ func (p *processor) distillUpdatePolicy(pref FieldUpdatePreference, incoming *It
 				if existing.DataText != nil {
 					existingDataLen = len(*existing.DataText)
 				} else if existing.DataFile != nil {
-					info, err := os.Stat(p.tl.FullPath(*existing.DataFile))
+					f, err := p.tl.OpenRepoFile(*existing.DataFile)
+					if err != nil {
+						return 0, err
+					}
+					info, err := f.Stat()
+					f.Close()
 					if err != nil {
 						return 0, err
 					}
@@ -1520,8 +1600,15 @@ const (
 	// (for example, profile pictures).
 	AssetsFolderName = "assets"
 
+	// The folder containing media generated from data files that
+	// browsers can display (for example, video previews).
+	PreviewsFolderName = "previews"
+
 	// An optional file that is placed for informational purposes only.
 	MarkerFilename = "timelinize_repo.txt" // TODO: README.txt?
+
+	// The file that describes the encryption of the timeline, if enabled.
+	EncryptionFilename = "encryption.json"
 )
 
 const timelineMarkerContents = `This folder is a Timelinize repository.
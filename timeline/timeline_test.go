@@ -0,0 +1,62 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package timeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// newTestTimeline returns a timeline with a provisioned database, but
+// none of the background work of an opened one, and the "sms" data source.
+func newTestTimeline(t *testing.T) *Timeline {
+	t.Helper()
+	repoDir := t.TempDir()
+	db, err := openAndProvisionDB(context.Background(), repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := os.MkdirAll(filepath.Join(repoDir, DataFolderName), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	// tests can refer to a data source with row ID 1
+	if _, err := db.Exec(`INSERT INTO data_sources (name, title) VALUES ('sms', 'SMS')`); err != nil {
+		t.Fatal(err)
+	}
+	return &Timeline{
+		ctx:             context.Background(),
+		db:              db,
+		repoDir:         repoDir,
+		id:              uuid.New(),
+		classifications: make(map[string]uint64),
+		entityTypes:     make(map[string]uint64),
+	}
+}
+
+func mustExec(t *testing.T, tl *Timeline, query string, args ...any) {
+	t.Helper()
+	if _, err := tl.db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -44,6 +44,7 @@ import (
 
 	"github.com/timelinize/timelinize/timeline"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type App struct {
@@ -59,6 +60,13 @@ type App struct {
 
 	pyServer *exec.Cmd
 
+	// posts events from the opened timelines to the configured webhooks
+	webhooks *timeline.EventWebhooks
+
+	// commands run without a server open the repositories from last time once
+	cliReposOnce *sync.Once
+	cliReposErr  error
+
 	// references to embedded assets... due to limitations
 	// in the go embed tool, the vars have to be in a parent
 	// directory of what is being embedded, so we pass in
@@ -70,7 +78,32 @@ type App struct {
 }
 
 func New(ctx context.Context, cfg *Config, embeddedWebsite fs.FS) (*App, error) {
+	// the console gets debug logs by default, which can be turned down
+	// without recompiling (and changed at runtime; see SetConsoleLevel)
+	if envVal := os.Getenv("TLZ_CONSOLE_LOG_LEVEL"); envVal != "" {
+		level, err := zapcore.ParseLevel(envVal)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLZ_CONSOLE_LOG_LEVEL: %w", err)
+		}
+		timeline.SetConsoleLevel(level)
+	}
+
 	cfg.fillDefaults()
+	if err := cfg.LogFile.apply(); err != nil {
+		return nil, fmt.Errorf("setting up log file: %w", err)
+	}
+	timeline.LogStartupConfig(cfg)
+	if cfg.DataSourcePlugins != "" {
+		if _, err := timeline.LoadDataSourcePlugins(cfg.DataSourcePlugins); err != nil {
+			cfg.log.Error("loading data source plugins", zap.Error(err))
+		}
+	}
+	timeline.LogSystemLocale()
+
+	webhooks, err := timeline.NewEventWebhooks(cfg.Webhooks)
+	if err != nil {
+		return nil, fmt.Errorf("setting up webhooks: %w", err)
+	}
 
 	var frontend fs.FS
 	if cfg.WebsiteDir == "" {
@@ -97,6 +130,8 @@ func New(ctx context.Context, cfg *Config, embeddedWebsite fs.FS) (*App, error)
 		ctx:             ctx,
 		cfg:             cfg,
 		log:             timeline.Log,
+		webhooks:        webhooks,
+		cliReposOnce:    new(sync.Once),
 		embeddedWebsite: embeddedWebsite,
 	}
 	newApp.server = server{
@@ -111,6 +146,9 @@ func New(ctx context.Context, cfg *Config, embeddedWebsite fs.FS) (*App, error)
 		// close all open timelines (TODO: Maybe they should be open on the app, not global in the timeline package?)
 		shutdownTimelines()
 
+		// post the last events of the timelines
+		newApp.webhooks.Close()
+
 		// stop python server (will wait for it below)
 		if err := newApp.pyServer.Process.Kill(); err != nil {
 			newApp.log.Error("could not terminate ML server", zap.Error(err))
@@ -124,6 +162,18 @@ func New(ctx context.Context, cfg *Config, embeddedWebsite fs.FS) (*App, error)
 			defer shutdownCancel()
 			_ = newApp.server.httpServer.Shutdown(shutdownCtx)
 		}
+		if newApp.server.syncServer != nil {
+			const shutdownTimeout = 10 * time.Second
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer shutdownCancel()
+			_ = newApp.server.syncServer.Shutdown(shutdownCtx)
+		}
+		if newApp.server.shareServer != nil {
+			const shutdownTimeout = 10 * time.Second
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer shutdownCancel()
+			_ = newApp.server.shareServer.Shutdown(shutdownCtx)
+		}
 
 		// finish waiting for python server to exit
 		if state, err := newApp.pyServer.Process.Wait(); err != nil {
@@ -152,56 +202,22 @@ func (a *App) RunCommand(ctx context.Context, args []string) error {
 	}
 
 	// make request body
-	var body io.Reader
+	var body []byte
 	switch endpoint.GetContentType() {
 	case Form:
-		bodyStr := makeForm(args[1:])
-		body = strings.NewReader(bodyStr)
+		body = []byte(makeForm(args[1:]))
 	case JSON:
-		bodyBytes, err := makeJSON(args[1:])
+		var err error
+		body, err = makeJSON(args[1:])
 		if err != nil {
 			return err
 		}
-		if len(bodyBytes) > 0 {
-			body = bytes.NewReader(bodyBytes)
-		}
 	case None:
 	}
 
-	url := "http://" + a.cfg.listenAddr() + apiBasePath + commandName
-
-	req, err := http.NewRequestWithContext(ctx, endpoint.Method, url, body)
+	resp, err := a.doCommand(ctx, commandName, endpoint, body)
 	if err != nil {
-		return fmt.Errorf("building request: %w", err)
-	}
-	req.Header.Set("Content-Type", string(endpoint.GetContentType()))
-	req.Header.Set("Origin", req.URL.Scheme+"://"+req.URL.Host)
-
-	// execute the command; if the server is running in another
-	// process already, send the request to it; otherwise send
-	// a virtual request directly to the HTTP handler function
-	var resp *http.Response
-	if a.serverRunning() {
-		httpClient := &http.Client{Timeout: 1 * time.Minute}
-		resp, err = httpClient.Do(req)
-		if err != nil {
-			return fmt.Errorf("running command on server: %w", err)
-		}
-	} else {
-		if err := a.openRepos(); err != nil {
-			return fmt.Errorf("opening repos from last time: %w", err)
-		}
-		vrw := &virtualResponseWriter{body: new(bytes.Buffer), header: make(http.Header)}
-		err := endpoint.ServeHTTP(vrw, req)
-		if err != nil {
-			return fmt.Errorf("running command: %w", err)
-		}
-		resp = &http.Response{
-			StatusCode:    vrw.status,
-			Header:        vrw.header,
-			Body:          io.NopCloser(vrw.body),
-			ContentLength: int64(vrw.body.Len()),
-		}
+		return err
 	}
 	defer resp.Body.Close()
 
@@ -235,11 +251,99 @@ func (a *App) RunCommand(ctx context.Context, args []string) error {
 	return nil
 }
 
+// Call runs the command (API endpoint) with the payload, which is encoded
+// as JSON, and decodes the JSON response into result, if not nil. Like
+// RunCommand, it sends the request to the server if one is running in
+// another process, or handles it in this process otherwise. Error responses
+// are returned as errors.
+func (a *App) Call(ctx context.Context, command string, payload, result any) error {
+	endpoint, ok := a.commands[command]
+	if !ok {
+		return fmt.Errorf("unrecognized command: %s", command)
+	}
+
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("encoding payload: %w", err)
+		}
+	}
+
+	resp, err := a.doCommand(ctx, command, endpoint, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= lowestErrorStatus {
+		var errResp Error
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.ErrString == "" {
+			return fmt.Errorf("server returned error: HTTP %d %s",
+				resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+		return errors.New(errResp.ErrString)
+	}
+
+	if result == nil || resp.ContentLength == 0 {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// doCommand executes the command; if the server is running in another
+// process already, it sends the request to it; otherwise it sends a
+// virtual request directly to the HTTP handler function, opening the
+// repositories from last time first.
+func (a *App) doCommand(ctx context.Context, commandName string, endpoint Endpoint, body []byte) (*http.Response, error) {
+	var bodyReader io.Reader
+	if len(body) > 0 {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	url := "http://" + a.cfg.listenAddr() + apiBasePath + commandName
+
+	req, err := http.NewRequestWithContext(ctx, endpoint.Method, url, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+	req.Header.Set("Content-Type", string(endpoint.GetContentType()))
+	req.Header.Set("Origin", req.URL.Scheme+"://"+req.URL.Host)
+
+	if a.ServerRunning() {
+		httpClient := &http.Client{Timeout: 1 * time.Minute}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("running command on server: %w", err)
+		}
+		return resp, nil
+	}
+
+	a.cliReposOnce.Do(func() { a.cliReposErr = a.openRepos() })
+	if a.cliReposErr != nil {
+		return nil, fmt.Errorf("opening repos from last time: %w", a.cliReposErr)
+	}
+	vrw := &virtualResponseWriter{body: new(bytes.Buffer), header: make(http.Header)}
+	if err := endpoint.ServeHTTP(vrw, req); err != nil {
+		return nil, fmt.Errorf("running command: %w", err)
+	}
+	return &http.Response{
+		StatusCode:    vrw.status,
+		Header:        vrw.header,
+		Body:          io.NopCloser(vrw.body),
+		ContentLength: int64(vrw.body.Len()),
+	}, nil
+}
+
 // Serve serves the application server only if it is not already running
 // (possibly in another process). It returns true if it started the
 // application server, or false if it was already running.
 func (a *App) Serve() (bool, error) {
-	if a.serverRunning() {
+	if a.ServerRunning() {
 		return false, nil
 	}
 	return true, a.serve()
@@ -249,6 +353,13 @@ func (a *App) MustServe() error {
 	return a.serve()
 }
 
+// MustServeAPI is like MustServe, but the application server serves only
+// the API, not the web UI, as when running on a server without a desktop.
+func (a *App) MustServeAPI() error {
+	a.server.apiOnly = true
+	return a.serve()
+}
+
 func (a *App) startPythonServer(host string, port int) error {
 	// nothing to do if uv isn't installed
 	if _, err := exec.LookPath("uv"); err != nil {
@@ -343,11 +454,13 @@ func (a *App) serve() error {
 	}
 
 	// static file server
-	a.server.staticFiles = http.FileServer(http.FS(a.server.frontend))
-	addRoute("/", Endpoint{
-		Method:  http.MethodGet,
-		Handler: a.server.serveFrontend,
-	})
+	if !a.server.apiOnly {
+		a.server.staticFiles = http.FileServer(http.FS(a.server.frontend))
+		addRoute("/", Endpoint{
+			Method:  http.MethodGet,
+			Handler: a.server.serveFrontend,
+		})
+	}
 
 	// API endpoints
 	for command, endpoint := range a.commands {
@@ -379,8 +492,17 @@ func (a *App) serve() error {
 		Method:  http.MethodGet,
 		Handler: httpWrap(expvar.Handler()),
 	})
+	addRoute("/metrics", Endpoint{
+		Method:  http.MethodGet,
+		Handler: httpWrap(timeline.MetricsHandler()),
+	})
 
-	// TODO: remote server (with TLS mutual auth)
+	if err := a.serveSync(); err != nil {
+		return fmt.Errorf("starting sync server: %w", err)
+	}
+	if err := a.serveShare(); err != nil {
+		return fmt.Errorf("starting share server: %w", err)
+	}
 
 	a.log.Info("started admin server", zap.String("listener", ln.Addr().String()))
 	a.server.httpServer = &http.Server{
@@ -438,7 +560,87 @@ func (a *App) serve() error {
 	}
 }
 
-func (a *App) serverRunning() bool {
+// serveSync starts the server that remote timelines sync with, if enabled.
+// Requests to /sync/<repo_id>/... are handled by the sync handler of the
+// open timeline with that ID, which authenticates them.
+func (a *App) serveSync() error {
+	cfg := a.cfg.Sync
+	if cfg == nil || cfg.Listen == "" {
+		return nil
+	}
+	srv, err := a.serveTimelines("sync", cfg.Listen, cfg.CertFile, cfg.KeyFile, "/sync/",
+		func(otl openedTimeline) http.Handler { return otl.SyncHandler() })
+	a.server.syncServer = srv
+	return err
+}
+
+// serveShare starts the server that share grants give access through, if
+// enabled. Requests to /share/<repo_id>/... are handled by the share
+// handler of the open timeline with that ID, which authenticates them.
+func (a *App) serveShare() error {
+	cfg := a.cfg.Share
+	if cfg == nil || cfg.Listen == "" {
+		return nil
+	}
+	srv, err := a.serveTimelines("share", cfg.Listen, cfg.CertFile, cfg.KeyFile, "/share/",
+		func(otl openedTimeline) http.Handler { return otl.ShareHandler() })
+	a.server.shareServer = srv
+	return err
+}
+
+// serveTimelines starts a server on the listen address that hands requests
+// to <prefix><repo_id>/... to the handler of the open timeline with that
+// ID, with the prefix and ID stripped from the path.
+func (a *App) serveTimelines(name, listen, certFile, keyFile, prefix string, timelineHandler func(openedTimeline) http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s listener: %w", name, err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Timelinize")
+		repoID, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if !strings.HasPrefix(r.URL.Path, prefix) || repoID == "" {
+			http.NotFound(w, r)
+			return
+		}
+		otl, err := getOpenTimeline(repoID)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		http.StripPrefix(prefix+repoID, timelineHandler(otl)).ServeHTTP(w, r)
+	})
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    1024 * 512,
+	}
+
+	go func() {
+		var err error
+		if certFile != "" {
+			err = srv.ServeTLS(ln, certFile, keyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, http.ErrServerClosed) {
+			a.log.Info("stopped "+name+" server", zap.String("listener", ln.Addr().String()))
+		} else if err != nil {
+			a.log.Error(name+" server failed", zap.String("listener", ln.Addr().String()), zap.Error(err))
+		}
+	}()
+
+	a.log.Info("started "+name+" server",
+		zap.String("listener", ln.Addr().String()),
+		zap.Bool("tls", certFile != ""))
+	return srv, nil
+}
+
+// ServerRunning returns true if the application server is running,
+// possibly in another process.
+func (a *App) ServerRunning() bool {
 	// TODO: get URL from config?
 	req, err := http.NewRequestWithContext(a.ctx, http.MethodGet, "http://localhost:12002", nil)
 	if err != nil {
@@ -458,7 +660,11 @@ func (a *App) openRepos() error {
 	// TODO: use race detector to verify ^
 	lastOpenedRepos := a.cfg.Repositories
 	for i, repoDir := range lastOpenedRepos {
-		_, err := a.openRepository(a.ctx, repoDir, false)
+		_, err := a.openRepository(a.ctx, repoDir, false, "")
+		if errors.Is(err, timeline.ErrLocked) {
+			a.log.Info("timeline is encrypted; waiting for passphrase to unlock it", zap.String("dir", repoDir))
+			continue
+		}
 		if err != nil {
 			a.log.Error(fmt.Sprintf("failed to open timeline %d of %d", i+1, len(a.cfg.Repositories)),
 				zap.Error(err),
@@ -72,9 +72,24 @@ func (a App) getOpenRepositories() []openedTimeline {
 	return repos
 }
 
+// getLockedRepositories returns the folders of encrypted timelines
+// that are waiting to be unlocked.
+func (App) getLockedRepositories() []string {
+	openTimelinesMu.RLock()
+	defer openTimelinesMu.RUnlock()
+	locked := make([]string, 0, len(lockedTimelines))
+	for repoDir := range lockedTimelines {
+		locked = append(locked, repoDir)
+	}
+	sort.Strings(locked)
+	return locked
+}
+
 // openRepository opens the timeline at repoDir as long as it
-// is not already open.
-func (a *App) openRepository(ctx context.Context, repoDir string, create bool) (openedTimeline, error) {
+// is not already open. If the timeline is encrypted, it is
+// unlocked with passphrase; if none is given, it is remembered
+// as locked so the UI can prompt for it.
+func (a *App) openRepository(ctx context.Context, repoDir string, create bool, passphrase string) (openedTimeline, error) {
 	absRepo, err := filepath.Abs(repoDir)
 	if err != nil {
 		return openedTimeline{}, fmt.Errorf("forming absolute path to repo at '%s': %w", repoDir, err)
@@ -99,14 +114,21 @@ func (a *App) openRepository(ctx context.Context, repoDir string, create bool) (
 	}
 
 	var tl *timeline.Timeline
-	if create {
+	switch {
+	case create:
 		tl, err = timeline.Create(ctx, absRepo, DefaultCacheDir())
-	} else {
+	case passphrase != "":
+		tl, err = timeline.Unlock(ctx, absRepo, DefaultCacheDir(), passphrase)
+	default:
 		tl, err = timeline.Open(ctx, absRepo, DefaultCacheDir())
 	}
+	if errors.Is(err, timeline.ErrLocked) {
+		lockedTimelines[absRepo] = struct{}{}
+	}
 	if err != nil {
 		return openedTimeline{}, err
 	}
+	delete(lockedTimelines, absRepo)
 	tlID := tl.ID().String()
 
 	// in very few places, the timeline package may emit data directly
@@ -134,8 +156,7 @@ func (a *App) openRepository(ctx context.Context, repoDir string, create bool) (
 
 	// for serving static data files from the timeline
 	fileServerPrefix := "/" + path.Join("repo", tlID)
-	fileRoot := absRepo
-	fileServer := http.FileServer(http.Dir(fileRoot))
+	fileServer := http.FileServer(http.FS(tl.RepoFS()))
 
 	otl := openedTimeline{
 		RepoDir:    absRepo,
@@ -146,6 +167,9 @@ func (a *App) openRepository(ctx context.Context, repoDir string, create bool) (
 
 	openTimelines[tlID] = otl
 
+	// the subscription ends when the timeline is closed
+	tl.Subscribe(a.webhooks.Dispatch)
+
 	// make appropriate log message
 	action := "opened"
 	if create {
@@ -165,6 +189,17 @@ func (a *App) openRepository(ctx context.Context, repoDir string, create bool) (
 	return otl, nil
 }
 
+// EncryptRepository enables encryption of the open timeline. Its files
+// are encrypted right away, and its database when it is closed, after
+// which it has to be unlocked with the passphrase to be opened again.
+func (App) EncryptRepository(repoID, passphrase string) error {
+	tl, err := getOpenTimeline(repoID)
+	if err != nil {
+		return err
+	}
+	return tl.EnableEncryption(passphrase)
+}
+
 func (a *App) CloseRepository(repoID string) error {
 	openTimelinesMu.Lock()
 	defer openTimelinesMu.Unlock()
@@ -660,6 +695,104 @@ func (a App) Import(params ImportParameters) (uint64, error) {
 	return tl.CreateJob(params.Job, scheduled, 0, 0, 0)
 }
 
+// ImportPreview returns the report of the import preview job.
+func (App) ImportPreview(ctx context.Context, repo string, jobID uint64) (timeline.PreviewReport, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return timeline.PreviewReport{}, err
+	}
+	return tl.ImportPreview(ctx, jobID)
+}
+
+func (a App) GraphNeighbors(ctx context.Context, repo string, node timeline.NodeRef, depth int, q timeline.GraphQuery) (timeline.GraphResults, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return timeline.GraphResults{}, err
+	}
+	results, err := tl.Neighbors(ctx, node, depth, q)
+	if err != nil {
+		return results, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		results.Anonymize(options)
+	}
+	return results, nil
+}
+
+func (a App) GraphPath(ctx context.Context, repo string, fromEntityID, toEntityID uint64, maxDepth int, q timeline.GraphQuery) (timeline.GraphResults, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return timeline.GraphResults{}, err
+	}
+	results, err := tl.ShortestPath(ctx, fromEntityID, toEntityID, maxDepth, q)
+	if err != nil {
+		return results, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		results.Anonymize(options)
+	}
+	return results, nil
+}
+
+func (a App) GraphCoOccurrences(ctx context.Context, repo string, entityID uint64, q timeline.GraphQuery) ([]timeline.CoOccurrence, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	results, err := tl.CoOccurrences(ctx, entityID, q)
+	if err != nil {
+		return nil, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		for i := range results {
+			results[i].Anonymize(options)
+		}
+	}
+	return results, nil
+}
+
+type ExportParameters struct {
+	Repo    string                 `json:"repo"`
+	Options timeline.ExportOptions `json:"options"`
+}
+
+func (App) Export(params ExportParameters) (uint64, error) {
+	tl, err := getOpenTimeline(params.Repo)
+	if err != nil {
+		return 0, err
+	}
+	return tl.Export(params.Options)
+}
+
+type SyncParameters struct {
+	Repo   string              `json:"repo"`
+	Remote timeline.SyncRemote `json:"remote"`
+}
+
+func (App) Sync(ctx context.Context, params SyncParameters) (uint64, error) {
+	tl, err := getOpenTimeline(params.Repo)
+	if err != nil {
+		return 0, err
+	}
+	return tl.Sync(ctx, params.Remote)
+}
+
+func (App) SyncPeers(ctx context.Context, repo string) ([]timeline.SyncPeer, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	return tl.SyncPeers(ctx)
+}
+
+func (App) SetSyncToken(ctx context.Context, repo, token string) error {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return err
+	}
+	return tl.SetSyncToken(ctx, token)
+}
+
 func (App) NextGraph(repoID string, jobID uint64) (*timeline.Graph, error) {
 	tl, err := getOpenTimeline(repoID)
 	if err != nil {
@@ -691,6 +824,131 @@ func (a *App) SearchItems(params timeline.ItemSearchParams) (timeline.SearchResu
 	return results, nil
 }
 
+func (a *App) SearchText(ctx context.Context, params timeline.TextSearchParams) (timeline.SearchResults, error) {
+	tl, err := getOpenTimeline(params.Repo)
+	if err != nil {
+		return timeline.SearchResults{}, err
+	}
+	results, err := tl.SearchText(ctx, params)
+	if err != nil {
+		return timeline.SearchResults{}, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		results.Anonymize(options)
+	}
+	return results, nil
+}
+
+func (a *App) Search(ctx context.Context, params timeline.QuerySearchParams) (timeline.SearchResults, error) {
+	tl, err := getOpenTimeline(params.Repo)
+	if err != nil {
+		return timeline.SearchResults{}, err
+	}
+	results, err := tl.SearchQuery(ctx, params)
+	if err != nil {
+		return timeline.SearchResults{}, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		results.Anonymize(options)
+	}
+	return results, nil
+}
+
+func (App) PlanQuery(ctx context.Context, repo, query string) (timeline.QueryPlan, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return timeline.QueryPlan{}, err
+	}
+	return tl.PlanQuery(ctx, query)
+}
+
+func (a *App) ItemsInBoundingBox(ctx context.Context, params timeline.GeoQuery) ([]timeline.GeoPoint, error) {
+	tl, err := getOpenTimeline(params.Repo)
+	if err != nil {
+		return nil, err
+	}
+	points, err := tl.ItemsInBoundingBox(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		for i := range points {
+			points[i].Anonymize(options)
+		}
+	}
+	return points, nil
+}
+
+func (a *App) ItemsNearPoint(ctx context.Context, params timeline.GeoQuery) ([]timeline.GeoPoint, error) {
+	tl, err := getOpenTimeline(params.Repo)
+	if err != nil {
+		return nil, err
+	}
+	points, err := tl.ItemsNearPoint(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		for i := range points {
+			points[i].Anonymize(options)
+		}
+	}
+	return points, nil
+}
+
+func (a *App) ClusterPoints(ctx context.Context, params timeline.GeoQuery) ([]timeline.GeoCluster, error) {
+	tl, err := getOpenTimeline(params.Repo)
+	if err != nil {
+		return nil, err
+	}
+	clusters, err := tl.ClusterPoints(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		for i := range clusters {
+			clusters[i].Anonymize(options)
+		}
+	}
+	return clusters, nil
+}
+
+func (a *App) SimplifiedPaths(ctx context.Context, params timeline.GeoQuery) ([]timeline.GeoPath, error) {
+	tl, err := getOpenTimeline(params.Repo)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := tl.SimplifiedPaths(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		for i := range paths {
+			paths[i].Anonymize(options)
+		}
+	}
+	return paths, nil
+}
+
+func (a *App) FindDuplicates(ctx context.Context, params timeline.DuplicateSearchParams) ([]timeline.DuplicateCluster, error) {
+	tl, err := getOpenTimeline(params.Repo)
+	if err != nil {
+		return nil, err
+	}
+	clusters, err := tl.FindDuplicates(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		for i := range clusters {
+			for _, sr := range clusters[i].Items {
+				sr.Anonymize(options)
+			}
+		}
+	}
+	return clusters, nil
+}
+
 // TODO: all of these methods should be cancelable by the browser... somehow
 
 func (a *App) SearchEntities(params timeline.EntitySearchParams) ([]timeline.Entity, error) {
@@ -875,6 +1133,81 @@ func (a App) MergeEntities(repo string, base uint64, others []uint64) error {
 	return tl.MergeEntities(a.ctx, base, others)
 }
 
+func (App) UnmergeEntities(ctx context.Context, repo string, mergeID uint64) (uint64, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return 0, err
+	}
+	return tl.UnmergeEntities(ctx, mergeID)
+}
+
+func (a App) EntityMerges(ctx context.Context, repo string, entityID uint64) ([]timeline.EntityMerge, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	merges, err := tl.EntityMerges(ctx, entityID)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := a.ObfuscationMode(tl.Timeline); ok {
+		for i := range merges {
+			merges[i].Anonymize()
+		}
+	}
+	return merges, nil
+}
+
+func (a App) SuggestedMerges(ctx context.Context, repo string) ([]timeline.MergeSuggestion, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	suggestions, err := tl.SuggestedMerges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := a.ObfuscationMode(tl.Timeline); ok {
+		for i := range suggestions {
+			suggestions[i].Anonymize()
+		}
+	}
+	return suggestions, nil
+}
+
+func (App) DismissSuggestedMerge(ctx context.Context, repo string, entityID, otherEntityID uint64) error {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return err
+	}
+	return tl.DismissSuggestedMerge(ctx, entityID, otherEntityID)
+}
+
+func (App) MergeItems(ctx context.Context, repo string, keep uint64, merge []uint64) error {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return err
+	}
+	return tl.MergeItems(ctx, keep, merge)
+}
+
+func (a App) ItemSources(ctx context.Context, repo string, itemID uint64) ([]timeline.ItemSource, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := tl.ItemSources(ctx, itemID)
+	if err != nil {
+		return nil, err
+	}
+	if options, ok := a.ObfuscationMode(tl.Timeline); ok {
+		for i := range sources {
+			sources[i].Anonymize(options)
+		}
+	}
+	return sources, nil
+}
+
 func (a App) DeleteItems(repo string, itemRowIDs []uint64, options timeline.DeleteOptions) error {
 	tl, err := getOpenTimeline(repo)
 	if err != nil {
@@ -918,6 +1251,14 @@ func (a App) UnpauseJob(ctx context.Context, repo string, jobID uint64) error {
 	return tl.UnpauseJob(ctx, jobID)
 }
 
+func (a App) ResumeJob(ctx context.Context, repo string, jobID uint64) error {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return err
+	}
+	return tl.ResumeJob(ctx, jobID)
+}
+
 func (a App) StartJob(ctx context.Context, repo string, jobID uint64, startOver bool) error {
 	tl, err := getOpenTimeline(repo)
 	if err != nil {
@@ -943,3 +1284,160 @@ func (a App) ObfuscationMode(repo *timeline.Timeline) (timeline.ObfuscationOptio
 	defer a.cfg.RUnlock()
 	return a.cfg.Obfuscation, a.cfg.Obfuscation.AppliesTo(repo)
 }
+
+func (App) Policies(ctx context.Context, repo string) ([]timeline.Policy, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	return tl.Policies(ctx)
+}
+
+func (App) AddPolicy(ctx context.Context, repo string, policy timeline.Policy) (uint64, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return 0, err
+	}
+	return tl.AddPolicy(ctx, policy)
+}
+
+func (App) DeletePolicy(ctx context.Context, repo string, policyID uint64) error {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return err
+	}
+	return tl.DeletePolicy(ctx, policyID)
+}
+
+func (App) PolicyDryRun(ctx context.Context, repo string, policy timeline.Policy) (timeline.PolicyReport, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return timeline.PolicyReport{}, err
+	}
+	return tl.PolicyDryRun(ctx, policy)
+}
+
+// EnforcePolicies starts a job that enforces the policies, or, if schedule
+// is set, schedules jobs to do so; it returns the ID of the job or schedule.
+func (App) EnforcePolicies(ctx context.Context, repo string, policyIDs []uint64, schedule *timeline.ScheduleSpec) (uint64, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return 0, err
+	}
+	if schedule != nil {
+		return tl.SchedulePolicies(ctx, policyIDs, *schedule)
+	}
+	return tl.EnforcePolicies(policyIDs, false)
+}
+
+func (App) AddBackupTarget(ctx context.Context, repo string, target timeline.BackupTarget) (uint64, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return 0, err
+	}
+	return tl.AddBackupTarget(ctx, target)
+}
+
+func (App) BackupTargets(ctx context.Context, repo string) ([]timeline.BackupTarget, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	return tl.BackupTargets(ctx)
+}
+
+func (App) DeleteBackupTarget(ctx context.Context, repo string, targetID uint64) error {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return err
+	}
+	return tl.DeleteBackupTarget(ctx, targetID)
+}
+
+func (App) BackupSnapshots(ctx context.Context, repo string, targetID uint64) ([]timeline.BackupSnapshot, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	return tl.BackupSnapshots(ctx, targetID)
+}
+
+// Backup starts a job that snapshots the timeline to the target, or, if
+// schedule is set, creates a schedule that does; it returns the job or
+// schedule ID.
+func (App) Backup(ctx context.Context, repo string, targetID uint64, schedule *timeline.ScheduleSpec) (uint64, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return 0, err
+	}
+	if schedule != nil {
+		return tl.ScheduleBackup(ctx, targetID, *schedule)
+	}
+	return tl.Backup(ctx, targetID)
+}
+
+func (App) Restore(ctx context.Context, repo, snapshotID string) (uint64, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return 0, err
+	}
+	return tl.Restore(ctx, snapshotID)
+}
+
+func (App) Enrich(repo string, itemIDs []uint64, tasks []timeline.EnrichmentTask) (uint64, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return 0, err
+	}
+	return tl.Enrich(itemIDs, tasks)
+}
+
+func (App) ItemEnrichment(ctx context.Context, repo string, itemID uint64) (timeline.Enrichment, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return timeline.Enrichment{}, err
+	}
+	return tl.ItemEnrichment(ctx, itemID)
+}
+
+func (App) FaceClusters(ctx context.Context, repo string) ([]timeline.FaceCluster, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	return tl.FaceClusters(ctx)
+}
+
+func (App) LinkFaceCluster(ctx context.Context, repo string, clusterID, entityID uint64) error {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return err
+	}
+	return tl.LinkFaceCluster(ctx, clusterID, entityID)
+}
+
+func (App) ShareGrants(ctx context.Context, repo string) ([]timeline.ShareGrant, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return nil, err
+	}
+	return tl.ShareGrants(ctx)
+}
+
+// CreateShareGrant returns the new grant and its token, which is only
+// available now.
+func (App) CreateShareGrant(ctx context.Context, repo, name string, scope timeline.ShareScope, expires *time.Time) (timeline.ShareGrant, string, error) {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return timeline.ShareGrant{}, "", err
+	}
+	return tl.CreateShareGrant(ctx, name, scope, expires)
+}
+
+func (App) RevokeShareGrant(ctx context.Context, repo string, grantID uint64) error {
+	tl, err := getOpenTimeline(repo)
+	if err != nil {
+		return err
+	}
+	return tl.RevokeShareGrant(ctx, grantID)
+}
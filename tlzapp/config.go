@@ -51,7 +51,7 @@ type Config struct {
 	// The API token to use for Mapbox GL JS and tiles. The
 	// user should set this to their own to guarantee
 	// availability of the maps.
-	MapboxAPIKey string `json:"mapbox_api_key,omitempty"`
+	MapboxAPIKey string `json:"mapbox_api_key,omitempty" sensitive:"true"`
 
 	// The folder paths of timeline repositories to open at
 	// program start.
@@ -61,9 +61,89 @@ type Config struct {
 	// software to mask personal data and details.
 	Obfuscation timeline.ObfuscationOptions `json:"obfuscation,omitempty"`
 
+	// Writes the logs to a file as JSON lines, which is useful
+	// for headless deployments that have no UI to show them.
+	// The file is also the log store that the logs-query
+	// endpoint reads from, so it must be set to query logs
+	// from before a restart; it is disabled by default.
+	LogFile *LogFileConfig `json:"log_file,omitempty"`
+
+	// The folder of data source plugin manifests to load at
+	// program start (see timeline.LoadDataSourcePlugins).
+	DataSourcePlugins string `json:"data_source_plugins,omitempty"`
+
+	// Serves the opened timelines to remote timelines that
+	// sync with them (see timeline.Timeline.Sync).
+	Sync *SyncServerConfig `json:"sync,omitempty"`
+
+	// Serves the parts of the opened timelines that were shared
+	// with others to them (see timeline.Timeline.ShareHandler).
+	Share *ShareServerConfig `json:"share,omitempty"`
+
+	// Endpoints to post events of the opened timelines to, like
+	// finished imports and new items (see timeline.Event).
+	Webhooks []timeline.EventWebhook `json:"webhooks,omitempty"`
+
 	log *zap.Logger
 }
 
+// SyncServerConfig configures the server that remote timelines
+// sync with. Each open timeline is served at /sync/<repo_id>.
+type SyncServerConfig struct {
+	// The listen address to bind the socket to. If empty,
+	// there is no sync server.
+	Listen string `json:"listen,omitempty"`
+
+	// The certificate and key to serve TLS with. Without
+	// them, sync tokens (and data) are sent in the clear,
+	// so this should only be omitted on trusted networks.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// ShareServerConfig configures the server that share grants give
+// access through. Each open timeline is served at /share/<repo_id>.
+type ShareServerConfig struct {
+	// The listen address to bind the socket to. If empty,
+	// there is no share server.
+	Listen string `json:"listen,omitempty"`
+
+	// The certificate and key to serve TLS with. Without
+	// them, share tokens (and data) are sent in the clear.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// LogFileConfig configures the log file.
+type LogFileConfig struct {
+	// The path of the log file. If empty, there is no log file.
+	Path string `json:"path,omitempty"`
+
+	// The size, in bytes, at which the log file is rotated.
+	// If 0, it is not rotated.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// How many rotated log files to keep, and how many days
+	// to keep them. If 0, they are kept regardless.
+	MaxBackups int `json:"max_backups,omitempty"`
+	MaxAgeDays int `json:"max_age_days,omitempty"`
+}
+
+// apply sets up the log file as configured.
+func (lfc *LogFileConfig) apply() error {
+	if lfc == nil || lfc.Path == "" {
+		return nil
+	}
+	var opts []timeline.LogFileOption
+	if lfc.MaxSize > 0 {
+		opts = append(opts, timeline.WithLogFileSizeRotation(lfc.MaxSize))
+	}
+	if lfc.MaxBackups > 0 || lfc.MaxAgeDays > 0 {
+		opts = append(opts, timeline.WithLogFileRetention(lfc.MaxBackups, time.Duration(lfc.MaxAgeDays)*24*time.Hour))
+	}
+	return timeline.SetLogFile(lfc.Path, opts...)
+}
+
 func (cfg *Config) listenAddr() string {
 	cfg.RLock()
 	defer cfg.RUnlock()
@@ -120,12 +200,14 @@ func (cfg *Config) unsyncedSave() error {
 func (cfg *Config) syncOpenRepos() error {
 	// assemble the list of open timelines into a sorted slice
 	// so we can update the stored config and reopen these
-	// timelines automatically at next start
-	open := make([]string, len(openTimelines))
-	i := 0
+	// timelines automatically at next start (locked timelines
+	// are included, so they can still be unlocked then)
+	open := make([]string, 0, len(openTimelines)+len(lockedTimelines))
 	for _, otl := range openTimelines {
-		open[i] = otl.RepoDir
-		i++
+		open = append(open, otl.RepoDir)
+	}
+	for repoDir := range lockedTimelines {
+		open = append(open, repoDir)
 	}
 	sort.StringSlice(open).Sort()
 
@@ -34,12 +34,42 @@ func (a *App) registerCommands() {
 	// TODO: register flags with flag package... and command help... these will probably need to know the payload structure...
 	// TODO: make endpoint URIs consistent with App methods and frontend function names
 	a.commands = map[string]Endpoint{
+		"add-backup-target": {
+			Handler: a.server.handleAddBackupTarget,
+			Method:  http.MethodPost,
+			Payload: backupTargetPayload{},
+			Help:    "Adds a folder or S3-compatible bucket to back up the timeline to; snapshots of the timeline already there are added to the catalog.",
+		},
+		"add-policy": {
+			Handler: a.server.handleAddPolicy,
+			Method:  http.MethodPost,
+			Payload: policyPayload{},
+			Help:    "Adds a policy for deleting or redacting items; it is not enforced until requested.",
+		},
 		"add-entity": {
 			Handler: a.server.handleAddEntity,
 			Method:  http.MethodPost,
 			Payload: addEntityPayload{},
 			Help:    "Creates a new entity.",
 		},
+		"backup": {
+			Handler: a.server.handleBackup,
+			Method:  http.MethodPost,
+			Payload: backupPayload{},
+			Help:    "Starts a job that snapshots the timeline to a backup target, or schedules such jobs if a schedule is given.",
+		},
+		"backup-snapshots": {
+			Handler: a.server.handleBackupSnapshots,
+			Method:  http.MethodPost,
+			Payload: backupSnapshotsPayload{},
+			Help:    "Returns the catalog of snapshots of the timeline, newest first, optionally only those in one backup target.",
+		},
+		"backup-targets": {
+			Handler: a.server.handleBackupTargets,
+			Method:  http.MethodPost,
+			Payload: "",
+			Help:    "Returns the backup targets of the given timeline, without their secrets.",
+		},
 		"build-info": {
 			Handler: a.server.handleBuildInfo,
 			Method:  http.MethodGet,
@@ -69,17 +99,77 @@ func (a *App) registerCommands() {
 			Payload: timeline.ItemSearchParams{},
 			Help:    "Loads a conversation.",
 		},
+		"create-share-grant": {
+			Handler: a.server.handleCreateShareGrant,
+			Method:  http.MethodPost,
+			Payload: createShareGrantPayload{},
+			Help:    "Grants read-only access to part of a timeline, and returns the token to share; the token cannot be retrieved later.",
+		},
 		"data-sources": {
 			Handler: a.server.handleGetDataSources,
 			Method:  http.MethodGet,
 			Help:    "Returns the supported data sources.",
 		},
+		"delete-backup-target": {
+			Handler: a.server.handleDeleteBackupTarget,
+			Method:  http.MethodPost,
+			Payload: backupSnapshotsPayload{},
+			Help:    "Deletes a backup target and removes its snapshots from the catalog. The backups in the target are not deleted.",
+		},
 		"delete-items": {
 			Handler: a.server.handleDeleteItems,
 			Method:  http.MethodDelete,
 			Payload: deleteItemsPayload{},
 			Help:    "Deletes items from a timeline.",
 		},
+		"delete-policy": {
+			Handler: a.server.handleDeletePolicy,
+			Method:  http.MethodDelete,
+			Payload: deletePolicyPayload{},
+			Help:    "Deletes a policy. Items it already deleted or redacted stay that way.",
+		},
+		"dismiss-merge-suggestion": {
+			Handler: a.server.handleDismissMergeSuggestion,
+			Method:  http.MethodPost,
+			Payload: dismissMergeSuggestionPayload{},
+			Help:    "Indicates that two entities are not the same, so merging them won't be suggested again.",
+		},
+		"encrypt-repository": {
+			Handler: a.server.handleEncryptRepo,
+			Method:  http.MethodPost,
+			Payload: encryptRepoPayload{},
+			Help:    "Enables encryption of a timeline with a passphrase; it is encrypted when closed.",
+		},
+		"enrich": {
+			Handler: a.server.handleEnrich,
+			Method:  http.MethodPost,
+			Payload: enrichPayload{},
+			Help:    "Starts a job that recognizes text, tags what is depicted, and clusters faces in images, using only the local ML server.",
+		},
+		"enforce-policies": {
+			Handler: a.server.handleEnforcePolicies,
+			Method:  http.MethodPost,
+			Payload: enforcePoliciesPayload{},
+			Help:    "Starts a job that enforces policies, or schedules such jobs if a schedule is given.",
+		},
+		"entity-merges": {
+			Handler: a.server.handleEntityMerges,
+			Method:  http.MethodPost,
+			Payload: entityMergesPayload{},
+			Help:    "Returns the history of merges into or of an entity.",
+		},
+		"export": {
+			Handler: a.server.handleExport,
+			Method:  http.MethodPost,
+			Payload: ExportParameters{},
+			Help:    "Starts a job that exports the timeline to a portable archive.",
+		},
+		"face-clusters": {
+			Handler: a.server.handleFaceClusters,
+			Method:  http.MethodPost,
+			Payload: "",
+			Help:    "Returns the clusters of similar faces in the given timeline, biggest first.",
+		},
 		"file-stat": {
 			Handler: a.server.handleFileStat,
 			Method:  http.MethodPost,
@@ -97,6 +187,54 @@ func (a *App) registerCommands() {
 			Method:  http.MethodGet,
 			Help:    "Returns a list of root paths for a file picker.",
 		},
+		"find-duplicates": {
+			Handler: a.server.handleFindDuplicates,
+			Method:  http.MethodPost,
+			Payload: timeline.DuplicateSearchParams{},
+			Help:    "Returns clusters of items that are likely duplicates of each other.",
+		},
+		"geo-bbox": {
+			Handler: a.server.handleGeoBoundingBox,
+			Method:  http.MethodPost,
+			Payload: timeline.GeoQuery{},
+			Help:    "Returns the locations of items within a bounding box.",
+		},
+		"geo-clusters": {
+			Handler: a.server.handleGeoClusters,
+			Method:  http.MethodPost,
+			Payload: timeline.GeoQuery{},
+			Help:    "Returns clusters of the locations of items for a map zoom level.",
+		},
+		"geo-nearby": {
+			Handler: a.server.handleGeoNearby,
+			Method:  http.MethodPost,
+			Payload: timeline.GeoQuery{},
+			Help:    "Returns the locations of items within a radius of a point, nearest first.",
+		},
+		"geo-paths": {
+			Handler: a.server.handleGeoPaths,
+			Method:  http.MethodPost,
+			Payload: timeline.GeoQuery{},
+			Help:    "Returns the paths traveled in an area, simplified for a map zoom level.",
+		},
+		"graph-cooccurrences": {
+			Handler: a.server.handleGraphCoOccurrences,
+			Method:  http.MethodPost,
+			Payload: graphCoOccurrencesPayload{},
+			Help:    "Returns the entities that appear in the same items as an entity, most frequent first.",
+		},
+		"graph-neighbors": {
+			Handler: a.server.handleGraphNeighbors,
+			Method:  http.MethodPost,
+			Payload: graphNeighborsPayload{},
+			Help:    "Returns the entities and items connected to an entity or item, up to a depth.",
+		},
+		"graph-path": {
+			Handler: a.server.handleGraphPath,
+			Method:  http.MethodPost,
+			Payload: graphPathPayload{},
+			Help:    "Returns the shortest path of relationships between two entities.",
+		},
 		"get-entity": {
 			Handler: a.server.handleGetEntity,
 			Method:  http.MethodPost,
@@ -109,12 +247,30 @@ func (a *App) registerCommands() {
 			Payload: ImportParameters{},
 			Help:    "Starts an import job.",
 		},
+		"import-preview": {
+			Handler: a.server.handleImportPreview,
+			Method:  http.MethodPost,
+			Payload: jobPayload{},
+			Help:    "Returns the report of an import preview job that is done.",
+		},
 		"item-classifications": {
 			Handler: a.server.handleItemClassifications,
 			Method:  http.MethodPost,
 			Payload: "",
 			Help:    "Returns the item classifications for the given timeline.",
 		},
+		"item-enrichment": {
+			Handler: a.server.handleItemEnrichment,
+			Method:  http.MethodPost,
+			Payload: itemEnrichmentPayload{},
+			Help:    "Returns the text, tags, and faces that enrichment found in an item.",
+		},
+		"item-sources": {
+			Handler: a.server.handleItemSources,
+			Method:  http.MethodPost,
+			Payload: itemSourcesPayload{},
+			Help:    "Returns where the items that were merged into an item came from.",
+		},
 		"jobs": {
 			Handler:     a.server.handleJobs,
 			Method:      methodQuery,
@@ -122,17 +278,50 @@ func (a *App) registerCommands() {
 			ContentType: JSON,
 			Help:        "Gets current information about jobs.",
 		},
+		"link-face-cluster": {
+			Handler: a.server.handleLinkFaceCluster,
+			Method:  http.MethodPost,
+			Payload: linkFaceClusterPayload{},
+			Help:    "Links a cluster of faces to an entity, relating the items with those faces to it; entity ID 0 unlinks it.",
+		},
+		"locked-repositories": {
+			Handler: a.server.handleLockedRepos,
+			Method:  http.MethodGet,
+			Help:    "Returns the folders of encrypted timelines that are waiting for a passphrase to be unlocked.",
+		},
 		"logs": {
 			Handler: a.server.handleLogs,
 			Method:  http.MethodGet,
 			Help:    "Initiates a WebSocket connection to send logs.",
 		},
+		"logs-query": {
+			Handler: a.server.handleLogsQuery,
+			Method:  http.MethodPost,
+			Payload: timeline.LogQuery{},
+			Help:    "Returns entries from the log file, which persists across restarts. Requires log_file to be set in the config.",
+		},
+		"logs-sse": {
+			Handler: a.server.handleLogsSSE,
+			Method:  http.MethodGet,
+			Help:    "Streams logs as Server-Sent Events, for clients that can't use WebSockets.",
+		},
 		"merge-entities": {
 			Handler: a.server.handleMergeEntities,
 			Method:  http.MethodPost,
 			Payload: mergeEntitiesPayload{},
 			Help:    "Merge two entities together.",
 		},
+		"merge-items": {
+			Handler: a.server.handleMergeItems,
+			Method:  http.MethodPost,
+			Payload: mergeItemsPayload{},
+			Help:    "Merge duplicate items into one, preserving where each came from.",
+		},
+		"metrics": {
+			Handler: a.server.handleMetrics,
+			Method:  http.MethodGet,
+			Help:    "Returns the current values of metrics about jobs, imports, the database, and media processing.",
+		},
 		"next-graph": {
 			Handler: a.server.handleNextGraph,
 			Method:  http.MethodGet,
@@ -147,7 +336,7 @@ func (a *App) registerCommands() {
 			Handler: a.server.handleOpenRepo,
 			Method:  http.MethodPost,
 			Payload: openRepoPayload{},
-			Help:    "Open a timeline repository.",
+			Help:    "Open a timeline repository; encrypted timelines are unlocked with the passphrase.",
 		},
 		"pause-job": {
 			Handler: a.server.handlePauseJob,
@@ -161,6 +350,18 @@ func (a *App) registerCommands() {
 			Payload: PlannerOptions{},
 			Help:    "Proposes an import plan in preparation for performing a data import.",
 		},
+		"policies": {
+			Handler: a.server.handlePolicies,
+			Method:  http.MethodPost,
+			Payload: "",
+			Help:    "Returns the deletion and redaction policies of the given timeline.",
+		},
+		"policy-dry-run": {
+			Handler: a.server.handlePolicyDryRun,
+			Method:  http.MethodPost,
+			Payload: policyPayload{},
+			Help:    "Reports how many items a policy would delete or redact, without changing anything.",
+		},
 		"recent-conversations": {
 			Handler: a.server.handleRecentConversations,
 			Method:  http.MethodPost,
@@ -173,17 +374,53 @@ func (a *App) registerCommands() {
 			Payload: "",
 			Help:    "Returns whether the repository is empty or not.",
 		},
+		"restore": {
+			Handler: a.server.handleRestore,
+			Method:  http.MethodPost,
+			Payload: restorePayload{},
+			Help:    "Starts a job that rolls the timeline back to a snapshot: its database, data files, and assets. No other jobs may be running.",
+		},
+		"resume-job": {
+			Handler: a.server.handleResumeJob,
+			Method:  http.MethodPost,
+			Payload: jobPayload{},
+			Help:    "Resumes an interrupted, paused, aborted, or failed job from its last checkpoint.",
+		},
+		"suggested-merges": {
+			Handler: a.server.handleSuggestedMerges,
+			Method:  http.MethodPost,
+			Payload: "",
+			Help:    "Returns pairs of entities in the given timeline that are likely the same and could be merged.",
+		},
+		"revoke-share-grant": {
+			Handler: a.server.handleRevokeShareGrant,
+			Method:  http.MethodPost,
+			Payload: revokeShareGrantPayload{},
+			Help:    "Revokes a share grant, so its token stops working.",
+		},
 		"settings": {
 			Handler: a.server.handleSettings,
 			Method:  http.MethodGet,
 			Help:    "Returns settings for the application and opened timelines.",
 		},
+		"share-grants": {
+			Handler: a.server.handleShareGrants,
+			Method:  http.MethodPost,
+			Payload: "",
+			Help:    "Returns the share grants of the given timeline, including revoked and expired ones.",
+		},
 		"submit-graph": {
 			Handler: a.server.handleSubmitGraph,
 			Method:  http.MethodPost,
 			Payload: submitGraphPayload{},
 			Help:    "Submits a graph for processing during an interactive import.",
 		},
+		"search": {
+			Handler: a.server.handleSearch,
+			Method:  http.MethodPost,
+			Payload: searchPayload{},
+			Help:    "Finds the items in a timeline that match a query, like \"photos with Mom in Spain during summer 2019\" or \"class:media with:Mom in:Spain\"; with explain, returns how the query would be carried out instead.",
+		},
 		"search-entities": {
 			Handler: a.server.handleSearchEntities,
 			Method:  http.MethodPost,
@@ -196,17 +433,47 @@ func (a *App) registerCommands() {
 			Payload: timeline.ItemSearchParams{},
 			Help:    "Finds and filters items in a timeline.",
 		},
+		"search-text": {
+			Handler: a.server.handleSearchText,
+			Method:  http.MethodPost,
+			Payload: timeline.TextSearchParams{},
+			Help:    "Finds the items in a timeline that contain the given words, ordered by relevance.",
+		},
 		"start-job": {
 			Handler: a.server.handleStartJob,
 			Method:  http.MethodPost,
 			Payload: jobPayload{},
 			Help:    "Starts a job.",
 		},
+		"sync": {
+			Handler: a.server.handleSync,
+			Method:  http.MethodPost,
+			Payload: SyncParameters{},
+			Help:    "Starts a job that syncs the timeline with a remote timeline.",
+		},
+		"sync-peers": {
+			Handler: a.server.handleSyncPeers,
+			Method:  http.MethodPost,
+			Payload: "",
+			Help:    "Returns the remote timelines that the given timeline syncs with.",
+		},
+		"sync-token": {
+			Handler: a.server.handleSyncToken,
+			Method:  http.MethodPost,
+			Payload: syncTokenPayload{},
+			Help:    "Sets the token that remote timelines must present to sync with the timeline; an empty token disables syncing.",
+		},
 		"charts": {
 			Handler: a.server.handleCharts,
 			Method:  http.MethodGet,
 			Help:    "Returns statistics about the timeline for use in charts.",
 		},
+		"unmerge-entities": {
+			Handler: a.server.handleUnmergeEntities,
+			Method:  http.MethodPost,
+			Payload: unmergeEntitiesPayload{},
+			Help:    "Undoes the merge of an entity into another, restoring the merged entity.",
+		},
 		"unpause-job": {
 			Handler: a.server.handleUnpauseJob,
 			Method:  http.MethodPost,
@@ -113,7 +113,7 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 	)
 
 	// log the error
-	timeline.Log.Named("http").Error(errVal.Log,
+	ReqLogger(r).Error(errVal.Log,
 		zap.Error(errVal.Err),
 		zap.Int("status", errVal.HTTPStatus),
 		zap.String("method", r.Method),
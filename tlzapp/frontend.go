@@ -172,8 +172,28 @@ func (s server) handleRepoResource(w http.ResponseWriter, r *http.Request) error
 	case "transcode":
 		// stream video data file in a format that can be played by the browser
 		dataFile := strings.Join(parts[4:], "/")
-		inputPath := tl.FullPath(dataFile)
 		_, obfuscate := s.app.ObfuscationMode(tl.Timeline)
+		if r.URL.Query().Get("format") == "mp4" {
+			// only the preview that was transcoded in the background (if any);
+			// unlike live transcodes, it can be seeked, since it's a file
+			previewPath, ok := tl.VideoPreview(r.Context(), dataFile)
+			if !ok || obfuscate {
+				return Error{
+					Err:        fmt.Errorf("no video preview for data file: %s", dataFile),
+					HTTPStatus: http.StatusNotFound,
+					Log:        "loading video preview",
+					Message:    "No preview of this video is available.",
+				}
+			}
+			w.Header().Set("Content-Type", "video/mp4")
+			http.ServeFileFS(w, r, tl.RepoFS(), previewPath)
+			return nil
+		}
+		inputPath, done, err := tl.DecryptedPath(dataFile)
+		if err != nil {
+			return err
+		}
+		defer done()
 		return s.transcodeVideo(r.Context(), w, inputPath, nil, obfuscate)
 
 	case "motion-photo":
@@ -216,7 +236,12 @@ func (s server) serveDataFile(w http.ResponseWriter, r *http.Request, tl openedT
 	if results.Items[0].DataType != nil {
 		_, obfuscate := s.app.ObfuscationMode(tl.Timeline)
 		if obfuscate && strings.HasPrefix(*results.Items[0].DataType, "video/") {
-			return s.transcodeVideo(r.Context(), w, tl.FullPath(dataFile), nil, obfuscate)
+			inputPath, done, err := tl.DecryptedPath(dataFile)
+			if err != nil {
+				return err
+			}
+			defer done()
+			return s.transcodeVideo(r.Context(), w, inputPath, nil, obfuscate)
 		}
 		w.Header().Set("Content-Type", *results.Items[0].DataType)
 	}
@@ -427,15 +452,18 @@ func (s server) motionPhoto(w http.ResponseWriter, r *http.Request, tl openedTim
 	// if we found/have a separate data file as the motion photo, make its full path now
 	var inputFile string
 	if videoDataFile != "" {
-		inputFile = tl.FullPath(videoDataFile)
+		fn, done, err := tl.DecryptedPath(videoDataFile)
+		if err != nil {
+			return err
+		}
+		defer done()
+		inputFile = fn
 	}
 
 	// no sidecar motion pic, see if it's embedded in the photo file
 	if videoDataFile == "" {
-		imgFilePath := tl.FullPath(imgDataFile)
-
 		// get the bytes of just the video from within the image file
-		videoBytes, err := media.ExtractVideoFromMotionPic(nil, imgFilePath)
+		videoBytes, err := media.ExtractVideoFromMotionPic(tl.RepoFS(), imgDataFile)
 		if err != nil || len(videoBytes) == 0 {
 			// no motion photo (or unable to get it), nothing to do
 			w.WriteHeader(http.StatusNotFound)
@@ -550,7 +578,7 @@ func (s server) downloadItem(w http.ResponseWriter, r *http.Request, tl openedTi
 		content = bytes.NewReader([]byte(*itemRow.DataText))
 
 	case itemRow.DataFile != nil:
-		f, err := os.Open(tl.FullPath(*itemRow.DataFile))
+		f, err := tl.OpenRepoFile(*itemRow.DataFile)
 		if err != nil {
 			return err
 		}
@@ -31,10 +31,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/timelinize/timelinize/timeline"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func (s *server) handleFileSelectorRoots(w http.ResponseWriter, _ *http.Request) error {
@@ -87,6 +89,75 @@ func (s *server) handleMergeEntities(w http.ResponseWriter, r *http.Request) err
 	return jsonResponse(w, nil, err)
 }
 
+type unmergeEntitiesPayload struct {
+	RepoID  string `json:"repo_id"`
+	MergeID uint64 `json:"merge_id"`
+}
+
+func (s *server) handleUnmergeEntities(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*unmergeEntitiesPayload)
+	restoredID, err := s.app.UnmergeEntities(r.Context(), payload.RepoID, payload.MergeID)
+	return jsonResponse(w, map[string]uint64{"entity_id": restoredID}, err)
+}
+
+type entityMergesPayload struct {
+	RepoID   string `json:"repo_id"`
+	EntityID uint64 `json:"entity_id"`
+}
+
+func (s *server) handleEntityMerges(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*entityMergesPayload)
+	merges, err := s.app.EntityMerges(r.Context(), payload.RepoID, payload.EntityID)
+	return jsonResponse(w, merges, err)
+}
+
+func (s *server) handleSuggestedMerges(w http.ResponseWriter, r *http.Request) error {
+	repoID := r.Context().Value(ctxKeyPayload).(*string)
+	suggestions, err := s.app.SuggestedMerges(r.Context(), *repoID)
+	return jsonResponse(w, suggestions, err)
+}
+
+type dismissMergeSuggestionPayload struct {
+	RepoID        string `json:"repo_id"`
+	EntityID      uint64 `json:"entity_id"`
+	OtherEntityID uint64 `json:"other_entity_id"`
+}
+
+func (s *server) handleDismissMergeSuggestion(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*dismissMergeSuggestionPayload)
+	err := s.app.DismissSuggestedMerge(r.Context(), payload.RepoID, payload.EntityID, payload.OtherEntityID)
+	return jsonResponse(w, nil, err)
+}
+
+type mergeItemsPayload struct {
+	RepoID       string   `json:"repo_id"`
+	KeepItemID   uint64   `json:"keep_item_id"`
+	MergeItemIDs []uint64 `json:"merge_item_ids"`
+}
+
+func (s *server) handleMergeItems(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*mergeItemsPayload)
+	err := s.app.MergeItems(r.Context(), payload.RepoID, payload.KeepItemID, payload.MergeItemIDs)
+	return jsonResponse(w, nil, err)
+}
+
+func (s *server) handleFindDuplicates(w http.ResponseWriter, r *http.Request) error {
+	params := r.Context().Value(ctxKeyPayload).(*timeline.DuplicateSearchParams)
+	clusters, err := s.app.FindDuplicates(r.Context(), *params)
+	return jsonResponse(w, clusters, err)
+}
+
+type itemSourcesPayload struct {
+	RepoID string `json:"repo_id"`
+	ItemID uint64 `json:"item_id"`
+}
+
+func (s *server) handleItemSources(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*itemSourcesPayload)
+	sources, err := s.app.ItemSources(r.Context(), payload.RepoID, payload.ItemID)
+	return jsonResponse(w, sources, err)
+}
+
 func (s *server) handleCharts(w http.ResponseWriter, r *http.Request) error {
 	chartName, repoID := r.FormValue("name"), r.FormValue("repo_id")
 	q := r.URL.Query()
@@ -115,7 +186,7 @@ func (s *server) handleCancelJobs(w http.ResponseWriter, r *http.Request) error
 	for _, jobID := range payload.JobIDs {
 		err := s.app.CancelJob(r.Context(), payload.RepoID, jobID)
 		if err != nil {
-			s.log.Error("canceling job failed",
+			ReqLogger(r).Error("canceling job failed",
 				zap.Uint64("job_id", jobID),
 				zap.Error(err))
 			if firstErr == nil {
@@ -144,6 +215,12 @@ func (s *server) handleUnpauseJob(w http.ResponseWriter, r *http.Request) error
 	return jsonResponse(w, nil, err)
 }
 
+func (s *server) handleResumeJob(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*jobPayload)
+	err := s.app.ResumeJob(r.Context(), payload.RepoID, payload.JobID)
+	return jsonResponse(w, nil, err)
+}
+
 func (s *server) handleStartJob(w http.ResponseWriter, r *http.Request) error {
 	payload := r.Context().Value(ctxKeyPayload).(*jobPayload)
 	err := s.app.StartJob(r.Context(), payload.RepoID, payload.JobID, payload.StartOver)
@@ -205,6 +282,63 @@ func (s *server) handleFileStat(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (server) handleLogs(w http.ResponseWriter, r *http.Request) error {
+	// optionally, only stream the logs for one or more jobs
+	var jobIDs []uint64
+	for _, jobIDStr := range r.URL.Query()["job_id"] {
+		jobID, err := strconv.ParseUint(jobIDStr, 10, 64)
+		if err != nil || jobID == 0 {
+			return Error{
+				Err:        fmt.Errorf("invalid job ID '%s': %w", jobIDStr, err),
+				HTTPStatus: http.StatusBadRequest,
+				Log:        "parsing job ID",
+				Message:    "The job ID must be a positive integer.",
+			}
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+
+	// a reconnecting client can resume after the last entry it saw
+	var since uint64
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		var err error
+		since, err = strconv.ParseUint(sinceStr, 10, 64)
+		if err != nil {
+			return Error{
+				Err:        fmt.Errorf("invalid sequence number '%s': %w", sinceStr, err),
+				HTTPStatus: http.StatusBadRequest,
+				Log:        "parsing sequence number",
+				Message:    "The sequence number must be a non-negative integer.",
+			}
+		}
+	}
+
+	// a client that only shows, for example, warnings and errors
+	// doesn't need to be sent anything less severe
+	var minLevel zapcore.LevelEnabler
+	if levelStr := r.URL.Query().Get("level"); levelStr != "" {
+		level, err := zapcore.ParseLevel(levelStr)
+		if err != nil {
+			return Error{
+				Err:        err,
+				HTTPStatus: http.StatusBadRequest,
+				Log:        "parsing log level",
+				Message:    "The level must be a log level, such as 'info' or 'warn'.",
+			}
+		}
+		minLevel = level
+	}
+
+	// only pools that the app has set up can be subscribed to
+	poolName := r.URL.Query().Get("pool")
+	if poolName != "" && timeline.LookupPool(poolName) == nil {
+		return Error{
+			Err:        fmt.Errorf("unknown log pool '%s'", poolName),
+			HTTPStatus: http.StatusNotFound,
+			Log:        "looking up log pool",
+			Message:    "There is no log stream with that name.",
+		}
+	}
+
 	conn, err := wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return Error{
@@ -217,8 +351,32 @@ func (server) handleLogs(w http.ResponseWriter, r *http.Request) error {
 	defer conn.Close()
 
 	// while the client is connected, broadcast the logs to it
-	timeline.AddLogConn(conn)
-	defer timeline.RemoveLogConn(conn)
+	// (optionally only those for jobs or an item, from certain loggers, at
+	// or above a level, or those of a pool set up for a particular purpose)
+	opts := timeline.FollowOptions{
+		AfterSeq: since,
+		Loggers:  r.URL.Query()["logger"],
+		JobIDs:   jobIDs,
+		ItemRef:  r.URL.Query().Get("item"),
+		MinLevel: minLevel,
+	}
+	removeConn := timeline.RemoveLogConn
+	if poolName != "" {
+		pool := timeline.LookupPool(poolName)
+		removeConn = pool.RemoveConn
+		err = pool.AddConnFollow(conn, opts)
+	} else {
+		err = timeline.AddLogConnFollow(conn, opts)
+	}
+	if err != nil {
+		// the connection has already been hijacked and closed,
+		// so there is no point in returning an HTTP error
+		ReqLogger(r).Warn("rejected log subscriber",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.Error(err))
+		return nil
+	}
+	defer removeConn(conn)
 
 	// simply keep the connection open until the client closes it
 	for {
@@ -231,10 +389,48 @@ func (server) handleLogs(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+func (server) handleLogsQuery(w http.ResponseWriter, r *http.Request) error {
+	query := *r.Context().Value(ctxKeyPayload).(*timeline.LogQuery)
+	entries, err := timeline.QueryLogs(r.Context(), query)
+	if errors.Is(err, timeline.ErrNoLogFile) {
+		return Error{
+			Err:        err,
+			HTTPStatus: http.StatusNotFound,
+			Log:        "querying logs",
+			Message:    "The log store is not enabled. Set log_file in the config to enable it.",
+		}
+	}
+	return jsonResponse(w, entries, err)
+}
+
+func (server) handleLogsSSE(w http.ResponseWriter, r *http.Request) error {
+	timeline.LogSSEHandler(w, r)
+	return nil
+}
+
 func (s *server) handleRepos(w http.ResponseWriter, _ *http.Request) error {
 	return jsonResponse(w, s.app.getOpenRepositories(), nil)
 }
 
+func (s *server) handleLockedRepos(w http.ResponseWriter, _ *http.Request) error {
+	return jsonResponse(w, s.app.getLockedRepositories(), nil)
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, _ *http.Request) error {
+	return jsonResponse(w, timeline.MetricsSnapshot(), nil)
+}
+
+type encryptRepoPayload struct {
+	RepoID     string `json:"repo_id"`
+	Passphrase string `json:"passphrase"`
+}
+
+func (s *server) handleEncryptRepo(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*encryptRepoPayload)
+	err := s.app.EncryptRepository(payload.RepoID, payload.Passphrase)
+	return jsonResponse(w, nil, err)
+}
+
 func (s *server) handleBuildInfo(w http.ResponseWriter, _ *http.Request) error {
 	return jsonResponse(w, s.app.BuildInfo(), nil)
 }
@@ -245,15 +441,16 @@ func (s *server) handleGetDataSources(w http.ResponseWriter, r *http.Request) er
 }
 
 type openRepoPayload struct {
-	RepoPath string `json:"repo_path"`
-	Create   bool   `json:"create"`
+	RepoPath   string `json:"repo_path"`
+	Create     bool   `json:"create"`
+	Passphrase string `json:"passphrase,omitempty"` // for encrypted timelines
 }
 
 func (s *server) handleOpenRepo(w http.ResponseWriter, r *http.Request) error {
 	payload := r.Context().Value(ctxKeyPayload).(*openRepoPayload)
 
 	// TODO: maybe have the app methods return structured errors
-	openedTL, err := s.app.openRepository(r.Context(), payload.RepoPath, payload.Create)
+	openedTL, err := s.app.openRepository(r.Context(), payload.RepoPath, payload.Create, payload.Passphrase)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			return Error{
@@ -264,6 +461,24 @@ func (s *server) handleOpenRepo(w http.ResponseWriter, r *http.Request) error {
 				Data:       err,
 			}
 		}
+		if errors.Is(err, timeline.ErrLocked) {
+			return Error{
+				Err:        err,
+				HTTPStatus: http.StatusLocked,
+				Log:        "timeline is locked",
+				Message:    "This timeline is encrypted. Enter its passphrase to unlock it.",
+				Data:       map[string]any{"locked": true, "repo_path": payload.RepoPath},
+			}
+		}
+		if errors.Is(err, timeline.ErrIncorrectPassphrase) {
+			return Error{
+				Err:        err,
+				HTTPStatus: http.StatusForbidden,
+				Log:        "incorrect passphrase for timeline",
+				Message:    "Incorrect passphrase.",
+				Data:       map[string]any{"locked": true, "repo_path": payload.RepoPath},
+			}
+		}
 		return Error{
 			Err:        err,
 			HTTPStatus: http.StatusBadRequest,
@@ -293,6 +508,110 @@ func (s *server) handleImport(w http.ResponseWriter, r *http.Request) error {
 	return jsonResponse(w, map[string]any{"job_id": jobID}, err)
 }
 
+func (s *server) handleImportPreview(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*jobPayload)
+	report, err := s.app.ImportPreview(r.Context(), payload.RepoID, payload.JobID)
+	return jsonResponse(w, report, err)
+}
+
+type graphNeighborsPayload struct {
+	RepoID string `json:"repo_id"`
+	timeline.NodeRef
+	Depth int `json:"depth,omitempty"`
+	timeline.GraphQuery
+}
+
+func (s *server) handleGraphNeighbors(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*graphNeighborsPayload)
+	results, err := s.app.GraphNeighbors(r.Context(), payload.RepoID, payload.NodeRef, payload.Depth, payload.GraphQuery)
+	return jsonResponse(w, results, err)
+}
+
+type graphPathPayload struct {
+	RepoID       string `json:"repo_id"`
+	FromEntityID uint64 `json:"from_entity_id"`
+	ToEntityID   uint64 `json:"to_entity_id"`
+	MaxDepth     int    `json:"max_depth,omitempty"`
+	timeline.GraphQuery
+}
+
+func (s *server) handleGraphPath(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*graphPathPayload)
+	results, err := s.app.GraphPath(r.Context(), payload.RepoID, payload.FromEntityID, payload.ToEntityID, payload.MaxDepth, payload.GraphQuery)
+	return jsonResponse(w, results, err)
+}
+
+type graphCoOccurrencesPayload struct {
+	RepoID   string `json:"repo_id"`
+	EntityID uint64 `json:"entity_id"`
+	timeline.GraphQuery
+}
+
+func (s *server) handleGraphCoOccurrences(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*graphCoOccurrencesPayload)
+	results, err := s.app.GraphCoOccurrences(r.Context(), payload.RepoID, payload.EntityID, payload.GraphQuery)
+	return jsonResponse(w, results, err)
+}
+
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) error {
+	params := *r.Context().Value(ctxKeyPayload).(*ExportParameters)
+	jobID, err := s.app.Export(params)
+	return jsonResponse(w, map[string]any{"job_id": jobID}, err)
+}
+
+func (s *server) handleSync(w http.ResponseWriter, r *http.Request) error {
+	params := *r.Context().Value(ctxKeyPayload).(*SyncParameters)
+	jobID, err := s.app.Sync(r.Context(), params)
+	return jsonResponse(w, map[string]any{"job_id": jobID}, err)
+}
+
+func (s *server) handleSyncPeers(w http.ResponseWriter, r *http.Request) error {
+	repoID := r.Context().Value(ctxKeyPayload).(*string)
+	peers, err := s.app.SyncPeers(r.Context(), *repoID)
+	return jsonResponse(w, peers, err)
+}
+
+func (s *server) handleShareGrants(w http.ResponseWriter, r *http.Request) error {
+	repoID := r.Context().Value(ctxKeyPayload).(*string)
+	grants, err := s.app.ShareGrants(r.Context(), *repoID)
+	return jsonResponse(w, grants, err)
+}
+
+type createShareGrantPayload struct {
+	RepoID  string              `json:"repo_id"`
+	Name    string              `json:"name,omitempty"`
+	Scope   timeline.ShareScope `json:"scope"`
+	Expires *time.Time          `json:"expires,omitempty"`
+}
+
+func (s *server) handleCreateShareGrant(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*createShareGrantPayload)
+	grant, token, err := s.app.CreateShareGrant(r.Context(), payload.RepoID, payload.Name, payload.Scope, payload.Expires)
+	return jsonResponse(w, map[string]any{"grant": grant, "token": token}, err)
+}
+
+type revokeShareGrantPayload struct {
+	RepoID  string `json:"repo_id"`
+	GrantID uint64 `json:"grant_id"`
+}
+
+func (s *server) handleRevokeShareGrant(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*revokeShareGrantPayload)
+	err := s.app.RevokeShareGrant(r.Context(), payload.RepoID, payload.GrantID)
+	return jsonResponse(w, nil, err)
+}
+
+type syncTokenPayload struct {
+	RepoID string `json:"repo_id"`
+	Token  string `json:"token"`
+}
+
+func (s *server) handleSyncToken(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*syncTokenPayload)
+	err := s.app.SetSyncToken(r.Context(), payload.RepoID, payload.Token)
+	return jsonResponse(w, nil, err)
+}
+
 func (s *server) handleNextGraph(w http.ResponseWriter, r *http.Request) error {
 	repoID, jobIDStr := r.FormValue("repo_id"), r.FormValue("job_id")
 	jobID, err := strconv.ParseUint(jobIDStr, 10, 64)
@@ -322,6 +641,53 @@ func (s *server) handleSearchItems(w http.ResponseWriter, r *http.Request) error
 	return jsonResponse(w, results, err)
 }
 
+type searchPayload struct {
+	timeline.QuerySearchParams
+
+	// if true, return the plan of the query instead of its results
+	Explain bool `json:"explain,omitempty"`
+}
+
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) error {
+	params := r.Context().Value(ctxKeyPayload).(*searchPayload)
+	if params.Explain {
+		plan, err := s.app.PlanQuery(r.Context(), params.Repo, params.Query)
+		return jsonResponse(w, plan, err)
+	}
+	results, err := s.app.Search(r.Context(), params.QuerySearchParams)
+	return jsonResponse(w, results, err)
+}
+
+func (s *server) handleSearchText(w http.ResponseWriter, r *http.Request) error {
+	params := r.Context().Value(ctxKeyPayload).(*timeline.TextSearchParams)
+	results, err := s.app.SearchText(r.Context(), *params)
+	return jsonResponse(w, results, err)
+}
+
+func (s *server) handleGeoBoundingBox(w http.ResponseWriter, r *http.Request) error {
+	params := r.Context().Value(ctxKeyPayload).(*timeline.GeoQuery)
+	results, err := s.app.ItemsInBoundingBox(r.Context(), *params)
+	return jsonResponse(w, results, err)
+}
+
+func (s *server) handleGeoNearby(w http.ResponseWriter, r *http.Request) error {
+	params := r.Context().Value(ctxKeyPayload).(*timeline.GeoQuery)
+	results, err := s.app.ItemsNearPoint(r.Context(), *params)
+	return jsonResponse(w, results, err)
+}
+
+func (s *server) handleGeoClusters(w http.ResponseWriter, r *http.Request) error {
+	params := r.Context().Value(ctxKeyPayload).(*timeline.GeoQuery)
+	results, err := s.app.ClusterPoints(r.Context(), *params)
+	return jsonResponse(w, results, err)
+}
+
+func (s *server) handleGeoPaths(w http.ResponseWriter, r *http.Request) error {
+	params := r.Context().Value(ctxKeyPayload).(*timeline.GeoQuery)
+	results, err := s.app.SimplifiedPaths(r.Context(), *params)
+	return jsonResponse(w, results, err)
+}
+
 func (s *server) handleSearchEntities(w http.ResponseWriter, r *http.Request) error {
 	params := r.Context().Value(ctxKeyPayload).(*timeline.EntitySearchParams)
 	results, err := s.app.SearchEntities(*params)
@@ -352,6 +718,156 @@ func (s *server) handleDeleteItems(w http.ResponseWriter, r *http.Request) error
 	return jsonResponse(w, nil, err)
 }
 
+func (s *server) handlePolicies(w http.ResponseWriter, r *http.Request) error {
+	repoID := r.Context().Value(ctxKeyPayload).(*string)
+	policies, err := s.app.Policies(r.Context(), *repoID)
+	return jsonResponse(w, policies, err)
+}
+
+type policyPayload struct {
+	RepoID string          `json:"repo_id"`
+	Policy timeline.Policy `json:"policy"`
+}
+
+func (s *server) handleAddPolicy(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*policyPayload)
+	policyID, err := s.app.AddPolicy(r.Context(), payload.RepoID, payload.Policy)
+	return jsonResponse(w, map[string]any{"policy_id": policyID}, err)
+}
+
+func (s *server) handlePolicyDryRun(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*policyPayload)
+	report, err := s.app.PolicyDryRun(r.Context(), payload.RepoID, payload.Policy)
+	return jsonResponse(w, report, err)
+}
+
+type deletePolicyPayload struct {
+	RepoID   string `json:"repo_id"`
+	PolicyID uint64 `json:"policy_id"`
+}
+
+func (s *server) handleDeletePolicy(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*deletePolicyPayload)
+	err := s.app.DeletePolicy(r.Context(), payload.RepoID, payload.PolicyID)
+	return jsonResponse(w, nil, err)
+}
+
+type enforcePoliciesPayload struct {
+	RepoID    string                 `json:"repo_id"`
+	PolicyIDs []uint64               `json:"policy_ids,omitempty"` // all policies if empty
+	Schedule  *timeline.ScheduleSpec `json:"schedule,omitempty"`
+}
+
+func (s *server) handleEnforcePolicies(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*enforcePoliciesPayload)
+	id, err := s.app.EnforcePolicies(r.Context(), payload.RepoID, payload.PolicyIDs, payload.Schedule)
+	if payload.Schedule != nil {
+		return jsonResponse(w, map[string]any{"schedule_id": id}, err)
+	}
+	return jsonResponse(w, map[string]any{"job_id": id}, err)
+}
+
+type backupTargetPayload struct {
+	RepoID string                `json:"repo_id"`
+	Target timeline.BackupTarget `json:"target"`
+}
+
+func (s *server) handleAddBackupTarget(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*backupTargetPayload)
+	targetID, err := s.app.AddBackupTarget(r.Context(), payload.RepoID, payload.Target)
+	return jsonResponse(w, map[string]any{"target_id": targetID}, err)
+}
+
+func (s *server) handleBackupTargets(w http.ResponseWriter, r *http.Request) error {
+	repoID := r.Context().Value(ctxKeyPayload).(*string)
+	targets, err := s.app.BackupTargets(r.Context(), *repoID)
+	return jsonResponse(w, targets, err)
+}
+
+type backupSnapshotsPayload struct {
+	RepoID   string `json:"repo_id"`
+	TargetID uint64 `json:"target_id,omitempty"`
+}
+
+func (s *server) handleDeleteBackupTarget(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*backupSnapshotsPayload)
+	err := s.app.DeleteBackupTarget(r.Context(), payload.RepoID, payload.TargetID)
+	return jsonResponse(w, nil, err)
+}
+
+func (s *server) handleBackupSnapshots(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*backupSnapshotsPayload)
+	snapshots, err := s.app.BackupSnapshots(r.Context(), payload.RepoID, payload.TargetID)
+	return jsonResponse(w, snapshots, err)
+}
+
+type backupPayload struct {
+	RepoID   string                 `json:"repo_id"`
+	TargetID uint64                 `json:"target_id"`
+	Schedule *timeline.ScheduleSpec `json:"schedule,omitempty"`
+}
+
+func (s *server) handleBackup(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*backupPayload)
+	id, err := s.app.Backup(r.Context(), payload.RepoID, payload.TargetID, payload.Schedule)
+	if payload.Schedule != nil {
+		return jsonResponse(w, map[string]any{"schedule_id": id}, err)
+	}
+	return jsonResponse(w, map[string]any{"job_id": id}, err)
+}
+
+type restorePayload struct {
+	RepoID     string `json:"repo_id"`
+	SnapshotID string `json:"snapshot_id"`
+}
+
+func (s *server) handleRestore(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*restorePayload)
+	jobID, err := s.app.Restore(r.Context(), payload.RepoID, payload.SnapshotID)
+	return jsonResponse(w, map[string]any{"job_id": jobID}, err)
+}
+
+type enrichPayload struct {
+	RepoID  string                    `json:"repo_id"`
+	ItemIDs []uint64                  `json:"item_ids,omitempty"` // all images if empty
+	Tasks   []timeline.EnrichmentTask `json:"tasks,omitempty"`    // all tasks if empty
+}
+
+func (s *server) handleEnrich(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*enrichPayload)
+	jobID, err := s.app.Enrich(payload.RepoID, payload.ItemIDs, payload.Tasks)
+	return jsonResponse(w, map[string]any{"job_id": jobID}, err)
+}
+
+type itemEnrichmentPayload struct {
+	RepoID string `json:"repo_id"`
+	ItemID uint64 `json:"item_id"`
+}
+
+func (s *server) handleItemEnrichment(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*itemEnrichmentPayload)
+	enrichment, err := s.app.ItemEnrichment(r.Context(), payload.RepoID, payload.ItemID)
+	return jsonResponse(w, enrichment, err)
+}
+
+func (s *server) handleFaceClusters(w http.ResponseWriter, r *http.Request) error {
+	repoID := r.Context().Value(ctxKeyPayload).(*string)
+	clusters, err := s.app.FaceClusters(r.Context(), *repoID)
+	return jsonResponse(w, clusters, err)
+}
+
+type linkFaceClusterPayload struct {
+	RepoID    string `json:"repo_id"`
+	ClusterID uint64 `json:"cluster_id"`
+	EntityID  uint64 `json:"entity_id"`
+}
+
+func (s *server) handleLinkFaceCluster(w http.ResponseWriter, r *http.Request) error {
+	payload := r.Context().Value(ctxKeyPayload).(*linkFaceClusterPayload)
+	err := s.app.LinkFaceCluster(r.Context(), payload.RepoID, payload.ClusterID, payload.EntityID)
+	return jsonResponse(w, nil, err)
+}
+
 // func (app) handleAutocompletePerson(w http.ResponseWriter, r *http.Request) error {
 // 	var payload struct {
 // 		Repo   string `json:"repo"`
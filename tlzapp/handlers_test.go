@@ -0,0 +1,132 @@
+/*
+	Timelinize
+	Copyright (c) 2013 Matthew Holt
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlzapp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/timelinize/timelinize/timeline"
+	"go.uber.org/zap"
+)
+
+// streamedLogEntry is the part of an entry streamed by handleLogs that
+// the tests look at.
+type streamedLogEntry struct {
+	Logger string `json:"logger"`
+	Msg    string `json:"msg"`
+	ID     uint64 `json:"id"`
+	Seq    uint64 `json:"seq"`
+}
+
+// followLogs connects to the logs endpoint of srv with the given query
+// string and returns the entries it sends until it goes quiet.
+func followLogs(t *testing.T, srv *httptest.Server, query string) []streamedLogEntry {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?" + query
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("connecting with %q: %v", query, err)
+	}
+	defer resp.Body.Close()
+	defer conn.Close()
+
+	var entries []streamedLogEntry
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return entries
+		}
+		var entry streamedLogEntry
+		if err := json.Unmarshal(msg, &entry); err != nil {
+			continue // not an entry, such as a gap marker
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func newLogsTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := (server{}).handleLogs(w, r); err != nil {
+			t.Errorf("handling logs request: %v", err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func messages(entries []streamedLogEntry) []string {
+	msgs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		msgs = append(msgs, entry.Msg)
+	}
+	return msgs
+}
+
+func TestHandleLogsCombinedFilters(t *testing.T) {
+	const jobID, otherJobID = 9050201, 9050202
+	timeline.Log.Named("job.status").Info("status 1", zap.Uint64("id", jobID))
+	timeline.Log.Named("job.action").Info("action 1", zap.Uint64("id", jobID))
+	timeline.Log.Named("job.status").Info("other job", zap.Uint64("id", otherJobID))
+	timeline.Log.Named("job.status").Debug("debug", zap.Uint64("id", jobID))
+	timeline.Log.Named("job.status").Warn("status 2", zap.Uint64("id", jobID))
+
+	srv := newLogsTestServer(t)
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{query: "job_id=9050201&logger=job.status", want: []string{"status 1", "debug", "status 2"}},
+		{query: "job_id=9050201&level=warn", want: []string{"status 2"}},
+		{query: "job_id=9050201&job_id=9050202&logger=job.status&level=info", want: []string{"status 1", "other job", "status 2"}},
+	} {
+		if got := messages(followLogs(t, srv, tc.query)); !slices.Equal(got, tc.want) {
+			t.Errorf("with %q: expected %v, got %v", tc.query, tc.want, got)
+		}
+	}
+
+}
+
+func TestHandleLogsResumeJob(t *testing.T) {
+	const jobID, otherJobID = 1490001, 1490002
+	timeline.Log.Named("job.status").Info("before drop", zap.Uint64("id", jobID))
+	srv := newLogsTestServer(t)
+	first := followLogs(t, srv, "job_id=1490001")
+	if got, want := messages(first), []string{"before drop"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	timeline.Log.Named("job.status").Info("other job", zap.Uint64("id", otherJobID))
+	timeline.Log.Named("job.action").Info("after drop", zap.Uint64("id", jobID))
+
+	// reconnecting after the last entry seen only sends this job's newer entries
+	query := "job_id=1490001&since=" + strconv.FormatUint(first[len(first)-1].Seq, 10)
+	if got, want := messages(followLogs(t, srv, query)), []string{"after drop"}; !slices.Equal(got, want) {
+		t.Errorf("with %q: expected %v, got %v", query, want, got)
+	}
+}
@@ -26,6 +26,7 @@ import os
 import requests
 import sqlite_vec
 import sqlite3
+import threading
 import torch
 from argparse import ArgumentParser
 
@@ -44,6 +45,24 @@ text_model = Siglip2TextModel.from_pretrained(MODEL).to(DEVICE)
 vision_model = Siglip2VisionModel.from_pretrained(MODEL).to(DEVICE)
 image_classifier = pipeline(task="zero-shot-image-classification", model=MODEL, device=DEVICE)
 
+# The models for enrichment are loaded when first needed, since not everyone enables it.
+enrichment_models = {}
+enrichment_models_lock = threading.Lock()
+
+def enrichment_model(name):
+	with enrichment_models_lock:
+		if name not in enrichment_models:
+			if name == "ocr":
+				import easyocr
+				enrichment_models[name] = easyocr.Reader(['en'], gpu=DEVICE.type == 'cuda')
+			elif name == "face_detector":
+				from facenet_pytorch import MTCNN
+				enrichment_models[name] = MTCNN(keep_all=True, device=DEVICE)
+			elif name == "face_embedder":
+				from facenet_pytorch import InceptionResnetV1
+				enrichment_models[name] = InceptionResnetV1(pretrained='vggface2').eval().to(DEVICE)
+		return enrichment_models[name]
+
 app = Flask(__name__)
 
 @app.route("/health-check")
@@ -116,6 +135,55 @@ def classify():
 
 	return results
 
+def request_image():
+	"""Returns the image in the request body, or in the file named by the filename query parameter."""
+	filename = request.args.get('filename')
+	if filename:
+		return Image.open(filename).convert("RGB")
+	return Image.open(io.BytesIO(request.data)).convert("RGB")
+
+@app.route("/tags", methods=["QUERY"])
+def tags():
+	labels = request.args.getlist('labels')
+	if not labels:
+		return "At least one label is required", 400
+
+	output = image_classifier(request_image(), candidate_labels=labels)
+
+	return json.dumps([{"label": ls['label'], "score": ls['score']} for ls in output])
+
+@app.route("/ocr", methods=["QUERY"])
+def ocr():
+	image = np.array(request_image())
+
+	# paragraph mode joins words into lines, and lines into blocks, in reading order
+	blocks = enrichment_model("ocr").readtext(image, detail=0, paragraph=True)
+
+	return json.dumps({"text": "\n".join(blocks)})
+
+@app.route("/faces", methods=["QUERY"])
+def faces():
+	image = request_image()
+	width, height = image.size
+
+	boxes, probs = enrichment_model("face_detector").detect(image)
+	if boxes is None:
+		return "[]"
+	crops = enrichment_model("face_detector").extract(image, boxes, save_path=None)
+	with torch.no_grad():
+		embeddings = enrichment_model("face_embedder")(crops.to(DEVICE)).cpu().numpy()
+
+	results = []
+	for box, prob, embedding in zip(boxes, probs, embeddings):
+		left, top, right, bottom = box.tolist()
+		results.append({
+			"box": [max(left/width, 0), max(top/height, 0), min(right/width, 1), min(bottom/height, 1)],
+			"score": float(prob),
+			"embedding": embedding.astype(np.float32).tolist(),
+		})
+
+	return json.dumps(results)
+
 if __name__ == "__main__":
 	# notify parent process the model has loaded and the server is becoming available
 	if args.pingback:
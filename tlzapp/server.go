@@ -20,6 +20,7 @@
 package tlzapp
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"net"
@@ -27,6 +28,8 @@ import (
 	"time"
 
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/google/uuid"
+	"github.com/timelinize/timelinize/timeline"
 	"go.uber.org/zap"
 )
 
@@ -78,6 +81,9 @@ type server struct {
 	adminLn    net.Listener // plaintext, no authentication (loopback-only by default)
 	httpServer *http.Server
 
+	syncServer  *http.Server // for remote timelines to sync with, if enabled (authenticated by token)
+	shareServer *http.Server // for others to read what was shared with them, if enabled (authenticated by token)
+
 	// enforce CORS and prevent DNS rebinding for the unauthenticated admin listener
 	allowedHosts   []string
 	allowedOrigins []string
@@ -85,21 +91,26 @@ type server struct {
 	mux         *http.ServeMux
 	staticFiles http.Handler
 	frontend    fs.FS // the file system that static assets are served from
+	apiOnly     bool  // if true, the web UI is not served
 }
 
 func (s server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// don't do any actual handling yet; just set up the request middleware stuff, logging, etc...
 	start := time.Now()
 
+	r = withRequestLogger(r, s.log)
+	log := ReqLogger(r)
+
 	rec := caddyhttp.NewResponseRecorder(w, nil, nil) // TODO: what other places do we pull in Caddy? Maybe we can strip this down and inline it or something...
 
 	w.Header().Set("Server", "Timelinize")
+	w.Header().Set("X-Request-ID", requestID(r))
 
 	var err error
 	defer func() {
-		logFn := s.log.Info
+		logFn := log.Info
 		if err != nil || rec.Status() >= lowestErrorStatus {
-			logFn = s.log.Error
+			logFn = log.Error
 		}
 
 		// the log message is intentionally specific to bust log sampling here
@@ -136,6 +147,41 @@ func (s server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(rec, r)
 }
 
+// withRequestLogger returns a copy of r whose context carries a new
+// request ID and a logger derived from logger that has the request ID
+// and user agent, so that everything logged while handling the request
+// can be correlated. Use ReqLogger to get the logger.
+func withRequestLogger(r *http.Request, logger *zap.Logger) *http.Request {
+	id := uuid.New().String()
+	ctx := context.WithValue(r.Context(), ctxKeyRequestID, id)
+	ctx = context.WithValue(ctx, ctxKeyRequestLogger, logger.With(
+		zap.String("request_id", id),
+		zap.String("user_agent", r.UserAgent()),
+	))
+	return r.WithContext(ctx)
+}
+
+// ReqLogger returns the logger for the request, which includes the
+// request ID and user agent in its entries. If the request did not
+// pass through the server's middleware, the HTTP logger is returned.
+func ReqLogger(r *http.Request) *zap.Logger {
+	if logger, ok := r.Context().Value(ctxKeyRequestLogger).(*zap.Logger); ok {
+		return logger
+	}
+	return timeline.Log.Named("http")
+}
+
+// requestID returns the ID of the request, or an empty string if it doesn't have one.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(ctxKeyRequestID).(string)
+	return id
+}
+
+var (
+	ctxKeyRequestID     ctxKey = "request_id"
+	ctxKeyRequestLogger ctxKey = "request_logger"
+)
+
 func (s *server) fillAllowedHosts(listenAddr string) {
 	loopbacks := []string{
 		"localhost",
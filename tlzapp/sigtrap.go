@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/signal"
 	"sync/atomic"
+	"time"
 
 	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/timelinize/timelinize/timeline"
@@ -71,7 +72,9 @@ func shutdown(exitCode int) {
 	}
 	appMu.Unlock()
 
-	_ = timeline.Log.Sync()
+	// give the UI a chance to receive the last logs, and
+	// let it know that the stream is ending
+	_, _ = timeline.CloseLog(shutdownLogDrainTimeout)
 
 	os.Exit(exitCode)
 }
@@ -79,3 +82,7 @@ func shutdown(exitCode int) {
 // shuttingDown is an atomic value which will be set
 // to 1 when the program is shutting down.
 var shuttingDown = new(int32)
+
+// shutdownLogDrainTimeout is how long to wait for logs to be
+// delivered to subscribers when shutting down.
+const shutdownLogDrainTimeout = time.Second
@@ -98,5 +98,6 @@ type openedTimeline struct {
 
 var (
 	openTimelines   = make(map[string]openedTimeline) // keyed by serialization of instance UUID
-	openTimelinesMu sync.RWMutex
+	lockedTimelines = make(map[string]struct{})       // repo dirs of encrypted timelines waiting for a passphrase
+	openTimelinesMu sync.RWMutex                      // protects both maps
 )